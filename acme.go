@@ -0,0 +1,123 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeEtcdCache stores ACME certificates and account keys in etcd, so they
+// can be shared between multiple signaling servers.
+type acmeEtcdCache struct {
+	client *EtcdClient
+	prefix string
+}
+
+func newAcmeEtcdCache(client *EtcdClient, prefix string) *acmeEtcdCache {
+	if prefix[len(prefix)-1] != '/' {
+		prefix += "/"
+	}
+	return &acmeEtcdCache{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (c *acmeEtcdCache) Get(ctx context.Context, key string) ([]byte, error) {
+	response, err := c.client.Get(ctx, c.prefix+key)
+	if err != nil {
+		return nil, err
+	} else if len(response.Kvs) == 0 {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return response.Kvs[0].Value, nil
+}
+
+func (c *acmeEtcdCache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := c.client.Put(ctx, c.prefix+key, string(data))
+	return err
+}
+
+func (c *acmeEtcdCache) Delete(ctx context.Context, key string) error {
+	_, err := c.client.Delete(ctx, c.prefix+key)
+	return err
+}
+
+// NewAcmeManager creates a manager that obtains and renews certificates for
+// the hostnames configured in the "acme" section. Returns nil if no hostnames
+// are configured. Certificates are stored in etcd through the given client if
+// an "etcdprefix" is configured.
+func NewAcmeManager(config *goconf.ConfigFile, etcdClient *EtcdClient) (*autocert.Manager, error) {
+	hostnamesValue, _ := config.GetString("acme", "hostnames")
+	var hostnames []string
+	for _, hostname := range strings.Split(hostnamesValue, ",") {
+		hostname = strings.TrimSpace(hostname)
+		if hostname != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	if len(hostnames) == 0 {
+		return nil, nil
+	}
+
+	var cache autocert.Cache
+	if prefix, _ := config.GetString("acme", "etcdprefix"); prefix != "" {
+		if etcdClient == nil {
+			return nil, ErrNoEtcdEndpoints
+		}
+
+		log.Printf("Storing ACME certificates in etcd at %s", prefix)
+		cache = newAcmeEtcdCache(etcdClient, prefix)
+	} else if dir, _ := config.GetString("acme", "cachedir"); dir != "" {
+		log.Printf("Storing ACME certificates in %s", dir)
+		cache = autocert.DirCache(dir)
+	} else {
+		return nil, fmt.Errorf("need either a cache directory or an etcd prefix to store ACME certificates")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hostnames...),
+		Cache:      cache,
+	}
+	manager.Email, _ = config.GetString("acme", "email")
+	if directory, _ := config.GetString("acme", "directory"); directory != "" {
+		manager.Client = &acme.Client{
+			DirectoryURL: directory,
+		}
+	}
+	if days, _ := config.GetInt("acme", "renewbefore"); days > 0 {
+		manager.RenewBefore = time.Duration(days) * 24 * time.Hour
+	}
+
+	log.Printf("Using ACME certificates for %s", strings.Join(hostnames, ", "))
+	return manager, nil
+}
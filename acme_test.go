@@ -0,0 +1,108 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dlintw/goconf"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestAcmeManagerConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if manager, err := NewAcmeManager(config, nil); err != nil {
+		t.Fatal(err)
+	} else if manager != nil {
+		t.Errorf("expected no manager without hostnames, got %+v", manager)
+	}
+
+	config.AddOption("acme", "hostnames", "signaling.example.com, other.example.com")
+	if manager, err := NewAcmeManager(config, nil); err == nil {
+		t.Errorf("expected error without cache, got %+v", manager)
+	}
+
+	config.AddOption("acme", "cachedir", t.TempDir())
+	config.AddOption("acme", "renewbefore", "10")
+	manager, err := NewAcmeManager(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if manager == nil {
+		t.Fatal("expected manager")
+	}
+
+	ctx := context.Background()
+	for _, host := range []string{"signaling.example.com", "other.example.com"} {
+		if err := manager.HostPolicy(ctx, host); err != nil {
+			t.Errorf("expected %s to be allowed: %s", host, err)
+		}
+	}
+	if err := manager.HostPolicy(ctx, "unknown.example.com"); err == nil {
+		t.Error("expected unknown host to be rejected")
+	}
+	if _, ok := manager.Cache.(autocert.DirCache); !ok {
+		t.Errorf("expected directory cache, got %+v", manager.Cache)
+	}
+}
+
+func TestAcmeEtcdCache(t *testing.T) {
+	etcd := NewEtcdForTest(t)
+
+	client := NewEtcdClientForTest(t, etcd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	cache := newAcmeEtcdCache(client, "/acme")
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("expected cache miss, got %v", err)
+	}
+
+	if err := cache.Put(ctx, "example.com", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.Get(ctx, "example.com"); err != nil {
+		t.Error(err)
+	} else if string(data) != "certificate" {
+		t.Errorf("expected certificate, got %q", string(data))
+	}
+
+	if err := cache.Delete(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("expected cache miss after delete, got %v", err)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("acme", "hostnames", "signaling.example.com")
+	config.AddOption("acme", "etcdprefix", "/acme")
+	if manager, err := NewAcmeManager(config, nil); err != ErrNoEtcdEndpoints {
+		t.Errorf("expected error %s without etcd client, got %+v / %s", ErrNoEtcdEndpoints, manager, err)
+	}
+	if manager, err := NewAcmeManager(config, client); err != nil {
+		t.Fatal(err)
+	} else if cache, ok := manager.Cache.(*acmeEtcdCache); !ok || cache.client != client {
+		t.Errorf("expected etcd cache using the client, got %+v", manager.Cache)
+	}
+}
@@ -25,18 +25,33 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	BackendVersion = "1.0"
 
-	HeaderBackendSignalingRandom   = "Spreed-Signaling-Random"
-	HeaderBackendSignalingChecksum = "Spreed-Signaling-Checksum"
-	HeaderBackendServer            = "Spreed-Signaling-Backend"
+	HeaderBackendSignalingRandom     = "Spreed-Signaling-Random"
+	HeaderBackendSignalingChecksum   = "Spreed-Signaling-Checksum"
+	HeaderBackendSignalingTimestamp  = "Spreed-Signaling-Timestamp"
+	HeaderBackendSignalingChecksumV2 = "Spreed-Signaling-Checksum-V2"
+	HeaderBackendServer              = "Spreed-Signaling-Backend"
+
+	// Maximum difference between the timestamp of a request using the "v2"
+	// checksum and the local time.
+	BackendChecksumV2MaxAge = 5 * time.Minute
+
+	minBackendChecksumV2RandomLength = 32
 )
 
 func newRandomString(length int) string {
@@ -47,30 +62,144 @@ func newRandomString(length int) string {
 	return hex.EncodeToString(b)
 }
 
-func CalculateBackendChecksum(random string, body []byte, secret []byte) string {
-	mac := hmac.New(sha256.New, secret)
+// backendChecksumKey caches HMAC instances for a secret, initializing a HMAC
+// is expensive as the key pads have to be computed. Backends keep one key per
+// configured secret so the instances are released together with the backend.
+//
+//easyjson:skip
+type backendChecksumKey struct {
+	secret []byte
+	pool   sync.Pool
+}
+
+func newBackendChecksumKey(secret []byte) *backendChecksumKey {
+	key := make([]byte, len(secret))
+	copy(key, secret)
+	return &backendChecksumKey{
+		secret: key,
+	}
+}
+
+// calculate appends the raw checksum to the given slice.
+func (k *backendChecksumKey) calculate(random string, body []byte, result []byte) []byte {
+	var mac hash.Hash
+	if m := k.pool.Get(); m != nil {
+		mac = m.(hash.Hash)
+		mac.Reset()
+	} else {
+		mac = hmac.New(sha256.New, k.secret)
+	}
 	mac.Write([]byte(random)) // nolint
 	mac.Write(body)           // nolint
-	return hex.EncodeToString(mac.Sum(nil))
+	result = mac.Sum(result)
+	k.pool.Put(mac)
+	return result
+}
+
+func (k *backendChecksumKey) checksum(random string, body []byte) string {
+	var buf [sha256.Size]byte
+	return hex.EncodeToString(k.calculate(random, body, buf[:0]))
+}
+
+func CalculateBackendChecksum(random string, body []byte, secret []byte) string {
+	return newBackendChecksumKey(secret).checksum(random, body)
 }
 
 func AddBackendChecksum(r *http.Request, body []byte, secret []byte) {
+	newBackendChecksumKey(secret).add(r, body)
+}
+
+func (k *backendChecksumKey) add(r *http.Request, body []byte) {
 	// Add checksum so the backend can validate the request.
 	rnd := newRandomString(64)
-	checksum := CalculateBackendChecksum(rnd, body, secret)
+	checksum := k.checksum(rnd, body)
 	r.Header.Set(HeaderBackendSignalingRandom, rnd)
 	r.Header.Set(HeaderBackendSignalingChecksum, checksum)
 }
 
+func getHeaderValue(header http.Header, key string) string {
+	// The keys are canonical already, so the lookup can be done directly.
+	if values := header[key]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
 func ValidateBackendChecksum(r *http.Request, body []byte, secret []byte) bool {
-	rnd := r.Header.Get(HeaderBackendSignalingRandom)
-	checksum := r.Header.Get(HeaderBackendSignalingChecksum)
-	return ValidateBackendChecksumValue(checksum, rnd, body, secret)
+	return newBackendChecksumKey(secret).validate(r, body)
+}
+
+func (k *backendChecksumKey) validate(r *http.Request, body []byte) bool {
+	rnd := getHeaderValue(r.Header, HeaderBackendSignalingRandom)
+	checksum := getHeaderValue(r.Header, HeaderBackendSignalingChecksum)
+	return k.validateValue(checksum, rnd, body)
+}
+
+// AddBackendChecksumV2 adds the "v2" checksum to the request which also
+// includes a timestamp, so the receiver can reject replayed requests.
+func AddBackendChecksumV2(r *http.Request, body []byte, secret []byte) {
+	newBackendChecksumKey(secret).addV2(r, body)
+}
+
+func (k *backendChecksumKey) addV2(r *http.Request, body []byte) {
+	rnd := newRandomString(64)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	checksum := k.checksum(timestamp+":"+rnd+":", body)
+	r.Header.Set(HeaderBackendSignalingRandom, rnd)
+	r.Header.Set(HeaderBackendSignalingTimestamp, timestamp)
+	r.Header.Set(HeaderBackendSignalingChecksumV2, checksum)
+}
+
+// IsBackendChecksumV2 returns true if the request contains a "v2" checksum.
+func IsBackendChecksumV2(r *http.Request) bool {
+	return getHeaderValue(r.Header, HeaderBackendSignalingChecksumV2) != ""
+}
+
+// ValidateBackendChecksumV2 validates the "v2" checksum and timestamp of the
+// request. The caller must make sure the random value is not reused while
+// the timestamp is valid.
+func ValidateBackendChecksumV2(r *http.Request, body []byte, secret []byte, now time.Time) bool {
+	return newBackendChecksumKey(secret).validateV2(r, body, now)
+}
+
+func (k *backendChecksumKey) validateV2(r *http.Request, body []byte, now time.Time) bool {
+	rnd := getHeaderValue(r.Header, HeaderBackendSignalingRandom)
+	if len(rnd) < minBackendChecksumV2RandomLength {
+		return false
+	}
+
+	timestamp := getHeaderValue(r.Header, HeaderBackendSignalingTimestamp)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if diff := now.Sub(time.Unix(ts, 0)); diff > BackendChecksumV2MaxAge || diff < -BackendChecksumV2MaxAge {
+		return false
+	}
+
+	checksum := getHeaderValue(r.Header, HeaderBackendSignalingChecksumV2)
+	return k.validateValue(checksum, timestamp+":"+rnd+":", body)
 }
 
 func ValidateBackendChecksumValue(checksum string, random string, body []byte, secret []byte) bool {
-	verify := CalculateBackendChecksum(random, body, secret)
-	return subtle.ConstantTimeCompare([]byte(verify), []byte(checksum)) == 1
+	return newBackendChecksumKey(secret).validateValue(checksum, random, body)
+}
+
+func (k *backendChecksumKey) validateValue(checksum string, random string, body []byte) bool {
+	if len(checksum) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+
+	var expected [sha256.Size]byte
+	if _, err := hex.Decode(expected[:], []byte(checksum)); err != nil {
+		return false
+	}
+
+	var buf [sha256.Size]byte
+	verify := k.calculate(random, body, buf[:0])
+	return hmac.Equal(verify, expected[:])
 }
 
 // Requests from Nextcloud to the signaling server.
@@ -94,6 +223,8 @@ type BackendServerRoomRequest struct {
 
 	Message *BackendRoomMessageRequest `json:"message,omitempty"`
 
+	Recording *BackendRoomRecordingRequest `json:"recording,omitempty"`
+
 	// Internal properties
 	ReceivedTime int64 `json:"received,omitempty"`
 }
@@ -141,6 +272,11 @@ type BackendRoomMessageRequest struct {
 	Data *json.RawMessage `json:"data,omitempty"`
 }
 
+type BackendRoomRecordingRequest struct {
+	// Either "start" or "stop".
+	Type string `json:"type"`
+}
+
 // Requests from the signaling server to the Nextcloud backend.
 
 type BackendClientAuthRequest struct {
@@ -158,6 +294,8 @@ type BackendClientRequest struct {
 	Ping *BackendClientPingRequest `json:"ping,omitempty"`
 
 	Session *BackendClientSessionRequest `json:"session,omitempty"`
+
+	Moderation *BackendClientModerationRequest `json:"moderation,omitempty"`
 }
 
 func NewBackendClientAuthRequest(params *json.RawMessage) *BackendClientRequest {
@@ -182,6 +320,8 @@ type BackendClientResponse struct {
 	Ping *BackendClientRingResponse `json:"ping,omitempty"`
 
 	Session *BackendClientSessionResponse `json:"session,omitempty"`
+
+	Moderation *BackendClientModerationResponse `json:"moderation,omitempty"`
 }
 
 type BackendClientAuthResponse struct {
@@ -235,10 +375,13 @@ type RoomSessionData struct {
 type BackendPingEntry struct {
 	UserId    string `json:"userid,omitempty"`
 	SessionId string `json:"sessionid"`
+	// Only set for batched requests containing sessions of multiple rooms.
+	RoomId string `json:"roomid,omitempty"`
 }
 
 type BackendClientPingRequest struct {
-	Version string             `json:"version"`
+	Version string `json:"version"`
+	// Empty for batched requests, the room is set in the entries instead.
 	RoomId  string             `json:"roomid"`
 	Entries []BackendPingEntry `json:"entries"`
 }
@@ -254,6 +397,19 @@ func NewBackendClientPingRequest(roomid string, entries []BackendPingEntry) *Bac
 	}
 }
 
+// NewBackendClientBatchPingRequest creates a ping request for sessions of
+// multiple rooms, must only be sent to backends supporting the feature
+// "signaling-batch-ping".
+func NewBackendClientBatchPingRequest(entries []BackendPingEntry) *BackendClientRequest {
+	return &BackendClientRequest{
+		Type: "ping",
+		Ping: &BackendClientPingRequest{
+			Version: BackendVersion,
+			Entries: entries,
+		},
+	}
+}
+
 type BackendClientRingResponse struct {
 	Version string `json:"version"`
 	RoomId  string `json:"roomid"`
@@ -290,12 +446,77 @@ func NewBackendClientSessionRequest(roomid string, action string, sessionid stri
 	return request
 }
 
+// BackendClientModerationRequest informs the backend about a moderator action
+// that was already executed by the signaling server.
+type BackendClientModerationRequest struct {
+	Version string `json:"version"`
+	RoomId  string `json:"roomid"`
+	Action  string `json:"action"`
+
+	// Room session ids of the moderator and the affected session.
+	ActorSessionId string `json:"actorsessionid"`
+	SessionId      string `json:"sessionid"`
+
+	// Used for action "mute".
+	Media string `json:"media,omitempty"`
+}
+
+type BackendClientModerationResponse struct {
+	Version string `json:"version"`
+	RoomId  string `json:"roomid"`
+}
+
+func NewBackendClientModerationRequest(roomid string, action string, actorSessionId string, sessionId string) *BackendClientRequest {
+	return &BackendClientRequest{
+		Type: "moderation",
+		Moderation: &BackendClientModerationRequest{
+			Version:        BackendVersion,
+			RoomId:         roomid,
+			Action:         action,
+			ActorSessionId: actorSessionId,
+			SessionId:      sessionId,
+		},
+	}
+}
+
 type OcsMeta struct {
 	Status     string `json:"status"`
 	StatusCode int    `json:"statuscode"`
 	Message    string `json:"message"`
 }
 
+// IsOk returns true if the OCS response was successful. Responses without
+// status are also treated as successful.
+func (m *OcsMeta) IsOk() bool {
+	return m.Status == "" || strings.EqualFold(m.Status, "ok")
+}
+
+// NewError returns an error for a failed OCS response that can be sent to
+// clients. The error code is based on the OCS status code.
+func (m *OcsMeta) NewError() *Error {
+	var code string
+	switch {
+	case m.StatusCode == 997 || m.StatusCode == http.StatusUnauthorized || m.StatusCode == http.StatusForbidden:
+		code = "backend_unauthorized"
+	case m.StatusCode == 998 || m.StatusCode == http.StatusNotFound:
+		code = "backend_not_found"
+	case m.StatusCode == 996 || m.StatusCode == 999 || m.StatusCode >= http.StatusInternalServerError:
+		code = "backend_server_error"
+	default:
+		code = "backend_failure"
+	}
+
+	message := m.Message
+	if message == "" {
+		message = fmt.Sprintf("Backend request failed with status %d", m.StatusCode)
+	}
+	return NewErrorDetail(code, message, &OcsMeta{
+		Status:     m.Status,
+		StatusCode: m.StatusCode,
+		Message:    m.Message,
+	})
+}
+
 type OcsBody struct {
 	Meta OcsMeta          `json:"meta"`
 	Data *json.RawMessage `json:"data"`
@@ -311,4 +532,302 @@ type TurnCredentials struct {
 	Password string   `json:"password"`
 	TTL      int64    `json:"ttl"`
 	URIs     []string `json:"uris"`
+
+	// Credentials of all TURN servers if multiple groups are configured.
+	Servers []TurnCredentials `json:"servers,omitempty"`
+}
+
+// BackendInformationEtcd is the information about a backend that is stored
+// in etcd if the backends are configured through etcd.
+type BackendInformationEtcd struct {
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+
+	// Additional secret that is accepted while the secret is rotated.
+	SecondarySecret string `json:"secondarysecret,omitempty"`
+
+	SessionLimit uint64 `json:"sessionlimit,omitempty"`
+
+	MaxStreamBitrate int `json:"maxstreambitrate,omitempty"`
+	MaxScreenBitrate int `json:"maxscreenbitrate,omitempty"`
+
+	PingInterval     int `json:"pinginterval,omitempty"`
+	IdlePingInterval int `json:"idlepinginterval,omitempty"`
+
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	Connections     int `json:"connections,omitempty"`
+	IdleConnections int `json:"idleconnections,omitempty"`
+
+	parsedUrl *url.URL
+	pattern   *regexp.Regexp
+}
+
+func (p *BackendInformationEtcd) CheckValid() error {
+	if p.Url == "" {
+		return fmt.Errorf("url missing")
+	}
+	if p.Secret == "" {
+		return fmt.Errorf("secret missing")
+	}
+
+	if p.Url[len(p.Url)-1] != '/' {
+		p.Url += "/"
+	}
+	parsed, err := url.Parse(p.Url)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %s", parsed.Scheme)
+	}
+
+	if strings.Contains(parsed.Host, ":") && hasStandardPort(parsed) {
+		parsed.Host = parsed.Hostname()
+		p.Url = parsed.String()
+	}
+
+	if isWildcardBackendUrl(parsed) {
+		if p.pattern, err = compileWildcardBackendUrl(parsed); err != nil {
+			return err
+		}
+	}
+
+	p.parsedUrl = parsed
+	return nil
+}
+
+// BackendAdminInformation is returned by the admin API for a backend. The
+// secret of the backend is never included.
+type BackendAdminInformation struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+
+	SessionLimit uint64 `json:"sessionlimit,omitempty"`
+
+	MaxStreamBitrate int `json:"maxstreambitrate,omitempty"`
+	MaxScreenBitrate int `json:"maxscreenbitrate,omitempty"`
+
+	PingInterval     int `json:"pinginterval,omitempty"`
+	IdlePingInterval int `json:"idlepinginterval,omitempty"`
+
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	Connections     int `json:"connections,omitempty"`
+	IdleConnections int `json:"idleconnections,omitempty"`
+
+	// HasSecondarySecret is set while the secret of the backend is rotated.
+	HasSecondarySecret bool `json:"hassecondarysecret,omitempty"`
+
+	// ReadOnly is set for backends that are defined in the configuration
+	// file and can't be changed through the admin API.
+	ReadOnly bool `json:"readonly"`
+}
+
+type BackendAdminListResponse struct {
+	Backends []*BackendAdminInformation `json:"backends"`
+}
+
+type BackendAdminCreateRequest struct {
+	Id string `json:"id"`
+
+	BackendInformationEtcd
+}
+
+// ConfigAdminValue is returned by the admin API for a configuration option,
+// secrets are redacted.
+type ConfigAdminValue struct {
+	Section string `json:"section"`
+	Option  string `json:"option"`
+	Value   string `json:"value"`
+	Source  string `json:"source"`
+}
+
+type ConfigAdminBackend struct {
+	Id     string `json:"id"`
+	Url    string `json:"url"`
+	Source string `json:"source"`
+}
+
+type ConfigAdminResponse struct {
+	Values   []*ConfigAdminValue   `json:"values"`
+	Backends []*ConfigAdminBackend `json:"backends"`
+}
+
+// SessionAdminInformation is returned by the admin API for a session.
+type SessionAdminInformation struct {
+	SessionId  string `json:"sessionid"`
+	Backend    string `json:"backend"`
+	ClientType string `json:"clienttype"`
+
+	UserId        string `json:"userid,omitempty"`
+	RoomId        string `json:"roomid,omitempty"`
+	RoomSessionId string `json:"roomsessionid,omitempty"`
+
+	// Connected is false for client sessions waiting to be resumed.
+	Connected bool `json:"connected"`
+
+	// Muted is only set for client sessions.
+	Muted *SessionMuteState `json:"muted,omitempty"`
+	// Quality is only set for client sessions that reported recently.
+	Quality *ClientQualityStats `json:"quality,omitempty"`
+}
+
+type SessionAdminListResponse struct {
+	Sessions []*SessionAdminInformation `json:"sessions"`
+}
+
+// SessionAdminEventsResponse is returned by the admin API with the events
+// recorded for a session.
+type SessionAdminEventsResponse struct {
+	SessionId string `json:"sessionid"`
+
+	// Active is false if the session has been closed already.
+	Active bool `json:"active"`
+
+	Events []SessionEvent `json:"events"`
+}
+
+// SessionAdminMcuClient contains the statistics of a publisher or subscriber
+// of a session as returned by the admin API.
+type SessionAdminMcuClient struct {
+	Id         string `json:"id"`
+	StreamType string `json:"streamtype"`
+	// Publisher is only set for subscribers.
+	Publisher string `json:"publisher,omitempty"`
+
+	Stats *McuClientStats `json:"stats,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// SessionAdminMcuResponse is returned by the admin API with the statistics of
+// the publishers and subscribers of a session.
+type SessionAdminMcuResponse struct {
+	SessionId string `json:"sessionid"`
+
+	Publishers  []*SessionAdminMcuClient `json:"publishers"`
+	Subscribers []*SessionAdminMcuClient `json:"subscribers"`
+}
+
+// ThrottleAdminPolicy is the policy of an action of the brute-force
+// protection as returned by the admin API.
+type ThrottleAdminPolicy struct {
+	MaxAttempts int `json:"maxattempts"`
+	// Window in seconds in which failed attempts are counted.
+	Window int `json:"window"`
+	// Delay in milliseconds after the first failed attempt.
+	Delay int `json:"delay"`
+	// MaxDelay in milliseconds after failed attempts.
+	MaxDelay int `json:"maxdelay"`
+}
+
+type ThrottleAdminClient struct {
+	Client      string    `json:"client"`
+	Action      string    `json:"action"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"lastattempt"`
+	// Blocked is true if further attempts are rejected.
+	Blocked bool `json:"blocked"`
+}
+
+type ThrottleAdminResponse struct {
+	Type     string                          `json:"type"`
+	Exempt   []string                        `json:"exempt,omitempty"`
+	Policies map[string]*ThrottleAdminPolicy `json:"policies,omitempty"`
+	Clients  []*ThrottleAdminClient          `json:"clients,omitempty"`
+}
+
+// WelcomeServerMessage is returned by "/api/v1/welcome" so clients and other
+// servers can discover the capabilities of the server.
+type WelcomeServerMessage struct {
+	// Always "Welcome", kept for compatibility with older clients.
+	Welcome string `json:"nextcloud-spreed-signaling"`
+	Version string `json:"version"`
+
+	// Versions of the "hello" request that are supported.
+	HelloVersions []string `json:"helloversions"`
+	// Maximum supported version of the "hello" request.
+	MaxHelloVersion string `json:"maxhelloversion"`
+
+	Features []string `json:"features"`
+
+	// Either "standalone" or "nats" if multiple servers are clustered.
+	Clustering string `json:"clustering"`
+}
+
+// RoomStatsPublisher is a publisher of a session in a room.
+type RoomStatsPublisher struct {
+	StreamType string `json:"streamtype"`
+	// Url of the MCU proxy the publisher is hosted on (if proxies are used).
+	Proxy string `json:"proxy,omitempty"`
+}
+
+type RoomStatsSession struct {
+	SessionId  string `json:"sessionid"`
+	ClientType string `json:"clienttype"`
+	UserId     string `json:"userid,omitempty"`
+
+	InCall     bool                  `json:"incall"`
+	Publishers []*RoomStatsPublisher `json:"publishers,omitempty"`
+
+	// Last connection quality reported by the client (if any).
+	Quality *ClientQualityStats `json:"quality,omitempty"`
+}
+
+// RoomQualityStats contains the aggregated connection quality reported by the
+// clients in a room.
+type RoomQualityStats struct {
+	// Number of sessions that reported recently.
+	Reports int `json:"reports"`
+
+	// Average and maximum round trip time in milliseconds.
+	Rtt    float64 `json:"rtt"`
+	MaxRtt float64 `json:"maxrtt"`
+
+	// Average and maximum packet loss in percent.
+	PacketLoss    float64 `json:"packetloss"`
+	MaxPacketLoss float64 `json:"maxpacketloss"`
+}
+
+// RoomStats contains the statistics of a room on this server as returned by
+// "/api/v1/stats/rooms".
+type RoomStats struct {
+	RoomId  string `json:"roomid"`
+	Backend string `json:"backend"`
+	// Id of the parent room for breakout rooms.
+	Parent string `json:"parent,omitempty"`
+
+	Participants int `json:"participants"`
+	InCall       int `json:"incall"`
+	Publishers   int `json:"publishers"`
+	// Number of publishers per MCU proxy.
+	Proxies map[string]int `json:"proxies,omitempty"`
+	// Only set if clients reported their connection quality.
+	Quality *RoomQualityStats `json:"quality,omitempty"`
+
+	Sessions []*RoomStatsSession `json:"sessions"`
+}
+
+type RoomStatsResponse struct {
+	Rooms []*RoomStats `json:"rooms"`
+}
+
+// ClusterRoomStats contains the number of participants of a room on all
+// servers of a cluster.
+type ClusterRoomStats struct {
+	RoomId  string `json:"roomid"`
+	Backend string `json:"backend"`
+
+	Participants int `json:"participants"`
+	InCall       int `json:"incall"`
+	// Number of servers the participants are connected to.
+	Servers int `json:"servers"`
+}
+
+// ClusterStatsResponse is returned by "/api/v1/stats/cluster" and
+// "/admin/rooms".
+type ClusterStatsResponse struct {
+	// Number of servers that responded to the request.
+	Servers  int                 `json:"servers"`
+	Sessions int                 `json:"sessions"`
+	Rooms    []*ClusterRoomStats `json:"rooms"`
 }
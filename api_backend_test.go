@@ -23,7 +23,9 @@ package signaling
 
 import (
 	"net/http"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestBackendChecksum(t *testing.T) {
@@ -46,6 +48,12 @@ func TestBackendChecksum(t *testing.T) {
 	if ValidateBackendChecksumValue(check1[:len(check1)-1], rnd, body, secret) {
 		t.Errorf("Checksum %s should not be valid", check1[:len(check1)-1])
 	}
+	if invalid := "x" + check1[1:]; ValidateBackendChecksumValue(invalid, rnd, body, secret) {
+		t.Errorf("Checksum %s should not be valid", invalid)
+	}
+	if ValidateBackendChecksumValue(check1, rnd, body, []byte("other-secret")) {
+		t.Errorf("Checksum %s should not be valid for other secret", check1)
+	}
 
 	request := &http.Request{
 		Header: make(http.Header),
@@ -56,3 +64,78 @@ func TestBackendChecksum(t *testing.T) {
 		t.Errorf("Checksum %s could not be validated from request", check1)
 	}
 }
+
+func TestBackendChecksumV2(t *testing.T) {
+	body := []byte{1, 2, 3, 4, 5}
+	secret := []byte("shared-secret")
+
+	request := &http.Request{
+		Header: make(http.Header),
+	}
+	AddBackendChecksumV2(request, body, secret)
+	if !IsBackendChecksumV2(request) {
+		t.Fatal("Request should contain v2 checksum")
+	}
+
+	now := time.Now()
+	if !ValidateBackendChecksumV2(request, body, secret, now) {
+		t.Error("Checksum could not be validated")
+	}
+	if ValidateBackendChecksumV2(request, body, []byte("other-secret"), now) {
+		t.Error("Checksum should not be valid for other secret")
+	}
+	if ValidateBackendChecksumV2(request, []byte{1, 2, 3}, secret, now) {
+		t.Error("Checksum should not be valid for other body")
+	}
+	if ValidateBackendChecksumV2(request, body, secret, now.Add(BackendChecksumV2MaxAge+time.Minute)) {
+		t.Error("Checksum should not be valid after the maximum age")
+	}
+	if ValidateBackendChecksumV2(request, body, secret, now.Add(-BackendChecksumV2MaxAge-time.Minute)) {
+		t.Error("Checksum should not be valid for timestamps in the future")
+	}
+
+	// The timestamp is part of the checksum.
+	ts, _ := strconv.ParseInt(request.Header.Get(HeaderBackendSignalingTimestamp), 10, 64)
+	request.Header.Set(HeaderBackendSignalingTimestamp, strconv.FormatInt(ts+1, 10))
+	if ValidateBackendChecksumV2(request, body, secret, now) {
+		t.Error("Checksum should not be valid for modified timestamp")
+	}
+
+	// The old checksum is not set.
+	if ValidateBackendChecksum(request, body, secret) {
+		t.Error("Old checksum should not be valid")
+	}
+}
+
+func BenchmarkCalculateBackendChecksum(b *testing.B) {
+	rnd := newRandomString(64)
+	body := make([]byte, 1024)
+	key := newBackendChecksumKey([]byte("shared-secret"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key.checksum(rnd, body)
+	}
+}
+
+func BenchmarkValidateBackendChecksum(b *testing.B) {
+	rnd := newRandomString(64)
+	body := make([]byte, 1024)
+	key := newBackendChecksumKey([]byte("shared-secret"))
+	checksum := key.checksum(rnd, body)
+
+	request := &http.Request{
+		Header: make(http.Header),
+	}
+	request.Header.Set(HeaderBackendSignalingRandom, rnd)
+	request.Header.Set(HeaderBackendSignalingChecksum, checksum)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !key.validate(request, body) {
+			b.Fatal("checksum could not be validated")
+		}
+	}
+}
@@ -123,6 +123,17 @@ type TokenClaims struct {
 	jwt.StandardClaims
 }
 
+const (
+	// Clients supporting this feature keep their publishers and subscribers
+	// if the connection to the MCU is interrupted and renegotiate them once
+	// it has been re-established.
+	ProxyFeatureRenegotiate = "renegotiate"
+
+	// Clients supporting this feature are notified about publishers that were
+	// created on the proxy through WHIP, so they can subscribe to them.
+	ProxyFeatureRemotePublishers = "remote-publishers"
+)
+
 type HelloProxyClientMessage struct {
 	Version string `json:"version"`
 
@@ -178,6 +189,15 @@ type CommandProxyClientMessage struct {
 	ClientId    string    `json:"clientId,omitempty"`
 	Bitrate     int       `json:"bitrate,omitempty"`
 	MediaTypes  MediaType `json:"mediatypes,omitempty"`
+
+	// Only used for "create-remote-publisher".
+	Streams []PublisherStream `json:"streams,omitempty"`
+
+	// Only used for "publish-remote" and "unpublish-remote".
+	RemoteId string `json:"remoteId,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	RtcpPort int    `json:"rtcpPort,omitempty"`
 }
 
 func (m *CommandProxyClientMessage) CheckValid() error {
@@ -198,9 +218,38 @@ func (m *CommandProxyClientMessage) CheckValid() error {
 	case "delete-publisher":
 		fallthrough
 	case "delete-subscriber":
+		fallthrough
+	case "get-publisher-streams":
+		if m.ClientId == "" {
+			return fmt.Errorf("client id missing")
+		}
+	case "create-remote-publisher":
+		if m.PublisherId == "" {
+			return fmt.Errorf("publisher id missing")
+		}
+		if m.StreamType == "" {
+			return fmt.Errorf("stream type missing")
+		}
+		if len(m.Streams) == 0 {
+			return fmt.Errorf("streams missing")
+		}
+	case "publish-remote":
+		if m.Hostname == "" {
+			return fmt.Errorf("hostname missing")
+		}
+		if m.Port <= 0 {
+			return fmt.Errorf("port missing")
+		}
+		fallthrough
+	case "unpublish-remote":
 		if m.ClientId == "" {
 			return fmt.Errorf("client id missing")
 		}
+		if m.RemoteId == "" {
+			return fmt.Errorf("remote id missing")
+		}
+	case "list-clients":
+		// No additional check required.
 	}
 	return nil
 }
@@ -208,6 +257,31 @@ func (m *CommandProxyClientMessage) CheckValid() error {
 type CommandProxyServerMessage struct {
 	Id  string `json:"id,omitempty"`
 	Sid string `json:"sid,omitempty"`
+
+	// Used for "list-clients": the ids of the clients in the session.
+	Publishers  []string `json:"publishers,omitempty"`
+	Subscribers []string `json:"subscribers,omitempty"`
+
+	// Used for "get-publisher-streams".
+	Streams []PublisherStream `json:"streams,omitempty"`
+
+	// Used for "create-remote-publisher": address the media of the publisher
+	// must be sent to.
+	Hostname string `json:"hostname,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	RtcpPort int    `json:"rtcpPort,omitempty"`
+}
+
+// PublisherStream describes a stream of a publisher that is required to
+// receive it on another MCU.
+type PublisherStream struct {
+	Type   string `json:"type"`
+	Mindex int    `json:"mindex"`
+	Mid    string `json:"mid"`
+
+	Codec     string `json:"codec,omitempty"`
+	Disabled  bool   `json:"disabled,omitempty"`
+	Simulcast bool   `json:"simulcast,omitempty"`
 }
 
 // Type "payload"
@@ -255,15 +329,40 @@ type PayloadProxyServerMessage struct {
 type EventProxyServerMessage struct {
 	Type string `json:"type"`
 
-	ClientId string `json:"clientId,omitempty"`
-	Load     int64  `json:"load,omitempty"`
-	Sid      string `json:"sid,omitempty"`
+	ClientId  string                     `json:"clientId,omitempty"`
+	Load      int64                      `json:"load,omitempty"`
+	Sid       string                     `json:"sid,omitempty"`
+	Bandwidth *EventProxyServerBandwidth `json:"bandwidth,omitempty"`
+
+	// Only set for "remote-publisher-added" and "remote-publisher-removed".
+	PublisherId string `json:"publisherId,omitempty"`
+	StreamType  string `json:"streamType,omitempty"`
+
+	// Only set for "shutdown-scheduled": number of seconds after which the
+	// proxy will shutdown even if clients are still connected.
+	DrainTimeout int64 `json:"draintimeout,omitempty"`
+}
+
+type EventProxyServerBandwidth struct {
+	// Incoming bandwidth in bits per second (i.e. sent by publishers).
+	Incoming uint64 `json:"incoming"`
+	// Outgoing bandwidth in bits per second (i.e. received by subscribers).
+	Outgoing uint64 `json:"outgoing"`
+}
+
+func (b *EventProxyServerBandwidth) Total() uint64 {
+	return b.Incoming + b.Outgoing
 }
 
 // Information on a proxy in the etcd cluster.
 
 type ProxyInformationEtcd struct {
 	Address string `json:"address"`
+
+	// Optional deployment metadata, can be used to filter proxies.
+	Region        string `json:"region,omitempty"`
+	Version       string `json:"version,omitempty"`
+	CapacityClass string `json:"capacityclass,omitempty"`
 }
 
 func (p *ProxyInformationEtcd) CheckValid() error {
@@ -25,7 +25,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"path"
+	"regexp"
 	"strings"
+	"sync"
 )
 
 const (
@@ -55,6 +58,30 @@ type ClientMessage struct {
 	Internal *InternalClientMessage `json:"internal,omitempty"`
 
 	TransientData *TransientDataClientMessage `json:"transient,omitempty"`
+
+	Reaction *ReactionClientMessage `json:"reaction,omitempty"`
+
+	Breakout *BreakoutClientMessage `json:"breakout,omitempty"`
+
+	Typing *TypingClientMessage `json:"typing,omitempty"`
+
+	Participants *ParticipantsClientMessage `json:"participants,omitempty"`
+
+	RtpForward *RtpForwardClientMessage `json:"rtpforward,omitempty"`
+
+	Recording *RecordingClientMessage `json:"recording,omitempty"`
+
+	Transcription *TranscriptionClientMessage `json:"transcription,omitempty"`
+
+	RoomKey *RoomKeyClientMessage `json:"room-key,omitempty"`
+
+	Moderation *ModerationClientMessage `json:"moderation,omitempty"`
+
+	Session *SessionClientMessage `json:"session,omitempty"`
+
+	Report *ReportClientMessage `json:"report,omitempty"`
+
+	Call *CallClientMessage `json:"call,omitempty"`
 }
 
 func (m *ClientMessage) CheckValid() error {
@@ -99,6 +126,78 @@ func (m *ClientMessage) CheckValid() error {
 		} else if err := m.TransientData.CheckValid(); err != nil {
 			return err
 		}
+	case "reaction":
+		if m.Reaction == nil {
+			return fmt.Errorf("reaction missing")
+		} else if err := m.Reaction.CheckValid(); err != nil {
+			return err
+		}
+	case "breakout":
+		if m.Breakout == nil {
+			return fmt.Errorf("breakout missing")
+		} else if err := m.Breakout.CheckValid(); err != nil {
+			return err
+		}
+	case "typing":
+		if m.Typing == nil {
+			return fmt.Errorf("typing missing")
+		} else if err := m.Typing.CheckValid(); err != nil {
+			return err
+		}
+	case "participants":
+		if m.Participants == nil {
+			return fmt.Errorf("participants missing")
+		} else if err := m.Participants.CheckValid(); err != nil {
+			return err
+		}
+	case "rtpforward":
+		if m.RtpForward == nil {
+			return fmt.Errorf("rtpforward missing")
+		} else if err := m.RtpForward.CheckValid(); err != nil {
+			return err
+		}
+	case "recording":
+		if m.Recording == nil {
+			return fmt.Errorf("recording missing")
+		} else if err := m.Recording.CheckValid(); err != nil {
+			return err
+		}
+	case "transcription":
+		if m.Transcription == nil {
+			return fmt.Errorf("transcription missing")
+		} else if err := m.Transcription.CheckValid(); err != nil {
+			return err
+		}
+	case "room-key":
+		if m.RoomKey == nil {
+			return fmt.Errorf("room-key missing")
+		} else if err := m.RoomKey.CheckValid(); err != nil {
+			return err
+		}
+	case "moderation":
+		if m.Moderation == nil {
+			return fmt.Errorf("moderation missing")
+		} else if err := m.Moderation.CheckValid(); err != nil {
+			return err
+		}
+	case "session":
+		if m.Session == nil {
+			return fmt.Errorf("session missing")
+		} else if err := m.Session.CheckValid(); err != nil {
+			return err
+		}
+	case "report":
+		if m.Report == nil {
+			return fmt.Errorf("report missing")
+		} else if err := m.Report.CheckValid(); err != nil {
+			return err
+		}
+	case "call":
+		if m.Call == nil {
+			return fmt.Errorf("call missing")
+		} else if err := m.Call.CheckValid(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -133,6 +232,9 @@ type ServerMessage struct {
 
 	Type string `json:"type"`
 
+	// Set if the message was received from an additional room.
+	RoomId string `json:"roomid,omitempty"`
+
 	Error *Error `json:"error,omitempty"`
 
 	Hello *HelloServerMessage `json:"hello,omitempty"`
@@ -148,6 +250,116 @@ type ServerMessage struct {
 	Event *EventServerMessage `json:"event,omitempty"`
 
 	TransientData *TransientDataServerMessage `json:"transient,omitempty"`
+
+	Reaction *ReactionServerMessage `json:"reaction,omitempty"`
+
+	Breakout *BreakoutServerMessage `json:"breakout,omitempty"`
+
+	Typing *TypingServerMessage `json:"typing,omitempty"`
+
+	Participants *ParticipantsServerMessage `json:"participants,omitempty"`
+
+	RtpForward *RtpForwardServerMessage `json:"rtpforward,omitempty"`
+
+	Recording *RecordingServerMessage `json:"recording,omitempty"`
+
+	Transcription *TranscriptionServerMessage `json:"transcription,omitempty"`
+
+	Caption *CaptionServerMessage `json:"caption,omitempty"`
+
+	RoomKey *RoomKeyServerMessage `json:"room-key,omitempty"`
+
+	Moderation *ModerationServerMessage `json:"moderation,omitempty"`
+
+	Session *SessionServerMessage `json:"session,omitempty"`
+
+	Call *CallServerMessage `json:"call,omitempty"`
+
+	// Serialized message if it is sent unmodified to multiple sessions.
+	prepared *preparedMessage
+}
+
+//easyjson:skip
+type preparedParticipantsUpdate struct {
+	once    sync.Once
+	message *ServerMessage
+}
+
+//easyjson:skip
+type preparedMessage struct {
+	once sync.Once
+	data []byte
+
+	// Participants updates for sessions without and with support for
+	// participant pages, only created once for all sessions.
+	participants [2]preparedParticipantsUpdate
+}
+
+// Prepare enables caching of the serialized message, so it's only serialized
+// once if it is sent to multiple sessions. The message may not be modified
+// afterwards, use "Copy" to get a modifiable message.
+func (r *ServerMessage) Prepare() *ServerMessage {
+	if r.prepared == nil {
+		r.prepared = &preparedMessage{}
+	}
+	return r
+}
+
+// setPrepared sets the serialized message, e.g. if it was received through
+// NATS.
+func (r *ServerMessage) setPrepared(data []byte) {
+	prepared := &preparedMessage{
+		data: data,
+	}
+	prepared.once.Do(func() {})
+	r.prepared = prepared
+}
+
+// getPrepared returns the cached serialized message or nil if the message
+// was not prepared.
+func (r *ServerMessage) getPrepared() []byte {
+	prepared := r.prepared
+	if prepared == nil {
+		return nil
+	}
+
+	prepared.once.Do(func() {
+		if data, err := r.MarshalJSON(); err == nil {
+			prepared.data = data
+		}
+	})
+	return prepared.data
+}
+
+// getParticipantsUpdate returns the participants update that should be sent
+// to sessions with or without support for participant pages. The result is
+// shared by all sessions if the message was prepared.
+func (r *ServerMessage) getParticipantsUpdate(pages bool) *ServerMessage {
+	prepared := r.prepared
+	if prepared == nil {
+		return filterParticipantsUpdate(r, pages)
+	}
+
+	idx := 0
+	if pages {
+		idx = 1
+	}
+	update := &prepared.participants[idx]
+	update.once.Do(func() {
+		update.message = filterParticipantsUpdate(r, pages)
+		if update.message != nil && update.message != r {
+			update.message.Prepare()
+		}
+	})
+	return update.message
+}
+
+// Copy returns a shallow copy of the message that can be modified without
+// affecting other recipients of the message.
+func (r *ServerMessage) Copy() *ServerMessage {
+	result := *r
+	result.prepared = nil
+	return &result
 }
 
 func (r *ServerMessage) CloseAfterSend(session Session) bool {
@@ -197,6 +409,13 @@ func (r *ServerMessage) IsParticipantsUpdate() bool {
 	return true
 }
 
+// IsLowPriority returns true for messages that may be delayed by other messages
+// sent to the client, so a flood of participants updates doesn't delay the
+// negotiation of streams. The order of low-priority messages is kept.
+func (r *ServerMessage) IsLowPriority() bool {
+	return r.Type == "event" && r.Event != nil && r.Event.Target == "participants"
+}
+
 func (r *ServerMessage) String() string {
 	data, err := json.Marshal(r)
 	if err != nil {
@@ -227,6 +446,20 @@ func (e *Error) Error() string {
 	return e.Message
 }
 
+// TooManySubscriptionsDetails are sent with "too_many_subscriptions" errors.
+type TooManySubscriptionsDetails struct {
+	// Maximum number of video streams a session may subscribe.
+	MaxSubscriptions int `json:"maxsubscriptions"`
+	// Number of participants in the call the limit is based on.
+	Participants int `json:"participants"`
+}
+
+// BackendMaintenanceDetails are sent with "backend_maintenance" errors.
+type BackendMaintenanceDetails struct {
+	// Number of seconds after which the client should try again.
+	RetryAfter int `json:"retryafter"`
+}
+
 const (
 	HelloClientTypeClient   = "client"
 	HelloClientTypeInternal = "internal"
@@ -290,6 +523,10 @@ type HelloClientMessage struct {
 
 	Features []string `json:"features,omitempty"`
 
+	// Highest versions of the command sets of its features an internal client
+	// supports. Features without a version use version 1.
+	Versions map[string]int `json:"versions,omitempty"`
+
 	// The authentication credentials.
 	Auth HelloClientMessageAuth `json:"auth"`
 }
@@ -324,6 +561,11 @@ func (m *HelloClientMessage) CheckValid() error {
 			} else if err := m.Auth.internalParams.CheckValid(); err != nil {
 				return err
 			}
+			for feature, version := range m.Versions {
+				if version <= 0 {
+					return fmt.Errorf("invalid version %d for feature %s", version, feature)
+				}
+			}
 		default:
 			return fmt.Errorf("unsupported auth type")
 		}
@@ -339,16 +581,111 @@ const (
 	ServerFeatureAudioVideoPermissions = "audio-video-permissions"
 	ServerFeatureTransientData         = "transient-data"
 	ServerFeatureInCallAll             = "incall-all"
+	ServerFeatureReactions             = "reactions"
+	ServerFeatureBreakoutRooms         = "breakout-rooms"
+	ServerFeatureMultiRoom             = "multi-room"
+	ServerFeatureTyping                = "typing"
+	ServerFeatureRecordingConsent      = "recording-consent"
+	ServerFeatureTranscription         = "transcription"
+	ServerFeatureRoomKey               = "room-key"
+	ServerFeatureModeration            = "moderation"
+	ServerFeatureParticipantsPages     = "participants-pages"
+	ServerFeatureAudioBridge           = "audiobridge"
+	ServerFeatureRtpForward            = "rtp-forward"
+	ServerFeatureSimulcastLayers       = "simulcast-layers"
+	ServerFeatureRenegotiate           = "renegotiate"
+	ServerFeatureIceServers            = "ice-servers"
+	ServerFeatureLongPolling           = "long-polling"
+	ServerFeatureRoomHistory           = "room-history"
+	ServerFeatureSessionMetadata       = "session-metadata"
+	ServerFeatureActiveSpeaker         = "active-speaker"
+	ServerFeatureReportStats           = "report-stats"
+	ServerFeatureCallHold              = "call-hold"
+
+	// Features that are relevant for backends.
+	ServerFeatureChecksumV2 = "checksum-v2"
 
 	// Features for internal clients only.
 	ServerFeatureInternalVirtualSessions = "virtual-sessions"
+
+	// Features that can be requested by clients in the "hello" request.
+	ClientFeatureParticipantsPages = "participants-pages"
+	ClientFeatureIceServers        = "ice-servers"
+	ClientFeatureRoomHistory       = "room-history"
+
+	// Features that can be announced by internal clients in the "hello" request.
+	ClientFeatureInternalRecording     = "recording"
+	ClientFeatureInternalTranscription = "transcription"
 )
 
+// InternalFeatureVersions is the range of versions of the command set of an
+// internal client feature the server supports.
+type InternalFeatureVersions struct {
+	Min int
+	Max int
+}
+
+var (
+	// Command sets of features that can be announced by internal clients.
+	internalFeatureVersions = map[string]InternalFeatureVersions{
+		ClientFeatureInternalRecording:     {Min: 1, Max: 1},
+		ClientFeatureInternalTranscription: {Min: 1, Max: 1},
+	}
+)
+
+// negotiateInternalFeatures returns the versions of the command sets to use
+// for the features announced by an internal client, and the features that
+// can't be used because the versions are incompatible.
+func negotiateInternalFeatures(features []string, versions map[string]int) (map[string]int, []*InternalFeatureError) {
+	var negotiated map[string]int
+	var unsupported []*InternalFeatureError
+	for _, feature := range features {
+		supported, found := internalFeatureVersions[feature]
+		if !found {
+			continue
+		}
+
+		version, found := versions[feature]
+		if !found {
+			version = 1
+		}
+		if version < supported.Min {
+			unsupported = append(unsupported, &InternalFeatureError{
+				Feature:    feature,
+				Version:    version,
+				MinVersion: supported.Min,
+				MaxVersion: supported.Max,
+			})
+			continue
+		}
+
+		if version > supported.Max {
+			version = supported.Max
+		}
+		if negotiated == nil {
+			negotiated = make(map[string]int)
+		}
+		negotiated[feature] = version
+	}
+	return negotiated, unsupported
+}
+
 var (
 	DefaultFeatures = []string{
 		ServerFeatureAudioVideoPermissions,
 		ServerFeatureTransientData,
 		ServerFeatureInCallAll,
+		ServerFeatureReactions,
+		ServerFeatureBreakoutRooms,
+		ServerFeatureTyping,
+		ServerFeatureParticipantsPages,
+		ServerFeatureRecordingConsent,
+		ServerFeatureTranscription,
+		ServerFeatureRoomKey,
+		ServerFeatureModeration,
+		ServerFeatureSessionMetadata,
+		ServerFeatureReportStats,
+		ServerFeatureCallHold,
 	}
 	DefaultFeaturesInternal = []string{
 		ServerFeatureInternalVirtualSessions,
@@ -370,6 +707,32 @@ type HelloServerMessage struct {
 	ResumeId  string                    `json:"resumeid"`
 	UserId    string                    `json:"userid"`
 	Server    *HelloServerMessageServer `json:"server,omitempty"`
+
+	// Only sent to clients that support the "ice-servers" feature.
+	IceServers *TurnCredentials `json:"iceservers,omitempty"`
+
+	// Only sent to internal clients.
+	Internal *HelloServerMessageInternal `json:"internal,omitempty"`
+}
+
+type HelloServerMessageInternal struct {
+	// Versions of the command sets to use for the features of the client.
+	Versions map[string]int `json:"versions,omitempty"`
+	// Features of the client that are not supported by the server.
+	Unsupported []*InternalFeatureError `json:"unsupported,omitempty"`
+}
+
+type InternalFeatureError struct {
+	Feature string `json:"feature"`
+	// Version requested by the client.
+	Version int `json:"version"`
+	// Range of versions supported by the server.
+	MinVersion int `json:"minversion"`
+	MaxVersion int `json:"maxversion"`
+}
+
+func (e *InternalFeatureError) String() string {
+	return fmt.Sprintf("%s (version %d, supported %d-%d)", e.Feature, e.Version, e.MinVersion, e.MaxVersion)
 }
 
 // Type "bye"
@@ -391,16 +754,28 @@ type ByeServerMessage struct {
 type RoomClientMessage struct {
 	RoomId    string `json:"roomid"`
 	SessionId string `json:"sessionid,omitempty"`
+
+	// Join (or leave) the room in addition to the current room. Only
+	// supported if the server has the "multi-room" feature.
+	Additional bool `json:"additional,omitempty"`
+	Leave      bool `json:"leave,omitempty"`
 }
 
 func (m *RoomClientMessage) CheckValid() error {
-	// No additional validation required.
+	if m.Additional && m.RoomId == "" {
+		return fmt.Errorf("room id missing")
+	} else if m.Leave && !m.Additional {
+		return fmt.Errorf("leave is only supported for additional rooms")
+	}
 	return nil
 }
 
 type RoomServerMessage struct {
 	RoomId     string           `json:"roomid"`
 	Properties *json.RawMessage `json:"properties,omitempty"`
+
+	// AudioBridge is set if the audio of the room is mixed by the MCU.
+	AudioBridge bool `json:"audiobridge,omitempty"`
 }
 
 // Type "message"
@@ -475,6 +850,9 @@ type MessageServerMessage struct {
 	Recipient *MessageClientMessageRecipient `json:"recipient,omitempty"`
 
 	Data *json.RawMessage `json:"data"`
+
+	// Set for messages replayed from the room history when joining.
+	History bool `json:"history,omitempty"`
 }
 
 // Type "control"
@@ -492,6 +870,9 @@ type ControlServerMessage struct {
 	Recipient *MessageClientMessageRecipient `json:"recipient,omitempty"`
 
 	Data *json.RawMessage `json:"data"`
+
+	// Set for messages replayed from the room history when joining.
+	History bool `json:"history,omitempty"`
 }
 
 // Type "internal"
@@ -551,6 +932,163 @@ func (m *RemoveSessionInternalClientMessage) CheckValid() error {
 	return m.CommonSessionInternalClientMessage.CheckValid()
 }
 
+type AddSessionsInternalClientMessage struct {
+	RoomId string `json:"roomid"`
+
+	Sessions []*AddSessionInternalClientMessage `json:"sessions"`
+}
+
+func (m *AddSessionsInternalClientMessage) CheckValid() error {
+	if m.RoomId == "" {
+		return fmt.Errorf("roomid missing")
+	}
+	if len(m.Sessions) == 0 {
+		return fmt.Errorf("sessions missing")
+	}
+	for _, s := range m.Sessions {
+		if s == nil {
+			return fmt.Errorf("invalid session")
+		}
+		if s.RoomId == "" {
+			s.RoomId = m.RoomId
+		} else if s.RoomId != m.RoomId {
+			return fmt.Errorf("session %s is for a different room", s.SessionId)
+		}
+		if err := s.CheckValid(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type RemoveSessionsInternalClientMessage struct {
+	RoomId string `json:"roomid"`
+
+	Sessions []*RemoveSessionInternalClientMessage `json:"sessions"`
+}
+
+func (m *RemoveSessionsInternalClientMessage) CheckValid() error {
+	if m.RoomId == "" {
+		return fmt.Errorf("roomid missing")
+	}
+	if len(m.Sessions) == 0 {
+		return fmt.Errorf("sessions missing")
+	}
+	for _, s := range m.Sessions {
+		if s == nil {
+			return fmt.Errorf("invalid session")
+		}
+		if s.RoomId == "" {
+			s.RoomId = m.RoomId
+		} else if s.RoomId != m.RoomId {
+			return fmt.Errorf("session %s is for a different room", s.SessionId)
+		}
+		if err := s.CheckValid(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type EventFilterInternalClientMessage struct {
+	// Patterns of room ids to receive events for, see "path.Match" for the
+	// supported syntax.
+	Rooms []string `json:"rooms,omitempty"`
+
+	// Targets of events to receive, e.g. "room" or "participants".
+	Targets []string `json:"targets,omitempty"`
+
+	// Types of events to receive, e.g. "join" or "update".
+	Types []string `json:"types,omitempty"`
+}
+
+func (m *EventFilterInternalClientMessage) CheckValid() error {
+	for _, pattern := range m.Rooms {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid room pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+type RecordingInternalClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for types "started", "stopped" and "failed".
+	RoomId string `json:"roomid,omitempty"`
+
+	// Used for type "status": number of concurrent recordings supported.
+	Capacity int `json:"capacity,omitempty"`
+
+	// Used for type "failed".
+	Error string `json:"error,omitempty"`
+}
+
+func (m *RecordingInternalClientMessage) CheckValid() error {
+	switch m.Type {
+	case "status":
+		if m.Capacity < 0 {
+			return fmt.Errorf("invalid capacity %d", m.Capacity)
+		}
+	case "started":
+		fallthrough
+	case "stopped":
+		fallthrough
+	case "failed":
+		if m.RoomId == "" {
+			return fmt.Errorf("roomid missing")
+		}
+	default:
+		return fmt.Errorf("unsupported recording type %s", m.Type)
+	}
+	return nil
+}
+
+type TranscriptionInternalClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for types "started", "stopped", "failed" and "caption".
+	RoomId string `json:"roomid,omitempty"`
+
+	// Used for type "status": number of concurrent transcriptions supported.
+	Capacity int `json:"capacity,omitempty"`
+
+	// Used for type "failed".
+	Error string `json:"error,omitempty"`
+
+	// Used for type "caption": the public id of the speaking session.
+	SessionId string `json:"sessionid,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Final     bool   `json:"final,omitempty"`
+	Language  string `json:"language,omitempty"`
+}
+
+func (m *TranscriptionInternalClientMessage) CheckValid() error {
+	switch m.Type {
+	case "status":
+		if m.Capacity < 0 {
+			return fmt.Errorf("invalid capacity %d", m.Capacity)
+		}
+	case "started":
+		fallthrough
+	case "stopped":
+		fallthrough
+	case "failed":
+		if m.RoomId == "" {
+			return fmt.Errorf("roomid missing")
+		}
+	case "caption":
+		if m.RoomId == "" {
+			return fmt.Errorf("roomid missing")
+		} else if m.Text == "" {
+			return fmt.Errorf("text missing")
+		}
+	default:
+		return fmt.Errorf("unsupported transcription type %s", m.Type)
+	}
+	return nil
+}
+
 type InternalClientMessage struct {
 	Type string `json:"type"`
 
@@ -559,6 +1097,16 @@ type InternalClientMessage struct {
 	UpdateSession *UpdateSessionInternalClientMessage `json:"updatesession,omitempty"`
 
 	RemoveSession *RemoveSessionInternalClientMessage `json:"removesession,omitempty"`
+
+	AddSessions *AddSessionsInternalClientMessage `json:"addsessions,omitempty"`
+
+	RemoveSessions *RemoveSessionsInternalClientMessage `json:"removesessions,omitempty"`
+
+	EventFilter *EventFilterInternalClientMessage `json:"eventfilter,omitempty"`
+
+	Recording *RecordingInternalClientMessage `json:"recording,omitempty"`
+
+	Transcription *TranscriptionInternalClientMessage `json:"transcription,omitempty"`
 }
 
 func (m *InternalClientMessage) CheckValid() error {
@@ -581,12 +1129,56 @@ func (m *InternalClientMessage) CheckValid() error {
 		} else if err := m.RemoveSession.CheckValid(); err != nil {
 			return err
 		}
+	case "addsessions":
+		if m.AddSessions == nil {
+			return fmt.Errorf("addsessions missing")
+		} else if err := m.AddSessions.CheckValid(); err != nil {
+			return err
+		}
+	case "removesessions":
+		if m.RemoveSessions == nil {
+			return fmt.Errorf("removesessions missing")
+		} else if err := m.RemoveSessions.CheckValid(); err != nil {
+			return err
+		}
+	case "eventfilter":
+		if m.EventFilter == nil {
+			return fmt.Errorf("eventfilter missing")
+		} else if err := m.EventFilter.CheckValid(); err != nil {
+			return err
+		}
+	case "recording":
+		if m.Recording == nil {
+			return fmt.Errorf("recording missing")
+		} else if err := m.Recording.CheckValid(); err != nil {
+			return err
+		}
+	case "transcription":
+		if m.Transcription == nil {
+			return fmt.Errorf("transcription missing")
+		} else if err := m.Transcription.CheckValid(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // Type "event"
 
+// SessionMuteState is the mute state of the camera stream published by a
+// session.
+type SessionMuteState struct {
+	Audio bool `json:"audio"`
+	Video bool `json:"video"`
+}
+
+func NewSessionMuteState(muted MediaType) *SessionMuteState {
+	return &SessionMuteState{
+		Audio: muted&MediaTypeAudio != 0,
+		Video: muted&MediaTypeVideo != 0,
+	}
+}
+
 type RoomEventServerMessage struct {
 	RoomId     string           `json:"roomid"`
 	Properties *json.RawMessage `json:"properties,omitempty"`
@@ -614,6 +1206,11 @@ type RoomEventMessage struct {
 	Data   *json.RawMessage `json:"data,omitempty"`
 }
 
+type RoomEventRecordingMessage struct {
+	RoomId string `json:"roomid"`
+	Error  string `json:"error,omitempty"`
+}
+
 type RoomFlagsServerMessage struct {
 	RoomId    string `json:"roomid"`
 	SessionId string `json:"sessionid"`
@@ -649,6 +1246,35 @@ type EventServerMessage struct {
 
 	// Used for target "message"
 	Message *RoomEventMessage `json:"message,omitempty"`
+
+	// Used for target "iceservers"
+	IceServers *TurnCredentials `json:"iceservers,omitempty"`
+
+	// Used for target "room" and type "recording-failed"
+	Recording *RoomEventRecordingMessage `json:"recording,omitempty"`
+
+	// Used for target "room" and type "transcription-failed"
+	Transcription *RoomEventRecordingMessage `json:"transcription,omitempty"`
+
+	// Used for target "room" and type "speaker"
+	Speaker *RoomEventSpeakerMessage `json:"speaker,omitempty"`
+
+	// Used for target "room" and type "publisher-closed"
+	Publisher *RoomEventPublisherMessage `json:"publisher,omitempty"`
+}
+
+type RoomEventPublisherMessage struct {
+	RoomId     string `json:"roomid"`
+	StreamType string `json:"streamtype"`
+	// Either "permissions", "lobby" or "call-permissions".
+	Reason string `json:"reason"`
+}
+
+type RoomEventSpeakerMessage struct {
+	// SessionId of the dominant speaker.
+	SessionId string `json:"sessionid"`
+	// Talking contains the ids of all sessions that are currently talking.
+	Talking []string `json:"talking"`
 }
 
 type EventServerMessageSessionEntry struct {
@@ -676,6 +1302,14 @@ type AnswerOfferMessage struct {
 	RoomType string                 `json:"roomType"`
 	Payload  map[string]interface{} `json:"payload"`
 	Sid      string                 `json:"sid,omitempty"`
+	Layers   *SimulcastLayers       `json:"layers,omitempty"`
+}
+
+// SimulcastLayers describes the simulcast substreams a publisher is sending,
+// so subscribers can select one of them through a "configure" message.
+type SimulcastLayers struct {
+	Substreams int      `json:"substreams"`
+	Rids       []string `json:"rids,omitempty"`
 }
 
 // Type "transient"
@@ -710,3 +1344,512 @@ type TransientDataServerMessage struct {
 	Value    interface{}            `json:"value,omitempty"`
 	Data     map[string]interface{} `json:"data,omitempty"`
 }
+
+// Type "reaction"
+
+const (
+	// Maximum length of an emoji reaction.
+	maxReactionEmojiLength = 32
+)
+
+type ReactionClientMessage struct {
+	Type string `json:"type"`
+
+	Emoji     string `json:"emoji,omitempty"`
+	SessionId string `json:"sessionid,omitempty"`
+}
+
+func (m *ReactionClientMessage) CheckValid() error {
+	switch m.Type {
+	case "raisehand":
+		// No additional check required.
+	case "lowerhand":
+		// No additional check required.
+	case "emoji":
+		if m.Emoji == "" {
+			return fmt.Errorf("emoji missing")
+		} else if len(m.Emoji) > maxReactionEmojiLength {
+			return fmt.Errorf("emoji too long")
+		}
+	default:
+		return fmt.Errorf("unsupported reaction type %s", m.Type)
+	}
+	return nil
+}
+
+type ReactionServerMessage struct {
+	Type string `json:"type"`
+
+	// Session ids with raised hands, mapped to the time (in milliseconds
+	// since the epoch) the hand was raised.
+	Raised  map[string]int64 `json:"raised,omitempty"`
+	Lowered []string         `json:"lowered,omitempty"`
+
+	// Number of emoji reactions received since the last update.
+	Emojis map[string]int `json:"emojis,omitempty"`
+}
+
+// Type "typing"
+
+type TypingClientMessage struct {
+	Type string `json:"type"`
+}
+
+func (m *TypingClientMessage) CheckValid() error {
+	switch m.Type {
+	case "start":
+		// No additional check required.
+	case "stop":
+		// No additional check required.
+	default:
+		return fmt.Errorf("unsupported typing type %s", m.Type)
+	}
+	return nil
+}
+
+type TypingServerMessage struct {
+	Type string `json:"type"`
+
+	SessionId string `json:"sessionid"`
+}
+
+// Type "participants"
+
+type ParticipantsClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for type "get"
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+func (m *ParticipantsClientMessage) CheckValid() error {
+	switch m.Type {
+	case "get":
+		if m.Offset < 0 {
+			return fmt.Errorf("invalid offset %d", m.Offset)
+		} else if m.Limit < 0 {
+			return fmt.Errorf("invalid limit %d", m.Limit)
+		}
+	default:
+		return fmt.Errorf("unsupported participants type %s", m.Type)
+	}
+	return nil
+}
+
+type ParticipantsServerMessage struct {
+	Type string `json:"type"`
+
+	RoomId string `json:"roomid"`
+
+	// Total number of sessions in the room.
+	Count int `json:"count"`
+
+	// Used for type "summary"
+	InCall     int                               `json:"incall,omitempty"`
+	Moderators []*EventServerMessageSessionEntry `json:"moderators,omitempty"`
+
+	// Used for type "page"
+	Offset   int                               `json:"offset,omitempty"`
+	Sessions []*EventServerMessageSessionEntry `json:"sessions,omitempty"`
+}
+
+// Type "rtpforward"
+
+type RtpForwardClientMessage struct {
+	Type string `json:"type"`
+
+	// Public id of the session that is publishing the stream.
+	SessionId  string `json:"sessionid"`
+	StreamType string `json:"streamtype"`
+
+	// Used for type "start"
+	Host      string `json:"host,omitempty"`
+	AudioPort int    `json:"audioport,omitempty"`
+	VideoPort int    `json:"videoport,omitempty"`
+
+	// Used for type "stop"
+	StreamIds []uint64 `json:"streamids,omitempty"`
+}
+
+func isValidRtpPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func (m *RtpForwardClientMessage) CheckValid() error {
+	if m.SessionId == "" {
+		return fmt.Errorf("sessionid missing")
+	}
+	if m.StreamType == "" {
+		m.StreamType = streamTypeVideo
+	}
+
+	switch m.Type {
+	case "start":
+		if m.Host == "" {
+			return fmt.Errorf("host missing")
+		} else if m.AudioPort == 0 && m.VideoPort == 0 {
+			return fmt.Errorf("audioport or videoport missing")
+		} else if m.AudioPort != 0 && !isValidRtpPort(m.AudioPort) {
+			return fmt.Errorf("invalid audioport %d", m.AudioPort)
+		} else if m.VideoPort != 0 && !isValidRtpPort(m.VideoPort) {
+			return fmt.Errorf("invalid videoport %d", m.VideoPort)
+		}
+	case "stop":
+		if len(m.StreamIds) == 0 {
+			return fmt.Errorf("streamids missing")
+		}
+	default:
+		return fmt.Errorf("unsupported rtpforward type %s", m.Type)
+	}
+	return nil
+}
+
+type RtpForwardStream struct {
+	StreamId uint64 `json:"streamid"`
+	// Either "audio" or "video".
+	Type string `json:"type"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+type RtpForwardServerMessage struct {
+	Type string `json:"type"`
+
+	SessionId  string `json:"sessionid"`
+	StreamType string `json:"streamtype"`
+
+	// Used for type "started"
+	Streams []*RtpForwardStream `json:"streams,omitempty"`
+
+	// Used for type "stopped"
+	StreamIds []uint64 `json:"streamids,omitempty"`
+}
+
+// Type "recording"
+
+type RecordingClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for type "consent".
+	Consent bool `json:"consent,omitempty"`
+}
+
+func (m *RecordingClientMessage) CheckValid() error {
+	switch m.Type {
+	case "consent":
+		// No additional check required.
+	default:
+		return fmt.Errorf("unsupported recording type %s", m.Type)
+	}
+	return nil
+}
+
+// RecordingServerMessage is sent to internal clients that support the
+// "recording" feature to start or stop recording a room.
+type RecordingServerMessage struct {
+	Type string `json:"type"`
+
+	RoomId string `json:"roomid"`
+}
+
+// Type "transcription"
+
+type TranscriptionClientMessage struct {
+	Type string `json:"type"`
+}
+
+func (m *TranscriptionClientMessage) CheckValid() error {
+	switch m.Type {
+	case "start":
+		// No additional check required.
+	case "stop":
+		// No additional check required.
+	default:
+		return fmt.Errorf("unsupported transcription type %s", m.Type)
+	}
+	return nil
+}
+
+// TranscriptionServerMessage is sent to internal clients that support the
+// "transcription" feature to start or stop transcribing a room.
+type TranscriptionServerMessage struct {
+	Type string `json:"type"`
+
+	RoomId string `json:"roomid"`
+}
+
+// Type "caption"
+
+type CaptionServerMessage struct {
+	RoomId    string `json:"roomid"`
+	SessionId string `json:"sessionid,omitempty"`
+	Text      string `json:"text"`
+	Final     bool   `json:"final,omitempty"`
+	Language  string `json:"language,omitempty"`
+}
+
+// Type "room-key"
+
+const (
+	// Maximum size of the (opaque) key material in a "room-key" message.
+	maxRoomKeyDataSize = 8192
+)
+
+type RoomKeyClientMessage struct {
+	Recipient MessageClientMessageRecipient `json:"recipient"`
+
+	Data *json.RawMessage `json:"data"`
+}
+
+func (m *RoomKeyClientMessage) CheckValid() error {
+	if m.Data == nil || len(*m.Data) == 0 {
+		return fmt.Errorf("data missing")
+	} else if len(*m.Data) > maxRoomKeyDataSize {
+		return fmt.Errorf("data too large")
+	}
+	switch m.Recipient.Type {
+	case RecipientTypeRoom:
+		// No additional checks required.
+	case RecipientTypeSession:
+		if m.Recipient.SessionId == "" {
+			return fmt.Errorf("session id missing")
+		}
+	default:
+		return fmt.Errorf("unsupported recipient type %v", m.Recipient.Type)
+	}
+	return nil
+}
+
+type RoomKeyServerMessage struct {
+	// Room the sender was in, the key material is only delivered to sessions
+	// in the same room.
+	RoomId string `json:"roomid"`
+
+	Sender *MessageServerMessageSender `json:"sender"`
+
+	Data *json.RawMessage `json:"data"`
+}
+
+// Type "moderation"
+
+type ModerationClientMessage struct {
+	Type string `json:"type"`
+
+	SessionId string `json:"sessionid"`
+
+	// Used for type "mute", can be "audio" (default) or "video".
+	Media string `json:"media,omitempty"`
+}
+
+func (m *ModerationClientMessage) CheckValid() error {
+	switch m.Type {
+	case "mute":
+		switch m.Media {
+		case "":
+			m.Media = "audio"
+		case "audio":
+		case "video":
+		default:
+			return fmt.Errorf("unsupported media %s", m.Media)
+		}
+	case "stopscreen":
+	case "lowerhand":
+	case "removefromcall":
+	default:
+		return fmt.Errorf("unsupported moderation type %s", m.Type)
+	}
+	if m.SessionId == "" {
+		return fmt.Errorf("sessionid missing")
+	}
+	return nil
+}
+
+// ModerationServerMessage informs a session about a moderator action that
+// affected it.
+type ModerationServerMessage struct {
+	Type string `json:"type"`
+
+	// Public id of the moderator session.
+	Actor string `json:"actor"`
+
+	Media string `json:"media,omitempty"`
+}
+
+// Type "session"
+
+const (
+	maxSessionMetadataKeys        = 16
+	maxSessionMetadataKeyLength   = 64
+	maxSessionMetadataValueLength = 256
+)
+
+var (
+	sessionMetadataKeyRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+)
+
+type SessionClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for type "set", values that are null are removed.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// Used for type "get", defaults to the own session.
+	SessionId string `json:"sessionid,omitempty"`
+}
+
+func (m *SessionClientMessage) CheckValid() error {
+	switch m.Type {
+	case "set":
+		if len(m.Metadata) == 0 {
+			return fmt.Errorf("metadata missing")
+		} else if len(m.Metadata) > maxSessionMetadataKeys {
+			return fmt.Errorf("too many metadata keys")
+		}
+		for key, value := range m.Metadata {
+			if len(key) > maxSessionMetadataKeyLength || !sessionMetadataKeyRegex.MatchString(key) {
+				return fmt.Errorf("invalid metadata key %s", key)
+			}
+			switch value := value.(type) {
+			case nil:
+			case bool:
+			case float64:
+			case string:
+				if len(value) > maxSessionMetadataValueLength {
+					return fmt.Errorf("value of metadata key %s too long", key)
+				}
+			default:
+				return fmt.Errorf("unsupported value of metadata key %s", key)
+			}
+		}
+	case "get":
+		// No additional check required.
+	default:
+		return fmt.Errorf("unsupported session type %s", m.Type)
+	}
+	return nil
+}
+
+type SessionServerMessage struct {
+	Type string `json:"type"`
+
+	SessionId string                 `json:"sessionid"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// Type "report"
+
+const (
+	// Maximum width / height of a reported video resolution.
+	maxReportResolution = 16384
+)
+
+// ClientQualityStats is a summary of the WebRTC statistics of a client.
+type ClientQualityStats struct {
+	// Round trip time in milliseconds.
+	Rtt float64 `json:"rtt"`
+	// Packet loss of the received streams in percent.
+	PacketLoss float64 `json:"packetloss"`
+
+	// Resolution of the received / sent video (optional).
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+func (s *ClientQualityStats) CheckValid() error {
+	if s.Rtt < 0 {
+		return fmt.Errorf("invalid rtt %f", s.Rtt)
+	} else if s.PacketLoss < 0 || s.PacketLoss > 100 {
+		return fmt.Errorf("invalid packet loss %f", s.PacketLoss)
+	} else if s.Width < 0 || s.Width > maxReportResolution || s.Height < 0 || s.Height > maxReportResolution {
+		return fmt.Errorf("invalid resolution %dx%d", s.Width, s.Height)
+	}
+	return nil
+}
+
+type ReportClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for type "stats".
+	Stats *ClientQualityStats `json:"stats,omitempty"`
+}
+
+func (m *ReportClientMessage) CheckValid() error {
+	switch m.Type {
+	case "stats":
+		if m.Stats == nil {
+			return fmt.Errorf("stats missing")
+		} else if err := m.Stats.CheckValid(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported report type %s", m.Type)
+	}
+	return nil
+}
+
+// Type "call"
+
+const (
+	// Call states of a session in a room.
+	CallStateJoined = "joined"
+	CallStateInCall = "incall"
+	CallStateOnHold = "onhold"
+)
+
+type CallClientMessage struct {
+	// Either "hold" or "resume".
+	Type string `json:"type"`
+}
+
+func (m *CallClientMessage) CheckValid() error {
+	switch m.Type {
+	case "hold":
+	case "resume":
+	default:
+		return fmt.Errorf("unsupported call type %s", m.Type)
+	}
+	return nil
+}
+
+type CallServerMessage struct {
+	RoomId string `json:"roomid"`
+	// Either "joined", "incall" or "onhold".
+	State string `json:"state"`
+}
+
+// Type "breakout"
+
+type BreakoutClientMessage struct {
+	Type string `json:"type"`
+
+	// Used for type "start": maps the ids of the breakout rooms to the public
+	// session ids that should be moved to them.
+	Rooms map[string][]string `json:"rooms,omitempty"`
+}
+
+func (m *BreakoutClientMessage) CheckValid() error {
+	switch m.Type {
+	case "start":
+		if len(m.Rooms) == 0 {
+			return fmt.Errorf("rooms missing")
+		}
+		for roomId := range m.Rooms {
+			if roomId == "" {
+				return fmt.Errorf("room id missing")
+			}
+		}
+	case "end":
+		// No additional check required.
+	default:
+		return fmt.Errorf("unsupported breakout type %s", m.Type)
+	}
+	return nil
+}
+
+type BreakoutServerMessage struct {
+	Type string `json:"type"`
+
+	RoomId string              `json:"roomid"`
+	Rooms  map[string][]string `json:"rooms,omitempty"`
+}
@@ -22,8 +22,11 @@
 package signaling
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -44,6 +47,10 @@ func wrapMessage(messageType string, msg testCheckValid) *ClientMessage {
 		wrapped.Bye = msg.(*ByeClientMessage)
 	case "room":
 		wrapped.Room = msg.(*RoomClientMessage)
+	case "session":
+		wrapped.Session = msg.(*SessionClientMessage)
+	case "report":
+		wrapped.Report = msg.(*ReportClientMessage)
 	default:
 		return nil
 	}
@@ -160,6 +167,17 @@ func TestHelloClientMessage(t *testing.T) {
 				Params: &json.RawMessage{'x', 'y', 'z'}, // Invalid JSON.
 			},
 		},
+		&HelloClientMessage{
+			Version:  HelloVersion,
+			Features: []string{ClientFeatureInternalRecording},
+			Versions: map[string]int{
+				ClientFeatureInternalRecording: 0,
+			},
+			Auth: HelloClientMessageAuth{
+				Type:   "internal",
+				Params: (*json.RawMessage)(&internalAuthParams),
+			},
+		},
 	}
 
 	testMessages(t, "hello", valid_messages, invalid_messages)
@@ -173,6 +191,55 @@ func TestHelloClientMessage(t *testing.T) {
 	}
 }
 
+func TestNegotiateInternalFeatures(t *testing.T) {
+	prev := internalFeatureVersions
+	defer func() {
+		internalFeatureVersions = prev
+	}()
+	internalFeatureVersions = map[string]InternalFeatureVersions{
+		ClientFeatureInternalRecording:     {Min: 1, Max: 2},
+		ClientFeatureInternalTranscription: {Min: 2, Max: 3},
+	}
+
+	if versions, unsupported := negotiateInternalFeatures(nil, nil); versions != nil || unsupported != nil {
+		t.Errorf("Expected no versions, got %+v / %+v", versions, unsupported)
+	}
+
+	// Features without command sets are ignored.
+	if versions, unsupported := negotiateInternalFeatures([]string{"foo"}, nil); versions != nil || unsupported != nil {
+		t.Errorf("Expected no versions, got %+v / %+v", versions, unsupported)
+	}
+
+	versions, unsupported := negotiateInternalFeatures([]string{ClientFeatureInternalRecording, ClientFeatureInternalTranscription}, nil)
+	if expected := map[string]int{ClientFeatureInternalRecording: 1}; !reflect.DeepEqual(expected, versions) {
+		t.Errorf("Expected versions %+v, got %+v", expected, versions)
+	}
+	if len(unsupported) != 1 {
+		t.Errorf("Expected one unsupported feature, got %+v", unsupported)
+	} else if expected := (&InternalFeatureError{
+		Feature:    ClientFeatureInternalTranscription,
+		Version:    1,
+		MinVersion: 2,
+		MaxVersion: 3,
+	}); !reflect.DeepEqual(expected, unsupported[0]) {
+		t.Errorf("Expected unsupported %+v, got %+v", expected, unsupported[0])
+	}
+
+	versions, unsupported = negotiateInternalFeatures([]string{ClientFeatureInternalRecording, ClientFeatureInternalTranscription}, map[string]int{
+		ClientFeatureInternalRecording:     5,
+		ClientFeatureInternalTranscription: 2,
+	})
+	if expected := map[string]int{
+		ClientFeatureInternalRecording:     2,
+		ClientFeatureInternalTranscription: 2,
+	}; !reflect.DeepEqual(expected, versions) {
+		t.Errorf("Expected versions %+v, got %+v", expected, versions)
+	}
+	if len(unsupported) != 0 {
+		t.Errorf("Expected no unsupported features, got %+v", unsupported)
+	}
+}
+
 func TestMessageClientMessage(t *testing.T) {
 	valid_messages := []testCheckValid{
 		&MessageClientMessage{
@@ -290,6 +357,123 @@ func TestRoomClientMessage(t *testing.T) {
 	}
 }
 
+func TestSessionClientMessage(t *testing.T) {
+	tooMany := make(map[string]interface{})
+	for i := 0; i <= maxSessionMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = i
+	}
+	valid_messages := []testCheckValid{
+		&SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				"device":    "mobile",
+				"audioonly": true,
+				"version":   float64(18),
+				"removed":   nil,
+			},
+		},
+		&SessionClientMessage{
+			Type: "get",
+		},
+		&SessionClientMessage{
+			Type:      "get",
+			SessionId: "the-session-id",
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&SessionClientMessage{},
+		&SessionClientMessage{
+			Type: "unknown",
+		},
+		&SessionClientMessage{
+			Type: "set",
+		},
+		&SessionClientMessage{
+			Type:     "set",
+			Metadata: tooMany,
+		},
+		&SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				"invalid key": "value",
+			},
+		},
+		&SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				strings.Repeat("a", maxSessionMetadataKeyLength+1): "value",
+			},
+		},
+		&SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				"key": strings.Repeat("a", maxSessionMetadataValueLength+1),
+			},
+		},
+		&SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				"nested": map[string]interface{}{
+					"key": "value",
+				},
+			},
+		},
+	}
+
+	testMessages(t, "session", valid_messages, invalid_messages)
+}
+
+func TestReportClientMessage(t *testing.T) {
+	valid_messages := []testCheckValid{
+		&ReportClientMessage{
+			Type: "stats",
+			Stats: &ClientQualityStats{
+				Rtt:        42.5,
+				PacketLoss: 1.5,
+			},
+		},
+		&ReportClientMessage{
+			Type: "stats",
+			Stats: &ClientQualityStats{
+				Rtt:        0,
+				PacketLoss: 100,
+				Width:      1280,
+				Height:     720,
+			},
+		},
+	}
+	invalid_messages := []testCheckValid{
+		&ReportClientMessage{},
+		&ReportClientMessage{
+			Type: "unknown",
+		},
+		&ReportClientMessage{
+			Type: "stats",
+		},
+		&ReportClientMessage{
+			Type: "stats",
+			Stats: &ClientQualityStats{
+				Rtt: -1,
+			},
+		},
+		&ReportClientMessage{
+			Type: "stats",
+			Stats: &ClientQualityStats{
+				PacketLoss: 100.5,
+			},
+		},
+		&ReportClientMessage{
+			Type: "stats",
+			Stats: &ClientQualityStats{
+				Width:  maxReportResolution + 1,
+				Height: 720,
+			},
+		},
+	}
+
+	testMessages(t, "report", valid_messages, invalid_messages)
+}
+
 func TestErrorMessages(t *testing.T) {
 	id := "request-id"
 	msg := ClientMessage{
@@ -346,3 +530,51 @@ func TestIsChatRefresh(t *testing.T) {
 		t.Error("message should not be detected as chat refresh")
 	}
 }
+
+func TestServerMessagePrepared(t *testing.T) {
+	message := &ServerMessage{
+		Type: "typing",
+		Typing: &TypingServerMessage{
+			Type:      "start",
+			SessionId: "the-session-id",
+		},
+	}
+	if data := message.getPrepared(); data != nil {
+		t.Errorf("Expected no prepared data, got %s", string(data))
+	}
+
+	expected, err := message.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message.Prepare()
+	data := message.getPrepared()
+	if string(data) != string(expected) {
+		t.Errorf("Expected %s, got %s", string(expected), string(data))
+	}
+	// The message is only serialized once.
+	if data2 := message.getPrepared(); &data2[0] != &data[0] {
+		t.Error("Expected the same prepared data")
+	}
+
+	var buffer bytes.Buffer
+	if err := marshalMessage(message, &buffer); err != nil {
+		t.Fatal(err)
+	} else if buffer.String() != string(expected) {
+		t.Errorf("Expected %s, got %s", string(expected), buffer.String())
+	}
+
+	// Copies can be modified.
+	msg := message.Copy()
+	msg.Id = "the-id"
+	if data := msg.getPrepared(); data != nil {
+		t.Errorf("Expected no prepared data, got %s", string(data))
+	}
+	buffer.Reset()
+	if err := marshalMessage(msg, &buffer); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(buffer.String(), "the-id") {
+		t.Errorf("Expected the id in %s", buffer.String())
+	}
+}
@@ -32,8 +32,12 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/dlintw/goconf"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 var (
@@ -48,10 +52,14 @@ type BackendClient struct {
 
 	pool         *HttpClientPool
 	capabilities *Capabilities
+
+	checksumV2 bool
+
+	delegate *GrpcBackendClient
 }
 
-func NewBackendClient(config *goconf.ConfigFile, maxConcurrentRequestsPerHost int, version string) (*BackendClient, error) {
-	backends, err := NewBackendConfiguration(config)
+func NewBackendClient(config *goconf.ConfigFile, maxConcurrentRequestsPerHost int, version string, etcdClient *EtcdClient) (*BackendClient, error) {
+	backends, err := NewBackendConfiguration(config, etcdClient)
 	if err != nil {
 		return nil, err
 	}
@@ -65,25 +73,105 @@ func NewBackendClient(config *goconf.ConfigFile, maxConcurrentRequestsPerHost in
 	if err != nil {
 		return nil, err
 	}
+	if idle, _ := config.GetInt("backend", "idleconnectionsperhost"); idle > 0 {
+		pool.SetMaxIdleConnsPerHost(idle)
+	}
+	if seconds, _ := config.GetInt("backend", "pooltimeout"); seconds > 0 {
+		pool.SetTimeout(time.Duration(seconds) * time.Second)
+	}
+	if http2, err := config.GetBool("backend", "http2"); err == nil && !http2 {
+		log.Println("HTTP/2 is disabled for backend requests")
+		pool.SetHttp2(false)
+	}
+	pool.SetPoolSettings(func(u *url.URL) *httpPoolSettings {
+		// Don't modify the url of the request when looking up the backend.
+		backendUrl := *u
+		backend := backends.GetBackend(&backendUrl)
+		if backend == nil {
+			return nil
+		}
+
+		settings := &httpPoolSettings{
+			tls: backend.tlsSettings,
+
+			maxConcurrentRequests: backend.maxConcurrentRequests,
+			maxIdleConnections:    backend.maxIdleConnections,
+		}
+		if backend.parent != nil {
+			// All instances of a pattern share the pools (which are still
+			// separate per host).
+			settings.name = backend.parent.Id()
+		} else if !backend.IsCompat() {
+			// The compat backend can be used with any host, use separate
+			// pools per host in this case.
+			settings.name = backend.Id()
+		}
+		return settings
+	})
 
 	capabilities, err := NewCapabilities(version, pool)
 	if err != nil {
 		return nil, err
 	}
 
-	return &BackendClient{
+	checksumV2, _ := config.GetBool("backend", "checksumv2")
+	if checksumV2 {
+		log.Println("Using v2 checksums for backends that support them")
+	}
+
+	delegate, err := NewGrpcBackendClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	RegisterBackendClientStats()
+
+	client := &BackendClient{
 		version:  version,
 		backends: backends,
 
 		pool:         pool,
 		capabilities: capabilities,
-	}, nil
+
+		checksumV2: checksumV2,
+
+		delegate: delegate,
+	}
+	backends.AddListener(client)
+	return client, nil
+}
+
+func (b *BackendClient) BackendRemoved(backend *Backend) {
+	deleteBackendClientStats(backend.Id())
+	if backend.url == "" {
+		return
+	}
+
+	if backend.pattern != nil {
+		b.capabilities.RemoveMatchingEntries(backend.pattern)
+	} else {
+		b.capabilities.RemoveEntries(backend.url)
+	}
+	b.pool.RemovePool(backend.Id())
+}
+
+// InvalidateCapabilities removes the cached capabilities of all urls starting
+// with the given prefix, so they are fetched again on the next request.
+func (b *BackendClient) InvalidateCapabilities(prefix string) {
+	b.capabilities.RemoveEntries(prefix)
 }
 
 func (b *BackendClient) Reload(config *goconf.ConfigFile) {
 	b.backends.Reload(config)
 }
 
+func (b *BackendClient) Close() {
+	b.backends.Close()
+	if b.delegate != nil {
+		b.delegate.Close()
+	}
+}
+
 func (b *BackendClient) GetCompatBackend() *Backend {
 	return b.backends.GetCompatBackend()
 }
@@ -100,19 +188,54 @@ func (b *BackendClient) IsUrlAllowed(u *url.URL) bool {
 	return b.backends.IsUrlAllowed(u)
 }
 
+// IsInMaintenance returns true if the backend at the given url is in
+// maintenance.
+func (b *BackendClient) IsInMaintenance(u *url.URL) bool {
+	backend := b.backends.GetBackend(u)
+	return backend != nil && b.backends.IsInMaintenance(backend)
+}
+
+// UseChecksumV2 returns true if the "v2" checksum is enabled and supported by
+// the backend at the given url. Requests from such backends must also use the
+// "v2" checksum.
+func (b *BackendClient) UseChecksumV2(ctx context.Context, u *url.URL) bool {
+	return b.checksumV2 && b.capabilities.HasCapabilityFeature(ctx, u, FeatureSignalingChecksumV2)
+}
+
+// UseBatchPing returns true if the backend at the given url supports pinging
+// sessions of multiple rooms in one request.
+func (b *BackendClient) UseBatchPing(ctx context.Context, u *url.URL) bool {
+	return b.capabilities.HasCapabilityFeature(ctx, u, FeatureSignalingV3Api) &&
+		b.capabilities.HasCapabilityFeature(ctx, u, FeatureSignalingBatchPing)
+}
+
 func isOcsRequest(u *url.URL) bool {
 	return strings.Contains(u.Path, "/ocs/v2.php") || strings.Contains(u.Path, "/ocs/v1.php")
 }
 
 // PerformJSONRequest sends a JSON POST request to the given url and decodes
 // the result into "response".
-func (b *BackendClient) PerformJSONRequest(ctx context.Context, u *url.URL, request interface{}, response interface{}) error {
+func (b *BackendClient) PerformJSONRequest(ctx context.Context, u *url.URL, request interface{}, response interface{}) (err error) {
 	if u == nil {
 		return fmt.Errorf("no url passed to perform JSON request %+v", request)
 	}
 
-	secret := b.backends.GetSecret(u)
-	if secret == nil {
+	ctx, span := startSpan(ctx, "backend.request", attribute.String("backend.host", u.Host))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if b.delegate != nil {
+		// The backend secrets are only known to the server requests are
+		// delegated to.
+		if b.backends.GetBackend(u) == nil {
+			return fmt.Errorf("no backend configured for %s", u)
+		}
+		return b.delegate.PerformJSONRequest(ctx, u, request, response)
+	}
+
+	backend := b.backends.GetBackend(u)
+	if backend == nil {
 		return fmt.Errorf("no backend secret configured for for %s", u)
 	}
 
@@ -148,12 +271,17 @@ func (b *BackendClient) PerformJSONRequest(ctx context.Context, u *url.URL, requ
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("OCS-APIRequest", "true")
 	req.Header.Set("User-Agent", "nextcloud-spreed-signaling/"+b.version)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	if b.hub != nil {
 		req.Header.Set("X-Spreed-Signaling-Features", strings.Join(b.hub.info.Features, ", "))
 	}
 
 	// Add checksum so the backend can validate the request.
-	AddBackendChecksum(req, data, secret)
+	if b.UseChecksumV2(ctx, u) {
+		backend.secretKey.addV2(req, data)
+	} else {
+		backend.secretKey.add(req, data)
+	}
 
 	resp, err := c.Do(req)
 	if err != nil {
@@ -187,6 +315,15 @@ func (b *BackendClient) PerformJSONRequest(ctx context.Context, u *url.URL, requ
 		if err := json.Unmarshal(body, &ocs); err != nil {
 			log.Printf("Could not decode OCS response %s from %s: %s", string(body), req.URL, err)
 			return err
+		} else if ocs.Ocs != nil && !ocs.Ocs.Meta.IsOk() {
+			log.Printf("Received OCS error %+v from %s", ocs.Ocs.Meta, req.URL)
+			backendId := u.Host
+			if backend := b.GetBackend(u); backend != nil {
+				backendId = backend.Id()
+			}
+			err := ocs.Ocs.Meta.NewError()
+			statsBackendClientOcsErrorsTotal.WithLabelValues(backendId, err.Code).Inc()
+			return err
 		} else if ocs.Ocs == nil || ocs.Ocs.Data == nil {
 			log.Printf("Incomplete OCS response %s from %s", string(body), req.URL)
 			return fmt.Errorf("incomplete OCS response")
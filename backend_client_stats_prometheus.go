@@ -0,0 +1,85 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsBackendClientOcsErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend_client",
+		Name:      "ocs_errors_total",
+		Help:      "The total number of OCS errors returned by backends",
+	}, []string{"backend", "category"})
+	statsBackendClientQueuePending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "backend_client",
+		Name:      "queue_pending",
+		Help:      "The current number of failed backend requests waiting to be retried",
+	})
+	statsBackendClientQueueRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend_client",
+		Name:      "queue_retries_total",
+		Help:      "The total number of retried backend requests",
+	})
+	statsBackendClientQueueDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend_client",
+		Name:      "queue_dropped_total",
+		Help:      "The total number of backend requests dropped after failed retries",
+	})
+	statsBackendClientQueueOverflowTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend_client",
+		Name:      "queue_overflow_total",
+		Help:      "The total number of backend requests dropped because the queue was full",
+	})
+
+	// The error codes returned by "OcsMeta.NewError".
+	ocsErrorCategories = []string{
+		"backend_unauthorized",
+		"backend_not_found",
+		"backend_server_error",
+		"backend_failure",
+	}
+
+	backendClientStats = []prometheus.Collector{
+		statsBackendClientOcsErrorsTotal,
+		statsBackendClientQueuePending,
+		statsBackendClientQueueRetriesTotal,
+		statsBackendClientQueueDroppedTotal,
+		statsBackendClientQueueOverflowTotal,
+	}
+)
+
+func RegisterBackendClientStats() {
+	registerAll(backendClientStats...)
+}
+
+func deleteBackendClientStats(backend string) {
+	for _, category := range ocsErrorCategories {
+		statsBackendClientOcsErrorsTotal.DeleteLabelValues(backend, category)
+	}
+}
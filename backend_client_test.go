@@ -95,7 +95,7 @@ func TestPostOnRedirect(t *testing.T) {
 	if u.Scheme == "http" {
 		config.AddOption("backend", "allowhttp", "true")
 	}
-	client, err := NewBackendClient(config, 1, "0.0")
+	client, err := NewBackendClient(config, 1, "0.0", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,7 +134,7 @@ func TestPostOnRedirectDifferentHost(t *testing.T) {
 	if u.Scheme == "http" {
 		config.AddOption("backend", "allowhttp", "true")
 	}
-	client, err := NewBackendClient(config, 1, "0.0")
+	client, err := NewBackendClient(config, 1, "0.0", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -187,7 +187,7 @@ func TestPostOnRedirectStatusFound(t *testing.T) {
 	if u.Scheme == "http" {
 		config.AddOption("backend", "allowhttp", "true")
 	}
-	client, err := NewBackendClient(config, 1, "0.0")
+	client, err := NewBackendClient(config, 1, "0.0", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -206,3 +206,104 @@ func TestPostOnRedirectStatusFound(t *testing.T) {
 		t.Errorf("Expected empty response, got %+v", response)
 	}
 }
+
+func TestPerformJSONRequestOcsError(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/one", func(w http.ResponseWriter, r *http.Request) {
+		response := OcsResponse{
+			Ocs: &OcsBody{
+				Meta: OcsMeta{
+					Status:     "failure",
+					StatusCode: 997,
+					Message:    "Current user is not logged in",
+				},
+			},
+		}
+		data, err := json.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		if _, err := w.Write(data); err != nil {
+			t.Error(err)
+		}
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/ocs/v2.php/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "allowed", u.Host)
+	config.AddOption("backend", "secret", string(testBackendSecret))
+	if u.Scheme == "http" {
+		config.AddOption("backend", "allowhttp", "true")
+	}
+	client, err := NewBackendClient(config, 1, "0.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	request := map[string]string{
+		"foo": "bar",
+	}
+	var response map[string]string
+	err = client.PerformJSONRequest(ctx, u, request, &response)
+	if err == nil {
+		t.Fatalf("Expected error, got %+v", response)
+	}
+
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected signaling error, got %s", err)
+	} else if e.Code != "backend_unauthorized" {
+		t.Errorf("Expected code backend_unauthorized, got %s", e.Code)
+	} else if e.Message != "Current user is not logged in" {
+		t.Errorf("Expected OCS message, got %s", e.Message)
+	} else if meta, ok := e.Details.(*OcsMeta); !ok || meta.StatusCode != 997 {
+		t.Errorf("Expected OCS meta as details, got %+v", e.Details)
+	}
+}
+
+func TestOcsMetaNewError(t *testing.T) {
+	testcases := map[int]string{
+		http.StatusUnauthorized:        "backend_unauthorized",
+		http.StatusForbidden:           "backend_unauthorized",
+		997:                            "backend_unauthorized",
+		http.StatusNotFound:            "backend_not_found",
+		998:                            "backend_not_found",
+		999:                            "backend_server_error",
+		http.StatusInternalServerError: "backend_server_error",
+		http.StatusBadRequest:          "backend_failure",
+	}
+	for status, code := range testcases {
+		meta := &OcsMeta{
+			Status:     "failure",
+			StatusCode: status,
+		}
+		if meta.IsOk() {
+			t.Errorf("Expected failure for %+v", meta)
+		}
+		if e := meta.NewError(); e.Code != code {
+			t.Errorf("Expected code %s for status %d, got %s", code, status, e.Code)
+		} else if e.Message == "" {
+			t.Errorf("Expected message for status %d", status)
+		}
+	}
+
+	for _, status := range []string{"", "ok", "OK"} {
+		meta := &OcsMeta{
+			Status: status,
+		}
+		if !meta.IsOk() {
+			t.Errorf("Expected success for %+v", meta)
+		}
+	}
+}
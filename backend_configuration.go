@@ -22,15 +22,27 @@
 package signaling
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dlintw/goconf"
 )
 
+const (
+	BackendTypeStatic = "static"
+	BackendTypeEtcd   = "etcd"
+)
+
 var (
 	SessionLimitExceeded = NewError("session_limit_exceeded", "Too many sessions connected for this backend.")
 )
@@ -41,14 +53,44 @@ type Backend struct {
 	secret []byte
 	compat bool
 
+	// Additional secret that is accepted while the secret is rotated.
+	secondarySecret []byte
+
+	// Cached HMAC instances for the secrets, replaced together with them.
+	secretKey          *backendChecksumKey
+	secondarySecretKey *backendChecksumKey
+
 	allowHttp bool
 
+	tlsSettings *tlsClientSettings
+
+	maxConcurrentRequests int
+	maxIdleConnections    int
+
 	maxStreamBitrate int
 	maxScreenBitrate int
 
+	// Interval in seconds to ping rooms with / without sessions in a call,
+	// overriding the global defaults if set.
+	pingInterval     int
+	idlePingInterval int
+
+	// No new sessions are accepted and no requests are sent to backends that
+	// are in maintenance.
+	maintenance bool
+
+	audioBridgeRoomTypes map[int]bool
+	audioBridgeAllRooms  bool
+
 	sessionLimit uint64
 	sessionsLock sync.Mutex
 	sessions     map[string]bool
+
+	// Set for backends that match multiple instances through a wildcard url
+	// or regular expression.
+	pattern *regexp.Regexp
+	// Set for backends of concrete instances that matched a pattern.
+	parent *Backend
 }
 
 func (b *Backend) Id() string {
@@ -59,10 +101,65 @@ func (b *Backend) Secret() []byte {
 	return b.secret
 }
 
+// configuredId returns the id of the backend in the configuration, i.e. the id
+// of the pattern for backends of concrete instances.
+func (b *Backend) configuredId() string {
+	if b.parent != nil {
+		return b.parent.id
+	}
+	return b.id
+}
+
+// ValidateChecksum returns true if the checksum of the request was created
+// with the secret or the secondary secret of the backend. Requests for backends
+// without a secret (e.g. on servers delegating backend requests) are always
+// rejected.
+func (b *Backend) ValidateChecksum(r *http.Request, body []byte) bool {
+	if len(b.secret) == 0 {
+		return false
+	}
+
+	validate := (*backendChecksumKey).validate
+	if IsBackendChecksumV2(r) {
+		now := time.Now()
+		validate = func(key *backendChecksumKey, r *http.Request, body []byte) bool {
+			return key.validateV2(r, body, now)
+		}
+	}
+
+	if validate(b.secretKey, r, body) {
+		return true
+	}
+
+	if len(b.secondarySecret) == 0 || !validate(b.secondarySecretKey, r, body) {
+		return false
+	}
+
+	statsBackendSecondarySecretTotal.WithLabelValues(b.configuredId()).Inc()
+	return true
+}
+
+// reuseChecksumKeys keeps the cached HMAC instances of an existing backend if
+// the secrets didn't change.
+func (b *Backend) reuseChecksumKeys(existing *Backend) {
+	if bytes.Equal(b.secret, existing.secret) {
+		b.secretKey = existing.secretKey
+	}
+	if bytes.Equal(b.secondarySecret, existing.secondarySecret) {
+		b.secondarySecretKey = existing.secondarySecretKey
+	}
+}
+
 func (b *Backend) IsCompat() bool {
 	return b.compat
 }
 
+// UseAudioBridge returns true if the audio of rooms with the given type should
+// be mixed by the MCU.
+func (b *Backend) UseAudioBridge(roomType int) bool {
+	return b.audioBridgeAllRooms || b.audioBridgeRoomTypes[roomType]
+}
+
 func (b *Backend) IsUrlAllowed(u *url.URL) bool {
 	switch u.Scheme {
 	case "https":
@@ -75,6 +172,11 @@ func (b *Backend) IsUrlAllowed(u *url.URL) bool {
 }
 
 func (b *Backend) AddSession(session Session) error {
+	if b.parent != nil {
+		// The session limit applies to all instances of a pattern.
+		return b.parent.AddSession(session)
+	}
+
 	if session.ClientType() == HelloClientTypeInternal || session.ClientType() == HelloClientTypeVirtual {
 		// Internal and virtual sessions are not counting to the limit.
 		return nil
@@ -99,14 +201,78 @@ func (b *Backend) AddSession(session Session) error {
 }
 
 func (b *Backend) RemoveSession(session Session) {
+	if b.parent != nil {
+		b.parent.RemoveSession(session)
+		return
+	}
+
 	b.sessionsLock.Lock()
 	defer b.sessionsLock.Unlock()
 
 	delete(b.sessions, session.PublicId())
 }
 
+func configureAudioBridge(backend *Backend, config *goconf.ConfigFile, section string) {
+	value, _ := config.GetString(section, "audiobridge")
+	for _, roomType := range strings.Fields(value) {
+		if roomType == "*" {
+			backend.audioBridgeAllRooms = true
+			continue
+		}
+
+		t, err := strconv.Atoi(roomType)
+		if err != nil {
+			log.Printf("Backend %s has an invalid room type %s configured for the audio bridge, ignoring", backend.id, roomType)
+			continue
+		}
+
+		if backend.audioBridgeRoomTypes == nil {
+			backend.audioBridgeRoomTypes = make(map[int]bool)
+		}
+		backend.audioBridgeRoomTypes[t] = true
+	}
+
+	if backend.audioBridgeAllRooms {
+		log.Printf("Backend %s uses the audio bridge for all rooms", backend.id)
+	} else if len(backend.audioBridgeRoomTypes) > 0 {
+		log.Printf("Backend %s uses the audio bridge for room types %s", backend.id, value)
+	}
+}
+
+// BackendListener is notified about changes of the configured backends.
+type BackendListener interface {
+	// BackendRemoved is called after a backend was removed from the
+	// configuration.
+	BackendRemoved(backend *Backend)
+}
+
+// BackendMaintenanceListener can be implemented by a BackendListener to be
+// notified when a backend enters or leaves maintenance.
+type BackendMaintenanceListener interface {
+	BackendMaintenanceChanged(id string, maintenance bool)
+}
+
 type BackendConfiguration struct {
+	mu       sync.RWMutex
 	backends map[string][]*Backend
+	// Number of backends matching multiple instances.
+	numPatterns int
+	// Ids of backends that are in maintenance.
+	maintenance map[string]bool
+
+	// Backends are received from etcd if a client is set.
+	etcdClient *EtcdClient
+	etcdPrefix string
+	etcdCancel context.CancelFunc
+
+	// Backends managed through the admin API if the backends are configured
+	// statically.
+	fileMu       sync.Mutex
+	backendsFile string
+	fileBackends map[string]*BackendInformationEtcd
+
+	listenersMu sync.Mutex
+	listeners   map[BackendListener]bool
 
 	// Deprecated
 	allowAll      bool
@@ -114,7 +280,7 @@ type BackendConfiguration struct {
 	compatBackend *Backend
 }
 
-func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration, error) {
+func NewBackendConfiguration(config *goconf.ConfigFile, etcdClient *EtcdClient) (*BackendConfiguration, error) {
 	allowAll, _ := config.GetBool("backend", "allowall")
 	allowHttp, _ := config.GetBool("backend", "allowhttp")
 	commonSecret, _ := config.GetString("backend", "secret")
@@ -122,6 +288,23 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 	if err != nil || sessionLimit < 0 {
 		sessionLimit = 0
 	}
+	backendType, _ := config.GetString("backend", "backendtype")
+	switch backendType {
+	case "":
+		backendType = BackendTypeStatic
+	case BackendTypeStatic:
+	case BackendTypeEtcd:
+	default:
+		return nil, fmt.Errorf("unsupported backend type: %s", backendType)
+	}
+
+	RegisterBackendConfigurationStats()
+	if backendType == BackendTypeEtcd {
+		return newBackendConfigurationEtcd(config, etcdClient)
+	}
+
+	backendsFile, _ := config.GetString("backend", "backendsfile")
+	var fileBackends map[string]*BackendInformationEtcd
 	backends := make(map[string][]*Backend)
 	var compatBackend *Backend
 	numBackends := 0
@@ -132,16 +315,24 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 			secret: []byte(commonSecret),
 			compat: true,
 
+			secretKey: newBackendChecksumKey([]byte(commonSecret)),
+
 			allowHttp: allowHttp,
 
 			sessionLimit: uint64(sessionLimit),
 		}
+		configureAudioBridge(compatBackend, config, "backend")
 		if sessionLimit > 0 {
 			log.Printf("Allow a maximum of %d sessions", sessionLimit)
 		}
 		numBackends++
-	} else if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
-		for host, configuredBackends := range getConfiguredHosts(backendIds, config) {
+	} else if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" || backendsFile != "" {
+		configuredHosts := getConfiguredHosts(backendIds, config)
+		if fileBackends, err = loadBackendsFile(backendsFile, configuredHosts); err != nil {
+			return nil, err
+		}
+
+		for host, configuredBackends := range configuredHosts {
 			backends[host] = append(backends[host], configuredBackends...)
 			for _, be := range configuredBackends {
 				log.Printf("Backend %s added for %s", be.id, be.url)
@@ -170,10 +361,13 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 				secret: []byte(commonSecret),
 				compat: true,
 
+				secretKey: newBackendChecksumKey([]byte(commonSecret)),
+
 				allowHttp: allowHttp,
 
 				sessionLimit: uint64(sessionLimit),
 			}
+			configureAudioBridge(compatBackend, config, "backend")
 			hosts := make([]string, 0, len(allowMap))
 			for host := range allowMap {
 				hosts = append(hosts, host)
@@ -190,33 +384,97 @@ func NewBackendConfiguration(config *goconf.ConfigFile) (*BackendConfiguration,
 		}
 	}
 
-	RegisterBackendConfigurationStats()
 	statsBackendsCurrent.Add(float64(numBackends))
 
-	return &BackendConfiguration{
+	result := &BackendConfiguration{
 		backends: backends,
 
+		backendsFile: backendsFile,
+		fileBackends: fileBackends,
+
 		allowAll:      allowAll,
 		commonSecret:  []byte(commonSecret),
 		compatBackend: compatBackend,
-	}, nil
+	}
+	result.updatePatternsLocked()
+	result.updateMaintenanceLocked()
+	return result, nil
+}
+
+func (b *BackendConfiguration) AddListener(listener BackendListener) {
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+
+	if b.listeners == nil {
+		b.listeners = make(map[BackendListener]bool)
+	}
+	b.listeners[listener] = true
+}
+
+func (b *BackendConfiguration) RemoveListener(listener BackendListener) {
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+
+	delete(b.listeners, listener)
+}
+
+func (b *BackendConfiguration) notifyBackendRemoved(backend *Backend) {
+	statsBackendLimitExceededTotal.DeleteLabelValues(backend.id)
+	statsBackendSecondarySecretTotal.DeleteLabelValues(backend.id)
+
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+
+	for listener := range b.listeners {
+		listener.BackendRemoved(backend)
+	}
+}
+
+func (b *BackendConfiguration) notifyMaintenanceChanged(changed map[string]bool) {
+	if len(changed) == 0 {
+		return
+	}
+
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+
+	for id, maintenance := range changed {
+		for listener := range b.listeners {
+			if l, ok := listener.(BackendMaintenanceListener); ok {
+				l.BackendMaintenanceChanged(id, maintenance)
+			}
+		}
+	}
 }
 
 func (b *BackendConfiguration) RemoveBackendsForHost(host string) {
-	if oldBackends := b.backends[host]; len(oldBackends) > 0 {
+	b.mu.Lock()
+	oldBackends := b.backends[host]
+	if len(oldBackends) > 0 {
 		for _, backend := range oldBackends {
 			log.Printf("Backend %s removed for %s", backend.id, backend.url)
 		}
 		statsBackendsCurrent.Sub(float64(len(oldBackends)))
 	}
 	delete(b.backends, host)
+	b.updatePatternsLocked()
+	changed := b.updateMaintenanceLocked()
+	b.mu.Unlock()
+
+	for _, backend := range oldBackends {
+		b.notifyBackendRemoved(backend)
+	}
+	b.notifyMaintenanceChanged(changed)
 }
 
 func (b *BackendConfiguration) UpsertHost(host string, backends []*Backend) {
+	b.mu.Lock()
+	var removedBackends []*Backend
 	for existingIndex, existingBackend := range b.backends[host] {
 		found := false
 		index := 0
 		for _, newBackend := range backends {
+			newBackend.reuseChecksumKeys(existingBackend)
 			if reflect.DeepEqual(existingBackend, newBackend) { // otherwise we could manually compare the struct members here
 				found = true
 				backends = append(backends[:index], backends[index+1:]...)
@@ -235,6 +493,7 @@ func (b *BackendConfiguration) UpsertHost(host string, backends []*Backend) {
 			log.Printf("Backend %s removed for %s", removed.id, removed.url)
 			b.backends[host] = append(b.backends[host][:existingIndex], b.backends[host][existingIndex+1:]...)
 			statsBackendsCurrent.Dec()
+			removedBackends = append(removedBackends, removed)
 		}
 	}
 
@@ -243,6 +502,22 @@ func (b *BackendConfiguration) UpsertHost(host string, backends []*Backend) {
 		log.Printf("Backend %s added for %s", added.id, added.url)
 	}
 	statsBackendsCurrent.Add(float64(len(backends)))
+	b.updatePatternsLocked()
+	changed := b.updateMaintenanceLocked()
+	b.mu.Unlock()
+
+	for _, removed := range removedBackends {
+		b.notifyBackendRemoved(removed)
+	}
+	b.notifyMaintenanceChanged(changed)
+}
+
+// HasBackendsForHost returns true if there are backends configured for the
+// given host.
+func (b *BackendConfiguration) HasBackendsForHost(host string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.backends[host]) > 0
 }
 
 func getConfiguredBackendIDs(backendIds string) (ids []string) {
@@ -266,32 +541,64 @@ func getConfiguredBackendIDs(backendIds string) (ids []string) {
 
 func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map[string][]*Backend) {
 	hosts = make(map[string][]*Backend)
+	// Backend requests are signed by the server they are delegated to.
+	delegated, _ := config.GetString("grpc", "delegate")
 	for _, id := range getConfiguredBackendIDs(backendIds) {
 		u, _ := config.GetString(id, "url")
-		if u == "" {
-			log.Printf("Backend %s is missing or incomplete, skipping", id)
-			continue
-		}
+		urlRegex, _ := config.GetString(id, "urlregex")
+		var host string
+		var allowHttp bool
+		var pattern *regexp.Regexp
+		if u == "" && urlRegex != "" {
+			var err error
+			if pattern, err = compileRegexBackendUrl(urlRegex); err != nil {
+				log.Printf("Backend %s has an invalid url regex %s configured (%s), skipping", id, urlRegex, err)
+				continue
+			}
 
-		if u[len(u)-1] != '/' {
-			u += "/"
-		}
-		parsed, err := url.Parse(u)
-		if err != nil {
-			log.Printf("Backend %s has an invalid url %s configured (%s), skipping", id, u, err)
-			continue
-		}
+			// The expression defines the allowed schemes.
+			u = backendRegexPrefix + urlRegex
+			host = u
+			allowHttp = true
+		} else {
+			if u == "" {
+				log.Printf("Backend %s is missing or incomplete, skipping", id)
+				continue
+			}
+
+			if u[len(u)-1] != '/' {
+				u += "/"
+			}
+			parsed, err := url.Parse(u)
+			if err != nil {
+				log.Printf("Backend %s has an invalid url %s configured (%s), skipping", id, u, err)
+				continue
+			}
 
-		if strings.Contains(parsed.Host, ":") && hasStandardPort(parsed) {
-			parsed.Host = parsed.Hostname()
-			u = parsed.String()
+			if strings.Contains(parsed.Host, ":") && hasStandardPort(parsed) {
+				parsed.Host = parsed.Hostname()
+				u = parsed.String()
+			}
+
+			if isWildcardBackendUrl(parsed) {
+				if pattern, err = compileWildcardBackendUrl(parsed); err != nil {
+					log.Printf("Backend %s has an invalid url %s configured (%s), skipping", id, u, err)
+					continue
+				}
+			}
+			host = parsed.Host
+			allowHttp = parsed.Scheme == "http"
 		}
 
 		secret, _ := config.GetString(id, "secret")
-		if u == "" || secret == "" {
+		if u == "" || (secret == "" && delegated == "") {
 			log.Printf("Backend %s is missing or incomplete, skipping", id)
 			continue
 		}
+		secondarySecret, _ := config.GetString(id, "secondarysecret")
+		if secondarySecret != "" {
+			log.Printf("Backend %s also accepts the secondary secret", id)
+		}
 
 		sessionLimit, err := config.GetInt(id, "sessionlimit")
 		if err != nil || sessionLimit < 0 {
@@ -301,6 +608,21 @@ func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map
 			log.Printf("Backend %s allows a maximum of %d sessions", id, sessionLimit)
 		}
 
+		tlsSettings, err := getTLSClientSettings(config, id)
+		if err != nil {
+			log.Printf("Backend %s has invalid TLS settings (%s), skipping", id, err)
+			continue
+		}
+
+		maxConcurrentRequests, err := config.GetInt(id, "connections")
+		if err != nil || maxConcurrentRequests < 0 {
+			maxConcurrentRequests = 0
+		}
+		maxIdleConnections, err := config.GetInt(id, "idleconnections")
+		if err != nil || maxIdleConnections < 0 {
+			maxIdleConnections = 0
+		}
+
 		maxStreamBitrate, err := config.GetInt(id, "maxstreambitrate")
 		if err != nil || maxStreamBitrate < 0 {
 			maxStreamBitrate = 0
@@ -310,18 +632,50 @@ func getConfiguredHosts(backendIds string, config *goconf.ConfigFile) (hosts map
 			maxScreenBitrate = 0
 		}
 
-		hosts[parsed.Host] = append(hosts[parsed.Host], &Backend{
+		pingInterval, err := config.GetInt(id, "pinginterval")
+		if err != nil || pingInterval < 0 {
+			pingInterval = 0
+		}
+		idlePingInterval, err := config.GetInt(id, "idlepinginterval")
+		if err != nil || idlePingInterval < 0 {
+			idlePingInterval = 0
+		}
+		maintenance, _ := config.GetBool(id, "maintenance")
+
+		backend := &Backend{
 			id:     id,
 			url:    u,
 			secret: []byte(secret),
 
-			allowHttp: parsed.Scheme == "http",
+			secondarySecret: []byte(secondarySecret),
+
+			secretKey:          newBackendChecksumKey([]byte(secret)),
+			secondarySecretKey: newBackendChecksumKey([]byte(secondarySecret)),
+
+			allowHttp: allowHttp,
+
+			tlsSettings: tlsSettings,
+
+			maxConcurrentRequests: maxConcurrentRequests,
+			maxIdleConnections:    maxIdleConnections,
 
 			maxStreamBitrate: maxStreamBitrate,
 			maxScreenBitrate: maxScreenBitrate,
 
+			pingInterval:     pingInterval,
+			idlePingInterval: idlePingInterval,
+
+			maintenance: maintenance,
+
 			sessionLimit: uint64(sessionLimit),
-		})
+
+			pattern: pattern,
+		}
+		configureAudioBridge(backend, config, id)
+		if pattern != nil {
+			log.Printf("Backend %s matches instances of %s", id, u)
+		}
+		hosts[host] = append(hosts[host], backend)
 	}
 
 	return hosts
@@ -331,17 +685,37 @@ func (b *BackendConfiguration) Reload(config *goconf.ConfigFile) {
 	if b.compatBackend != nil {
 		log.Println("Old-style configuration active, reload is not supported")
 		return
+	} else if b.etcdClient != nil {
+		// Backends are updated automatically when they change in etcd.
+		return
 	}
 
-	if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" {
+	backendsFile, _ := config.GetString("backend", "backendsfile")
+	if backendIds, _ := config.GetString("backend", "backends"); backendIds != "" || backendsFile != "" {
 		configuredHosts := getConfiguredHosts(backendIds, config)
+		b.fileMu.Lock()
+		fileBackends, err := loadBackendsFile(backendsFile, configuredHosts)
+		if err != nil {
+			b.fileMu.Unlock()
+			log.Printf("Could not reload backends, keeping current: %s", err)
+			return
+		}
+		b.backendsFile = backendsFile
+		b.fileBackends = fileBackends
+		b.fileMu.Unlock()
 
 		// remove backends that are no longer configured
+		b.mu.RLock()
+		var removed []string
 		for hostname := range b.backends {
 			if _, ok := configuredHosts[hostname]; !ok {
-				b.RemoveBackendsForHost(hostname)
+				removed = append(removed, hostname)
 			}
 		}
+		b.mu.RUnlock()
+		for _, hostname := range removed {
+			b.RemoveBackendsForHost(hostname)
+		}
 
 		// rewrite backends adding newly configured ones and rewriting existing ones
 		for hostname, configuredBackends := range configuredHosts {
@@ -350,6 +724,134 @@ func (b *BackendConfiguration) Reload(config *goconf.ConfigFile) {
 	}
 }
 
+func newBackendFromInformation(id string, info *BackendInformationEtcd) *Backend {
+	return &Backend{
+		id:     id,
+		url:    info.Url,
+		secret: []byte(info.Secret),
+
+		secondarySecret: []byte(info.SecondarySecret),
+
+		secretKey:          newBackendChecksumKey([]byte(info.Secret)),
+		secondarySecretKey: newBackendChecksumKey([]byte(info.SecondarySecret)),
+
+		allowHttp: info.parsedUrl.Scheme == "http",
+
+		maxConcurrentRequests: info.Connections,
+		maxIdleConnections:    info.IdleConnections,
+
+		maxStreamBitrate: info.MaxStreamBitrate,
+		maxScreenBitrate: info.MaxScreenBitrate,
+
+		pingInterval:     info.PingInterval,
+		idlePingInterval: info.IdlePingInterval,
+
+		maintenance: info.Maintenance,
+
+		sessionLimit: info.SessionLimit,
+
+		pattern: info.pattern,
+	}
+}
+
+func getBackendHost(backend *Backend) string {
+	if strings.HasPrefix(backend.url, backendRegexPrefix) {
+		return backend.url
+	}
+
+	u, err := url.Parse(backend.url)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+func (b *BackendConfiguration) getBackendByIdLocked(id string) *Backend {
+	for _, entries := range b.backends {
+		for _, entry := range entries {
+			if entry.id == id {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// GetBackendById returns the backend with the given id or nil if no such
+// backend exists.
+func (b *BackendConfiguration) GetBackendById(id string) *Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.getBackendByIdLocked(id)
+}
+
+// removeBackendLocked removes a backend from the list of its host. The lock
+// must be held by the caller.
+func (b *BackendConfiguration) removeBackendLocked(backend *Backend) {
+	host := getBackendHost(backend)
+	entries := b.backends[host]
+	for idx, entry := range entries {
+		if entry == backend {
+			entries = append(entries[:idx], entries[idx+1:]...)
+			break
+		}
+	}
+	if len(entries) > 0 {
+		b.backends[host] = entries
+	} else {
+		delete(b.backends, host)
+	}
+}
+
+// setBackend adds a backend or replaces an existing backend with the same id.
+func (b *BackendConfiguration) setBackend(backend *Backend) {
+	host := getBackendHost(backend)
+	b.mu.Lock()
+	var removed *Backend
+	if prev := b.getBackendByIdLocked(backend.id); prev != nil {
+		b.removeBackendLocked(prev)
+		if prev.url != backend.url {
+			removed = prev
+		}
+		log.Printf("Backend %s updated for %s", backend.id, backend.url)
+	} else {
+		statsBackendsCurrent.Inc()
+		log.Printf("Backend %s added for %s", backend.id, backend.url)
+	}
+	b.backends[host] = append(b.backends[host], backend)
+	b.updatePatternsLocked()
+	changed := b.updateMaintenanceLocked()
+	b.mu.Unlock()
+
+	if removed != nil {
+		b.notifyBackendRemoved(removed)
+	}
+	b.notifyMaintenanceChanged(changed)
+}
+
+// removeBackend removes the backend with the given id and returns false if
+// no such backend exists.
+func (b *BackendConfiguration) removeBackend(id string) bool {
+	b.mu.Lock()
+	backend := b.getBackendByIdLocked(id)
+	if backend == nil {
+		b.mu.Unlock()
+		return false
+	}
+
+	b.removeBackendLocked(backend)
+	statsBackendsCurrent.Dec()
+	b.updatePatternsLocked()
+	changed := b.updateMaintenanceLocked()
+	b.mu.Unlock()
+
+	log.Printf("Backend %s removed for %s", backend.id, backend.url)
+	b.notifyBackendRemoved(backend)
+	b.notifyMaintenanceChanged(changed)
+	return true
+}
+
 func (b *BackendConfiguration) GetCompatBackend() *Backend {
 	return b.compatBackend
 }
@@ -359,20 +861,15 @@ func (b *BackendConfiguration) GetBackend(u *url.URL) *Backend {
 		u.Host = u.Hostname()
 	}
 
-	entries, found := b.backends[u.Host]
-	if !found {
-		if b.allowAll {
-			return b.compatBackend
-		}
-		return nil
-	}
-
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	s := u.String()
 	if s[len(s)-1] != '/' {
 		s += "/"
 	}
+	entries, found := b.backends[u.Host]
 	for _, entry := range entries {
-		if !entry.IsUrlAllowed(u) {
+		if entry.pattern != nil || !entry.IsUrlAllowed(u) {
 			continue
 		}
 
@@ -384,10 +881,97 @@ func (b *BackendConfiguration) GetBackend(u *url.URL) *Backend {
 		}
 	}
 
+	if backend := b.getPatternBackendLocked(u, s); backend != nil {
+		return backend
+	}
+
+	if !found && b.allowAll {
+		return b.compatBackend
+	}
 	return nil
 }
 
+// updatePatternsLocked must be called after the backends have been modified.
+// The lock must be held by the caller.
+func (b *BackendConfiguration) updatePatternsLocked() {
+	count := 0
+	for _, entries := range b.backends {
+		for _, entry := range entries {
+			if entry.pattern != nil {
+				count++
+			}
+		}
+	}
+	b.numPatterns = count
+}
+
+// updateMaintenanceLocked must be called after the backends have been modified
+// and returns the ids of backends that entered (true) or left (false)
+// maintenance. The lock must be held by the caller.
+func (b *BackendConfiguration) updateMaintenanceLocked() map[string]bool {
+	maintenance := make(map[string]bool)
+	for _, entries := range b.backends {
+		for _, entry := range entries {
+			if entry.maintenance {
+				maintenance[entry.id] = true
+			}
+		}
+	}
+
+	changed := make(map[string]bool)
+	for id := range maintenance {
+		if !b.maintenance[id] {
+			log.Printf("Backend %s is in maintenance", id)
+			changed[id] = true
+		}
+	}
+	for id := range b.maintenance {
+		if !maintenance[id] {
+			log.Printf("Backend %s is no longer in maintenance", id)
+			changed[id] = false
+		}
+	}
+	b.maintenance = maintenance
+	return changed
+}
+
+// IsInMaintenance returns true if the given backend (or the pattern backend
+// it was created from) is currently in maintenance.
+func (b *BackendConfiguration) IsInMaintenance(backend *Backend) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.maintenance[backend.configuredId()]
+}
+
+// getPatternBackendLocked returns the backend of the instance at the given url
+// if it matches a wildcard or regex backend. The longest match is used if
+// multiple patterns match. The lock must be held by the caller.
+func (b *BackendConfiguration) getPatternBackendLocked(u *url.URL, s string) *Backend {
+	if b.numPatterns == 0 {
+		return nil
+	}
+
+	// Hostnames are case-insensitive.
+	if host := strings.ToLower(u.Host); host != u.Host {
+		s = strings.Replace(s, u.Host, host, 1)
+	}
+
+	var result *Backend
+	for _, entries := range b.backends {
+		for _, entry := range entries {
+			if instance := entry.matchInstance(u, s); instance != nil {
+				if result == nil || len(instance.url) > len(result.url) {
+					result = instance
+				}
+			}
+		}
+	}
+	return result
+}
+
 func (b *BackendConfiguration) GetBackends() []*Backend {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	var result []*Backend
 	for _, entries := range b.backends {
 		result = append(result, entries...)
@@ -0,0 +1,276 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+var (
+	ErrBackendStorageNotConfigured = errors.New("no storage for backends configured")
+	ErrBackendReadOnly             = errors.New("backend is defined in the configuration file")
+	ErrBackendNotFound             = errors.New("backend not found")
+	ErrBackendNoSecondarySecret    = errors.New("backend has no secondary secret")
+)
+
+// loadBackendsFile adds the backends stored in the given file to "hosts". The
+// file contains a JSON object mapping backend ids to their information in the
+// same format as used in etcd. Backends with an id that is already configured
+// are ignored.
+func loadBackendsFile(filename string, hosts map[string][]*Backend) (map[string]*BackendInformationEtcd, error) {
+	backends := make(map[string]*BackendInformationEtcd)
+	if filename == "" {
+		return backends, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return backends, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read backends from %s: %w", filename, err)
+	}
+
+	if err := json.Unmarshal(data, &backends); err != nil {
+		return nil, fmt.Errorf("could not decode backends from %s: %w", filename, err)
+	}
+
+	configured := make(map[string]bool)
+	for _, entries := range hosts {
+		for _, entry := range entries {
+			configured[entry.id] = true
+		}
+	}
+
+	for id, info := range backends {
+		if configured[id] {
+			log.Printf("Backend %s from %s is already configured, ignoring", id, filename)
+			delete(backends, id)
+			continue
+		}
+		if err := info.CheckValid(); err != nil {
+			log.Printf("Backend %s from %s is invalid (%s), ignoring", id, filename, err)
+			delete(backends, id)
+			continue
+		}
+
+		host := info.parsedUrl.Host
+		hosts[host] = append(hosts[host], newBackendFromInformation(id, info))
+	}
+	return backends, nil
+}
+
+func writeBackendsFile(filename string, backends map[string]*BackendInformationEtcd) error {
+	data, err := json.MarshalIndent(backends, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a partial file.
+	if err := os.WriteFile(filename+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// newBackendInformation returns the information to store the given backend.
+func newBackendInformation(backend *Backend) *BackendInformationEtcd {
+	return &BackendInformationEtcd{
+		Url:    backend.url,
+		Secret: string(backend.secret),
+
+		SecondarySecret: string(backend.secondarySecret),
+
+		SessionLimit: backend.sessionLimit,
+
+		MaxStreamBitrate: backend.maxStreamBitrate,
+		MaxScreenBitrate: backend.maxScreenBitrate,
+
+		PingInterval:     backend.pingInterval,
+		IdlePingInterval: backend.idlePingInterval,
+
+		Maintenance: backend.maintenance,
+
+		Connections:     backend.maxConcurrentRequests,
+		IdleConnections: backend.maxIdleConnections,
+	}
+}
+
+// IsBackendReadOnly returns true if the backend with the given id can't be
+// changed through StoreBackend / DeleteBackend.
+func (b *BackendConfiguration) IsBackendReadOnly(id string) bool {
+	if b.etcdClient != nil {
+		return false
+	}
+
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+	_, found := b.fileBackends[id]
+	return !found
+}
+
+// GetBackendSource returns where the backend with the given id is configured.
+func (b *BackendConfiguration) GetBackendSource(id string) string {
+	if b.etcdClient != nil {
+		return ConfigSourceEtcd
+	} else if b.IsBackendReadOnly(id) {
+		return ConfigSourceFile
+	}
+
+	return ConfigSourceBackendsFile
+}
+
+// StoreBackend adds or replaces the backend with the given id and persists it
+// in etcd or the backends file.
+func (b *BackendConfiguration) StoreBackend(ctx context.Context, id string, info *BackendInformationEtcd) error {
+	if err := info.CheckValid(); err != nil {
+		return err
+	}
+
+	if b.etcdClient != nil {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.etcdClient.Put(ctx, b.etcdPrefix+id, string(data)); err != nil {
+			return err
+		}
+	} else {
+		b.fileMu.Lock()
+		defer b.fileMu.Unlock()
+		if b.backendsFile == "" || b.compatBackend != nil {
+			return ErrBackendStorageNotConfigured
+		}
+		if _, found := b.fileBackends[id]; !found && b.GetBackendById(id) != nil {
+			return ErrBackendReadOnly
+		}
+
+		backends := make(map[string]*BackendInformationEtcd, len(b.fileBackends)+1)
+		for k, v := range b.fileBackends {
+			backends[k] = v
+		}
+		backends[id] = info
+		if err := writeBackendsFile(b.backendsFile, backends); err != nil {
+			return err
+		}
+		b.fileBackends = backends
+	}
+
+	// Changes in etcd will also be received through the watch, apply them
+	// directly so they are visible immediately.
+	b.setBackend(newBackendFromInformation(id, info))
+	return nil
+}
+
+// DeleteBackend removes the backend with the given id from etcd or the
+// backends file.
+func (b *BackendConfiguration) DeleteBackend(ctx context.Context, id string) error {
+	if b.etcdClient != nil {
+		if b.GetBackendById(id) == nil {
+			return ErrBackendNotFound
+		}
+
+		if _, err := b.etcdClient.Delete(ctx, b.etcdPrefix+id); err != nil {
+			return err
+		}
+	} else {
+		b.fileMu.Lock()
+		defer b.fileMu.Unlock()
+		if _, found := b.fileBackends[id]; !found {
+			if b.GetBackendById(id) != nil {
+				return ErrBackendReadOnly
+			}
+			return ErrBackendNotFound
+		}
+
+		backends := make(map[string]*BackendInformationEtcd, len(b.fileBackends))
+		for k, v := range b.fileBackends {
+			if k != id {
+				backends[k] = v
+			}
+		}
+		if err := writeBackendsFile(b.backendsFile, backends); err != nil {
+			return err
+		}
+		b.fileBackends = backends
+	}
+
+	b.removeBackend(id)
+	return nil
+}
+
+// PromoteSecondarySecret replaces the secret of the backend with the given id
+// by its secondary secret once the rotation is complete, i.e. the backend only
+// uses the new secret. The previous secret will no longer be accepted.
+func (b *BackendConfiguration) PromoteSecondarySecret(ctx context.Context, id string) error {
+	if b.IsBackendReadOnly(id) {
+		if b.GetBackendById(id) != nil {
+			return ErrBackendReadOnly
+		}
+		return ErrBackendNotFound
+	}
+
+	backend := b.GetBackendById(id)
+	if backend == nil {
+		return ErrBackendNotFound
+	} else if len(backend.secondarySecret) == 0 {
+		return ErrBackendNoSecondarySecret
+	}
+
+	info := newBackendInformation(backend)
+	info.Secret = string(backend.secondarySecret)
+	info.SecondarySecret = ""
+	if err := b.StoreBackend(ctx, id, info); err != nil {
+		return err
+	}
+
+	log.Printf("Promoted secondary secret of backend %s", id)
+	return nil
+}
+
+// SetMaintenance changes the maintenance mode of the backend with the given
+// id. While in maintenance, no new sessions are accepted for the backend and
+// requests to it are delayed.
+func (b *BackendConfiguration) SetMaintenance(ctx context.Context, id string, maintenance bool) error {
+	if b.IsBackendReadOnly(id) {
+		if b.GetBackendById(id) != nil {
+			return ErrBackendReadOnly
+		}
+		return ErrBackendNotFound
+	}
+
+	backend := b.GetBackendById(id)
+	if backend == nil {
+		return ErrBackendNotFound
+	} else if backend.maintenance == maintenance {
+		return nil
+	}
+
+	info := newBackendInformation(backend)
+	info.Maintenance = maintenance
+	return b.StoreBackend(ctx, id, info)
+}
@@ -0,0 +1,125 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestBackendConfigurationStoreFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "backends.json")
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend", "backendsfile", filename)
+	config.AddOption("backend1", "url", "https://domain1.invalid/")
+	config.AddOption("backend1", "secret", "secret1")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := &testBackendListener{}
+	cfg.AddListener(listener)
+	defer cfg.RemoveListener(listener)
+
+	ctx := context.Background()
+	if err := cfg.StoreBackend(ctx, "backend1", &BackendInformationEtcd{Url: "https://domain1.invalid", Secret: "changed"}); err != ErrBackendReadOnly {
+		t.Errorf("expected ErrBackendReadOnly, got %v", err)
+	}
+	if err := cfg.DeleteBackend(ctx, "backend1"); err != ErrBackendReadOnly {
+		t.Errorf("expected ErrBackendReadOnly, got %v", err)
+	}
+	if err := cfg.DeleteBackend(ctx, "unknown"); err != ErrBackendNotFound {
+		t.Errorf("expected ErrBackendNotFound, got %v", err)
+	}
+	if err := cfg.StoreBackend(ctx, "backend2", &BackendInformationEtcd{Url: "https://domain1.invalid/foo"}); err == nil {
+		t.Error("should have failed without secret")
+	}
+
+	if err := cfg.StoreBackend(ctx, "backend2", &BackendInformationEtcd{Url: "https://domain2.invalid/foo", Secret: "secret2", SessionLimit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if backend := cfg.GetBackend(&url.URL{Scheme: "https", Host: "domain2.invalid", Path: "/foo/bar"}); backend == nil || backend.Id() != "backend2" {
+		t.Errorf("expected backend2, got %+v", backend)
+	} else if backend.sessionLimit != 10 {
+		t.Errorf("expected session limit 10, got %d", backend.sessionLimit)
+	}
+	if cfg.IsBackendReadOnly("backend2") {
+		t.Error("backend2 should not be read-only")
+	}
+	if !cfg.IsBackendReadOnly("backend1") {
+		t.Error("backend1 should be read-only")
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("backends file should have been written: %s", err)
+	}
+
+	// Backends from the file are loaded when the configuration is reloaded.
+	cfg.Reload(config)
+	if backend := cfg.GetBackendById("backend2"); backend == nil {
+		t.Error("backend2 should still exist")
+	}
+	if removed := listener.getRemoved(); len(removed) > 0 {
+		t.Errorf("expected no backends to be removed, got %+v", removed)
+	}
+
+	cfg2, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend := cfg2.GetBackendById("backend2"); backend == nil || string(backend.Secret()) != "secret2" {
+		t.Errorf("backend2 should have been loaded, got %+v", backend)
+	}
+
+	if err := cfg.DeleteBackend(ctx, "backend2"); err != nil {
+		t.Fatal(err)
+	}
+	if backend := cfg.GetBackendById("backend2"); backend != nil {
+		t.Errorf("backend2 should have been removed, got %+v", backend)
+	}
+	if removed := listener.getRemoved(); !reflect.DeepEqual(removed, []string{"backend2"}) {
+		t.Errorf("expected backend2 to be removed, got %+v", removed)
+	}
+}
+
+func TestBackendConfigurationStoreNotConfigured(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend1", "url", "https://domain1.invalid/")
+	config.AddOption("backend1", "secret", "secret1")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.StoreBackend(context.Background(), "backend2", &BackendInformationEtcd{Url: "https://domain2.invalid", Secret: "secret2"}); err != ErrBackendStorageNotConfigured {
+		t.Errorf("expected ErrBackendStorageNotConfigured, got %v", err)
+	}
+}
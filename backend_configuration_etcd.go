@@ -0,0 +1,162 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func newBackendConfigurationEtcd(config *goconf.ConfigFile, etcdClient *EtcdClient) (*BackendConfiguration, error) {
+	prefix, _ := config.GetString("backend", "backendprefix")
+	if prefix == "" {
+		return nil, fmt.Errorf("no backend prefix configured for backend type %s", BackendTypeEtcd)
+	}
+	if prefix[len(prefix)-1] != '/' {
+		prefix += "/"
+	}
+
+	if etcdClient == nil {
+		return nil, ErrNoEtcdEndpoints
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &BackendConfiguration{
+		backends: make(map[string][]*Backend),
+
+		etcdClient: etcdClient,
+		etcdPrefix: prefix,
+		etcdCancel: cancel,
+	}
+	go result.watchEtcd(ctx)
+	return result, nil
+}
+
+// Close stops watching for backend changes in etcd.
+func (b *BackendConfiguration) Close() {
+	if b.etcdCancel == nil {
+		return
+	}
+
+	b.etcdCancel()
+}
+
+func (b *BackendConfiguration) watchEtcd(ctx context.Context) {
+	if err := b.etcdClient.WaitForConnection(ctx); err != nil {
+		return
+	}
+
+	log.Printf("Watching backends in %s", b.etcdPrefix)
+	waitDelay := initialWaitDelay
+	for {
+		if err := b.syncEtcd(ctx); ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Printf("Error watching backends in %s, retry in %s: %s", b.etcdPrefix, waitDelay, err)
+		} else {
+			log.Printf("Watching backends in %s was interrupted, retry in %s", b.etcdPrefix, waitDelay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(waitDelay):
+		}
+
+		waitDelay = waitDelay * 2
+		if waitDelay > maxWaitDelay {
+			waitDelay = maxWaitDelay
+		}
+	}
+}
+
+// syncEtcd loads the current backends and processes changes until the watch
+// is interrupted.
+func (b *BackendConfiguration) syncEtcd(ctx context.Context) error {
+	getCtx, cancel := context.WithTimeout(ctx, time.Second)
+	response, err := b.etcdClient.Get(getCtx, b.etcdPrefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]bool)
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		b.etcdBackendUpdated(key, kv.Value)
+		found[strings.TrimPrefix(key, b.etcdPrefix)] = true
+	}
+
+	// Remove backends that were deleted while not watching.
+	for _, backend := range b.GetBackends() {
+		if !found[backend.id] {
+			b.removeBackend(backend.id)
+		}
+	}
+
+	ch := b.etcdClient.Watch(clientv3.WithRequireLeader(ctx), b.etcdPrefix, clientv3.WithPrefix(), clientv3.WithRev(response.Header.Revision+1))
+	for response := range ch {
+		if err := response.Err(); err != nil {
+			return err
+		}
+
+		for _, ev := range response.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				b.etcdBackendUpdated(string(ev.Kv.Key), ev.Kv.Value)
+			case clientv3.EventTypeDelete:
+				b.etcdBackendDeleted(string(ev.Kv.Key))
+			default:
+				log.Printf("Unsupported event %s %q -> %q", ev.Type, ev.Kv.Key, ev.Kv.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BackendConfiguration) etcdBackendUpdated(key string, data []byte) {
+	id := strings.TrimPrefix(key, b.etcdPrefix)
+	var info BackendInformationEtcd
+	if err := json.Unmarshal(data, &info); err != nil {
+		log.Printf("Could not decode backend information %s: %s", string(data), err)
+		b.removeBackend(id)
+		return
+	}
+	if err := info.CheckValid(); err != nil {
+		log.Printf("Received invalid backend information %s: %s", string(data), err)
+		b.removeBackend(id)
+		return
+	}
+
+	b.setBackend(newBackendFromInformation(id, &info))
+}
+
+func (b *BackendConfiguration) etcdBackendDeleted(key string) {
+	b.removeBackend(strings.TrimPrefix(key, b.etcdPrefix))
+}
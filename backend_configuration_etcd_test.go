@@ -0,0 +1,153 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func waitForBackend(ctx context.Context, t *testing.T, cfg *BackendConfiguration, u string, f func(backend *Backend) bool) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if f(cfg.GetBackend(parsed)) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("backend for %s didn't reach expected state", u)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestBackendConfigurationEtcd(t *testing.T) {
+	etcd := NewEtcdForTest(t)
+
+	SetEtcdValue(etcd, "/backends/backend1", []byte(`{"url":"https://domain1.invalid/foo","secret":"secret1"}`))
+	SetEtcdValue(etcd, "/backends/invalid", []byte(`{"url":"https://domain3.invalid/"}`))
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backendtype", BackendTypeEtcd)
+	config.AddOption("backend", "backendprefix", "/backends")
+
+	cfg, err := NewBackendConfiguration(config, NewEtcdClientForTest(t, etcd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.Close()
+
+	listener := &testBackendListener{}
+	cfg.AddListener(listener)
+	defer cfg.RemoveListener(listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	waitForBackend(ctx, t, cfg, "https://domain1.invalid/foo/room", func(backend *Backend) bool {
+		return backend != nil && backend.Id() == "backend1" && string(backend.Secret()) == "secret1"
+	})
+	if backend := cfg.GetBackend(&url.URL{Scheme: "https", Host: "domain3.invalid", Path: "/"}); backend != nil {
+		t.Errorf("invalid backend should not have been added, got %+v", backend)
+	}
+
+	// Changes are applied automatically.
+	SetEtcdValue(etcd, "/backends/backend2", []byte(`{"url":"https://domain2.invalid","secret":"secret2","sessionlimit":2}`))
+	waitForBackend(ctx, t, cfg, "https://domain2.invalid/room", func(backend *Backend) bool {
+		return backend != nil && backend.Id() == "backend2" && backend.sessionLimit == 2
+	})
+
+	SetEtcdValue(etcd, "/backends/backend1", []byte(`{"url":"https://domain1.invalid/foo","secret":"secret1-changed"}`))
+	waitForBackend(ctx, t, cfg, "https://domain1.invalid/foo/room", func(backend *Backend) bool {
+		return backend != nil && string(backend.Secret()) == "secret1-changed"
+	})
+	if removed := listener.getRemoved(); len(removed) > 0 {
+		t.Errorf("expected no backends to be removed, got %+v", removed)
+	}
+	if backends := cfg.GetBackends(); len(backends) != 2 {
+		t.Errorf("expected two backends, got %+v", backends)
+	}
+
+	DeleteEtcdValue(etcd, "/backends/backend2")
+	waitForBackend(ctx, t, cfg, "https://domain2.invalid/room", func(backend *Backend) bool {
+		return backend == nil
+	})
+	if removed := listener.getRemoved(); !reflect.DeepEqual(removed, []string{"backend2"}) {
+		t.Errorf("expected backend2 to be removed, got %+v", removed)
+	}
+	if cfg.HasBackendsForHost("domain2.invalid") {
+		t.Error("host domain2.invalid should not have backends")
+	}
+
+	// Backends can match multiple instances through a wildcard.
+	SetEtcdValue(etcd, "/backends/wildcard", []byte(`{"url":"https://*.customer.invalid","secret":"secret-wildcard"}`))
+	waitForBackend(ctx, t, cfg, "https://cloud1.customer.invalid/room", func(backend *Backend) bool {
+		return backend != nil && backend.Id() == "wildcard@cloud1.customer.invalid" && string(backend.Secret()) == "secret-wildcard"
+	})
+	DeleteEtcdValue(etcd, "/backends/wildcard")
+	waitForBackend(ctx, t, cfg, "https://cloud1.customer.invalid/room", func(backend *Backend) bool {
+		return backend == nil
+	})
+	if removed := listener.getRemoved(); !reflect.DeepEqual(removed, []string{"wildcard"}) {
+		t.Errorf("expected wildcard to be removed, got %+v", removed)
+	}
+
+	// Moving a backend to a different url removes the previous one.
+	SetEtcdValue(etcd, "/backends/backend1", []byte(`{"url":"https://domain4.invalid/","secret":"secret1"}`))
+	waitForBackend(ctx, t, cfg, "https://domain4.invalid/room", func(backend *Backend) bool {
+		return backend != nil && backend.Id() == "backend1"
+	})
+	if backend := cfg.GetBackend(&url.URL{Scheme: "https", Host: "domain1.invalid", Path: "/foo/"}); backend != nil {
+		t.Errorf("previous backend should have been removed, got %+v", backend)
+	}
+	if removed := listener.getRemoved(); !reflect.DeepEqual(removed, []string{"backend1"}) {
+		t.Errorf("expected backend1 to be removed, got %+v", removed)
+	}
+}
+
+func TestBackendConfigurationEtcdInvalid(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backendtype", "unknown")
+	if _, err := NewBackendConfiguration(config, nil); err == nil {
+		t.Error("should have failed for unknown backend type")
+	}
+
+	config.AddOption("backend", "backendtype", BackendTypeEtcd)
+	if _, err := NewBackendConfiguration(config, nil); err == nil {
+		t.Error("should have failed without prefix")
+	}
+
+	config.AddOption("backend", "backendprefix", "/backends")
+	if _, err := NewBackendConfiguration(config, nil); err == nil {
+		t.Error("should have failed without etcd client")
+	}
+}
@@ -32,6 +32,12 @@ var (
 		Name:      "session_limit_exceeded_total",
 		Help:      "The number of times the session limit exceeded",
 	}, []string{"backend"})
+	statsBackendSecondarySecretTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "backend",
+		Name:      "secondary_secret_total",
+		Help:      "The total number of requests validated with the secondary secret",
+	}, []string{"backend"})
 	statsBackendsCurrent = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "signaling",
 		Subsystem: "backend",
@@ -41,6 +47,7 @@ var (
 
 	backendConfigurationStats = []prometheus.Collector{
 		statsBackendLimitExceededTotal,
+		statsBackendSecondarySecretTotal,
 		statsBackendsCurrent,
 	}
 )
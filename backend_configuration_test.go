@@ -23,8 +23,10 @@ package signaling
 
 import (
 	"bytes"
+	"net/http"
 	"net/url"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/dlintw/goconf"
@@ -104,7 +106,7 @@ func TestIsUrlAllowed_Compat(t *testing.T) {
 	config.AddOption("backend", "allowed", "domain.invalid")
 	config.AddOption("backend", "allowhttp", "true")
 	config.AddOption("backend", "secret", string(testBackendSecret))
-	cfg, err := NewBackendConfiguration(config)
+	cfg, err := NewBackendConfiguration(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,7 +127,7 @@ func TestIsUrlAllowed_CompatForceHttps(t *testing.T) {
 	config := goconf.NewConfigFile()
 	config.AddOption("backend", "allowed", "domain.invalid")
 	config.AddOption("backend", "secret", string(testBackendSecret))
-	cfg, err := NewBackendConfiguration(config)
+	cfg, err := NewBackendConfiguration(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,7 +172,7 @@ func TestIsUrlAllowed(t *testing.T) {
 	config.AddOption("baz", "secret", string(testBackendSecret)+"-baz")
 	config.AddOption("lala", "url", "https://otherdomain.invalid/")
 	config.AddOption("lala", "secret", string(testBackendSecret)+"-lala")
-	cfg, err := NewBackendConfiguration(config)
+	cfg, err := NewBackendConfiguration(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -187,7 +189,7 @@ func TestIsUrlAllowed_EmptyAllowlist(t *testing.T) {
 	config := goconf.NewConfigFile()
 	config.AddOption("backend", "allowed", "")
 	config.AddOption("backend", "secret", string(testBackendSecret))
-	cfg, err := NewBackendConfiguration(config)
+	cfg, err := NewBackendConfiguration(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -207,7 +209,7 @@ func TestIsUrlAllowed_AllowAll(t *testing.T) {
 	config.AddOption("backend", "allowall", "true")
 	config.AddOption("backend", "allowed", "")
 	config.AddOption("backend", "secret", string(testBackendSecret))
-	cfg, err := NewBackendConfiguration(config)
+	cfg, err := NewBackendConfiguration(config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -247,7 +249,7 @@ func TestBackendReloadNoChange(t *testing.T) {
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
 	original_config.AddOption("backend2", "url", "http://domain2.invalid")
 	original_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	o_cfg, err := NewBackendConfiguration(original_config)
+	o_cfg, err := NewBackendConfiguration(original_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -260,7 +262,7 @@ func TestBackendReloadNoChange(t *testing.T) {
 	new_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
 	new_config.AddOption("backend2", "url", "http://domain2.invalid")
 	new_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	n_cfg, err := NewBackendConfiguration(new_config)
+	n_cfg, err := NewBackendConfiguration(new_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -282,7 +284,7 @@ func TestBackendReloadChangeExistingURL(t *testing.T) {
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
 	original_config.AddOption("backend2", "url", "http://domain2.invalid")
 	original_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	o_cfg, err := NewBackendConfiguration(original_config)
+	o_cfg, err := NewBackendConfiguration(original_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -296,7 +298,7 @@ func TestBackendReloadChangeExistingURL(t *testing.T) {
 	new_config.AddOption("backend1", "sessionlimit", "10")
 	new_config.AddOption("backend2", "url", "http://domain2.invalid")
 	new_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	n_cfg, err := NewBackendConfiguration(new_config)
+	n_cfg, err := NewBackendConfiguration(new_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -322,7 +324,7 @@ func TestBackendReloadChangeSecret(t *testing.T) {
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
 	original_config.AddOption("backend2", "url", "http://domain2.invalid")
 	original_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	o_cfg, err := NewBackendConfiguration(original_config)
+	o_cfg, err := NewBackendConfiguration(original_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -335,7 +337,7 @@ func TestBackendReloadChangeSecret(t *testing.T) {
 	new_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend3")
 	new_config.AddOption("backend2", "url", "http://domain2.invalid")
 	new_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	n_cfg, err := NewBackendConfiguration(new_config)
+	n_cfg, err := NewBackendConfiguration(new_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -344,11 +346,21 @@ func TestBackendReloadChangeSecret(t *testing.T) {
 	original_config.RemoveOption("backend1", "secret")
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend3")
 
+	key1 := o_cfg.GetBackendById("backend1").secretKey
+	key2 := o_cfg.GetBackendById("backend2").secretKey
 	o_cfg.Reload(original_config)
 	checkStatsValue(t, statsBackendsCurrent, current+4)
 	if !reflect.DeepEqual(n_cfg, o_cfg) {
 		t.Error("BackendConfiguration should be equal after Reload")
 	}
+
+	// The cached HMAC instances must be replaced together with the secret.
+	if key := o_cfg.GetBackendById("backend1").secretKey; key == key1 {
+		t.Error("Checksum key should have been replaced for changed secret")
+	}
+	if key := o_cfg.GetBackendById("backend2").secretKey; key != key2 {
+		t.Error("Checksum key should have been kept for unchanged secret")
+	}
 }
 
 func TestBackendReloadAddBackend(t *testing.T) {
@@ -358,7 +370,7 @@ func TestBackendReloadAddBackend(t *testing.T) {
 	original_config.AddOption("backend", "allowall", "false")
 	original_config.AddOption("backend1", "url", "http://domain1.invalid")
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
-	o_cfg, err := NewBackendConfiguration(original_config)
+	o_cfg, err := NewBackendConfiguration(original_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -372,7 +384,7 @@ func TestBackendReloadAddBackend(t *testing.T) {
 	new_config.AddOption("backend2", "url", "http://domain2.invalid")
 	new_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
 	new_config.AddOption("backend2", "sessionlimit", "10")
-	n_cfg, err := NewBackendConfiguration(new_config)
+	n_cfg, err := NewBackendConfiguration(new_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -400,7 +412,7 @@ func TestBackendReloadRemoveHost(t *testing.T) {
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
 	original_config.AddOption("backend2", "url", "http://domain2.invalid")
 	original_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	o_cfg, err := NewBackendConfiguration(original_config)
+	o_cfg, err := NewBackendConfiguration(original_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -411,7 +423,7 @@ func TestBackendReloadRemoveHost(t *testing.T) {
 	new_config.AddOption("backend", "allowall", "false")
 	new_config.AddOption("backend1", "url", "http://domain1.invalid")
 	new_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
-	n_cfg, err := NewBackendConfiguration(new_config)
+	n_cfg, err := NewBackendConfiguration(new_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -437,7 +449,7 @@ func TestBackendReloadRemoveBackendFromSharedHost(t *testing.T) {
 	original_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
 	original_config.AddOption("backend2", "url", "http://domain1.invalid/bar/")
 	original_config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
-	o_cfg, err := NewBackendConfiguration(original_config)
+	o_cfg, err := NewBackendConfiguration(original_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -448,7 +460,7 @@ func TestBackendReloadRemoveBackendFromSharedHost(t *testing.T) {
 	new_config.AddOption("backend", "allowall", "false")
 	new_config.AddOption("backend1", "url", "http://domain1.invalid/foo/")
 	new_config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
-	n_cfg, err := NewBackendConfiguration(new_config)
+	n_cfg, err := NewBackendConfiguration(new_config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -464,3 +476,311 @@ func TestBackendReloadRemoveBackendFromSharedHost(t *testing.T) {
 		t.Error("BackendConfiguration should be equal after Reload")
 	}
 }
+
+type testBackendListener struct {
+	mu          sync.Mutex
+	removed     []string
+	maintenance map[string]bool
+}
+
+func (l *testBackendListener) BackendRemoved(backend *Backend) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removed = append(l.removed, backend.Id())
+}
+
+func (l *testBackendListener) getRemoved() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := l.removed
+	l.removed = nil
+	return result
+}
+
+func (l *testBackendListener) BackendMaintenanceChanged(id string, maintenance bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maintenance == nil {
+		l.maintenance = make(map[string]bool)
+	}
+	l.maintenance[id] = maintenance
+}
+
+func (l *testBackendListener) getMaintenance() map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := l.maintenance
+	l.maintenance = nil
+	return result
+}
+
+func TestBackendMaintenance(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1, backend2")
+	config.AddOption("backend", "allowall", "false")
+	config.AddOption("backend1", "url", "http://domain1.invalid/foo/")
+	config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
+	config.AddOption("backend1", "maintenance", "true")
+	config.AddOption("backend2", "url", "http://*.domain2.invalid/")
+	config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := &testBackendListener{}
+	cfg.AddListener(listener)
+	defer cfg.RemoveListener(listener)
+
+	u1, _ := url.Parse("http://domain1.invalid/foo/")
+	u2, _ := url.Parse("http://cloud.domain2.invalid/")
+	backend1 := cfg.GetBackend(u1)
+	backend2 := cfg.GetBackend(u2)
+	if backend1 == nil || backend2 == nil {
+		t.Fatalf("expected backends, got %+v / %+v", backend1, backend2)
+	}
+	if !cfg.IsInMaintenance(backend1) {
+		t.Error("backend1 should be in maintenance")
+	}
+	if cfg.IsInMaintenance(backend2) {
+		t.Error("backend2 should not be in maintenance")
+	}
+
+	config.RemoveOption("backend1", "maintenance")
+	config.AddOption("backend2", "maintenance", "true")
+	cfg.Reload(config)
+	if maintenance := listener.getMaintenance(); !reflect.DeepEqual(maintenance, map[string]bool{"backend1": false, "backend2": true}) {
+		t.Errorf("unexpected maintenance changes %+v", maintenance)
+	}
+	if cfg.IsInMaintenance(backend1) {
+		t.Error("backend1 should no longer be in maintenance")
+	}
+	// Instances of a pattern use the maintenance state of the pattern.
+	if !cfg.IsInMaintenance(backend2) {
+		t.Error("backend2 should be in maintenance")
+	}
+
+	// Removing a backend also ends its maintenance.
+	config.RemoveOption("backend", "backends")
+	config.AddOption("backend", "backends", "backend1")
+	config.RemoveSection("backend2")
+	cfg.Reload(config)
+	if maintenance := listener.getMaintenance(); !reflect.DeepEqual(maintenance, map[string]bool{"backend2": false}) {
+		t.Errorf("unexpected maintenance changes %+v", maintenance)
+	}
+}
+
+func TestBackendReloadNotifiesListeners(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1, backend2, backend3")
+	config.AddOption("backend", "allowall", "false")
+	config.AddOption("backend1", "url", "http://domain1.invalid/foo/")
+	config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
+	config.AddOption("backend2", "url", "http://domain1.invalid/bar/")
+	config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
+	config.AddOption("backend3", "url", "http://domain2.invalid")
+	config.AddOption("backend3", "secret", string(testBackendSecret)+"-backend3")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := &testBackendListener{}
+	cfg.AddListener(listener)
+	defer cfg.RemoveListener(listener)
+
+	// Remove backend from a host that still has other backends.
+	config.RemoveOption("backend", "backends")
+	config.AddOption("backend", "backends", "backend1, backend3")
+	config.RemoveSection("backend2")
+	cfg.Reload(config)
+	if removed := listener.getRemoved(); !reflect.DeepEqual(removed, []string{"backend2"}) {
+		t.Errorf("expected backend2 to be removed, got %+v", removed)
+	}
+	if !cfg.HasBackendsForHost("domain1.invalid") {
+		t.Error("host domain1.invalid should still have backends")
+	}
+
+	// Remove the last backend of a host.
+	config.RemoveOption("backend", "backends")
+	config.AddOption("backend", "backends", "backend1")
+	config.RemoveSection("backend3")
+	cfg.Reload(config)
+	if removed := listener.getRemoved(); !reflect.DeepEqual(removed, []string{"backend3"}) {
+		t.Errorf("expected backend3 to be removed, got %+v", removed)
+	}
+	if cfg.HasBackendsForHost("domain2.invalid") {
+		t.Error("host domain2.invalid should not have backends")
+	}
+
+	// Reloading the same configuration doesn't remove anything.
+	cfg.Reload(config)
+	if removed := listener.getRemoved(); len(removed) > 0 {
+		t.Errorf("expected no backends to be removed, got %+v", removed)
+	}
+}
+
+func TestBackendAudioBridge(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1, backend2, backend3")
+	config.AddOption("backend1", "url", "http://domain1.invalid")
+	config.AddOption("backend1", "secret", string(testBackendSecret)+"-backend1")
+	config.AddOption("backend1", "audiobridge", "2 3 invalid")
+	config.AddOption("backend2", "url", "http://domain2.invalid")
+	config.AddOption("backend2", "secret", string(testBackendSecret)+"-backend2")
+	config.AddOption("backend2", "audiobridge", "*")
+	config.AddOption("backend3", "url", "http://domain3.invalid")
+	config.AddOption("backend3", "secret", string(testBackendSecret)+"-backend3")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[int]bool{
+		"domain1.invalid": {1: false, 2: true, 3: true, 4: false},
+		"domain2.invalid": {1: true, 2: true, 3: true, 4: true},
+		"domain3.invalid": {1: false, 2: false, 3: false, 4: false},
+	}
+	for host, roomTypes := range expected {
+		u, _ := url.Parse("http://" + host)
+		backend := cfg.GetBackend(u)
+		if backend == nil {
+			t.Fatalf("No backend found for %s", host)
+		}
+		for roomType, use := range roomTypes {
+			if backend.UseAudioBridge(roomType) != use {
+				t.Errorf("Expected audio bridge for room type %d of %s to be %v", roomType, host, use)
+			}
+		}
+	}
+}
+
+func TestIsUrlAllowed_Patterns(t *testing.T) {
+	valid_urls := [][]string{
+		{"https://cloud1.customer.invalid/", string(testBackendSecret) + "-wildcard"},
+		{"https://Cloud-2.customer.invalid/folder/", string(testBackendSecret) + "-wildcard"},
+		{"https://cloud1.customer.invalid:443/", string(testBackendSecret) + "-wildcard"},
+		{"https://cloud1.special.customer.invalid/", string(testBackendSecret) + "-nested"},
+		{"https://customer.invalid/", string(testBackendSecret) + "-exact"},
+		{"https://hoster.invalid/instance-1/", string(testBackendSecret) + "-regex"},
+		{"https://hoster.invalid/instance-2/nextcloud/", string(testBackendSecret) + "-regex"},
+	}
+	invalid_urls := []string{
+		"http://cloud1.customer.invalid/",
+		"https://cloud1.customer.invalid:8443/",
+		"https://a.b.customer.invalid/",
+		"https://cloud1.customer.invalid.evil.invalid/",
+		"https://evilcustomer.invalid/",
+		"https://-invalid.customer.invalid/",
+		"https://hoster.invalid/",
+		"https://hoster.invalid/instance/",
+		"https://hoster.invalid/other/instance-1/",
+	}
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "wildcard, nested, exact, regex, invalid")
+	config.AddOption("wildcard", "url", "https://*.customer.invalid")
+	config.AddOption("wildcard", "secret", string(testBackendSecret)+"-wildcard")
+	config.AddOption("nested", "url", "https://*.special.customer.invalid")
+	config.AddOption("nested", "secret", string(testBackendSecret)+"-nested")
+	config.AddOption("exact", "url", "https://customer.invalid")
+	config.AddOption("exact", "secret", string(testBackendSecret)+"-exact")
+	config.AddOption("regex", "urlregex", `https://hoster\.invalid/instance-[0-9]+/`)
+	config.AddOption("regex", "secret", string(testBackendSecret)+"-regex")
+	config.AddOption("invalid", "url", "https://cloud.*.customer.invalid")
+	config.AddOption("invalid", "secret", string(testBackendSecret)+"-invalid")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackends(t, cfg, valid_urls, invalid_urls)
+}
+
+func TestBackendPatternInstances(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend1", "url", "https://*.customer.invalid")
+	config.AddOption("backend1", "secret", string(testBackendSecret))
+	config.AddOption("backend1", "sessionlimit", "1")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u1, _ := url.Parse("https://cloud1.customer.invalid/index.php")
+	backend1 := cfg.GetBackend(u1)
+	u2, _ := url.Parse("https://CLOUD2.customer.invalid/")
+	backend2 := cfg.GetBackend(u2)
+	if backend1 == nil || backend2 == nil {
+		t.Fatalf("Expected backends for %s and %s", u1, u2)
+	}
+
+	if id := backend1.Id(); id != "backend1@cloud1.customer.invalid" {
+		t.Errorf("Unexpected id %s", id)
+	}
+	if id := backend2.Id(); id != "backend1@cloud2.customer.invalid" {
+		t.Errorf("Unexpected id %s", id)
+	}
+	if backend1.url != "https://cloud1.customer.invalid/" {
+		t.Errorf("Unexpected url %s", backend1.url)
+	}
+
+	if other := cfg.GetBackend(u1); other == nil || other.Id() != backend1.Id() {
+		t.Errorf("Expected backend %s, got %+v", backend1.Id(), other)
+	}
+
+	// The session limit is shared by all instances.
+	session1 := &ClientSession{
+		publicId:   "session1",
+		clientType: HelloClientTypeClient,
+	}
+	session2 := &ClientSession{
+		publicId:   "session2",
+		clientType: HelloClientTypeClient,
+	}
+	if err := backend1.AddSession(session1); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend2.AddSession(session2); err != SessionLimitExceeded {
+		t.Errorf("Expected session limit error, got %s", err)
+	}
+	backend1.RemoveSession(session1)
+	if err := backend2.AddSession(session2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackendSecondarySecret(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend1", "url", "https://domain1.invalid")
+	config.AddOption("backend1", "secret", string(testBackendSecret)+"-primary")
+	config.AddOption("backend1", "secondarysecret", string(testBackendSecret)+"-secondary")
+	cfg, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("https://domain1.invalid/")
+	backend := cfg.GetBackend(u)
+	if backend == nil {
+		t.Fatalf("No backend found for %s", u)
+	}
+
+	// Outgoing requests always use the primary secret.
+	if secret := cfg.GetSecret(u); string(secret) != string(testBackendSecret)+"-primary" {
+		t.Errorf("Expected primary secret, got %s", string(secret))
+	}
+
+	body := []byte("{}")
+	secondaryCount := testutil.ToFloat64(statsBackendSecondarySecretTotal.WithLabelValues("backend1"))
+	for _, secret := range []string{"-primary", "-secondary", "-invalid"} {
+		r := &http.Request{
+			Header: make(http.Header),
+		}
+		AddBackendChecksum(r, body, []byte(string(testBackendSecret)+secret))
+		if valid := backend.ValidateChecksum(r, body); valid != (secret != "-invalid") {
+			t.Errorf("Unexpected result %v for secret %s", valid, secret)
+		}
+	}
+	checkStatsValue(t, statsBackendSecondarySecretTotal.WithLabelValues("backend1"), secondaryCount+1)
+}
@@ -0,0 +1,123 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Prefix of the url of backends that are matched by a regular expression.
+	backendRegexPrefix = "~"
+
+	// A wildcard matches exactly one DNS label, similar to TLS certificates.
+	backendWildcardLabel = "[a-z0-9]([a-z0-9-]*[a-z0-9])?"
+)
+
+// isWildcardBackendUrl returns true if the host of the given url contains a
+// wildcard, e.g. "https://*.customer.domain.invalid/".
+func isWildcardBackendUrl(u *url.URL) bool {
+	return strings.Contains(u.Host, "*")
+}
+
+// compileWildcardBackendUrl converts a (normalized) url with a wildcard as
+// leftmost label of the host to a regular expression matching urls of
+// concrete hosts.
+func compileWildcardBackendUrl(u *url.URL) (*regexp.Regexp, error) {
+	host := strings.ToLower(u.Host)
+	if !strings.HasPrefix(host, "*.") || strings.Count(host, "*") != 1 {
+		return nil, fmt.Errorf("wildcard is only supported as leftmost label of the host: %s", u.Host)
+	}
+
+	path := u.EscapedPath()
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	pattern := "^" + regexp.QuoteMeta(u.Scheme+"://") + backendWildcardLabel + regexp.QuoteMeta(host[1:]+path)
+	return regexp.Compile(pattern)
+}
+
+// compileRegexBackendUrl compiles a regular expression that must match the
+// beginning of the urls of a backend.
+func compileRegexBackendUrl(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	return regexp.Compile("^(?:" + expr + ")")
+}
+
+// matchInstance returns a backend for the concrete instance at the given url
+// if it matches the pattern of the backend. Each instance gets a separate id,
+// so rooms and sessions of different instances are isolated, but they share
+// the secret and session limit of the pattern backend.
+func (b *Backend) matchInstance(u *url.URL, s string) *Backend {
+	if b.pattern == nil || !b.IsUrlAllowed(u) {
+		return nil
+	}
+
+	prefix := b.pattern.FindString(s)
+	if prefix == "" {
+		return nil
+	}
+
+	parsed, err := url.Parse(prefix)
+	if err != nil || parsed.Host == "" {
+		return nil
+	}
+
+	return &Backend{
+		id:     b.id + "@" + parsed.Host,
+		url:    prefix,
+		secret: b.secret,
+
+		secondarySecret: b.secondarySecret,
+
+		secretKey:          b.secretKey,
+		secondarySecretKey: b.secondarySecretKey,
+
+		allowHttp: b.allowHttp,
+
+		tlsSettings: b.tlsSettings,
+
+		maxConcurrentRequests: b.maxConcurrentRequests,
+		maxIdleConnections:    b.maxIdleConnections,
+
+		maxStreamBitrate: b.maxStreamBitrate,
+		maxScreenBitrate: b.maxScreenBitrate,
+
+		pingInterval:     b.pingInterval,
+		idlePingInterval: b.idlePingInterval,
+
+		maintenance: b.maintenance,
+
+		audioBridgeRoomTypes: b.audioBridgeRoomTypes,
+		audioBridgeAllRooms:  b.audioBridgeAllRooms,
+
+		sessionLimit: b.sessionLimit,
+
+		parent: b,
+	}
+}
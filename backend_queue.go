@@ -0,0 +1,406 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	defaultBackendQueueMaxAttempts = 10
+	defaultBackendQueueMaxSize     = 10000
+
+	backendQueueInitialDelay = time.Second
+	backendQueueMaxDelay     = 5 * time.Minute
+
+	backendQueueIdLength = 16
+)
+
+var (
+	ErrBackendInMaintenance = errors.New("backend is in maintenance")
+)
+
+type backendQueuePerformer func(ctx context.Context, u *url.URL, request interface{}, response interface{}) error
+
+type backendQueueEntry struct {
+	Id       string          `json:"id"`
+	Url      string          `json:"url"`
+	Request  json.RawMessage `json:"request"`
+	Created  time.Time       `json:"created"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+	LastErr  string          `json:"lasterror,omitempty"`
+}
+
+// BackendRequestQueue retries notifications to the backend that failed, e.g.
+// while the Nextcloud instance is temporarily unavailable. Retries are delayed
+// with an exponential backoff and requests are dropped (and logged) after a
+// maximum number of attempts. If a directory is configured, pending requests
+// are persisted and will be retried after a restart of the server. The oldest
+// requests are dropped if more than the maximum size are pending.
+// Requests to backends that are paused, e.g. while they are in maintenance,
+// are queued without trying them and are sent once the backend is resumed.
+type BackendRequestQueue struct {
+	perform     backendQueuePerformer
+	timeout     time.Duration
+	directory   string
+	maxAttempts int
+	maxSize     int
+
+	// Optional, returns true if requests to the given url should be delayed.
+	paused func(u *url.URL) bool
+
+	mu      sync.Mutex
+	entries map[string]*backendQueueEntry
+
+	wakeupChan chan bool
+	stopChan   chan bool
+}
+
+func NewBackendRequestQueue(config *goconf.ConfigFile, perform backendQueuePerformer, timeout time.Duration) (*BackendRequestQueue, error) {
+	directory, _ := config.GetString("backend", "queuedir")
+	maxAttempts, _ := config.GetInt("backend", "queuemaxattempts")
+	if maxAttempts <= 0 {
+		maxAttempts = defaultBackendQueueMaxAttempts
+	}
+	maxSize, _ := config.GetInt("backend", "queuemaxsize")
+	if maxSize <= 0 {
+		maxSize = defaultBackendQueueMaxSize
+	}
+
+	queue := &BackendRequestQueue{
+		perform:     perform,
+		timeout:     timeout,
+		directory:   directory,
+		maxAttempts: maxAttempts,
+		maxSize:     maxSize,
+
+		entries: make(map[string]*backendQueueEntry),
+
+		wakeupChan: make(chan bool, 1),
+		stopChan:   make(chan bool, 1),
+	}
+	if directory != "" {
+		if err := os.MkdirAll(directory, 0700); err != nil {
+			return nil, fmt.Errorf("could not create backend queue directory %s: %w", directory, err)
+		}
+		if err := queue.load(); err != nil {
+			return nil, err
+		}
+		queue.dropOverflow()
+		log.Printf("Persisting failed backend requests in %s, %d pending", directory, len(queue.entries))
+	}
+	statsBackendClientQueuePending.Set(float64(len(queue.entries)))
+	return queue, nil
+}
+
+func (q *BackendRequestQueue) load() error {
+	files, err := os.ReadDir(q.directory)
+	if err != nil {
+		return fmt.Errorf("could not read backend queue directory %s: %w", q.directory, err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		filename := filepath.Join(q.directory, file.Name())
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			log.Printf("Could not read queued backend request %s: %s", filename, err)
+			continue
+		}
+
+		var entry backendQueueEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Id == "" {
+			log.Printf("Removing invalid queued backend request %s: %s", filename, string(data))
+			os.Remove(filename) // nolint
+			continue
+		}
+
+		q.entries[entry.Id] = &entry
+	}
+	return nil
+}
+
+func (q *BackendRequestQueue) filename(entry *backendQueueEntry) string {
+	return filepath.Join(q.directory, entry.Id+".json")
+}
+
+func (q *BackendRequestQueue) store(entry *backendQueueEntry) {
+	if q.directory == "" {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Could not marshal queued backend request %s: %s", entry.Id, err)
+		return
+	}
+
+	// Write to a temporary file first so a crash can't leave partial entries.
+	filename := q.filename(entry)
+	if err := os.WriteFile(filename+".tmp", data, 0600); err != nil {
+		log.Printf("Could not persist queued backend request %s: %s", entry.Id, err)
+		return
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		log.Printf("Could not persist queued backend request %s: %s", entry.Id, err)
+	}
+}
+
+func (q *BackendRequestQueue) remove(entry *backendQueueEntry) {
+	if q.directory == "" {
+		return
+	}
+
+	if err := os.Remove(q.filename(entry)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Could not remove queued backend request %s: %s", entry.Id, err)
+	}
+}
+
+func (q *BackendRequestQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func isRetryableBackendError(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		// The backend processed the request but rejected it, retrying won't help.
+		return e.Code == "backend_server_error"
+	}
+
+	return true
+}
+
+func getBackendQueueDelay(attempts int) time.Duration {
+	delay := backendQueueInitialDelay
+	for i := 1; i < attempts && delay < backendQueueMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > backendQueueMaxDelay {
+		delay = backendQueueMaxDelay
+	}
+	return delay
+}
+
+func (q *BackendRequestQueue) isPaused(u *url.URL) bool {
+	return q.paused != nil && q.paused(u)
+}
+
+// PerformJSONRequest sends a request to the backend and queues it for later
+// retries if it failed. The error of the initial request is returned.
+// Requests to paused backends are queued directly and ErrBackendInMaintenance
+// is returned.
+func (q *BackendRequestQueue) PerformJSONRequest(ctx context.Context, u *url.URL, request interface{}, response interface{}) error {
+	if q.isPaused(u) {
+		q.add(u, request, 0, ErrBackendInMaintenance)
+		return ErrBackendInMaintenance
+	}
+
+	err := q.perform(ctx, u, request, response)
+	if err == nil || !isRetryableBackendError(err) {
+		return err
+	}
+
+	q.add(u, request, 1, err)
+	return err
+}
+
+func (q *BackendRequestQueue) add(u *url.URL, request interface{}, attempts int, err error) {
+	data, merr := json.Marshal(request)
+	if merr != nil {
+		log.Printf("Could not marshal request %+v to queue: %s", request, merr)
+		return
+	}
+
+	now := time.Now()
+	entry := &backendQueueEntry{
+		Id:       newRandomString(backendQueueIdLength),
+		Url:      u.String(),
+		Request:  data,
+		Created:  now,
+		Attempts: attempts,
+		Next:     now,
+		LastErr:  err.Error(),
+	}
+	if attempts > 0 {
+		entry.Next = now.Add(getBackendQueueDelay(attempts))
+	}
+
+	q.mu.Lock()
+	q.entries[entry.Id] = entry
+	q.store(entry)
+	q.dropOverflow()
+	statsBackendClientQueuePending.Set(float64(len(q.entries)))
+	q.mu.Unlock()
+	log.Printf("Queued request %s to %s for retry: %s", entry.Id, entry.Url, err)
+	q.Wakeup()
+}
+
+// dropOverflow removes the oldest entries if more than the maximum size are
+// pending, e.g. if a backend is unreachable for a long time.
+// The lock must be held by the caller.
+func (q *BackendRequestQueue) dropOverflow() {
+	for len(q.entries) > q.maxSize {
+		var oldest *backendQueueEntry
+		for _, entry := range q.entries {
+			if oldest == nil || entry.Created.Before(oldest.Created) {
+				oldest = entry
+			}
+		}
+
+		log.Printf("Dropping queued request %s to %s as the queue is full (first tried %s, %d attempts): %s (request %s)", oldest.Id, oldest.Url, oldest.Created, oldest.Attempts, oldest.LastErr, string(oldest.Request))
+		statsBackendClientQueueOverflowTotal.Inc()
+		delete(q.entries, oldest.Id)
+		q.remove(oldest)
+	}
+}
+
+// Wakeup checks for requests that are due, e.g. after a backend was resumed.
+func (q *BackendRequestQueue) Wakeup() {
+	select {
+	case q.wakeupChan <- true:
+	default:
+	}
+}
+
+// getDue returns the entries that should be retried and the time when the
+// next entry will be due. Entries for paused backends are skipped.
+func (q *BackendRequestQueue) getDue(now time.Time) ([]*backendQueueEntry, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*backendQueueEntry
+	var next time.Time
+	for _, entry := range q.entries {
+		if q.paused != nil {
+			if u, err := url.Parse(entry.Url); err == nil && q.paused(u) {
+				continue
+			}
+		}
+
+		if !entry.Next.After(now) {
+			due = append(due, entry)
+		} else if next.IsZero() || entry.Next.Before(next) {
+			next = entry.Next
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Created.Before(due[j].Created)
+	})
+	return due, next
+}
+
+func (q *BackendRequestQueue) retry(entry *backendQueueEntry) {
+	u, err := url.Parse(entry.Url)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		var response json.RawMessage
+		err = q.perform(ctx, u, entry.Request, &response)
+		cancel()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	statsBackendClientQueueRetriesTotal.Inc()
+	if err == nil {
+		log.Printf("Retried queued request %s to %s after %d attempts", entry.Id, entry.Url, entry.Attempts)
+		delete(q.entries, entry.Id)
+		q.remove(entry)
+	} else if entry.Attempts+1 >= q.maxAttempts || !isRetryableBackendError(err) {
+		log.Printf("Dropping queued request %s to %s after %d attempts (first tried %s): %s (request %s)", entry.Id, entry.Url, entry.Attempts+1, entry.Created, err, string(entry.Request))
+		statsBackendClientQueueDroppedTotal.Inc()
+		delete(q.entries, entry.Id)
+		q.remove(entry)
+	} else {
+		entry.Attempts++
+		entry.Next = time.Now().Add(getBackendQueueDelay(entry.Attempts))
+		entry.LastErr = err.Error()
+		q.store(entry)
+	}
+	statsBackendClientQueuePending.Set(float64(len(q.entries)))
+}
+
+func (q *BackendRequestQueue) Run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-q.wakeupChan:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-q.stopChan:
+			return
+		}
+
+		due, next := q.getDue(time.Now())
+		for len(due) > 0 {
+			for _, entry := range due {
+				select {
+				case <-q.stopChan:
+					return
+				default:
+				}
+
+				q.retry(entry)
+			}
+
+			// Other entries might have become due while retrying.
+			due, next = q.getDue(time.Now())
+		}
+		if next.IsZero() {
+			// Wait until new entries are added.
+			next = time.Now().Add(backendQueueMaxDelay)
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+func (q *BackendRequestQueue) Stop() {
+	select {
+	case q.stopChan <- true:
+	default:
+	}
+}
@@ -0,0 +1,335 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testBackendPerformer struct {
+	mu       sync.Mutex
+	err      error
+	requests []string
+}
+
+func (p *testBackendPerformer) SetError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func (p *testBackendPerformer) Requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.requests...)
+}
+
+func (p *testBackendPerformer) PerformJSONRequest(ctx context.Context, u *url.URL, request interface{}, response interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, u.String()+" "+string(data))
+	return p.err
+}
+
+func TestBackendQueueDelay(t *testing.T) {
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+	}
+	for idx, delay := range expected {
+		if d := getBackendQueueDelay(idx + 1); d != delay {
+			t.Errorf("expected delay %s for attempt %d, got %s", delay, idx+1, d)
+		}
+	}
+	if d := getBackendQueueDelay(100); d != backendQueueMaxDelay {
+		t.Errorf("expected maximum delay %s, got %s", backendQueueMaxDelay, d)
+	}
+}
+
+func TestBackendQueueRetry(t *testing.T) {
+	performer := &testBackendPerformer{}
+	performer.SetError(errors.New("connection refused"))
+
+	queue, err := NewBackendRequestQueue(goconf.NewConfigFile(), performer.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go queue.Run()
+	defer queue.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	u, _ := url.Parse("https://server.domain.invalid/ocs/v2.php/apps/spreed/api/v1/signaling/backend")
+	var response map[string]interface{}
+	if err := queue.PerformJSONRequest(ctx, u, map[string]string{"foo": "bar"}, &response); err == nil {
+		t.Fatal("expected error")
+	}
+	if l := queue.Len(); l != 1 {
+		t.Errorf("expected one queued request, got %d", l)
+	}
+
+	// Errors returned by the backend for invalid requests are not retried.
+	if err := queue.PerformJSONRequest(ctx, u, map[string]string{"foo": "baz"}, &response); err == nil {
+		t.Fatal("expected error")
+	}
+	performer.SetError(NewError("backend_not_found", "Not found"))
+	if err := queue.PerformJSONRequest(ctx, u, map[string]string{"foo": "invalid"}, &response); err == nil {
+		t.Fatal("expected error")
+	}
+	if l := queue.Len(); l != 2 {
+		t.Errorf("expected two queued requests, got %d", l)
+	}
+
+	performer.SetError(nil)
+	waitForCondition(ctx, t, func() bool {
+		return queue.Len() == 0
+	})
+
+	requests := performer.Requests()
+	expected := []string{
+		u.String() + ` {"foo":"bar"}`,
+		u.String() + ` {"foo":"baz"}`,
+		u.String() + ` {"foo":"invalid"}`,
+		u.String() + ` {"foo":"bar"}`,
+		u.String() + ` {"foo":"baz"}`,
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected requests %+v, got %+v", expected, requests)
+	}
+	for idx, r := range expected {
+		if requests[idx] != r {
+			t.Errorf("expected request %s at %d, got %s", r, idx, requests[idx])
+		}
+	}
+}
+
+func TestBackendQueuePaused(t *testing.T) {
+	performer := &testBackendPerformer{}
+	queue, err := NewBackendRequestQueue(goconf.NewConfigFile(), performer.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	paused := true
+	queue.paused = func(u *url.URL) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return paused && u.Host == "server1.domain.invalid"
+	}
+	go queue.Run()
+	defer queue.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	u1, _ := url.Parse("https://server1.domain.invalid/ocs/v2.php/apps/spreed/api/v1/signaling/backend")
+	u2, _ := url.Parse("https://server2.domain.invalid/ocs/v2.php/apps/spreed/api/v1/signaling/backend")
+	var response map[string]interface{}
+	if err := queue.PerformJSONRequest(ctx, u1, map[string]string{"foo": "bar"}, &response); err != ErrBackendInMaintenance {
+		t.Errorf("expected error %s, got %s", ErrBackendInMaintenance, err)
+	}
+	if err := queue.PerformJSONRequest(ctx, u2, map[string]string{"foo": "baz"}, &response); err != nil {
+		t.Error(err)
+	}
+	if l := queue.Len(); l != 1 {
+		t.Errorf("expected one queued request, got %d", l)
+	}
+
+	// Requests to paused backends are not retried.
+	time.Sleep(100 * time.Millisecond)
+	if requests := performer.Requests(); len(requests) != 1 || requests[0] != u2.String()+` {"foo":"baz"}` {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+
+	mu.Lock()
+	paused = false
+	mu.Unlock()
+	queue.Wakeup()
+	waitForCondition(ctx, t, func() bool {
+		return queue.Len() == 0
+	})
+	if requests := performer.Requests(); len(requests) != 2 || requests[1] != u1.String()+` {"foo":"bar"}` {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+}
+
+func TestBackendQueueDropped(t *testing.T) {
+	performer := &testBackendPerformer{}
+	performer.SetError(errors.New("connection refused"))
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "queuemaxattempts", "2")
+	queue, err := NewBackendRequestQueue(config, performer.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go queue.Run()
+	defer queue.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	u, _ := url.Parse("https://server.domain.invalid/")
+	var response map[string]interface{}
+	if err := queue.PerformJSONRequest(ctx, u, map[string]string{"foo": "bar"}, &response); err == nil {
+		t.Fatal("expected error")
+	}
+
+	waitForCondition(ctx, t, func() bool {
+		return queue.Len() == 0
+	})
+	if requests := performer.Requests(); len(requests) != 2 {
+		t.Errorf("expected two attempts, got %+v", requests)
+	}
+}
+
+func TestBackendQueuePersistent(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "queue")
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "queuedir", dir)
+
+	performer := &testBackendPerformer{}
+	performer.SetError(errors.New("connection refused"))
+	queue, err := NewBackendRequestQueue(config, performer.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	u, _ := url.Parse("https://server.domain.invalid/")
+	var response map[string]interface{}
+	if err := queue.PerformJSONRequest(ctx, u, map[string]string{"foo": "bar"}, &response); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if files, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Fatalf("expected one persisted request, got %+v", files)
+	}
+
+	// Simulate a restart of the server, the request will be loaded again.
+	performer2 := &testBackendPerformer{}
+	queue2, err := NewBackendRequestQueue(config, performer2.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := queue2.Len(); l != 1 {
+		t.Fatalf("expected one loaded request, got %d", l)
+	}
+	go queue2.Run()
+	defer queue2.Stop()
+
+	waitForCondition(ctx, t, func() bool {
+		return queue2.Len() == 0
+	})
+	if requests := performer2.Requests(); len(requests) != 1 || requests[0] != u.String()+` {"foo":"bar"}` {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+	if files, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Errorf("expected no persisted requests, got %+v", files)
+	}
+}
+
+func TestBackendQueueMaxSize(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "queue")
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "queuedir", dir)
+	config.AddOption("backend", "queuemaxsize", "2")
+
+	performer := &testBackendPerformer{}
+	performer.SetError(errors.New("connection refused"))
+	queue, err := NewBackendRequestQueue(config, performer.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	overflow := testutil.ToFloat64(statsBackendClientQueueOverflowTotal)
+	u, _ := url.Parse("https://server.domain.invalid/")
+	var response map[string]interface{}
+	for _, value := range []string{"one", "two", "three"} {
+		if err := queue.PerformJSONRequest(ctx, u, map[string]string{"foo": value}, &response); err == nil {
+			t.Fatal("expected error")
+		}
+		// Make sure the entries have different creation times.
+		time.Sleep(time.Millisecond)
+	}
+
+	// The oldest request is dropped.
+	if l := queue.Len(); l != 2 {
+		t.Errorf("expected two queued requests, got %d", l)
+	}
+	checkStatsValue(t, statsBackendClientQueueOverflowTotal, overflow+1)
+	if files, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Errorf("expected two persisted requests, got %+v", files)
+	}
+
+	// Loading more requests than allowed also drops the oldest.
+	config.RemoveOption("backend", "queuemaxsize")
+	config.AddOption("backend", "queuemaxsize", "1")
+	performer2 := &testBackendPerformer{}
+	queue2, err := NewBackendRequestQueue(config, performer2.PerformJSONRequest, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := queue2.Len(); l != 1 {
+		t.Errorf("expected one loaded request, got %d", l)
+	}
+	checkStatsValue(t, statsBackendClientQueueOverflowTotal, overflow+2)
+	go queue2.Run()
+	defer queue2.Stop()
+
+	waitForCondition(ctx, t, func() bool {
+		return queue2.Len() == 0
+	})
+	if requests := performer2.Requests(); len(requests) != 1 || requests[0] != u.String()+` {"foo":"three"}` {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+}
@@ -22,10 +22,8 @@
 package signaling
 
 import (
-	"crypto/hmac"
+	"context"
 	"crypto/rand"
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -56,64 +54,66 @@ type BackendServer struct {
 	nats         NatsClient
 	roomSessions RoomSessions
 
-	version        string
-	welcomeMessage string
+	version string
 
-	turnapikey  string
-	turnsecret  []byte
-	turnvalid   time.Duration
-	turnservers []string
+	turnapikey string
 
 	statsAllowedIps map[string]bool
 	invalidSecret   []byte
+
+	adminSecret     []byte
+	adminAllowedIps map[string]bool
+
+	nonces usedNonces
 }
 
-func NewBackendServer(config *goconf.ConfigFile, hub *Hub, version string) (*BackendServer, error) {
-	turnapikey, _ := config.GetString("turn", "apikey")
-	turnsecret, _ := config.GetString("turn", "secret")
-	turnservers, _ := config.GetString("turn", "servers")
-	// TODO(jojo): Make the validity for TURN credentials configurable.
-	turnvalid := 24 * time.Hour
+// parseAllowedIps returns the comma-separated IP addresses as map, or only
+// "127.0.0.1" if the value is empty.
+func parseAllowedIps(value string) map[string]bool {
+	if value == "" {
+		return map[string]bool{
+			"127.0.0.1": true,
+		}
+	}
 
-	var turnserverslist []string
-	for _, s := range strings.Split(turnservers, ",") {
-		s = strings.TrimSpace(s)
-		if s != "" {
-			turnserverslist = append(turnserverslist, s)
+	result := make(map[string]bool)
+	for _, ip := range strings.Split(value, ",") {
+		ip = strings.TrimSpace(ip)
+		if ip != "" {
+			result[ip] = true
 		}
 	}
+	return result
+}
 
-	if len(turnserverslist) != 0 {
+func NewBackendServer(config *goconf.ConfigFile, hub *Hub, version string) (*BackendServer, error) {
+	turnapikey, _ := config.GetString("turn", "apikey")
+	if hub.turn.IsEnabled() {
 		if turnapikey == "" {
 			return nil, fmt.Errorf("need a TURN API key if TURN servers are configured")
 		}
-		if turnsecret == "" {
-			return nil, fmt.Errorf("need a shared TURN secret if TURN servers are configured")
-		}
 
 		log.Printf("Using configured TURN API key")
-		log.Printf("Using configured shared TURN secret")
-		for _, s := range turnserverslist {
-			log.Printf("Adding \"%s\" as TURN server", s)
-		}
 	}
 
 	statsAllowed, _ := config.GetString("stats", "allowed_ips")
-	var statsAllowedIps map[string]bool
 	if statsAllowed == "" {
 		log.Printf("No IPs configured for the stats endpoint, only allowing access from 127.0.0.1")
-		statsAllowedIps = map[string]bool{
-			"127.0.0.1": true,
-		}
 	} else {
 		log.Printf("Only allowing access to the stats endpoing from %s", statsAllowed)
-		statsAllowedIps = make(map[string]bool)
-		for _, ip := range strings.Split(statsAllowed, ",") {
-			ip = strings.TrimSpace(ip)
-			if ip != "" {
-				statsAllowedIps[ip] = true
-			}
+	}
+	statsAllowedIps := parseAllowedIps(statsAllowed)
+
+	adminSecret, _ := config.GetString("admin", "secret")
+	adminAllowed, _ := config.GetString("admin", "allowed_ips")
+	var adminAllowedIps map[string]bool
+	if adminSecret != "" {
+		if adminAllowed == "" {
+			log.Printf("No IPs configured for the admin API, only allowing access from 127.0.0.1")
+		} else {
+			log.Printf("Only allowing access to the admin API from %s", adminAllowed)
 		}
+		adminAllowedIps = parseAllowedIps(adminAllowed)
 	}
 
 	invalidSecret := make([]byte, 32)
@@ -127,37 +127,50 @@ func NewBackendServer(config *goconf.ConfigFile, hub *Hub, version string) (*Bac
 		roomSessions: hub.roomSessions,
 		version:      version,
 
-		turnapikey:  turnapikey,
-		turnsecret:  []byte(turnsecret),
-		turnvalid:   turnvalid,
-		turnservers: turnserverslist,
+		turnapikey: turnapikey,
 
 		statsAllowedIps: statsAllowedIps,
 		invalidSecret:   invalidSecret,
+
+		adminSecret:     []byte(adminSecret),
+		adminAllowedIps: adminAllowedIps,
 	}, nil
 }
 
 func (b *BackendServer) Start(r *mux.Router) error {
-	welcome := map[string]string{
-		"nextcloud-spreed-signaling": "Welcome",
-		"version":                    b.version,
-	}
-	welcomeMessage, err := json.Marshal(welcome)
-	if err != nil {
-		// Should never happen.
-		return err
-	}
-
-	b.welcomeMessage = string(welcomeMessage) + "\n"
-
 	s := r.PathPrefix("/api/v1").Subrouter()
 	s.HandleFunc("/welcome", b.setComonHeaders(b.welcomeFunc)).Methods("GET")
 	s.HandleFunc("/room/{roomid}", b.setComonHeaders(b.parseRequestBody(b.roomHandler))).Methods("POST")
 	s.HandleFunc("/stats", b.setComonHeaders(b.validateStatsRequest(b.statsHandler))).Methods("GET")
+	if len(b.adminSecret) > 0 {
+		// The room statistics contain user and session ids, so the admin
+		// secret is required in addition to the allowed IPs.
+		s.HandleFunc("/stats/rooms", b.setComonHeaders(b.validateStatsAdminRequest(b.roomStatsHandler))).Methods("GET")
+		s.HandleFunc("/stats/cluster", b.setComonHeaders(b.validateStatsAdminRequest(b.clusterStatsHandler))).Methods("GET")
+	}
 
 	// Expose prometheus metrics at "/metrics".
 	r.HandleFunc("/metrics", b.setComonHeaders(b.validateStatsRequest(b.metricsHandler))).Methods("GET")
 
+	if len(b.adminSecret) > 0 {
+		a := r.PathPrefix("/admin").Subrouter()
+		a.HandleFunc("/config", b.setComonHeaders(b.validateAdminRequest(b.adminGetConfig))).Methods("GET")
+		a.HandleFunc("/backends", b.setComonHeaders(b.validateAdminRequest(b.adminListBackends))).Methods("GET")
+		a.HandleFunc("/backends", b.setComonHeaders(b.validateAdminRequest(b.adminCreateBackend))).Methods("POST")
+		a.HandleFunc("/backends/{id}", b.setComonHeaders(b.validateAdminRequest(b.adminGetBackend))).Methods("GET")
+		a.HandleFunc("/backends/{id}", b.setComonHeaders(b.validateAdminRequest(b.adminUpdateBackend))).Methods("PUT")
+		a.HandleFunc("/backends/{id}", b.setComonHeaders(b.validateAdminRequest(b.adminDeleteBackend))).Methods("DELETE")
+		a.HandleFunc("/backends/{id}/promote", b.setComonHeaders(b.validateAdminRequest(b.adminPromoteBackendSecret))).Methods("POST")
+		a.HandleFunc("/backends/{id}/maintenance", b.setComonHeaders(b.validateAdminRequest(b.adminSetBackendMaintenance))).Methods("POST", "DELETE")
+		a.HandleFunc("/backends/{id}/rooms/{roomid}", b.setComonHeaders(b.validateAdminRequest(b.adminCloseRoom))).Methods("DELETE")
+		a.HandleFunc("/sessions", b.setComonHeaders(b.validateAdminRequest(b.adminListSessions))).Methods("GET")
+		a.HandleFunc("/sessions/{sessionid}", b.setComonHeaders(b.validateAdminRequest(b.adminKickSession))).Methods("DELETE")
+		a.HandleFunc("/sessions/{sessionid}/events", b.setComonHeaders(b.validateAdminRequest(b.adminGetSessionEvents))).Methods("GET")
+		a.HandleFunc("/sessions/{sessionid}/mcu", b.setComonHeaders(b.validateAdminRequest(b.adminGetSessionMcu))).Methods("GET")
+		a.HandleFunc("/throttle", b.setComonHeaders(b.validateAdminRequest(b.adminGetThrottle))).Methods("GET")
+		a.HandleFunc("/rooms", b.setComonHeaders(b.validateAdminRequest(b.adminListRooms))).Methods("GET")
+	}
+
 	// Provide a REST service to get TURN credentials.
 	// See https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
 	r.HandleFunc("/turn/credentials", b.setComonHeaders(b.getTurnCredentials)).Methods("GET")
@@ -172,19 +185,39 @@ func (b *BackendServer) setComonHeaders(f func(http.ResponseWriter, *http.Reques
 	}
 }
 
+func (b *BackendServer) getWelcomeMessage() *WelcomeServerMessage {
+	clustering := "nats"
+	if _, ok := b.hub.nats.(*LoopbackNatsClient); ok {
+		clustering = "standalone"
+	}
+
+	features := make([]string, len(b.hub.info.Features))
+	copy(features, b.hub.info.Features)
+	return &WelcomeServerMessage{
+		Welcome: "Welcome",
+		Version: b.version,
+
+		HelloVersions:   []string{HelloVersion},
+		MaxHelloVersion: HelloVersion,
+
+		Features: features,
+
+		Clustering: clustering,
+	}
+}
+
 func (b *BackendServer) welcomeFunc(w http.ResponseWriter, r *http.Request) {
+	welcomeMessage, err := b.getWelcomeMessage().MarshalJSON()
+	if err != nil {
+		// Should never happen.
+		log.Printf("Could not serialize welcome message: %s", err)
+		http.Error(w, "Could not serialize welcome message", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	io.WriteString(w, b.welcomeMessage) // nolint
-}
-
-func calculateTurnSecret(username string, secret []byte, valid time.Duration) (string, string) {
-	expires := time.Now().Add(valid)
-	username = fmt.Sprintf("%d:%s", expires.Unix(), username)
-	m := hmac.New(sha1.New, secret)
-	m.Write([]byte(username)) // nolint
-	password := base64.StdEncoding.EncodeToString(m.Sum(nil))
-	return username, password
+	w.Write(append(welcomeMessage, '\n')) // nolint
 }
 
 func (b *BackendServer) getTurnCredentials(w http.ResponseWriter, r *http.Request) {
@@ -208,23 +241,18 @@ func (b *BackendServer) getTurnCredentials(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if len(b.turnservers) == 0 {
+	if !b.hub.turn.IsEnabled() {
 		w.WriteHeader(http.StatusNotFound)
 		io.WriteString(w, "No TURN servers available.\n") // nolint
 		return
 	}
 
-	if username == "" {
-		// Make sure to include an actual username in the credentials.
-		username = newRandomString(randomUsernameLength)
-	}
-
-	username, password := calculateTurnSecret(username, b.turnsecret, b.turnvalid)
-	result := TurnCredentials{
-		Username: username,
-		Password: password,
-		TTL:      int64(b.turnvalid.Seconds()),
-		URIs:     b.turnservers,
+	result, err := b.hub.turn.GetCredentials(r.Context(), username, b.hub.lookupCountry(getRealUserIP(r, b.hub.trustedProxies)))
+	if err != nil {
+		log.Printf("Could not get TURN credentials: %s", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "No TURN servers available.\n") // nolint
+		return
 	}
 
 	data, err := json.Marshal(result)
@@ -262,7 +290,7 @@ func (b *BackendServer) parseRequestBody(f func(http.ResponseWriter, *http.Reque
 		}
 
 		if r.Header.Get(HeaderBackendSignalingRandom) == "" ||
-			r.Header.Get(HeaderBackendSignalingChecksum) == "" {
+			(r.Header.Get(HeaderBackendSignalingChecksum) == "" && !IsBackendChecksumV2(r)) {
 			http.Error(w, "Authentication check failed", http.StatusForbidden)
 			return
 		}
@@ -461,6 +489,23 @@ func (b *BackendServer) sendRoomIncall(roomid string, backend *Backend, request
 	return b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
 }
 
+func getPermissionsBitmap(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case float64:
+		// Default JSON decoder unmarshals numbers to float64.
+		return int(value), true
+	case int:
+		return value, true
+	case json.Number:
+		if bitmap, err := value.Int64(); err == nil {
+			return int(bitmap), true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
 func (b *BackendServer) sendRoomParticipantsUpdate(roomid string, backend *Backend, request *BackendServerRoomRequest) error {
 	timeout := time.Second
 
@@ -478,6 +523,29 @@ loop:
 	for _, user := range request.Participants.Changed {
 		permissionsInterface, found := user["permissions"]
 		if !found {
+			bitmapInterface, found := user["participantPermissions"]
+			if !found {
+				continue
+			}
+
+			sessionId := user["sessionId"].(string)
+			bitmap, ok := getPermissionsBitmap(bitmapInterface)
+			if !ok {
+				log.Printf("Received invalid participant permissions %+v (%s) for session %s", bitmapInterface, reflect.TypeOf(bitmapInterface), sessionId)
+				continue
+			}
+
+			wg.Add(1)
+			go func(sessionId string, bitmap int) {
+				defer wg.Done()
+				message := &NatsMessage{
+					Type:              "permissions",
+					PermissionsBitmap: &bitmap,
+				}
+				if err := b.nats.Publish("session."+sessionId, message); err != nil {
+					log.Printf("Could not send permissions update (%d) to session %s: %s", bitmap, sessionId, err)
+				}
+			}(sessionId, bitmap)
 			continue
 		}
 
@@ -518,14 +586,99 @@ func (b *BackendServer) sendRoomMessage(roomid string, backend *Backend, request
 	return b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomid, backend), request)
 }
 
+// usedNonces stores the random values of requests with a "v2" checksum until
+// their timestamp expires, so the requests can't be replayed.
+// The values are only known to the local server, a request could still be
+// replayed to other servers of a cluster.
+type usedNonces struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+// add returns false if the nonce has been used before.
+func (n *usedNonces) add(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.lastPrune) >= BackendChecksumV2MaxAge {
+		for key, expires := range n.nonces {
+			if now.After(expires) {
+				delete(n.nonces, key)
+			}
+		}
+		n.lastPrune = now
+	}
+
+	if expires, found := n.nonces[nonce]; found && !now.After(expires) {
+		return false
+	}
+
+	if n.nonces == nil {
+		n.nonces = make(map[string]time.Time)
+	}
+	// The timestamp of a request may be in the future, so it is valid for
+	// twice the allowed age.
+	n.nonces[nonce] = now.Add(2 * BackendChecksumV2MaxAge)
+	return true
+}
+
+// checkChecksumVersion must be called after the checksum of the request was
+// validated. It rejects replayed requests with a "v2" checksum and requests
+// with the old checksum from backends that support the "v2" checksum.
+func (b *BackendServer) checkChecksumVersion(r *http.Request, backend *Backend, backendUrl *url.URL) bool {
+	if IsBackendChecksumV2(r) {
+		if !b.nonces.add(getHeaderValue(r.Header, HeaderBackendSignalingRandom), time.Now()) {
+			log.Printf("Rejecting replayed request from backend %s", backend.Id())
+			return false
+		}
+		return true
+	}
+
+	u := backendUrl
+	if backend.url != "" && backend.pattern == nil {
+		var err error
+		if u, err = url.Parse(backend.url); err != nil {
+			return true
+		}
+	} else if u == nil {
+		// Old-style configuration without the backend url.
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.hub.backendTimeout)
+	defer cancel()
+	if b.hub.backend.UseChecksumV2(ctx, u) {
+		log.Printf("Rejecting request without v2 checksum from backend %s", backend.Id())
+		return false
+	}
+	return true
+}
+
+// getCapabilitiesPrefix returns the prefix of the urls whose capabilities
+// should be invalidated for a request from the given backend.
+func getCapabilitiesPrefix(backend *Backend, backendUrl *url.URL) string {
+	if backend.url != "" && backend.pattern == nil {
+		return backend.url
+	} else if backendUrl != nil {
+		// The capabilities are cached for the urls passed by clients, which
+		// might differ in their path from the url of the request.
+		return backendUrl.Scheme + "://" + backendUrl.Host
+	}
+
+	// Old-style configuration, the url of the requesting server is unknown.
+	return ""
+}
+
 func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body []byte) {
 	v := mux.Vars(r)
 	roomid := v["roomid"]
 
 	var backend *Backend
-	backendUrl := r.Header.Get(HeaderBackendServer)
-	if backendUrl != "" {
-		if u, err := url.Parse(backendUrl); err == nil {
+	var backendUrl *url.URL
+	if value := r.Header.Get(HeaderBackendServer); value != "" {
+		if u, err := url.Parse(value); err == nil {
+			backendUrl = u
 			backend = b.hub.backend.GetBackend(u)
 		}
 
@@ -544,7 +697,7 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 			// Old-style Talk, find backend that created the checksum.
 			// TODO(fancycode): Remove once all supported Talk versions send the backend header.
 			for _, b := range b.hub.backend.GetBackends() {
-				if ValidateBackendChecksum(r, body, b.Secret()) {
+				if b.ValidateChecksum(r, body) {
 					backend = b
 					break
 				}
@@ -557,7 +710,7 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 		}
 	}
 
-	if !ValidateBackendChecksum(r, body, backend.Secret()) {
+	if !backend.ValidateChecksum(r, body) || !b.checkChecksumVersion(r, backend, backendUrl) {
 		http.Error(w, "Authentication check failed", http.StatusForbidden)
 		return
 	}
@@ -591,6 +744,23 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 		err = b.sendRoomParticipantsUpdate(roomid, backend, &request)
 	case "message":
 		err = b.sendRoomMessage(roomid, backend, &request)
+	case "recording":
+		if request.Recording == nil {
+			http.Error(w, "Recording request missing", http.StatusBadRequest)
+			return
+		}
+
+		switch request.Recording.Type {
+		case "start":
+			b.hub.recordings.Start(roomid, backend)
+		case "stop":
+			b.hub.recordings.Stop(roomid, backend)
+		default:
+			http.Error(w, "Unsupported recording request type: "+request.Recording.Type, http.StatusBadRequest)
+			return
+		}
+	case "capabilities":
+		err = b.hub.InvalidateCapabilities(getCapabilitiesPrefix(backend, backendUrl))
 	default:
 		http.Error(w, "Unsupported request type: "+request.Type, http.StatusBadRequest)
 		return
@@ -609,15 +779,19 @@ func (b *BackendServer) roomHandler(w http.ResponseWriter, r *http.Request, body
 	w.Write([]byte("{}")) // nolint
 }
 
+func isRequestFromAllowedIp(r *http.Request, trusted *TrustedProxies, allowed map[string]bool) bool {
+	addr := getRealUserIP(r, trusted)
+	if strings.Contains(addr, ":") {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+	}
+	return allowed[addr]
+}
+
 func (b *BackendServer) validateStatsRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		addr := getRealUserIP(r)
-		if strings.Contains(addr, ":") {
-			if host, _, err := net.SplitHostPort(addr); err == nil {
-				addr = host
-			}
-		}
-		if !b.statsAllowedIps[addr] {
+		if !isRequestFromAllowedIp(r, b.hub.trustedProxies, b.statsAllowedIps) {
 			http.Error(w, "Authentication check failed", http.StatusForbidden)
 			return
 		}
@@ -626,6 +800,16 @@ func (b *BackendServer) validateStatsRequest(f func(http.ResponseWriter, *http.R
 	}
 }
 
+func (b *BackendServer) validateStatsAdminRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return b.validateStatsRequest(func(w http.ResponseWriter, r *http.Request) {
+		if !b.checkAdminSecret(w, r) {
+			return
+		}
+
+		f(w, r)
+	})
+}
+
 func (b *BackendServer) statsHandler(w http.ResponseWriter, r *http.Request) {
 	stats := b.hub.GetStats()
 	statsData, err := json.MarshalIndent(stats, "", "  ")
@@ -641,6 +825,44 @@ func (b *BackendServer) statsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(statsData) // nolint
 }
 
+func (b *BackendServer) roomStatsHandler(w http.ResponseWriter, r *http.Request) {
+	response := &RoomStatsResponse{
+		Rooms: b.hub.GetRoomStats(r.URL.Query().Get("backend")),
+	}
+	statsData, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Printf("Could not serialize room stats: %s", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(statsData) // nolint
+}
+
+func (b *BackendServer) clusterStatsHandler(w http.ResponseWriter, r *http.Request) {
+	response, err := b.hub.GetClusterStats(r.Context(), r.URL.Query().Get("backend"))
+	if err != nil {
+		log.Printf("Could not get cluster stats: %s", err)
+		http.Error(w, "Could not get cluster stats", http.StatusInternalServerError)
+		return
+	}
+
+	statsData, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Printf("Could not serialize cluster stats: %s", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(statsData) // nolint
+}
+
 func (b *BackendServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	promhttp.Handler().ServeHTTP(w, r)
 }
@@ -0,0 +1,486 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAdminKickReason = "kicked"
+)
+
+func (b *BackendServer) validateAdminRequest(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isRequestFromAllowedIp(r, b.hub.trustedProxies, b.adminAllowedIps) {
+			http.Error(w, "Authentication check failed", http.StatusForbidden)
+			return
+		}
+
+		if !b.checkAdminSecret(w, r) {
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+// checkAdminSecret returns true if the request contains the admin secret as
+// bearer token. Otherwise an error is returned to the client.
+func (b *BackendServer) checkAdminSecret(w http.ResponseWriter, r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if len(b.adminSecret) == 0 || !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), b.adminSecret) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Authentication check failed", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func isValidBackendId(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/, \t\r\n")
+}
+
+func (b *BackendServer) newAdminInformation(backend *Backend) *BackendAdminInformation {
+	return &BackendAdminInformation{
+		Id:  backend.id,
+		Url: backend.url,
+
+		SessionLimit: backend.sessionLimit,
+
+		MaxStreamBitrate: backend.maxStreamBitrate,
+		MaxScreenBitrate: backend.maxScreenBitrate,
+
+		PingInterval:     backend.pingInterval,
+		IdlePingInterval: backend.idlePingInterval,
+
+		Maintenance: backend.maintenance,
+
+		Connections:     backend.maxConcurrentRequests,
+		IdleConnections: backend.maxIdleConnections,
+
+		HasSecondarySecret: len(backend.secondarySecret) > 0,
+
+		ReadOnly: b.hub.backend.backends.IsBackendReadOnly(backend.id),
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Could not serialize %+v: %s", value, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data) // nolint
+}
+
+func writeAdminError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case errors.Is(err, ErrBackendNotFound):
+		http.Error(w, "No such backend", http.StatusNotFound)
+	case errors.Is(err, ErrBackendReadOnly):
+		http.Error(w, "Backend is defined in the configuration file", http.StatusForbidden)
+	case errors.Is(err, ErrBackendNoSecondarySecret):
+		http.Error(w, "Backend has no secondary secret", http.StatusConflict)
+	case errors.Is(err, ErrBackendStorageNotConfigured):
+		http.Error(w, "Backends can not be changed", http.StatusNotImplemented)
+	default:
+		log.Printf("Could not change backend %s: %s", id, err)
+		http.Error(w, "Could not change backend", http.StatusInternalServerError)
+	}
+}
+
+func (b *BackendServer) adminListBackends(w http.ResponseWriter, r *http.Request) {
+	backends := b.hub.backend.GetBackends()
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].id < backends[j].id
+	})
+
+	response := &BackendAdminListResponse{
+		Backends: make([]*BackendAdminInformation, 0, len(backends)),
+	}
+	for _, backend := range backends {
+		response.Backends = append(response.Backends, b.newAdminInformation(backend))
+	}
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func (b *BackendServer) adminGetBackend(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	backend := b.hub.backend.backends.GetBackendById(id)
+	if backend == nil {
+		http.Error(w, "No such backend", http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, b.newAdminInformation(backend))
+}
+
+func readAdminRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return false
+	}
+
+	if err := json.Unmarshal(body, request); err != nil {
+		http.Error(w, "Could not decode body", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (b *BackendServer) storeAdminBackend(w http.ResponseWriter, r *http.Request, id string, info *BackendInformationEtcd, status int) {
+	if err := info.CheckValid(); err != nil {
+		http.Error(w, "Invalid backend: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.hub.backendTimeout)
+	defer cancel()
+
+	if err := b.hub.backend.backends.StoreBackend(ctx, id, info); err != nil {
+		writeAdminError(w, id, err)
+		return
+	}
+
+	log.Printf("Backend %s for %s stored through admin API by %s", id, info.Url, getRealUserIP(r, b.hub.trustedProxies))
+	backend := b.hub.backend.backends.GetBackendById(id)
+	if backend == nil {
+		http.Error(w, "No such backend", http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, status, b.newAdminInformation(backend))
+}
+
+func (b *BackendServer) adminCreateBackend(w http.ResponseWriter, r *http.Request) {
+	var request BackendAdminCreateRequest
+	if !readAdminRequest(w, r, &request) {
+		return
+	}
+
+	if !isValidBackendId(request.Id) {
+		http.Error(w, "Invalid backend id", http.StatusBadRequest)
+		return
+	} else if b.hub.backend.backends.GetBackendById(request.Id) != nil {
+		http.Error(w, "Backend already exists", http.StatusConflict)
+		return
+	}
+
+	b.storeAdminBackend(w, r, request.Id, &request.BackendInformationEtcd, http.StatusCreated)
+}
+
+func (b *BackendServer) adminUpdateBackend(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !isValidBackendId(id) {
+		http.Error(w, "Invalid backend id", http.StatusBadRequest)
+		return
+	}
+
+	var info BackendInformationEtcd
+	if !readAdminRequest(w, r, &info) {
+		return
+	}
+
+	b.storeAdminBackend(w, r, id, &info, http.StatusOK)
+}
+
+func (b *BackendServer) adminDeleteBackend(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.hub.backendTimeout)
+	defer cancel()
+
+	if err := b.hub.backend.backends.DeleteBackend(ctx, id); err != nil {
+		writeAdminError(w, id, err)
+		return
+	}
+
+	log.Printf("Backend %s deleted through admin API by %s", id, getRealUserIP(r, b.hub.trustedProxies))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *BackendServer) adminPromoteBackendSecret(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.hub.backendTimeout)
+	defer cancel()
+
+	if err := b.hub.backend.backends.PromoteSecondarySecret(ctx, id); err != nil {
+		writeAdminError(w, id, err)
+		return
+	}
+
+	log.Printf("Secondary secret of backend %s promoted through admin API by %s", id, getRealUserIP(r, b.hub.trustedProxies))
+	backend := b.hub.backend.backends.GetBackendById(id)
+	if backend == nil {
+		http.Error(w, "No such backend", http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, b.newAdminInformation(backend))
+}
+
+func (b *BackendServer) adminSetBackendMaintenance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	maintenance := r.Method == http.MethodPost
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.hub.backendTimeout)
+	defer cancel()
+
+	if err := b.hub.backend.backends.SetMaintenance(ctx, id, maintenance); err != nil {
+		writeAdminError(w, id, err)
+		return
+	}
+
+	if maintenance {
+		log.Printf("Backend %s put in maintenance through admin API by %s", id, getRealUserIP(r, b.hub.trustedProxies))
+	} else {
+		log.Printf("Maintenance of backend %s ended through admin API by %s", id, getRealUserIP(r, b.hub.trustedProxies))
+	}
+	backend := b.hub.backend.backends.GetBackendById(id)
+	if backend == nil {
+		http.Error(w, "No such backend", http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, b.newAdminInformation(backend))
+}
+
+func (b *BackendServer) adminGetSessionEvents(w http.ResponseWriter, r *http.Request) {
+	sessionId := mux.Vars(r)["sessionid"]
+	events, active := b.hub.GetSessionEvents(sessionId)
+	if events == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Events of session %s requested through admin API by %s", sessionId, getRealUserIP(r, b.hub.trustedProxies))
+	response := &SessionAdminEventsResponse{
+		SessionId: sessionId,
+		Active:    active,
+		Events:    events.Events(),
+	}
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func newSessionAdminMcuClient(ctx context.Context, client McuClient) *SessionAdminMcuClient {
+	result := &SessionAdminMcuClient{
+		Id:         client.Id(),
+		StreamType: client.StreamType(),
+	}
+	if subscriber, ok := client.(McuSubscriber); ok {
+		result.Publisher = subscriber.Publisher()
+	}
+	if c, ok := client.(McuClientWithStats); ok {
+		stats, err := c.Stats(ctx)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Stats = stats
+		}
+	}
+	return result
+}
+
+func (b *BackendServer) adminGetSessionMcu(w http.ResponseWriter, r *http.Request) {
+	sessionId := mux.Vars(r)["sessionid"]
+	session, ok := b.hub.GetSessionByPublicId(sessionId).(*ClientSession)
+	if !ok {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), b.hub.mcuTimeout)
+	defer cancel()
+
+	publishers := session.GetPublishers()
+	streamTypes := make([]string, 0, len(publishers))
+	for streamType := range publishers {
+		streamTypes = append(streamTypes, streamType)
+	}
+	sort.Strings(streamTypes)
+
+	response := &SessionAdminMcuResponse{
+		SessionId:   sessionId,
+		Publishers:  make([]*SessionAdminMcuClient, 0, len(publishers)),
+		Subscribers: []*SessionAdminMcuClient{},
+	}
+	for _, streamType := range streamTypes {
+		response.Publishers = append(response.Publishers, newSessionAdminMcuClient(ctx, publishers[streamType]))
+	}
+	for _, subscriber := range session.GetSubscribers() {
+		response.Subscribers = append(response.Subscribers, newSessionAdminMcuClient(ctx, subscriber))
+	}
+	sort.Slice(response.Subscribers, func(i, j int) bool {
+		if response.Subscribers[i].Publisher != response.Subscribers[j].Publisher {
+			return response.Subscribers[i].Publisher < response.Subscribers[j].Publisher
+		}
+		return response.Subscribers[i].StreamType < response.Subscribers[j].StreamType
+	})
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func newSessionAdminInformation(session Session) *SessionAdminInformation {
+	info := &SessionAdminInformation{
+		SessionId:  session.PublicId(),
+		Backend:    session.Backend().Id(),
+		ClientType: session.ClientType(),
+		UserId:     session.UserId(),
+		Connected:  true,
+	}
+	if room := session.GetRoom(); room != nil {
+		info.RoomId = room.Id()
+	}
+	if sess, ok := session.(*ClientSession); ok {
+		info.RoomSessionId = sess.RoomSessionId()
+		info.Connected = sess.GetClient() != nil
+		info.Muted = NewSessionMuteState(sess.GetMutedMedia())
+		info.Quality = sess.GetQualityStats()
+	}
+	return info
+}
+
+func (b *BackendServer) adminListSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sessions := b.hub.GetSessions(query.Get("backend"), query.Get("room"), query.Get("user"))
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].PublicId() < sessions[j].PublicId()
+	})
+
+	response := &SessionAdminListResponse{
+		Sessions: make([]*SessionAdminInformation, 0, len(sessions)),
+	}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, newSessionAdminInformation(session))
+	}
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func (b *BackendServer) adminKickSession(w http.ResponseWriter, r *http.Request) {
+	sessionId := mux.Vars(r)["sessionid"]
+	if b.hub.decodeSessionId(sessionId, publicSessionName) == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = defaultAdminKickReason
+	}
+
+	local, err := b.hub.KickSession(sessionId, reason)
+	if err != nil {
+		log.Printf("Could not kick session %s: %s", sessionId, err)
+		http.Error(w, "Could not kick session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Session %s kicked through admin API by %s (%s)", sessionId, getRealUserIP(r, b.hub.trustedProxies), reason)
+	if local {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		// The session is not connected to this server, the request has been
+		// forwarded to the other servers.
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (b *BackendServer) adminCloseRoom(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	backend := b.hub.backend.backends.GetBackendById(id)
+	if backend == nil {
+		http.Error(w, "No such backend", http.StatusNotFound)
+		return
+	}
+
+	roomId := vars["roomid"]
+	request := &BackendServerRoomRequest{
+		Type:   "delete",
+		Delete: &BackendRoomDeleteRequest{},
+
+		ReceivedTime: time.Now().UnixNano(),
+	}
+	if err := b.nats.PublishBackendServerRoomRequest(GetSubjectForBackendRoomId(roomId, backend), request); err != nil {
+		log.Printf("Could not close room %s in backend %s: %s", roomId, id, err)
+		http.Error(w, "Could not close room", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Room %s in backend %s closed through admin API by %s", roomId, id, getRealUserIP(r, b.hub.trustedProxies))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *BackendServer) adminGetConfig(w http.ResponseWriter, r *http.Request) {
+	backends := b.hub.backend.GetBackends()
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].id < backends[j].id
+	})
+
+	response := &ConfigAdminResponse{
+		Values:   GetConfigValues(b.hub.getConfig()),
+		Backends: make([]*ConfigAdminBackend, 0, len(backends)),
+	}
+	for _, backend := range backends {
+		response.Backends = append(response.Backends, &ConfigAdminBackend{
+			Id:     backend.id,
+			Url:    backend.url,
+			Source: b.hub.backend.backends.GetBackendSource(backend.id),
+		})
+	}
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func (b *BackendServer) adminGetThrottle(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, b.hub.throttler.GetState())
+}
+
+func (b *BackendServer) adminListRooms(w http.ResponseWriter, r *http.Request) {
+	response, err := b.hub.GetClusterStats(r.Context(), r.URL.Query().Get("backend"))
+	if err != nil {
+		log.Printf("Could not get rooms of cluster: %s", err)
+		http.Error(w, "Could not get rooms", http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,783 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	testAdminSecret = "admin-secret"
+)
+
+func performAdminRequest(t *testing.T, method string, url string, secret string, body interface{}) (*http.Response, []byte) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		request.Header.Set("Authorization", "Bearer "+secret)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	result, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, result
+}
+
+func TestBackendServer_AdminBackends(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend", "backendsfile", filepath.Join(t.TempDir(), "backends.json"))
+	config.AddOption("backend1", "url", "https://domain1.invalid/")
+	config.AddOption("backend1", "secret", "secret1")
+	_, _, _, _, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/backends", "", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized without secret, got %s", res.Status)
+	}
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/backends", "invalid", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized with invalid secret, got %s", res.Status)
+	}
+
+	res, body := performAdminRequest(t, "GET", server.URL+"/admin/backends", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var list BackendAdminListResponse
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Backends) != 1 || list.Backends[0].Id != "backend1" || !list.Backends[0].ReadOnly {
+		t.Errorf("unexpected backends %s", string(body))
+	}
+	if bytes.Contains(body, []byte("secret1")) {
+		t.Errorf("secrets must not be returned: %s", string(body))
+	}
+
+	create := &BackendAdminCreateRequest{
+		Id: "backend2",
+		BackendInformationEtcd: BackendInformationEtcd{
+			Url:          "https://domain2.invalid",
+			Secret:       "secret2",
+			SessionLimit: 5,
+		},
+	}
+	if res, body := performAdminRequest(t, "POST", server.URL+"/admin/backends", testAdminSecret, create); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected created, got %s: %s", res.Status, string(body))
+	}
+	if res, _ := performAdminRequest(t, "POST", server.URL+"/admin/backends", testAdminSecret, create); res.StatusCode != http.StatusConflict {
+		t.Errorf("expected conflict, got %s", res.Status)
+	}
+	create.Id = "invalid/id"
+	if res, _ := performAdminRequest(t, "POST", server.URL+"/admin/backends", testAdminSecret, create); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %s", res.Status)
+	}
+
+	res, body = performAdminRequest(t, "GET", server.URL+"/admin/backends/backend2", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var info BackendAdminInformation
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Url != "https://domain2.invalid/" || info.SessionLimit != 5 || info.ReadOnly {
+		t.Errorf("unexpected backend %s", string(body))
+	}
+
+	update := &BackendInformationEtcd{
+		Url:    "https://domain2.invalid",
+		Secret: "secret2",
+	}
+	res, body = performAdminRequest(t, "PUT", server.URL+"/admin/backends/backend2", testAdminSecret, update)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var updated BackendAdminInformation
+	if err := json.Unmarshal(body, &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.SessionLimit != 0 {
+		t.Errorf("session limit should have been removed, got %s", string(body))
+	}
+	if res, _ := performAdminRequest(t, "PUT", server.URL+"/admin/backends/backend1", testAdminSecret, update); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden for backend from configuration, got %s", res.Status)
+	}
+	update.Secret = ""
+	if res, _ := performAdminRequest(t, "PUT", server.URL+"/admin/backends/backend2", testAdminSecret, update); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %s", res.Status)
+	}
+
+	if res, _ := performAdminRequest(t, "DELETE", server.URL+"/admin/backends/backend1", testAdminSecret, nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden for backend from configuration, got %s", res.Status)
+	}
+	if res, body := performAdminRequest(t, "DELETE", server.URL+"/admin/backends/backend2", testAdminSecret, nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected no content, got %s: %s", res.Status, string(body))
+	}
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/backends/backend2", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+	if res, _ := performAdminRequest(t, "DELETE", server.URL+"/admin/backends/backend2", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+}
+
+func TestBackendServer_AdminDisabled(t *testing.T) {
+	_, _, _, _, _, server := CreateBackendServerForTest(t)
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/backends", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found if admin API is disabled, got %s", res.Status)
+	}
+}
+
+func TestBackendServer_AdminPromoteSecret(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend", "backendsfile", filepath.Join(t.TempDir(), "backends.json"))
+	config.AddOption("backend1", "url", "https://domain1.invalid/")
+	config.AddOption("backend1", "secret", "secret1")
+	config.AddOption("backend1", "secondarysecret", "secret1-new")
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	if res, _ := performAdminRequest(t, "POST", server.URL+"/admin/backends/backend1/promote", testAdminSecret, nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden for backend from configuration, got %s", res.Status)
+	}
+	if res, _ := performAdminRequest(t, "POST", server.URL+"/admin/backends/unknown/promote", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+
+	create := &BackendAdminCreateRequest{
+		Id: "backend2",
+		BackendInformationEtcd: BackendInformationEtcd{
+			Url:             "https://domain2.invalid",
+			Secret:          "secret2",
+			SecondarySecret: "secret2-new",
+		},
+	}
+	res, body := performAdminRequest(t, "POST", server.URL+"/admin/backends", testAdminSecret, create)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected created, got %s: %s", res.Status, string(body))
+	}
+	var info BackendAdminInformation
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	} else if !info.HasSecondarySecret {
+		t.Errorf("expected secondary secret, got %s", string(body))
+	}
+	if bytes.Contains(body, []byte("secret2")) {
+		t.Errorf("secrets must not be returned: %s", string(body))
+	}
+
+	res, body = performAdminRequest(t, "POST", server.URL+"/admin/backends/backend2/promote", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var promoted BackendAdminInformation
+	if err := json.Unmarshal(body, &promoted); err != nil {
+		t.Fatal(err)
+	} else if promoted.HasSecondarySecret {
+		t.Errorf("secondary secret should have been promoted, got %s", string(body))
+	}
+
+	if backend := hub.backend.backends.GetBackendById("backend2"); backend == nil {
+		t.Error("backend2 should exist")
+	} else if string(backend.Secret()) != "secret2-new" || len(backend.secondarySecret) != 0 {
+		t.Errorf("unexpected secrets %s / %s", string(backend.Secret()), string(backend.secondarySecret))
+	}
+
+	if res, _ := performAdminRequest(t, "POST", server.URL+"/admin/backends/backend2/promote", testAdminSecret, nil); res.StatusCode != http.StatusConflict {
+		t.Errorf("expected conflict without secondary secret, got %s", res.Status)
+	}
+}
+
+func TestBackendServer_AdminMaintenance(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	config.AddOption("backend", "backendsfile", filepath.Join(t.TempDir(), "backends.json"))
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	create := &BackendAdminCreateRequest{
+		Id: "backend1",
+		BackendInformationEtcd: BackendInformationEtcd{
+			Url:    server.URL,
+			Secret: string(testBackendSecret),
+		},
+	}
+	if res, body := performAdminRequest(t, "POST", server.URL+"/admin/backends", testAdminSecret, create); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected created, got %s: %s", res.Status, string(body))
+	}
+	if res, _ := performAdminRequest(t, "POST", server.URL+"/admin/backends/unknown/maintenance", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	res, body := performAdminRequest(t, "POST", server.URL+"/admin/backends/backend1/maintenance", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var info BackendAdminInformation
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	} else if !info.Maintenance {
+		t.Errorf("expected backend in maintenance, got %s", string(body))
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "backend_maintenance"); err != nil {
+		t.Fatal(err)
+	} else {
+		var details BackendMaintenanceDetails
+		if data, err := json.Marshal(message.Error.Details); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(data, &details); err != nil {
+			t.Fatal(err)
+		} else if details.RetryAfter != int(backendMaintenanceRetryAfter/time.Second) {
+			t.Errorf("unexpected details %+v", details)
+		}
+	}
+
+	res, body = performAdminRequest(t, "DELETE", server.URL+"/admin/backends/backend1/maintenance", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	info = BackendAdminInformation{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	} else if info.Maintenance {
+		t.Errorf("expected backend not in maintenance, got %s", string(body))
+	}
+
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendServer_AdminSessionEvents(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/sessions/unknown/events", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/sessions/"+hello.Hello.SessionId+"/events", "", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %s", res.Status)
+	}
+
+	res, body := performAdminRequest(t, "GET", server.URL+"/admin/sessions/"+hello.Hello.SessionId+"/events", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var response SessionAdminEventsResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.SessionId != hello.Hello.SessionId || !response.Active {
+		t.Errorf("unexpected response %s", string(body))
+	}
+	if len(response.Events) != 2 {
+		t.Fatalf("expected 2 events, got %s", string(body))
+	} else if response.Events[0].Type != SessionEventHello || response.Events[1].Type != SessionEventJoin {
+		t.Errorf("unexpected events %s", string(body))
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId)
+	if session == nil {
+		t.Fatalf("Could not get session %s", hello.Hello.SessionId)
+	}
+	session.Close()
+
+	res, body = performAdminRequest(t, "GET", server.URL+"/admin/sessions/"+hello.Hello.SessionId+"/events", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var closed SessionAdminEventsResponse
+	if err := json.Unmarshal(body, &closed); err != nil {
+		t.Fatal(err)
+	}
+	if closed.Active {
+		t.Errorf("session should be closed, got %s", string(body))
+	}
+	if len(closed.Events) == 0 || closed.Events[len(closed.Events)-1].Type != SessionEventClosed {
+		t.Errorf("expected closed event, got %s", string(body))
+	}
+}
+
+type testStatsPublisher struct {
+	McuPublisher
+
+	stats *McuClientStats
+}
+
+func (p *testStatsPublisher) Id() string {
+	return "the-publisher"
+}
+
+func (p *testStatsPublisher) StreamType() string {
+	return streamTypeVideo
+}
+
+func (p *testStatsPublisher) Stats(ctx context.Context) (*McuClientStats, error) {
+	return p.stats, nil
+}
+
+func TestBackendServer_AdminSessionMcu(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/sessions/unknown/mcu", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/sessions/"+hello.Hello.SessionId+"/mcu", "", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %s", res.Status)
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	stats := &McuClientStats{
+		BitrateReceived: 1000,
+		Lost:            2,
+		Nacks:           3,
+		Jitter:          4.5,
+	}
+	session.mu.Lock()
+	session.publishers = map[string]McuPublisher{
+		streamTypeVideo: &testStatsPublisher{
+			stats: stats,
+		},
+	}
+	session.mu.Unlock()
+	defer func() {
+		session.mu.Lock()
+		session.publishers = nil
+		session.mu.Unlock()
+	}()
+
+	res, body := performAdminRequest(t, "GET", server.URL+"/admin/sessions/"+hello.Hello.SessionId+"/mcu", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+	var response SessionAdminMcuResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.SessionId != hello.Hello.SessionId || len(response.Subscribers) != 0 {
+		t.Errorf("unexpected response %s", string(body))
+	}
+	if len(response.Publishers) != 1 {
+		t.Fatalf("expected one publisher, got %s", string(body))
+	} else if publisher := response.Publishers[0]; publisher.Id != "the-publisher" || publisher.StreamType != streamTypeVideo || publisher.Stats == nil || *publisher.Stats != *stats {
+		t.Errorf("unexpected publisher %+v", publisher)
+	}
+}
+
+func TestBackendServer_AdminSessions(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	_, _, n, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	listSessions := func(query string) []*SessionAdminInformation {
+		res, body := performAdminRequest(t, "GET", server.URL+"/admin/sessions"+query, testAdminSecret, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+		}
+		var response SessionAdminListResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Sessions
+	}
+
+	if sessions := listSessions(""); len(sessions) != 2 {
+		t.Errorf("expected two sessions, got %+v", sessions)
+	}
+	if sessions := listSessions("?backend=unknown"); len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %+v", sessions)
+	}
+	if sessions := listSessions("?user=" + testDefaultUserId + "2"); len(sessions) != 1 {
+		t.Errorf("expected one session, got %+v", sessions)
+	} else if sessions[0].SessionId != hello2.Hello.SessionId || sessions[0].RoomId != "" || !sessions[0].Connected {
+		t.Errorf("unexpected session %+v", sessions[0])
+	}
+	if sessions := listSessions("?backend=compat&room=" + roomId); len(sessions) != 1 {
+		t.Errorf("expected one session, got %+v", sessions)
+	} else if sessions[0].SessionId != hello1.Hello.SessionId || sessions[0].RoomId != roomId || sessions[0].UserId != testDefaultUserId+"1" {
+		t.Errorf("unexpected session %+v", sessions[0])
+	}
+
+	if res, _ := performAdminRequest(t, "DELETE", server.URL+"/admin/sessions/invalid-session", testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+	if res, body := performAdminRequest(t, "DELETE", server.URL+"/admin/sessions/"+hello2.Hello.SessionId+"?reason=ghost", testAdminSecret, nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected no content, got %s: %s", res.Status, string(body))
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(message, "bye"); err != nil {
+		t.Error(err)
+	} else if message.Bye.Reason != "ghost" {
+		t.Errorf("expected reason \"ghost\", got %+v", message.Bye)
+	}
+	if err := client2.WaitForSessionRemoved(ctx, hello2.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+
+	if res, _ := performAdminRequest(t, "DELETE", server.URL+"/admin/backends/unknown/rooms/"+roomId, testAdminSecret, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %s", res.Status)
+	}
+	if res, body := performAdminRequest(t, "DELETE", server.URL+"/admin/backends/compat/rooms/"+roomId, testAdminSecret, nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected no content, got %s: %s", res.Status, string(body))
+	}
+	if err := client1.RunUntilRoom(ctx, ""); err != nil {
+		t.Error(err)
+	}
+	if room := hub.getRoom(roomId); room != nil {
+		t.Errorf("room %s should have been closed", roomId)
+	}
+
+	// Sessions on other servers are kicked through NATS.
+	msg := &NatsMessage{
+		Type: "bye",
+		Message: &ServerMessage{
+			Type: "bye",
+			Bye: &ByeServerMessage{
+				Reason: "remote",
+			},
+		},
+	}
+	if err := n.PublishNats("session."+hello1.Hello.SessionId, msg); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(message, "bye"); err != nil {
+		t.Error(err)
+	} else if message.Bye.Reason != "remote" {
+		t.Errorf("expected reason \"remote\", got %+v", message.Bye)
+	}
+	if err := client1.WaitForSessionRemoved(ctx, hello1.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBackendServer_AdminConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	config.AddOption("backend", "backendsfile", filepath.Join(t.TempDir(), "backends.json"))
+	config.AddOption("app", "sessionevents", "10")
+	config.AddOption("backend", "backends", "backend2")
+	config.AddOption("backend2", "url", "https://domain2.invalid/")
+	config.AddOption("backend2", "secret", "secret2")
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	create := &BackendAdminCreateRequest{
+		Id: "backend1",
+		BackendInformationEtcd: BackendInformationEtcd{
+			Url:    "https://domain1.invalid",
+			Secret: "secret1",
+		},
+	}
+	if res, body := performAdminRequest(t, "POST", server.URL+"/admin/backends", testAdminSecret, create); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected created, got %s: %s", res.Status, string(body))
+	}
+
+	getConfig := func() *ConfigAdminResponse {
+		res, body := performAdminRequest(t, "GET", server.URL+"/admin/config", testAdminSecret, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+		}
+		if bytes.Contains(body, []byte(testAdminSecret)) || bytes.Contains(body, []byte("secret1")) || bytes.Contains(body, []byte("secret2")) {
+			t.Errorf("secrets must not be returned: %s", string(body))
+		}
+
+		var response ConfigAdminResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatal(err)
+		}
+		return &response
+	}
+	getValue := func(response *ConfigAdminResponse, section string, option string) *ConfigAdminValue {
+		for _, value := range response.Values {
+			if value.Section == section && value.Option == option {
+				return value
+			}
+		}
+		return nil
+	}
+
+	response := getConfig()
+	if value := getValue(response, "app", "sessionevents"); value == nil || value.Value != "10" || value.Source != ConfigSourceFile {
+		t.Errorf("unexpected sessionevents value %+v", value)
+	}
+	if value := getValue(response, "backend", "timeout"); value == nil || value.Source != ConfigSourceDefault {
+		t.Errorf("unexpected timeout value %+v", value)
+	}
+	if value := getValue(response, "admin", "secret"); value == nil || value.Value != redactedConfigValue {
+		t.Errorf("unexpected admin secret value %+v", value)
+	}
+
+	sources := make(map[string]string)
+	for _, backend := range response.Backends {
+		sources[backend.Id] = backend.Source
+	}
+	if sources["backend1"] != ConfigSourceBackendsFile || sources["backend2"] != ConfigSourceFile {
+		t.Errorf("unexpected backend sources %+v", response.Backends)
+	}
+
+	reloaded := goconf.NewConfigFile()
+	for _, section := range config.GetSections() {
+		options, _ := config.GetOptions(section)
+		for _, option := range options {
+			value, _ := config.GetRawString(section, option)
+			reloaded.AddOption(section, option, value)
+		}
+	}
+	reloaded.AddOption("app", "sessionevents", "20")
+	hub.Reload(reloaded)
+
+	response = getConfig()
+	if value := getValue(response, "app", "sessionevents"); value == nil || value.Value != "20" {
+		t.Errorf("expected reloaded sessionevents value, got %+v", value)
+	}
+}
+
+func TestBackendServer_AdminThrottle(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	config.AddOption("throttle", "exempt", "192.168.0.0/24")
+	config.AddOption("throttle", "join_maxattempts", "2")
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	throttler := hub.throttler.(*memoryThrottler)
+	throttler.doWait = func(ctx context.Context, delay time.Duration) {}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		throttle, err := throttler.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionJoin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		throttle(ctx)
+	}
+
+	res, body := performAdminRequest(t, "GET", server.URL+"/admin/throttle", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+	}
+
+	var response ThrottleAdminResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Type != "memory" {
+		t.Errorf("expected type memory, got %s", response.Type)
+	}
+	if len(response.Exempt) != 1 || response.Exempt[0] != "192.168.0.0/24" {
+		t.Errorf("unexpected exempt addresses %+v", response.Exempt)
+	}
+	if policy := response.Policies[ThrottleActionJoin]; policy == nil || policy.MaxAttempts != 2 {
+		t.Errorf("unexpected join policy %+v", policy)
+	}
+	if policy := response.Policies[ThrottleActionHello]; policy == nil || policy.MaxAttempts != defaultThrottleMaxAttempts || policy.MaxDelay != 25000 {
+		t.Errorf("unexpected hello policy %+v", policy)
+	}
+	if len(response.Clients) != 1 {
+		t.Fatalf("expected one client, got %+v", response.Clients)
+	} else if client := response.Clients[0]; client.Client != "192.0.2.1" || client.Action != ThrottleActionJoin || client.Attempts != 2 || !client.Blocked {
+		t.Errorf("unexpected client %+v", client)
+	}
+}
+
+func TestBackendServer_AdminRooms(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if res, _ := performAdminRequest(t, "GET", server.URL+"/admin/rooms", "", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %s", res.Status)
+	}
+
+	listRooms := func(query string) *ClusterStatsResponse {
+		res, body := performAdminRequest(t, "GET", server.URL+"/admin/rooms"+query, testAdminSecret, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected success, got %s: %s", res.Status, string(body))
+		}
+		var response ClusterStatsResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatal(err)
+		}
+		return &response
+	}
+
+	if response := listRooms(""); response.Servers != 1 || response.Sessions != 1 || len(response.Rooms) != 1 {
+		t.Errorf("unexpected response %+v", response)
+	} else if room := response.Rooms[0]; room.RoomId != roomId || room.Backend != "compat" || room.Participants != 1 || room.InCall != 0 || room.Servers != 1 {
+		t.Errorf("unexpected room %+v", room)
+	}
+	if response := listRooms("?backend=unknown"); response.Servers != 1 || response.Sessions != 0 || len(response.Rooms) != 0 {
+		t.Errorf("unexpected response %+v", response)
+	}
+}
@@ -160,6 +160,179 @@ func expectRoomlistEvent(n NatsClient, ch chan *nats.Msg, subject string, msgTyp
 	}
 }
 
+func TestBackendServer_Welcome(t *testing.T) {
+	_, _, _, hub, _, server := CreateBackendServerForTest(t)
+
+	res, err := http.Get(server.URL + "/api/v1/welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected success, got %s: %s", res.Status, string(body))
+	}
+
+	var welcome WelcomeServerMessage
+	if err := json.Unmarshal(body, &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Welcome != "Welcome" {
+		t.Errorf("Expected welcome message, got %s", string(body))
+	}
+	if len(welcome.HelloVersions) != 1 || welcome.HelloVersions[0] != HelloVersion || welcome.MaxHelloVersion != HelloVersion {
+		t.Errorf("Unexpected hello versions in %+v", welcome)
+	}
+	if !reflect.DeepEqual(welcome.Features, hub.info.Features) {
+		t.Errorf("Expected features %+v, got %+v", hub.info.Features, welcome.Features)
+	}
+	if welcome.Clustering != "standalone" {
+		t.Errorf("Expected standalone server, got %s", welcome.Clustering)
+	}
+}
+
+type testProxyPublisher struct {
+	McuPublisher
+
+	url string
+}
+
+func (p *testProxyPublisher) ProxyUrl() string {
+	return p.url
+}
+
+func TestBackendServer_RoomStats(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.GetRoom().setSessionInCall(session1, true)
+	session1.mu.Lock()
+	session1.publishers = map[string]McuPublisher{
+		streamTypeVideo: &testProxyPublisher{
+			url: "https://proxy1.domain.invalid",
+		},
+	}
+	session1.mu.Unlock()
+	defer func() {
+		session1.mu.Lock()
+		session1.publishers = nil
+		session1.mu.Unlock()
+	}()
+
+	res, body := performAdminRequest(t, "GET", server.URL+"/api/v1/stats/rooms", testAdminSecret, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected success, got %s: %s", res.Status, string(body))
+	}
+
+	var response RoomStatsResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Rooms) != 1 {
+		t.Fatalf("Expected one room, got %s", string(body))
+	}
+	stats := response.Rooms[0]
+	if stats.RoomId != roomId || stats.Participants != 2 || stats.InCall != 1 || stats.Publishers != 1 {
+		t.Errorf("Unexpected room stats %s", string(body))
+	}
+	if !reflect.DeepEqual(stats.Proxies, map[string]int{"https://proxy1.domain.invalid": 1}) {
+		t.Errorf("Unexpected proxies %+v", stats.Proxies)
+	}
+	for _, session := range stats.Sessions {
+		switch session.SessionId {
+		case hello1.Hello.SessionId:
+			if !session.InCall || len(session.Publishers) != 1 || session.Publishers[0].StreamType != streamTypeVideo || session.Publishers[0].Proxy != "https://proxy1.domain.invalid" {
+				t.Errorf("Unexpected stats for session 1 %+v", session)
+			}
+		case hello2.Hello.SessionId:
+			if session.InCall || len(session.Publishers) != 0 || session.UserId != testDefaultUserId+"2" {
+				t.Errorf("Unexpected stats for session 2 %+v", session)
+			}
+		default:
+			t.Errorf("Unexpected session %+v", session)
+		}
+	}
+
+	// Rooms can be filtered by backend.
+	if stats := hub.GetRoomStats("unknown-backend"); len(stats) != 0 {
+		t.Errorf("Expected no rooms for unknown backend, got %+v", stats)
+	}
+}
+
+func TestBackendServer_RoomStatsAuth(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("admin", "secret", testAdminSecret)
+	_, _, _, _, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	for _, path := range []string{"/api/v1/stats/rooms", "/api/v1/stats/cluster"} {
+		if res, _ := performAdminRequest(t, "GET", server.URL+path, "", nil); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected unauthorized for %s without secret, got %s", path, res.Status)
+		}
+		if res, _ := performAdminRequest(t, "GET", server.URL+path, "invalid", nil); res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected unauthorized for %s with invalid secret, got %s", path, res.Status)
+		}
+		if res, body := performAdminRequest(t, "GET", server.URL+path, testAdminSecret, nil); res.StatusCode != http.StatusOK {
+			t.Errorf("expected success for %s, got %s: %s", path, res.Status, string(body))
+		}
+	}
+
+	// The general stats don't require the secret.
+	if res, body := performAdminRequest(t, "GET", server.URL+"/api/v1/stats", "", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("expected success, got %s: %s", res.Status, string(body))
+	}
+}
+
+func TestBackendServer_RoomStatsNoAdminSecret(t *testing.T) {
+	_, _, _, _, _, server := CreateBackendServerForTest(t)
+
+	for _, path := range []string{"/api/v1/stats/rooms", "/api/v1/stats/cluster"} {
+		if res, _ := performAdminRequest(t, "GET", server.URL+path, "", nil); res.StatusCode != http.StatusNotFound {
+			t.Errorf("expected not found for %s, got %s", path, res.Status)
+		}
+	}
+}
+
 func TestBackendServer_NoAuth(t *testing.T) {
 	_, _, _, _, _, server := CreateBackendServerForTest(t)
 
@@ -308,6 +481,44 @@ func TestBackendServer_UnsupportedRequest(t *testing.T) {
 	}
 }
 
+func TestBackendServer_InvalidateCapabilities(t *testing.T) {
+	_, _, _, hub, _, server := CreateBackendServerForTest(t)
+
+	capabilities := hub.backend.capabilities
+	ownUrl := server.URL + "/"
+	otherUrl := "https://other.domain.invalid/"
+	capabilities.setCapabilities(ownUrl, map[string]interface{}{})
+	capabilities.setCapabilities(otherUrl, map[string]interface{}{})
+
+	msg := &BackendServerRoomRequest{
+		Type: "capabilities",
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/the-room-id", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	if _, found := capabilities.getCapabilities(ownUrl); found {
+		t.Errorf("Capabilities of %s should have been invalidated", ownUrl)
+	}
+	if _, found := capabilities.getCapabilities(otherUrl); !found {
+		t.Errorf("Capabilities of %s should not have been invalidated", otherUrl)
+	}
+}
+
 func TestBackendServer_RoomInvite(t *testing.T) {
 	_, _, n, hub, _, server := CreateBackendServerForTest(t)
 
@@ -1252,6 +1463,98 @@ func TestBackendServer_RoomMessage(t *testing.T) {
 	}
 }
 
+func TestBackendServer_Recording(t *testing.T) {
+	_, _, _, hub, _, server := CreateBackendServerForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	recorder := NewTestClient(t, server, hub)
+	defer recorder.CloseWithBye()
+	if err := recorder.SendHelloInternalWithFeatures([]string{ClientFeatureInternalRecording}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recorder.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	data, err := json.Marshal(&BackendServerRoomRequest{
+		Type: "recording",
+		Recording: &BackendRoomRecordingRequest{
+			Type: "start",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	if message, err := recorder.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "recording"); err != nil {
+		t.Fatal(err)
+	} else if message.Recording.Type != "start" || message.Recording.RoomId != roomId {
+		t.Errorf("Expected start of recording in %s, got %+v", roomId, message.Recording)
+	}
+
+	// No other recording backend is available after this one failed.
+	if err := recorder.WriteJSON(&ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "recording",
+			Recording: &RecordingInternalClientMessage{
+				Type:   "failed",
+				RoomId: roomId,
+				Error:  "out of disk space",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Target != "room" || message.Event.Type != "recording-failed" {
+		t.Errorf("Expected recording-failed event, got %+v", message.Event)
+	} else if message.Event.Recording == nil || message.Event.Recording.RoomId != roomId || message.Event.Recording.Error != RecordingFailedNoBackend {
+		t.Errorf("Expected failed recording in %s, got %+v", roomId, message.Event.Recording)
+	}
+}
+
 func TestBackendServer_TurnCredentials(t *testing.T) {
 	_, _, _, _, _, server := CreateBackendServerForTestWithTurn(t)
 
@@ -1294,3 +1597,249 @@ func TestBackendServer_TurnCredentials(t *testing.T) {
 		t.Errorf("Expected the list of servers as %s, got %s", turnServers, cred.URIs)
 	}
 }
+
+func TestBackendServer_TurnCredentialsGroups(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("turn", "apikey", turnApiKey)
+	config.AddOption("turn", "secret", turnSecret)
+	config.AddOption("turn", "servers", turnServersString)
+	config.AddOption("turn", "groups", "turn-other, turn-eu")
+	config.AddOption("turn-other", "secret", "other-secret")
+	config.AddOption("turn-other", "servers", "turn:5.6.7.8:3478")
+	config.AddOption("turn-other", "ttl", "3600")
+	config.AddOption("turn-eu", "secret", "eu-secret")
+	config.AddOption("turn-eu", "servers", "turn:eu.domain.invalid:3478")
+	config.AddOption("turn-eu", "regions", "EU")
+	_, _, _, _, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	q := make(url.Values)
+	q.Set("service", "turn")
+	q.Set("api", turnApiKey)
+	res, err := http.Get(server.URL + "/turn/credentials?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	var cred TurnCredentials
+	if err := json.Unmarshal(body, &cred); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cred.URIs, turnServers) {
+		t.Errorf("Expected the list of servers as %s, got %s", turnServers, cred.URIs)
+	}
+	// The regional group is not used for requests from localhost.
+	if len(cred.Servers) != 2 {
+		t.Fatalf("Expected two groups of servers, got %+v", cred.Servers)
+	}
+
+	expected := []struct {
+		secret  string
+		ttl     time.Duration
+		servers []string
+	}{
+		{turnSecret, 24 * time.Hour, turnServers},
+		{"other-secret", time.Hour, []string{"turn:5.6.7.8:3478"}},
+	}
+	for idx, e := range expected {
+		server := cred.Servers[idx]
+		m := hmac.New(sha1.New, []byte(e.secret))
+		m.Write([]byte(server.Username)) // nolint
+		password := base64.StdEncoding.EncodeToString(m.Sum(nil))
+		if server.Password != password {
+			t.Errorf("Expected password %s, got %s", password, server.Password)
+		}
+		if server.TTL != int64(e.ttl.Seconds()) {
+			t.Errorf("Expected a TTL of %d, got %d", int64(e.ttl.Seconds()), server.TTL)
+		}
+		if !reflect.DeepEqual(server.URIs, e.servers) {
+			t.Errorf("Expected the list of servers as %s, got %s", e.servers, server.URIs)
+		}
+	}
+}
+
+func TestBackendServer_TurnCredentialsWebhookFallback(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer webhook.Close()
+
+	config := goconf.NewConfigFile()
+	config.AddOption("turn", "apikey", turnApiKey)
+	config.AddOption("turn", "secret", turnSecret)
+	config.AddOption("turn", "servers", turnServersString)
+	config.AddOption("turn", "webhookurl", webhook.URL)
+	_, _, _, _, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	q := make(url.Values)
+	q.Set("service", "turn")
+	q.Set("api", turnApiKey)
+	res, err := http.Get(server.URL + "/turn/credentials?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	var cred TurnCredentials
+	if err := json.Unmarshal(body, &cred); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cred.URIs, turnServers) {
+		t.Errorf("Expected the list of servers as %s, got %s", turnServers, cred.URIs)
+	}
+}
+
+func TestBackendServer_ChecksumV2(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "checksumv2", "true")
+	_, _, _, hub, _, server := CreateBackendServerForTestFromConfig(t, config)
+
+	if !hasFeature(hub.info, ServerFeatureChecksumV2) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureChecksumV2, hub.info.Features)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// Requests to the backend use the v2 checksum (validated by the handler).
+	u, err := url.Parse(server.URL + "/ocs/v2.php/apps/spreed/api/v1/signaling/backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response BackendClientResponse
+	if err := hub.backend.PerformJSONRequest(ctx, u, NewBackendClientPingRequest("the-room", nil), &response); err != nil {
+		t.Fatal(err)
+	} else if response.Type != "ping" {
+		t.Errorf("Expected ping response, got %+v", response)
+	}
+
+	msg := &BackendServerRoomRequest{
+		Type: "update",
+		Update: &BackendRoomUpdateRequest{
+			UserIds: []string{
+				"the-user-id",
+			},
+		},
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func() *http.Request {
+		request, err := http.NewRequest("POST", server.URL+"/api/v1/room/the-room-id", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Spreed-Signaling-Backend", server.URL)
+		return request
+	}
+	performRequest := func(request *http.Request, status int) {
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if res.StatusCode != status {
+			t.Errorf("Expected status %d, got %s: %s", status, res.Status, string(body))
+		}
+	}
+
+	request := newRequest()
+	AddBackendChecksumV2(request, data, testBackendSecret)
+	performRequest(request, http.StatusOK)
+
+	// Requests can't be replayed.
+	replayed := newRequest()
+	for _, key := range []string{HeaderBackendSignalingRandom, HeaderBackendSignalingTimestamp, HeaderBackendSignalingChecksumV2} {
+		replayed.Header.Set(key, request.Header.Get(key))
+	}
+	performRequest(replayed, http.StatusForbidden)
+
+	// The old checksum is rejected as the backend supports the v2 checksum.
+	request = newRequest()
+	AddBackendChecksum(request, data, testBackendSecret)
+	performRequest(request, http.StatusForbidden)
+}
+
+func TestBackendServer_UsedNonces(t *testing.T) {
+	var nonces usedNonces
+	now := time.Now()
+	if !nonces.add("nonce1", now) {
+		t.Error("nonce1 should not have been used before")
+	}
+	if !nonces.add("nonce2", now) {
+		t.Error("nonce2 should not have been used before")
+	}
+	if nonces.add("nonce1", now.Add(time.Second)) {
+		t.Error("replayed nonce1 should have been rejected")
+	}
+	if nonces.add("nonce2", now.Add(2*BackendChecksumV2MaxAge)) {
+		t.Error("replayed nonce2 should have been rejected while the timestamp is valid")
+	}
+
+	// Nonces can be used again once requests with them would be too old.
+	if !nonces.add("nonce1", now.Add(3*BackendChecksumV2MaxAge)) {
+		t.Error("nonce1 should have expired")
+	}
+	nonces.mu.Lock()
+	defer nonces.mu.Unlock()
+	if _, found := nonces.nonces["nonce2"]; found {
+		t.Error("nonce2 should have been pruned")
+	}
+}
+
+func TestBackendServer_ChecksumV2Disabled(t *testing.T) {
+	_, _, _, hub, _, server := CreateBackendServerForTest(t)
+
+	if hasFeature(hub.info, ServerFeatureChecksumV2) {
+		t.Errorf("Feature %s should not be enabled, got %+v", ServerFeatureChecksumV2, hub.info.Features)
+	}
+
+	// The old checksum is still accepted if v2 checksums are not enabled,
+	// even if the backend supports them.
+	msg := &BackendServerRoomRequest{
+		Type: "update",
+		Update: &BackendRoomUpdateRequest{
+			UserIds: []string{
+				"the-user-id",
+			},
+		},
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/the-room-id", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected success, got %s: %s", res.Status, string(body))
+	}
+}
@@ -0,0 +1,212 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+// tlsClientSettings contains the TLS settings to use for requests to a
+// backend. The settings are comparable, so backends with the same settings
+// can share connections.
+type tlsClientSettings struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	minVersion uint16
+	skipVerify bool
+}
+
+func parseTLSVersion(value string) (uint16, error) {
+	switch strings.TrimSpace(value) {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %s", value)
+	}
+}
+
+// getTLSClientSettings returns the TLS settings configured in the given
+// section. Returns nil if the default settings should be used.
+func getTLSClientSettings(config *goconf.ConfigFile, section string) (*tlsClientSettings, error) {
+	caFile, _ := config.GetString(section, "cafile")
+	certFile, _ := config.GetString(section, "clientcert")
+	keyFile, _ := config.GetString(section, "clientkey")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("both a client certificate and key must be configured")
+	}
+
+	value, _ := config.GetString(section, "tlsminversion")
+	minVersion, err := parseTLSVersion(value)
+	if err != nil {
+		return nil, err
+	}
+
+	skipVerify, _ := config.GetBool(section, "skipverify")
+	if caFile == "" && certFile == "" && minVersion == 0 && !skipVerify {
+		return nil, nil
+	}
+
+	settings := &tlsClientSettings{
+		caFile:     caFile,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		minVersion: minVersion,
+		skipVerify: skipVerify,
+	}
+	// Make sure the files can be loaded.
+	if _, err := settings.newTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (s *tlsClientSettings) String() string {
+	return fmt.Sprintf("ca=%s,cert=%s,key=%s,minversion=%d,skipverify=%v", s.caFile, s.certFile, s.keyFile, s.minVersion, s.skipVerify)
+}
+
+func (s *tlsClientSettings) newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         s.minVersion,
+		InsecureSkipVerify: s.skipVerify,
+	}
+
+	if s.caFile != "" {
+		data, err := os.ReadFile(s.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", s.caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if s.certFile != "" {
+		reloader, err := newCertificateReloader(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return config, nil
+}
+
+// certificateReloader loads a certificate and reloads it if the certificate
+// or key file changed.
+type certificateReloader struct {
+	mu sync.Mutex
+
+	certFile string
+	keyFile  string
+
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (r *certificateReloader) getModTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *certificateReloader) load() error {
+	certModTime, keyModTime, err := r.getModTimes()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load client certificate: %w", err)
+	}
+
+	r.certificate = &certificate
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+func (r *certificateReloader) GetCertificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, keyModTime, err := r.getModTimes()
+	if err != nil {
+		log.Printf("Could not check client certificate %s for changes, using previous: %s", r.certFile, err)
+	} else if !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime) {
+		if err := r.load(); err != nil {
+			log.Printf("Could not reload client certificate %s, using previous: %s", r.certFile, err)
+		} else {
+			log.Printf("Reloaded client certificate %s", r.certFile)
+		}
+	}
+
+	return r.certificate
+}
+
+func (r *certificateReloader) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.GetCertificate(), nil
+}
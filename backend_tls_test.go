@@ -0,0 +1,247 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/gorilla/mux"
+)
+
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{
+			CommonName: "signaling",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyData, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: data}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestBackendTLSSettings(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	config := goconf.NewConfigFile()
+	if settings, err := getTLSClientSettings(config, "backend1"); err != nil {
+		t.Fatal(err)
+	} else if settings != nil {
+		t.Errorf("Expected default settings, got %s", settings)
+	}
+
+	config.AddOption("backend1", "cafile", certFile)
+	config.AddOption("backend1", "clientcert", certFile)
+	config.AddOption("backend1", "clientkey", keyFile)
+	config.AddOption("backend1", "tlsminversion", "1.2")
+	expected := &tlsClientSettings{
+		caFile:     certFile,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		minVersion: tls.VersionTLS12,
+	}
+	if settings, err := getTLSClientSettings(config, "backend1"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(expected, settings) {
+		t.Errorf("Expected %s, got %s", expected, settings)
+	}
+
+	invalid := map[string]string{
+		"cafile":        keyFile,
+		"clientcert":    path.Join(dir, "missing.pem"),
+		"clientkey":     "",
+		"tlsminversion": "1.4",
+	}
+	for option, value := range invalid {
+		config := goconf.NewConfigFile()
+		config.AddOption("backend1", "cafile", certFile)
+		config.AddOption("backend1", "clientcert", certFile)
+		config.AddOption("backend1", "clientkey", keyFile)
+		config.AddOption("backend1", option, value)
+		if settings, err := getTLSClientSettings(config, "backend1"); err == nil {
+			t.Errorf("Expected error for %s=%s, got %s", option, value, settings)
+		}
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if certificate, err := x509.ParseCertificate(reloader.GetCertificate().Certificate[0]); err != nil {
+		t.Fatal(err)
+	} else if certificate.SerialNumber.Int64() != 1 {
+		t.Errorf("Expected serial 1, got %s", certificate.SerialNumber)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 2)
+	modified := time.Now().Add(time.Minute)
+	for _, filename := range []string{certFile, keyFile} {
+		if err := os.Chtimes(filename, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if certificate, err := x509.ParseCertificate(reloader.GetCertificate().Certificate[0]); err != nil {
+		t.Fatal(err)
+	} else if certificate.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected serial 2, got %s", certificate.SerialNumber)
+	}
+
+	// The previous certificate is used if the files are invalid.
+	if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modified = modified.Add(time.Minute)
+	if err := os.Chtimes(keyFile, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	if certificate, err := x509.ParseCertificate(reloader.GetCertificate().Certificate[0]); err != nil {
+		t.Fatal(err)
+	} else if certificate.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected serial 2, got %s", certificate.SerialNumber)
+	}
+}
+
+func TestBackendClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+	clientCertificate := writeTestCertificate(t, certFile, keyFile, 1)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/ocs/v2.php/test", func(w http.ResponseWriter, r *http.Request) {
+		returnOCS(t, w, []byte("{\"foo\":\"bar\"}"))
+	})
+
+	server := httptest.NewUnstartedServer(r)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := path.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(server.URL + "/ocs/v2.php/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	for _, withClientCert := range []bool{false, true} {
+		config := goconf.NewConfigFile()
+		config.AddOption("backend", "backends", "backend1")
+		config.AddOption("backend1", "url", server.URL)
+		config.AddOption("backend1", "secret", string(testBackendSecret))
+		config.AddOption("backend1", "cafile", caFile)
+		config.AddOption("backend1", "tlsminversion", "1.2")
+		if withClientCert {
+			config.AddOption("backend1", "clientcert", certFile)
+			config.AddOption("backend1", "clientkey", keyFile)
+		}
+		client, err := NewBackendClient(config, 1, "0.0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response map[string]string
+		err = client.PerformJSONRequest(ctx, u, map[string]string{}, &response)
+		if !withClientCert {
+			if err == nil {
+				t.Error("Expected error without client certificate")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		} else if response["foo"] != "bar" {
+			t.Errorf("Expected response from backend, got %+v", response)
+		}
+	}
+}
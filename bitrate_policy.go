@@ -0,0 +1,138 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dlintw/goconf"
+)
+
+type bitrateTier struct {
+	publishers int
+	bitrate    int
+}
+
+// BitratePolicy calculates the maximum bitrate of video streams in a room
+// depending on the number of publishers and if screensharing is active.
+// Screensharing streams are limited separately depending on the number of
+// screensharing publishers.
+type BitratePolicy struct {
+	// Sorted by number of publishers in descending order.
+	tiers []bitrateTier
+
+	screenShareBitrate int
+
+	// Sorted by number of screensharing publishers in descending order.
+	screenTiers []bitrateTier
+}
+
+func parseBitrateTiers(value string) ([]bitrateTier, error) {
+	var tiers []bitrateTier
+	for _, entry := range strings.Fields(value) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bitrate tier %s, expected \"publishers:bitrate\"", entry)
+		}
+
+		publishers, err := strconv.Atoi(parts[0])
+		if err != nil || publishers <= 0 {
+			return nil, fmt.Errorf("invalid number of publishers in bitrate tier %s", entry)
+		}
+
+		bitrate, err := strconv.Atoi(parts[1])
+		if err != nil || bitrate <= 0 {
+			return nil, fmt.Errorf("invalid bitrate in bitrate tier %s", entry)
+		}
+
+		tiers = append(tiers, bitrateTier{
+			publishers: publishers,
+			bitrate:    bitrate,
+		})
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].publishers > tiers[j].publishers
+	})
+	return tiers, nil
+}
+
+// NewBitratePolicy creates a bitrate policy from the settings in section
+// "mcu". Returns nil if no limits are configured.
+func NewBitratePolicy(config *goconf.ConfigFile) (*BitratePolicy, error) {
+	value, _ := config.GetString("mcu", "bitratetiers")
+	tiers, err := parseBitrateTiers(value)
+	if err != nil {
+		return nil, err
+	}
+
+	screenShareBitrate, _ := config.GetInt("mcu", "screensharestreambitrate")
+	if screenShareBitrate < 0 {
+		return nil, fmt.Errorf("invalid screensharing stream bitrate %d", screenShareBitrate)
+	}
+
+	value, _ = config.GetString("mcu", "screensharetiers")
+	screenTiers, err := parseBitrateTiers(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tiers) == 0 && screenShareBitrate == 0 && len(screenTiers) == 0 {
+		return nil, nil
+	}
+
+	return &BitratePolicy{
+		tiers:              tiers,
+		screenShareBitrate: screenShareBitrate,
+		screenTiers:        screenTiers,
+	}, nil
+}
+
+func getTierBitrate(tiers []bitrateTier, publishers int) int {
+	for _, tier := range tiers {
+		if publishers >= tier.publishers {
+			return tier.bitrate
+		}
+	}
+	return 0
+}
+
+// GetStreamBitrate returns the maximum bitrate of video streams in a room with
+// the given number of video publishers. Returns 0 if the bitrate should not be
+// limited.
+func (p *BitratePolicy) GetStreamBitrate(publishers int, screensharing bool) int {
+	bitrate := getTierBitrate(p.tiers, publishers)
+	if screensharing && p.screenShareBitrate > 0 && (bitrate == 0 || p.screenShareBitrate < bitrate) {
+		bitrate = p.screenShareBitrate
+	}
+	return bitrate
+}
+
+// GetScreenBitrate returns the maximum bitrate of screensharing streams in a
+// room with the given number of screensharing publishers. Returns 0 if the
+// bitrate should not be limited.
+func (p *BitratePolicy) GetScreenBitrate(publishers int) int {
+	return getTierBitrate(p.screenTiers, publishers)
+}
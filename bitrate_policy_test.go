@@ -0,0 +1,125 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestBitratePolicy(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if policy, err := NewBitratePolicy(config); err != nil {
+		t.Fatal(err)
+	} else if policy != nil {
+		t.Errorf("Expected no policy, got %+v", policy)
+	}
+
+	config.AddOption("mcu", "bitratetiers", "20:262144 10:524288")
+	config.AddOption("mcu", "screensharestreambitrate", "393216")
+	policy, err := NewBitratePolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	} else if policy == nil {
+		t.Fatal("Expected a policy")
+	}
+
+	testcases := []struct {
+		publishers    int
+		screensharing bool
+		expected      int
+	}{
+		{1, false, 0},
+		{9, false, 0},
+		{10, false, 524288},
+		{19, false, 524288},
+		{20, false, 262144},
+		{100, false, 262144},
+		{1, true, 393216},
+		{10, true, 393216},
+		{20, true, 262144},
+	}
+	for _, tc := range testcases {
+		if bitrate := policy.GetStreamBitrate(tc.publishers, tc.screensharing); bitrate != tc.expected {
+			t.Errorf("Expected bitrate %d for %d publishers (screensharing %v), got %d", tc.expected, tc.publishers, tc.screensharing, bitrate)
+		}
+	}
+	// Screensharing streams are only limited by their own tiers.
+	if bitrate := policy.GetScreenBitrate(5); bitrate != 0 {
+		t.Errorf("Expected no screensharing bitrate limit, got %d", bitrate)
+	}
+}
+
+func TestBitratePolicyScreen(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("mcu", "screensharetiers", "4:524288 2:1048576")
+	policy, err := NewBitratePolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	} else if policy == nil {
+		t.Fatal("Expected a policy")
+	}
+
+	testcases := []struct {
+		publishers int
+		expected   int
+	}{
+		{1, 0},
+		{2, 1048576},
+		{3, 1048576},
+		{4, 524288},
+		{10, 524288},
+	}
+	for _, tc := range testcases {
+		if bitrate := policy.GetScreenBitrate(tc.publishers); bitrate != tc.expected {
+			t.Errorf("Expected screensharing bitrate %d for %d publishers, got %d", tc.expected, tc.publishers, bitrate)
+		}
+	}
+	// Camera streams are not limited by the screensharing tiers.
+	if bitrate := policy.GetStreamBitrate(10, true); bitrate != 0 {
+		t.Errorf("Expected no bitrate limit, got %d", bitrate)
+	}
+}
+
+func TestBitratePolicyInvalid(t *testing.T) {
+	for _, tiers := range []string{
+		"10",
+		"10:",
+		"abc:1000",
+		"0:1000",
+		"10:-1",
+		"10:1000 20",
+	} {
+		config := goconf.NewConfigFile()
+		config.AddOption("mcu", "bitratetiers", tiers)
+		if _, err := NewBitratePolicy(config); err == nil {
+			t.Errorf("Expected error for tiers %s", tiers)
+		}
+
+		config = goconf.NewConfigFile()
+		config.AddOption("mcu", "screensharetiers", tiers)
+		if _, err := NewBitratePolicy(config); err == nil {
+			t.Errorf("Expected error for screensharing tiers %s", tiers)
+		}
+	}
+}
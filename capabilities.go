@@ -29,6 +29,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -41,6 +42,13 @@ const (
 	// Name of capability to enable the "v3" API for the signaling endpoint.
 	FeatureSignalingV3Api = "signaling-v3"
 
+	// Name of capability to enable the "v2" checksum for backend requests.
+	FeatureSignalingChecksumV2 = "signaling-checksum-v2"
+
+	// Name of capability to enable pinging sessions of multiple rooms in one
+	// request to the "v3" API.
+	FeatureSignalingBatchPing = "signaling-batch-ping"
+
 	// Cache received capabilities for one hour.
 	CapabilitiesCacheDuration = time.Hour
 )
@@ -106,6 +114,32 @@ func (c *Capabilities) setCapabilities(key string, capabilities map[string]inter
 	c.entries[key] = entry
 }
 
+// RemoveEntries removes the cached capabilities of all urls starting with
+// the given prefix.
+func (c *Capabilities) RemoveEntries(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// RemoveMatchingEntries removes the cached capabilities of all urls matching
+// the given pattern.
+func (c *Capabilities) RemoveMatchingEntries(pattern *regexp.Regexp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if pattern.MatchString(key) {
+			delete(c.entries, key)
+		}
+	}
+}
+
 func (c *Capabilities) loadCapabilities(ctx context.Context, u *url.URL) (map[string]interface{}, error) {
 	key := u.String()
 
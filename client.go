@@ -24,7 +24,9 @@ package signaling
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"log"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,6 +50,9 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 64 * 1024
+
+	// Number of low-priority messages that can be queued before senders block.
+	lowPriorityQueueSize = 64
 )
 
 var (
@@ -93,30 +98,69 @@ type WritableClientMessage interface {
 	CloseAfterSend(session Session) bool
 }
 
+// LowPriorityClientMessage can be implemented by messages that may be delayed
+// by other messages sent to a client (e.g. participants updates).
+type LowPriorityClientMessage interface {
+	IsLowPriority() bool
+}
+
+// ClientConn is the connection of a client. Besides websockets, this can be
+// a long-polling connection that emulates the websocket semantics.
+type ClientConn interface {
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(appData string) error)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	NextReader() (messageType int, r io.Reader, err error)
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteMessage(messageType int, data []byte) error
+	EnableWriteCompression(enable bool)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
 type Client struct {
-	conn    *websocket.Conn
+	conn    ClientConn
 	addr    string
 	agent   string
 	closed  uint32
 	country *string
 	logRTT  bool
 
+	// Messages smaller than this are sent uncompressed, compression is
+	// disabled if zero.
+	compressionThreshold int
+
+	// Common name of the validated client certificate, if any.
+	certificateSubject string
+
+	// Heartbeat settings, accessed atomically.
+	pingPeriod int64
+	pongWait   int64
+	deadPeer   uint32
+
 	session unsafe.Pointer
 
 	mu sync.Mutex
 
 	closeChan         chan bool
+	heartbeatChan     chan bool
 	messagesDone      sync.WaitGroup
 	messageChan       chan *bytes.Buffer
 	messageProcessing uint32
 
+	// Low-priority messages are queued and sent from the write pump, so other
+	// messages (e.g. SDP offers / answers) don't have to wait for them.
+	lowPriorityChan chan WritableClientMessage
+	writerDone      chan struct{}
+
 	OnLookupCountry   func(*Client) string
 	OnClosed          func(*Client)
 	OnMessageReceived func(*Client, []byte)
 	OnRTTReceived     func(*Client, time.Duration)
 }
 
-func NewClient(conn *websocket.Conn, remoteAddress string, agent string) (*Client, error) {
+func NewClient(conn ClientConn, remoteAddress string, agent string) (*Client, error) {
 	remoteAddress = strings.TrimSpace(remoteAddress)
 	if remoteAddress == "" {
 		remoteAddress = "unknown remote address"
@@ -131,8 +175,15 @@ func NewClient(conn *websocket.Conn, remoteAddress string, agent string) (*Clien
 		agent:  agent,
 		logRTT: true,
 
-		closeChan:   make(chan bool, 1),
-		messageChan: make(chan *bytes.Buffer, 16),
+		pingPeriod: int64(pingPeriod),
+		pongWait:   int64(pongWait),
+
+		closeChan:     make(chan bool, 1),
+		heartbeatChan: make(chan bool, 1),
+		messageChan:   make(chan *bytes.Buffer, 16),
+
+		lowPriorityChan: make(chan WritableClientMessage, lowPriorityQueueSize),
+		writerDone:      make(chan struct{}),
 
 		OnLookupCountry:   func(client *Client) string { return unknownCountry },
 		OnClosed:          func(client *Client) {},
@@ -142,11 +193,31 @@ func NewClient(conn *websocket.Conn, remoteAddress string, agent string) (*Clien
 	return client, nil
 }
 
-func (c *Client) SetConn(conn *websocket.Conn, remoteAddress string) {
+// SetCompressionThreshold configures the minimum size of messages that will
+// be compressed if the client negotiated compression. Must be called before
+// messages are sent to the client.
+func (c *Client) SetCompressionThreshold(threshold int) {
+	c.compressionThreshold = threshold
+}
+
+func (c *Client) SetCertificateSubject(subject string) {
+	c.certificateSubject = subject
+}
+
+func (c *Client) CertificateSubject() string {
+	return c.certificateSubject
+}
+
+func (c *Client) SetConn(conn ClientConn, remoteAddress string) {
 	c.conn = conn
 	c.addr = remoteAddress
+	c.pingPeriod = int64(pingPeriod)
+	c.pongWait = int64(pongWait)
 	c.closeChan = make(chan bool, 1)
+	c.heartbeatChan = make(chan bool, 1)
 	c.messageChan = make(chan *bytes.Buffer, 16)
+	c.lowPriorityChan = make(chan WritableClientMessage, lowPriorityQueueSize)
+	c.writerDone = make(chan struct{})
 	c.OnLookupCountry = func(client *Client) string { return unknownCountry }
 	c.OnClosed = func(client *Client) {}
 	c.OnMessageReceived = func(client *Client, data []byte) {}
@@ -156,6 +227,38 @@ func (c *Client) IsConnected() bool {
 	return atomic.LoadUint32(&c.closed) == 0
 }
 
+// SetHeartbeat changes the interval in which pings are sent to the peer and
+// the time to wait for a response before the connection is considered dead.
+func (c *Client) SetHeartbeat(period time.Duration, wait time.Duration) {
+	atomic.StoreInt64(&c.pingPeriod, int64(period))
+	atomic.StoreInt64(&c.pongWait, int64(wait))
+	// The read pump only updates the deadline after the next message or pong
+	// was received, so apply the new timeout to the pending read.
+	c.mu.Lock()
+	if conn := c.conn; conn != nil {
+		conn.SetReadDeadline(time.Now().Add(wait)) // nolint
+	}
+	c.mu.Unlock()
+	select {
+	case c.heartbeatChan <- true:
+	default:
+	}
+}
+
+func (c *Client) getPingPeriod() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.pingPeriod))
+}
+
+func (c *Client) getPongWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.pongWait))
+}
+
+// IsDeadPeer returns true if the connection was closed because the peer
+// didn't respond to pings in time.
+func (c *Client) IsDeadPeer() bool {
+	return atomic.LoadUint32(&c.deadPeer) != 0
+}
+
 func (c *Client) IsAuthenticated() bool {
 	return c.GetSession() != nil
 }
@@ -247,9 +350,28 @@ func (c *Client) SendByeResponseWithReason(message *ClientMessage, reason string
 }
 
 func (c *Client) SendMessage(message WritableClientMessage) bool {
+	if m, ok := message.(LowPriorityClientMessage); ok && m.IsLowPriority() {
+		return c.queueMessage(message)
+	}
+
 	return c.writeMessage(message)
 }
 
+// queueMessage adds a low-priority message to the queue that is processed by
+// the write pump. Blocks if the queue is full.
+func (c *Client) queueMessage(message WritableClientMessage) bool {
+	if !c.IsConnected() {
+		return false
+	}
+
+	select {
+	case c.lowPriorityChan <- message:
+		return true
+	case <-c.writerDone:
+		return false
+	}
+}
+
 func (c *Client) ReadPump() {
 	defer func() {
 		c.Close()
@@ -268,7 +390,7 @@ func (c *Client) ReadPump() {
 	conn.SetReadLimit(maxMessageSize)
 	conn.SetPongHandler(func(msg string) error {
 		now := time.Now()
-		conn.SetReadDeadline(now.Add(pongWait)) // nolint
+		conn.SetReadDeadline(now.Add(c.getPongWait())) // nolint
 		if msg == "" {
 			return nil
 		}
@@ -290,9 +412,12 @@ func (c *Client) ReadPump() {
 	go c.processMessages()
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(pongWait)) // nolint
+		conn.SetReadDeadline(time.Now().Add(c.getPongWait())) // nolint
 		messageType, reader, err := conn.NextReader()
 		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				atomic.StoreUint32(&c.deadPeer, 1)
+			}
 			if _, ok := err.(*websocket.CloseError); !ok || websocket.IsUnexpectedCloseError(err,
 				websocket.CloseNormalClosure,
 				websocket.CloseGoingAway,
@@ -358,20 +483,53 @@ func (c *Client) processMessages() {
 	}
 }
 
+func marshalMessage(message json.Marshaler, writer io.Writer) error {
+	if m, ok := message.(*ServerMessage); ok {
+		if data := m.getPrepared(); data != nil {
+			_, err := writer.Write(data)
+			return err
+		}
+	}
+
+	if m, ok := (interface{}(message)).(easyjson.Marshaler); ok {
+		_, err := easyjson.MarshalToWriter(m, writer)
+		return err
+	}
+
+	return json.NewEncoder(writer).Encode(message)
+}
+
+// writeCompressed encodes the message first, so only messages exceeding the
+// compression threshold are compressed.
+func (c *Client) writeCompressed(message json.Marshaler) error {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bufferPool.Put(buffer)
+
+	if err := marshalMessage(message, buffer); err != nil {
+		return err
+	}
+
+	c.conn.EnableWriteCompression(buffer.Len() >= c.compressionThreshold)
+	return c.conn.WriteMessage(websocket.TextMessage, buffer.Bytes())
+}
+
 func (c *Client) writeInternal(message json.Marshaler) bool {
 	var closeData []byte
 
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint
-	writer, err := c.conn.NextWriter(websocket.TextMessage)
-	if err == nil {
-		if m, ok := (interface{}(message)).(easyjson.Marshaler); ok {
-			_, err = easyjson.MarshalToWriter(m, writer)
-		} else {
-			err = json.NewEncoder(writer).Encode(message)
+	var err error
+	if c.compressionThreshold > 0 {
+		err = c.writeCompressed(message)
+	} else {
+		var writer io.WriteCloser
+		writer, err = c.conn.NextWriter(websocket.TextMessage)
+		if err == nil {
+			err = marshalMessage(message, writer)
+		}
+		if err == nil {
+			err = writer.Close()
 		}
-	}
-	if err == nil {
-		err = writer.Close()
 	}
 	if err != nil {
 		if err == websocket.ErrCloseSent {
@@ -480,9 +638,10 @@ func (c *Client) sendPing() bool {
 }
 
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.getPingPeriod())
 	defer func() {
 		ticker.Stop()
+		close(c.writerDone)
 	}()
 
 	// Fetch initial RTT before any messages have been sent to the client.
@@ -493,6 +652,12 @@ func (c *Client) WritePump() {
 			if !c.sendPing() {
 				return
 			}
+		case <-c.heartbeatChan:
+			ticker.Reset(c.getPingPeriod())
+		case message := <-c.lowPriorityChan:
+			// Other messages are written directly by the senders and only
+			// have to wait for a single low-priority message.
+			c.writeMessage(message)
 		case <-c.closeChan:
 			return
 		}
@@ -43,7 +43,6 @@ import (
 
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
 	"github.com/mailru/easyjson"
 
@@ -120,7 +119,7 @@ type MessagePayload struct {
 
 type SignalingClient struct {
 	readyWg *sync.WaitGroup
-	cookie  *securecookie.SecureCookie
+	codec   *signaling.SessionIdCodec
 
 	conn *websocket.Conn
 
@@ -135,7 +134,7 @@ type SignalingClient struct {
 	userId           string
 }
 
-func NewSignalingClient(cookie *securecookie.SecureCookie, url string, stats *Stats, readyWg *sync.WaitGroup, doneWg *sync.WaitGroup) (*SignalingClient, error) {
+func NewSignalingClient(codec *signaling.SessionIdCodec, url string, stats *Stats, readyWg *sync.WaitGroup, doneWg *sync.WaitGroup) (*SignalingClient, error) {
 	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
 		return nil, err
@@ -143,7 +142,7 @@ func NewSignalingClient(cookie *securecookie.SecureCookie, url string, stats *St
 
 	client := &SignalingClient{
 		readyWg: readyWg,
-		cookie:  cookie,
+		codec:   codec,
 
 		conn: conn,
 
@@ -218,11 +217,11 @@ func (c *SignalingClient) processMessage(message *signaling.ServerMessage) {
 }
 
 func (c *SignalingClient) privateToPublicSessionId(privateId string) string {
-	var data signaling.SessionIdData
-	if err := c.cookie.Decode(privateSessionName, privateId, &data); err != nil {
+	data, err := c.codec.Decode(privateSessionName, privateId)
+	if err != nil {
 		panic(fmt.Sprintf("could not decode private session id: %s", err))
 	}
-	encoded, err := c.cookie.Encode(publicSessionName, data)
+	encoded, err := c.codec.Encode(publicSessionName, data)
 	if err != nil {
 		panic(fmt.Sprintf("could not encode public id: %s", err))
 	}
@@ -521,26 +520,10 @@ func main() {
 	secret, _ := config.GetString("backend", "secret")
 	backendSecret = []byte(secret)
 
-	hashKey, _ := config.GetString("sessions", "hashkey")
-	switch len(hashKey) {
-	case 32:
-	case 64:
-	default:
-		log.Printf("WARNING: The sessions hash key should be 32 or 64 bytes but is %d bytes", len(hashKey))
-	}
-
-	blockKey, _ := config.GetString("sessions", "blockkey")
-	blockBytes := []byte(blockKey)
-	switch len(blockKey) {
-	case 0:
-		blockBytes = nil
-	case 16:
-	case 24:
-	case 32:
-	default:
-		log.Fatalf("The sessions block key must be 16, 24 or 32 bytes but is %d bytes", len(blockKey))
+	codec, err := signaling.NewSessionIdCodec(config)
+	if err != nil {
+		log.Fatal("Could not create session id codec: ", err)
 	}
-	cookie := securecookie.New([]byte(hashKey), blockBytes).MaxAge(0)
 
 	cpus := runtime.NumCPU()
 	runtime.GOMAXPROCS(cpus)
@@ -593,7 +576,7 @@ func main() {
 	var readyWg sync.WaitGroup
 
 	for i := 0; i < *maxClients; i++ {
-		client, err := NewSignalingClient(cookie, urls[i%len(urls)].String(), stats, &readyWg, &doneWg)
+		client, err := NewSignalingClient(codec, urls[i%len(urls)].String(), stats, &readyWg, &doneWg)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,201 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testClientConn struct {
+	mu           sync.Mutex
+	messages     []*ServerMessage
+	received     chan struct{}
+	readDeadline time.Time
+}
+
+func newTestClientConn() *testClientConn {
+	return &testClientConn{
+		received: make(chan struct{}, 16),
+	}
+}
+
+type testClientConnWriter struct {
+	bytes.Buffer
+
+	conn *testClientConn
+}
+
+func (w *testClientConnWriter) Close() error {
+	return w.conn.WriteMessage(websocket.TextMessage, w.Bytes())
+}
+
+func (c *testClientConn) SetReadLimit(limit int64)                    {}
+func (c *testClientConn) SetPongHandler(h func(appData string) error) {}
+func (c *testClientConn) SetWriteDeadline(t time.Time) error          { return nil }
+func (c *testClientConn) EnableWriteCompression(enable bool)          {}
+func (c *testClientConn) RemoteAddr() net.Addr                        { return nil }
+func (c *testClientConn) Close() error                                { return nil }
+
+func (c *testClientConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *testClientConn) getReadDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readDeadline
+}
+
+func (c *testClientConn) NextReader() (int, io.Reader, error) {
+	return 0, nil, io.EOF
+}
+
+func (c *testClientConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &testClientConnWriter{
+		conn: c,
+	}, nil
+}
+
+func (c *testClientConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return nil
+	}
+
+	var message ServerMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.messages = append(c.messages, &message)
+	c.mu.Unlock()
+	c.received <- struct{}{}
+	return nil
+}
+
+func (c *testClientConn) getMessages() []*ServerMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make([]*ServerMessage, len(c.messages))
+	copy(result, c.messages)
+	return result
+}
+
+func newTestParticipantsUpdate(roomId string) *ServerMessage {
+	return &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: roomId,
+			},
+		},
+	}
+}
+
+func TestClient_LowPriorityMessages(t *testing.T) {
+	conn := newTestClientConn()
+	client, err := NewClient(conn, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Low-priority messages are queued until the write pump is running.
+	for _, roomId := range []string{"room1", "room2"} {
+		if !client.SendMessage(newTestParticipantsUpdate(roomId)) {
+			t.Fatalf("Could not queue update for %s", roomId)
+		}
+	}
+	if !client.SendError(NewError("test_error", "Test error.")) {
+		t.Fatal("Could not send error")
+	}
+	if messages := conn.getMessages(); len(messages) != 1 {
+		t.Fatalf("Expected only the error to be sent, got %+v", messages)
+	} else if err := checkMessageError(messages[0], "test_error"); err != nil {
+		t.Error(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.WritePump()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	for len(conn.getMessages()) < 3 {
+		select {
+		case <-conn.received:
+		case <-ctx.Done():
+			t.Fatalf("Queued messages were not sent: %s", ctx.Err())
+		}
+	}
+
+	// The order of low-priority messages is kept.
+	messages := conn.getMessages()
+	for idx, roomId := range []string{"room1", "room2"} {
+		if msg := messages[idx+1]; !msg.IsParticipantsUpdate() || msg.Event.Update.RoomId != roomId {
+			t.Errorf("Expected update for %s, got %+v", roomId, msg)
+		}
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatalf("Write pump was not stopped: %s", ctx.Err())
+	}
+
+	if client.SendMessage(newTestParticipantsUpdate("room3")) {
+		t.Error("Should not be able to queue messages for closed clients")
+	}
+}
+
+func TestClient_SetHeartbeatReadDeadline(t *testing.T) {
+	conn := newTestClientConn()
+	client, err := NewClient(conn, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new timeout must be applied to the pending read immediately.
+	before := time.Now()
+	client.SetHeartbeat(50*time.Millisecond, 200*time.Millisecond)
+	if deadline := conn.getReadDeadline(); deadline.Before(before.Add(200*time.Millisecond)) || deadline.After(time.Now().Add(200*time.Millisecond)) {
+		t.Errorf("Expected read deadline in 200ms, got %s", deadline.Sub(before))
+	}
+}
@@ -35,6 +35,7 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/pion/sdp"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -57,10 +58,15 @@ type ClientSession struct {
 	data      *SessionIdData
 
 	clientType string
+	country    string
 	features   []string
 	userId     string
 	userData   *json.RawMessage
 
+	// Negotiated versions of the command sets of internal client features.
+	featureVersions     map[string]int
+	unsupportedFeatures []*InternalFeatureError
+
 	supportsPermissions bool
 	permissions         map[Permission]bool
 
@@ -83,6 +89,9 @@ type ClientSession struct {
 	sessionSubscription NatsSubscription
 	roomSubscription    NatsSubscription
 
+	breakoutSubscriptions map[string]NatsSubscription
+	additionalRooms       map[string]*additionalRoom
+
 	publishers  map[string]McuPublisher
 	subscribers map[string]McuSubscriber
 
@@ -91,6 +100,21 @@ type ClientSession struct {
 	hasPendingParticipantsUpdate bool
 
 	virtualSessions map[*VirtualSession]bool
+
+	eventFilter *EventFilter
+
+	roomKeyLimiter *rate.Limiter
+
+	events *SessionEvents
+
+	// Metadata the client attached to the session.
+	metadata map[string]interface{}
+	// Media of the published camera stream that is muted.
+	mutedMedia MediaType
+
+	// Last connection quality reported by the client.
+	qualityStats        *ClientQualityStats
+	qualityStatsUpdated time.Time
 }
 
 func NewClientSession(hub *Hub, privateId string, publicId string, data *SessionIdData, backend *Backend, hello *HelloClientMessage, auth *BackendClientAuthResponse) (*ClientSession, error) {
@@ -108,10 +132,15 @@ func NewClientSession(hub *Hub, privateId string, publicId string, data *Session
 		backend: backend,
 
 		natsReceiver: make(chan *nats.Msg, 64),
+		events:       NewSessionEvents(hub.sessionEventsSize),
 		stopRun:      make(chan bool, 1),
 		runStopped:   make(chan bool, 1),
 	}
 	if s.clientType == HelloClientTypeInternal {
+		s.featureVersions, s.unsupportedFeatures = negotiateInternalFeatures(s.features, hello.Versions)
+		for _, f := range s.unsupportedFeatures {
+			log.Printf("Internal session %s uses unsupported feature %s", publicId, f)
+		}
 		s.backendUrl = hello.Auth.internalParams.Backend
 		s.parsedBackendUrl = hello.Auth.internalParams.parsedBackend
 	} else {
@@ -169,6 +198,12 @@ func (s *ClientSession) GetFeatures() []string {
 	return s.features
 }
 
+// GetFeatureVersion returns the negotiated version of the command set of an
+// internal client feature, or 0 if the feature is not supported.
+func (s *ClientSession) GetFeatureVersion(feature string) int {
+	return s.featureVersions[feature]
+}
+
 func (s *ClientSession) HasFeature(feature string) bool {
 	for _, f := range s.features {
 		if f == feature {
@@ -178,6 +213,89 @@ func (s *ClientSession) HasFeature(feature string) bool {
 	return false
 }
 
+// GetMetadata returns a copy of the metadata of the session.
+func (s *ClientSession) GetMetadata() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copySessionMetadata(s.metadata)
+}
+
+// UpdateMetadata merges the values into the metadata of the session, values
+// that are nil are removed. Returns the resulting metadata.
+func (s *ClientSession) UpdateMetadata(values map[string]interface{}) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metadata := copySessionMetadata(s.metadata)
+	for key, value := range values {
+		if value == nil {
+			delete(metadata, key)
+		} else {
+			metadata[key] = value
+		}
+	}
+	if len(metadata) > maxSessionMetadataKeys {
+		return nil, ErrTooManySessionMetadataKeys
+	}
+
+	s.metadata = metadata
+	return copySessionMetadata(metadata), nil
+}
+
+// GetMutedMedia returns the media of the published camera stream that is
+// muted.
+func (s *ClientSession) GetMutedMedia() MediaType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mutedMedia
+}
+
+// SetMediaMuted updates the mute state of the published camera stream and
+// notifies the room if it changed.
+func (s *ClientSession) SetMediaMuted(mediaTypes MediaType, muted bool) {
+	s.mu.Lock()
+	prev := s.mutedMedia
+	if muted {
+		s.mutedMedia |= mediaTypes
+	} else {
+		s.mutedMedia &^= mediaTypes
+	}
+	current := s.mutedMedia
+	s.mu.Unlock()
+
+	if current == prev {
+		return
+	}
+
+	if room := s.GetRoom(); room != nil {
+		room.SetSessionMuted(s, current)
+	}
+}
+
+// SetQualityStats stores the connection quality reported by the client.
+func (s *ClientSession) SetQualityStats(stats *ClientQualityStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.qualityStats = stats
+	s.qualityStatsUpdated = time.Now()
+}
+
+// GetQualityStats returns the last connection quality reported by the client
+// or nil if it didn't report recently.
+func (s *ClientSession) GetQualityStats() *ClientQualityStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.qualityStats == nil || time.Since(s.qualityStatsUpdated) > clientQualityStatsMaxAge {
+		return nil
+	}
+
+	return s.qualityStats
+}
+
 // HasPermission checks if the session has the passed permissions.
 func (s *ClientSession) HasPermission(permission Permission) bool {
 	s.mu.Lock()
@@ -212,6 +330,16 @@ func (s *ClientSession) hasAnyPermissionLocked(permission ...Permission) bool {
 }
 
 func (s *ClientSession) hasPermissionLocked(permission Permission) bool {
+	if s.getRevokedReasonLocked(permission) != "" {
+		return false
+	}
+
+	return s.hasSessionPermissionLocked(permission)
+}
+
+// hasSessionPermissionLocked checks the permissions of the session without
+// the permissions revoked by the properties of its room.
+func (s *ClientSession) hasSessionPermissionLocked(permission Permission) bool {
 	if !s.supportsPermissions {
 		// Old-style session that doesn't receive permissions from Nextcloud.
 		if result, found := DefaultPermissionOverrides[permission]; found {
@@ -226,6 +354,27 @@ func (s *ClientSession) hasPermissionLocked(permission Permission) bool {
 	return false
 }
 
+// getRevokedReasonLocked returns the reason if the given permission is
+// revoked by the properties of the room (e.g. the lobby is enabled), or an
+// empty string otherwise. Moderators keep all their permissions.
+func (s *ClientSession) getRevokedReasonLocked(permission Permission) string {
+	if s.clientType != HelloClientTypeClient {
+		return ""
+	}
+
+	room := s.GetRoom()
+	if room == nil {
+		return ""
+	}
+
+	revoked, reason := room.getRevokedPublishPermissions()
+	if !revoked[permission] || s.hasSessionPermissionLocked(PERMISSION_MAY_CONTROL) {
+		return ""
+	}
+
+	return reason
+}
+
 func permissionsEqual(a, b map[Permission]bool) bool {
 	if a == nil && b == nil {
 		return true
@@ -266,6 +415,113 @@ func (s *ClientSession) SetPermissions(permissions []Permission) {
 	log.Printf("Permissions of session %s changed: %s", s.PublicId(), permissions)
 }
 
+// SetPermissionsBitmap updates the permissions that are defined by the given
+// participant permissions bitmap, other permissions are kept.
+func (s *ClientSession) SetPermissionsBitmap(bitmap int) {
+	s.mu.Lock()
+	var permissions []Permission
+	for permission, granted := range s.permissions {
+		if granted && !isBitmapPermission(permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+	s.mu.Unlock()
+
+	s.SetPermissions(append(permissions, PermissionsFromBitmap(bitmap)...))
+}
+
+// isPublisherAllowed checks if the publisher of the given stream type
+// may be used with the permissions returned by "hasPermission".
+func isPublisherAllowed(streamType string, publisher McuPublisher, hasPermission func(Permission) bool) bool {
+	switch streamType {
+	case streamTypeScreen:
+		return hasPermission(PERMISSION_MAY_PUBLISH_SCREEN)
+	default:
+		if hasPermission(PERMISSION_MAY_PUBLISH_MEDIA) {
+			return true
+		}
+
+		return (!publisher.HasMedia(MediaTypeAudio) || hasPermission(PERMISSION_MAY_PUBLISH_AUDIO)) &&
+			(!publisher.HasMedia(MediaTypeVideo) || hasPermission(PERMISSION_MAY_PUBLISH_VIDEO))
+	}
+}
+
+// closeUnallowedPublishers closes the publishers of media the session is no
+// longer allowed to publish and notifies the client about the reason.
+func (s *ClientSession) closeUnallowedPublishers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room := s.GetRoom()
+	var closed []McuPublisher
+	var messages []*ServerMessage
+	for streamType, publisher := range s.publishers {
+		var reason string
+		if !isPublisherAllowed(streamType, publisher, s.hasSessionPermissionLocked) {
+			reason = PublisherClosedReasonPermissions
+		} else if !isPublisherAllowed(streamType, publisher, s.hasPermissionLocked) {
+			_, reason = room.getRevokedPublishPermissions()
+		} else {
+			continue
+		}
+
+		delete(s.publishers, streamType)
+		log.Printf("Session %s is no longer allowed to publish %s (%s), closing publisher %s", s.PublicId(), streamType, reason, publisher.Id())
+		closed = append(closed, publisher)
+		if room != nil {
+			messages = append(messages, &ServerMessage{
+				Type: "event",
+				Event: &EventServerMessage{
+					Target: "room",
+					Type:   "publisher-closed",
+					Publisher: &RoomEventPublisherMessage{
+						RoomId:     room.Id(),
+						StreamType: streamType,
+						Reason:     reason,
+					},
+				},
+			})
+		}
+	}
+	if len(closed) == 0 {
+		return
+	}
+
+	if room != nil {
+		room.PublishersChanged()
+	}
+	go func() {
+		ctx := context.Background()
+		for _, publisher := range closed {
+			publisher.Close(ctx)
+		}
+		for _, message := range messages {
+			s.SendMessage(message)
+		}
+	}()
+}
+
+// ClosePublisher closes the publisher of the given stream type, returns false
+// if no such publisher exists.
+func (s *ClientSession) ClosePublisher(streamType string) bool {
+	s.mu.Lock()
+	publisher, found := s.publishers[streamType]
+	if found {
+		delete(s.publishers, streamType)
+	}
+	s.mu.Unlock()
+	if !found {
+		return false
+	}
+
+	log.Printf("Closing %s publisher %s of session %s", streamType, publisher.Id(), s.PublicId())
+	if room := s.GetRoom(); room != nil {
+		room.PublishersChanged()
+	}
+	go publisher.Close(context.Background())
+	return true
+}
+
 func (s *ClientSession) Backend() *Backend {
 	return s.backend
 }
@@ -329,6 +585,7 @@ func (s *ClientSession) IsExpired(now time.Time) bool {
 func (s *ClientSession) SetRoom(room *Room) {
 	atomic.StorePointer(&s.room, unsafe.Pointer(room))
 	if room != nil {
+		s.events.Add(SessionEventJoin, "Joined room %s", room.Id())
 		atomic.StoreInt64(&s.roomJoinTime, time.Now().UnixNano())
 	} else {
 		atomic.StoreInt64(&s.roomJoinTime, 0)
@@ -364,6 +621,26 @@ func (s *ClientSession) releaseMcuObjects() {
 	}
 }
 
+// hasMcuObjects returns true if the session has publishers or subscribers.
+func (s *ClientSession) hasMcuObjects() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.publishers) > 0 || len(s.subscribers) > 0
+}
+
+// releaseLeakedMcuObjects closes publishers and subscribers of a session that
+// is no longer in a room.
+func (s *ClientSession) releaseLeakedMcuObjects() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.GetRoom() != nil {
+		return false
+	}
+
+	s.releaseMcuObjects()
+	return true
+}
+
 func (s *ClientSession) Close() {
 	s.closeAndWait(true)
 }
@@ -385,6 +662,19 @@ func (s *ClientSession) closeAndWait(wait bool) {
 		}
 		s.sessionSubscription = nil
 	}
+	s.unsubscribeBreakoutRoomsNatsLocked()
+	if len(s.additionalRooms) > 0 {
+		for _, r := range s.additionalRooms {
+			r.unsubscribe(s)
+		}
+		go func(additionalRooms map[string]*additionalRoom) {
+			for _, r := range additionalRooms {
+				r.room.RemoveObserver(s)
+				s.notifyRoomSessionLeft(r.room, r.roomSessionId)
+			}
+		}(s.additionalRooms)
+		s.additionalRooms = nil
+	}
 	go func(virtualSessions map[*VirtualSession]bool) {
 		for session := range virtualSessions {
 			session.Close()
@@ -452,6 +742,44 @@ func (s *ClientSession) SubscribeRoomNats(n NatsClient, roomid string, roomSessi
 	return nil
 }
 
+// SubscribeBreakoutRoomNats subscribes the session to the messages of a
+// breakout room without joining it.
+func (s *ClientSession) SubscribeBreakoutRoomNats(n NatsClient, room *Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.breakoutSubscriptions[room.Id()]; found {
+		return nil
+	}
+
+	subscription, err := n.Subscribe(GetSubjectForRoomId(room.Id(), room.Backend()), s.natsReceiver)
+	if err != nil {
+		return err
+	}
+
+	if s.breakoutSubscriptions == nil {
+		s.breakoutSubscriptions = make(map[string]NatsSubscription)
+	}
+	s.breakoutSubscriptions[room.Id()] = subscription
+	return nil
+}
+
+func (s *ClientSession) UnsubscribeBreakoutRoomsNats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unsubscribeBreakoutRoomsNatsLocked()
+}
+
+func (s *ClientSession) unsubscribeBreakoutRoomsNatsLocked() {
+	for roomId, subscription := range s.breakoutSubscriptions {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing breakout room %s subscription in session %s: %s", roomId, s.PublicId(), err)
+		}
+	}
+	s.breakoutSubscriptions = nil
+}
+
 func (s *ClientSession) LeaveCall() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -462,6 +790,7 @@ func (s *ClientSession) LeaveCall() {
 	}
 
 	log.Printf("Session %s left call %s", s.PublicId(), room.Id())
+	room.clearSessionOnHold(s)
 	s.releaseMcuObjects()
 }
 
@@ -478,6 +807,7 @@ func (s *ClientSession) LeaveRoom(notify bool) *Room {
 	s.SetRoom(nil)
 	s.releaseMcuObjects()
 	room.RemoveSession(s)
+	s.events.Add(SessionEventLeave, "Left room %s", room.Id())
 	return room
 }
 
@@ -497,23 +827,101 @@ func (s *ClientSession) doUnsubscribeRoomNats(notify bool) {
 	}
 	s.hub.roomSessions.DeleteRoomSession(s)
 	room := s.GetRoom()
-	if notify && room != nil && s.roomSessionId != "" {
-		// Notify
-		go func(sid string) {
-			ctx := context.Background()
-			request := NewBackendClientRoomRequest(room.Id(), s.userId, sid)
-			request.Room.Action = "leave"
-			var response map[string]interface{}
-			if err := s.hub.backend.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
-				log.Printf("Could not notify about room session %s left room %s: %s", sid, room.Id(), err)
-			} else {
-				log.Printf("Removed room session %s: %+v", sid, response)
-			}
-		}(s.roomSessionId)
+	if notify && room != nil {
+		s.notifyRoomSessionLeft(room, s.roomSessionId)
 	}
 	s.roomSessionId = ""
 }
 
+func (s *ClientSession) notifyRoomSessionLeft(room *Room, sid string) {
+	if sid == "" {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		request := NewBackendClientRoomRequest(room.BackendRoomId(), s.userId, sid)
+		request.Room.Action = "leave"
+		var response map[string]interface{}
+		if err := s.hub.backendQueue.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
+			log.Printf("Could not notify about room session %s left room %s: %s", sid, room.Id(), err)
+		} else {
+			log.Printf("Removed room session %s: %+v", sid, response)
+		}
+	}()
+}
+
+// JoinAdditionalRoom subscribes the session to the messages of a room in
+// addition to the current room.
+func (s *ClientSession) JoinAdditionalRoom(n NatsClient, room *Room, roomSessionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.additionalRooms[room.Id()]; found {
+		return nil
+	}
+
+	subject := GetSubjectForRoomId(room.Id(), room.Backend())
+	subscription, err := n.Subscribe(subject, s.natsReceiver)
+	if err != nil {
+		return err
+	}
+
+	if s.additionalRooms == nil {
+		s.additionalRooms = make(map[string]*additionalRoom)
+	}
+	s.additionalRooms[room.Id()] = &additionalRoom{
+		room:          room,
+		roomSessionId: roomSessionId,
+		subject:       subject,
+		subscription:  subscription,
+	}
+	log.Printf("Session %s joined additional room %s with room session id %s", s.PublicId(), room.Id(), roomSessionId)
+	return nil
+}
+
+func (s *ClientSession) IsInAdditionalRoom(roomId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.additionalRooms[roomId]
+	return found
+}
+
+// LeaveAdditionalRoom returns the room that was left or nil if the session
+// was not in the additional room.
+func (s *ClientSession) LeaveAdditionalRoom(roomId string, notify bool) *Room {
+	s.mu.Lock()
+	r, found := s.additionalRooms[roomId]
+	if found {
+		delete(s.additionalRooms, roomId)
+		r.unsubscribe(s)
+	}
+	s.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	r.room.RemoveObserver(s)
+	if notify {
+		s.notifyRoomSessionLeft(r.room, r.roomSessionId)
+	}
+	log.Printf("Session %s left additional room %s", s.PublicId(), roomId)
+	return r.room
+}
+
+func (s *ClientSession) getAdditionalRoomId(subject string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for roomId, r := range s.additionalRooms {
+		if r.subject == subject {
+			return roomId
+		}
+	}
+	return ""
+}
+
 func (s *ClientSession) ClearClient(client *Client) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -545,6 +953,16 @@ func (s *ClientSession) getClientUnlocked() *Client {
 	return s.client
 }
 
+// Country returns the country of the connected client, if known.
+func (s *ClientSession) Country() string {
+	client := s.GetClient()
+	if client == nil {
+		return ""
+	}
+
+	return client.Country()
+}
+
 func (s *ClientSession) SetClient(client *Client) *Client {
 	if client == nil {
 		panic("Use ClearClient to set the client to nil")
@@ -575,6 +993,7 @@ func (s *ClientSession) sendOffer(client McuClient, sender string, streamType st
 		RoomType: streamType,
 		Payload:  offer,
 		Sid:      client.Sid(),
+		Layers:   getSimulcastLayers(client),
 	}
 	offer_data, err := json.Marshal(offer_message)
 	if err != nil {
@@ -625,6 +1044,36 @@ func (s *ClientSession) sendCandidate(client McuClient, sender string, streamTyp
 	s.sendMessageUnlocked(response_message)
 }
 
+// sendRenegotiate asks the client to re-establish the connection of the given
+// MCU client, e.g. after the connection to the MCU was interrupted.
+func (s *ClientSession) sendRenegotiate(client McuClient, sender string, streamType string) {
+	renegotiate_message := &AnswerOfferMessage{
+		To:       s.PublicId(),
+		From:     sender,
+		Type:     "renegotiate",
+		RoomType: streamType,
+		Payload:  map[string]interface{}{},
+		Sid:      client.Sid(),
+	}
+	renegotiate_data, err := json.Marshal(renegotiate_message)
+	if err != nil {
+		log.Println("Could not serialize renegotiate request", renegotiate_message, err)
+		return
+	}
+	response_message := &ServerMessage{
+		Type: "message",
+		Message: &MessageServerMessage{
+			Sender: &MessageServerMessageSender{
+				Type:      "session",
+				SessionId: sender,
+			},
+			Data: (*json.RawMessage)(&renegotiate_data),
+		},
+	}
+
+	s.sendMessageUnlocked(response_message)
+}
+
 func (s *ClientSession) sendMessageUnlocked(message *ServerMessage) bool {
 	if c := s.getClientUnlocked(); c != nil {
 		if c.SendMessage(message) {
@@ -645,6 +1094,10 @@ func (s *ClientSession) SendError(e *Error) bool {
 }
 
 func (s *ClientSession) SendMessage(message *ServerMessage) bool {
+	if message.Type == "error" && message.Error != nil {
+		s.events.Add(SessionEventError, "Sent error %s: %s", message.Error.Code, message.Error.Message)
+	}
+
 	message = s.filterMessage(message)
 	if message == nil {
 		return true
@@ -708,6 +1161,29 @@ func (s *ClientSession) OnIceCompleted(client McuClient) {
 }
 
 func (s *ClientSession) SubscriberSidUpdated(subscriber McuSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subscribers {
+		if sub == subscriber {
+			log.Printf("Subscriber of %s stream from %s in session %s was reconnected, requesting renegotiation", subscriber.StreamType(), subscriber.Publisher(), s.PublicId())
+			s.sendRenegotiate(subscriber, subscriber.Publisher(), subscriber.StreamType())
+			return
+		}
+	}
+}
+
+func (s *ClientSession) PublisherReconnected(publisher McuPublisher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pub := range s.publishers {
+		if pub == publisher {
+			log.Printf("Publisher of %s stream in session %s was reconnected, requesting renegotiation", publisher.StreamType(), s.PublicId())
+			s.sendRenegotiate(publisher, s.PublicId(), publisher.StreamType())
+			return
+		}
+	}
 }
 
 func (s *ClientSession) PublisherClosed(publisher McuPublisher) {
@@ -717,11 +1193,32 @@ func (s *ClientSession) PublisherClosed(publisher McuPublisher) {
 	for id, p := range s.publishers {
 		if p == publisher {
 			delete(s.publishers, id)
+			if room := s.GetRoom(); room != nil {
+				room.PublishersChanged()
+			}
 			break
 		}
 	}
 }
 
+func (s *ClientSession) PublisherMediaChanged(publisher McuPublisher, mediaType MediaType, receiving bool) {
+	if publisher.StreamType() != streamTypeVideo {
+		return
+	}
+
+	s.SetMediaMuted(mediaType, !receiving)
+}
+
+func (s *ClientSession) PublisherTalking(publisher McuPublisher, talking bool, level float64) {
+	if publisher.StreamType() != streamTypeVideo {
+		return
+	}
+
+	if room := s.GetRoom(); room != nil {
+		room.SetTalking(s, talking, level)
+	}
+}
+
 func (s *ClientSession) SubscriberClosed(subscriber McuSubscriber) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -853,12 +1350,30 @@ func (s *ClientSession) checkOfferTypeLocked(streamType string, data *MessageCli
 			return 0, err
 		}
 
+		if streamType == streamTypeAudioBridge && mediaTypes&^MediaTypeAudio != 0 {
+			return 0, &SdpError{"audio bridge only supports audio"}
+		}
+
 		return mediaTypes, nil
 	}
 
 	return 0, nil
 }
 
+func (s *ClientSession) newAudioBridgeParticipant(ctx context.Context, mcu Mcu, sid string, mediaTypes MediaType) (McuPublisher, error) {
+	bridge, ok := mcu.(McuAudioBridge)
+	if !ok {
+		return nil, ErrAudioBridgeNotSupported
+	}
+
+	room := s.GetRoom()
+	if room == nil {
+		return nil, fmt.Errorf("session %s is not in a room", s.PublicId())
+	}
+
+	return bridge.NewAudioBridgeParticipant(ctx, s, getRoomIdForBackend(room.Id(), room.Backend()), s.PublicId(), sid, mediaTypes)
+}
+
 func (s *ClientSession) GetOrCreatePublisher(ctx context.Context, mcu Mcu, streamType string, data *MessageClientMessageData) (McuPublisher, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -873,22 +1388,26 @@ func (s *ClientSession) GetOrCreatePublisher(ctx context.Context, mcu Mcu, strea
 		client := s.getClientUnlocked()
 		s.mu.Unlock()
 
-		bitrate := data.Bitrate
-		if backend := s.Backend(); backend != nil {
-			var maxBitrate int
-			if streamType == streamTypeScreen {
-				maxBitrate = backend.maxScreenBitrate
-			} else {
-				maxBitrate = backend.maxStreamBitrate
-			}
-			if bitrate <= 0 {
-				bitrate = maxBitrate
-			} else if maxBitrate > 0 && bitrate > maxBitrate {
-				bitrate = maxBitrate
+		var err error
+		if streamType == streamTypeAudioBridge {
+			publisher, err = s.newAudioBridgeParticipant(ctx, mcu, data.Sid, mediaTypes)
+		} else {
+			bitrate := data.Bitrate
+			if backend := s.Backend(); backend != nil {
+				var maxBitrate int
+				if streamType == streamTypeScreen {
+					maxBitrate = backend.maxScreenBitrate
+				} else {
+					maxBitrate = backend.maxStreamBitrate
+				}
+				if bitrate <= 0 {
+					bitrate = maxBitrate
+				} else if maxBitrate > 0 && bitrate > maxBitrate {
+					bitrate = maxBitrate
+				}
 			}
+			publisher, err = mcu.NewPublisher(ctx, s, s.PublicId(), data.Sid, streamType, bitrate, mediaTypes, client)
 		}
-		var err error
-		publisher, err = mcu.NewPublisher(ctx, s, s.PublicId(), data.Sid, streamType, bitrate, mediaTypes, client)
 		s.mu.Lock()
 		if err != nil {
 			return nil, err
@@ -905,10 +1424,17 @@ func (s *ClientSession) GetOrCreatePublisher(ctx context.Context, mcu Mcu, strea
 			publisher = prev
 		} else {
 			s.publishers[streamType] = publisher
+			if room := s.GetRoom(); room != nil {
+				room.PublishersChanged()
+			}
 		}
 		log.Printf("Publishing %s as %s for session %s", streamType, publisher.Id(), s.PublicId())
 	} else {
+		hadVideo := publisher.HasMedia(MediaTypeVideo)
 		publisher.SetMedia(mediaTypes)
+		if room := s.GetRoom(); room != nil && hadVideo != publisher.HasMedia(MediaTypeVideo) {
+			room.PublishersChanged()
+		}
 	}
 
 	return publisher, nil
@@ -921,6 +1447,46 @@ func (s *ClientSession) GetPublisher(streamType string) McuPublisher {
 	return s.publishers[streamType]
 }
 
+// GetPublishers returns the publishers of the session, mapped by their
+// stream type.
+func (s *ClientSession) GetPublishers() map[string]McuPublisher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]McuPublisher, len(s.publishers))
+	for streamType, publisher := range s.publishers {
+		result[streamType] = publisher
+	}
+	return result
+}
+
+// GetSubscribers returns the subscribers of the session.
+func (s *ClientSession) GetSubscribers() []McuSubscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]McuSubscriber, 0, len(s.subscribers))
+	for _, subscriber := range s.subscribers {
+		result = append(result, subscriber)
+	}
+	return result
+}
+
+// SetSubscribersPaused pauses or resumes the media of all subscribers of the
+// session in the MCU, e.g. while its call is on hold.
+func (s *ClientSession) SetSubscribersPaused(ctx context.Context, paused bool) {
+	for _, subscriber := range s.GetSubscribers() {
+		pauser, ok := subscriber.(McuSubscriberPauser)
+		if !ok {
+			continue
+		}
+
+		if err := pauser.SetPaused(ctx, paused); err != nil {
+			log.Printf("Could not set paused state of subscriber %s in session %s to %v: %s", subscriber.Id(), s.PublicId(), paused, err)
+		}
+	}
+}
+
 func (s *ClientSession) GetOrCreateSubscriber(ctx context.Context, mcu Mcu, id string, streamType string) (McuSubscriber, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -962,44 +1528,54 @@ func (s *ClientSession) GetSubscriber(id string, streamType string) McuSubscribe
 	return s.subscribers[id+"|"+streamType]
 }
 
-func (s *ClientSession) processClientMessage(msg *nats.Msg) {
+func (s *ClientSession) decodeNatsMessage(msg *nats.Msg) (*NatsMessage, error) {
+	if room := s.GetRoom(); room != nil && room.subject == msg.Subject {
+		// Messages of the room are decoded once for all local sessions.
+		return room.DecodeNatsMessage(msg)
+	}
+
 	var message NatsMessage
 	if err := s.hub.nats.Decode(msg, &message); err != nil {
+		return nil, err
+	}
+
+	if message.Type == "message" && message.Message != nil {
+		// Messages that are sent unmodified to the client don't need to be
+		// serialized again.
+		if data := getRawNatsServerMessage(msg.Data); data != nil {
+			message.Message.setPrepared(data)
+		}
+	}
+	return &message, nil
+}
+
+func (s *ClientSession) processClientMessage(msg *nats.Msg) {
+	message, err := s.decodeNatsMessage(msg)
+	if err != nil {
 		log.Printf("Could not decode NATS message %+v for session %s: %s", *msg, s.PublicId(), err)
 		return
 	}
 
 	switch message.Type {
 	case "permissions":
-		s.SetPermissions(message.Permissions)
-		go func() {
-			s.mu.Lock()
-			defer s.mu.Unlock()
-
-			if !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_MEDIA) {
-				if publisher, found := s.publishers[streamTypeVideo]; found {
-					if (publisher.HasMedia(MediaTypeAudio) && !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_AUDIO)) ||
-						(publisher.HasMedia(MediaTypeVideo) && !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_VIDEO)) {
-						delete(s.publishers, streamTypeVideo)
-						log.Printf("Session %s is no longer allowed to publish media, closing publisher %s", s.PublicId(), publisher.Id())
-						go func() {
-							publisher.Close(context.Background())
-						}()
-						return
-					}
-				}
-			}
-			if !s.hasPermissionLocked(PERMISSION_MAY_PUBLISH_SCREEN) {
-				if publisher, found := s.publishers[streamTypeScreen]; found {
-					delete(s.publishers, streamTypeScreen)
-					log.Printf("Session %s is no longer allowed to publish screen, closing publisher %s", s.PublicId(), publisher.Id())
-					go func() {
-						publisher.Close(context.Background())
-					}()
-					return
-				}
-			}
-		}()
+		if message.PermissionsBitmap != nil {
+			s.SetPermissionsBitmap(*message.PermissionsBitmap)
+		} else {
+			s.SetPermissions(message.Permissions)
+		}
+		go s.closeUnallowedPublishers()
+		return
+	case "bye":
+		var reason string
+		if message.Message != nil && message.Message.Bye != nil {
+			reason = message.Message.Bye.Reason
+		}
+		log.Printf("Kicking session %s (%s)", s.PublicId(), reason)
+		s.events.Add(SessionEventKicked, "Kicked: %s", reason)
+		if client := s.GetClient(); client != nil {
+			client.SendByeResponseWithReason(nil, reason)
+		}
+		s.closeAndWait(false)
 		return
 	case "message":
 		if message.Message.Type == "bye" && message.Message.Bye.Reason == "room_session_reconnected" {
@@ -1012,11 +1588,15 @@ func (s *ClientSession) processClientMessage(msg *nats.Msg) {
 		}
 	}
 
-	serverMessage := s.processNatsMessage(&message)
+	serverMessage := s.processNatsMessage(message)
 	if serverMessage == nil {
 		return
 	}
 
+	if roomId := s.getAdditionalRoomId(msg.Subject); roomId != "" {
+		serverMessage = serverMessage.Copy()
+		serverMessage.RoomId = roomId
+	}
 	s.SendMessage(serverMessage)
 }
 
@@ -1079,31 +1659,119 @@ func filterDisplayNames(events []*EventServerMessageSessionEntry) []*EventServer
 	return result
 }
 
+// SetEventFilter restricts the events that are sent to the session, a "nil"
+// filter sends all events.
+func (s *ClientSession) SetEventFilter(filter *EventFilter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.eventFilter = filter
+}
+
+func (s *ClientSession) getEventFilter() *EventFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.eventFilter
+}
+
+// HasVerifiedIdentity returns true if the session belongs to a user that was
+// authenticated by the backend.
+func (s *ClientSession) HasVerifiedIdentity() bool {
+	return s.ClientType() == HelloClientTypeClient && s.UserId() != ""
+}
+
+// AllowRoomKey returns false if the session exceeded the rate limit for
+// sending room keys.
+func (s *ClientSession) AllowRoomKey(perMinute int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.roomKeyLimiter == nil {
+		s.roomKeyLimiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+	}
+	return s.roomKeyLimiter.Allow()
+}
+
+// copyEvent returns a copy of an event message that can be modified for a
+// single session.
+func copyEvent(message *ServerMessage) *ServerMessage {
+	message = message.Copy()
+	event := *message.Event
+	message.Event = &event
+	return message
+}
+
+func copyParticipantsUpdate(message *ServerMessage) (*ServerMessage, *RoomEventServerMessage) {
+	message = copyEvent(message)
+	update := *message.Event.Update
+	message.Event.Update = &update
+	return message, &update
+}
+
+// filterParticipantsUpdate returns the participants update to send to sessions
+// with or without support for participant pages, or nil if nothing should be
+// sent. The message is returned unmodified if no changes are necessary.
+func filterParticipantsUpdate(message *ServerMessage, pages bool) *ServerMessage {
+	if !message.Event.Update.All && pages {
+		// Only send the changed participants, the full list can be
+		// requested in pages by the client if necessary.
+		if len(message.Event.Update.Changed) == 0 {
+			return nil
+		}
+
+		msg, m := copyParticipantsUpdate(message)
+		m.Users = m.Changed
+		m.Changed = nil
+		return msg
+	} else if len(message.Event.Update.Changed) > 0 {
+		msg, m := copyParticipantsUpdate(message)
+		users := make(map[string]bool)
+		for _, entry := range m.Users {
+			users[entry["sessionId"].(string)] = true
+		}
+		// The list of users might be shared with other messages.
+		merged := make([]map[string]interface{}, len(m.Users), len(m.Users)+len(m.Changed))
+		copy(merged, m.Users)
+		for _, entry := range m.Changed {
+			if users[entry["sessionId"].(string)] {
+				continue
+			}
+			merged = append(merged, entry)
+		}
+		// TODO(jojo): Only send all users if current session id has
+		// changed its "inCall" flag to true.
+		m.Users = merged
+		m.Changed = nil
+		return msg
+	}
+
+	return message
+}
+
 func (s *ClientSession) filterMessage(message *ServerMessage) *ServerMessage {
+	if filter := s.getEventFilter(); filter != nil {
+		var roomId string
+		if room := s.GetRoom(); room != nil {
+			roomId = room.Id()
+		}
+		if !filter.Matches(message, roomId) {
+			return nil
+		}
+	}
+
 	switch message.Type {
 	case "event":
 		switch message.Event.Target {
 		case "participants":
 			if message.Event.Type == "update" {
-				m := message.Event.Update
-				users := make(map[string]bool)
-				for _, entry := range m.Users {
-					users[entry["sessionId"].(string)] = true
-				}
-				for _, entry := range m.Changed {
-					if users[entry["sessionId"].(string)] {
-						continue
-					}
-					m.Users = append(m.Users, entry)
-				}
-				// TODO(jojo): Only send all users if current session id has
-				// changed its "inCall" flag to true.
-				m.Changed = nil
+				return message.getParticipantsUpdate(s.HasFeature(ClientFeatureParticipantsPages))
 			}
 		case "room":
 			switch message.Event.Type {
 			case "join":
 				if s.HasPermission(PERMISSION_HIDE_DISPLAYNAMES) {
+					message = copyEvent(message)
 					message.Event.Join = filterDisplayNames(message.Event.Join)
 				}
 			case "message":
@@ -1120,7 +1788,10 @@ func (s *ClientSession) filterMessage(message *ServerMessage) *ServerMessage {
 					if displayName, found := (*data.Chat.Comment)["actorDisplayName"]; found && displayName != "" {
 						(*data.Chat.Comment)["actorDisplayName"] = ""
 						if encoded, err := json.Marshal(data); err == nil {
-							message.Event.Message.Data = (*json.RawMessage)(&encoded)
+							message = copyEvent(message)
+							eventMessage := *message.Event.Message
+							eventMessage.Data = (*json.RawMessage)(&encoded)
+							message.Event.Message = &eventMessage
 						}
 					}
 				}
@@ -1165,6 +1836,22 @@ func (s *ClientSession) processNatsMessage(msg *NatsMessage) *ServerMessage {
 				// Don't send message back to sender (can happen if sent to user or room)
 				return nil
 			}
+		case "room-key":
+			if msg.Message.RoomKey == nil ||
+				msg.Message.RoomKey.Sender == nil ||
+				msg.Message.RoomKey.Sender.SessionId == s.PublicId() {
+				// Don't send message back to sender (can happen if sent to room)
+				return nil
+			}
+
+			// Key material is only delivered to verified sessions in the same room.
+			if room := s.GetRoom(); room == nil ||
+				room.Id() != msg.Message.RoomKey.RoomId ||
+				getBackendId(room.Backend()) != msg.Backend ||
+				!s.HasVerifiedIdentity() {
+				log.Printf("Not delivering room key from %s to session %s", msg.Message.RoomKey.Sender.SessionId, s.PublicId())
+				return nil
+			}
 		case "event":
 			if msg.Message.Event.Target == "room" {
 				// Can happen mostly during tests where an older room NATS message
@@ -0,0 +1,123 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Options with this suffix contain the name of a file to read the value
+	// of the option without the suffix from.
+	configFileSuffix = "_file"
+)
+
+var (
+	configEnvRegExp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// LoadConfig reads the configuration from the given filename and resolves
+// environment variables and options that are read from files.
+func LoadConfig(filename string) (*goconf.ConfigFile, error) {
+	config, err := goconf.ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ResolveConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func expandConfigEnv(value string) (string, error) {
+	var missing []string
+	result := configEnvRegExp.ReplaceAllStringFunc(value, func(s string) string {
+		name := s[2 : len(s)-1]
+		v, found := os.LookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return result, nil
+}
+
+// ResolveConfig replaces "${NAME}" in all values with the environment
+// variable "NAME". Options "foo_file" are replaced with an option "foo" that
+// contains the contents of the referenced file (e.g. a Docker secret).
+func ResolveConfig(config *goconf.ConfigFile) error {
+	for _, section := range config.GetSections() {
+		options, _ := config.GetOptions(section)
+		for _, option := range options {
+			value, err := config.GetRawString(section, option)
+			if err != nil {
+				// Option of the default section.
+				continue
+			}
+
+			if value, err = expandConfigEnv(value); err != nil {
+				return fmt.Errorf("invalid option %s in section %s: %w", option, section, err)
+			}
+
+			config.AddOption(section, option, value)
+		}
+	}
+
+	for _, section := range config.GetSections() {
+		options, _ := config.GetOptions(section)
+		for _, option := range options {
+			if !strings.HasSuffix(option, configFileSuffix) {
+				continue
+			}
+
+			filename, err := config.GetRawString(section, option)
+			if err != nil {
+				continue
+			}
+
+			name := strings.TrimSuffix(option, configFileSuffix)
+			if _, err := config.GetRawString(section, name); err == nil {
+				return fmt.Errorf("only one of %s and %s may be set in section %s", name, option, section)
+			}
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				return fmt.Errorf("could not read %s for option %s in section %s: %w", filename, name, section, err)
+			}
+
+			config.AddOption(section, name, strings.TrimRight(string(data), "\r\n"))
+		}
+	}
+
+	return nil
+}
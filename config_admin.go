@@ -0,0 +1,176 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	ConfigSourceFile         = "file"
+	ConfigSourceDefault      = "default"
+	ConfigSourceEtcd         = "etcd"
+	ConfigSourceBackendsFile = "backendsfile"
+
+	redactedConfigValue = "***"
+)
+
+type configDefault struct {
+	section string
+	option  string
+	value   string
+}
+
+// Default values of options that are used if they are not configured.
+var configDefaults = []configDefault{
+	{"app", "participantspagesize", strconv.Itoa(defaultParticipantsPageSize)},
+	{"app", "reconcileinterval", strconv.Itoa(int(defaultReconcileInterval / time.Second))},
+	{"app", "roomhistory", "0"},
+	{"app", "roomhistoryage", strconv.Itoa(int(defaultRoomHistoryMaxAge / time.Second))},
+	{"app", "sessionevents", strconv.Itoa(defaultSessionEventsSize)},
+	{"backend", "backendtype", BackendTypeStatic},
+	{"backend", "connectionsperhost", strconv.Itoa(defaultMaxConcurrentRequestsPerHost)},
+	{"backend", "idlepinginterval", strconv.Itoa(int(defaultIdleRoomPingInterval / time.Second))},
+	{"backend", "pinginterval", strconv.Itoa(int(defaultRoomPingInterval / time.Second))},
+	{"backend", "pingjitter", strconv.Itoa(defaultRoomPingJitter)},
+	{"backend", "queuemaxattempts", strconv.Itoa(defaultBackendQueueMaxAttempts)},
+	{"backend", "timeout", strconv.Itoa(defaultBackendTimeoutSeconds)},
+	{"clients", "internalpinginterval", strconv.Itoa(int(defaultInternalPingPeriod / time.Second))},
+	{"clients", "internalpongtimeout", strconv.Itoa(int(defaultInternalPongWait / time.Second))},
+	{"mcu", "activespeakerinterval", "0"},
+	{"mcu", "healthcheckinterval", strconv.Itoa(int(defaultJanusHealthCheckInterval / time.Second))},
+	{"mcu", "maxscreenbitrate", strconv.Itoa(defaultMaxScreenBitrate)},
+	{"mcu", "maxstreambitrate", strconv.Itoa(defaultMaxStreamBitrate)},
+	{"mcu", "prewarmsubscribers", "0"},
+	{"mcu", "proxytimeout", strconv.Itoa(defaultProxyTimeoutSeconds)},
+	{"mcu", "statsinterval", "0"},
+	{"mcu", "timeout", strconv.Itoa(defaultMcuTimeoutSeconds)},
+	{"redis", "prefix", defaultRedisPrefix},
+	{"roomsessions", "type", RoomSessionsTypeBuiltin},
+	{"sessions", "cipher", SessionIdCipherSecureCookie},
+	{"stats", "clustertimeout", strconv.Itoa(int(defaultClusterStatsTimeout / time.Millisecond))},
+	{"tracing", "protocol", TracingProtocolGrpc},
+	{"tracing", "samplerate", "1.0"},
+	{"turn", "ttl", strconv.Itoa(int(defaultTurnTTL / time.Second))},
+	{"turn", "webhooktimeout", strconv.Itoa(int(defaultTurnWebhookTimeout / time.Second))},
+}
+
+// Options containing one of these strings are never returned.
+var secretConfigOptions = []string{
+	"secret",
+	"key",
+	"password",
+	"token",
+	"license",
+}
+
+func isSecretConfigOption(option string) bool {
+	for _, s := range secretConfigOptions {
+		if strings.Contains(option, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactConfigUrls removes passwords from (lists of) urls.
+func redactConfigUrls(value string) string {
+	parts := strings.Split(value, ",")
+	for idx, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		u, err := url.Parse(trimmed)
+		if err != nil || u.User == nil {
+			continue
+		}
+
+		if _, found := u.User.Password(); found {
+			// Keep the remaining url as configured.
+			pos := strings.LastIndex(trimmed, "@")
+			redacted := u.Scheme + "://" + url.User(u.User.Username()).String() + ":" + redactedConfigValue + trimmed[pos:]
+			parts[idx] = strings.Replace(part, trimmed, redacted, 1)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func redactConfigValue(option string, value string) string {
+	if value == "" {
+		return value
+	} else if isSecretConfigOption(option) {
+		return redactedConfigValue
+	}
+
+	return redactConfigUrls(value)
+}
+
+// GetConfigValues returns the values from the configuration file with
+// secrets redacted and the defaults of options that are not configured.
+func GetConfigValues(config *goconf.ConfigFile) []*ConfigAdminValue {
+	var result []*ConfigAdminValue
+	configured := make(map[string]bool)
+	for _, section := range config.GetSections() {
+		options, _ := config.GetOptions(section)
+		for _, option := range options {
+			key := section + "|" + option
+			if configured[key] {
+				// Options from the default section are returned for all sections.
+				continue
+			}
+
+			configured[key] = true
+			value, _ := config.GetString(section, option)
+			result = append(result, &ConfigAdminValue{
+				Section: section,
+				Option:  option,
+				Value:   redactConfigValue(option, value),
+				Source:  ConfigSourceFile,
+			})
+		}
+	}
+
+	for _, d := range configDefaults {
+		if configured[d.section+"|"+d.option] {
+			continue
+		}
+
+		result = append(result, &ConfigAdminValue{
+			Section: d.section,
+			Option:  d.option,
+			Value:   d.value,
+			Source:  ConfigSourceDefault,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Section != result[j].Section {
+			return result[i].Section < result[j].Section
+		}
+		return result[i].Option < result[j].Option
+	})
+	return result
+}
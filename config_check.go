@@ -0,0 +1,310 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Timeout for connecting to external services if probing is enabled.
+	configCheckProbeTimeout = 5 * time.Second
+)
+
+var (
+	ErrConfigCheckSkipped = errors.New("not configured")
+)
+
+type ConfigCheckResult struct {
+	Name string
+	Err  error
+}
+
+// ConfigCheckReport contains the results of validating a configuration
+// without starting the server.
+type ConfigCheckReport struct {
+	Results []*ConfigCheckResult
+}
+
+// Check runs the given function and records its result.
+func (r *ConfigCheckReport) Check(name string, f func() error) {
+	r.Results = append(r.Results, &ConfigCheckResult{
+		Name: name,
+		Err:  f(),
+	})
+}
+
+func (r *ConfigCheckReport) Passed() bool {
+	for _, result := range r.Results {
+		if result.Err != nil && result.Err != ErrConfigCheckSkipped {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ConfigCheckReport) Print(w io.Writer) {
+	for _, result := range r.Results {
+		switch result.Err {
+		case nil:
+			fmt.Fprintf(w, "OK    %s\n", result.Name) // nolint
+		case ErrConfigCheckSkipped:
+			fmt.Fprintf(w, "SKIP  %s\n", result.Name) // nolint
+		default:
+			fmt.Fprintf(w, "FAIL  %s: %s\n", result.Name, result.Err) // nolint
+		}
+	}
+	if r.Passed() {
+		fmt.Fprintln(w, "Configuration is valid") // nolint
+	} else {
+		fmt.Fprintln(w, "Configuration is invalid") // nolint
+	}
+}
+
+// CheckTLSCertificate checks that the certificate and key can be loaded.
+func CheckTLSCertificate(certFile string, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("need a certificate and key")
+	}
+
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("could not load certificate %s: %w", certFile, err)
+	}
+	return nil
+}
+
+// CheckEtcdConfig checks the etcd settings in the given section and
+// optionally if the cluster can be reached.
+func CheckEtcdConfig(ctx context.Context, config *goconf.ConfigFile, section string, probe bool) error {
+	client, err := NewEtcdClient(config, section)
+	if err != nil {
+		return err
+	}
+	defer client.Close() // nolint
+
+	if !probe {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, configCheckProbeTimeout)
+	defer cancel()
+	if err := client.WaitForConnection(ctx); err != nil {
+		return fmt.Errorf("could not connect to etcd: %w", err)
+	}
+	return nil
+}
+
+// CheckNatsConfig checks the NATS server url and optionally if the server can
+// be reached.
+func CheckNatsConfig(natsUrl string, probe bool) error {
+	if natsUrl == ":loopback:" {
+		return nil
+	}
+
+	for _, u := range strings.Split(natsUrl, ",") {
+		if _, err := url.Parse(strings.TrimSpace(u)); err != nil {
+			return fmt.Errorf("invalid NATS url %s: %w", u, err)
+		}
+	}
+
+	if !probe {
+		return nil
+	}
+
+	nc, err := nats.Connect(natsUrl, nats.Timeout(configCheckProbeTimeout), nats.NoReconnect())
+	if err != nil {
+		return fmt.Errorf("could not connect to NATS: %w", err)
+	}
+	nc.Close()
+	return nil
+}
+
+func checkBackendReachable(ctx context.Context, client *http.Client, backend *Backend) error {
+	ctx, cancel := context.WithTimeout(ctx, configCheckProbeTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, backend.url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("backend %s is not reachable: %w", backend.id, err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+func checkBackendsConfig(ctx context.Context, config *goconf.ConfigFile, probe bool) error {
+	if backendType, _ := config.GetString("backend", "backendtype"); backendType == BackendTypeEtcd {
+		// Don't start watching etcd for backend changes.
+		if prefix, _ := config.GetString("backend", "backendprefix"); prefix == "" {
+			return fmt.Errorf("no backend prefix configured for backend type %s", BackendTypeEtcd)
+		}
+
+		return CheckEtcdConfig(ctx, config, "etcd", probe)
+	}
+
+	backends, err := NewBackendConfiguration(config, nil)
+	if err != nil {
+		return err
+	}
+	defer backends.Close()
+
+	all := backends.GetBackends()
+	if len(all) == 0 && backends.GetCompatBackend() == nil && backends.backendsFile == "" {
+		return fmt.Errorf("no backends configured")
+	}
+
+	if !probe {
+		return nil
+	}
+
+	for _, backend := range all {
+		if backend.pattern != nil || backend.url == "" {
+			// Only concrete instances can be probed.
+			continue
+		}
+
+		client := &http.Client{}
+		if backend.tlsSettings != nil {
+			tlsConfig, err := backend.tlsSettings.newTLSConfig()
+			if err != nil {
+				return err
+			}
+
+			client.Transport = &http.Transport{
+				TLSClientConfig: tlsConfig,
+			}
+		}
+		if err := checkBackendReachable(ctx, client, backend); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckServerConfig validates the configuration of the signaling server. If
+// "probe" is set, the connectivity to external services is also checked.
+func CheckServerConfig(ctx context.Context, config *goconf.ConfigFile, probe bool) *ConfigCheckReport {
+	report := &ConfigCheckReport{}
+	report.Check("sessions", func() error {
+		_, err := NewSessionIdCodec(config)
+		return err
+	})
+	report.Check("backends", func() error {
+		return checkBackendsConfig(ctx, config, probe)
+	})
+	report.Check("trusted proxies", func() error {
+		value, _ := config.GetString("app", "trustedproxies")
+		_, err := ParseTrustedProxies(value)
+		return err
+	})
+	report.Check("https", func() error {
+		if listen, _ := config.GetString("https", "listen"); listen == "" {
+			return ErrConfigCheckSkipped
+		}
+
+		var etcdClient *EtcdClient
+		if prefix, _ := config.GetString("acme", "etcdprefix"); prefix != "" {
+			client, err := NewEtcdClient(config, "etcd")
+			if err != nil {
+				return err
+			}
+			defer client.Close() // nolint
+
+			etcdClient = client
+		}
+
+		if acme, err := NewAcmeManager(config, etcdClient); err != nil {
+			return err
+		} else if acme != nil {
+			return nil
+		}
+
+		certFile, _ := config.GetString("https", "certificate")
+		keyFile, _ := config.GetString("https", "key")
+		return CheckTLSCertificate(certFile, keyFile)
+	})
+	report.Check("mtls", func() error {
+		if _, err := getCertificateClients(config); err != nil {
+			return err
+		}
+
+		if listen, _ := config.GetString("mtls", "listen"); listen == "" {
+			return ErrConfigCheckSkipped
+		}
+
+		_, err := NewInternalClientsTLSConfig(config)
+		return err
+	})
+	report.Check("nats", func() error {
+		natsUrl, _ := config.GetString("nats", "url")
+		if natsUrl == "" {
+			natsUrl = nats.DefaultURL
+		}
+		return CheckNatsConfig(natsUrl, probe)
+	})
+	report.Check("etcd", func() error {
+		if !hasEtcdConfig(config, "etcd") {
+			return ErrConfigCheckSkipped
+		}
+		return CheckEtcdConfig(ctx, config, "etcd", probe)
+	})
+	report.Check("mcu", func() error {
+		mcuType, _ := config.GetString("mcu", "type")
+		mcuUrl, _ := config.GetString("mcu", "url")
+		switch mcuType {
+		case "":
+			return ErrConfigCheckSkipped
+		case McuTypeJanus:
+			if mcuUrl == "" {
+				return fmt.Errorf("no url configured for MCU type %s", mcuType)
+			}
+			_, err := url.Parse(mcuUrl)
+			return err
+		case McuTypeProxy:
+			return nil
+		default:
+			return ErrUnsupportedMcuType
+		}
+	})
+	return report
+}
+
+func hasEtcdConfig(config *goconf.ConfigFile, section string) bool {
+	endpoints, _ := config.GetString(section, "endpoints")
+	discoverySrv, _ := config.GetString(section, "discoverysrv")
+	return endpoints != "" || discoverySrv != ""
+}
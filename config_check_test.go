@@ -0,0 +1,108 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func newConfigCheckConfigForTest(backendUrl string) *goconf.ConfigFile {
+	config := goconf.NewConfigFile()
+	config.AddOption("sessions", "hashkey", "12345678901234567890123456789012")
+	config.AddOption("sessions", "blockkey", "09876543210987654321098765432109")
+	config.AddOption("backend", "backends", "backend1")
+	config.AddOption("backend1", "url", backendUrl)
+	config.AddOption("backend1", "secret", string(testBackendSecret))
+	config.AddOption("nats", "url", ":loopback:")
+	return config
+}
+
+func getConfigCheckResult(t *testing.T, report *ConfigCheckReport, name string) error {
+	for _, result := range report.Results {
+		if result.Name == name {
+			return result.Err
+		}
+	}
+	t.Fatalf("no result for %s in %+v", name, report.Results)
+	return nil
+}
+
+func TestCheckServerConfig(t *testing.T) {
+	ctx := context.Background()
+	config := newConfigCheckConfigForTest("https://domain.invalid/")
+	if report := CheckServerConfig(ctx, config, false); !report.Passed() {
+		t.Errorf("expected valid configuration, got %+v", report.Results)
+	} else if err := getConfigCheckResult(t, report, "https"); err != ErrConfigCheckSkipped {
+		t.Errorf("expected skipped https check, got %v", err)
+	}
+
+	config.AddOption("sessions", "blockkey", "invalid")
+	config.AddOption("https", "listen", "127.0.0.1:8443")
+	config.AddOption("https", "certificate", filepath.Join(t.TempDir(), "missing.crt"))
+	config.AddOption("https", "key", filepath.Join(t.TempDir(), "missing.key"))
+	config.AddOption("mcu", "type", "unknown")
+	config.RemoveOption("backend", "backends")
+	report := CheckServerConfig(ctx, config, false)
+	if report.Passed() {
+		t.Fatal("expected invalid configuration")
+	}
+	for _, name := range []string{"sessions", "backends", "https", "mcu"} {
+		if err := getConfigCheckResult(t, report, name); err == nil || err == ErrConfigCheckSkipped {
+			t.Errorf("expected %s check to fail, got %v", name, err)
+		}
+	}
+	if err := getConfigCheckResult(t, report, "trusted proxies"); err != nil {
+		t.Errorf("expected trusted proxies check to pass, got %s", err)
+	}
+}
+
+func TestCheckServerConfigProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	config := newConfigCheckConfigForTest(server.URL)
+	config.AddOption("backend", "allowhttp", "true")
+	if report := CheckServerConfig(ctx, config, true); !report.Passed() {
+		t.Errorf("expected valid configuration, got %+v", report.Results)
+	}
+
+	server.Close()
+	report := CheckServerConfig(ctx, config, true)
+	if report.Passed() {
+		t.Error("expected unreachable backend to fail")
+	} else if err := getConfigCheckResult(t, report, "backends"); err == nil {
+		t.Error("expected backends check to fail")
+	}
+	// Without probing, the backend is not contacted.
+	if report := CheckServerConfig(ctx, config, false); !report.Passed() {
+		t.Errorf("expected valid configuration, got %+v", report.Results)
+	}
+}
@@ -0,0 +1,94 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestResolveConfigEnv(t *testing.T) {
+	t.Setenv("TEST_SIGNALING_SECRET", "the-secret")
+	t.Setenv("TEST_SIGNALING_HOST", "cloud.domain.invalid")
+
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "secret", "${TEST_SIGNALING_SECRET}")
+	config.AddOption("backend", "url", "https://${TEST_SIGNALING_HOST}/path")
+	config.AddOption("backend", "plain", "$foo ${ bar")
+	if err := ResolveConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"secret": "the-secret",
+		"url":    "https://cloud.domain.invalid/path",
+		"plain":  "$foo ${ bar",
+	}
+	for option, value := range expected {
+		if v, _ := config.GetString("backend", option); v != value {
+			t.Errorf("expected %s for %s, got %s", value, option, v)
+		}
+	}
+
+	config.AddOption("backend", "secret", "${TEST_SIGNALING_UNKNOWN}")
+	if err := ResolveConfig(config); err == nil {
+		t.Error("should have failed for unknown environment variable")
+	}
+}
+
+func TestResolveConfigFile(t *testing.T) {
+	filename := path.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(filename, []byte("the-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_SIGNALING_SECRET_FILE", filename)
+	config := goconf.NewConfigFile()
+	config.AddOption("sessions", "hashkey_file", filename)
+	config.AddOption("turn", "secret_file", "${TEST_SIGNALING_SECRET_FILE}")
+	if err := ResolveConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := config.GetString("sessions", "hashkey"); value != "the-secret" {
+		t.Errorf("expected the-secret, got %s", value)
+	}
+	if value, _ := config.GetString("turn", "secret"); value != "the-secret" {
+		t.Errorf("expected the-secret, got %s", value)
+	}
+
+	config = goconf.NewConfigFile()
+	config.AddOption("sessions", "blockkey_file", path.Join(t.TempDir(), "missing"))
+	if err := ResolveConfig(config); err == nil {
+		t.Error("should have failed for missing file")
+	}
+
+	config = goconf.NewConfigFile()
+	config.AddOption("sessions", "hashkey", "the-key")
+	config.AddOption("sessions", "hashkey_file", filename)
+	if err := ResolveConfig(config); err == nil {
+		t.Error("should have failed if both the option and the file are set")
+	}
+}
@@ -0,0 +1,181 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"go.etcd.io/etcd/client/pkg/v3/srv"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	ErrNoEtcdEndpoints = errors.New("no etcd endpoints configured in section etcd")
+)
+
+// isEtcdConfigured returns true if endpoints or a discovery domain for the
+// etcd cluster are configured in the given section.
+func isEtcdConfigured(config *goconf.ConfigFile, section string) bool {
+	if endpoints, _ := config.GetString(section, "endpoints"); endpoints != "" {
+		return true
+	}
+
+	discoverySrv, _ := config.GetString(section, "discoverysrv")
+	return discoverySrv != ""
+}
+
+// EtcdClient is a client for the etcd cluster configured in a section of the
+// configuration file.
+type EtcdClient struct {
+	client *clientv3.Client
+}
+
+// NewEtcdClient creates a client for the etcd cluster configured with the
+// options "endpoints" (or "discoverysrv" and "discoveryservice") and
+// "clientkey", "clientcert" and "cacert" in the given section.
+func NewEtcdClient(config *goconf.ConfigFile, section string) (*EtcdClient, error) {
+	var endpoints []string
+	if endpointsString, _ := config.GetString(section, "endpoints"); endpointsString != "" {
+		for _, ep := range strings.Split(endpointsString, ",") {
+			ep := strings.TrimSpace(ep)
+			if ep != "" {
+				endpoints = append(endpoints, ep)
+			}
+		}
+	} else if discoverySrv, _ := config.GetString(section, "discoverysrv"); discoverySrv != "" {
+		discoveryService, _ := config.GetString(section, "discoveryservice")
+		clients, err := srv.GetClient("etcd-client", discoverySrv, discoveryService)
+		if err != nil {
+			return nil, fmt.Errorf("Could not discover etcd endpoints for %s: %s", discoverySrv, err)
+		}
+
+		endpoints = clients.Endpoints
+	}
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("No etcd endpoints configured in section %s", section)
+	}
+
+	cfg := clientv3.Config{
+		Endpoints: endpoints,
+
+		// set timeout per request to fail fast when the target endpoint is unavailable
+		DialTimeout: time.Second,
+	}
+
+	clientKey, _ := config.GetString(section, "clientkey")
+	clientCert, _ := config.GetString(section, "clientcert")
+	caCert, _ := config.GetString(section, "cacert")
+	if clientKey != "" && clientCert != "" && caCert != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      clientCert,
+			KeyFile:       clientKey,
+			TrustedCAFile: caCert,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("Could not setup etcd TLS configuration: %s", err)
+		}
+
+		cfg.TLS = tlsConfig
+	}
+
+	c, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Using etcd endpoints %+v", endpoints)
+	return &EtcdClient{
+		client: c,
+	}, nil
+}
+
+func (c *EtcdClient) Close() error {
+	return c.client.Close()
+}
+
+// WaitForConnection blocks until the client is connected to the cluster or
+// the context is cancelled.
+func (c *EtcdClient) WaitForConnection(ctx context.Context) error {
+	waitDelay := initialWaitDelay
+	for {
+		syncCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := c.client.Sync(syncCtx)
+		cancel()
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == context.DeadlineExceeded {
+			log.Printf("Timeout waiting for etcd client to connect to the cluster, retry in %s", waitDelay)
+		} else {
+			log.Printf("Could not sync etcd client with the cluster, retry in %s: %s", waitDelay, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitDelay):
+		}
+
+		waitDelay = waitDelay * 2
+		if waitDelay > maxWaitDelay {
+			waitDelay = maxWaitDelay
+		}
+	}
+}
+
+func (c *EtcdClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return c.client.Get(ctx, key, opts...)
+}
+
+func (c *EtcdClient) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return c.client.Watch(ctx, key, opts...)
+}
+
+func (c *EtcdClient) Put(ctx context.Context, key string, value string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	return c.client.Put(ctx, key, value, opts...)
+}
+
+func (c *EtcdClient) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	return c.client.Delete(ctx, key, opts...)
+}
+
+// Grant creates a new lease that expires after the given number of seconds.
+func (c *EtcdClient) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	return c.client.Grant(ctx, ttl)
+}
+
+// KeepAlive refreshes the given lease until the context is cancelled.
+func (c *EtcdClient) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	return c.client.KeepAlive(ctx, id)
+}
@@ -0,0 +1,136 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/dlintw/goconf"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.etcd.io/etcd/server/v3/lease"
+)
+
+func isErrorAddressAlreadyInUse(err error) bool {
+	var eOsSyscall *os.SyscallError
+	if !errors.As(err, &eOsSyscall) {
+		return false
+	}
+	var errErrno syscall.Errno
+	if !errors.As(eOsSyscall, &errErrno) {
+		return false
+	}
+	if errErrno == syscall.EADDRINUSE {
+		return true
+	}
+	const WSAEADDRINUSE = 10048
+	if runtime.GOOS == "windows" && errErrno == WSAEADDRINUSE {
+		return true
+	}
+	return false
+}
+
+func NewEtcdForTest(t *testing.T) *embed.Etcd {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	os.Chmod(cfg.Dir, 0700) // nolint
+	cfg.LogLevel = "warn"
+
+	// Find free ports to bind the server to.
+	var etcd *embed.Etcd
+	var err error
+	for port := 51000; port < 51100; port++ {
+		cfg.LCUrls = []url.URL{{Scheme: "http", Host: net.JoinHostPort("localhost", strconv.Itoa(port))}}
+		cfg.LPUrls = []url.URL{{Scheme: "http", Host: net.JoinHostPort("localhost", strconv.Itoa(port+100))}}
+		cfg.ACUrls = cfg.LCUrls
+		cfg.APUrls = cfg.LPUrls
+		cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+		etcd, err = embed.StartEtcd(cfg)
+		if isErrorAddressAlreadyInUse(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	if etcd == nil {
+		t.Fatal("could not find free port")
+	}
+
+	t.Cleanup(func() {
+		etcd.Close()
+	})
+	// Wait for server to be ready.
+	<-etcd.Server.ReadyNotify()
+
+	return etcd
+}
+
+func SetEtcdValue(etcd *embed.Etcd, key string, value []byte) {
+	if kv := etcd.Server.KV(); kv != nil {
+		kv.Put([]byte(key), value, lease.NoLease)
+		kv.Commit()
+	}
+}
+
+func DeleteEtcdValue(etcd *embed.Etcd, key string) {
+	if kv := etcd.Server.KV(); kv != nil {
+		kv.DeleteRange([]byte(key), nil)
+		kv.Commit()
+	}
+}
+
+func NewEtcdClientForTest(t *testing.T, etcd *embed.Etcd) *EtcdClient {
+	config := goconf.NewConfigFile()
+	config.AddOption("etcd", "endpoints", etcd.Config().LCUrls[0].String())
+	client, err := NewEtcdClient(config, "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := client.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return client
+}
+
+func TestEtcdClientConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if _, err := NewEtcdClient(config, "etcd"); err == nil {
+		t.Error("should have failed without endpoints")
+	}
+
+	etcd := NewEtcdForTest(t)
+	config.AddOption("etcd", "endpoints", etcd.Config().LCUrls[0].String())
+	client, err := NewEtcdClient(config, "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+}
@@ -0,0 +1,118 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"path"
+)
+
+// EventFilter restricts the events that are sent to an internal session.
+// Empty lists in the filter accept all values.
+type EventFilter struct {
+	rooms   []string
+	targets map[string]bool
+	types   map[string]bool
+}
+
+func newStringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+
+	result := make(map[string]bool, len(values))
+	for _, v := range values {
+		result[v] = true
+	}
+	return result
+}
+
+// NewEventFilter creates a filter from the given message. It returns nil if
+// the message doesn't restrict any events.
+func NewEventFilter(msg *EventFilterInternalClientMessage) *EventFilter {
+	if len(msg.Rooms) == 0 && len(msg.Targets) == 0 && len(msg.Types) == 0 {
+		return nil
+	}
+
+	return &EventFilter{
+		rooms:   msg.Rooms,
+		targets: newStringSet(msg.Targets),
+		types:   newStringSet(msg.Types),
+	}
+}
+
+func getEventRoomId(message *ServerMessage) string {
+	if message.RoomId != "" {
+		// Event from an additional room.
+		return message.RoomId
+	}
+
+	event := message.Event
+	switch {
+	case event.Update != nil:
+		return event.Update.RoomId
+	case event.Invite != nil:
+		return event.Invite.RoomId
+	case event.Disinvite != nil:
+		return event.Disinvite.RoomId
+	case event.Flags != nil:
+		return event.Flags.RoomId
+	case event.Message != nil:
+		return event.Message.RoomId
+	default:
+		return ""
+	}
+}
+
+func (f *EventFilter) matchesRoom(roomId string) bool {
+	if len(f.rooms) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.rooms {
+		if matched, _ := path.Match(pattern, roomId); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches checks if the event should be sent to the session. The id of the
+// current room of the session is used if the event doesn't contain a room id.
+func (f *EventFilter) Matches(message *ServerMessage, currentRoomId string) bool {
+	if f == nil || message.Type != "event" || message.Event == nil {
+		return true
+	}
+
+	event := message.Event
+	if f.targets != nil && !f.targets[event.Target] {
+		return false
+	}
+	if f.types != nil && !f.types[event.Type] {
+		return false
+	}
+
+	roomId := getEventRoomId(message)
+	if roomId == "" {
+		roomId = currentRoomId
+	}
+	return f.matchesRoom(roomId)
+}
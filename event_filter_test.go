@@ -0,0 +1,124 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+)
+
+func TestEventFilter(t *testing.T) {
+	if filter := NewEventFilter(&EventFilterInternalClientMessage{}); filter != nil {
+		t.Errorf("Expected no filter, got %+v", filter)
+	}
+
+	filter := NewEventFilter(&EventFilterInternalClientMessage{
+		Rooms:   []string{"record-*"},
+		Targets: []string{"room", "participants"},
+	})
+
+	join := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "join",
+		},
+	}
+	if !filter.Matches(join, "record-1") {
+		t.Error("should match event in current room")
+	}
+	if filter.Matches(join, "other-room") {
+		t.Error("should not match event in other room")
+	}
+
+	update := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: "record-2",
+			},
+		},
+	}
+	if !filter.Matches(update, "") {
+		t.Error("should match room id of event")
+	}
+
+	additional := &ServerMessage{
+		Type:   "event",
+		RoomId: "other-room",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "leave",
+		},
+	}
+	if filter.Matches(additional, "record-1") {
+		t.Error("should not match event from additional room")
+	}
+
+	roomlist := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "roomlist",
+			Type:   "invite",
+			Invite: &RoomEventServerMessage{
+				RoomId: "record-1",
+			},
+		},
+	}
+	if filter.Matches(roomlist, "record-1") {
+		t.Error("should not match event with other target")
+	}
+
+	message := &ServerMessage{
+		Type: "message",
+	}
+	if !filter.Matches(message, "other-room") {
+		t.Error("should not filter non-event messages")
+	}
+
+	filter = NewEventFilter(&EventFilterInternalClientMessage{
+		Types: []string{"join"},
+	})
+	if !filter.Matches(join, "any-room") {
+		t.Error("should match event with allowed type")
+	}
+	if filter.Matches(update, "any-room") {
+		t.Error("should not match event with other type")
+	}
+}
+
+func TestEventFilterCheckValid(t *testing.T) {
+	valid := &EventFilterInternalClientMessage{
+		Rooms: []string{"room-*", "room-[0-9]"},
+	}
+	if err := valid.CheckValid(); err != nil {
+		t.Errorf("Expected valid filter, got %s", err)
+	}
+
+	invalid := &EventFilterInternalClientMessage{
+		Rooms: []string{"room-["},
+	}
+	if err := invalid.CheckValid(); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
@@ -23,7 +23,10 @@ package signaling
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -31,6 +34,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -47,18 +51,44 @@ func GetGeoIpDownloadUrl(license string) string {
 		return ""
 	}
 
+	return getGeoIpDownloadUrl("GeoLite2-Country", license)
+}
+
+// GetGeoIpAsnDownloadUrl returns the URL of the MaxMind database containing
+// the autonomous systems of IP addresses.
+func GetGeoIpAsnDownloadUrl(license string) string {
+	if license == "" {
+		return ""
+	}
+
+	return getGeoIpDownloadUrl("GeoLite2-ASN", license)
+}
+
+func getGeoIpDownloadUrl(edition string, license string) string {
 	result := "https://download.maxmind.com/app/geoip_download"
-	result += "?edition_id=GeoLite2-Country"
+	result += "?edition_id=" + url.QueryEscape(edition)
 	result += "&license_key=" + url.QueryEscape(license)
 	result += "&suffix=tar.gz"
 	return result
 }
 
+// GetGeoIpChecksumUrl returns the URL of the SHA256 checksum of the database
+// returned by GetGeoIpDownloadUrl.
+func GetGeoIpChecksumUrl(license string) string {
+	if license == "" {
+		return ""
+	}
+
+	return GetGeoIpDownloadUrl(license) + ".sha256"
+}
+
 type GeoLookup struct {
-	url    string
-	isFile bool
-	client http.Client
-	mu     sync.Mutex
+	url         string
+	isFile      bool
+	checksumUrl string
+	cacheFile   string
+	client      http.Client
+	mu          sync.Mutex
 
 	lastModifiedHeader string
 	lastModifiedTime   time.Time
@@ -85,6 +115,52 @@ func NewGeoLookupFromFile(filename string) (*GeoLookup, error) {
 	return geoip, nil
 }
 
+// SetChecksumUrl configures an URL to download the SHA256 checksum of the
+// database from. Downloaded databases that don't match are rejected.
+func (g *GeoLookup) SetChecksumUrl(url string) {
+	g.checksumUrl = url
+}
+
+// SetCacheFile configures a file to store downloaded databases in. If the file
+// already exists, it is used until a newer database has been downloaded.
+func (g *GeoLookup) SetCacheFile(filename string) error {
+	g.cacheFile = filename
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	if err := reader.Verify(); err != nil {
+		return err
+	}
+
+	metadata := reader.Metadata
+	log.Printf("Using cached %s GeoIP database from %s (built on %s)", metadata.DatabaseType, filename, time.Unix(int64(metadata.BuildEpoch), 0).UTC())
+
+	g.mu.Lock()
+	if g.reader != nil {
+		g.reader.Close()
+	}
+	g.reader = reader
+	// The modification time of the cache file is set to the "Last-Modified"
+	// header of the download.
+	g.lastModifiedHeader = info.ModTime().UTC().Format(http.TimeFormat)
+	g.mu.Unlock()
+	return nil
+}
+
 func (g *GeoLookup) Close() {
 	g.mu.Lock()
 	if g.reader != nil {
@@ -155,7 +231,18 @@ func (g *GeoLookup) updateUrl() error {
 		return fmt.Errorf("downloading %s returned an error: %s", g.url, response.Status)
 	}
 
-	body := response.Body
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if g.checksumUrl != "" {
+		if err := g.verifyChecksum(data); err != nil {
+			return err
+		}
+	}
+
+	var body io.Reader = bytes.NewReader(data)
 	if strings.HasSuffix(g.url, ".gz") {
 		body, err = gzip.NewReader(body)
 		if err != nil {
@@ -200,16 +287,93 @@ func (g *GeoLookup) updateUrl() error {
 	metadata := reader.Metadata
 	log.Printf("Using %s GeoIP database from %s (built on %s)", metadata.DatabaseType, g.url, time.Unix(int64(metadata.BuildEpoch), 0).UTC())
 
+	lastModified := response.Header.Get("Last-Modified")
+	if g.cacheFile != "" {
+		if err := writeGeoIpCacheFile(g.cacheFile, geoipdata, lastModified); err != nil {
+			// The downloaded database can still be used.
+			log.Printf("Could not store GeoIP database in %s: %s", g.cacheFile, err)
+		}
+	}
+
 	g.mu.Lock()
 	if g.reader != nil {
 		g.reader.Close()
 	}
 	g.reader = reader
-	g.lastModifiedHeader = response.Header.Get("Last-Modified")
+	g.lastModifiedHeader = lastModified
 	g.mu.Unlock()
 	return nil
 }
 
+func (g *GeoLookup) verifyChecksum(data []byte) error {
+	response, err := g.client.Get(g.checksumUrl)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("downloading checksum %s returned an error: %s", g.checksumUrl, response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	// Format is "<hex-checksum>  <filename>".
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return fmt.Errorf("no checksum found at %s", g.checksumUrl)
+	}
+
+	expected, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid checksum at %s: %w", g.checksumUrl, err)
+	}
+
+	checksum := sha256.Sum256(data)
+	if !bytes.Equal(checksum[:], expected) {
+		return fmt.Errorf("checksum mismatch for %s, expected %s, got %s", g.url, fields[0], hex.EncodeToString(checksum[:]))
+	}
+
+	return nil
+}
+
+// writeGeoIpCacheFile replaces the cache file atomically, so readers never see
+// a partially written database.
+func writeGeoIpCacheFile(filename string, data []byte, lastModified string) error {
+	tmpfile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	if lastModified != "" {
+		if modified, err := http.ParseTime(lastModified); err == nil {
+			if err := os.Chtimes(tmpfile.Name(), modified, modified); err != nil {
+				log.Printf("Could not set modification time of %s: %s", tmpfile.Name(), err)
+			}
+		}
+	}
+
+	if err := os.Rename(tmpfile.Name(), filename); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	return nil
+}
+
 func (g *GeoLookup) LookupCountry(ip net.IP) (string, error) {
 	var record struct {
 		Country struct {
@@ -231,6 +395,25 @@ func (g *GeoLookup) LookupCountry(ip net.IP) (string, error) {
 	return record.Country.ISOCode, nil
 }
 
+func (g *GeoLookup) LookupASN(ip net.IP) (uint, error) {
+	var record struct {
+		AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+	}
+
+	g.mu.Lock()
+	if g.reader == nil {
+		g.mu.Unlock()
+		return 0, ErrDatabaseNotInitialized
+	}
+	err := g.reader.Lookup(ip, &record)
+	g.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return record.AutonomousSystemNumber, nil
+}
+
 func LookupContinents(country string) []string {
 	continents, found := ContinentMap[country]
 	if !found {
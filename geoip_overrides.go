@@ -0,0 +1,358 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type geoIpOverrideRule struct {
+	net     *net.IPNet
+	asn     uint
+	country string
+}
+
+func (r *geoIpOverrideRule) String() string {
+	if r.net != nil {
+		return r.net.String()
+	}
+
+	return fmt.Sprintf("AS%d", r.asn)
+}
+
+// parseGeoIpOverride parses a single override rule. The key can be an IP
+// address, a CIDR or an autonomous system number like "AS64496".
+func parseGeoIpOverride(key string, value string) (*geoIpOverrideRule, error) {
+	key = strings.TrimSpace(key)
+	rule := &geoIpOverrideRule{}
+	if len(key) > 2 && strings.EqualFold(key[:2], "AS") {
+		asn, err := strconv.ParseUint(key[2:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse ASN %s: %s", key, err)
+		}
+		rule.asn = uint(asn)
+	} else if strings.Contains(key, "/") {
+		_, ipNet, err := net.ParseCIDR(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse CIDR %s: %s", key, err)
+		}
+		rule.net = ipNet
+	} else {
+		ip := net.ParseIP(key)
+		if ip == nil {
+			return nil, fmt.Errorf("could not parse IP %s", key)
+		}
+
+		var mask net.IPMask
+		if ipv4 := ip.To4(); ipv4 != nil {
+			mask = net.CIDRMask(32, 32)
+		} else {
+			mask = net.CIDRMask(128, 128)
+		}
+		rule.net = &net.IPNet{
+			IP:   ip,
+			Mask: mask,
+		}
+	}
+
+	rule.country = strings.ToUpper(strings.TrimSpace(value))
+	return rule, nil
+}
+
+func loadGeoIpOverrideSection(config *goconf.ConfigFile) ([]*geoIpOverrideRule, error) {
+	options, _ := config.GetOptions("geoip-overrides")
+	var rules []*geoIpOverrideRule
+	for _, option := range options {
+		value, _ := config.GetString("geoip-overrides", option)
+		rule, err := parseGeoIpOverride(option, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if rule.country == "" {
+			log.Printf("%s doesn't have a country assigned, skipping", rule)
+			continue
+		} else if !IsValidCountry(rule.country) {
+			log.Printf("Country %s for %s is invalid, skipping", rule.country, rule)
+			continue
+		}
+
+		log.Printf("Using country %s for %s", rule.country, rule)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// loadGeoIpOverrideRules loads the rules from the "geoip-overrides" section of
+// the configuration and the optional overrides file.
+func loadGeoIpOverrideRules(config *goconf.ConfigFile) ([]*geoIpOverrideRule, error) {
+	rules, err := loadGeoIpOverrideSection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if filename, _ := config.GetString("geoip", "overridesfile"); filename != "" {
+		overrides, err := goconf.ReadConfigFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not read GeoIP overrides from %s: %s", filename, err)
+		}
+
+		fileRules, err := loadGeoIpOverrideSection(overrides)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoIP overrides in %s: %s", filename, err)
+		}
+
+		rules = append(rules, fileRules...)
+	}
+	return rules, nil
+}
+
+// GeoIpOverrides maps client addresses to countries based on IP ranges or the
+// autonomous system of the address, e.g. for corporate networks whose
+// addresses are located wrong by the GeoIP database.
+type GeoIpOverrides struct {
+	mu sync.RWMutex
+	// Rules from the configuration and overrides file.
+	rules []*geoIpOverrideRule
+	// Rules from etcd, indexed by key.
+	etcdRules map[string]*geoIpOverrideRule
+
+	etcdClient *EtcdClient
+	etcdPrefix string
+	etcdCancel context.CancelFunc
+}
+
+func NewGeoIpOverrides(config *goconf.ConfigFile, etcdClient *EtcdClient) (*GeoIpOverrides, error) {
+	rules, err := loadGeoIpOverrideRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GeoIpOverrides{
+		rules:     rules,
+		etcdRules: make(map[string]*geoIpOverrideRule),
+	}
+
+	if prefix, _ := config.GetString("geoip", "overridesprefix"); prefix != "" {
+		if prefix[len(prefix)-1] != '/' {
+			prefix += "/"
+		}
+
+		if etcdClient == nil {
+			return nil, ErrNoEtcdEndpoints
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result.etcdClient = etcdClient
+		result.etcdPrefix = prefix
+		result.etcdCancel = cancel
+		go result.watchEtcd(ctx)
+	}
+	return result, nil
+}
+
+// IsEnabled returns true if overrides are configured at all.
+func (o *GeoIpOverrides) IsEnabled() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.rules) > 0 || o.etcdClient != nil
+}
+
+func (o *GeoIpOverrides) Reload(config *goconf.ConfigFile) {
+	rules, err := loadGeoIpOverrideRules(config)
+	if err != nil {
+		log.Printf("Could not reload GeoIP overrides, keeping previous: %s", err)
+		return
+	}
+
+	o.mu.Lock()
+	o.rules = rules
+	o.mu.Unlock()
+}
+
+// Close stops watching for overrides in etcd.
+func (o *GeoIpOverrides) Close() {
+	if o.etcdCancel == nil {
+		return
+	}
+
+	o.etcdCancel()
+}
+
+// Lookup returns the country of the most specific IP range that contains the
+// address. ASN rules are only checked if no range matches and "lookupAsn" can
+// determine the autonomous system of the address.
+func (o *GeoIpOverrides) Lookup(ip net.IP, lookupAsn func(ip net.IP) (uint, bool)) (string, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var match *geoIpOverrideRule
+	matchSize := -1
+	hasAsnRules := false
+	check := func(rule *geoIpOverrideRule) {
+		if rule.net == nil {
+			hasAsnRules = true
+			return
+		}
+
+		if size, _ := rule.net.Mask.Size(); size > matchSize && rule.net.Contains(ip) {
+			match = rule
+			matchSize = size
+		}
+	}
+	// Rules from etcd take precedence over static rules for the same range.
+	for _, rule := range o.etcdRules {
+		check(rule)
+	}
+	for _, rule := range o.rules {
+		check(rule)
+	}
+	if match != nil {
+		return match.country, true
+	}
+
+	if !hasAsnRules || lookupAsn == nil {
+		return "", false
+	}
+
+	asn, found := lookupAsn(ip)
+	if !found {
+		return "", false
+	}
+
+	for _, rule := range o.etcdRules {
+		if rule.net == nil && rule.asn == asn {
+			return rule.country, true
+		}
+	}
+	for _, rule := range o.rules {
+		if rule.net == nil && rule.asn == asn {
+			return rule.country, true
+		}
+	}
+	return "", false
+}
+
+func (o *GeoIpOverrides) watchEtcd(ctx context.Context) {
+	if err := o.etcdClient.WaitForConnection(ctx); err != nil {
+		return
+	}
+
+	log.Printf("Watching GeoIP overrides in %s", o.etcdPrefix)
+	waitDelay := initialWaitDelay
+	for {
+		if err := o.syncEtcd(ctx); ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Printf("Error watching GeoIP overrides in %s, retry in %s: %s", o.etcdPrefix, waitDelay, err)
+		} else {
+			log.Printf("Watching GeoIP overrides in %s was interrupted, retry in %s", o.etcdPrefix, waitDelay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(waitDelay):
+		}
+
+		waitDelay = waitDelay * 2
+		if waitDelay > maxWaitDelay {
+			waitDelay = maxWaitDelay
+		}
+	}
+}
+
+// syncEtcd loads the current overrides and processes changes until the watch
+// is interrupted.
+func (o *GeoIpOverrides) syncEtcd(ctx context.Context) error {
+	getCtx, cancel := context.WithTimeout(ctx, time.Second)
+	response, err := o.etcdClient.Get(getCtx, o.etcdPrefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	rules := make(map[string]*geoIpOverrideRule)
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		if rule := o.parseEtcdRule(key, kv.Value); rule != nil {
+			rules[key] = rule
+		}
+	}
+	o.mu.Lock()
+	o.etcdRules = rules
+	o.mu.Unlock()
+
+	ch := o.etcdClient.Watch(clientv3.WithRequireLeader(ctx), o.etcdPrefix, clientv3.WithPrefix(), clientv3.WithRev(response.Header.Revision+1))
+	for response := range ch {
+		if err := response.Err(); err != nil {
+			return err
+		}
+
+		for _, ev := range response.Events {
+			key := string(ev.Kv.Key)
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				rule := o.parseEtcdRule(key, ev.Kv.Value)
+				o.mu.Lock()
+				if rule != nil {
+					o.etcdRules[key] = rule
+				} else {
+					delete(o.etcdRules, key)
+				}
+				o.mu.Unlock()
+			case clientv3.EventTypeDelete:
+				log.Printf("Removed GeoIP override %s", strings.TrimPrefix(key, o.etcdPrefix))
+				o.mu.Lock()
+				delete(o.etcdRules, key)
+				o.mu.Unlock()
+			default:
+				log.Printf("Unsupported event %s %q -> %q", ev.Type, ev.Kv.Key, ev.Kv.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *GeoIpOverrides) parseEtcdRule(key string, value []byte) *geoIpOverrideRule {
+	rule, err := parseGeoIpOverride(strings.TrimPrefix(key, o.etcdPrefix), string(value))
+	if err != nil {
+		log.Printf("Received invalid GeoIP override %s: %s", key, err)
+		return nil
+	} else if !IsValidCountry(rule.country) {
+		log.Printf("Country %s for %s is invalid, skipping", rule.country, rule)
+		return nil
+	}
+
+	log.Printf("Using country %s for %s", rule.country, rule)
+	return rule
+}
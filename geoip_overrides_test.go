@@ -0,0 +1,204 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func checkGeoIpOverride(t *testing.T, overrides *GeoIpOverrides, ip string, lookupAsn func(ip net.IP) (uint, bool), expected string) {
+	t.Helper()
+	country, found := overrides.Lookup(net.ParseIP(ip), lookupAsn)
+	if expected == "" {
+		if found {
+			t.Errorf("expected no override for %s, got %s", ip, country)
+		}
+	} else if !found {
+		t.Errorf("expected override %s for %s, got none", expected, ip)
+	} else if country != expected {
+		t.Errorf("expected override %s for %s, got %s", expected, ip, country)
+	}
+}
+
+func TestGeoIpOverridesParse(t *testing.T) {
+	invalid := []string{
+		"",
+		"1.2.3",
+		"1.2.3.4/33",
+		"AS",
+		"ASfoo",
+		"AS99999999999",
+	}
+	for _, key := range invalid {
+		if rule, err := parseGeoIpOverride(key, "DE"); err == nil {
+			t.Errorf("expected error for %s, got %s", key, rule)
+		}
+	}
+
+	valid := map[string]string{
+		"1.2.3.4":       "1.2.3.4/32",
+		"10.0.0.0/8":    "10.0.0.0/8",
+		"2001:db8::1":   "2001:db8::1/128",
+		"AS64496":       "AS64496",
+		" as64497 ":     "AS64497",
+		"10.1.2.3/16":   "10.1.0.0/16",
+		"2001:db8::/32": "2001:db8::/32",
+	}
+	for key, expected := range valid {
+		if rule, err := parseGeoIpOverride(key, " de "); err != nil {
+			t.Errorf("could not parse %s: %s", key, err)
+		} else if rule.String() != expected {
+			t.Errorf("expected %s for %s, got %s", expected, key, rule)
+		} else if rule.country != "DE" {
+			t.Errorf("expected country DE for %s, got %s", key, rule.country)
+		}
+	}
+}
+
+func TestGeoIpOverridesLookup(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("geoip-overrides", "10.0.0.0/8", "DE")
+	config.AddOption("geoip-overrides", "10.1.0.0/16", "FR")
+	config.AddOption("geoip-overrides", "10.1.2.3", "IT")
+	config.AddOption("geoip-overrides", "AS64496", "US")
+	config.AddOption("geoip-overrides", "192.168.0.0/16", "")
+
+	overrides, err := NewGeoIpOverrides(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overrides.Close()
+
+	if !overrides.IsEnabled() {
+		t.Error("overrides should be enabled")
+	}
+
+	lookupAsn := func(ip net.IP) (uint, bool) {
+		if ip.Equal(net.ParseIP("1.2.3.4")) {
+			return 64496, true
+		}
+		return 64497, true
+	}
+
+	// The most specific range is used.
+	checkGeoIpOverride(t, overrides, "10.2.3.4", lookupAsn, "DE")
+	checkGeoIpOverride(t, overrides, "10.1.3.4", lookupAsn, "FR")
+	checkGeoIpOverride(t, overrides, "10.1.2.3", lookupAsn, "IT")
+	checkGeoIpOverride(t, overrides, "192.168.1.2", lookupAsn, "")
+	// ASN rules are checked if no range matches.
+	checkGeoIpOverride(t, overrides, "1.2.3.4", lookupAsn, "US")
+	checkGeoIpOverride(t, overrides, "1.2.3.5", lookupAsn, "")
+	checkGeoIpOverride(t, overrides, "1.2.3.4", nil, "")
+
+	config.AddOption("geoip-overrides", "1.2.3.0/33", "DE")
+	if _, err := NewGeoIpOverrides(config, nil); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
+func TestGeoIpOverridesFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "overrides.conf")
+	if err := os.WriteFile(filename, []byte("[geoip-overrides]\n10.0.0.0/8 = DE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("geoip", "overridesfile", filename)
+	config.AddOption("geoip-overrides", "192.168.0.0/16", "FR")
+
+	overrides, err := NewGeoIpOverrides(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overrides.Close()
+
+	checkGeoIpOverride(t, overrides, "10.1.2.3", nil, "DE")
+	checkGeoIpOverride(t, overrides, "192.168.1.2", nil, "FR")
+
+	if err := os.WriteFile(filename, []byte("[geoip-overrides]\n10.0.0.0/8 = IT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	overrides.Reload(config)
+	checkGeoIpOverride(t, overrides, "10.1.2.3", nil, "IT")
+	checkGeoIpOverride(t, overrides, "192.168.1.2", nil, "FR")
+
+	// Invalid files keep the previous overrides.
+	if err := os.WriteFile(filename, []byte("[geoip-overrides]\n10.0.0.0/33 = DE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	overrides.Reload(config)
+	checkGeoIpOverride(t, overrides, "10.1.2.3", nil, "IT")
+}
+
+func TestGeoIpOverridesEtcd(t *testing.T) {
+	etcd := NewEtcdForTest(t)
+
+	SetEtcdValue(etcd, "/geoip/10.0.0.0/8", []byte("DE"))
+	SetEtcdValue(etcd, "/geoip/invalid", []byte("DE"))
+
+	config := goconf.NewConfigFile()
+	config.AddOption("geoip", "overridesprefix", "/geoip")
+	config.AddOption("geoip-overrides", "10.0.0.0/8", "FR")
+
+	overrides, err := NewGeoIpOverrides(config, NewEtcdClientForTest(t, etcd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overrides.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	waitForOverride := func(ip string, lookupAsn func(ip net.IP) (uint, bool), expected string) {
+		t.Helper()
+		for {
+			if country, _ := overrides.Lookup(net.ParseIP(ip), lookupAsn); country == expected {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				t.Fatalf("override for %s didn't change to %s", ip, expected)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	// Rules from etcd take precedence.
+	waitForOverride("10.1.2.3", nil, "DE")
+
+	lookupAsn := func(ip net.IP) (uint, bool) {
+		return 64496, true
+	}
+	SetEtcdValue(etcd, "/geoip/AS64496", []byte("US"))
+	waitForOverride("1.2.3.4", lookupAsn, "US")
+
+	DeleteEtcdValue(etcd, "/geoip/10.0.0.0/8")
+	waitForOverride("10.1.2.3", nil, "FR")
+}
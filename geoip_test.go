@@ -23,13 +23,19 @@ package signaling
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func testGeoLookupReader(t *testing.T, reader *GeoLookup) {
@@ -202,6 +208,84 @@ func TestGeoLookupFromFile(t *testing.T) {
 	testGeoLookupReader(t, reader)
 }
 
+func TestGeoLookupChecksum(t *testing.T) {
+	data := []byte("not-a-database")
+	checksum := sha256.Sum256(data)
+	expected := hex.EncodeToString(checksum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/database.tar":
+			w.Write(data) // nolint
+		case "/valid.sha256":
+			w.Write([]byte(expected + "  database.tar\n")) // nolint
+		case "/invalid.sha256":
+			w.Write([]byte(strings.Repeat("0", len(expected)) + "  database.tar\n")) // nolint
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	reader, err := NewGeoLookupFromUrl(server.URL + "/database.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	reader.SetChecksumUrl(server.URL + "/invalid.sha256")
+	if err := reader.Update(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %s", err)
+	}
+
+	// The checksum matches, but the data is not a valid tarball.
+	reader.SetChecksumUrl(server.URL + "/valid.sha256")
+	if err := reader.Update(); err == nil || strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected invalid tarball, got %s", err)
+	}
+}
+
+func TestGeoLookupWriteCacheFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geoip.mmdb")
+	if err := os.WriteFile(filename, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := writeGeoIpCacheFile(filename, []byte("new"), modified.Format(http.TimeFormat)); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(filename); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, []byte("new")) {
+		t.Errorf("expected new data, got %s", string(data))
+	}
+
+	if info, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if !info.ModTime().Equal(modified) {
+		t.Errorf("expected modification time %s, got %s", modified, info.ModTime())
+	}
+
+	if entries, err := os.ReadDir(filepath.Dir(filename)); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("expected only the cache file, got %+v", entries)
+	}
+
+	// Invalid cache files are not used.
+	reader, err := NewGeoLookupFromUrl("ignore-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := reader.SetCacheFile(filename); err == nil {
+		t.Error("expected error when loading invalid cache file")
+	}
+}
+
 func TestIsValidContinent(t *testing.T) {
 	for country, continents := range ContinentMap {
 		for _, continent := range continents {
@@ -0,0 +1,321 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+
+	"github.com/dlintw/goconf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The backend service is described manually and uses JSON encoded
+	// messages, so no generated protobuf code is necessary.
+	grpcBackendServiceName   = "signaling.Backend"
+	grpcBackendPerformMethod = "PerformRequest"
+
+	grpcJsonCodecName = "signaling-json"
+
+	grpcSecretMetadataKey = "x-signaling-secret"
+)
+
+var (
+	ErrNoGrpcSecret      = errors.New("no GRPC secret configured")
+	ErrNoGrpcCertificate = errors.New("no GRPC certificate configured")
+)
+
+type grpcJsonCodec struct{}
+
+func (c grpcJsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c grpcJsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (c grpcJsonCodec) Name() string {
+	return grpcJsonCodecName
+}
+
+func init() {
+	encoding.RegisterCodec(grpcJsonCodec{})
+}
+
+// GrpcBackendRequest is sent by a delegating signaling server to perform a
+// backend request with the secret known to the receiving server.
+type GrpcBackendRequest struct {
+	Url     string          `json:"url"`
+	Request json.RawMessage `json:"request"`
+}
+
+// GrpcBackendResponse contains either the (decoded) response of the backend
+// or the OCS error returned by it.
+type GrpcBackendResponse struct {
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *Error          `json:"error,omitempty"`
+}
+
+type grpcBackendService interface {
+	PerformRequest(ctx context.Context, request *GrpcBackendRequest) (*GrpcBackendResponse, error)
+}
+
+func grpcBackendPerformRequestHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	request := new(GrpcBackendRequest)
+	if err := dec(request); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(grpcBackendService).PerformRequest(ctx, request)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + grpcBackendServiceName + "/" + grpcBackendPerformMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(grpcBackendService).PerformRequest(ctx, req.(*GrpcBackendRequest))
+	}
+	return interceptor(ctx, request, info, handler)
+}
+
+var grpcBackendServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcBackendServiceName,
+	HandlerType: (*grpcBackendService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: grpcBackendPerformMethod,
+			Handler:    grpcBackendPerformRequestHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// GrpcBackendServer performs backend requests on behalf of signaling servers
+// that don't have the backend secrets configured.
+type GrpcBackendServer struct {
+	backend *BackendClient
+	secret  []byte
+
+	server   *grpc.Server
+	listener net.Listener
+}
+
+// NewGrpcBackendServer creates a server listening on the address configured
+// in "listen" of the "grpc" section. It returns nil if no address is configured.
+func NewGrpcBackendServer(config *goconf.ConfigFile, hub *Hub) (*GrpcBackendServer, error) {
+	addr, _ := config.GetString("grpc", "listen")
+	if addr == "" {
+		return nil, nil
+	}
+
+	secret, _ := config.GetString("grpc", "secret")
+	if secret == "" {
+		return nil, ErrNoGrpcSecret
+	}
+
+	var opts []grpc.ServerOption
+	certificate, _ := config.GetString("grpc", "certificate")
+	key, _ := config.GetString("grpc", "key")
+	if certificate != "" && key != "" {
+		creds, err := credentials.NewServerTLSFromFile(certificate, key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load GRPC certificate: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	} else if insecure, _ := config.GetBool("grpc", "insecure"); insecure {
+		log.Println("WARNING: GRPC connections are not encrypted, only use for development!")
+	} else {
+		return nil, ErrNoGrpcCertificate
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", addr, err)
+	}
+
+	server := &GrpcBackendServer{
+		backend: hub.backend,
+		secret:  []byte(secret),
+
+		server:   grpc.NewServer(opts...),
+		listener: listener,
+	}
+	server.server.RegisterService(&grpcBackendServiceDesc, server)
+	return server, nil
+}
+
+func (s *GrpcBackendServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *GrpcBackendServer) Run() error {
+	log.Printf("Listening for GRPC backend requests on %s", s.listener.Addr())
+	return s.server.Serve(s.listener)
+}
+
+func (s *GrpcBackendServer) Close() {
+	s.server.GracefulStop()
+}
+
+func (s *GrpcBackendServer) isAuthenticated(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+
+	for _, secret := range md.Get(grpcSecretMetadataKey) {
+		if subtle.ConstantTimeCompare([]byte(secret), s.secret) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *GrpcBackendServer) PerformRequest(ctx context.Context, request *GrpcBackendRequest) (*GrpcBackendResponse, error) {
+	if !s.isAuthenticated(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "invalid secret")
+	}
+
+	u, err := url.Parse(request.Url)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid url %s: %s", request.Url, err)
+	}
+
+	// Only sign requests for explicitly configured backends, the compat
+	// backend would allow requests to arbitrary hosts.
+	if backend := s.backend.GetBackend(u); backend == nil || backend.IsCompat() {
+		return nil, status.Errorf(codes.PermissionDenied, "url %s is not allowed", request.Url)
+	}
+
+	var response json.RawMessage
+	if err := s.backend.PerformJSONRequest(ctx, u, request.Request, &response); err != nil {
+		if e, ok := err.(*Error); ok {
+			return &GrpcBackendResponse{
+				Error: e,
+			}, nil
+		}
+
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &GrpcBackendResponse{
+		Response: response,
+	}, nil
+}
+
+// GrpcBackendClient delegates backend requests to another signaling server
+// which has the backend secrets configured.
+type GrpcBackendClient struct {
+	conn   *grpc.ClientConn
+	secret string
+}
+
+// NewGrpcBackendClient creates a client connecting to the server configured
+// in "delegate" of the "grpc" section. It returns nil if no server is
+// configured.
+func NewGrpcBackendClient(config *goconf.ConfigFile) (*GrpcBackendClient, error) {
+	target, _ := config.GetString("grpc", "delegate")
+	if target == "" {
+		return nil, nil
+	}
+
+	secret, _ := config.GetString("grpc", "secret")
+	if secret == "" {
+		return nil, ErrNoGrpcSecret
+	}
+
+	var opts []grpc.DialOption
+	if insecure, _ := config.GetBool("grpc", "insecure"); insecure {
+		log.Println("WARNING: GRPC connections are not encrypted, only use for development!")
+		opts = append(opts, grpc.WithInsecure())
+	} else if ca, _ := config.GetString("grpc", "ca"); ca != "" {
+		creds, err := credentials.NewClientTLSFromFile(ca, "")
+		if err != nil {
+			return nil, fmt.Errorf("could not load GRPC CA certificate: %w", err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		// Use the system certificate pool.
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	}
+
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Delegating backend requests to %s", target)
+	return &GrpcBackendClient{
+		conn:   conn,
+		secret: secret,
+	}, nil
+}
+
+func (c *GrpcBackendClient) Close() {
+	if err := c.conn.Close(); err != nil {
+		log.Printf("Error closing GRPC connection to %s: %s", c.conn.Target(), err)
+	}
+}
+
+// PerformJSONRequest lets the remote server send the request to the given
+// url and decodes the result into "response".
+func (c *GrpcBackendClient) PerformJSONRequest(ctx context.Context, u *url.URL, request interface{}, response interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("Could not marshal request %+v: %s", request, err)
+		return err
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, grpcSecretMetadataKey, c.secret)
+	req := &GrpcBackendRequest{
+		Url:     u.String(),
+		Request: data,
+	}
+	var resp GrpcBackendResponse
+	if err := c.conn.Invoke(ctx, "/"+grpcBackendServiceName+"/"+grpcBackendPerformMethod, req, &resp, grpc.CallContentSubtype(grpcJsonCodecName)); err != nil {
+		log.Printf("Could not delegate request to %s: %s", u, err)
+		return err
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err := json.Unmarshal(resp.Response, response); err != nil {
+		log.Printf("Could not decode delegated response %s from %s: %s", string(resp.Response), u, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dlintw/goconf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testGrpcSecret = "the-grpc-secret"
+)
+
+func CreateGrpcBackendServerForTest(t *testing.T, hub *Hub) *GrpcBackendServer {
+	config := goconf.NewConfigFile()
+	config.AddOption("grpc", "listen", "127.0.0.1:0")
+	config.AddOption("grpc", "secret", testGrpcSecret)
+	config.AddOption("grpc", "insecure", "true")
+	server, err := NewGrpcBackendServer(config, hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := server.Run(); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return server
+}
+
+func getTestConfigWithDelegate(server *httptest.Server, addr string, secret string) (*goconf.ConfigFile, error) {
+	config, err := getTestConfigWithMultipleBackends(server)
+	if err != nil {
+		return nil, err
+	}
+
+	config.RemoveOption("backend1", "secret")
+	config.RemoveOption("backend2", "secret")
+	config.AddOption("grpc", "delegate", addr)
+	config.AddOption("grpc", "secret", secret)
+	config.AddOption("grpc", "insecure", "true")
+	return config, nil
+}
+
+func TestGrpcBackend_RequireCertificate(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("grpc", "listen", "127.0.0.1:0")
+	config.AddOption("grpc", "secret", testGrpcSecret)
+	if server, err := NewGrpcBackendServer(config, nil); err != ErrNoGrpcCertificate {
+		t.Errorf("Expected error %s, got %+v / %s", ErrNoGrpcCertificate, server, err)
+	}
+}
+
+func TestGrpcBackend_DelegateHello(t *testing.T) {
+	hub1, _, _, server1 := CreateHubWithMultipleBackendsForTest(t)
+	grpcServer := CreateGrpcBackendServerForTest(t, hub1)
+
+	hub2, _, _, server2 := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		return getTestConfigWithDelegate(server1, grpcServer.Addr().String(), testGrpcSecret)
+	})
+
+	client := NewTestClient(t, server2, hub2)
+	defer client.CloseWithBye()
+
+	params := TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	}
+	if err := client.SendHelloParams(server1.URL+"/one", "", params); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if hello, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	} else {
+		if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+		if hello.Hello.SessionId == "" {
+			t.Errorf("Expected session id, got %+v", hello.Hello)
+		}
+	}
+}
+
+func TestGrpcBackend_RejectUnsigned(t *testing.T) {
+	hub1, _, _, server1 := CreateHubWithMultipleBackendsForTest(t)
+	grpcServer := CreateGrpcBackendServerForTest(t, hub1)
+
+	_, _, _, server2 := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		return getTestConfigWithDelegate(server1, grpcServer.Addr().String(), testGrpcSecret)
+	})
+
+	// Requests of backends without a secret must not be accepted by delegating
+	// servers, the checksum can't be validated.
+	msg := &BackendServerRoomRequest{
+		Type: "update",
+		Update: &BackendRoomUpdateRequest{
+			UserIds: []string{testDefaultUserId},
+		},
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest("POST", server2.URL+"/api/v1/room/the-room", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderBackendServer, server1.URL+"/one")
+	AddBackendChecksum(request, data, nil)
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden, got %s", res.Status)
+	}
+}
+
+func TestGrpcBackend_RejectCompatBackend(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+	grpcServer := CreateGrpcBackendServerForTest(t, hub)
+
+	config, err := getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RemoveOption("backend", "secret")
+	config.AddOption("grpc", "delegate", grpcServer.Addr().String())
+	config.AddOption("grpc", "secret", testGrpcSecret)
+	config.AddOption("grpc", "insecure", "true")
+	client, err := NewBackendClient(config, 1, "0.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	request := NewBackendClientAuthRequest(nil)
+	var response BackendClientResponse
+	if err := client.PerformJSONRequest(ctx, u, request, &response); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Should have failed for the compat backend, got %+v / %s", response, err)
+	}
+}
+
+func TestGrpcBackend_InvalidSecret(t *testing.T) {
+	hub, _, _, server := CreateHubWithMultipleBackendsForTest(t)
+	grpcServer := CreateGrpcBackendServerForTest(t, hub)
+
+	config, err := getTestConfigWithDelegate(server, grpcServer.Addr().String(), "invalid-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewBackendClient(config, 1, "0.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	u, err := url.Parse(server.URL + "/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	request := NewBackendClientAuthRequest(nil)
+	var response BackendClientResponse
+	if err := client.PerformJSONRequest(ctx, u, request, &response); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Should have failed with an invalid secret, got %+v / %s", response, err)
+	}
+}
@@ -29,48 +29,126 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	ErrHttpClientPoolTimeout = errors.New("timeout while waiting for free connection")
+)
+
+// httpPoolSettings contains the settings for the pool of a backend. Zero
+// values use the defaults of the HttpClientPool.
+type httpPoolSettings struct {
+	// Name of the pool, e.g. the id of the backend. Requests to the same host
+	// but with different names use separate pools so a slow backend can't
+	// exhaust the connections of other backends. The host is used if empty.
+	name string
+
+	tls *tlsClientSettings
+
+	maxConcurrentRequests int
+	maxIdleConnections    int
+}
+
+func (s *httpPoolSettings) String() string {
+	result := fmt.Sprintf("name=%s,concurrent=%d,idle=%d", s.name, s.maxConcurrentRequests, s.maxIdleConnections)
+	if s.tls != nil {
+		result += "," + s.tls.String()
+	}
+	return result
+}
+
 type Pool struct {
-	pool chan *http.Client
+	// 32-bit members that are accessed atomically must be 32-bit aligned.
+	closed int32
+
+	name    string
+	host    string
+	timeout time.Duration
+
+	pool      chan *http.Client
+	transport *http.Transport
 }
 
 func (p *Pool) get(ctx context.Context) (client *http.Client, err error) {
+	start := time.Now()
 	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case client := <-p.pool:
-		return client, nil
+	case client = <-p.pool:
+	default:
+		// Pool is saturated, wait for a client to be returned.
+		var timeout <-chan time.Time
+		if p.timeout > 0 {
+			timer := time.NewTimer(p.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			statsHttpClientPoolTimeoutsTotal.WithLabelValues(p.name).Inc()
+			return nil, ErrHttpClientPoolTimeout
+		case client = <-p.pool:
+		}
 	}
+
+	statsHttpClientPoolWaitSeconds.WithLabelValues(p.name).Observe(time.Since(start).Seconds())
+	statsHttpClientPoolActive.WithLabelValues(p.name).Inc()
+	return client, nil
 }
 
 func (p *Pool) Put(c *http.Client) {
+	if atomic.LoadInt32(&p.closed) != 0 {
+		// The host was removed while the client was in use.
+		c.CloseIdleConnections()
+	} else {
+		statsHttpClientPoolActive.WithLabelValues(p.name).Dec()
+	}
 	p.pool <- c
 }
 
-func newPool(constructor func() *http.Client, size int) (*Pool, error) {
+func (p *Pool) close() {
+	atomic.StoreInt32(&p.closed, 1)
+	p.transport.CloseIdleConnections()
+	deleteHttpClientPoolStats(p.name)
+}
+
+func newPool(name string, host string, transport *http.Transport, constructor func(transport *http.Transport) *http.Client, size int, timeout time.Duration) (*Pool, error) {
 	if size <= 0 {
 		return nil, fmt.Errorf("can't create empty pool")
 	}
 
 	p := &Pool{
-		pool: make(chan *http.Client, size),
+		name:    name,
+		host:    host,
+		timeout: timeout,
+
+		pool:      make(chan *http.Client, size),
+		transport: transport,
 	}
-	for size > 0 {
-		c := constructor()
+	for i := 0; i < size; i++ {
+		c := constructor(transport)
 		p.pool <- c
-		size--
 	}
+	statsHttpClientPoolSize.WithLabelValues(name).Set(float64(size))
+	statsHttpClientPoolActive.WithLabelValues(name).Set(0)
 	return p, nil
 }
 
 type HttpClientPool struct {
 	mu sync.Mutex
 
+	// Template for the transports of the pools, each pool uses its own
+	// transport so idle connections can be closed per host.
 	transport *http.Transport
 	clients   map[string]*Pool
+	settings  func(u *url.URL) *httpPoolSettings
 
 	maxConcurrentRequestsPerHost int
+	maxIdleConnsPerHost          int
+	timeout                      time.Duration
 }
 
 func NewHttpClientPool(maxConcurrentRequestsPerHost int, skipVerify bool) (*HttpClientPool, error) {
@@ -84,27 +162,119 @@ func NewHttpClientPool(maxConcurrentRequestsPerHost int, skipVerify bool) (*Http
 	transport := &http.Transport{
 		MaxIdleConnsPerHost: maxConcurrentRequestsPerHost,
 		TLSClientConfig:     tlsconfig,
+		// A custom TLS config disables HTTP/2 unless explicitly requested.
+		ForceAttemptHTTP2: true,
 	}
 
+	RegisterHttpClientPoolStats()
 	result := &HttpClientPool{
 		transport: transport,
 		clients:   make(map[string]*Pool),
 
 		maxConcurrentRequestsPerHost: maxConcurrentRequestsPerHost,
+		maxIdleConnsPerHost:          maxConcurrentRequestsPerHost,
 	}
 	return result, nil
 }
 
+// SetPoolSettings sets the function that returns custom settings for requests
+// to a given URL. The default settings of the pool are used if it returns nil.
+func (p *HttpClientPool) SetPoolSettings(f func(u *url.URL) *httpPoolSettings) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settings = f
+}
+
+// SetMaxIdleConnsPerHost sets the default number of idle connections to keep
+// open per pool.
+func (p *HttpClientPool) SetMaxIdleConnsPerHost(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxIdleConnsPerHost = count
+}
+
+// SetTimeout sets the maximum time to wait for a free client if all clients
+// of a pool are in use. Requests will only be limited by their context if the
+// timeout is zero.
+func (p *HttpClientPool) SetTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = timeout
+}
+
+// SetHttp2 controls if HTTP/2 should be used for TLS connections if the
+// server supports it.
+func (p *HttpClientPool) SetHttp2(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transport.ForceAttemptHTTP2 = enabled
+	if enabled {
+		p.transport.TLSNextProto = nil
+	} else {
+		// A non-nil empty map disables HTTP/2.
+		p.transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+}
+
+func (p *HttpClientPool) newTransport(settings *httpPoolSettings, maxIdleConns int) (*http.Transport, error) {
+	transport := p.transport.Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	if settings != nil && settings.tls != nil {
+		tlsconfig, err := settings.tls.newTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		transport.TLSClientConfig = tlsconfig
+	}
+	return transport, nil
+}
+
 func (p *HttpClientPool) getPool(url *url.URL) (*Pool, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if pool, found := p.clients[url.Host]; found {
+
+	var settings *httpPoolSettings
+	if p.settings != nil {
+		settings = p.settings(url)
+	}
+
+	name := url.Host
+	key := url.Host
+	maxConcurrent := p.maxConcurrentRequestsPerHost
+	maxIdle := p.maxIdleConnsPerHost
+	if settings != nil {
+		if settings.name != "" {
+			name = settings.name
+		}
+		if settings.maxConcurrentRequests > 0 {
+			maxConcurrent = settings.maxConcurrentRequests
+		}
+		if settings.maxIdleConnections > 0 {
+			maxIdle = settings.maxIdleConnections
+		}
+		key += "|" + settings.String()
+	}
+	if pool, found := p.clients[key]; found {
 		return pool, nil
 	}
 
-	pool, err := newPool(func() *http.Client {
+	// The settings of a backend might have changed, close its previous pool.
+	for k, pool := range p.clients {
+		if pool.name == name && pool.host == url.Host {
+			delete(p.clients, k)
+			pool.close()
+		}
+	}
+
+	transport, err := p.newTransport(settings, maxIdle)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := newPool(name, url.Host, transport, func(transport *http.Transport) *http.Client {
 		return &http.Client{
-			Transport: p.transport,
+			Transport: transport,
 			// Only send body in redirect if going to same scheme / host.
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				if len(via) >= 10 {
@@ -118,15 +288,44 @@ func (p *HttpClientPool) getPool(url *url.URL) (*Pool, error) {
 				return nil
 			},
 		}
-	}, p.maxConcurrentRequestsPerHost)
+	}, maxConcurrent, p.timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	p.clients[url.Host] = pool
+	p.clients[key] = pool
 	return pool, nil
 }
 
+// RemoveHost removes the clients for the given host and closes their idle
+// connections. Clients that are currently in use will be discarded when they
+// are returned.
+func (p *HttpClientPool) RemoveHost(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pool := range p.clients {
+		if pool.host == host {
+			delete(p.clients, key)
+			pool.close()
+		}
+	}
+}
+
+// RemovePool removes the clients of the pool with the given name (e.g. the id
+// of a backend) and closes their idle connections.
+func (p *HttpClientPool) RemovePool(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pool := range p.clients {
+		if pool.name == name {
+			delete(p.clients, key)
+			pool.close()
+		}
+	}
+}
+
 func (p *HttpClientPool) Get(ctx context.Context, url *url.URL) (*http.Client, *Pool, error) {
 	pool, err := p.getPool(url)
 	if err != nil {
@@ -0,0 +1,72 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statsHttpClientPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "http_client_pool",
+		Name:      "size",
+		Help:      "The maximum number of concurrent requests per pool",
+	}, []string{"pool"})
+	statsHttpClientPoolActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "http_client_pool",
+		Name:      "active",
+		Help:      "The current number of active requests per pool",
+	}, []string{"pool"})
+	statsHttpClientPoolWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "signaling",
+		Subsystem: "http_client_pool",
+		Name:      "wait_seconds",
+		Help:      "The time in seconds requests waited for a free client of the pool",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 7),
+	}, []string{"pool"})
+	statsHttpClientPoolTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "http_client_pool",
+		Name:      "timeouts_total",
+		Help:      "The total number of requests that timed out waiting for a free client",
+	}, []string{"pool"})
+
+	httpClientPoolStats = []prometheus.Collector{
+		statsHttpClientPoolSize,
+		statsHttpClientPoolActive,
+		statsHttpClientPoolWaitSeconds,
+		statsHttpClientPoolTimeoutsTotal,
+	}
+)
+
+func RegisterHttpClientPoolStats() {
+	registerAll(httpClientPoolStats...)
+}
+
+func deleteHttpClientPoolStats(pool string) {
+	statsHttpClientPoolSize.DeleteLabelValues(pool)
+	statsHttpClientPoolActive.DeleteLabelValues(pool)
+	statsHttpClientPoolWaitSeconds.DeleteLabelValues(pool)
+	statsHttpClientPoolTimeoutsTotal.DeleteLabelValues(pool)
+}
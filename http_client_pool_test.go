@@ -24,6 +24,7 @@ package signaling
 import (
 	"context"
 	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -74,3 +75,129 @@ func TestHttpClientPool(t *testing.T) {
 		t.Errorf("fetching from empty pool should have timed out, got %s", err)
 	}
 }
+
+func TestHttpClientPoolRemoveHost(t *testing.T) {
+	pool, err := NewHttpClientPool(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse("http://localhost/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, p, err := pool.Get(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.RemoveHost(u.Host)
+	// Returning a client of a removed host must not block.
+	p.Put(client)
+
+	// A new pool is created for the removed host.
+	if _, p2, err := pool.Get(ctx, u); err != nil {
+		t.Fatal(err)
+	} else if p2 == p {
+		t.Error("should have created a new pool for the removed host")
+	}
+}
+
+func TestHttpClientPoolTimeout(t *testing.T) {
+	pool, err := NewHttpClientPool(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetTimeout(10 * time.Millisecond)
+
+	u, err := url.Parse("http://localhost/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, p, err := pool.Get(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatsValue(t, statsHttpClientPoolActive.WithLabelValues(u.Host), 1)
+
+	if _, _, err := pool.Get(ctx, u); err != ErrHttpClientPoolTimeout {
+		t.Errorf("fetching from saturated pool should have timed out, got %v", err)
+	}
+
+	p.Put(client)
+	checkStatsValue(t, statsHttpClientPoolActive.WithLabelValues(u.Host), 0)
+	if _, _, err := pool.Get(ctx, u); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHttpClientPoolSettings(t *testing.T) {
+	pool, err := NewHttpClientPool(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var concurrent int32 = 2
+	pool.SetPoolSettings(func(u *url.URL) *httpPoolSettings {
+		switch u.Path {
+		case "/backend1":
+			return &httpPoolSettings{
+				name:                  "backend1",
+				maxConcurrentRequests: int(atomic.LoadInt32(&concurrent)),
+			}
+		case "/backend2":
+			return &httpPoolSettings{
+				name: "backend2",
+			}
+		default:
+			return nil
+		}
+	})
+
+	u1, _ := url.Parse("http://localhost/backend1")
+	u2, _ := url.Parse("http://localhost/backend2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Backends on the same host use separate pools.
+	_, p1, err := pool.Get(ctx, u1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pool.Get(ctx, u1); err != nil {
+		t.Fatal(err)
+	}
+	_, p2, err := pool.Get(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	} else if p1 == p2 {
+		t.Error("backends should use separate pools")
+	}
+	checkStatsValue(t, statsHttpClientPoolSize.WithLabelValues("backend1"), 2)
+	checkStatsValue(t, statsHttpClientPoolActive.WithLabelValues("backend1"), 2)
+
+	if _, _, err := pool.Get(ctx, u2); err != context.DeadlineExceeded {
+		t.Errorf("fetching from empty pool should have timed out, got %v", err)
+	}
+
+	// Changed settings replace the pool.
+	atomic.StoreInt32(&concurrent, 3)
+	if _, p3, err := pool.Get(context.Background(), u1); err != nil {
+		t.Fatal(err)
+	} else if p3 == p1 {
+		t.Error("should have created a new pool for changed settings")
+	}
+	checkStatsValue(t, statsHttpClientPoolSize.WithLabelValues("backend1"), 3)
+
+	pool.RemovePool("backend2")
+	if _, p4, err := pool.Get(context.Background(), u2); err != nil {
+		t.Fatal(err)
+	} else if p4 == p2 {
+		t.Error("should have created a new pool for the removed backend")
+	}
+}
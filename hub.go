@@ -33,6 +33,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -40,8 +41,9 @@ import (
 
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -52,7 +54,9 @@ var (
 	InvalidClientType = NewError("invalid_client_type", "The client type is not supported.")
 	InvalidBackendUrl = NewError("invalid_backend", "The backend URL is not supported.")
 	InvalidToken      = NewError("invalid_token", "The passed token is invalid.")
+	InvalidClientCert = NewError("invalid_certificate", "The client certificate is not allowed.")
 	NoSuchSession     = NewError("no_such_session", "The session to resume does not exist.")
+	TooManyRequests   = NewError("too_many_requests", "Too many failed attempts, please try again later.")
 
 	// Maximum number of concurrent requests to a backend.
 	defaultMaxConcurrentRequestsPerHost = 8
@@ -63,9 +67,29 @@ var (
 	// MCU requests will be cancelled if they take too long.
 	defaultMcuTimeoutSeconds = 10
 
+	// Maximum number of participants that are returned in one page.
+	defaultParticipantsPageSize = 100
+
+	// Maximum number of room keys a session may send per minute.
+	defaultRoomKeyRateLimit = 60
+
+	// Default compression level for websocket messages (flate.BestSpeed).
+	defaultWebsocketCompressionLevel = 1
+
+	// Messages smaller than this are not compressed by default.
+	defaultWebsocketCompressionThreshold = 1024
+
+	// The GeoIP database will be checked for updates once a day.
+	defaultGeoipRefreshInterval = 24 * time.Hour
+
 	// New connections have to send a "Hello" request after 2 seconds.
 	initialHelloTimeout = 2 * time.Second
 
+	// Internal clients are pinged every 5 seconds by default and are
+	// considered dead if they don't respond within 10 seconds.
+	defaultInternalPingPeriod = 5 * time.Second
+	defaultInternalPongWait   = 10 * time.Second
+
 	// Anonymous clients have to join a room after 10 seconds.
 	anonmyousJoinRoomTimeout = 10 * time.Second
 
@@ -105,7 +129,7 @@ type Hub struct {
 
 	nats         NatsClient
 	upgrader     websocket.Upgrader
-	cookie       *securecookie.SecureCookie
+	sessionIds   atomic.Value
 	info         *HelloServerMessageServer
 	infoInternal *HelloServerMessageServer
 
@@ -125,6 +149,8 @@ type Hub struct {
 	clients  map[uint64]*Client
 	sessions map[uint64]Session
 	rooms    map[string]*Room
+	// Active breakout rooms, key is the internal id of the parent room.
+	breakoutRooms map[string]*BreakoutRooms
 
 	roomSessions    RoomSessions
 	virtualSessions map[string]uint64
@@ -133,9 +159,36 @@ type Hub struct {
 
 	mcu                   Mcu
 	mcuTimeout            time.Duration
+	rtpForwardHosts       map[string]bool
+	bitratePolicy         atomic.Value
+	subscriberPolicy      atomic.Value
+	config                atomic.Value
 	internalClientsSecret []byte
+	// Features of internal clients with client certificates, mapped by the
+	// common name of the certificate.
+	certificateClients atomic.Value
+
+	internalPingPeriod time.Duration
+	internalPongWait   time.Duration
 
 	allowSubscribeAnyStream bool
+	allowMultiRoom          bool
+	participantsPageSize    int
+	roomKeyRateLimit        int
+
+	reconcileInterval time.Duration
+	reconciling       int32
+	reconcileSuspects map[string]bool
+
+	sessionEventsSize   int
+	closedSessionEvents *LruCache
+
+	roomHistorySize   int
+	roomHistoryMaxAge time.Duration
+
+	activeSpeakerInterval time.Duration
+	// Number of recent speakers to subscribe when a session joins a call.
+	prewarmSubscribers int
 
 	expiredSessions    map[Session]bool
 	expectHelloClients map[*Client]time.Time
@@ -143,31 +196,46 @@ type Hub struct {
 
 	backendTimeout time.Duration
 	backend        *BackendClient
+	backendQueue   *BackendRequestQueue
+	roomPing       *RoomPing
+
+	roomPingIntervals *roomPingIntervals
+
+	etcdClient *EtcdClient
 
 	geoip          *GeoLookup
-	geoipOverrides map[*net.IPNet]string
+	geoipAsn       *GeoLookup
+	geoipOverrides *GeoIpOverrides
 	geoipUpdating  int32
+
+	geoipRefreshInterval time.Duration
+
+	trustedProxies *TrustedProxies
+
+	websocketCompressionLevel     int
+	websocketCompressionThreshold int
+
+	longPolls *longPollConnections
+
+	throttler Throttler
+
+	clusterStatsTimeout      time.Duration
+	clusterStatsRequests     chan *nats.Msg
+	clusterStatsSubscription NatsSubscription
+
+	capabilitiesInvalidate             chan *nats.Msg
+	capabilitiesInvalidateSubscription NatsSubscription
+
+	turn *TurnServers
+
+	recordings     *RecordingBackends
+	transcriptions *RecordingBackends
 }
 
 func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version string) (*Hub, error) {
-	hashKey, _ := config.GetString("sessions", "hashkey")
-	switch len(hashKey) {
-	case 32:
-	case 64:
-	default:
-		log.Printf("WARNING: The sessions hash key should be 32 or 64 bytes but is %d bytes", len(hashKey))
-	}
-
-	blockKey, _ := config.GetString("sessions", "blockkey")
-	blockBytes := []byte(blockKey)
-	switch len(blockKey) {
-	case 0:
-		blockBytes = nil
-	case 16:
-	case 24:
-	case 32:
-	default:
-		return nil, fmt.Errorf("the sessions block key must be 16, 24 or 32 bytes but is %d bytes", len(blockKey))
+	sessionIds, err := NewSessionIdCodec(config)
+	if err != nil {
+		return nil, err
 	}
 
 	internalClientsSecret, _ := config.GetString("clients", "internalsecret")
@@ -175,12 +243,36 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		log.Println("WARNING: No shared secret has been set for internal clients.")
 	}
 
+	certificateClients, err := getCertificateClients(config)
+	if err != nil {
+		return nil, err
+	}
+
+	internalPingPeriod := defaultInternalPingPeriod
+	if seconds, _ := config.GetInt("clients", "internalpinginterval"); seconds > 0 {
+		internalPingPeriod = time.Duration(seconds) * time.Second
+	}
+	internalPongWait := defaultInternalPongWait
+	if seconds, _ := config.GetInt("clients", "internalpongtimeout"); seconds > 0 {
+		internalPongWait = time.Duration(seconds) * time.Second
+	}
+	if internalPongWait <= internalPingPeriod {
+		log.Printf("WARNING: The pong timeout for internal clients (%s) should be larger than the ping interval (%s)", internalPongWait, internalPingPeriod)
+	}
+
 	maxConcurrentRequestsPerHost, _ := config.GetInt("backend", "connectionsperhost")
 	if maxConcurrentRequestsPerHost <= 0 {
 		maxConcurrentRequestsPerHost = defaultMaxConcurrentRequestsPerHost
 	}
 
-	backend, err := NewBackendClient(config, maxConcurrentRequestsPerHost, version)
+	var etcdClient *EtcdClient
+	if isEtcdConfigured(config, "etcd") {
+		if etcdClient, err = NewEtcdClient(config, "etcd"); err != nil {
+			return nil, err
+		}
+	}
+
+	backend, err := NewBackendClient(config, maxConcurrentRequestsPerHost, version, etcdClient)
 	if err != nil {
 		return nil, err
 	}
@@ -193,23 +285,148 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 	backendTimeout := time.Duration(backendTimeoutSeconds) * time.Second
 	log.Printf("Using a timeout of %s for backend connections", backendTimeout)
 
+	backendQueue, err := NewBackendRequestQueue(config, backend.PerformJSONRequest, backendTimeout)
+	if err != nil {
+		return nil, err
+	}
+	backendQueue.paused = backend.IsInMaintenance
+
 	mcuTimeoutSeconds, _ := config.GetInt("mcu", "timeout")
 	if mcuTimeoutSeconds <= 0 {
 		mcuTimeoutSeconds = defaultMcuTimeoutSeconds
 	}
 	mcuTimeout := time.Duration(mcuTimeoutSeconds) * time.Second
 
+	rtpForwardHosts := make(map[string]bool)
+	if hosts, _ := config.GetString("mcu", "rtpforwardhosts"); hosts != "" {
+		for _, host := range strings.Fields(hosts) {
+			rtpForwardHosts[strings.ToLower(host)] = true
+		}
+		log.Printf("Allow forwarding RTP streams to %s", hosts)
+	}
+
+	bitratePolicy, err := NewBitratePolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriberPolicy, err := NewSubscriberPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	turn, err := NewTurnServers(config)
+	if err != nil {
+		return nil, err
+	}
+
+	roomPingIntervals := newRoomPingIntervals(config)
+	log.Printf("Pinging active sessions of rooms every %s (%s for rooms without call)", roomPingIntervals.busy, roomPingIntervals.idle)
+
+	clusterStatsTimeout := defaultClusterStatsTimeout
+	if timeout, _ := config.GetInt("stats", "clustertimeout"); timeout > 0 {
+		clusterStatsTimeout = time.Duration(timeout) * time.Millisecond
+	}
+
 	allowSubscribeAnyStream, _ := config.GetBool("app", "allowsubscribeany")
 	if allowSubscribeAnyStream {
 		log.Printf("WARNING: Allow subscribing any streams, this is insecure and should only be enabled for testing")
 	}
 
+	allowMultiRoom, _ := config.GetBool("app", "multiroom")
+	if allowMultiRoom {
+		log.Printf("Allow sessions to join multiple rooms")
+	}
+
+	participantsPageSize, _ := config.GetInt("app", "participantspagesize")
+	if participantsPageSize <= 0 {
+		participantsPageSize = defaultParticipantsPageSize
+	}
+
+	roomKeyRateLimit, _ := config.GetInt("app", "roomkeyratelimit")
+	if roomKeyRateLimit <= 0 {
+		roomKeyRateLimit = defaultRoomKeyRateLimit
+	}
+
+	trustedProxiesValue, _ := config.GetString("app", "trustedproxies")
+	trustedProxies, err := ParseTrustedProxies(trustedProxiesValue)
+	if err != nil {
+		return nil, err
+	}
+
+	websocketCompression, _ := config.GetBool("app", "websocketcompression")
+	websocketCompressionLevel := defaultWebsocketCompressionLevel
+	if level, err := config.GetInt("app", "websocketcompressionlevel"); err == nil {
+		// Levels are the same as for "compress/flate".
+		if level < -2 || level > 9 {
+			return nil, fmt.Errorf("invalid websocket compression level %d", level)
+		}
+		websocketCompressionLevel = level
+	}
+	websocketCompressionThreshold := 0
+	if websocketCompression {
+		websocketCompressionThreshold = defaultWebsocketCompressionThreshold
+		if threshold, err := config.GetInt("app", "websocketcompressionthreshold"); err == nil && threshold > 0 {
+			websocketCompressionThreshold = threshold
+		}
+		log.Printf("Compressing websocket messages of at least %d bytes with level %d", websocketCompressionThreshold, websocketCompressionLevel)
+	}
+
+	var longPolls *longPollConnections
+	if longPolling, _ := config.GetBool("app", "longpolling"); longPolling {
+		log.Printf("Long-polling fallback transport is enabled")
+		longPolls = newLongPollConnections()
+	}
+
+	reconcileInterval := defaultReconcileInterval
+	if seconds, err := config.GetInt("app", "reconcileinterval"); err == nil {
+		if seconds > 0 {
+			reconcileInterval = time.Duration(seconds) * time.Second
+		} else {
+			log.Printf("Reconciliation of the hub state is disabled")
+			reconcileInterval = 0
+		}
+	}
+
+	sessionEventsSize := defaultSessionEventsSize
+	if size, err := config.GetInt("app", "sessionevents"); err == nil {
+		if size > 0 {
+			sessionEventsSize = size
+		} else {
+			log.Printf("Recording of session events is disabled")
+			sessionEventsSize = 0
+		}
+	}
+
+	roomHistorySize, _ := config.GetInt("app", "roomhistory")
+	roomHistoryMaxAge := defaultRoomHistoryMaxAge
+	if roomHistorySize > 0 {
+		if seconds, _ := config.GetInt("app", "roomhistoryage"); seconds > 0 {
+			roomHistoryMaxAge = time.Duration(seconds) * time.Second
+		}
+		log.Printf("Replaying up to %d messages of the last %s to sessions joining a room", roomHistorySize, roomHistoryMaxAge)
+	} else {
+		roomHistorySize = 0
+	}
+
+	activeSpeakerInterval := getActiveSpeakerInterval(config)
+	prewarmSubscribers := getPrewarmSubscribers(config)
+	if activeSpeakerInterval > 0 {
+		log.Printf("Sending active speaker events every %s", activeSpeakerInterval)
+		if prewarmSubscribers > 0 {
+			log.Printf("Subscribing up to %d recent speakers when joining a call", prewarmSubscribers)
+		}
+	} else if prewarmSubscribers > 0 {
+		log.Printf("Active speakers are disabled, not subscribing recent speakers when joining a call")
+		prewarmSubscribers = 0
+	}
+
 	decodeCaches := make([]*LruCache, 0, numDecodeCaches)
 	for i := 0; i < numDecodeCaches; i++ {
 		decodeCaches = append(decodeCaches, NewLruCache(decodeCacheSize))
 	}
 
-	roomSessions, err := NewBuiltinRoomSessions()
+	roomSessions, err := NewRoomSessions(config)
 	if err != nil {
 		return nil, err
 	}
@@ -218,14 +435,22 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 	if geoipUrl == "default" || geoipUrl == "none" {
 		geoipUrl = ""
 	}
-	if geoipUrl == "" {
-		if geoipLicense, _ := config.GetString("geoip", "license"); geoipLicense != "" {
-			geoipUrl = GetGeoIpDownloadUrl(geoipLicense)
-		}
+	geoipLicense, _ := config.GetString("geoip", "license")
+	if geoipUrl == "" && geoipLicense != "" {
+		geoipUrl = GetGeoIpDownloadUrl(geoipLicense)
+	}
+
+	geoipChecksumUrl, _ := config.GetString("geoip", "checksumurl")
+	if geoipChecksumUrl == "" && geoipUrl == GetGeoIpDownloadUrl(geoipLicense) {
+		geoipChecksumUrl = GetGeoIpChecksumUrl(geoipLicense)
+	}
+
+	geoipRefreshInterval := defaultGeoipRefreshInterval
+	if seconds, _ := config.GetInt("geoip", "refresh"); seconds > 0 {
+		geoipRefreshInterval = time.Duration(seconds) * time.Second
 	}
 
 	var geoip *GeoLookup
-	var geoipOverrides map[*net.IPNet]string
 	if geoipUrl != "" {
 		if strings.HasPrefix(geoipUrl, "file://") {
 			geoipUrl = geoipUrl[7:]
@@ -234,64 +459,61 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		} else {
 			log.Printf("Downloading GeoIP database from %s", geoipUrl)
 			geoip, err = NewGeoLookupFromUrl(geoipUrl)
+			if err == nil {
+				if geoipChecksumUrl != "" {
+					geoip.SetChecksumUrl(geoipChecksumUrl)
+				}
+				if cacheFile, _ := config.GetString("geoip", "cachefile"); cacheFile != "" {
+					if err := geoip.SetCacheFile(cacheFile); err != nil {
+						log.Printf("Could not load cached GeoIP database from %s: %s", cacheFile, err)
+					}
+				}
+			}
 		}
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		log.Printf("Not using GeoIP database")
+	}
 
-		if options, _ := config.GetOptions("geoip-overrides"); len(options) > 0 {
-			geoipOverrides = make(map[*net.IPNet]string)
-			for _, option := range options {
-				var ip net.IP
-				var ipNet *net.IPNet
-				if strings.Contains(option, "/") {
-					_, ipNet, err = net.ParseCIDR(option)
-					if err != nil {
-						return nil, fmt.Errorf("could not parse CIDR %s: %s", option, err)
-					}
-				} else {
-					ip = net.ParseIP(option)
-					if ip == nil {
-						return nil, fmt.Errorf("could not parse IP %s", option)
-					}
-
-					var mask net.IPMask
-					if ipv4 := ip.To4(); ipv4 != nil {
-						mask = net.CIDRMask(32, 32)
-					} else {
-						mask = net.CIDRMask(128, 128)
-					}
-					ipNet = &net.IPNet{
-						IP:   ip,
-						Mask: mask,
-					}
-				}
+	var geoipAsn *GeoLookup
+	geoipAsnUrl, _ := config.GetString("geoip", "asnurl")
+	if geoipAsnUrl == "default" {
+		geoipAsnUrl = GetGeoIpAsnDownloadUrl(geoipLicense)
+	}
+	if geoipAsnUrl != "" {
+		if strings.HasPrefix(geoipAsnUrl, "file://") {
+			geoipAsnUrl = geoipAsnUrl[7:]
+			log.Printf("Using GeoIP ASN database from %s", geoipAsnUrl)
+			geoipAsn, err = NewGeoLookupFromFile(geoipAsnUrl)
+		} else {
+			log.Printf("Downloading GeoIP ASN database from %s", geoipAsnUrl)
+			geoipAsn, err = NewGeoLookupFromUrl(geoipAsnUrl)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-				value, _ := config.GetString("geoip-overrides", option)
-				value = strings.ToUpper(strings.TrimSpace(value))
-				if value == "" {
-					log.Printf("IP %s doesn't have a country assigned, skipping", option)
-					continue
-				} else if !IsValidCountry(value) {
-					log.Printf("Country %s for IP %s is invalid, skipping", value, option)
-					continue
-				}
+	geoipOverrides, err := NewGeoIpOverrides(config, etcdClient)
+	if err != nil {
+		return nil, err
+	}
 
-				log.Printf("Using country %s for %s", value, ipNet)
-				geoipOverrides[ipNet] = value
-			}
-		}
-	} else {
-		log.Printf("Not using GeoIP database")
+	throttler, err := NewThrottler(config, nats)
+	if err != nil {
+		geoipOverrides.Close()
+		return nil, err
 	}
 
 	hub := &Hub{
 		nats: nats,
 		upgrader: websocket.Upgrader{
-			ReadBufferSize:  websocketReadBufferSize,
-			WriteBufferSize: websocketWriteBufferSize,
+			ReadBufferSize:    websocketReadBufferSize,
+			WriteBufferSize:   websocketWriteBufferSize,
+			EnableCompression: websocketCompression,
 		},
-		cookie: securecookie.New([]byte(hashKey), blockBytes).MaxAge(0),
 		info: &HelloServerMessageServer{
 			Version:  version,
 			Features: DefaultFeatures,
@@ -308,9 +530,10 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		roomInCall:       make(chan *BackendServerRoomRequest),
 		roomParticipants: make(chan *BackendServerRoomRequest),
 
-		clients:  make(map[uint64]*Client),
-		sessions: make(map[uint64]Session),
-		rooms:    make(map[string]*Room),
+		clients:       make(map[uint64]*Client),
+		sessions:      make(map[uint64]Session),
+		rooms:         make(map[string]*Room),
+		breakoutRooms: make(map[string]*BreakoutRooms),
 
 		roomSessions:    roomSessions,
 		virtualSessions: make(map[string]uint64),
@@ -318,26 +541,104 @@ func NewHub(config *goconf.ConfigFile, nats NatsClient, r *mux.Router, version s
 		decodeCaches: decodeCaches,
 
 		mcuTimeout:            mcuTimeout,
+		rtpForwardHosts:       rtpForwardHosts,
 		internalClientsSecret: []byte(internalClientsSecret),
 
+		internalPingPeriod: internalPingPeriod,
+		internalPongWait:   internalPongWait,
+
 		allowSubscribeAnyStream: allowSubscribeAnyStream,
+		allowMultiRoom:          allowMultiRoom,
+		participantsPageSize:    participantsPageSize,
+		roomKeyRateLimit:        roomKeyRateLimit,
+
+		reconcileInterval: reconcileInterval,
+
+		sessionEventsSize:   sessionEventsSize,
+		closedSessionEvents: NewLruCache(closedSessionEventsSize),
+
+		roomHistorySize:   roomHistorySize,
+		roomHistoryMaxAge: roomHistoryMaxAge,
+
+		activeSpeakerInterval: activeSpeakerInterval,
+		prewarmSubscribers:    prewarmSubscribers,
 
 		expiredSessions:    make(map[Session]bool),
 		anonymousClients:   make(map[*Client]time.Time),
 		expectHelloClients: make(map[*Client]time.Time),
 
 		backendTimeout: backendTimeout,
+		backendQueue:   backendQueue,
+		roomPing:       NewRoomPing(backend.PerformJSONRequest, backendTimeout, roomPingIntervals.busy),
 		backend:        backend,
 
+		roomPingIntervals: roomPingIntervals,
+
+		etcdClient: etcdClient,
+
 		geoip:          geoip,
+		geoipAsn:       geoipAsn,
 		geoipOverrides: geoipOverrides,
+
+		geoipRefreshInterval: geoipRefreshInterval,
+
+		trustedProxies: trustedProxies,
+
+		websocketCompressionLevel:     websocketCompressionLevel,
+		websocketCompressionThreshold: websocketCompressionThreshold,
+
+		longPolls: longPolls,
+
+		throttler: throttler,
+
+		turn: turn,
+
+		clusterStatsTimeout: clusterStatsTimeout,
 	}
+	hub.bitratePolicy.Store(bitratePolicy)
+	hub.subscriberPolicy.Store(subscriberPolicy)
+	hub.certificateClients.Store(certificateClients)
+	hub.sessionIds.Store(sessionIds)
+	hub.config.Store(config)
+	if allowMultiRoom {
+		addFeature(hub.info, ServerFeatureMultiRoom)
+		addFeature(hub.infoInternal, ServerFeatureMultiRoom)
+	}
+	if backend.checksumV2 {
+		addFeature(hub.info, ServerFeatureChecksumV2)
+	}
+	if turn.IsEnabled() {
+		addFeature(hub.info, ServerFeatureIceServers)
+	}
+	turn.SetOnChanged(func() {
+		hub.notifyIceServersChanged()
+	})
+	hub.recordings = NewRecordingBackends(hub.publishRecordingFailed)
+	hub.transcriptions = NewTranscriptionBackends(hub.publishTranscriptionFailed)
 	backend.hub = hub
 	hub.upgrader.CheckOrigin = hub.checkOrigin
 	r.HandleFunc("/spreed", func(w http.ResponseWriter, r *http.Request) {
 		hub.serveWs(w, r)
 	})
+	if roomHistorySize > 0 {
+		addFeature(hub.info, ServerFeatureRoomHistory)
+	}
+	if activeSpeakerInterval > 0 {
+		addFeature(hub.info, ServerFeatureActiveSpeaker)
+	}
+	if longPolls != nil {
+		addFeature(hub.info, ServerFeatureLongPolling)
+		hub.registerLongPolling(r)
+	}
+
+	if err := hub.subscribeClusterStats(); err != nil {
+		return nil, err
+	}
+	if err := hub.subscribeCapabilitiesInvalidate(); err != nil {
+		return nil, err
+	}
 
+	backend.backends.AddListener(hub)
 	return hub, nil
 }
 
@@ -366,23 +667,54 @@ func removeFeature(msg *HelloServerMessageServer, feature string) {
 	msg.Features = newFeatures
 }
 
+func hasFeature(msg *HelloServerMessageServer, feature string) bool {
+	for _, f := range msg.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Hub) SetMcu(mcu Mcu) {
 	h.mcu = mcu
 	if mcu == nil {
 		removeFeature(h.info, ServerFeatureMcu)
 		removeFeature(h.info, ServerFeatureSimulcast)
 		removeFeature(h.info, ServerFeatureUpdateSdp)
+		removeFeature(h.info, ServerFeatureSimulcastLayers)
+		removeFeature(h.info, ServerFeatureRenegotiate)
 		removeFeature(h.infoInternal, ServerFeatureMcu)
 		removeFeature(h.infoInternal, ServerFeatureSimulcast)
 		removeFeature(h.infoInternal, ServerFeatureUpdateSdp)
+		removeFeature(h.infoInternal, ServerFeatureSimulcastLayers)
+		removeFeature(h.infoInternal, ServerFeatureRenegotiate)
 	} else {
 		log.Printf("Using a timeout of %s for MCU requests", h.mcuTimeout)
 		addFeature(h.info, ServerFeatureMcu)
 		addFeature(h.info, ServerFeatureSimulcast)
 		addFeature(h.info, ServerFeatureUpdateSdp)
+		addFeature(h.info, ServerFeatureSimulcastLayers)
+		addFeature(h.info, ServerFeatureRenegotiate)
 		addFeature(h.infoInternal, ServerFeatureMcu)
 		addFeature(h.infoInternal, ServerFeatureSimulcast)
 		addFeature(h.infoInternal, ServerFeatureUpdateSdp)
+		addFeature(h.infoInternal, ServerFeatureSimulcastLayers)
+		addFeature(h.infoInternal, ServerFeatureRenegotiate)
+	}
+	if mcu != nil && len(h.rtpForwardHosts) > 0 {
+		addFeature(h.info, ServerFeatureRtpForward)
+		addFeature(h.infoInternal, ServerFeatureRtpForward)
+	} else {
+		removeFeature(h.info, ServerFeatureRtpForward)
+		removeFeature(h.infoInternal, ServerFeatureRtpForward)
+	}
+	if _, ok := mcu.(McuAudioBridge); ok {
+		addFeature(h.info, ServerFeatureAudioBridge)
+		addFeature(h.infoInternal, ServerFeatureAudioBridge)
+	} else {
+		removeFeature(h.info, ServerFeatureAudioBridge)
+		removeFeature(h.infoInternal, ServerFeatureAudioBridge)
 	}
 }
 
@@ -400,7 +732,7 @@ func (h *Hub) GetServerInfo(session Session) *HelloServerMessageServer {
 }
 
 func (h *Hub) updateGeoDatabase() {
-	if h.geoip == nil {
+	if h.geoip == nil && h.geoipAsn == nil {
 		return
 	}
 
@@ -410,14 +742,23 @@ func (h *Hub) updateGeoDatabase() {
 	}
 
 	defer atomic.CompareAndSwapInt32(&h.geoipUpdating, 1, 0)
+	if h.geoip != nil {
+		h.updateGeoLookup(h.geoip, "GeoIP")
+	}
+	if h.geoipAsn != nil {
+		h.updateGeoLookup(h.geoipAsn, "GeoIP ASN")
+	}
+}
+
+func (h *Hub) updateGeoLookup(lookup *GeoLookup, name string) {
 	delay := time.Second
 	for atomic.LoadInt32(&h.stopped) == 0 {
-		err := h.geoip.Update()
+		err := lookup.Update()
 		if err == nil {
 			break
 		}
 
-		log.Printf("Could not update GeoIP database, will retry later (%s)", err)
+		log.Printf("Could not update %s database, will retry later (%s)", name, err)
 		time.Sleep(delay)
 		delay = delay * 2
 		if delay > 5*time.Minute {
@@ -428,9 +769,17 @@ func (h *Hub) updateGeoDatabase() {
 
 func (h *Hub) Run() {
 	go h.updateGeoDatabase()
+	go h.backendQueue.Run()
+	go h.roomPing.Run()
 
 	housekeeping := time.NewTicker(housekeepingInterval)
-	geoipUpdater := time.NewTicker(24 * time.Hour)
+	geoipUpdater := time.NewTicker(h.geoipRefreshInterval)
+	var reconcile <-chan time.Time
+	if h.reconcileInterval > 0 {
+		reconcileTicker := time.NewTicker(h.reconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcile = reconcileTicker.C
+	}
 
 loop:
 	for {
@@ -449,13 +798,47 @@ loop:
 			h.performHousekeeping(now)
 		case <-geoipUpdater.C:
 			go h.updateGeoDatabase()
+		case <-reconcile:
+			go h.reconcile()
+		case msg := <-h.clusterStatsRequests:
+			go h.processClusterStatsRequest(msg)
+		case msg := <-h.capabilitiesInvalidate:
+			h.processCapabilitiesInvalidate(msg)
 		case <-h.stopChan:
 			break loop
 		}
 	}
+	h.backendQueue.Stop()
+	h.roomPing.Stop()
+	h.backend.Close()
+	h.roomSessions.Close()
 	if h.geoip != nil {
 		h.geoip.Close()
 	}
+	if h.geoipAsn != nil {
+		h.geoipAsn.Close()
+	}
+	h.geoipOverrides.Close()
+	if h.etcdClient != nil {
+		if err := h.etcdClient.Close(); err != nil {
+			log.Printf("Error closing etcd client: %s", err)
+		}
+	}
+	h.throttler.Close()
+	if err := h.clusterStatsSubscription.Unsubscribe(); err != nil {
+		log.Printf("Error unsubscribing cluster stats requests: %s", err)
+	}
+	if err := h.capabilitiesInvalidateSubscription.Unsubscribe(); err != nil {
+		log.Printf("Error unsubscribing capabilities invalidations: %s", err)
+	}
+	h.backend.backends.RemoveListener(h)
+}
+
+// EtcdClient returns the client for the etcd cluster configured in the "etcd"
+// section, or nil if none is configured. The client is closed when the hub
+// stops.
+func (h *Hub) EtcdClient() *EtcdClient {
+	return h.etcdClient
 }
 
 func (h *Hub) Stop() {
@@ -470,7 +853,68 @@ func (h *Hub) Reload(config *goconf.ConfigFile) {
 	if h.mcu != nil {
 		h.mcu.Reload(config)
 	}
+	if bitratePolicy, err := NewBitratePolicy(config); err != nil {
+		log.Printf("Could not reload bitrate policy, keeping previous: %s", err)
+	} else {
+		h.bitratePolicy.Store(bitratePolicy)
+		h.updatePublisherBitrates()
+	}
+	if subscriberPolicy, err := NewSubscriberPolicy(config); err != nil {
+		log.Printf("Could not reload subscriber policy, keeping previous: %s", err)
+	} else {
+		h.subscriberPolicy.Store(subscriberPolicy)
+	}
+	if certificateClients, err := getCertificateClients(config); err != nil {
+		log.Printf("Could not reload certificate clients, keeping previous: %s", err)
+	} else {
+		h.certificateClients.Store(certificateClients)
+	}
+	if sessionIds, err := NewSessionIdCodec(config); err != nil {
+		log.Printf("Could not reload session id codec, keeping previous: %s", err)
+	} else {
+		h.sessionIds.Store(sessionIds)
+	}
 	h.backend.Reload(config)
+	h.throttler.Reload(config)
+	if h.turn.Reload(config) {
+		go h.notifyIceServersChanged()
+	}
+	natsUrl, _ := config.GetString("nats", "url")
+	if natsUrl == "" {
+		natsUrl = nats.DefaultURL
+	}
+	h.nats.Reload(natsUrl)
+	h.geoipOverrides.Reload(config)
+	h.config.Store(config)
+}
+
+// getConfig returns the configuration that was last loaded.
+func (h *Hub) getConfig() *goconf.ConfigFile {
+	config, _ := h.config.Load().(*goconf.ConfigFile)
+	return config
+}
+
+func (h *Hub) getBitratePolicy() *BitratePolicy {
+	policy, _ := h.bitratePolicy.Load().(*BitratePolicy)
+	return policy
+}
+
+func (h *Hub) getSubscriberPolicy() *SubscriberPolicy {
+	policy, _ := h.subscriberPolicy.Load().(*SubscriberPolicy)
+	return policy
+}
+
+func (h *Hub) getSessionIdCodec() *SessionIdCodec {
+	return h.sessionIds.Load().(*SessionIdCodec)
+}
+
+func (h *Hub) updatePublisherBitrates() {
+	h.ru.RLock()
+	defer h.ru.RUnlock()
+
+	for _, room := range h.rooms {
+		go room.updatePublisherBitrates()
+	}
 }
 
 func reverseSessionId(s string) (string, error) {
@@ -487,7 +931,7 @@ func reverseSessionId(s string) (string, error) {
 }
 
 func (h *Hub) encodeSessionId(data *SessionIdData, sessionType string) (string, error) {
-	encoded, err := h.cookie.Encode(sessionType, data)
+	encoded, err := h.getSessionIdCodec().Encode(sessionType, data)
 	if err != nil {
 		return "", err
 	}
@@ -548,13 +992,13 @@ func (h *Hub) decodeSessionId(id string, sessionType string) *SessionIdData {
 		}
 	}
 
-	var data SessionIdData
-	if h.cookie.Decode(sessionType, id, &data) != nil {
+	data, err := h.getSessionIdCodec().Decode(sessionType, id)
+	if err != nil {
 		return nil
 	}
 
-	cache.Set(cache_key, &data)
-	return &data
+	cache.Set(cache_key, data)
+	return data
 }
 
 func (h *Hub) GetSessionByPublicId(sessionId string) Session {
@@ -569,6 +1013,76 @@ func (h *Hub) GetSessionByPublicId(sessionId string) Session {
 	return session
 }
 
+// GetSessions returns the sessions connected to this server that match the
+// given backend, room and user id. Empty values match all sessions.
+func (h *Hub) GetSessions(backendId string, roomId string, userId string) []Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]Session, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		if backendId != "" && session.Backend().Id() != backendId {
+			continue
+		}
+		if roomId != "" {
+			if room := session.GetRoom(); room == nil || room.Id() != roomId {
+				continue
+			}
+		}
+		if userId != "" && session.UserId() != userId {
+			continue
+		}
+
+		result = append(result, session)
+	}
+	return result
+}
+
+// KickSession closes the session with the given public id after sending a
+// "bye" with the reason to the client. Sessions connected to other servers
+// are closed through NATS, in this case "local" will be false.
+func (h *Hub) KickSession(sessionId string, reason string) (local bool, err error) {
+	session := h.GetSessionByPublicId(sessionId)
+	if session == nil {
+		// Session could be located on a different server.
+		msg := &NatsMessage{
+			SendTime: time.Now(),
+			Type:     "bye",
+			Message: &ServerMessage{
+				Type: "bye",
+				Bye: &ByeServerMessage{
+					Reason: reason,
+				},
+			},
+		}
+		return false, h.nats.PublishNats("session."+sessionId, msg)
+	}
+
+	log.Printf("Kicking session %s (%s)", session.PublicId(), reason)
+	if sess, ok := session.(*ClientSession); ok {
+		sess.events.Add(SessionEventKicked, "Kicked: %s", reason)
+		if client := sess.GetClient(); client != nil {
+			client.SendByeResponseWithReason(nil, reason)
+		}
+	}
+	session.Close()
+	return true, nil
+}
+
+// GetSessionEvents returns the events recorded for the session with the given
+// public id. Events of closed sessions are kept for some time.
+func (h *Hub) GetSessionEvents(sessionId string) (events *SessionEvents, active bool) {
+	if session, ok := h.GetSessionByPublicId(sessionId).(*ClientSession); ok && session.events != nil {
+		return session.events, true
+	}
+
+	if events, ok := h.closedSessionEvents.Get(sessionId).(*SessionEvents); ok {
+		return events, false
+	}
+
+	return nil, false
+}
+
 func (h *Hub) checkExpiredSessions(now time.Time) {
 	for s := range h.expiredSessions {
 		if s.IsExpired(now) {
@@ -621,27 +1135,81 @@ func (h *Hub) removeSession(session Session) (removed bool) {
 	h.invalidateSessionId(session.PublicId(), publicSessionName)
 
 	h.mu.Lock()
+	if virtualSession, ok := session.(*VirtualSession); ok {
+		delete(h.virtualSessions, GetVirtualSessionId(virtualSession.Session(), virtualSession.SessionId()))
+	}
 	if data := session.Data(); data != nil && data.Sid > 0 {
 		delete(h.clients, data.Sid)
 		if _, found := h.sessions[data.Sid]; found {
 			delete(h.sessions, data.Sid)
 			statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), session.ClientType()).Dec()
+			if clientSession, ok := session.(*ClientSession); ok {
+				if clientSession.country != "" {
+					statsHubSessionsCountriesCurrent.WithLabelValues(session.Backend().Id(), clientSession.country).Dec()
+				}
+				if clientSession.events != nil {
+					clientSession.events.Add(SessionEventClosed, "Session closed")
+					h.closedSessionEvents.Set(session.PublicId(), clientSession.events)
+				}
+			}
 			removed = true
 		}
 	}
 	delete(h.expiredSessions, session)
 	h.mu.Unlock()
+	if clientSession, ok := session.(*ClientSession); ok {
+		if clientSession.GetFeatureVersion(ClientFeatureInternalRecording) > 0 {
+			h.recordings.RemoveBackend(clientSession)
+		}
+		if clientSession.GetFeatureVersion(ClientFeatureInternalTranscription) > 0 {
+			h.transcriptions.RemoveBackend(clientSession)
+		}
+	}
 	return
 }
 
-func (h *Hub) startWaitAnonymousClientRoom(client *Client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	h.startWaitAnonymousClientRoomLocked(client)
+func (h *Hub) publishRecordingFailed(roomId string, backend *Backend, reason string) {
+	msg := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "recording-failed",
+			Recording: &RoomEventRecordingMessage{
+				RoomId: roomId,
+				Error:  reason,
+			},
+		},
+	}
+	if err := h.nats.PublishMessage(GetSubjectForRoomId(roomId, backend), msg); err != nil {
+		log.Printf("Could not publish failed recording in room %s: %s", roomId, err)
+	}
 }
 
-func (h *Hub) startWaitAnonymousClientRoomLocked(client *Client) {
+func (h *Hub) publishTranscriptionFailed(roomId string, backend *Backend, reason string) {
+	msg := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "transcription-failed",
+			Transcription: &RoomEventRecordingMessage{
+				RoomId: roomId,
+				Error:  reason,
+			},
+		},
+	}
+	if err := h.nats.PublishMessage(GetSubjectForRoomId(roomId, backend), msg); err != nil {
+		log.Printf("Could not publish failed transcription in room %s: %s", roomId, err)
+	}
+}
+
+func (h *Hub) startWaitAnonymousClientRoom(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.startWaitAnonymousClientRoomLocked(client)
+}
+
+func (h *Hub) startWaitAnonymousClientRoomLocked(client *Client) {
 	if !client.IsConnected() {
 		return
 	}
@@ -736,6 +1304,13 @@ func (h *Hub) processRegister(client *Client, message *ClientMessage, backend *B
 		return
 	}
 
+	if h.hasGeoLookup() {
+		// Remember the country the session was created from, so the per-country
+		// stats can be updated consistently even if the session is resumed.
+		session.country = client.Country()
+	}
+	session.events.Add(SessionEventHello, "Registered %s from %s in %s (%s)", session.ClientType(), client.RemoteAddr(), client.Country(), client.UserAgent())
+
 	if err := backend.AddSession(session); err != nil {
 		log.Printf("Error adding session %s to backend %s: %s", session.PublicId(), backend.Id(), err)
 		session.Close()
@@ -753,6 +1328,9 @@ func (h *Hub) processRegister(client *Client, message *ClientMessage, backend *B
 	}
 
 	session.SetClient(client)
+	if session.ClientType() == HelloClientTypeInternal {
+		client.SetHeartbeat(h.internalPingPeriod, h.internalPongWait)
+	}
 	h.sessions[sessionIdData.Sid] = session
 	h.clients[sessionIdData.Sid] = client
 	delete(h.expectHelloClients, client)
@@ -766,10 +1344,20 @@ func (h *Hub) processRegister(client *Client, message *ClientMessage, backend *B
 	}
 	statsHubSessionsCurrent.WithLabelValues(backend.Id(), session.ClientType()).Inc()
 	statsHubSessionsTotal.WithLabelValues(backend.Id(), session.ClientType()).Inc()
+	if session.country != "" {
+		statsHubSessionsCountriesCurrent.WithLabelValues(backend.Id(), session.country).Inc()
+		statsHubSessionsCountriesTotal.WithLabelValues(backend.Id(), session.country).Inc()
+	}
 
 	h.setDecodedSessionId(privateSessionId, privateSessionName, sessionIdData)
 	h.setDecodedSessionId(publicSessionId, publicSessionName, sessionIdData)
 	h.sendHelloResponse(session, message)
+	if session.ClientType() == HelloClientTypeInternal && session.GetFeatureVersion(ClientFeatureInternalRecording) > 0 {
+		h.recordings.AddBackend(session)
+	}
+	if session.ClientType() == HelloClientTypeInternal && session.GetFeatureVersion(ClientFeatureInternalTranscription) > 0 {
+		h.transcriptions.AddBackend(session)
+	}
 }
 
 func (h *Hub) processUnregister(client *Client) *ClientSession {
@@ -786,12 +1374,37 @@ func (h *Hub) processUnregister(client *Client) *ClientSession {
 	if session != nil {
 		log.Printf("Unregister %s (private=%s)", session.PublicId(), session.PrivateId())
 		session.ClearClient(client)
+		if session.ClientType() == HelloClientTypeInternal && client.IsDeadPeer() {
+			// The internal service (e.g. SIP bridge or recording server) most
+			// likely crashed, don't wait for the session to expire so its
+			// virtual sessions are removed from the rooms immediately.
+			log.Printf("Internal client %s did not respond to pings, closing session", session.PublicId())
+			session.Close()
+		}
 	}
 
 	client.Close()
 	return session
 }
 
+// throttleInvalidMessage delays clients that send invalid messages and
+// closes the connection if too many were received.
+func (h *Hub) throttleInvalidMessage(client *Client) {
+	ctx := context.Background()
+	throttle, err := h.throttler.CheckBruteforce(ctx, client.RemoteAddr(), ThrottleActionMessage)
+	if err == ErrBruteforceDetected {
+		log.Printf("Too many invalid messages from %s, closing connection", client.RemoteAddr())
+		client.SendError(TooManyRequests)
+		client.Close()
+		return
+	} else if err != nil {
+		log.Printf("Error checking for bruteforce: %s", err)
+		return
+	}
+
+	throttle(ctx)
+}
+
 func (h *Hub) processMessage(client *Client, data []byte) {
 	var message ClientMessage
 	if err := message.UnmarshalJSON(data); err != nil {
@@ -802,6 +1415,7 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 			log.Printf("Error decoding message from %s: %v", client.RemoteAddr(), err)
 			client.SendError(InvalidFormat)
 		}
+		h.throttleInvalidMessage(client)
 		return
 	}
 
@@ -813,11 +1427,15 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 			log.Printf("Invalid message %+v from %s: %v", message, client.RemoteAddr(), err)
 			client.SendMessage(message.NewErrorServerMessage(InvalidFormat))
 		}
+		h.throttleInvalidMessage(client)
 		return
 	}
 
 	statsMessagesTotal.WithLabelValues(message.Type).Inc()
 
+	ctx, span := startSpan(context.Background(), "hub.message", attribute.String("message.type", message.Type))
+	defer span.End()
+
 	session := client.GetSession()
 	if session == nil {
 		if message.Type != "hello" {
@@ -825,21 +1443,46 @@ func (h *Hub) processMessage(client *Client, data []byte) {
 			return
 		}
 
-		h.processHello(client, &message)
+		h.processHello(ctx, client, &message)
 		return
 	}
 
+	span.SetAttributes(attribute.String("session.id", session.PublicId()))
 	switch message.Type {
 	case "room":
-		h.processRoom(client, &message)
+		h.processRoom(ctx, client, &message)
 	case "message":
-		h.processMessageMsg(client, &message)
+		h.processMessageMsg(ctx, client, &message)
 	case "control":
 		h.processControlMsg(client, &message)
 	case "internal":
 		h.processInternalMsg(client, &message)
 	case "transient":
 		h.processTransientMsg(client, &message)
+	case "reaction":
+		h.processReactionMsg(client, &message)
+	case "breakout":
+		h.processBreakoutMsg(client, &message)
+	case "typing":
+		h.processTypingMsg(client, &message)
+	case "participants":
+		h.processParticipantsMsg(client, &message)
+	case "rtpforward":
+		h.processRtpForwardMsg(client, &message)
+	case "recording":
+		h.processRecordingMsg(client, &message)
+	case "transcription":
+		h.processTranscriptionMsg(client, &message)
+	case "room-key":
+		h.processRoomKeyMsg(client, &message)
+	case "moderation":
+		h.processModerationMsg(client, &message)
+	case "session":
+		h.processSessionMsg(client, &message)
+	case "report":
+		h.processReportMsg(client, &message)
+	case "call":
+		h.processCallMsg(client, &message)
 	case "bye":
 		h.processByeMsg(client, &message)
 	case "hello":
@@ -861,15 +1504,81 @@ func (h *Hub) sendHelloResponse(session *ClientSession, message *ClientMessage)
 			Server:    h.GetServerInfo(session),
 		},
 	}
+	if session.ClientType() == HelloClientTypeInternal && (len(session.featureVersions) > 0 || len(session.unsupportedFeatures) > 0) {
+		response.Hello.Internal = &HelloServerMessageInternal{
+			Versions:    session.featureVersions,
+			Unsupported: session.unsupportedFeatures,
+		}
+	}
+	if session.HasFeature(ClientFeatureIceServers) && h.turn.IsEnabled() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+		defer cancel()
+		if credentials, err := h.turn.GetCredentials(ctx, "", session.country); err != nil {
+			log.Printf("Could not get ICE servers for session %s: %s", session.PublicId(), err)
+		} else {
+			response.Hello.IceServers = credentials
+		}
+	}
 	return session.SendMessage(response)
 }
 
-func (h *Hub) processHello(client *Client, message *ClientMessage) {
+// notifyIceServersChanged sends updated ICE servers to all sessions that
+// support receiving them.
+func (h *Hub) notifyIceServersChanged() {
+	if !h.turn.IsEnabled() {
+		return
+	}
+
+	var sessions []*ClientSession
+	h.mu.RLock()
+	for _, session := range h.sessions {
+		if s, ok := session.(*ClientSession); ok && s.HasFeature(ClientFeatureIceServers) {
+			sessions = append(sessions, s)
+		}
+	}
+	h.mu.RUnlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	log.Printf("Sending updated ICE servers to %d sessions", len(sessions))
+	ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+	defer cancel()
+	for _, session := range sessions {
+		credentials, err := h.turn.GetCredentials(ctx, "", session.country)
+		if err != nil {
+			log.Printf("Could not get ICE servers for session %s: %s", session.PublicId(), err)
+			continue
+		}
+
+		session.SendMessage(&ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target:     "iceservers",
+				Type:       "update",
+				IceServers: credentials,
+			},
+		})
+	}
+}
+
+func (h *Hub) processHello(ctx context.Context, client *Client, message *ClientMessage) {
 	resumeId := message.Hello.ResumeId
 	if resumeId != "" {
+		throttle, err := h.throttler.CheckBruteforce(ctx, client.RemoteAddr(), ThrottleActionResume)
+		if err == ErrBruteforceDetected {
+			client.SendMessage(message.NewErrorServerMessage(TooManyRequests))
+			return
+		} else if err != nil {
+			log.Printf("Error checking for bruteforce: %s", err)
+			client.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
 		data := h.decodeSessionId(resumeId, privateSessionName)
 		if data == nil {
 			statsHubSessionResumeFailed.Inc()
+			throttle(ctx)
 			client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
 			return
 		}
@@ -879,6 +1588,7 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 		if !found || resumeId != session.PrivateId() {
 			h.mu.Unlock()
 			statsHubSessionResumeFailed.Inc()
+			throttle(ctx)
 			client.SendMessage(message.NewErrorServerMessage(NoSuchSession))
 			return
 		}
@@ -904,6 +1614,9 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 			prev.SendByeResponseWithReason(nil, "session_resumed")
 		}
 
+		if clientSession.ClientType() == HelloClientTypeInternal {
+			client.SetHeartbeat(h.internalPingPeriod, h.internalPongWait)
+		}
 		clientSession.StopExpire()
 		h.clients[data.Sid] = client
 		delete(h.expectHelloClients, client)
@@ -912,6 +1625,7 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 		log.Printf("Resume session from %s in %s (%s) %s (private=%s)", client.RemoteAddr(), client.Country(), client.UserAgent(), session.PublicId(), session.PrivateId())
 
 		statsHubSessionsResumedTotal.WithLabelValues(clientSession.Backend().Id(), clientSession.ClientType()).Inc()
+		clientSession.events.Add(SessionEventResume, "Resumed from %s in %s (%s)", client.RemoteAddr(), client.Country(), client.UserAgent())
 		h.sendHelloResponse(clientSession, message)
 		clientSession.NotifySessionResumed(client)
 		return
@@ -924,16 +1638,16 @@ func (h *Hub) processHello(client *Client, message *ClientMessage) {
 
 	switch message.Hello.Auth.Type {
 	case HelloClientTypeClient:
-		h.processHelloClient(client, message)
+		h.processHelloClient(ctx, client, message)
 	case HelloClientTypeInternal:
-		h.processHelloInternal(client, message)
+		h.processHelloInternal(ctx, client, message)
 	default:
 		h.startExpectHello(client)
 		client.SendMessage(message.NewErrorServerMessage(InvalidClientType))
 	}
 }
 
-func (h *Hub) processHelloClient(client *Client, message *ClientMessage) {
+func (h *Hub) processHelloClient(ctx context.Context, client *Client, message *ClientMessage) {
 	// Make sure the client must send another "hello" in case of errors.
 	defer h.startExpectHello(client)
 
@@ -942,45 +1656,103 @@ func (h *Hub) processHelloClient(client *Client, message *ClientMessage) {
 	if backend == nil {
 		client.SendMessage(message.NewErrorServerMessage(InvalidBackendUrl))
 		return
+	} else if h.backend.backends.IsInMaintenance(backend) {
+		client.SendMessage(message.NewErrorServerMessage(newBackendMaintenanceError()))
+		return
+	}
+
+	throttle, err := h.throttler.CheckBruteforce(ctx, client.RemoteAddr(), ThrottleActionHello)
+	if err == ErrBruteforceDetected {
+		client.SendMessage(message.NewErrorServerMessage(TooManyRequests))
+		return
+	} else if err != nil {
+		log.Printf("Error checking for bruteforce: %s", err)
+		client.SendMessage(message.NewWrappedErrorServerMessage(err))
+		return
 	}
 
 	// Run in timeout context to prevent blocking too long.
-	ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+	requestCtx, cancel := context.WithTimeout(ctx, h.backendTimeout)
 	defer cancel()
 
 	request := NewBackendClientAuthRequest(message.Hello.Auth.Params)
 	var auth BackendClientResponse
-	if err := h.backend.PerformJSONRequest(ctx, url, request, &auth); err != nil {
+	if err := h.backend.PerformJSONRequest(requestCtx, url, request, &auth); err != nil {
 		client.SendMessage(message.NewWrappedErrorServerMessage(err))
 		return
 	}
 
+	if auth.Type != "auth" {
+		// The backend rejected the credentials.
+		throttle(ctx)
+	}
+
 	// TODO(jojo): Validate response
 
 	h.processRegister(client, message, backend, &auth)
 }
 
-func (h *Hub) processHelloInternal(client *Client, message *ClientMessage) {
+// getCertificateFeatures returns the internal client features a client with
+// a certificate for the given subject may announce.
+func (h *Hub) getCertificateFeatures(subject string) ([]string, bool) {
+	clients, _ := h.certificateClients.Load().(map[string][]string)
+	features, found := clients[strings.ToLower(subject)]
+	return features, found
+}
+
+func (h *Hub) processHelloInternal(ctx context.Context, client *Client, message *ClientMessage) {
 	defer h.startExpectHello(client)
+	if subject := client.CertificateSubject(); subject != "" {
+		// The client certificate has already been validated by the listener.
+		allowed, found := h.getCertificateFeatures(subject)
+		if !found {
+			log.Printf("Certificate %s of %s is not allowed for internal clients", subject, client.RemoteAddr())
+			client.SendMessage(message.NewErrorServerMessage(InvalidClientCert))
+			return
+		}
+
+		message.Hello.Features = filterCertificateFeatures(subject, message.Hello.Features, allowed)
+		h.processHelloInternalBackend(client, message)
+		return
+	}
+
 	if len(h.internalClientsSecret) == 0 {
 		client.SendMessage(message.NewErrorServerMessage(InvalidClientType))
 		return
 	}
 
+	throttle, err := h.throttler.CheckBruteforce(ctx, client.RemoteAddr(), ThrottleActionHello)
+	if err == ErrBruteforceDetected {
+		client.SendMessage(message.NewErrorServerMessage(TooManyRequests))
+		return
+	} else if err != nil {
+		log.Printf("Error checking for bruteforce: %s", err)
+		client.SendMessage(message.NewWrappedErrorServerMessage(err))
+		return
+	}
+
 	// Validate internal connection.
 	rnd := message.Hello.Auth.internalParams.Random
 	mac := hmac.New(sha256.New, h.internalClientsSecret)
 	mac.Write([]byte(rnd)) // nolint
 	check := hex.EncodeToString(mac.Sum(nil))
 	if len(rnd) < minTokenRandomLength || check != message.Hello.Auth.internalParams.Token {
+		throttle(ctx)
 		client.SendMessage(message.NewErrorServerMessage(InvalidToken))
 		return
 	}
 
+	h.processHelloInternalBackend(client, message)
+}
+
+func (h *Hub) processHelloInternalBackend(client *Client, message *ClientMessage) {
 	backend := h.backend.GetBackend(message.Hello.Auth.internalParams.parsedBackend)
 	if backend == nil {
 		client.SendMessage(message.NewErrorServerMessage(InvalidBackendUrl))
 		return
+	} else if h.backend.backends.IsInMaintenance(backend) {
+		client.SendMessage(message.NewErrorServerMessage(newBackendMaintenanceError()))
+		return
 	}
 
 	auth := &BackendClientResponse{
@@ -1038,14 +1810,20 @@ func (h *Hub) sendRoom(session *ClientSession, message *ClientMessage, room *Roo
 		}
 	} else {
 		response.Room = &RoomServerMessage{
-			RoomId:     room.id,
-			Properties: room.properties,
+			RoomId:      room.id,
+			Properties:  room.properties,
+			AudioBridge: room.UsesAudioBridge(),
 		}
 	}
 	return session.SendMessage(response)
 }
 
-func (h *Hub) processRoom(client *Client, message *ClientMessage) {
+func (h *Hub) processRoom(ctx context.Context, client *Client, message *ClientMessage) {
+	if message.Room.Additional {
+		h.processAdditionalRoom(ctx, client, message)
+		return
+	}
+
 	session := client.GetSession()
 	roomId := message.Room.RoomId
 	if roomId == "" {
@@ -1068,6 +1846,10 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 		if room := h.getRoomForBackend(roomId, session.Backend()); room != nil && room.HasSession(session) {
 			// Session already is in that room, no action needed.
 			return
+		} else if session.IsInAdditionalRoom(roomId) {
+			response := message.NewErrorServerMessage(NewError("already_joined", "The room has already been joined as additional room."))
+			session.SendMessage(response)
+			return
 		}
 	}
 
@@ -1081,8 +1863,18 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 			},
 		}
 	} else {
+		throttle, err := h.throttler.CheckBruteforce(ctx, client.RemoteAddr(), ThrottleActionJoin)
+		if err == ErrBruteforceDetected {
+			session.SendMessage(message.NewErrorServerMessage(TooManyRequests))
+			return
+		} else if err != nil {
+			log.Printf("Error checking for bruteforce: %s", err)
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
 		// Run in timeout context to prevent blocking too long.
-		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+		requestCtx, cancel := context.WithTimeout(ctx, h.backendTimeout)
 		defer cancel()
 
 		sessionId := message.Room.SessionId
@@ -1092,11 +1884,16 @@ func (h *Hub) processRoom(client *Client, message *ClientMessage) {
 			sessionId = session.PublicId()
 		}
 		request := NewBackendClientRoomRequest(roomId, session.UserId(), sessionId)
-		if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &room); err != nil {
+		if err := h.backend.PerformJSONRequest(requestCtx, session.ParsedBackendUrl(), request, &room); err != nil {
 			session.SendMessage(message.NewWrappedErrorServerMessage(err))
 			return
 		}
 
+		if room.Type != "room" {
+			// The backend rejected the join request.
+			throttle(ctx)
+		}
+
 		// TODO(jojo): Validate response
 
 		if message.Room.SessionId != "" {
@@ -1192,30 +1989,38 @@ func (h *Hub) processJoinRoom(session *ClientSession, message *ClientMessage, ro
 func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionData *json.RawMessage) {
 	// Register session with the room
 	if sessions := room.AddSession(session, sessionData); len(sessions) > 0 {
-		events := make([]*EventServerMessageSessionEntry, 0, len(sessions))
-		for _, s := range sessions {
-			entry := &EventServerMessageSessionEntry{
-				SessionId: s.PublicId(),
-				UserId:    s.UserId(),
-				User:      s.UserData(),
+		var msg *ServerMessage
+		if session.HasFeature(ClientFeatureParticipantsPages) {
+			// Large rooms would result in huge "join" events, the client
+			// requests the list of participants in pages instead.
+			msg = &ServerMessage{
+				Type:         "participants",
+				Participants: newParticipantsSummary(room),
 			}
-			if s, ok := s.(*ClientSession); ok {
-				entry.RoomSessionId = s.RoomSessionId()
+		} else {
+			events := make([]*EventServerMessageSessionEntry, 0, len(sessions))
+			for _, s := range sessions {
+				events = append(events, newEventServerMessageSessionEntry(s))
+			}
+			msg = &ServerMessage{
+				Type: "event",
+				Event: &EventServerMessage{
+					Target: "room",
+					Type:   "join",
+					Join:   events,
+				},
 			}
-			events = append(events, entry)
-		}
-		msg := &ServerMessage{
-			Type: "event",
-			Event: &EventServerMessage{
-				Target: "room",
-				Type:   "join",
-				Join:   events,
-			},
 		}
 
 		// No need to send through NATS, the session is connected locally.
 		session.SendMessage(msg)
 
+		if session.HasFeature(ClientFeatureRoomHistory) {
+			for _, msg := range room.GetHistory(session.PublicId()) {
+				session.SendMessage(msg)
+			}
+		}
+
 		// Notify about initial flags of virtual sessions.
 		for _, s := range sessions {
 			vsess, ok := s.(*VirtualSession)
@@ -1247,7 +2052,7 @@ func (h *Hub) notifyUserJoinedRoom(room *Room, session *ClientSession, sessionDa
 	}
 }
 
-func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
+func (h *Hub) processMessageMsg(ctx context.Context, client *Client, message *ClientMessage) {
 	msg := message.Message
 	session := client.GetSession()
 	if session == nil {
@@ -1277,7 +2082,7 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 					case "requestoffer":
 						// Process asynchronously to avoid blocking regular
 						// message processing for this client.
-						go h.processMcuMessage(session, session, message, msg, &data)
+						go h.processMcuMessage(ctx, session, session, message, msg, &data)
 						return
 					case "offer":
 						fallthrough
@@ -1287,8 +2092,10 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 						fallthrough
 					case "selectStream":
 						fallthrough
+					case "configure":
+						fallthrough
 					case "candidate":
-						h.processMcuMessage(session, session, message, msg, &data)
+						h.processMcuMessage(ctx, session, session, message, msg, &data)
 						return
 					}
 				}
@@ -1352,6 +2159,12 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 		return
 	}
 
+	if clientData != nil && (clientData.Type == "mute" || clientData.Type == "unmute") {
+		if mediaType := getMuteMediaType(clientData.Payload); mediaType != 0 {
+			session.SetMediaMuted(mediaType, clientData.Type == "mute")
+		}
+	}
+
 	if clientData != nil && clientData.Type == "unshareScreen" {
 		// User is stopping to share his screen. Firefox doesn't properly clean
 		// up the peer connections in all cases, so make sure to stop publishing
@@ -1400,7 +2213,7 @@ func (h *Hub) processMessageMsg(client *Client, message *ClientMessage) {
 			// It may take some time for the publisher (which is the current
 			// client) to start his stream, so we must not block the active
 			// goroutine.
-			go h.processMcuMessage(session, recipient, message, msg, clientData)
+			go h.processMcuMessage(ctx, session, recipient, message, msg, clientData)
 			return
 		}
 		recipient.SendMessage(response)
@@ -1537,65 +2350,41 @@ func (h *Hub) processInternalMsg(client *Client, message *ClientMessage) {
 			return
 		}
 
-		sessionIdData := h.newSessionIdData(session.Backend())
-		privateSessionId, err := h.encodeSessionId(sessionIdData, privateSessionName)
-		if err != nil {
-			log.Printf("Could not encode private virtual session id: %s", err)
+		sess := h.addVirtualSession(session, message, room, msg)
+		if sess == nil {
 			return
 		}
-		publicSessionId, err := h.encodeSessionId(sessionIdData, publicSessionName)
-		if err != nil {
-			log.Printf("Could not encode public virtual session id: %s", err)
+
+		sess.SetRoom(room)
+		room.AddSession(sess, nil)
+	case "addsessions":
+		msg := msg.AddSessions
+		room := h.getRoomForBackend(msg.RoomId, session.Backend())
+		if room == nil {
+			log.Printf("Ignore add sessions message for invalid room %s from %s", msg.RoomId, session.PublicId())
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
-		defer cancel()
-
-		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
-
-		if msg.Options != nil {
-			request := NewBackendClientRoomRequest(room.Id(), msg.UserId, publicSessionId)
-			request.Room.ActorId = msg.Options.ActorId
-			request.Room.ActorType = msg.Options.ActorType
-			request.Room.InCall = FlagInCall | FlagWithPhone
-
-			var response BackendClientResponse
-			if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
-				log.Printf("Could not join virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
-				reply := message.NewErrorServerMessage(NewError("add_failed", "Could not join virtual session."))
-				session.SendMessage(reply)
-				return
-			}
-
-			if response.Type == "error" {
-				log.Printf("Could not join virtual session %s at backend %s: %+v", virtualSessionId, session.BackendUrl(), response.Error)
-				reply := message.NewErrorServerMessage(NewError("add_failed", response.Error.Error()))
-				session.SendMessage(reply)
-				return
-			}
-		} else {
-			request := NewBackendClientSessionRequest(room.Id(), "add", publicSessionId, msg)
-			var response BackendClientSessionResponse
-			if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
-				log.Printf("Could not add virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
-				reply := message.NewErrorServerMessage(NewError("add_failed", "Could not add virtual session."))
-				session.SendMessage(reply)
-				return
-			}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		sessions := make([]*VirtualSession, 0, len(msg.Sessions))
+		for _, m := range msg.Sessions {
+			wg.Add(1)
+			go func(m *AddSessionInternalClientMessage) {
+				defer wg.Done()
+				if sess := h.addVirtualSession(session, message, room, m); sess != nil {
+					mu.Lock()
+					sessions = append(sessions, sess)
+					mu.Unlock()
+				}
+			}(m)
 		}
+		wg.Wait()
 
-		sess := NewVirtualSession(session, privateSessionId, publicSessionId, sessionIdData, msg)
-		h.mu.Lock()
-		h.sessions[sessionIdData.Sid] = sess
-		h.virtualSessions[virtualSessionId] = sessionIdData.Sid
-		h.mu.Unlock()
-		statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
-		statsHubSessionsTotal.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
-		log.Printf("Session %s added virtual session %s with initial flags %d", session.PublicId(), sess.PublicId(), sess.Flags())
-		session.AddVirtualSession(sess)
-		sess.SetRoom(room)
-		room.AddSession(sess, nil)
+		for _, sess := range sessions {
+			sess.SetRoom(room)
+		}
+		room.AddVirtualSessions(sessions)
 	case "updatesession":
 		msg := msg.UpdateSession
 		room := h.getRoomForBackend(msg.RoomId, session.Backend())
@@ -1637,32 +2426,198 @@ func (h *Hub) processInternalMsg(client *Client, message *ClientMessage) {
 			return
 		}
 
-		virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
-		h.mu.Lock()
-		sid, found := h.virtualSessions[virtualSessionId]
-		if !found {
-			h.mu.Unlock()
+		if sess := h.getVirtualSessionForRemove(session, msg.SessionId); sess != nil {
+			log.Printf("Session %s removed virtual session %s", session.PublicId(), sess.PublicId())
+			if vsess, ok := sess.(*VirtualSession); ok {
+				// We should always have a VirtualSession here.
+				vsess.CloseWithFeedback(session, message)
+			} else {
+				sess.Close()
+			}
+		}
+	case "removesessions":
+		msg := msg.RemoveSessions
+		room := h.getRoomForBackend(msg.RoomId, session.Backend())
+		if room == nil {
+			log.Printf("Ignore remove sessions message for invalid room %s from %s", msg.RoomId, session.PublicId())
 			return
 		}
 
-		delete(h.virtualSessions, virtualSessionId)
-		sess := h.sessions[sid]
-		h.mu.Unlock()
-		if sess != nil {
-			log.Printf("Session %s removed virtual session %s", session.PublicId(), sess.PublicId())
+		sessions := make([]*VirtualSession, 0, len(msg.Sessions))
+		for _, m := range msg.Sessions {
+			sess := h.getVirtualSessionForRemove(session, m.SessionId)
+			if sess == nil {
+				continue
+			}
+
 			if vsess, ok := sess.(*VirtualSession); ok {
 				// We should always have a VirtualSession here.
-				vsess.CloseWithFeedback(session, message)
+				sessions = append(sessions, vsess)
 			} else {
 				sess.Close()
 			}
 		}
+		log.Printf("Session %s removed %d virtual sessions", session.PublicId(), len(sessions))
+
+		// Remove from the room first so only one event is sent to the other
+		// sessions, closing will then notify the backend.
+		room.RemoveVirtualSessions(sessions)
+		for _, vsess := range sessions {
+			vsess.CloseWithFeedback(session, message)
+		}
+	case "eventfilter":
+		filter := NewEventFilter(msg.EventFilter)
+		if filter == nil {
+			log.Printf("Session %s removed event filter", session.PublicId())
+		} else {
+			log.Printf("Session %s set event filter %+v", session.PublicId(), *msg.EventFilter)
+		}
+		session.SetEventFilter(filter)
+	case "recording":
+		if session.GetFeatureVersion(ClientFeatureInternalRecording) == 0 {
+			log.Printf("Ignore recording message %+v from %s without recording feature", *msg.Recording, session.PublicId())
+			return
+		}
+
+		msg := msg.Recording
+		switch msg.Type {
+		case "status":
+			log.Printf("Recording backend %s supports %d concurrent recordings", session.PublicId(), msg.Capacity)
+			h.recordings.SetCapacity(session, msg.Capacity)
+		case "started":
+			log.Printf("Recording backend %s started recording room %s", session.PublicId(), msg.RoomId)
+		case "stopped":
+			log.Printf("Recording backend %s stopped recording room %s", session.PublicId(), msg.RoomId)
+			h.recordings.Stopped(session, msg.RoomId)
+		case "failed":
+			h.recordings.Failed(session, msg.RoomId, msg.Error)
+		}
+	case "transcription":
+		if session.GetFeatureVersion(ClientFeatureInternalTranscription) == 0 {
+			log.Printf("Ignore transcription message %+v from %s without transcription feature", *msg.Transcription, session.PublicId())
+			return
+		}
+
+		msg := msg.Transcription
+		switch msg.Type {
+		case "status":
+			log.Printf("Transcription backend %s supports %d concurrent transcriptions", session.PublicId(), msg.Capacity)
+			h.transcriptions.SetCapacity(session, msg.Capacity)
+		case "started":
+			log.Printf("Transcription backend %s started transcribing room %s", session.PublicId(), msg.RoomId)
+		case "stopped":
+			log.Printf("Transcription backend %s stopped transcribing room %s", session.PublicId(), msg.RoomId)
+			h.transcriptions.Stopped(session, msg.RoomId)
+		case "failed":
+			h.transcriptions.Failed(session, msg.RoomId, msg.Error)
+		case "caption":
+			h.publishCaption(session, msg)
+		}
 	default:
 		log.Printf("Ignore unsupported internal message %+v from %s", msg, session.PublicId())
 		return
 	}
 }
 
+func (h *Hub) publishCaption(session *ClientSession, msg *TranscriptionInternalClientMessage) {
+	if h.transcriptions.GetRecordingBackend(msg.RoomId, session.Backend()) != session.PublicId() {
+		log.Printf("Ignore caption from %s which is not transcribing room %s", session.PublicId(), msg.RoomId)
+		return
+	}
+
+	caption := &ServerMessage{
+		Type: "caption",
+		Caption: &CaptionServerMessage{
+			RoomId:    msg.RoomId,
+			SessionId: msg.SessionId,
+			Text:      msg.Text,
+			Final:     msg.Final,
+			Language:  msg.Language,
+		},
+	}
+	if err := h.nats.PublishMessage(GetSubjectForRoomId(msg.RoomId, session.Backend()), caption); err != nil {
+		log.Printf("Could not publish caption in room %s: %s", msg.RoomId, err)
+	}
+}
+
+// addVirtualSession notifies the backend about a new virtual session and
+// registers it in the hub. The caller must add the session to the room.
+func (h *Hub) addVirtualSession(session *ClientSession, message *ClientMessage, room *Room, msg *AddSessionInternalClientMessage) *VirtualSession {
+	sessionIdData := h.newSessionIdData(session.Backend())
+	privateSessionId, err := h.encodeSessionId(sessionIdData, privateSessionName)
+	if err != nil {
+		log.Printf("Could not encode private virtual session id: %s", err)
+		return nil
+	}
+	publicSessionId, err := h.encodeSessionId(sessionIdData, publicSessionName)
+	if err != nil {
+		log.Printf("Could not encode public virtual session id: %s", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.backendTimeout)
+	defer cancel()
+
+	virtualSessionId := GetVirtualSessionId(session, msg.SessionId)
+
+	if msg.Options != nil {
+		request := NewBackendClientRoomRequest(room.Id(), msg.UserId, publicSessionId)
+		request.Room.ActorId = msg.Options.ActorId
+		request.Room.ActorType = msg.Options.ActorType
+		request.Room.InCall = FlagInCall | FlagWithPhone
+
+		var response BackendClientResponse
+		if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
+			log.Printf("Could not join virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
+			reply := message.NewErrorServerMessage(NewError("add_failed", "Could not join virtual session."))
+			session.SendMessage(reply)
+			return nil
+		}
+
+		if response.Type == "error" {
+			log.Printf("Could not join virtual session %s at backend %s: %+v", virtualSessionId, session.BackendUrl(), response.Error)
+			reply := message.NewErrorServerMessage(NewError("add_failed", response.Error.Error()))
+			session.SendMessage(reply)
+			return nil
+		}
+	} else {
+		request := NewBackendClientSessionRequest(room.Id(), "add", publicSessionId, msg)
+		var response BackendClientSessionResponse
+		if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
+			log.Printf("Could not add virtual session %s at backend %s: %s", virtualSessionId, session.BackendUrl(), err)
+			reply := message.NewErrorServerMessage(NewError("add_failed", "Could not add virtual session."))
+			session.SendMessage(reply)
+			return nil
+		}
+	}
+
+	sess := NewVirtualSession(session, privateSessionId, publicSessionId, sessionIdData, msg)
+	h.mu.Lock()
+	h.sessions[sessionIdData.Sid] = sess
+	h.virtualSessions[virtualSessionId] = sessionIdData.Sid
+	h.mu.Unlock()
+	statsHubSessionsCurrent.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
+	statsHubSessionsTotal.WithLabelValues(session.Backend().Id(), sess.ClientType()).Inc()
+	log.Printf("Session %s added virtual session %s with initial flags %d", session.PublicId(), sess.PublicId(), sess.Flags())
+	session.AddVirtualSession(sess)
+	return sess
+}
+
+// getVirtualSessionForRemove unregisters the virtual session with the given
+// internal id and returns it so it can be closed by the caller.
+func (h *Hub) getVirtualSessionForRemove(session *ClientSession, sessionId string) Session {
+	virtualSessionId := GetVirtualSessionId(session, sessionId)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sid, found := h.virtualSessions[virtualSessionId]
+	if !found {
+		return nil
+	}
+
+	delete(h.virtualSessions, virtualSessionId)
+	return h.sessions[sid]
+}
+
 func isAllowedToUpdateTransientData(session Session) bool {
 	if session.ClientType() == HelloClientTypeInternal {
 		// Internal clients are always allowed.
@@ -1716,23 +2671,497 @@ func (h *Hub) processTransientMsg(client *Client, message *ClientMessage) {
 	}
 }
 
-func sendNotAllowed(session *ClientSession, message *ClientMessage, reason string) {
-	response := message.NewErrorServerMessage(NewError("not_allowed", reason))
-	session.SendMessage(response)
-}
+func (h *Hub) processReactionMsg(client *Client, message *ClientMessage) {
+	msg := message.Reaction
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
 
-func sendMcuClientNotFound(session *ClientSession, message *ClientMessage) {
-	response := message.NewErrorServerMessage(NewError("client_not_found", "No MCU client found to send message to."))
-	session.SendMessage(response)
-}
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
 
-func sendMcuProcessingFailed(session *ClientSession, message *ClientMessage) {
-	response := message.NewErrorServerMessage(NewError("processing_failed", "Processing of the message failed, please check server logs."))
-	session.SendMessage(response)
+	switch msg.Type {
+	case "raisehand":
+		room.RaiseHand(session)
+	case "lowerhand":
+		sessionId := msg.SessionId
+		if sessionId == "" {
+			sessionId = session.PublicId()
+		} else if sessionId != session.PublicId() && !isAllowedToControl(session) {
+			// Only moderators may lower the hands of other sessions.
+			sendNotAllowed(session, message, "Not allowed to lower hand.")
+			return
+		}
+
+		room.LowerHand(sessionId)
+	case "emoji":
+		room.AddReaction(msg.Emoji)
+	}
 }
 
-func (h *Hub) isInSameCall(senderSession *ClientSession, recipientSessionId string) bool {
-	if senderSession.ClientType() == HelloClientTypeInternal {
+func (h *Hub) processTypingMsg(client *Client, message *ClientMessage) {
+	msg := message.Typing
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	switch msg.Type {
+	case "start":
+		room.StartTyping(session)
+	case "stop":
+		room.StopTyping(session)
+	}
+}
+
+func (h *Hub) processReportMsg(client *Client, message *ClientMessage) {
+	msg := message.Report
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	switch msg.Type {
+	case "stats":
+		session.SetQualityStats(msg.Stats)
+	}
+}
+
+func (h *Hub) processCallMsg(client *Client, message *ClientMessage) {
+	msg := message.Call
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	onHold := msg.Type == "hold"
+	state, changed := room.SetSessionOnHold(session, onHold)
+	if state != CallStateInCall && state != CallStateOnHold {
+		response := message.NewErrorServerMessage(NewError("not_in_call", "The session is not in the call."))
+		session.SendMessage(response)
+		return
+	}
+
+	if changed {
+		ctx, cancel := context.WithTimeout(context.Background(), h.mcuTimeout)
+		defer cancel()
+
+		session.SetSubscribersPaused(ctx, onHold)
+	}
+
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "call",
+		Call: &CallServerMessage{
+			RoomId: room.Id(),
+			State:  state,
+		},
+	})
+}
+
+func (h *Hub) processRecordingMsg(client *Client, message *ClientMessage) {
+	msg := message.Recording
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	switch msg.Type {
+	case "consent":
+		room.SetRecordingConsent(session, msg.Consent)
+	}
+}
+
+func (h *Hub) processTranscriptionMsg(client *Client, message *ClientMessage) {
+	msg := message.Transcription
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	if !session.HasPermission(PERMISSION_MAY_CONTROL) {
+		sendNotAllowed(session, message, "Not allowed to control transcriptions.")
+		return
+	}
+
+	switch msg.Type {
+	case "start":
+		// Participants are notified if no transcription service is available.
+		h.transcriptions.Start(room.Id(), room.Backend())
+	case "stop":
+		h.transcriptions.Stop(room.Id(), room.Backend())
+	}
+}
+
+func (h *Hub) processRoomKeyMsg(client *Client, message *ClientMessage) {
+	msg := message.RoomKey
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	if !session.HasVerifiedIdentity() {
+		sendNotAllowed(session, message, "Only authenticated users may send room keys.")
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	if !session.AllowRoomKey(h.roomKeyRateLimit) {
+		log.Printf("Session %s exceeded the rate limit for room keys", session.PublicId())
+		response := message.NewErrorServerMessage(NewError("rate_limited", "Too many room keys sent."))
+		session.SendMessage(response)
+		return
+	}
+
+	var subject string
+	switch msg.Recipient.Type {
+	case RecipientTypeSession:
+		if msg.Recipient.SessionId == session.PublicId() {
+			// Don't loop messages to the sender.
+			return
+		}
+
+		if data := h.decodeSessionId(msg.Recipient.SessionId, publicSessionName); data != nil {
+			// Sessions connected to this server can be checked before sending the
+			// key material, others check the room when receiving it.
+			if target, ok := h.GetSessionByPublicId(msg.Recipient.SessionId).(*ClientSession); ok && target.GetRoom() != room {
+				response := message.NewErrorServerMessage(NewError("no_such_session", "The session is not in the room."))
+				session.SendMessage(response)
+				return
+			}
+
+			subject = "session." + msg.Recipient.SessionId
+		}
+	case RecipientTypeRoom:
+		subject = GetSubjectForRoomId(room.Id(), room.Backend())
+	}
+	if subject == "" {
+		log.Printf("Unknown recipient in room key from %s", session.PublicId())
+		return
+	}
+
+	// The key material is relayed as-is and never stored.
+	response := &ServerMessage{
+		Type: "room-key",
+		RoomKey: &RoomKeyServerMessage{
+			RoomId: room.Id(),
+			Sender: &MessageServerMessageSender{
+				Type:      msg.Recipient.Type,
+				SessionId: session.PublicId(),
+				UserId:    session.UserId(),
+			},
+			Data: msg.Data,
+		},
+	}
+	natsMsg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "message",
+		Message:  response,
+		Backend:  getBackendId(room.Backend()),
+	}
+	if err := h.nats.PublishNats(subject, natsMsg); err != nil {
+		log.Printf("Error publishing room key from %s: %s", session.PublicId(), err)
+	}
+}
+
+func (h *Hub) processModerationMsg(client *Client, message *ClientMessage) {
+	msg := message.Moderation
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	if !isAllowedToControl(session) {
+		sendNotAllowed(session, message, "Not allowed to moderate participants.")
+		return
+	}
+
+	target, ok := h.GetSessionByPublicId(msg.SessionId).(*ClientSession)
+	if !ok || target.GetRoom() != room {
+		response := message.NewErrorServerMessage(NewError("no_such_session", "The session is not in the room."))
+		session.SendMessage(response)
+		return
+	}
+
+	switch msg.Type {
+	case "mute":
+		mediaType := MediaTypeAudio
+		if msg.Media == "video" {
+			mediaType = MediaTypeVideo
+		}
+		if publisher := target.GetPublisher(streamTypeVideo); publisher != nil {
+			if muter, ok := publisher.(McuPublisherMuter); ok {
+				ctx, cancel := context.WithTimeout(context.Background(), h.mcuTimeout)
+				defer cancel()
+
+				if err := muter.Mute(ctx, mediaType); err != nil {
+					log.Printf("Error muting %s of publisher %s in session %s: %s", msg.Media, publisher.Id(), target.PublicId(), err)
+				} else {
+					target.SetMediaMuted(mediaType, true)
+				}
+			}
+		}
+	case "stopscreen":
+		target.ClosePublisher(streamTypeScreen)
+	case "lowerhand":
+		room.LowerHand(target.PublicId())
+	case "removefromcall":
+		room.RemoveSessionFromCall(target)
+	}
+
+	target.SendMessage(&ServerMessage{
+		Type: "moderation",
+		Moderation: &ModerationServerMessage{
+			Type:  msg.Type,
+			Actor: session.PublicId(),
+			Media: msg.Media,
+		},
+	})
+
+	// The action was already executed, the backend only needs to update its
+	// state so it doesn't have to be waited for.
+	request := NewBackendClientModerationRequest(room.BackendRoomId(), msg.Type, session.RoomSessionId(), target.RoomSessionId())
+	request.Moderation.Media = msg.Media
+	go func() {
+		ctx := context.Background()
+		var response BackendClientResponse
+		if err := h.backendQueue.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &response); err != nil {
+			log.Printf("Could not notify backend about %s of session %s in room %s by %s: %s", msg.Type, target.PublicId(), room.Id(), session.PublicId(), err)
+		}
+	}()
+}
+
+func (h *Hub) processSessionMsg(client *Client, message *ClientMessage) {
+	msg := message.Session
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	var target *ClientSession
+	var metadata map[string]interface{}
+	switch msg.Type {
+	case "set":
+		var err error
+		if metadata, err = session.UpdateMetadata(msg.Metadata); err != nil {
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		target = session
+		if room := session.GetRoom(); room != nil {
+			room.SetSessionMetadata(session, metadata)
+		}
+	case "get":
+		target = session
+		if msg.SessionId != "" && msg.SessionId != session.PublicId() {
+			if !isAllowedToControl(session) {
+				sendNotAllowed(session, message, "Not allowed to get the metadata of other sessions.")
+				return
+			}
+
+			room := session.GetRoom()
+			var ok bool
+			if target, ok = h.GetSessionByPublicId(msg.SessionId).(*ClientSession); !ok || room == nil || target.GetRoom() != room {
+				response := message.NewErrorServerMessage(NewError("no_such_session", "The session is not in the room."))
+				session.SendMessage(response)
+				return
+			}
+		}
+		metadata = target.GetMetadata()
+	}
+
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "session",
+		Session: &SessionServerMessage{
+			Type:      "metadata",
+			SessionId: target.PublicId(),
+			Metadata:  metadata,
+		},
+	})
+}
+
+func (h *Hub) processParticipantsMsg(client *Client, message *ClientMessage) {
+	msg := message.Participants
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	switch msg.Type {
+	case "get":
+		limit := msg.Limit
+		if limit <= 0 || limit > h.participantsPageSize {
+			limit = h.participantsPageSize
+		}
+
+		response := &ServerMessage{
+			Id:           message.Id,
+			Type:         "participants",
+			Participants: newParticipantsPage(room, msg.Offset, limit),
+		}
+		session.SendMessage(response)
+	}
+}
+
+func (h *Hub) processRtpForwardMsg(client *Client, message *ClientMessage) {
+	msg := message.RtpForward
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	isInternal := session.ClientType() == HelloClientTypeInternal
+	if !isInternal && !session.HasPermission(PERMISSION_MAY_CONTROL) {
+		sendNotAllowed(session, message, "Not allowed to forward streams.")
+		return
+	}
+
+	if msg.Type == "start" && !h.rtpForwardHosts[strings.ToLower(msg.Host)] {
+		sendNotAllowed(session, message, "Not allowed to forward streams to this host.")
+		return
+	}
+
+	target, ok := h.GetSessionByPublicId(msg.SessionId).(*ClientSession)
+	if !ok || (!isInternal && (session.GetRoom() == nil || target.GetRoom() != session.GetRoom())) {
+		response := message.NewErrorServerMessage(NewError("no_such_session", "The session to forward streams of was not found."))
+		session.SendMessage(response)
+		return
+	}
+
+	publisher := target.GetPublisher(msg.StreamType)
+	if publisher == nil {
+		response := message.NewErrorServerMessage(NewError("no_such_publisher", "The session is not publishing the requested stream."))
+		session.SendMessage(response)
+		return
+	}
+
+	forwarder, ok := publisher.(McuRtpForwarder)
+	if !ok {
+		response := message.NewErrorServerMessage(NewError("not_supported", "Forwarding streams is not supported by the MCU."))
+		session.SendMessage(response)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.mcuTimeout)
+	defer cancel()
+
+	response := &ServerMessage{
+		Id:   message.Id,
+		Type: "rtpforward",
+		RtpForward: &RtpForwardServerMessage{
+			SessionId:  msg.SessionId,
+			StreamType: msg.StreamType,
+		},
+	}
+	switch msg.Type {
+	case "start":
+		streams, err := forwarder.StartRtpForward(ctx, msg.Host, msg.AudioPort, msg.VideoPort)
+		if err != nil {
+			log.Printf("Could not forward %s streams of %s to %s for %s: %s", msg.StreamType, msg.SessionId, msg.Host, session.PublicId(), err)
+			session.SendMessage(message.NewErrorServerMessage(NewError("processing_failed", "Could not forward streams.")))
+			return
+		}
+
+		response.RtpForward.Type = "started"
+		response.RtpForward.Streams = streams
+	case "stop":
+		for _, streamId := range msg.StreamIds {
+			if err := forwarder.StopRtpForward(ctx, streamId); err != nil {
+				log.Printf("Could not stop forwarding stream %d of %s for %s: %s", streamId, msg.SessionId, session.PublicId(), err)
+				session.SendMessage(message.NewErrorServerMessage(NewError("processing_failed", "Could not stop forwarding streams.")))
+				return
+			}
+		}
+
+		response.RtpForward.Type = "stopped"
+		response.RtpForward.StreamIds = msg.StreamIds
+	}
+	session.SendMessage(response)
+}
+
+func sendNotAllowed(session *ClientSession, message *ClientMessage, reason string) {
+	response := message.NewErrorServerMessage(NewError("not_allowed", reason))
+	session.SendMessage(response)
+}
+
+func sendMcuClientNotFound(session *ClientSession, message *ClientMessage) {
+	response := message.NewErrorServerMessage(NewError("client_not_found", "No MCU client found to send message to."))
+	session.SendMessage(response)
+}
+
+func sendMcuProcessingFailed(session *ClientSession, message *ClientMessage) {
+	response := message.NewErrorServerMessage(NewError("processing_failed", "Processing of the message failed, please check server logs."))
+	session.SendMessage(response)
+}
+
+func (h *Hub) isInSameCall(senderSession *ClientSession, recipientSessionId string) bool {
+	if senderSession.ClientType() == HelloClientTypeInternal {
 		// Internal clients may subscribe all streams.
 		return true
 	}
@@ -1759,8 +3188,55 @@ func (h *Hub) isInSameCall(senderSession *ClientSession, recipientSessionId stri
 	return true
 }
 
-func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSession, client_message *ClientMessage, message *MessageClientMessage, data *MessageClientMessageData) {
-	ctx, cancel := context.WithTimeout(context.Background(), h.mcuTimeout)
+// checkVideoSubscriberLimit returns false and sends an error to the client if
+// the session may not subscribe another video stream in its call.
+func (h *Hub) checkVideoSubscriberLimit(senderSession *ClientSession, session *ClientSession, message *ClientMessage, publisherId string, streamType string) bool {
+	if streamType != streamTypeVideo || session.ClientType() == HelloClientTypeInternal {
+		return true
+	}
+
+	policy := h.getSubscriberPolicy()
+	if policy == nil {
+		return true
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		return true
+	}
+
+	participants := room.GetCallSize()
+	maxSubscribers := policy.GetMaxVideoSubscribers(participants)
+	if maxSubscribers == 0 || session.GetSubscriber(publisherId, streamType) != nil {
+		// Not limited or renegotiation of an existing subscription.
+		return true
+	}
+
+	count := 0
+	for _, subscriber := range session.GetSubscribers() {
+		if subscriber.StreamType() == streamTypeVideo {
+			count++
+		}
+	}
+	if count < maxSubscribers {
+		return true
+	}
+
+	log.Printf("Session %s already subscribed %d video streams in call with %d participants, not subscribing %s", session.PublicId(), count, participants, publisherId)
+	senderSession.events.Add(SessionEventMcu, "Rejected video subscriber for %s, limit of %d reached", publisherId, maxSubscribers)
+	response := message.NewErrorServerMessage(NewErrorDetail("too_many_subscriptions", "Too many video subscriptions.", &TooManySubscriptionsDetails{
+		MaxSubscriptions: maxSubscribers,
+		Participants:     participants,
+	}))
+	senderSession.SendMessage(response)
+	return false
+}
+
+func (h *Hub) processMcuMessage(ctx context.Context, senderSession *ClientSession, session *ClientSession, client_message *ClientMessage, message *MessageClientMessage, data *MessageClientMessageData) {
+	ctx, span := startSpan(ctx, "hub.mcu", attribute.String("mcu.type", data.Type))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, h.mcuTimeout)
 	defer cancel()
 
 	var mc McuClient
@@ -1781,13 +3257,41 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 			return
 		}
 
+		if room := session.GetRoom(); room != nil && room.GetSessionCallState(session) == CallStateOnHold {
+			log.Printf("Call of session %s is on hold, not requesting offer from %s", session.PublicId(), message.Recipient.SessionId)
+			sendNotAllowed(senderSession, client_message, "Call is on hold.")
+			return
+		}
+
+		if !h.checkVideoSubscriberLimit(senderSession, session, client_message, message.Recipient.SessionId, data.RoomType) {
+			return
+		}
+
 		clientType = "subscriber"
 		mc, err = session.GetOrCreateSubscriber(ctx, h.mcu, message.Recipient.SessionId, data.RoomType)
 	case "sendoffer":
 		// Permissions have already been checked in "processMessageMsg".
+		if !h.checkVideoSubscriberLimit(senderSession, session, client_message, message.Recipient.SessionId, data.RoomType) {
+			return
+		}
+
 		clientType = "subscriber"
 		mc, err = session.GetOrCreateSubscriber(ctx, h.mcu, message.Recipient.SessionId, data.RoomType)
 	case "offer":
+		if data.RoomType == streamTypeAudioBridge {
+			if room := session.GetRoom(); room == nil || !room.UsesAudioBridge() {
+				log.Printf("Session %s tried to join the audio bridge of a room that doesn't use it, ignoring", session.PublicId())
+				sendNotAllowed(senderSession, client_message, "Audio bridge is not enabled for this room.")
+				return
+			}
+		}
+
+		if room := session.GetRoom(); room != nil && !room.IsAllowedToPublish(session) {
+			log.Printf("Session %s didn't consent to being recorded in room %s, not allowed to publish %s", session.PublicId(), room.Id(), data.RoomType)
+			sendNotAllowed(senderSession, client_message, "Consent to recording required.")
+			return
+		}
+
 		clientType = "publisher"
 		mc, err = session.GetOrCreatePublisher(ctx, h.mcu, data.RoomType, data)
 		if err, ok := err.(*PermissionError); ok {
@@ -1800,6 +3304,8 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 			sendNotAllowed(senderSession, client_message, "Not allowed to publish.")
 			return
 		}
+	case "configure":
+		fallthrough
 	case "selectStream":
 		if session.PublicId() == message.Recipient.SessionId {
 			log.Printf("Not selecting substream for own %s stream in session %s", data.RoomType, session.PublicId())
@@ -1825,17 +3331,29 @@ func (h *Hub) processMcuMessage(senderSession *ClientSession, session *ClientSes
 	}
 	if err != nil {
 		log.Printf("Could not create MCU %s for session %s to send %+v to %s: %s", clientType, session.PublicId(), data, message.Recipient.SessionId, err)
+		senderSession.events.Add(SessionEventMcu, "Could not create %s %s for %s: %s", data.RoomType, clientType, message.Recipient.SessionId, err)
 		sendMcuClientNotFound(senderSession, client_message)
 		return
 	} else if mc == nil {
 		log.Printf("No MCU %s found for session %s to send %+v to %s", clientType, session.PublicId(), data, message.Recipient.SessionId)
+		senderSession.events.Add(SessionEventMcu, "No %s %s found for %s to send %s", data.RoomType, clientType, message.Recipient.SessionId, data.Type)
 		sendMcuClientNotFound(senderSession, client_message)
 		return
 	}
 
+	switch data.Type {
+	case "requestoffer":
+		fallthrough
+	case "sendoffer":
+		fallthrough
+	case "offer":
+		senderSession.events.Add(SessionEventMcu, "Processing %s for %s %s %s of %s", data.Type, data.RoomType, clientType, mc.Id(), message.Recipient.SessionId)
+	}
+
 	mc.SendMessage(context.TODO(), message, data, func(err error, response map[string]interface{}) {
 		if err != nil {
 			log.Printf("Could not send MCU message %+v for session %s to %s: %s", data, session.PublicId(), message.Recipient.SessionId, err)
+			senderSession.events.Add(SessionEventMcu, "Could not send %s to %s %s: %s", data.Type, clientType, mc.Id(), err)
 			sendMcuProcessingFailed(senderSession, client_message)
 			return
 		} else if response == nil {
@@ -1883,6 +3401,7 @@ func (h *Hub) sendMcuMessageResponse(session *ClientSession, mcuClient McuClient
 			RoomType: data.RoomType,
 			Payload:  response,
 			Sid:      mcuClient.Sid(),
+			Layers:   getSimulcastLayers(mcuClient),
 		}
 		offer_data, err := json.Marshal(offer_message)
 		if err != nil {
@@ -1917,11 +3436,20 @@ func (h *Hub) processByeMsg(client *Client, message *ClientMessage) {
 
 func (h *Hub) processRoomUpdated(message *BackendServerRoomRequest) {
 	room := message.room
-	room.UpdateProperties(message.Update.Properties)
+	if room.UpdateProperties(message.Update.Properties) {
+		// The lobby or call permissions might have changed.
+		go room.closeUnallowedPublishers()
+	}
 }
 
 func (h *Hub) processRoomDeleted(message *BackendServerRoomRequest) {
 	room := message.room
+	h.closeBreakoutRooms(room)
+	for _, observer := range room.GetObservers() {
+		if observer.LeaveAdditionalRoom(room.Id(), true) != nil {
+			h.sendAdditionalRoom(observer, nil, room.Id(), nil)
+		}
+	}
 	sessions := room.Close()
 	for _, session := range sessions {
 		// The session is no longer in the room
@@ -1978,40 +3506,103 @@ func (h *Hub) GetStats() map[string]interface{} {
 	return result
 }
 
-func getRealUserIP(r *http.Request) string {
-	// Note this function assumes it is running behind a trusted proxy, so
-	// the headers can be trusted.
+// GetRoomStats returns the statistics of all rooms on this server, optionally
+// filtered by the id of a backend.
+func (h *Hub) GetRoomStats(backendId string) []*RoomStats {
+	h.ru.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		if backendId != "" && room.Backend().Id() != backendId {
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	h.ru.RUnlock()
+
+	result := make([]*RoomStats, 0, len(rooms))
+	for _, room := range rooms {
+		result = append(result, room.GetStats())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Backend != result[j].Backend {
+			return result[i].Backend < result[j].Backend
+		}
+		return result[i].RoomId < result[j].RoomId
+	})
+	return result
+}
+
+// isUnixSocketAddr returns true if the remote address is the peer of a Unix
+// domain socket. These are reported as "@" (unnamed), "@name" (abstract) or a
+// filesystem path and can never be an IP address.
+func isUnixSocketAddr(addr string) bool {
+	return addr == "" || addr[0] == '@' || addr[0] == '/'
+}
+
+// getRealUserIP returns the address of the client that sent the request.
+// Headers set by proxies are only evaluated for requests from trusted proxies,
+// all proxies are trusted if "trusted" is nil. Requests received through a
+// Unix domain socket always come from a local proxy and are trusted.
+func getRealUserIP(r *http.Request, trusted *TrustedProxies) string {
+	if !isUnixSocketAddr(r.RemoteAddr) && !trusted.Contains(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+
 	if ip := r.Header.Get("X-Real-IP"); ip != "" {
 		return ip
 	}
 
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// Result could be a list "clientip, proxy1, proxy2", so only use first element.
-		if pos := strings.Index(ip, ","); pos >= 0 {
-			ip = strings.TrimSpace(ip[:pos])
+	if header := r.Header.Get("X-Forwarded-For"); header != "" {
+		// Result could be a list "clientip, proxy1, proxy2".
+		ips := strings.Split(header, ",")
+		if trusted == nil {
+			return strings.TrimSpace(ips[0])
+		}
+
+		// Use the last address that was not added by a trusted proxy, the
+		// first elements could have been set by the client.
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if i == 0 || !trusted.Contains(ip) {
+				return ip
+			}
 		}
-		return ip
 	}
 
 	return r.RemoteAddr
 }
 
 func (h *Hub) lookupClientCountry(client *Client) string {
-	ip := net.ParseIP(client.RemoteAddr())
+	return h.lookupCountry(client.RemoteAddr())
+}
+
+// lookupCountry returns the country of the given address. Returns one of
+// the special values "no-country", "loopback" or "unknown-country" if the
+// country can't be determined.
+func (h *Hub) lookupCountry(addr string) string {
+	ip := net.ParseIP(addr)
 	if ip == nil {
-		return noCountry
+		// The address of direct connections contains the port of the client.
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			ip = net.ParseIP(host)
+		}
+		if ip == nil {
+			return noCountry
+		}
 	}
 
-	for overrideNet, country := range h.geoipOverrides {
-		if overrideNet.Contains(ip) {
-			return country
-		}
+	if country, found := h.geoipOverrides.Lookup(ip, h.lookupAsn); found {
+		return country
 	}
 
 	if ip.IsLoopback() {
 		return loopback
 	}
 
+	if h.geoip == nil {
+		return unknownCountry
+	}
+
 	country, err := h.geoip.LookupCountry(ip)
 	if err != nil {
 		log.Printf("Could not lookup country for %s: %s", ip, err)
@@ -2024,8 +3615,27 @@ func (h *Hub) lookupClientCountry(client *Client) string {
 	return country
 }
 
+func (h *Hub) lookupAsn(ip net.IP) (uint, bool) {
+	if h.geoipAsn == nil {
+		return 0, false
+	}
+
+	asn, err := h.geoipAsn.LookupASN(ip)
+	if err != nil {
+		log.Printf("Could not lookup ASN for %s: %s", ip, err)
+		return 0, false
+	}
+
+	return asn, asn != 0
+}
+
+// hasGeoLookup returns true if the country of clients can be determined.
+func (h *Hub) hasGeoLookup() bool {
+	return h.geoip != nil || h.geoipOverrides.IsEnabled()
+}
+
 func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
-	addr := getRealUserIP(r)
+	addr := getRealUserIP(r, h.trustedProxies)
 	agent := r.Header.Get("User-Agent")
 
 	conn, err := h.upgrader.Upgrade(w, r, nil)
@@ -2040,7 +3650,19 @@ func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if h.geoip != nil {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		// Connected through the listener for internal clients with certificates.
+		client.SetCertificateSubject(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+
+	if h.websocketCompressionThreshold > 0 {
+		if err := conn.SetCompressionLevel(h.websocketCompressionLevel); err != nil {
+			log.Printf("Could not set compression level for %s: %s", addr, err)
+		}
+		client.SetCompressionThreshold(h.websocketCompressionThreshold)
+	}
+
+	if h.hasGeoLookup() {
 		client.OnLookupCountry = h.lookupClientCountry
 	}
 	client.OnMessageReceived = h.processMessage
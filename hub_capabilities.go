@@ -0,0 +1,70 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	capabilitiesInvalidateNatsSubject = "signaling.capabilities.invalidate"
+)
+
+// CapabilitiesInvalidateNatsRequest is sent to all servers of a cluster to
+// remove the cached capabilities of all urls starting with "prefix".
+type CapabilitiesInvalidateNatsRequest struct {
+	Prefix string `json:"prefix"`
+}
+
+func (h *Hub) subscribeCapabilitiesInvalidate() error {
+	h.capabilitiesInvalidate = make(chan *nats.Msg, 64)
+	sub, err := h.nats.Subscribe(capabilitiesInvalidateNatsSubject, h.capabilitiesInvalidate)
+	if err != nil {
+		return err
+	}
+
+	h.capabilitiesInvalidateSubscription = sub
+	return nil
+}
+
+func (h *Hub) processCapabilitiesInvalidate(msg *nats.Msg) {
+	var request CapabilitiesInvalidateNatsRequest
+	if err := h.nats.Decode(msg, &request); err != nil {
+		log.Printf("Could not decode capabilities invalidation %+v: %s", msg, err)
+		return
+	}
+
+	h.backend.InvalidateCapabilities(request.Prefix)
+}
+
+// InvalidateCapabilities removes the cached capabilities of all urls starting
+// with the given prefix on all servers of the cluster.
+func (h *Hub) InvalidateCapabilities(prefix string) error {
+	h.backend.InvalidateCapabilities(prefix)
+
+	request := &CapabilitiesInvalidateNatsRequest{
+		Prefix: prefix,
+	}
+	return h.nats.Publish(capabilitiesInvalidateNatsSubject, request)
+}
@@ -0,0 +1,188 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	clusterStatsNatsSubject = "signaling.stats.rooms"
+
+	defaultClusterStatsTimeout = time.Second
+)
+
+// ClusterStatsNatsRequest is sent to all servers of a cluster, the servers
+// reply with a ClusterStatsNatsResponse to the subject in "reply".
+type ClusterStatsNatsRequest struct {
+	Reply   string `json:"reply"`
+	Backend string `json:"backend,omitempty"`
+}
+
+type ClusterStatsNatsResponse struct {
+	Sessions int                 `json:"sessions"`
+	Rooms    []*ClusterRoomStats `json:"rooms"`
+}
+
+func (h *Hub) subscribeClusterStats() error {
+	h.clusterStatsRequests = make(chan *nats.Msg, 64)
+	sub, err := h.nats.Subscribe(clusterStatsNatsSubject, h.clusterStatsRequests)
+	if err != nil {
+		return err
+	}
+
+	h.clusterStatsSubscription = sub
+	return nil
+}
+
+// getLocalClusterStats returns the rooms and participants on this server,
+// optionally filtered by the id of a backend.
+func (h *Hub) getLocalClusterStats(backendId string) *ClusterStatsNatsResponse {
+	h.ru.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		if backendId != "" && room.Backend().Id() != backendId {
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	h.ru.RUnlock()
+
+	result := &ClusterStatsNatsResponse{
+		Sessions: len(h.GetSessions(backendId, "", "")),
+		Rooms:    make([]*ClusterRoomStats, 0, len(rooms)),
+	}
+	for _, room := range rooms {
+		participants, inCall := room.GetParticipantCounts()
+		result.Rooms = append(result.Rooms, &ClusterRoomStats{
+			RoomId:       room.Id(),
+			Backend:      room.Backend().Id(),
+			Participants: participants,
+			InCall:       inCall,
+			Servers:      1,
+		})
+	}
+	return result
+}
+
+func (h *Hub) processClusterStatsRequest(msg *nats.Msg) {
+	var request ClusterStatsNatsRequest
+	if err := h.nats.Decode(msg, &request); err != nil {
+		log.Printf("Could not decode cluster stats request %+v: %s", msg, err)
+		return
+	} else if request.Reply == "" {
+		return
+	}
+
+	if err := h.nats.Publish(request.Reply, h.getLocalClusterStats(request.Backend)); err != nil {
+		log.Printf("Could not send cluster stats to %s: %s", request.Reply, err)
+	}
+}
+
+func mergeClusterRoomStats(rooms map[string]*ClusterRoomStats, stats []*ClusterRoomStats) {
+	for _, room := range stats {
+		key := room.Backend + "|" + room.RoomId
+		existing, found := rooms[key]
+		if !found {
+			existing = &ClusterRoomStats{
+				RoomId:  room.RoomId,
+				Backend: room.Backend,
+			}
+			rooms[key] = existing
+		}
+		existing.Participants += room.Participants
+		existing.InCall += room.InCall
+		existing.Servers += room.Servers
+	}
+}
+
+// GetClusterStats returns the rooms and number of participants on all servers
+// of the cluster, optionally filtered by the id of a backend. The servers must
+// reply before the configured timeout to be included.
+func (h *Hub) GetClusterStats(ctx context.Context, backendId string) (*ClusterStatsResponse, error) {
+	result := &ClusterStatsResponse{}
+	rooms := make(map[string]*ClusterRoomStats)
+	if _, ok := h.nats.(*LoopbackNatsClient); ok {
+		// No other servers can be connected.
+		local := h.getLocalClusterStats(backendId)
+		result.Servers = 1
+		result.Sessions = local.Sessions
+		mergeClusterRoomStats(rooms, local.Rooms)
+	} else {
+		reply := clusterStatsNatsSubject + ".reply." + newRandomString(32)
+		receiver := make(chan *nats.Msg, 64)
+		sub, err := h.nats.Subscribe(reply, receiver)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := sub.Unsubscribe(); err != nil {
+				log.Printf("Error unsubscribing cluster stats replies %s: %s", reply, err)
+			}
+		}()
+
+		request := &ClusterStatsNatsRequest{
+			Reply:   reply,
+			Backend: backendId,
+		}
+		if err := h.nats.Publish(clusterStatsNatsSubject, request); err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, h.clusterStatsTimeout)
+		defer cancel()
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				break loop
+			case msg := <-receiver:
+				var response ClusterStatsNatsResponse
+				if err := h.nats.Decode(msg, &response); err != nil {
+					log.Printf("Could not decode cluster stats response %+v: %s", msg, err)
+					continue
+				}
+
+				result.Servers++
+				result.Sessions += response.Sessions
+				mergeClusterRoomStats(rooms, response.Rooms)
+			}
+		}
+	}
+
+	result.Rooms = make([]*ClusterRoomStats, 0, len(rooms))
+	for _, room := range rooms {
+		result.Rooms = append(result.Rooms, room)
+	}
+	sort.Slice(result.Rooms, func(i, j int) bool {
+		if result.Rooms[i].Backend != result.Rooms[j].Backend {
+			return result.Rooms[i].Backend < result.Rooms[j].Backend
+		}
+		return result.Rooms[i].RoomId < result.Rooms[j].RoomId
+	})
+	return result, nil
+}
@@ -0,0 +1,125 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func createClusteredHubForTest(t *testing.T, natsUrl string) (*Hub, *httptest.Server) {
+	r := mux.NewRouter()
+	registerBackendHandler(t, r)
+
+	server := httptest.NewServer(r)
+	nats, err := NewNatsClient(natsUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := getTestConfig(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddOption("stats", "clustertimeout", "200")
+	h, err := NewHub(config, nats, r, "no-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go h.Run()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		WaitForHub(ctx, t, h)
+		nats.Close()
+		server.Close()
+	})
+
+	return h, server
+}
+
+func TestHubClusterStats(t *testing.T) {
+	natsUrl := startLocalNatsServer(t)
+	hub1, server1 := createClusteredHubForTest(t, natsUrl)
+	hub2, server2 := createClusteredHubForTest(t, natsUrl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	roomId := "test-room"
+	for idx, hubServer := range []struct {
+		hub    *Hub
+		server *httptest.Server
+	}{
+		{hub1, server1},
+		{hub2, server2},
+	} {
+		client := NewTestClient(t, hubServer.server, hubServer.hub)
+		defer client.CloseWithBye()
+		if err := client.SendHello(testDefaultUserId + string(rune('1'+idx))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.RunUntilHello(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+	}
+
+	// An additional session without a room on the first server.
+	client := NewTestClient(t, server1, hub1)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []*Hub{hub1, hub2} {
+		stats, err := h.GetClusterStats(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Servers != 2 || stats.Sessions != 3 || len(stats.Rooms) != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		} else if room := stats.Rooms[0]; room.RoomId != roomId || room.Participants != 2 || room.Servers != 2 {
+			t.Errorf("Unexpected room %+v", room)
+		}
+	}
+
+	stats, err := hub1.GetClusterStats(ctx, "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Servers != 2 || stats.Sessions != 0 || len(stats.Rooms) != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,96 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// Time after which clients should retry to connect to a backend that is
+	// in maintenance.
+	backendMaintenanceRetryAfter = time.Minute
+)
+
+func newBackendMaintenanceError() *Error {
+	return NewErrorDetail("backend_maintenance", "The backend is in maintenance, please try again later.", &BackendMaintenanceDetails{
+		RetryAfter: int(backendMaintenanceRetryAfter / time.Second),
+	})
+}
+
+// BackendRemoved is part of the BackendListener interface, sessions of
+// removed backends are not closed. The metrics of the backend are removed,
+// the current number of rooms and sessions is kept while some of them exist
+// so they can still be decremented.
+func (h *Hub) BackendRemoved(backend *Backend) {
+	deleteHubBackendStats(backend.Id(), !h.hasBackendSessions(backend.Id()))
+}
+
+// hasBackendSessions returns true if rooms or sessions of the backend with
+// the given id exist.
+func (h *Hub) hasBackendSessions(id string) bool {
+	h.ru.RLock()
+	for _, room := range h.rooms {
+		if room.Backend().Id() == id {
+			h.ru.RUnlock()
+			return true
+		}
+	}
+	h.ru.RUnlock()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, session := range h.sessions {
+		if session.Backend().Id() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// BackendMaintenanceChanged resynchronizes the state of the rooms of a
+// backend and sends the requests that were queued while it was in
+// maintenance.
+func (h *Hub) BackendMaintenanceChanged(id string, maintenance bool) {
+	if maintenance {
+		return
+	}
+
+	h.backendQueue.Wakeup()
+
+	h.ru.RLock()
+	var rooms []*Room
+	for _, room := range h.rooms {
+		if room.Backend().configuredId() == id {
+			rooms = append(rooms, room)
+		}
+	}
+	h.ru.RUnlock()
+
+	if len(rooms) > 0 {
+		log.Printf("Resynchronizing %d rooms of backend %s after maintenance", len(rooms), id)
+	}
+	for _, room := range rooms {
+		go room.publishActiveSessions()
+	}
+}
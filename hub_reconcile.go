@@ -0,0 +1,239 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReconcileInterval = 5 * time.Minute
+
+	// A room contains a session that is no longer registered in the hub.
+	reconcileGhostRoomSession = "ghost_room_session"
+	// A session references a room that is no longer registered in the hub.
+	reconcileStaleSessionRoom = "stale_session_room"
+	// A client is registered without a corresponding session.
+	reconcileGhostClient = "ghost_client"
+	// A virtual session id maps to a session that no longer exists.
+	reconcileGhostVirtualSession = "ghost_virtual_session"
+	// The room session id of a session is missing in the room sessions store.
+	reconcileMissingRoomSession = "missing_room_session"
+	// The room session id of a session maps to a different session.
+	reconcileMismatchedRoomSession = "mismatched_room_session"
+	// A session that is not in a room still has MCU publishers / subscribers.
+	reconcileLeakedMcuObjects = "leaked_mcu_objects"
+)
+
+// reconcileCheck is an inconsistency that was found in the state of the hub.
+// The repair function is optional and must re-validate the inconsistency.
+type reconcileCheck struct {
+	kind   string
+	id     string
+	repair func() bool
+}
+
+func (c *reconcileCheck) key() string {
+	return c.kind + "|" + c.id
+}
+
+// reconcile cross-checks the different registries of the hub and repairs
+// inconsistencies where this is safe. As state changes concurrently, only
+// inconsistencies that were also found in the previous run are handled.
+func (h *Hub) reconcile() {
+	if !atomic.CompareAndSwapInt32(&h.reconciling, 0, 1) {
+		// Already running.
+		return
+	}
+	defer atomic.StoreInt32(&h.reconciling, 0)
+
+	checks := h.findInconsistencies()
+	suspects := make(map[string]bool, len(checks))
+	for _, check := range checks {
+		key := check.key()
+		suspects[key] = true
+		if !h.reconcileSuspects[key] {
+			continue
+		}
+
+		statsHubReconcileDiscrepanciesTotal.WithLabelValues(check.kind).Inc()
+		if check.repair == nil {
+			log.Printf("Reconciliation found %s for %s", check.kind, check.id)
+			continue
+		}
+
+		if check.repair() {
+			log.Printf("Reconciliation repaired %s for %s", check.kind, check.id)
+			statsHubReconcileRepairedTotal.WithLabelValues(check.kind).Inc()
+			delete(suspects, key)
+		}
+	}
+	h.reconcileSuspects = suspects
+}
+
+func (h *Hub) findInconsistencies() []*reconcileCheck {
+	var checks []*reconcileCheck
+
+	h.mu.RLock()
+	sessions := make([]Session, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	for sid := range h.clients {
+		if _, found := h.sessions[sid]; !found {
+			sid := sid
+			checks = append(checks, &reconcileCheck{
+				kind: reconcileGhostClient,
+				id:   strconv.FormatUint(sid, 10),
+				repair: func() bool {
+					h.mu.Lock()
+					defer h.mu.Unlock()
+					if _, found := h.sessions[sid]; found {
+						return false
+					}
+
+					delete(h.clients, sid)
+					return true
+				},
+			})
+		}
+	}
+	for id, sid := range h.virtualSessions {
+		if _, found := h.sessions[sid]; !found {
+			id, sid := id, sid
+			checks = append(checks, &reconcileCheck{
+				kind: reconcileGhostVirtualSession,
+				id:   id,
+				repair: func() bool {
+					h.mu.Lock()
+					defer h.mu.Unlock()
+					if _, found := h.sessions[sid]; found || h.virtualSessions[id] != sid {
+						return false
+					}
+
+					delete(h.virtualSessions, id)
+					return true
+				},
+			})
+		}
+	}
+	h.mu.RUnlock()
+
+	h.ru.RLock()
+	rooms := make(map[string]*Room, len(h.rooms))
+	for id, room := range h.rooms {
+		rooms[id] = room
+	}
+	h.ru.RUnlock()
+
+	for _, room := range rooms {
+		for _, session := range room.GetSessions() {
+			if h.isSessionRegistered(session) {
+				continue
+			}
+
+			room, session := room, session
+			checks = append(checks, &reconcileCheck{
+				kind: reconcileGhostRoomSession,
+				id:   room.Id() + "|" + session.PublicId(),
+				repair: func() bool {
+					if h.isSessionRegistered(session) || !room.HasSession(session) {
+						return false
+					}
+
+					room.RemoveSession(session)
+					return true
+				},
+			})
+		}
+	}
+
+	for _, s := range sessions {
+		session, ok := s.(*ClientSession)
+		if !ok {
+			continue
+		}
+
+		if room := session.GetRoom(); room != nil {
+			if rooms[getRoomIdForBackend(room.Id(), room.Backend())] != room {
+				checks = append(checks, &reconcileCheck{
+					kind: reconcileStaleSessionRoom,
+					id:   session.PublicId(),
+				})
+			}
+		} else if session.hasMcuObjects() {
+			checks = append(checks, &reconcileCheck{
+				kind:   reconcileLeakedMcuObjects,
+				id:     session.PublicId(),
+				repair: session.releaseLeakedMcuObjects,
+			})
+		}
+
+		if roomSessionId := session.RoomSessionId(); roomSessionId != "" {
+			sessionId, err := h.roomSessions.GetSessionId(roomSessionId)
+			if errors.Is(err, ErrNoSuchRoomSession) {
+				session := session
+				checks = append(checks, &reconcileCheck{
+					kind: reconcileMissingRoomSession,
+					id:   session.PublicId(),
+					repair: func() bool {
+						roomSessionId := session.RoomSessionId()
+						if roomSessionId == "" || !h.isSessionRegistered(session) {
+							return false
+						}
+						if _, err := h.roomSessions.GetSessionId(roomSessionId); !errors.Is(err, ErrNoSuchRoomSession) {
+							return false
+						}
+
+						if err := h.roomSessions.SetRoomSession(session, roomSessionId); err != nil {
+							log.Printf("Error restoring room session %s of %s: %s", roomSessionId, session.PublicId(), err)
+							return false
+						}
+						return true
+					},
+				})
+			} else if err == nil && sessionId != session.PublicId() {
+				checks = append(checks, &reconcileCheck{
+					kind: reconcileMismatchedRoomSession,
+					id:   session.PublicId(),
+				})
+			}
+		}
+	}
+
+	return checks
+}
+
+func (h *Hub) isSessionRegistered(session Session) bool {
+	data := session.Data()
+	if data == nil {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions[data.Sid] == session
+}
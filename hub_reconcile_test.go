@@ -0,0 +1,114 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHubReconcile(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoomWithRoomSession(ctx, roomId, "roomsession1"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Room %s not found", roomId)
+	}
+
+	// A consistent state doesn't report anything.
+	hub.reconcile()
+	hub.reconcile()
+	if len(hub.reconcileSuspects) != 0 {
+		t.Errorf("Expected no inconsistencies, got %+v", hub.reconcileSuspects)
+	}
+
+	repaired := testutil.ToFloat64(statsHubReconcileRepairedTotal.WithLabelValues(reconcileMissingRoomSession))
+	ghosts := testutil.ToFloat64(statsHubReconcileRepairedTotal.WithLabelValues(reconcileGhostVirtualSession))
+
+	hub.roomSessions.DeleteRoomSession(session)
+	hub.mu.Lock()
+	hub.virtualSessions["ghost"] = 12345
+	hub.mu.Unlock()
+
+	// Inconsistencies are only repaired if they are found in two runs.
+	hub.reconcile()
+	if _, err := hub.roomSessions.GetSessionId("roomsession1"); err != ErrNoSuchRoomSession {
+		t.Errorf("Room session should not have been repaired yet, got %s", err)
+	}
+
+	hub.reconcile()
+	if sid, err := hub.roomSessions.GetSessionId("roomsession1"); err != nil {
+		t.Error(err)
+	} else if sid != session.PublicId() {
+		t.Errorf("Expected session %s, got %s", session.PublicId(), sid)
+	}
+	hub.mu.RLock()
+	if _, found := hub.virtualSessions["ghost"]; found {
+		t.Error("Ghost virtual session should have been removed")
+	}
+	hub.mu.RUnlock()
+	if len(hub.reconcileSuspects) != 0 {
+		t.Errorf("Expected no remaining inconsistencies, got %+v", hub.reconcileSuspects)
+	}
+
+	checkStatsValue(t, statsHubReconcileRepairedTotal.WithLabelValues(reconcileMissingRoomSession), repaired+1)
+	checkStatsValue(t, statsHubReconcileRepairedTotal.WithLabelValues(reconcileGhostVirtualSession), ghosts+1)
+
+	// Sessions in a room that are no longer registered in the hub are removed.
+	hub.mu.Lock()
+	delete(hub.sessions, session.Data().Sid)
+	hub.mu.Unlock()
+	hub.reconcile()
+	if !room.HasSession(session) {
+		t.Error("Session should still be in the room")
+	}
+	hub.reconcile()
+	if room.HasSession(session) {
+		t.Error("Session should have been removed from the room")
+	}
+}
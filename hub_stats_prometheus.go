@@ -50,21 +50,77 @@ var (
 		Name:      "sessions_resume_total",
 		Help:      "The total number of resumed sessions per backend",
 	}, []string{"backend", "clienttype"})
+	statsHubSessionsCountriesCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "hub",
+		Name:      "sessions_countries",
+		Help:      "The current number of client sessions per backend and country",
+	}, []string{"backend", "country"})
+	statsHubSessionsCountriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "hub",
+		Name:      "sessions_countries_total",
+		Help:      "The total number of client sessions per backend and country",
+	}, []string{"backend", "country"})
 	statsHubSessionResumeFailed = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "signaling",
 		Subsystem: "hub",
 		Name:      "sessions_resume_failed_total",
 		Help:      "The total number of failed session resume requests",
 	})
+	statsHubReconcileDiscrepanciesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "hub",
+		Name:      "reconcile_discrepancies_total",
+		Help:      "The total number of inconsistencies found in the hub state",
+	}, []string{"type"})
+	statsHubReconcileRepairedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "hub",
+		Name:      "reconcile_repaired_total",
+		Help:      "The total number of repaired inconsistencies in the hub state",
+	}, []string{"type"})
 
 	hubStats = []prometheus.Collector{
 		statsHubRoomsCurrent,
 		statsHubSessionsCurrent,
 		statsHubSessionsTotal,
+		statsHubSessionsResumedTotal,
+		statsHubSessionsCountriesCurrent,
+		statsHubSessionsCountriesTotal,
 		statsHubSessionResumeFailed,
+		statsHubReconcileDiscrepanciesTotal,
+		statsHubReconcileRepairedTotal,
 	}
 )
 
 func RegisterHubStats() {
 	registerAll(hubStats...)
 }
+
+// deleteHubBackendStats removes the per-backend series of a backend. The
+// current number of rooms and sessions is only removed if "current" is true,
+// otherwise it will be decremented by the remaining rooms and sessions.
+func deleteHubBackendStats(backend string, current bool) {
+	countries := []string{noCountry, loopback, unknownCountry}
+	for country := range ContinentMap {
+		countries = append(countries, country)
+	}
+
+	for _, clientType := range []string{HelloClientTypeClient, HelloClientTypeInternal, HelloClientTypeVirtual} {
+		if current {
+			statsHubSessionsCurrent.DeleteLabelValues(backend, clientType)
+		}
+		statsHubSessionsTotal.DeleteLabelValues(backend, clientType)
+		statsHubSessionsResumedTotal.DeleteLabelValues(backend, clientType)
+	}
+	for _, country := range countries {
+		if current {
+			statsHubSessionsCountriesCurrent.DeleteLabelValues(backend, country)
+		}
+		statsHubSessionsCountriesTotal.DeleteLabelValues(backend, country)
+	}
+	if current {
+		statsHubRoomsCurrent.DeleteLabelValues(backend)
+	}
+}
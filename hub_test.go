@@ -38,6 +38,8 @@ import (
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const (
@@ -97,15 +99,11 @@ func getTestConfigWithMultipleBackends(server *httptest.Server) (*goconf.ConfigF
 	return config, nil
 }
 
-func CreateHubForTestWithConfig(t *testing.T, getConfigFunc func(*httptest.Server) (*goconf.ConfigFile, error)) (*Hub, NatsClient, *mux.Router, *httptest.Server) {
+func createHubForTestWithNats(t *testing.T, nats NatsClient, getConfigFunc func(*httptest.Server) (*goconf.ConfigFile, error)) (*Hub, *mux.Router, *httptest.Server) {
 	r := mux.NewRouter()
 	registerBackendHandler(t, r)
 
 	server := httptest.NewServer(r)
-	nats, err := NewLoopbackNatsClient()
-	if err != nil {
-		t.Fatal(err)
-	}
 	config, err := getConfigFunc(server)
 	if err != nil {
 		t.Fatal(err)
@@ -124,6 +122,16 @@ func CreateHubForTestWithConfig(t *testing.T, getConfigFunc func(*httptest.Serve
 
 	go h.Run()
 
+	return h, r, server
+}
+
+func CreateHubForTestWithConfig(t *testing.T, getConfigFunc func(*httptest.Server) (*goconf.ConfigFile, error)) (*Hub, NatsClient, *mux.Router, *httptest.Server) {
+	nats, err := NewLoopbackNatsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, r, server := createHubForTestWithNats(t, nats, getConfigFunc)
+
 	t.Cleanup(func() {
 		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 		defer cancel()
@@ -137,6 +145,34 @@ func CreateHubForTestWithConfig(t *testing.T, getConfigFunc func(*httptest.Serve
 	return h, nats, r, server
 }
 
+// CreateClusteredHubsForTest creates two hubs that share a NATS client. Both
+// use the backend of the first server, so sessions of both hubs can join the
+// same rooms.
+func CreateClusteredHubsForTest(t *testing.T) (*Hub, *Hub, *httptest.Server, *httptest.Server) {
+	nats, err := NewLoopbackNatsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, _, server1 := createHubForTestWithNats(t, nats, getTestConfig)
+	h2, _, server2 := createHubForTestWithNats(t, nats, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		return getTestConfig(server1)
+	})
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		WaitForHub(ctx, t, h1)
+		WaitForHub(ctx, t, h2)
+		(nats).(*LoopbackNatsClient).waitForSubscriptionsEmpty(ctx, t)
+		nats.Close()
+		server1.Close()
+		server2.Close()
+	})
+
+	return h1, h2, server1, server2
+}
+
 func CreateHubForTest(t *testing.T) (*Hub, NatsClient, *mux.Router, *httptest.Server) {
 	return CreateHubForTestWithConfig(t, getTestConfig)
 }
@@ -188,14 +224,22 @@ func validateBackendChecksum(t *testing.T, f func(http.ResponseWriter, *http.Req
 			t.Fatal("Error reading body: ", err)
 		}
 
-		rnd := r.Header.Get(HeaderBackendSignalingRandom)
-		checksum := r.Header.Get(HeaderBackendSignalingChecksum)
-		if rnd == "" || checksum == "" {
-			t.Fatalf("No checksum headers found in request to %s", r.URL)
-		}
+		if IsBackendChecksumV2(r) {
+			if !ValidateBackendChecksumV2(r, body, testBackendSecret, time.Now()) {
+				t.Fatalf("Backend checksum v2 verification failed for request to %s", r.URL)
+			}
+		} else if strings.Contains(t.Name(), "ChecksumV2") {
+			t.Fatalf("Expected checksum v2 in request to %s", r.URL)
+		} else {
+			rnd := r.Header.Get(HeaderBackendSignalingRandom)
+			checksum := r.Header.Get(HeaderBackendSignalingChecksum)
+			if rnd == "" || checksum == "" {
+				t.Fatalf("No checksum headers found in request to %s", r.URL)
+			}
 
-		if verify := CalculateBackendChecksum(rnd, body, testBackendSecret); verify != checksum {
-			t.Fatalf("Backend checksum verification failed for request to %s", r.URL)
+			if verify := CalculateBackendChecksum(rnd, body, testBackendSecret); verify != checksum {
+				t.Fatalf("Backend checksum verification failed for request to %s", r.URL)
+			}
 		}
 
 		var request BackendClientRequest
@@ -293,6 +337,14 @@ func processRoomRequest(t *testing.T, w http.ResponseWriter, r *http.Request, re
 			RoomId:  request.Room.RoomId,
 		},
 	}
+	if request.Room.RoomId == "test-room-audiobridge" {
+		properties := json.RawMessage(`{"type":3}`)
+		response.Room.Properties = &properties
+	}
+	if request.Room.RoomId == "test-room-recording-consent" {
+		properties := json.RawMessage(`{"recordingConsent":1}`)
+		response.Room.Properties = &properties
+	}
 	if request.Room.RoomId == "test-room-with-sessiondata" {
 		data := map[string]string{
 			"userid": "userid-from-sessiondata",
@@ -323,12 +375,34 @@ func processSessionRequest(t *testing.T, w http.ResponseWriter, r *http.Request,
 	return response
 }
 
+func processModerationRequest(t *testing.T, w http.ResponseWriter, r *http.Request, request *BackendClientRequest) *BackendClientResponse {
+	if request.Type != "moderation" || request.Moderation == nil {
+		t.Fatalf("Expected a moderation backend request, got %+v", request)
+	}
+
+	response := &BackendClientResponse{
+		Type: "moderation",
+		Moderation: &BackendClientModerationResponse{
+			Version: BackendVersion,
+			RoomId:  request.Moderation.RoomId,
+		},
+	}
+	return response
+}
+
 func processPingRequest(t *testing.T, w http.ResponseWriter, r *http.Request, request *BackendClientRequest) *BackendClientResponse {
 	if request.Type != "ping" || request.Ping == nil {
 		t.Fatalf("Expected an ping backend request, got %+v", request)
 	}
 
-	if request.Ping.RoomId == "test-room-with-sessiondata" {
+	if request.Ping.RoomId == "" {
+		// Batched request, the rooms are contained in the entries.
+		for _, entry := range request.Ping.Entries {
+			if entry.RoomId == "" {
+				t.Errorf("Expected room in batched entry, got %+v", entry)
+			}
+		}
+	} else if request.Ping.RoomId == "test-room-with-sessiondata" {
 		if entries := request.Ping.Entries; len(entries) != 1 {
 			t.Errorf("Expected one entry, got %+v", entries)
 		} else {
@@ -363,6 +437,8 @@ func registerBackendHandlerUrl(t *testing.T, router *mux.Router, url string) {
 			return processSessionRequest(t, w, r, request)
 		case "ping":
 			return processPingRequest(t, w, r, request)
+		case "moderation":
+			return processModerationRequest(t, w, r, request)
 		default:
 			t.Fatalf("Unsupported request received: %+v", request)
 			return nil
@@ -382,6 +458,12 @@ func registerBackendHandlerUrl(t *testing.T, router *mux.Router, url string) {
 		if strings.Contains(t.Name(), "V3Api") {
 			features = append(features, "signaling-v3")
 		}
+		if strings.Contains(t.Name(), "BatchPing") {
+			features = append(features, "signaling-v3", "signaling-batch-ping")
+		}
+		if strings.Contains(t.Name(), "ChecksumV2") {
+			features = append(features, "signaling-checksum-v2")
+		}
 		response := &CapabilitiesResponse{
 			Version: CapabilitiesVersion{
 				Major: 20,
@@ -416,7 +498,7 @@ func registerBackendHandlerUrl(t *testing.T, router *mux.Router, url string) {
 	}
 	router.HandleFunc(url+"ocs/v2.php/cloud/capabilities", handleCapabilitiesFunc)
 
-	if strings.Contains(t.Name(), "V3Api") {
+	if strings.Contains(t.Name(), "V3Api") || strings.Contains(t.Name(), "BatchPing") {
 		router.HandleFunc(url+"ocs/v2.php/apps/spreed/api/v3/signaling/backend", handleFunc)
 	} else {
 		router.HandleFunc(url+"ocs/v2.php/apps/spreed/api/v1/signaling/backend", handleFunc)
@@ -552,6 +634,57 @@ func TestClientHelloAllowAll(t *testing.T) {
 	}
 }
 
+func TestClientHelloCompression(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("app", "websocketcompression", "true")
+		config.AddOption("app", "websocketcompressionthreshold", "100")
+		return config, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	for _, compress := range []bool{false, true} {
+		client := NewTestClientWithDialer(t, server, hub, &websocket.Dialer{
+			EnableCompression: compress,
+		})
+		defer client.Close()
+
+		extensions := client.response.Header.Get("Sec-Websocket-Extensions")
+		if compress && !strings.Contains(extensions, "permessage-deflate") {
+			t.Errorf("Expected compression to be negotiated, got %q", extensions)
+		} else if !compress && extensions != "" {
+			t.Errorf("Expected no extensions, got %q", extensions)
+		}
+
+		// Both compressed and uncompressed messages must be received.
+		if err := client.SendHello(testDefaultUserId); err != nil {
+			t.Fatal(err)
+		}
+
+		if hello, err := client.RunUntilHello(ctx); err != nil {
+			t.Error(err)
+		} else if hello.Hello.UserId != testDefaultUserId {
+			t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+		}
+
+		// The response to "bye" is below the threshold and not compressed.
+		if err := client.SendBye(); err != nil {
+			t.Fatal(err)
+		}
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Error(err)
+		} else if err := checkMessageType(message, "bye"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestClientHelloSessionLimit(t *testing.T) {
 	hub, _, router, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
 		config, err := getTestConfig(server)
@@ -793,6 +926,277 @@ func TestClientHelloResume(t *testing.T) {
 	}
 }
 
+func TestClientHelloSessionStats(t *testing.T) {
+	testcases := map[string]struct {
+		geoip     bool
+		overrides bool
+		country   string
+	}{
+		"NoGeoIp": {},
+		"Overrides": {
+			overrides: true,
+			country:   "DE",
+		},
+		"GeoIp": {
+			geoip:   true,
+			country: loopback,
+		},
+		"GeoIpOverrides": {
+			geoip:     true,
+			overrides: true,
+			country:   "DE",
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+				config, err := getTestConfig(server)
+				if err != nil {
+					return nil, err
+				}
+				if tc.geoip {
+					// The database can't be downloaded, so only loopback addresses
+					// and overrides have a country.
+					config.RemoveOption("geoip", "url")
+					config.AddOption("geoip", "url", server.URL+"/GeoLite2-Country.mmdb")
+				}
+				if tc.overrides {
+					config.AddOption("geoip-overrides", "127.0.0.1", "DE")
+				}
+				return config, nil
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+
+			u, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend := hub.backend.GetBackend(u)
+			if backend == nil {
+				t.Fatalf("Could not get backend for %s", u)
+			}
+			sessions := statsHubSessionsCurrent.WithLabelValues(backend.Id(), HelloClientTypeClient)
+			resumed := statsHubSessionsResumedTotal.WithLabelValues(backend.Id(), HelloClientTypeClient)
+			countries := map[string]prometheus.Gauge{
+				loopback: statsHubSessionsCountriesCurrent.WithLabelValues(backend.Id(), loopback),
+				"DE":     statsHubSessionsCountriesCurrent.WithLabelValues(backend.Id(), "DE"),
+			}
+			sessionsValue := testutil.ToFloat64(sessions)
+			resumedValue := testutil.ToFloat64(resumed)
+			countriesValues := make(map[string]float64)
+			for country, gauge := range countries {
+				countriesValues[country] = testutil.ToFloat64(gauge)
+			}
+			var countriesTotal prometheus.Counter
+			var countriesTotalValue float64
+			if tc.country != "" {
+				countriesTotal = statsHubSessionsCountriesTotal.WithLabelValues(backend.Id(), tc.country)
+				countriesTotalValue = testutil.ToFloat64(countriesTotal)
+			}
+			checkCountries := func(delta float64) {
+				for country, gauge := range countries {
+					if country == tc.country {
+						checkStatsValue(t, gauge, countriesValues[country]+delta)
+					} else {
+						checkStatsValue(t, gauge, countriesValues[country])
+					}
+				}
+			}
+
+			client := NewTestClient(t, server, hub)
+			defer client.CloseWithBye()
+			if err := client.SendHello(testDefaultUserId); err != nil {
+				t.Fatal(err)
+			}
+			hello, err := client.RunUntilHello(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkStatsValue(t, sessions, sessionsValue+1)
+			checkCountries(1)
+			if tc.country != "" {
+				checkStatsValue(t, countriesTotal, countriesTotalValue+1)
+			}
+
+			// The session stays active while the client is disconnected.
+			client.Close()
+			if err := client.WaitForClientRemoved(ctx); err != nil {
+				t.Error(err)
+			}
+			checkStatsValue(t, sessions, sessionsValue+1)
+			checkCountries(1)
+
+			client = NewTestClient(t, server, hub)
+			defer client.CloseWithBye()
+			if err := client.SendHelloResume(hello.Hello.ResumeId); err != nil {
+				t.Fatal(err)
+			}
+			if hello2, err := client.RunUntilHello(ctx); err != nil {
+				t.Fatal(err)
+			} else if hello2.Hello.SessionId != hello.Hello.SessionId {
+				t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+			}
+
+			checkStatsValue(t, sessions, sessionsValue+1)
+			checkStatsValue(t, resumed, resumedValue+1)
+			checkCountries(1)
+			if tc.country != "" {
+				checkStatsValue(t, countriesTotal, countriesTotalValue+1)
+			}
+
+			if err := client.SendBye(); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WaitForSessionRemoved(ctx, hello.Hello.SessionId); err != nil {
+				t.Fatal(err)
+			}
+
+			checkStatsValue(t, sessions, sessionsValue)
+			checkCountries(0)
+		})
+	}
+}
+
+func TestBackendRemovedDeletesStats(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId)
+	if session == nil {
+		t.Fatalf("Could not find session %s", hello.Hello.SessionId)
+	}
+	backend := session.Backend()
+
+	statsHubSessionsCountriesCurrent.WithLabelValues(backend.Id(), "DE").Set(0)
+	statsHubSessionsCountriesTotal.WithLabelValues(backend.Id(), "DE").Inc()
+	checkSeries := func(collector prometheus.Collector, expected bool) {
+		t.Helper()
+		if found := hasStatsSeries(t, collector, "backend", backend.Id()); found != expected {
+			t.Errorf("Expected series for backend %s to exist: %v, got %v", backend.Id(), expected, found)
+		}
+	}
+
+	// The current number of sessions is kept while sessions of the backend exist.
+	hub.BackendRemoved(backend)
+	checkSeries(statsHubSessionsCurrent, true)
+	checkSeries(statsHubSessionsCountriesCurrent, true)
+	checkSeries(statsHubSessionsTotal, false)
+	checkSeries(statsHubSessionsCountriesTotal, false)
+
+	if err := client.SendBye(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WaitForSessionRemoved(ctx, hello.Hello.SessionId); err != nil {
+		t.Fatal(err)
+	}
+
+	hub.BackendRemoved(backend)
+	checkSeries(statsHubSessionsCurrent, false)
+	checkSeries(statsHubSessionsCountriesCurrent, false)
+}
+
+func TestClientHelloResumeThrottle(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	throttler, err := newMemoryThrottler(goconf.NewConfigFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttler.doWait = func(ctx context.Context, delay time.Duration) {}
+	hub.throttler.Close()
+	hub.throttler = throttler
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	for i := 0; i < defaultThrottleMaxAttempts; i++ {
+		if err := client.SendHelloResume("this-is-invalid"); err != nil {
+			t.Fatal(err)
+		}
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, "no_such_session"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := client.SendHelloResume("this-is-invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "too_many_requests"); err != nil {
+		t.Error(err)
+	}
+
+	// Other actions are not affected.
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientHelloThrottleMultipleConnections(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	throttler, err := newMemoryThrottler(goconf.NewConfigFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttler.doWait = func(ctx context.Context, delay time.Duration) {}
+	hub.throttler.Close()
+	hub.throttler = throttler
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	params := ClientTypeInternalAuthParams{
+		Random:  newRandomString(48),
+		Token:   "invalid-token",
+		Backend: server.URL,
+	}
+	// Every connection uses a different source port, the failed attempts must
+	// still be counted for the same address.
+	for i := 0; i <= defaultThrottleMaxAttempts; i++ {
+		client := NewTestClient(t, server, hub)
+		if err := client.SendHelloParams("", "internal", params); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "invalid_token"
+		if i == defaultThrottleMaxAttempts {
+			expected = "too_many_requests"
+		}
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, expected); err != nil {
+			t.Errorf("attempt %d: %s", i+1, err)
+		}
+		client.CloseWithBye()
+	}
+}
+
 func TestClientHelloResumeExpired(t *testing.T) {
 	hub, _, _, server := CreateHubForTest(t)
 
@@ -1298,72 +1702,183 @@ func TestClientHelloInternal(t *testing.T) {
 		if hello.Hello.ResumeId == "" {
 			t.Errorf("Expected resume id, got %+v", hello.Hello)
 		}
+		if hello.Hello.Internal != nil {
+			t.Errorf("Expected no internal feature versions, got %+v", hello.Hello.Internal)
+		}
 	}
 }
 
-func TestClientMessageToSessionId(t *testing.T) {
+func TestClientHelloInternalFeatureVersions(t *testing.T) {
 	hub, _, _, server := CreateHubForTest(t)
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
-		t.Fatal(err)
-	}
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHelloInternalWithFeatures([]string{ClientFeatureInternalRecording}); err != nil {
 		t.Fatal(err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-	hello2, err := client2.RunUntilHello(ctx)
+	hello, err := client.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if hello1.Hello.SessionId == hello2.Hello.SessionId {
-		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
-	}
-
-	recipient1 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
+	if hello.Hello.Internal == nil {
+		t.Fatalf("Expected internal feature versions, got %+v", hello.Hello)
+	} else if expected := map[string]int{ClientFeatureInternalRecording: 1}; !reflect.DeepEqual(expected, hello.Hello.Internal.Versions) {
+		t.Errorf("Expected versions %+v, got %+v", expected, hello.Hello.Internal.Versions)
+	} else if len(hello.Hello.Internal.Unsupported) != 0 {
+		t.Errorf("Expected no unsupported features, got %+v", hello.Hello.Internal.Unsupported)
 	}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient2, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient1, data2) // nolint
-
-	var payload string
-	if err := checkReceiveClientMessage(ctx, client1, "session", hello2.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data2 {
-		t.Errorf("Expected payload %s, got %s", data2, payload)
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if version := session.GetFeatureVersion(ClientFeatureInternalRecording); version != 1 {
+		t.Errorf("Expected version 1 for recording, got %d", version)
 	}
-	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if payload != data1 {
-		t.Errorf("Expected payload %s, got %s", data1, payload)
+	if version := session.GetFeatureVersion(ClientFeatureInternalTranscription); version != 0 {
+		t.Errorf("Expected transcription to be unsupported, got %d", version)
 	}
 }
 
-func TestClientMessageToUserId(t *testing.T) {
-	hub, _, _, server := CreateHubForTest(t)
+func TestClientHelloIceServers(t *testing.T) {
+	var config *goconf.ConfigFile
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		var err error
+		if config, err = getTestConfig(server); err != nil {
+			return nil, err
+		}
+
+		config.AddOption("turn", "apikey", turnApiKey)
+		config.AddOption("turn", "secret", turnSecret)
+		config.AddOption("turn", "servers", turnServersString)
+		return config, nil
+	})
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+	if err := client1.SendHelloWithFeatures(testDefaultUserId+"1", []string{ClientFeatureIceServers}); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFeature(hello1.Hello.Server, ServerFeatureIceServers) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureIceServers, hello1.Hello.Server.Features)
+	}
+	if hello1.Hello.IceServers == nil {
+		t.Errorf("Expected ICE servers, got %+v", hello1.Hello)
+	} else if !reflect.DeepEqual(hello1.Hello.IceServers.URIs, turnServers) {
+		t.Errorf("Expected servers %s, got %s", turnServers, hello1.Hello.IceServers.URIs)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello2.Hello.IceServers != nil {
+		t.Errorf("Expected no ICE servers, got %+v", hello2.Hello.IceServers)
+	}
+
+	config.AddOption("turn", "servers", "turn:5.6.7.8:3478")
+	hub.Reload(config)
+
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Error(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Error(err)
+	} else if message.Event.Target != "iceservers" || message.Event.Type != "update" || message.Event.IceServers == nil {
+		t.Errorf("Expected ICE servers update, got %+v", message.Event)
+	} else if !reflect.DeepEqual(message.Event.IceServers.URIs, []string{"turn:5.6.7.8:3478"}) {
+		t.Errorf("Expected updated servers, got %s", message.Event.IceServers.URIs)
+	}
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	if message, err := client2.RunUntilMessage(ctx2); err == nil {
+		t.Errorf("Expected no message, got %+v", message)
+	} else if err != ErrNoMessageReceived && err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+}
+
+func TestClientMessageToSessionId(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello1.Hello.SessionId == hello2.Hello.SessionId {
+		t.Fatalf("Expected different session ids, got %s twice", hello1.Hello.SessionId)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient2, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient1, data2) // nolint
+
+	var payload string
+	if err := checkReceiveClientMessage(ctx, client1, "session", hello2.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data2 {
+		t.Errorf("Expected payload %s, got %s", data2, payload)
+	}
+	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data1 {
+		t.Errorf("Expected payload %s, got %s", data1, payload)
+	}
+}
+
+func TestClientMessageToUserId(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
 	client2 := NewTestClient(t, server, hub)
@@ -1614,6 +2129,129 @@ func TestClientMessageToRoom(t *testing.T) {
 	}
 }
 
+func TestClientMessageToRoomHistory(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("app", "roomhistory", "10")
+		return config, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasFeature(hello1.Hello.Server, ServerFeatureRoomHistory) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureRoomHistory, hello1.Hello.Server.Features)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+	data := "sent-before-join"
+	if err := client1.SendMessage(recipient, data); err != nil {
+		t.Fatal(err)
+	}
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	for len(room.GetHistory("")) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Message was not added to the history")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if messages := room.GetHistory(hello1.Hello.SessionId); len(messages) != 0 {
+		t.Errorf("Messages of the session should not be replayed, got %+v", messages)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHelloWithFeatures(testDefaultUserId+"2", []string{ClientFeatureRoomHistory}); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	// The history is replayed after the existing sessions of the room were sent.
+	_, unexpected, err := client2.RunUntilJoinedAndReturn(ctx, hello1.Hello, hello2.Hello)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(unexpected) != 1 {
+		t.Fatalf("Expected one replayed message, got %+v", unexpected)
+	}
+
+	var payload string
+	message := unexpected[0]
+	if err := checkMessageType(message, "message"); err != nil {
+		t.Error(err)
+	} else if err := checkMessageSender(hub, message.Message, "room", hello1.Hello); err != nil {
+		t.Error(err)
+	} else if err := json.Unmarshal(*message.Message.Data, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data || !message.Message.History {
+		t.Errorf("Expected replayed message %s, got %+v", data, message.Message)
+	}
+
+	// Clients that don't support the history don't get old messages.
+	client3 := NewTestClient(t, server, hub)
+	defer client3.CloseWithBye()
+	if err := client3.SendHello(testDefaultUserId + "3"); err != nil {
+		t.Fatal(err)
+	}
+	hello3, err := client3.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room, err := client3.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client3.RunUntilJoined(ctx, hello1.Hello, hello2.Hello, hello3.Hello); err != nil {
+		t.Error(err)
+	}
+
+	data = "sent-after-join"
+	if err := client1.SendMessage(recipient, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkReceiveClientMessage(ctx, client3, "room", hello1.Hello, &payload); err != nil {
+		t.Error(err)
+	} else if payload != data {
+		t.Errorf("Expected payload %s, got %s", data, payload)
+	}
+}
+
 func TestJoinRoom(t *testing.T) {
 	hub, _, _, server := CreateHubForTest(t)
 
@@ -2011,7 +2649,7 @@ func TestGetRealUserIP(t *testing.T) {
 	request := &http.Request{
 		RemoteAddr: REMOTE_ATTR,
 	}
-	if ip := getRealUserIP(request); ip != REMOTE_ATTR {
+	if ip := getRealUserIP(request, nil); ip != REMOTE_ATTR {
 		t.Errorf("Expected %s but got %s", REMOTE_ATTR, ip)
 	}
 
@@ -2019,7 +2657,7 @@ func TestGetRealUserIP(t *testing.T) {
 	request.Header = http.Header{
 		http.CanonicalHeaderKey("x-real-ip"): []string{X_REAL_IP},
 	}
-	if ip := getRealUserIP(request); ip != X_REAL_IP {
+	if ip := getRealUserIP(request, nil); ip != X_REAL_IP {
 		t.Errorf("Expected %s but got %s", X_REAL_IP, ip)
 	}
 
@@ -2030,18 +2668,66 @@ func TestGetRealUserIP(t *testing.T) {
 		http.CanonicalHeaderKey("x-real-ip"):       []string{X_REAL_IP},
 		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
 	}
-	if ip := getRealUserIP(request); ip != X_REAL_IP {
+	if ip := getRealUserIP(request, nil); ip != X_REAL_IP {
 		t.Errorf("Expected %s but got %s", X_REAL_IP, ip)
 	}
 
 	request.Header = http.Header{
 		http.CanonicalHeaderKey("x-forwarded-for"): []string{X_FORWARDED_FOR},
 	}
-	if ip := getRealUserIP(request); ip != X_FORWARDED_FOR_IP {
+	if ip := getRealUserIP(request, nil); ip != X_FORWARDED_FOR_IP {
 		t.Errorf("Expected %s but got %s", X_FORWARDED_FOR_IP, ip)
 	}
 }
 
+func TestGetRealUserIPTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies("192.168.0.0/24, 10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &http.Request{
+		RemoteAddr: "1.2.3.4:1234",
+		Header: http.Header{
+			http.CanonicalHeaderKey("x-real-ip"): []string{"5.6.7.8"},
+		},
+	}
+	// Headers from untrusted addresses are ignored.
+	if ip := getRealUserIP(request, trusted); ip != request.RemoteAddr {
+		t.Errorf("Expected %s but got %s", request.RemoteAddr, ip)
+	}
+
+	request.RemoteAddr = "192.168.0.10:1234"
+	if ip := getRealUserIP(request, trusted); ip != "5.6.7.8" {
+		t.Errorf("Expected %s but got %s", "5.6.7.8", ip)
+	}
+
+	// The first untrusted address from the right is used, previous entries
+	// could have been sent by the client.
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{"9.9.9.9, 5.6.7.8, 10.0.0.1"},
+	}
+	if ip := getRealUserIP(request, trusted); ip != "5.6.7.8" {
+		t.Errorf("Expected %s but got %s", "5.6.7.8", ip)
+	}
+
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{"192.168.0.20, 10.0.0.1"},
+	}
+	if ip := getRealUserIP(request, trusted); ip != "192.168.0.20" {
+		t.Errorf("Expected %s but got %s", "192.168.0.20", ip)
+	}
+
+	// Requests received through a Unix domain socket come from a local proxy.
+	request.RemoteAddr = "@"
+	request.Header = http.Header{
+		http.CanonicalHeaderKey("x-forwarded-for"): []string{"9.9.9.9, 5.6.7.8"},
+	}
+	if ip := getRealUserIP(request, trusted); ip != "5.6.7.8" {
+		t.Errorf("Expected %s but got %s", "5.6.7.8", ip)
+	}
+}
+
 func TestClientMessageToSessionIdWhileDisconnected(t *testing.T) {
 	hub, _, _, server := CreateHubForTest(t)
 
@@ -2240,17 +2926,47 @@ func TestRoomParticipantsListUpdateWhileDisconnected(t *testing.T) {
 		}
 	}
 
-	// The participants list update event is triggered again after the session resume.
+	// The participants list update event is triggered again after the session
+	// resume. It has a lower priority, so it could be received after the chat
+	// refresh.
 	// TODO(jojo): Check contents of message and try with multiple users.
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
-		t.Error(err)
-	}
-
 	var payload map[string]interface{}
-	if err := checkReceiveClientMessage(ctx, client2, "session", hello1.Hello, &payload); err != nil {
-		t.Error(err)
-	} else if !reflect.DeepEqual(payload, data1) {
-		t.Errorf("Expected payload %+v, got %+v", data1, payload)
+	var receivedUpdate, receivedMessage bool
+	for i := 0; i < 2; i++ {
+		message, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type == "event" {
+			if receivedUpdate {
+				t.Errorf("Received duplicate update event %+v", message.Event)
+			}
+			receivedUpdate = true
+			if message.Event.Type != "update" {
+				t.Errorf("Expected update event, got %+v", message.Event)
+			}
+		} else if err := checkMessageType(message, "message"); err != nil {
+			t.Error(err)
+		} else {
+			if receivedMessage {
+				t.Errorf("Received duplicate message %+v", message.Message)
+			}
+			receivedMessage = true
+			if err := checkMessageSender(hub, message.Message, "session", hello1.Hello); err != nil {
+				t.Error(err)
+			} else if err := json.Unmarshal(*message.Message.Data, &payload); err != nil {
+				t.Error(err)
+			} else if !reflect.DeepEqual(payload, data1) {
+				t.Errorf("Expected payload %+v, got %+v", data1, payload)
+			}
+		}
+	}
+	if !receivedUpdate {
+		t.Error("Expected participants list update event")
+	}
+	if !receivedMessage {
+		t.Error("Expected chat refresh message")
 	}
 
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
@@ -2868,7 +3584,7 @@ loop:
 	}
 }
 
-func TestClientRequestOfferNotInRoom(t *testing.T) {
+func TestClientSendOfferPermissionsBitmap(t *testing.T) {
 	hub, _, _, server := CreateHubForTest(t)
 
 	mcu, err := NewTestMCU()
@@ -2896,260 +3612,2001 @@ func TestClientRequestOfferNotInRoom(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
-
-	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
-		t.Fatal(err)
-	}
-
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	// Join room by id.
 	roomId := "test-room"
-	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, "roomsession1"); err != nil {
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
 
-	// We will receive a "joined" event.
 	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
 		t.Error(err)
 	}
 
-	// Client 2 may not request an offer (he is not in the room yet).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL, PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_SCREEN})
+
+	var pubs []McuPublisher
+	for _, roomType := range []string{"video", "screen"} {
+		if err := client1.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello1.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "offer",
+			Sid:      "54321",
+			RoomType: roomType,
+			Payload: map[string]interface{}{
+				"sdp": MockSdpOfferAudioAndVideo,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+			t.Fatal(err)
+		}
+
+		if pub := session1.GetPublisher(roomType); pub == nil {
+			t.Fatalf("expected %s publisher", roomType)
+		} else {
+			pubs = append(pubs, pub)
+		}
+	}
+
+	// Client is only allowed to send audio, this will stop both publishers.
+	msg := &BackendServerRoomRequest{
+		Type: "participants",
+		Participants: &BackendRoomParticipantsRequest{
+			Changed: []map[string]interface{}{
+				{
+					"sessionId":              roomId + "-" + hello1.Hello.SessionId,
+					"participantPermissions": ParticipantPermissionPublishAudio | ParticipantPermissionChat,
+				},
+			},
+			Users: []map[string]interface{}{
+				{
+					"sessionId":              roomId + "-" + hello1.Hello.SessionId,
+					"participantPermissions": ParticipantPermissionPublishAudio | ParticipantPermissionChat,
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+
+	for _, pub := range pubs {
+		for !pub.(*TestMCUPublisher).isClosed() {
+			if err := ctx2.Err(); err != nil {
+				t.Fatalf("publisher %s was not closed: %s", pub.Id(), err)
+			}
+
+			// Give some time to async processing.
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Permissions that are not part of the bitmap are kept.
+	assertSessionHasPermission(t, session1, PERMISSION_MAY_CONTROL)
+	assertSessionHasPermission(t, session1, PERMISSION_MAY_PUBLISH_AUDIO)
+	assertSessionHasPermission(t, session1, PERMISSION_MAY_CHAT)
+	assertSessionHasNotPermission(t, session1, PERMISSION_MAY_PUBLISH_MEDIA)
+	assertSessionHasNotPermission(t, session1, PERMISSION_MAY_PUBLISH_VIDEO)
+	assertSessionHasNotPermission(t, session1, PERMISSION_MAY_PUBLISH_SCREEN)
+}
+
+func TestClientSessionMetadata(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasFeature(hello1.Hello.Server, ServerFeatureSessionMetadata) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureSessionMetadata, hello1.Hello.Server.Features)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata can be set before joining a room.
+	if err := client1.WriteJSON(&ClientMessage{
+		Id:   "set-1",
+		Type: "session",
+		Session: &SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				"device": "mobile",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "session"); err != nil {
+		t.Fatal(err)
+	} else if message.Id != "set-1" || message.Session.SessionId != hello1.Hello.SessionId || message.Session.Metadata["device"] != "mobile" {
+		t.Errorf("Unexpected response %+v", message.Session)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Room %s not found", roomId)
+	}
+	if users := room.addInternalSessions([]map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+		},
+	}); len(users) != 1 {
+		t.Errorf("Expected one user, got %+v", users)
+	} else if metadata, ok := users[0]["metadata"].(map[string]interface{}); !ok || metadata["device"] != "mobile" {
+		t.Errorf("Expected metadata of joined session, got %+v", users[0])
+	}
+
+	// Changes are sent to the other participants, null values remove keys.
+	if err := client1.WriteJSON(&ClientMessage{
+		Type: "session",
+		Session: &SessionClientMessage{
+			Type: "set",
+			Metadata: map[string]interface{}{
+				"device":    nil,
+				"audioonly": true,
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Target != "participants" || message.Event.Type != "update" {
+		t.Errorf("Expected participants update, got %+v", message.Event)
+	} else {
+		var changed map[string]interface{}
+		for _, user := range message.Event.Update.Users {
+			if user["sessionId"] == hello1.Hello.SessionId {
+				changed = user
+				break
+			}
+		}
+		if changed == nil {
+			t.Errorf("Expected change of %s, got %+v", hello1.Hello.SessionId, message.Event.Update.Users)
+		} else if metadata, ok := changed["metadata"].(map[string]interface{}); !ok || len(metadata) != 1 || metadata["audioonly"] != true {
+			t.Errorf("Unexpected metadata in %+v", changed)
+		}
+	}
+
+	getMetadata := func() *ClientMessage {
+		return &ClientMessage{
+			Id:   "get-1",
+			Type: "session",
+			Session: &SessionClientMessage{
+				Type:      "get",
+				SessionId: hello1.Hello.SessionId,
+			},
+		}
+	}
+
+	// Only moderators may get the metadata of other sessions.
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if err := client2.WriteJSON(getMetadata()); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	session2.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	if err := client2.WriteJSON(getMetadata()); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "session"); err != nil {
+		t.Fatal(err)
+	} else if message.Id != "get-1" || message.Session.SessionId != hello1.Hello.SessionId || len(message.Session.Metadata) != 1 || message.Session.Metadata["audioonly"] != true {
+		t.Errorf("Unexpected metadata %+v", message.Session)
+	}
+}
+
+func TestClientMuteState(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	// Forwarded "mute" messages might arrive before or after the update.
+	runUntilParticipantsUpdate := func(client *TestClient) *ServerMessage {
+		t.Helper()
+		for {
+			message, err := client.RunUntilMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if message.Type == "message" {
+				continue
+			} else if err := checkMessageType(message, "event"); err != nil {
+				t.Fatal(err)
+			} else if message.Event.Target != "participants" || message.Event.Type != "update" {
+				t.Fatalf("Expected participants update, got %+v", message.Event)
+			}
+			return message
+		}
+	}
+
+	checkMuteUpdate := func(message *ServerMessage, audio bool, video bool) {
+		t.Helper()
+		for _, user := range message.Event.Update.Users {
+			if user["sessionId"] != hello1.Hello.SessionId {
+				continue
+			}
+
+			if muted, ok := user["muted"].(map[string]interface{}); !ok || muted["audio"] != audio || muted["video"] != video {
+				t.Errorf("Expected audio muted %v and video muted %v, got %+v", audio, video, user)
+			}
+			return
+		}
+		t.Errorf("Expected entry for %s, got %+v", hello1.Hello.SessionId, message.Event.Update.Users)
+	}
+
+	// Clients notify the other participants when muting their media.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type: "room",
+	}, MessageClientMessageData{
+		Type:     "mute",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"name": "audio",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMuteUpdate(runUntilParticipantsUpdate(client1), true, false)
+	checkMuteUpdate(runUntilParticipantsUpdate(client2), true, false)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if muted := session1.GetMutedMedia(); muted != MediaTypeAudio {
+		t.Errorf("Expected muted audio, got %d", muted)
+	}
+	if info := newSessionAdminInformation(session1); info.Muted == nil || !info.Muted.Audio || info.Muted.Video {
+		t.Errorf("Expected muted audio in admin information, got %+v", info.Muted)
+	}
+
+	// Sessions joining later see the current state in the participants list.
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Room %s not found", roomId)
+	}
+	if users := room.addInternalSessions([]map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+		},
+	}); len(users) != 1 {
+		t.Errorf("Expected one user, got %+v", users)
+	} else if muted, ok := users[0]["muted"].(*SessionMuteState); !ok || !muted.Audio || muted.Video {
+		t.Errorf("Expected mute state of session, got %+v", users[0])
+	}
+
+	// Media events of the MCU update the state of the camera publisher.
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := session1.GetPublisher(streamTypeVideo)
+	if publisher == nil {
+		t.Fatal("Expected publisher")
+	}
+	session1.PublisherMediaChanged(publisher, MediaTypeVideo, false)
+	checkMuteUpdate(runUntilParticipantsUpdate(client2), true, true)
+
+	session1.PublisherMediaChanged(publisher, MediaTypeAudio, true)
+	checkMuteUpdate(runUntilParticipantsUpdate(client2), false, true)
+	session1.PublisherMediaChanged(publisher, MediaTypeVideo, true)
+	checkMuteUpdate(runUntilParticipantsUpdate(client2), false, false)
+	if users := room.addInternalSessions([]map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+		},
+	}); len(users) != 1 {
+		t.Errorf("Expected one user, got %+v", users)
+	} else if _, found := users[0]["muted"]; found {
+		t.Errorf("Expected no mute state, got %+v", users[0])
+	}
+}
+
+func TestClientActiveSpeaker(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "activespeakerinterval", "10")
+		return config, nil
+	})
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasFeature(hello1.Hello.Server, ServerFeatureActiveSpeaker) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureActiveSpeaker, hello1.Hello.Server.Features)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := session1.GetPublisher(streamTypeVideo)
+	if publisher == nil {
+		t.Fatal("Expected publisher")
+	}
+	session1.PublisherTalking(publisher, true, 30)
+
+	for _, client := range []*TestClient{client1, client2} {
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(message, "event"); err != nil {
+			t.Fatal(err)
+		} else if message.Event.Target != "room" || message.Event.Type != "speaker" {
+			t.Errorf("Expected speaker event, got %+v", message.Event)
+		} else if message.Event.Speaker.SessionId != hello1.Hello.SessionId {
+			t.Errorf("Expected %s as dominant speaker, got %+v", hello1.Hello.SessionId, message.Event.Speaker)
+		}
+	}
+}
+
+func TestClientPrewarmSubscribers(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "activespeakerinterval", "10")
+		config.AddOption("mcu", "prewarmsubscribers", "2")
+		return config, nil
+	})
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	users1 := []map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+			"inCall":    FlagInCall | FlagWithVideo,
+		},
+	}
+	room.PublishUsersInCallChanged(users1, users1)
+	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := session1.GetPublisher(streamTypeVideo)
+	if publisher == nil {
+		t.Fatal("Expected publisher")
+	}
+	session1.PublisherTalking(publisher, true, 30)
+
+	for room.speakers.GetDominantSpeaker() != hello1.Hello.SessionId {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if sub := session2.GetSubscriber(hello1.Hello.SessionId, streamTypeVideo); sub != nil {
+		t.Fatalf("Expected no subscriber before joining the call, got %+v", sub)
+	}
+
+	users2 := []map[string]interface{}{
+		{
+			"sessionId": hello2.Hello.SessionId,
+			"inCall":    FlagInCall | FlagWithVideo,
+		},
+	}
+	room.PublishUsersInCallChanged(users2, append(users1, users2...))
+
+	// The video of the recent speaker is subscribed without an explicit request.
+	for session2.GetSubscriber(hello1.Hello.SessionId, streamTypeVideo) == nil {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if sub := session1.GetSubscriber(hello1.Hello.SessionId, streamTypeVideo); sub != nil {
+		t.Errorf("Speaker should not subscribe its own stream, got %+v", sub)
+	}
+}
+
+func TestClientModeration(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_SCREEN})
+
+	for _, roomType := range []string{"video", "screen"} {
+		if err := client2.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello2.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "offer",
+			Sid:      "54321",
+			RoomType: roomType,
+			Payload: map[string]interface{}{
+				"sdp": MockSdpOfferAudioAndVideo,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client2.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Regular participants may not moderate others.
+	if err := client2.SendModeration("mute", hello1.Hello.SessionId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := session2.GetPublisher(streamTypeVideo).(*TestMCUPublisher)
+	if err := client1.SendModeration("mute", hello2.Hello.SessionId, ""); err != nil {
+		t.Fatal(err)
+	}
+	// The participants are notified about the changed mute state.
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "event"); err != nil {
+		t.Fatal(err)
+	} else if message.Event.Target != "participants" {
+		t.Errorf("Expected participants update, got %+v", message.Event)
+	}
+	for i := 0; i < 2; i++ {
+		message, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type == "event" {
+			if message.Event.Target != "participants" {
+				t.Errorf("Expected participants update, got %+v", message.Event)
+			}
+		} else if err := checkMessageType(message, "moderation"); err != nil {
+			t.Fatal(err)
+		} else if message.Moderation.Type != "mute" || message.Moderation.Media != "audio" || message.Moderation.Actor != hello1.Hello.SessionId {
+			t.Errorf("Unexpected moderation message %+v", message.Moderation)
+		}
+	}
+	if muted := session2.GetMutedMedia(); muted != MediaTypeAudio {
+		t.Errorf("Expected muted audio, got %d", muted)
+	}
+	if !pub.isMuted(MediaTypeAudio) {
+		t.Error("Expected audio to be muted")
+	} else if pub.isMuted(MediaTypeVideo) {
+		t.Error("Expected video not to be muted")
+	}
+
+	screen := session2.GetPublisher(streamTypeScreen).(*TestMCUPublisher)
+	if err := client1.SendModeration("stopscreen", hello2.Hello.SessionId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "moderation"); err != nil {
+		t.Fatal(err)
+	} else if message.Moderation.Type != "stopscreen" {
+		t.Errorf("Unexpected moderation message %+v", message.Moderation)
+	}
+	if session2.GetPublisher(streamTypeScreen) != nil {
+		t.Error("Expected screen publisher to be removed")
+	}
+
+	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+	for !screen.isClosed() {
+		if err := ctx2.Err(); err != nil {
+			t.Fatalf("screen publisher was not closed: %s", err)
+		}
+
+		// Give some time to async processing.
+		time.Sleep(time.Millisecond)
+	}
+	if pub.isClosed() {
+		t.Error("Expected video publisher to be still open")
+	}
+
+	// Sessions must be in the same room.
+	if err := client1.SendModeration("lowerhand", "invalid-session", ""); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "no_such_session"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRequestOfferNotInRoom(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoomWithRoomSession(ctx, roomId, "roomsession1"); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may not request an offer (he is not in the room yet).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// We will receive a "joined" event.
+	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may not request an offer (he is not in the call yet).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate request from the backend that somebody joined the call.
+	users1 := []map[string]interface{}{
+		{
+			"sessionId": hello2.Hello.SessionId,
+			"inCall":    1,
+		},
+	}
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	room.PublishUsersInCallChanged(users1, users1)
+	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may not request an offer (recipient is not in the call yet).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate request from the backend that somebody joined the call.
+	users2 := []map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+			"inCall":    1,
+		},
+	}
+	room.PublishUsersInCallChanged(users2, users2)
+	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
+		t.Error(err)
+	}
+
+	// Client 2 may request an offer now (both are in the same room and call).
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		// We check for "client_not_found" as the testing MCU doesn't support publishing/subscribing.
+		if err := checkMessageError(msg, "client_not_found"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+type testVideoSubscriber struct {
+	McuSubscriber
+}
+
+func (s *testVideoSubscriber) StreamType() string {
+	return streamTypeVideo
+}
+
+func TestClientVideoSubscriberLimit(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "videosubscribertiers", "3:1")
+		return config, nil
+	})
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+
+	requestOffer := func(streamType string, expectedError string) *ServerMessage {
+		if err := client2.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello1.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "requestoffer",
+			Sid:      "12345",
+			RoomType: streamType,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(msg, expectedError); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	users := []map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+			"inCall":    1,
+		},
+		{
+			"sessionId": hello2.Hello.SessionId,
+			"inCall":    1,
+		},
+	}
+	room.PublishUsersInCallChanged(users, users)
+	for _, client := range []*TestClient{client1, client2} {
+		if err := checkReceiveClientEvent(ctx, client, "update", nil); err != nil {
+			t.Error(err)
+		}
+	}
+	if size := room.GetCallSize(); size != 2 {
+		t.Errorf("Expected call size 2, got %d", size)
+	}
+
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.mu.Lock()
+	if session2.subscribers == nil {
+		session2.subscribers = make(map[string]McuSubscriber)
+	}
+	session2.subscribers["other-session|"+streamTypeVideo] = &testVideoSubscriber{}
+	session2.mu.Unlock()
+	defer func() {
+		session2.mu.Lock()
+		delete(session2.subscribers, "other-session|"+streamTypeVideo)
+		session2.mu.Unlock()
+	}()
+
+	// The number of subscribers is not limited for small calls. We check for
+	// "client_not_found" as the testing MCU doesn't support subscribing.
+	requestOffer(streamTypeVideo, "client_not_found")
+
+	users = append(users, map[string]interface{}{
+		"sessionId": "other-session",
+		"inCall":    1,
+	})
+	room.PublishUsersInCallChanged(users[2:], users)
+	for _, client := range []*TestClient{client1, client2} {
+		if err := checkReceiveClientEvent(ctx, client, "update", nil); err != nil {
+			t.Error(err)
+		}
+	}
+	if size := room.GetCallSize(); size != 3 {
+		t.Errorf("Expected call size 3, got %d", size)
+	}
+
+	msg := requestOffer(streamTypeVideo, "too_many_subscriptions")
+	var details TooManySubscriptionsDetails
+	if data, err := json.Marshal(msg.Error.Details); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &details); err != nil {
+		t.Fatal(err)
+	} else if details.MaxSubscriptions != 1 || details.Participants != 3 {
+		t.Errorf("Unexpected error details %+v", details)
+	}
+
+	// Screensharing streams are not limited.
+	requestOffer(streamTypeScreen, "client_not_found")
+}
+
+func TestNoSendBetweenSessionsOnDifferentBackends(t *testing.T) {
+	// Clients can't send messages to sessions connected from other backends.
+	hub, _, _, server := CreateHubWithMultipleBackendsForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	params1 := TestBackendClientAuthParams{
+		UserId: "user1",
+	}
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	params2 := TestBackendClientAuthParams{
+		UserId: "user2",
+	}
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient1 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}
+	recipient2 := MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.Hello.SessionId,
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient2, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient1, data2) // nolint
+
+	var payload string
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel3()
+	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+}
+
+func TestNoSameRoomOnDifferentBackends(t *testing.T) {
+	hub, _, _, server := CreateHubWithMultipleBackendsForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	params1 := TestBackendClientAuthParams{
+		UserId: "user1",
+	}
+	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+
+	params2 := TestBackendClientAuthParams{
+		UserId: "user2",
+	}
+	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	msg1, err := client1.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := client1.checkMessageJoined(msg1, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	msg2, err := client2.RunUntilMessage(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := client2.checkMessageJoined(msg2, hello2.Hello); err != nil {
+		t.Error(err)
+	}
+
+	hub.ru.RLock()
+	var rooms []*Room
+	for _, room := range hub.rooms {
+		defer room.Close()
+		rooms = append(rooms, room)
+	}
+	hub.ru.RUnlock()
+
+	if len(rooms) != 2 {
+		t.Errorf("Expected 2 rooms, got %+v", rooms)
+	}
+
+	if rooms[0].IsEqual(rooms[1]) {
+		t.Errorf("Rooms should be different: %+v", rooms)
+	}
+
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+
+	data1 := "from-1-to-2"
+	client1.SendMessage(recipient, data1) // nolint
+	data2 := "from-2-to-1"
+	client2.SendMessage(recipient, data2) // nolint
+
+	var payload string
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel3()
+	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
+		if err != ErrNoMessageReceived {
+			t.Error(err)
+		}
+	} else {
+		t.Errorf("Expected no payload, got %+v", payload)
+	}
+}
+
+func TestClientRtpForward(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "rtpforwardhosts", "127.0.0.1")
+		return config, nil
+	})
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+
+	start := &RtpForwardClientMessage{
+		Type:      "start",
+		SessionId: hello1.Hello.SessionId,
+		Host:      "127.0.0.1",
+		AudioPort: 5002,
+		VideoPort: 5004,
+	}
+
+	// Only moderators may forward streams.
+	if err := client1.SendRtpForward(start); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_CONTROL})
+	if err := client1.SendRtpForward(start); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "no_such_publisher"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
 		SessionId: hello1.Hello.SessionId,
 	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Streams may only be forwarded to configured hosts.
+	invalid := *start
+	invalid.Host = "192.168.0.1"
+	if err := client1.SendRtpForward(&invalid); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.SendRtpForward(start); err != nil {
+		t.Fatal(err)
+	}
+	var streamIds []uint64
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "rtpforward"); err != nil {
 		t.Fatal(err)
+	} else if msg.RtpForward.Type != "started" || len(msg.RtpForward.Streams) != 2 {
+		t.Fatalf("Expected two started streams, got %+v", msg.RtpForward)
 	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
+		for _, stream := range msg.RtpForward.Streams {
+			streamIds = append(streamIds, stream.StreamId)
+		}
+	}
+
+	publisher := mcu.GetPublisher(hello1.Hello.SessionId)
+	if count := publisher.getRtpForwards(); count != 2 {
+		t.Errorf("Expected 2 forwarded streams, got %d", count)
+	}
+
+	if err := client1.SendRtpForward(&RtpForwardClientMessage{
+		Type:      "stop",
+		SessionId: hello1.Hello.SessionId,
+		StreamIds: streamIds,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "rtpforward"); err != nil {
+		t.Fatal(err)
+	} else if msg.RtpForward.Type != "stopped" || !reflect.DeepEqual(msg.RtpForward.StreamIds, streamIds) {
+		t.Fatalf("Expected stopped streams %+v, got %+v", streamIds, msg.RtpForward)
+	}
+
+	if count := publisher.getRtpForwards(); count != 0 {
+		t.Errorf("Expected no forwarded streams, got %d", count)
+	}
+}
+
+func waitForMaxBitrate(ctx context.Context, t *testing.T, publisher *TestMCUPublisher, expected int) {
+	for publisher.getMaxBitrate() != expected {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Expected maximum bitrate %d for %s, got %d", expected, publisher.Id(), publisher.getMaxBitrate())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestClientBitratePolicy(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "bitratetiers", "2:100000")
+		return config, nil
+	})
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
 			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 		}
 	}
 
-	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	publish := func(client *TestClient, hello *ServerMessage) *TestMCUPublisher {
+		session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+		session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+
+		if err := client.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "offer",
+			Sid:      "54321",
+			RoomType: "video",
+			Payload: map[string]interface{}{
+				"sdp": MockSdpOfferAudioAndVideo,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+			t.Fatal(err)
+		}
+
+		return mcu.GetPublisher(hello.Hello.SessionId)
+	}
+
+	publisher1 := publish(client1, hello1)
+	// Publishing alone is not limited.
+	time.Sleep(10 * time.Millisecond)
+	if bitrate := publisher1.getMaxBitrate(); bitrate != 0 {
+		t.Errorf("Expected no bitrate limit, got %d", bitrate)
+	}
+
+	publisher2 := publish(client2, hello2)
+	waitForMaxBitrate(ctx, t, publisher1, 100000)
+	waitForMaxBitrate(ctx, t, publisher2, 100000)
+
+	// The limit is removed once the room has less publishers.
+	client2.CloseWithBye()
+	if err := client2.WaitForClientRemoved(ctx); err != nil {
+		t.Error(err)
+	}
+
+	waitForMaxBitrate(ctx, t, publisher1, 0)
+}
+
+func TestClientBitratePolicyScreen(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mcu", "screensharetiers", "1:200000")
+		return config, nil
+	})
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
 		t.Fatal(err)
 	} else if room.Room.RoomId != roomId {
 		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 	}
 
-	// We will receive a "joined" event.
-	if err := client1.RunUntilJoined(ctx, hello2.Hello); err != nil {
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
 		t.Error(err)
 	}
-	if err := client2.RunUntilJoined(ctx, hello1.Hello, hello2.Hello); err != nil {
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_SCREEN})
+
+	// Camera and screen can be published at the same time.
+	for _, roomType := range []string{"video", "screen"} {
+		if err := client.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "offer",
+			Sid:      "54321",
+			RoomType: roomType,
+			Payload: map[string]interface{}{
+				"sdp": MockSdpOfferAudioAndVideo,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	video, ok := session.GetPublisher(streamTypeVideo).(*TestMCUPublisher)
+	if !ok {
+		t.Fatal("Expected video publisher")
+	}
+	screen, ok := session.GetPublisher(streamTypeScreen).(*TestMCUPublisher)
+	if !ok {
+		t.Fatal("Expected screen publisher")
+	}
+
+	// Only the screensharing stream is limited.
+	waitForMaxBitrate(ctx, t, screen, 200000)
+	if bitrate := video.getMaxBitrate(); bitrate != 0 {
+		t.Errorf("Expected no bitrate limit for video, got %d", bitrate)
+	}
+}
+
+func TestClientPublisherReconnected(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
 		t.Error(err)
 	}
 
-	// Client 2 may not request an offer (he is not in the call yet).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+
+	if err := client.SendMessage(MessageClientMessageRecipient{
 		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
+		SessionId: hello.Hello.SessionId,
 	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
-		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
+	if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := mcu.GetPublisher(hello.Hello.SessionId)
+	if publisher == nil {
+		t.Fatalf("No publisher for %s found", hello.Hello.SessionId)
+	}
+
+	// The MCU notifies the session after the publisher has been re-created.
+	session.PublisherReconnected(publisher)
+
+	message, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "message"); err != nil {
+		t.Fatal(err)
+	}
+
+	var data AnswerOfferMessage
+	if err := json.Unmarshal(*message.Message.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Type != "renegotiate" {
+		t.Errorf("Expected renegotiate message, got %+v", data)
+	}
+	if data.RoomType != "video" {
+		t.Errorf("Expected room type video, got %+v", data)
+	}
+	if data.From != hello.Hello.SessionId || data.To != hello.Hello.SessionId {
+		t.Errorf("Expected renegotiate message from and to %s, got %+v", hello.Hello.SessionId, data)
+	}
+	if data.Sid != publisher.Sid() {
+		t.Errorf("Expected sid %s, got %+v", publisher.Sid(), data)
+	}
+}
+
+func TestClientRoomKey(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+	hub.roomKeyRateLimit = 3
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	var clients []*TestClient
+	var hellos []*HelloServerMessage
+	for _, userId := range []string{testDefaultUserId + "1", testDefaultUserId + "2", authAnonymousUserId} {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		if err := client.SendHello(userId); err != nil {
+			t.Fatal(err)
+		}
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roomId := "test-room"
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
 			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
 		}
-	}
 
-	// Simulate request from the backend that somebody joined the call.
-	users1 := []map[string]interface{}{
-		{
-			"sessionId": hello2.Hello.SessionId,
-			"inCall":    1,
-		},
-	}
-	room := hub.getRoom(roomId)
-	if room == nil {
-		t.Fatalf("Could not find room %s", roomId)
-	}
-	room.PublishUsersInCallChanged(users1, users1)
-	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
-		t.Error(err)
-	}
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
-		t.Error(err)
+		clients = append(clients, client)
+		hellos = append(hellos, hello.Hello)
+		for _, c := range clients[:len(clients)-1] {
+			if err := c.RunUntilJoined(ctx, hello.Hello); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.RunUntilJoined(ctx, hellos...); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	// Client 2 may not request an offer (recipient is not in the call yet).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
-	}); err != nil {
+	client1, client2, client3 := clients[0], clients[1], clients[2]
+	hello1, hello2, hello3 := hellos[0], hellos[1], hellos[2]
+
+	// Anonymous users may not send room keys.
+	if err := client3.SendRoomKey(MessageClientMessageRecipient{
+		Type: "room",
+	}, "the-key"); err != nil {
 		t.Fatal(err)
 	}
-
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+	if msg, err := client3.RunUntilMessage(ctx); err != nil {
 		t.Fatal(err)
-	} else {
-		if err := checkMessageError(msg, "not_allowed"); err != nil {
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRoomKey := func(client *TestClient, recipientType string, key string) {
+		t.Helper()
+		if msg, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageType(msg, "room-key"); err != nil {
 			t.Fatal(err)
+		} else if msg.RoomKey.Sender.Type != recipientType || msg.RoomKey.Sender.SessionId != hello1.SessionId || msg.RoomKey.Sender.UserId != hello1.UserId {
+			t.Errorf("Expected room key from %s, got %+v", hello1.SessionId, msg.RoomKey.Sender)
+		} else if string(*msg.RoomKey.Data) != "\""+key+"\"" {
+			t.Errorf("Expected key %s, got %s", key, string(*msg.RoomKey.Data))
 		}
 	}
 
-	// Simulate request from the backend that somebody joined the call.
-	users2 := []map[string]interface{}{
-		{
-			"sessionId": hello1.Hello.SessionId,
-			"inCall":    1,
-		},
-	}
-	room.PublishUsersInCallChanged(users2, users2)
-	if err := checkReceiveClientEvent(ctx, client1, "update", nil); err != nil {
-		t.Error(err)
+	// Only the authenticated user receives keys sent to the room.
+	if err := client1.SendRoomKey(MessageClientMessageRecipient{
+		Type: "room",
+	}, "room-key"); err != nil {
+		t.Fatal(err)
 	}
-	if err := checkReceiveClientEvent(ctx, client2, "update", nil); err != nil {
-		t.Error(err)
+	checkRoomKey(client2, "room", "room-key")
+
+	// Keys are not delivered to anonymous sessions.
+	if err := client1.SendRoomKey(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello3.SessionId,
+	}, "anonymous-key"); err != nil {
+		t.Fatal(err)
 	}
 
-	// Client 2 may request an offer now (both are in the same room and call).
-	if err := client2.SendMessage(MessageClientMessageRecipient{
+	if err := client1.SendRoomKey(MessageClientMessageRecipient{
 		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}, MessageClientMessageData{
-		Type:     "requestoffer",
-		Sid:      "12345",
-		RoomType: "screen",
-	}); err != nil {
+		SessionId: hello2.SessionId,
+	}, "session-key"); err != nil {
 		t.Fatal(err)
 	}
+	checkRoomKey(client2, "session", "session-key")
 
-	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+	// The rate limit has been reached.
+	if err := client1.SendRoomKey(MessageClientMessageRecipient{
+		Type: "room",
+	}, "too-many"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "rate_limited"); err != nil {
 		t.Fatal(err)
-	} else {
-		// We check for "client_not_found" as the testing MCU doesn't support publishing/subscribing.
-		if err := checkMessageError(msg, "client_not_found"); err != nil {
-			t.Fatal(err)
-		}
 	}
 
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+
+	for _, client := range []*TestClient{client2, client3} {
+		if msg, err := client.RunUntilMessage(ctx2); err != nil {
+			if err != context.DeadlineExceeded {
+				t.Fatal(err)
+			}
+		} else {
+			t.Errorf("Expected no message, got %+v", msg)
+		}
+	}
 }
 
-func TestNoSendBetweenSessionsOnDifferentBackends(t *testing.T) {
-	// Clients can't send messages to sessions connected from other backends.
+func TestClientRoomKeyDifferentBackends(t *testing.T) {
 	hub, _, _, server := CreateHubWithMultipleBackendsForTest(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
-	client1 := NewTestClient(t, server, hub)
-	defer client1.CloseWithBye()
+	var clients []*TestClient
+	var hellos []*HelloServerMessage
+	for _, backend := range []string{"one", "two"} {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
 
-	params1 := TestBackendClientAuthParams{
-		UserId: "user1",
-	}
-	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
-		t.Fatal(err)
-	}
-	hello1, err := client1.RunUntilHello(ctx)
-	if err != nil {
-		t.Fatal(err)
-	}
+		params := TestBackendClientAuthParams{
+			UserId: "user-" + backend,
+		}
+		if err := client.SendHelloParams(server.URL+"/"+backend, "client", params); err != nil {
+			t.Fatal(err)
+		}
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	client2 := NewTestClient(t, server, hub)
-	defer client2.CloseWithBye()
+		// Both backends use the same room id.
+		roomId := "test-room"
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+		if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+			t.Fatal(err)
+		}
 
-	params2 := TestBackendClientAuthParams{
-		UserId: "user2",
+		clients = append(clients, client)
+		hellos = append(hellos, hello.Hello)
 	}
-	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+
+	client1, client2 := clients[0], clients[1]
+	hello1, hello2 := hellos[0], hellos[1]
+
+	// Keys are not sent to sessions in a room of a different backend.
+	if err := client1.SendRoomKey(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello2.SessionId,
+	}, "the-key"); err != nil {
 		t.Fatal(err)
 	}
-	hello2, err := client2.RunUntilHello(ctx)
-	if err != nil {
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "no_such_session"); err != nil {
 		t.Fatal(err)
 	}
 
-	recipient1 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello1.Hello.SessionId,
-	}
-	recipient2 := MessageClientMessageRecipient{
-		Type:      "session",
-		SessionId: hello2.Hello.SessionId,
+	// Keys of other backends received from other servers are not delivered.
+	data := json.RawMessage(`"remote-key"`)
+	if err := hub.nats.PublishNats("session."+hello2.SessionId, &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "message",
+		Message: &ServerMessage{
+			Type: "room-key",
+			RoomKey: &RoomKeyServerMessage{
+				RoomId: "test-room",
+				Sender: &MessageServerMessageSender{
+					Type:      "session",
+					SessionId: hello1.SessionId,
+					UserId:    hello1.UserId,
+				},
+				Data: &data,
+			},
+		},
+		Backend: "backend1",
+	}); err != nil {
+		t.Fatal(err)
 	}
 
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient2, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient1, data2) // nolint
-
-	var payload string
 	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel2()
-	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
-	}
 
-	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel3()
-	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
+	if msg, err := client2.RunUntilMessage(ctx2); err != nil {
+		if err != context.DeadlineExceeded {
+			t.Fatal(err)
 		}
 	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+		t.Errorf("Expected no message, got %+v", msg)
 	}
 }
 
-func TestNoSameRoomOnDifferentBackends(t *testing.T) {
-	hub, _, _, server := CreateHubWithMultipleBackendsForTest(t)
+func TestClientReportStats(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
 	defer cancel()
 
 	client1 := NewTestClient(t, server, hub)
 	defer client1.CloseWithBye()
-
-	params1 := TestBackendClientAuthParams{
-		UserId: "user1",
-	}
-	if err := client1.SendHelloParams(server.URL+"/one", "client", params1); err != nil {
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
 		t.Fatal(err)
 	}
 	hello1, err := client1.RunUntilHello(ctx)
 	if err != nil {
 		t.Fatal(err)
+	} else if !hasFeature(hello1.Hello.Server, ServerFeatureReportStats) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureReportStats, hello1.Hello.Server.Features)
 	}
 
 	client2 := NewTestClient(t, server, hub)
 	defer client2.CloseWithBye()
-
-	params2 := TestBackendClientAuthParams{
-		UserId: "user2",
-	}
-	if err := client2.SendHelloParams(server.URL+"/two", "client", params2); err != nil {
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
 		t.Fatal(err)
 	}
 	hello2, err := client2.RunUntilHello(ctx)
@@ -3157,77 +5614,103 @@ func TestNoSameRoomOnDifferentBackends(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Join room by id.
 	roomId := "test-room"
-	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
-		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
 	}
-	msg1, err := client1.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
 	}
-	if err := client1.checkMessageJoined(msg1, hello1.Hello); err != nil {
-		t.Error(err)
+	if stats := room.GetQualityStats(); stats != nil {
+		t.Errorf("Expected no quality stats, got %+v", stats)
 	}
 
-	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
-		t.Fatal(err)
-	} else if room.Room.RoomId != roomId {
-		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	stats1 := &ClientQualityStats{
+		Rtt:        40,
+		PacketLoss: 1,
+		Width:      1280,
+		Height:     720,
 	}
-	msg2, err := client2.RunUntilMessage(ctx)
-	if err != nil {
-		t.Error(err)
-	}
-	if err := client2.checkMessageJoined(msg2, hello2.Hello); err != nil {
-		t.Error(err)
+	stats2 := &ClientQualityStats{
+		Rtt:        120,
+		PacketLoss: 5,
 	}
+	for idx, client := range []*TestClient{client1, client2} {
+		stats := stats1
+		if idx == 1 {
+			stats = stats2
+		}
+		if err := client.SendReport(stats); err != nil {
+			t.Fatal(err)
+		}
 
-	hub.ru.RLock()
-	var rooms []*Room
-	for _, room := range hub.rooms {
-		defer room.Close()
-		rooms = append(rooms, room)
+		// Invalid reports are rejected. As messages of a client are processed
+		// in order, the valid report has been processed once the error is
+		// received.
+		if err := client.WriteJSON(map[string]interface{}{
+			"type": "report",
+			"report": map[string]interface{}{
+				"type": "stats",
+				"stats": map[string]interface{}{
+					"packetloss": 200,
+				},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if message, err := client.RunUntilMessage(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := checkMessageError(message, "invalid_format"); err != nil {
+			t.Fatal(err)
+		}
 	}
-	hub.ru.RUnlock()
 
-	if len(rooms) != 2 {
-		t.Errorf("Expected 2 rooms, got %+v", rooms)
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if stats := session1.GetQualityStats(); stats == nil || *stats != *stats1 {
+		t.Errorf("Expected quality stats %+v, got %+v", stats1, stats)
 	}
 
-	if rooms[0].IsEqual(rooms[1]) {
-		t.Errorf("Rooms should be different: %+v", rooms)
+	expected := RoomQualityStats{
+		Reports:       2,
+		Rtt:           80,
+		MaxRtt:        120,
+		PacketLoss:    3,
+		MaxPacketLoss: 5,
 	}
-
-	recipient := MessageClientMessageRecipient{
-		Type: "room",
+	if stats := room.GetQualityStats(); stats == nil || *stats != expected {
+		t.Errorf("Expected room quality stats %+v, got %+v", expected, stats)
 	}
-
-	data1 := "from-1-to-2"
-	client1.SendMessage(recipient, data1) // nolint
-	data2 := "from-2-to-1"
-	client2.SendMessage(recipient, data2) // nolint
-
-	var payload string
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel2()
-	if err := checkReceiveClientMessage(ctx2, client1, "session", hello2.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
+	if stats := room.GetStats(); stats.Quality == nil || *stats.Quality != expected {
+		t.Errorf("Expected room quality stats %+v, got %+v", expected, stats.Quality)
 	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+		for _, session := range stats.Sessions {
+			if session.SessionId == hello2.Hello.SessionId && (session.Quality == nil || *session.Quality != *stats2) {
+				t.Errorf("Expected quality stats %+v, got %+v", stats2, session.Quality)
+			}
+		}
 	}
 
-	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	defer cancel3()
-	if err := checkReceiveClientMessage(ctx3, client2, "session", hello1.Hello, &payload); err != nil {
-		if err != ErrNoMessageReceived {
-			t.Error(err)
-		}
-	} else {
-		t.Errorf("Expected no payload, got %+v", payload)
+	room.updateQualityStats()
+	checkStatsValue(t, statsRoomClientReportsCurrent.WithLabelValues(room.Backend().Id(), roomId), 2)
+	checkStatsValue(t, statsRoomClientRttCurrent.WithLabelValues(room.Backend().Id(), roomId), 80)
+	checkStatsValue(t, statsRoomClientPacketLossCurrent.WithLabelValues(room.Backend().Id(), roomId), 3)
+
+	// Old reports are no longer used.
+	session1.mu.Lock()
+	session1.qualityStatsUpdated = time.Now().Add(-2 * clientQualityStatsMaxAge)
+	session1.mu.Unlock()
+	if stats := session1.GetQualityStats(); stats != nil {
+		t.Errorf("Expected no quality stats, got %+v", stats)
+	}
+	if stats := room.GetQualityStats(); stats == nil || stats.Reports != 1 || stats.Rtt != stats2.Rtt {
+		t.Errorf("Expected room quality stats of one session, got %+v", stats)
 	}
 }
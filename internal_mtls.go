@@ -0,0 +1,127 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dlintw/goconf"
+)
+
+// NewInternalClientsTLSConfig returns the TLS configuration of the listener
+// for internal clients that authenticate with a client certificate instead
+// of the shared secret.
+func NewInternalClientsTLSConfig(config *goconf.ConfigFile) (*tls.Config, error) {
+	certFile, _ := config.GetString("mtls", "certificate")
+	keyFile, _ := config.GetString("mtls", "key")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("need a certificate and key for the mTLS listener")
+	}
+
+	caFile, _ := config.GetString("mtls", "clientca")
+	if caFile == "" {
+		return nil, fmt.Errorf("need a CA bundle to validate client certificates")
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+	}
+
+	value, _ := config.GetString("mtls", "tlsminversion")
+	minVersion, err := parseTLSVersion(value)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.GetCertificate(), nil
+		},
+	}, nil
+}
+
+// getCertificateClients returns the features internal clients may announce,
+// mapped by the lowercase common name of their client certificates.
+func getCertificateClients(config *goconf.ConfigFile) (map[string][]string, error) {
+	options, _ := config.GetOptions("mtlsclients")
+	result := make(map[string][]string, len(options))
+	for _, subject := range options {
+		value, _ := config.GetString("mtlsclients", subject)
+		features := make([]string, 0)
+		for _, feature := range strings.Split(value, ",") {
+			feature = strings.TrimSpace(feature)
+			if feature == "" {
+				continue
+			}
+
+			if _, found := internalFeatureVersions[feature]; !found {
+				return nil, fmt.Errorf("unsupported feature %s for certificate %s", feature, subject)
+			}
+			features = append(features, feature)
+		}
+		result[strings.ToLower(subject)] = features
+	}
+	return result, nil
+}
+
+// filterCertificateFeatures removes the internal client features a client
+// with a certificate is not allowed to announce.
+func filterCertificateFeatures(subject string, features []string, allowed []string) []string {
+	result := make([]string, 0, len(features))
+	for _, feature := range features {
+		if _, found := internalFeatureVersions[feature]; found && !isCertificateFeatureAllowed(allowed, feature) {
+			log.Printf("Certificate %s is not allowed to use feature %s, ignoring", subject, feature)
+			continue
+		}
+
+		result = append(result, feature)
+	}
+	return result
+}
+
+func isCertificateFeatureAllowed(allowed []string, feature string) bool {
+	for _, f := range allowed {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/gorilla/websocket"
+)
+
+func newTestClientCertificate(t *testing.T, commonName string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{data},
+		PrivateKey:  key,
+		Leaf:        certificate,
+	}, certificate
+}
+
+func TestCertificateClients(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if clients, err := getCertificateClients(config); err != nil {
+		t.Fatal(err)
+	} else if len(clients) != 0 {
+		t.Errorf("Expected no clients, got %+v", clients)
+	}
+
+	config.AddOption("mtlsclients", "Recorder.Example.com", "recording")
+	config.AddOption("mtlsclients", "transcriber", "transcription, recording")
+	config.AddOption("mtlsclients", "other", "")
+	expected := map[string][]string{
+		"recorder.example.com": {ClientFeatureInternalRecording},
+		"transcriber":          {ClientFeatureInternalTranscription, ClientFeatureInternalRecording},
+		"other":                {},
+	}
+	if clients, err := getCertificateClients(config); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(expected, clients) {
+		t.Errorf("Expected %+v, got %+v", expected, clients)
+	}
+
+	config.AddOption("mtlsclients", "invalid", "recording, unknown")
+	if clients, err := getCertificateClients(config); err == nil {
+		t.Errorf("Expected error for unknown feature, got %+v", clients)
+	}
+}
+
+func TestFilterCertificateFeatures(t *testing.T) {
+	features := []string{
+		ClientFeatureInternalRecording,
+		ClientFeatureInternalTranscription,
+		"other-feature",
+	}
+	filtered := filterCertificateFeatures("recorder", features, []string{ClientFeatureInternalRecording})
+	if expected := []string{ClientFeatureInternalRecording, "other-feature"}; !reflect.DeepEqual(expected, filtered) {
+		t.Errorf("Expected %+v, got %+v", expected, filtered)
+	}
+
+	filtered = filterCertificateFeatures("recorder", features, nil)
+	if expected := []string{"other-feature"}; !reflect.DeepEqual(expected, filtered) {
+		t.Errorf("Expected %+v, got %+v", expected, filtered)
+	}
+}
+
+func newMtlsTestClient(t *testing.T, hub *Hub, server *httptest.Server, commonName string) *TestClient {
+	clientCert, clientCa := newTestClientCertificate(t, commonName)
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCa)
+
+	mtlsServer := httptest.NewUnstartedServer(server.Config.Handler)
+	mtlsServer.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	mtlsServer.StartTLS()
+	t.Cleanup(mtlsServer.Close)
+
+	dialer := &websocket.Dialer{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      mtlsServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+			Certificates: []tls.Certificate{clientCert},
+		},
+	}
+	return NewTestClientWithDialer(t, mtlsServer, hub, dialer)
+}
+
+func TestClientHelloInternalCertificate(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mtlsclients", "recorder", ClientFeatureInternalRecording)
+		return config, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := newMtlsTestClient(t, hub, server, "recorder")
+	defer client.CloseWithBye()
+
+	// No random / token is required for clients with certificates.
+	params := ClientTypeInternalAuthParams{
+		Backend: server.URL,
+	}
+	if err := client.SendHelloParamsWithFeatures("", HelloClientTypeInternal, params, []string{
+		ClientFeatureInternalRecording,
+		ClientFeatureInternalTranscription,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	if session.ClientType() != HelloClientTypeInternal {
+		t.Errorf("Expected internal session, got %s", session.ClientType())
+	}
+	if version := session.GetFeatureVersion(ClientFeatureInternalRecording); version != 1 {
+		t.Errorf("Expected recording to be allowed, got version %d", version)
+	}
+	if session.HasFeature(ClientFeatureInternalTranscription) {
+		t.Errorf("Transcription should not be allowed, got %+v", session.GetFeatures())
+	}
+}
+
+func TestClientHelloInternalCertificateUnknown(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("mtlsclients", "recorder", ClientFeatureInternalRecording)
+		return config, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := newMtlsTestClient(t, hub, server, "other")
+	defer client.CloseWithBye()
+
+	params := ClientTypeInternalAuthParams{
+		Backend: server.URL,
+	}
+	if err := client.SendHelloParamsWithFeatures("", HelloClientTypeInternal, params, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if msg.Type != "error" || msg.Error == nil {
+		t.Errorf("Expected error message, got %+v", msg)
+	} else if msg.Error.Code != InvalidClientCert.Code {
+		t.Errorf("Expected error %s, got %+v", InvalidClientCert.Code, msg.Error)
+	}
+}
+
+func TestInternalClientsTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	config := goconf.NewConfigFile()
+	if _, err := NewInternalClientsTLSConfig(config); err == nil {
+		t.Error("Expected error without certificate")
+	}
+
+	config.AddOption("mtls", "certificate", certFile)
+	config.AddOption("mtls", "key", keyFile)
+	if _, err := NewInternalClientsTLSConfig(config); err == nil {
+		t.Error("Expected error without client CA")
+	}
+
+	config.AddOption("mtls", "clientca", keyFile)
+	if _, err := NewInternalClientsTLSConfig(config); err == nil {
+		t.Error("Expected error for invalid client CA")
+	}
+
+	config.AddOption("mtls", "clientca", certFile)
+	config.AddOption("mtls", "tlsminversion", "1.2")
+	if tlsConfig, err := NewInternalClientsTLSConfig(config); err != nil {
+		t.Fatal(err)
+	} else if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected client certificates to be required, got %s", tlsConfig.ClientAuth)
+	} else if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected minimum version TLS 1.2, got %d", tlsConfig.MinVersion)
+	}
+}
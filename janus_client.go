@@ -42,6 +42,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/notedit/janus-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -170,6 +171,7 @@ func unexpected(request string) error {
 }
 
 type transaction struct {
+	method   string
 	ch       chan interface{}
 	incoming chan interface{}
 	quitChan chan bool
@@ -210,7 +212,9 @@ func newTransaction() *transaction {
 func newRequest(method string) (map[string]interface{}, *transaction) {
 	req := make(map[string]interface{}, 8)
 	req["janus"] = method
-	return req, newTransaction()
+	t := newTransaction()
+	t.method = method
+	return req, t
 }
 
 type GatewayListener interface {
@@ -501,10 +505,17 @@ func (gateway *JanusGateway) recv() {
 }
 
 func waitForMessage(ctx context.Context, t *transaction) (interface{}, error) {
+	_, span := startSpan(ctx, "janus.transaction", attribute.String("janus.method", t.method))
 	select {
 	case <-ctx.Done():
+		endSpan(span, ctx.Err())
 		return nil, ctx.Err()
 	case msg := <-t.ch:
+		if err, ok := msg.(*janus.ErrorMsg); ok {
+			endSpan(span, err)
+		} else {
+			span.End()
+		}
 		return msg, nil
 	}
 }
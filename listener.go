@@ -0,0 +1,177 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// File descriptor of the first socket passed by systemd.
+	systemdListenFdsStart = 3
+
+	// Prefix of addresses that use sockets passed by systemd.
+	systemdAddressPrefix = "systemd:"
+
+	// Prefix of addresses that use Unix domain sockets.
+	unixAddressPrefix = "unix:"
+)
+
+type systemdListener struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+var (
+	systemdListenersOnce sync.Once
+	systemdListenersMu   sync.Mutex
+	systemdListeners     []*systemdListener
+	systemdListenersErr  error
+)
+
+// parseSystemdListeners creates listeners for the sockets passed by systemd
+// (see "sd_listen_fds(3)").
+func parseSystemdListeners(listenPid string, listenFds string, listenFdNames string, firstFd int) ([]*systemdListener, error) {
+	if listenPid == "" || listenFds == "" {
+		return nil, nil
+	}
+
+	if pid, err := strconv.Atoi(listenPid); err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID %s: %s", listenPid, err)
+	} else if pid != os.Getpid() {
+		// Sockets were passed to a different process.
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(listenFds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %s", listenFds)
+	}
+
+	var names []string
+	if listenFdNames != "" {
+		names = strings.Split(listenFdNames, ":")
+	}
+
+	var result []*systemdListener
+	for idx := 0; idx < count; idx++ {
+		fd := firstFd + idx
+		name := "unknown"
+		if idx < len(names) && names[idx] != "" {
+			name = names[idx]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		// The listener uses a duplicate of the file descriptor.
+		f.Close()
+		if err != nil {
+			for _, l := range result {
+				l.listener.Close()
+			}
+			return nil, fmt.Errorf("could not use socket %d (%s): %s", fd, name, err)
+		}
+
+		result = append(result, &systemdListener{
+			name:     name,
+			listener: listener,
+		})
+	}
+	return result, nil
+}
+
+func loadSystemdListeners() {
+	systemdListeners, systemdListenersErr = parseSystemdListeners(
+		os.Getenv("LISTEN_PID"),
+		os.Getenv("LISTEN_FDS"),
+		os.Getenv("LISTEN_FDNAMES"),
+		systemdListenFdsStart,
+	)
+
+	// Don't pass the sockets to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// getSystemdListener returns the next unused socket passed by systemd with
+// the given name. Any unused socket is returned if the name is empty.
+func getSystemdListener(listeners []*systemdListener, name string) (net.Listener, error) {
+	available := false
+	for _, l := range listeners {
+		if name != "" && l.name != name {
+			continue
+		}
+
+		available = true
+		if !l.used {
+			l.used = true
+			return l.listener, nil
+		}
+	}
+
+	if name == "" {
+		if available {
+			return nil, fmt.Errorf("all sockets passed by systemd are already used")
+		}
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	} else if available {
+		return nil, fmt.Errorf("all sockets %s passed by systemd are already used", name)
+	}
+	return nil, fmt.Errorf("no socket %s passed by systemd", name)
+}
+
+// Listen creates a listener for the given address. The address can be
+// - "host:port" for a TCP socket,
+// - "unix:/path/to/socket" or "/path/to/socket" for a Unix domain socket,
+// - "systemd:name" for a socket passed by systemd with "FileDescriptorName=name"
+// or "systemd:" for the next socket passed by systemd.
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, systemdAddressPrefix) {
+		systemdListenersOnce.Do(loadSystemdListeners)
+		if systemdListenersErr != nil {
+			return nil, systemdListenersErr
+		}
+
+		systemdListenersMu.Lock()
+		defer systemdListenersMu.Unlock()
+		return getSystemdListener(systemdListeners, addr[len(systemdAddressPrefix):])
+	}
+
+	if strings.HasPrefix(addr, unixAddressPrefix) {
+		addr = addr[len(unixAddressPrefix):]
+	} else if !strings.HasPrefix(addr, "/") {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove stale socket from a previous run.
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", addr)
+}
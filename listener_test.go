@@ -0,0 +1,138 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	for _, prefix := range []string{"", unixAddressPrefix} {
+		filename := filepath.Join(t.TempDir(), "signaling.sock")
+		// Stale sockets from previous runs are replaced.
+		if err := os.WriteFile(filename, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := Listen(prefix + filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if addr, ok := listener.Addr().(*net.UnixAddr); !ok || addr.Name != filename {
+			t.Errorf("expected unix address %s, got %s", filename, listener.Addr())
+		}
+
+		conn, err := net.Dial("unix", filename)
+		if err != nil {
+			t.Error(err)
+		} else {
+			conn.Close()
+		}
+		listener.Close()
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	// Returns a duplicate of the socket of a new listener that will be owned by
+	// the parsed listeners.
+	createSocket := func() (int, string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		f, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fd, listener.Addr().String()
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if listeners, err := parseSystemdListeners(strconv.Itoa(os.Getpid()+1), "1", "", 1000); err != nil {
+		t.Error(err)
+	} else if len(listeners) != 0 {
+		t.Errorf("sockets of other processes should be ignored, got %+v", listeners)
+	}
+	if _, err := parseSystemdListeners(pid, "invalid", "", 1000); err == nil {
+		t.Error("expected error for invalid LISTEN_FDS")
+	}
+
+	var listeners []*systemdListener
+	defer func() {
+		for _, l := range listeners {
+			l.listener.Close()
+		}
+	}()
+
+	var addrs []string
+	for _, names := range []string{"http", ""} {
+		fd, addr := createSocket()
+		parsed, err := parseSystemdListeners(pid, "1", names, fd)
+		if err != nil {
+			syscall.Close(fd) // nolint
+			t.Fatal(err)
+		}
+		listeners = append(listeners, parsed...)
+		addrs = append(addrs, addr)
+	}
+
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %+v", listeners)
+	}
+	if listeners[0].name != "http" || listeners[1].name != "unknown" {
+		t.Errorf("unexpected listener names %s / %s", listeners[0].name, listeners[1].name)
+	}
+
+	if listener, err := getSystemdListener(listeners, "http"); err != nil {
+		t.Error(err)
+	} else if listener.Addr().String() != addrs[0] {
+		t.Errorf("expected address %s, got %s", addrs[0], listener.Addr())
+	}
+	if listener, err := getSystemdListener(listeners, "http"); err == nil {
+		t.Errorf("socket should only be used once, got %s", listener.Addr())
+	}
+	if listener, err := getSystemdListener(listeners, "https"); err == nil {
+		t.Errorf("expected error for unknown socket, got %s", listener.Addr())
+	}
+	if listener, err := getSystemdListener(listeners, ""); err != nil {
+		t.Error(err)
+	} else if listener.Addr().String() != addrs[1] {
+		t.Errorf("expected address %s, got %s", addrs[1], listener.Addr())
+	}
+	if listener, err := getSystemdListener(listeners, ""); err == nil {
+		t.Errorf("all sockets should be used, got %s", listener.Addr())
+	}
+}
@@ -0,0 +1,494 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Maximum time a receive request waits for new messages.
+	longPollTimeout = 25 * time.Second
+
+	// Maximum number of messages that are queued for a client that doesn't
+	// fetch them.
+	maxLongPollQueueSize = 1024
+
+	// Length of the (secret) ids of long-polling connections.
+	longPollIdLength = 64
+)
+
+var (
+	ErrLongPollQueueFull = errors.New("too many queued messages")
+	ErrLongPollClosed    = errors.New("connection closed")
+)
+
+type longPollTimeoutError struct{}
+
+func (e longPollTimeoutError) Error() string   { return "read timeout" }
+func (e longPollTimeoutError) Timeout() bool   { return true }
+func (e longPollTimeoutError) Temporary() bool { return true }
+
+// longPollConn emulates a websocket connection with HTTP requests. Messages
+// from the client are received with separate "send" requests, messages to the
+// client are queued until they are fetched by a "receive" request.
+type longPollConn struct {
+	id         string
+	remoteAddr net.Addr
+	onClosed   func(conn *longPollConn)
+
+	mu           sync.Mutex
+	readLimit    int64
+	readTimeout  time.Duration
+	lastActivity time.Time
+	queue        [][]byte
+	closing      bool
+	closed       bool
+
+	incoming chan []byte
+	activity chan struct{}
+	queued   chan struct{}
+	closeCh  chan struct{}
+}
+
+func newLongPollConn(id string, remoteAddr net.Addr, onClosed func(conn *longPollConn)) *longPollConn {
+	return &longPollConn{
+		id:         id,
+		remoteAddr: remoteAddr,
+		onClosed:   onClosed,
+
+		readLimit:    maxMessageSize,
+		readTimeout:  pongWait,
+		lastActivity: time.Now(),
+
+		incoming: make(chan []byte, 16),
+		activity: make(chan struct{}, 1),
+		queued:   make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+	}
+}
+
+func (c *longPollConn) SetReadLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readLimit = limit
+}
+
+func (c *longPollConn) getReadLimit() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readLimit
+}
+
+func (c *longPollConn) SetPongHandler(h func(appData string) error) {
+	// Long-polling clients don't respond to pings.
+}
+
+// SetReadDeadline configures the time without requests from the client
+// after which the connection is considered dead.
+func (c *longPollConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !t.IsZero() {
+		c.readTimeout = time.Until(t)
+	}
+	return nil
+}
+
+func (c *longPollConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *longPollConn) EnableWriteCompression(enable bool) {
+}
+
+func (c *longPollConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *longPollConn) markActive() {
+	c.mu.Lock()
+	c.lastActivity = time.Now()
+	c.mu.Unlock()
+
+	select {
+	case c.activity <- struct{}{}:
+	default:
+	}
+}
+
+func (c *longPollConn) NextReader() (int, io.Reader, error) {
+	for {
+		c.mu.Lock()
+		timeout := time.Until(c.lastActivity.Add(c.readTimeout))
+		c.mu.Unlock()
+		if timeout <= 0 {
+			return 0, nil, longPollTimeoutError{}
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case data := <-c.incoming:
+			timer.Stop()
+			return websocket.TextMessage, bytes.NewReader(data), nil
+		case <-c.activity:
+			timer.Stop()
+		case <-timer.C:
+		case <-c.closeCh:
+			timer.Stop()
+			return 0, nil, &websocket.CloseError{
+				Code: websocket.CloseNormalClosure,
+			}
+		}
+	}
+}
+
+type longPollWriter struct {
+	bytes.Buffer
+
+	conn *longPollConn
+}
+
+func (w *longPollWriter) Close() error {
+	return w.conn.enqueue(w.Bytes())
+}
+
+func (c *longPollConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != websocket.TextMessage {
+		return nil, websocket.ErrBadHandshake
+	}
+
+	return &longPollWriter{
+		conn: c,
+	}, nil
+}
+
+func (c *longPollConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage:
+		return c.enqueue(append([]byte(nil), data...))
+	case websocket.CloseMessage:
+		c.mu.Lock()
+		c.closing = true
+		c.mu.Unlock()
+		c.notifyQueued()
+		return nil
+	default:
+		// Pings are not supported.
+		return nil
+	}
+}
+
+func (c *longPollConn) enqueue(data []byte) error {
+	c.mu.Lock()
+	if c.closing || c.closed {
+		c.mu.Unlock()
+		return websocket.ErrCloseSent
+	} else if len(c.queue) >= maxLongPollQueueSize {
+		c.mu.Unlock()
+		return ErrLongPollQueueFull
+	}
+	c.queue = append(c.queue, data)
+	c.mu.Unlock()
+
+	c.notifyQueued()
+	return nil
+}
+
+func (c *longPollConn) notifyQueued() {
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the connection. Messages that are still queued can be fetched
+// until the next receive request or the long-polling timeout.
+func (c *longPollConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.closing = true
+	pending := len(c.queue)
+	c.mu.Unlock()
+
+	close(c.closeCh)
+	c.notifyQueued()
+	if pending == 0 {
+		c.onClosed(c)
+	} else {
+		time.AfterFunc(longPollTimeout, func() {
+			c.onClosed(c)
+		})
+	}
+	return nil
+}
+
+func (c *longPollConn) send(data []byte) error {
+	c.markActive()
+	select {
+	case c.incoming <- data:
+		return nil
+	case <-c.closeCh:
+		return ErrLongPollClosed
+	}
+}
+
+// receive waits for queued messages. Returns "false" if the connection was
+// closed and all messages have been fetched.
+func (c *longPollConn) receive(done <-chan struct{}, timeout time.Duration) ([][]byte, bool) {
+	c.markActive()
+	defer c.markActive()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		queue := c.queue
+		c.queue = nil
+		closing := c.closing
+		closed := c.closed
+		c.mu.Unlock()
+		if len(queue) > 0 {
+			return queue, true
+		} else if closing {
+			if closed {
+				c.onClosed(c)
+			}
+			return nil, false
+		}
+
+		select {
+		case <-c.queued:
+		case <-timer.C:
+			return nil, true
+		case <-done:
+			return nil, true
+		}
+	}
+}
+
+// longPollConnections contains the active long-polling connections.
+type longPollConnections struct {
+	mu    sync.Mutex
+	conns map[string]*longPollConn
+}
+
+func newLongPollConnections() *longPollConnections {
+	return &longPollConnections{
+		conns: make(map[string]*longPollConn),
+	}
+}
+
+func (l *longPollConnections) newConn(remoteAddr net.Addr) *longPollConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := newRandomString(longPollIdLength)
+	for l.conns[id] != nil {
+		id = newRandomString(longPollIdLength)
+	}
+	conn := newLongPollConn(id, remoteAddr, l.remove)
+	l.conns[id] = conn
+	return conn
+}
+
+func (l *longPollConnections) get(id string) *longPollConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[id]
+}
+
+func (l *longPollConnections) remove(conn *longPollConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[conn.id] == conn {
+		delete(l.conns, conn.id)
+	}
+}
+
+func (l *longPollConnections) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.conns)
+}
+
+type longPollAddr string
+
+func (a longPollAddr) Network() string {
+	return "http"
+}
+
+func (a longPollAddr) String() string {
+	return string(a)
+}
+
+type LongPollConnectResponse struct {
+	Id string `json:"id"`
+}
+
+func (h *Hub) registerLongPolling(r *mux.Router) {
+	r.HandleFunc("/spreed/poll", h.serveLongPollConnect).Methods("POST")
+	r.HandleFunc("/spreed/poll/{id}/send", h.serveLongPollSend).Methods("POST")
+	r.HandleFunc("/spreed/poll/{id}/receive", h.serveLongPollReceive).Methods("GET")
+	r.HandleFunc("/spreed/poll/{id}", h.serveLongPollClose).Methods("DELETE")
+}
+
+func (h *Hub) serveLongPollConnect(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	addr := getRealUserIP(r, h.trustedProxies)
+	agent := r.Header.Get("User-Agent")
+
+	conn := h.longPolls.newConn(longPollAddr(r.RemoteAddr))
+	client, err := NewClient(conn, addr, agent)
+	if err != nil {
+		log.Printf("Could not create client for %s: %s", addr, err)
+		conn.Close()
+		http.Error(w, "Could not create client", http.StatusInternalServerError)
+		return
+	}
+
+	if h.hasGeoLookup() {
+		client.OnLookupCountry = h.lookupClientCountry
+	}
+	client.OnMessageReceived = h.processMessage
+	client.OnClosed = func(client *Client) {
+		h.processUnregister(client)
+	}
+
+	h.processNewClient(client)
+	go func(h *Hub) {
+		atomic.AddUint32(&h.writePumpActive, 1)
+		defer atomic.AddUint32(&h.writePumpActive, ^uint32(0))
+		client.WritePump()
+	}(h)
+	go func(h *Hub) {
+		atomic.AddUint32(&h.readPumpActive, 1)
+		defer atomic.AddUint32(&h.readPumpActive, ^uint32(0))
+		client.ReadPump()
+	}(h)
+
+	data, err := json.Marshal(&LongPollConnectResponse{
+		Id: conn.id,
+	})
+	if err != nil {
+		log.Printf("Could not serialize long-polling response for %s: %s", addr, err)
+		conn.Close()
+		http.Error(w, "Could not serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data) // nolint
+}
+
+func (h *Hub) getLongPollConn(w http.ResponseWriter, r *http.Request) *longPollConn {
+	conn := h.longPolls.get(mux.Vars(r)["id"])
+	if conn == nil {
+		http.Error(w, "Unknown connection", http.StatusNotFound)
+	}
+	return conn
+}
+
+func (h *Hub) serveLongPollSend(w http.ResponseWriter, r *http.Request) {
+	conn := h.getLongPollConn(w, r)
+	if conn == nil {
+		return
+	}
+
+	limit := conn.getReadLimit()
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	} else if int64(len(body)) > limit {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := conn.send(body); err != nil {
+		http.Error(w, "Connection closed", http.StatusGone)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Hub) serveLongPollReceive(w http.ResponseWriter, r *http.Request) {
+	conn := h.getLongPollConn(w, r)
+	if conn == nil {
+		return
+	}
+
+	messages, open := conn.receive(r.Context().Done(), longPollTimeout)
+	if !open {
+		http.Error(w, "Connection closed", http.StatusGone)
+		return
+	}
+
+	var data bytes.Buffer
+	data.WriteByte('[')
+	for idx, message := range messages {
+		if idx > 0 {
+			data.WriteByte(',')
+		}
+		data.Write(bytes.TrimSpace(message))
+	}
+	data.WriteByte(']')
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data.Bytes()) // nolint
+}
+
+func (h *Hub) serveLongPollClose(w http.ResponseWriter, r *http.Request) {
+	conn := h.getLongPollConn(w, r)
+	if conn == nil {
+		return
+	}
+
+	conn.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,217 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+type longPollTestClient struct {
+	t      *testing.T
+	server *httptest.Server
+	id     string
+}
+
+func newLongPollTestClient(t *testing.T, server *httptest.Server) *longPollTestClient {
+	response, err := http.Post(server.URL+"/spreed/poll", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %s", http.StatusOK, response.Status)
+	}
+
+	var connect LongPollConnectResponse
+	if err := json.NewDecoder(response.Body).Decode(&connect); err != nil {
+		t.Fatal(err)
+	} else if connect.Id == "" {
+		t.Fatal("expected connection id")
+	}
+
+	return &longPollTestClient{
+		t:      t,
+		server: server,
+		id:     connect.Id,
+	}
+}
+
+func (c *longPollTestClient) do(method string, path string, body interface{}) *http.Response {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	request, err := http.NewRequest(method, c.server.URL+"/spreed/poll/"+c.id+path, bytes.NewReader(data))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return response
+}
+
+func (c *longPollTestClient) Send(message *ClientMessage) {
+	response := c.do("POST", "/send", message)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		c.t.Fatalf("expected status %d, got %s", http.StatusNoContent, response.Status)
+	}
+}
+
+func (c *longPollTestClient) Receive() ([]*ServerMessage, int) {
+	response := c.do("GET", "/receive", nil)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, response.StatusCode
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	var messages []*ServerMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		c.t.Fatalf("could not decode %q: %s", string(body), err)
+	}
+	return messages, response.StatusCode
+}
+
+func (c *longPollTestClient) RunUntilMessage() *ServerMessage {
+	for {
+		messages, status := c.Receive()
+		if status != http.StatusOK {
+			c.t.Fatalf("expected status %d, got %d", http.StatusOK, status)
+		} else if len(messages) > 0 {
+			return messages[0]
+		}
+	}
+}
+
+func (c *longPollTestClient) Close() int {
+	response := c.do("DELETE", "", nil)
+	defer response.Body.Close()
+	return response.StatusCode
+}
+
+func TestLongPollingDisabled(t *testing.T) {
+	_, _, _, server := CreateHubForTest(t)
+
+	response, err := http.Post(server.URL+"/spreed/poll", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound && response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected long-polling to be disabled, got %s", response.Status)
+	}
+}
+
+func TestLongPollingHelloResume(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("app", "longpolling", "true")
+		return config, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := newLongPollTestClient(t, server)
+	params, err := json.Marshal(TestBackendClientAuthParams{
+		UserId: testDefaultUserId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(&ClientMessage{
+		Id:   "1234",
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version: HelloVersion,
+			Auth: HelloClientMessageAuth{
+				Url:    server.URL,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	})
+
+	hello := client.RunUntilMessage()
+	if err := checkMessageType(hello, "hello"); err != nil {
+		t.Fatal(err)
+	} else if hello.Hello.UserId != testDefaultUserId {
+		t.Errorf("Expected \"%s\", got %+v", testDefaultUserId, hello.Hello)
+	} else if hello.Hello.ResumeId == "" {
+		t.Errorf("Expected resume id, got %+v", hello.Hello)
+	} else if !hasFeature(hello.Hello.Server, ServerFeatureLongPolling) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureLongPolling, hello.Hello.Server)
+	}
+
+	if status := client.Close(); status != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, status)
+	}
+	if _, status := client.Receive(); status != http.StatusNotFound && status != http.StatusGone {
+		t.Errorf("expected closed connection, got %d", status)
+	}
+
+	// The session can be resumed with a websocket connection.
+	wsClient := NewTestClient(t, server, hub)
+	defer wsClient.CloseWithBye()
+
+	if err := wsClient.SendHelloResume(hello.Hello.ResumeId); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := wsClient.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if hello2.Hello.SessionId != hello.Hello.SessionId {
+		t.Errorf("Expected session id %s, got %+v", hello.Hello.SessionId, hello2.Hello)
+	}
+
+	unknown := &longPollTestClient{
+		t:      t,
+		server: server,
+		id:     "unknown",
+	}
+	if _, status := unknown.Receive(); status != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown connection, got %d", http.StatusNotFound, status)
+	}
+}
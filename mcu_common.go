@@ -24,6 +24,7 @@ package signaling
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/dlintw/goconf"
 )
@@ -36,9 +37,63 @@ const (
 )
 
 var (
-	ErrNotConnected = fmt.Errorf("not connected")
+	ErrNotConnected            = fmt.Errorf("not connected")
+	ErrAudioBridgeNotSupported = fmt.Errorf("audio bridge not supported")
+	ErrUnsupportedMcuType      = fmt.Errorf("unsupported MCU type")
 )
 
+// McuFactory creates a MCU that connects to the given url.
+type McuFactory func(url string, config *goconf.ConfigFile) (Mcu, error)
+
+type mcuTypeInfo struct {
+	factory         McuFactory
+	registerStats   func()
+	unregisterStats func()
+}
+
+var (
+	mcuTypesLock sync.Mutex
+	mcuTypes     = make(map[string]*mcuTypeInfo)
+)
+
+// RegisterMcuType makes a MCU implementation available to be used through
+// the "type" setting in the "mcu" section of the configuration. The stats
+// functions are optional and will be called when a MCU of the type is
+// created.
+func RegisterMcuType(mcuType string, factory McuFactory, registerStats func(), unregisterStats func()) {
+	mcuTypesLock.Lock()
+	defer mcuTypesLock.Unlock()
+
+	mcuTypes[mcuType] = &mcuTypeInfo{
+		factory:         factory,
+		registerStats:   registerStats,
+		unregisterStats: unregisterStats,
+	}
+}
+
+// NewMcu creates a MCU of the given type. Returns "ErrUnsupportedMcuType" if
+// no implementation is registered for the type.
+func NewMcu(mcuType string, url string, config *goconf.ConfigFile) (Mcu, error) {
+	mcuTypesLock.Lock()
+	info, found := mcuTypes[mcuType]
+	if found {
+		for t, other := range mcuTypes {
+			if t != mcuType && other.unregisterStats != nil {
+				other.unregisterStats()
+			}
+		}
+		if info.registerStats != nil {
+			info.registerStats()
+		}
+	}
+	mcuTypesLock.Unlock()
+	if !found {
+		return nil, ErrUnsupportedMcuType
+	}
+
+	return info.factory(url, config)
+}
+
 type MediaType int
 
 const (
@@ -56,6 +111,7 @@ type McuListener interface {
 	OnIceCompleted(client McuClient)
 
 	SubscriberSidUpdated(subscriber McuSubscriber)
+	PublisherReconnected(publisher McuPublisher)
 
 	PublisherClosed(publisher McuPublisher)
 	SubscriberClosed(subscriber McuSubscriber)
@@ -79,6 +135,81 @@ type Mcu interface {
 	NewSubscriber(ctx context.Context, listener McuListener, publisher string, streamType string) (McuSubscriber, error)
 }
 
+// McuAudioBridge is implemented by MCUs that can mix the audio of all
+// participants of a room on the server.
+type McuAudioBridge interface {
+	NewAudioBridgeParticipant(ctx context.Context, listener McuListener, roomId string, id string, sid string, mediaTypes MediaType) (McuPublisher, error)
+}
+
+// McuRtpForwarder is implemented by publishers that can forward their media
+// as plain RTP to external hosts.
+type McuRtpForwarder interface {
+	StartRtpForward(ctx context.Context, host string, audioPort int, videoPort int) ([]*RtpForwardStream, error)
+	StopRtpForward(ctx context.Context, streamId uint64) error
+}
+
+// McuRemotePublisherSource is implemented by publishers that can send their
+// media to a publisher on another MCU, e.g. to cascade it to subscribers on a
+// different continent.
+type McuRemotePublisherSource interface {
+	// GetStreams returns the streams sent by the publisher.
+	GetStreams(ctx context.Context) ([]PublisherStream, error)
+
+	PublishRemote(ctx context.Context, remoteId string, hostname string, port int, rtcpPort int) error
+	UnpublishRemote(ctx context.Context, remoteId string) error
+}
+
+// McuRemotePublisher receives the media of a publisher on another MCU.
+// Subscribers can be created for it like for any other publisher.
+type McuRemotePublisher interface {
+	McuPublisher
+
+	// Address the media of the source publisher must be sent to.
+	Hostname() string
+	Port() int
+	RtcpPort() int
+}
+
+// McuRemotePublisherCreator is implemented by MCUs that can receive the media
+// of publishers on other MCUs.
+type McuRemotePublisherCreator interface {
+	NewRemotePublisher(ctx context.Context, listener McuListener, id string, streamType string, streams []PublisherStream) (McuRemotePublisher, error)
+}
+
+// McuBitrateLimiter is implemented by publishers whose bitrate can be limited
+// while they are publishing.
+type McuBitrateLimiter interface {
+	// SetMaxBitrate limits the bitrate of the publisher, a value of 0 restores
+	// the bitrate the publisher was created with.
+	SetMaxBitrate(ctx context.Context, bitrate int) error
+}
+
+// McuPublisherMuter is implemented by publishers whose media can be muted in
+// the MCU, so it is no longer sent to subscribers.
+type McuPublisherMuter interface {
+	Mute(ctx context.Context, mediaTypes MediaType) error
+}
+
+// McuSubscriberPauser is implemented by subscribers whose media can be paused
+// in the MCU, e.g. while the session is on hold.
+type McuSubscriberPauser interface {
+	SetPaused(ctx context.Context, paused bool) error
+}
+
+// McuSimulcastSubscriber is implemented by subscribers that know about the
+// simulcast layers sent by their publisher.
+type McuSimulcastSubscriber interface {
+	SimulcastLayers() *SimulcastLayers
+}
+
+func getSimulcastLayers(client McuClient) *SimulcastLayers {
+	if subscriber, ok := client.(McuSimulcastSubscriber); ok {
+		return subscriber.SimulcastLayers()
+	}
+
+	return nil
+}
+
 type McuClient interface {
 	Id() string
 	Sid() string
@@ -89,6 +220,60 @@ type McuClient interface {
 	SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{}))
 }
 
+// McuClientBandwidth contains the bandwidth in bits per second that is
+// received and sent by the MCU for a client.
+type McuClientBandwidth struct {
+	Received uint64
+	Sent     uint64
+}
+
+// McuClientWithBandwidth is implemented by clients that can report their
+// current bandwidth. A nil result is returned if the bandwidth is unknown.
+type McuClientWithBandwidth interface {
+	Bandwidth(ctx context.Context) (*McuClientBandwidth, error)
+}
+
+// McuClientStats contains statistics about the media quality of a client.
+type McuClientStats struct {
+	// Bitrates in bits per second during the last second.
+	BitrateReceived uint64 `json:"bitratereceived"`
+	BitrateSent     uint64 `json:"bitratesent"`
+
+	// Counters since the client was created.
+	Lost  uint64 `json:"lost"`
+	Nacks uint64 `json:"nacks"`
+	Plis  uint64 `json:"plis"`
+
+	// Jitter in milliseconds, the maximum of all streams.
+	Jitter float64 `json:"jitter"`
+}
+
+// McuClientWithStats is implemented by clients that can report statistics
+// about their media quality. A nil result is returned if they are unknown.
+type McuClientWithStats interface {
+	Stats(ctx context.Context) (*McuClientStats, error)
+}
+
+// McuPublisherMediaListener can be implemented by listeners of publishers to
+// get notified if the MCU starts or stops receiving media from the publisher.
+type McuPublisherMediaListener interface {
+	PublisherMediaChanged(publisher McuPublisher, mediaType MediaType, receiving bool)
+}
+
+// McuPublisherTalkingListener can be implemented by listeners of publishers to
+// get notified if the MCU detected that the publisher started or stopped
+// talking. The level is the average audio level in -dBov (0 is loudest).
+type McuPublisherTalkingListener interface {
+	PublisherTalking(publisher McuPublisher, talking bool, level float64)
+}
+
+// McuClientWithProxy is implemented by clients that are hosted on one of
+// multiple MCU proxies.
+type McuClientWithProxy interface {
+	// ProxyUrl returns the url of the proxy the client is hosted on.
+	ProxyUrl() string
+}
+
 type McuPublisher interface {
 	McuClient
 
@@ -29,6 +29,7 @@ import (
 	"log"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,7 +39,8 @@ import (
 )
 
 const (
-	pluginVideoRoom = "janus.plugin.videoroom"
+	pluginVideoRoom   = "janus.plugin.videoroom"
+	pluginAudioBridge = "janus.plugin.audiobridge"
 
 	keepaliveInterval = 30 * time.Second
 
@@ -53,6 +55,9 @@ const (
 
 	streamTypeVideo  = "video"
 	streamTypeScreen = "screen"
+
+	// Participants of audio-only rooms that are mixed by the MCU.
+	streamTypeAudioBridge = "audiobridge"
 )
 
 var (
@@ -125,6 +130,31 @@ func getPluginStringValue(data janus.PluginData, pluginName string, key string)
 	return strVal
 }
 
+func getPluginFloatValue(data janus.PluginData, pluginName string, key string) float64 {
+	switch val := getPluginValue(data, pluginName, key).(type) {
+	case float64:
+		return val
+	case json.Number:
+		result, err := val.Float64()
+		if err != nil {
+			log.Printf("Invalid value %+v for %s: %s", val, key, err)
+			return 0
+		}
+		return result
+	default:
+		return 0
+	}
+}
+
+func getPluginError(data janus.PluginData, pluginName string) error {
+	if msg := getPluginStringValue(data, pluginName, "error"); msg != "" {
+		code := getPluginIntValue(data, pluginName, "error_code")
+		return fmt.Errorf("Plugin error %d: %s", code, msg)
+	}
+
+	return nil
+}
+
 // TODO(jojo): Lots of error handling still missing.
 
 type clientInterface interface {
@@ -141,10 +171,23 @@ type mcuJanus struct {
 	maxStreamBitrate int
 	maxScreenBitrate int
 	mcuTimeout       time.Duration
-
-	gw      *JanusGateway
-	session *JanusSession
-	handle  *JanusHandle
+	// Request "talking" events for publishers from Janus.
+	audioLevelEvents bool
+	// Interval in which statistics of the handles are collected.
+	statsInterval   time.Duration
+	collectingStats uint32
+	statsMu         sync.Mutex
+	statsTotals     janusStatsTotals
+	adminKey        string
+	admin           *janusAdminClient
+	// Address other MCUs send the media of cascaded publishers to, defaults
+	// to the address reported by Janus.
+	cascadeHost string
+
+	gw         *JanusGateway
+	gwListener *mcuJanusGatewayListener
+	session    *JanusSession
+	handle     *JanusHandle
 
 	closeChan chan bool
 
@@ -155,6 +198,10 @@ type mcuJanus struct {
 	publisherCreated   Notifier
 	publisherConnected Notifier
 
+	audioBridgeSupported bool
+	muAudioBridge        sync.Mutex
+	audioBridgeRooms     map[string]*mcuJanusAudioBridgeRoom
+
 	reconnectTimer    *time.Timer
 	reconnectInterval time.Duration
 
@@ -163,10 +210,42 @@ type mcuJanus struct {
 	onDisconnected atomic.Value
 }
 
+func init() {
+	RegisterMcuType(McuTypeJanus, NewMcuJanus, RegisterJanusMcuStats, UnregisterJanusMcuStats)
+}
+
 func emptyOnConnected()    {}
 func emptyOnDisconnected() {}
 
 func NewMcuJanus(url string, config *goconf.ConfigFile) (Mcu, error) {
+	if urls := strings.Fields(url); len(urls) > 1 {
+		return newMcuJanusPool(urls, config)
+	}
+
+	adminUrl, _ := config.GetString("mcu", "adminurl")
+	mcu := newMcuJanus(url, adminUrl, config)
+	if err := mcu.reconnect(); err != nil {
+		return nil, err
+	}
+	return mcu, nil
+}
+
+// mcuJanusGatewayListener forwards interruptions of a gateway connection to
+// the MCU unless the connection was closed intentionally.
+type mcuJanusGatewayListener struct {
+	// 32-bit members that are accessed atomically must be 32-bit aligned.
+	closed uint32
+
+	mcu *mcuJanus
+}
+
+func (l *mcuJanusGatewayListener) ConnectionInterrupted() {
+	if atomic.LoadUint32(&l.closed) == 0 {
+		l.mcu.ConnectionInterrupted()
+	}
+}
+
+func getJanusMaxBitrates(config *goconf.ConfigFile) (int, int) {
 	maxStreamBitrate, _ := config.GetInt("mcu", "maxstreambitrate")
 	if maxStreamBitrate <= 0 {
 		maxStreamBitrate = defaultMaxStreamBitrate
@@ -175,21 +254,35 @@ func NewMcuJanus(url string, config *goconf.ConfigFile) (Mcu, error) {
 	if maxScreenBitrate <= 0 {
 		maxScreenBitrate = defaultMaxScreenBitrate
 	}
+	return maxStreamBitrate, maxScreenBitrate
+}
+
+func newMcuJanus(url string, adminUrl string, config *goconf.ConfigFile) *mcuJanus {
+	maxStreamBitrate, maxScreenBitrate := getJanusMaxBitrates(config)
 	mcuTimeoutSeconds, _ := config.GetInt("mcu", "timeout")
 	if mcuTimeoutSeconds <= 0 {
 		mcuTimeoutSeconds = defaultMcuTimeoutSeconds
 	}
 	mcuTimeout := time.Duration(mcuTimeoutSeconds) * time.Second
+	adminKey, _ := config.GetString("mcu", "adminkey")
+	adminSecret, _ := config.GetString("mcu", "adminsecret")
+	cascadeHost, _ := config.GetString("mcu", "cascadehost")
 
 	mcu := &mcuJanus{
 		url:              url,
 		maxStreamBitrate: maxStreamBitrate,
 		maxScreenBitrate: maxScreenBitrate,
 		mcuTimeout:       mcuTimeout,
+		audioLevelEvents: getActiveSpeakerInterval(config) > 0,
+		statsInterval:    getJanusStatsInterval(config),
+		adminKey:         adminKey,
+		admin:            newJanusAdminClient(adminUrl, adminSecret),
+		cascadeHost:      cascadeHost,
 		closeChan:        make(chan bool, 1),
 		clients:          make(map[clientInterface]bool),
 
-		publishers: make(map[string]*mcuJanusPublisher),
+		publishers:       make(map[string]*mcuJanusPublisher),
+		audioBridgeRooms: make(map[string]*mcuJanusAudioBridgeRoom),
 
 		reconnectInterval: initialReconnectInterval,
 	}
@@ -198,10 +291,7 @@ func NewMcuJanus(url string, config *goconf.ConfigFile) (Mcu, error) {
 
 	mcu.reconnectTimer = time.AfterFunc(mcu.reconnectInterval, mcu.doReconnect)
 	mcu.reconnectTimer.Stop()
-	if err := mcu.reconnect(); err != nil {
-		return nil, err
-	}
-	return mcu, nil
+	return mcu
 }
 
 func (m *mcuJanus) disconnect() {
@@ -219,21 +309,33 @@ func (m *mcuJanus) disconnect() {
 		m.session = nil
 	}
 	if m.gw != nil {
+		atomic.StoreUint32(&m.gwListener.closed, 1)
 		if err := m.gw.Close(); err != nil {
 			log.Println("Error while closing connection to MCU", err)
 		}
 		m.gw = nil
+		m.gwListener = nil
 	}
 }
 
+func (m *mcuJanus) getUrl() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.url
+}
+
 func (m *mcuJanus) reconnect() error {
 	m.disconnect()
-	gw, err := NewJanusGateway(m.url, m)
+	listener := &mcuJanusGatewayListener{
+		mcu: m,
+	}
+	gw, err := NewJanusGateway(m.getUrl(), listener)
 	if err != nil {
 		return err
 	}
 
 	m.gw = gw
+	m.gwListener = listener
 	m.reconnectTimer.Stop()
 	return nil
 }
@@ -256,11 +358,41 @@ func (m *mcuJanus) doReconnect() {
 	m.reconnectInterval = initialReconnectInterval
 	m.mu.Unlock()
 
-	m.muClients.Lock()
-	for client := range m.clients {
+	m.muAudioBridge.Lock()
+	m.audioBridgeRooms = make(map[string]*mcuJanusAudioBridgeRoom)
+	m.muAudioBridge.Unlock()
+
+	m.reconcileClients()
+}
+
+// reconcileClients re-creates the state of all clients after the connection
+// to Janus was re-established. The rooms of the publishers are created first
+// so the subscribers can attach to them afterwards. The clients are notified
+// that they need to renegotiate their connections.
+func (m *mcuJanus) reconcileClients() {
+	var publishers []clientInterface
+	var others []clientInterface
+	for _, client := range m.getClients() {
+		if _, ok := client.(*mcuJanusPublisher); ok {
+			publishers = append(publishers, client)
+		} else {
+			others = append(others, client)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, client := range publishers {
+		wg.Add(1)
+		go func(client clientInterface) {
+			defer wg.Done()
+			client.NotifyReconnected()
+		}(client)
+	}
+	wg.Wait()
+
+	for _, client := range others {
 		go client.NotifyReconnected()
 	}
-	m.muClients.Unlock()
 }
 
 func (m *mcuJanus) scheduleReconnect(err error) {
@@ -298,6 +430,14 @@ func (m *mcuJanus) Start() error {
 	}
 
 	log.Printf("Found %s %s by %s", plugin.Name, plugin.VersionString, plugin.Author)
+	audioBridge, audioBridgeSupported := info.Plugins[pluginAudioBridge]
+	if audioBridgeSupported {
+		log.Printf("Found %s %s by %s", audioBridge.Name, audioBridge.VersionString, audioBridge.Author)
+	}
+	m.mu.Lock()
+	m.audioBridgeSupported = audioBridgeSupported
+	m.mu.Unlock()
+
 	if !info.DataChannels {
 		return fmt.Errorf("Data channels are not supported")
 	}
@@ -308,8 +448,10 @@ func (m *mcuJanus) Start() error {
 	} else {
 		log.Println("Full-Trickle is enabled")
 	}
+	m.mu.Lock()
 	log.Printf("Maximum bandwidth %d bits/sec per publishing stream", m.maxStreamBitrate)
 	log.Printf("Maximum bandwidth %d bits/sec per screensharing stream", m.maxScreenBitrate)
+	m.mu.Unlock()
 
 	if m.session, err = m.gw.Create(ctx); err != nil {
 		m.disconnect()
@@ -346,11 +488,22 @@ func (m *mcuJanus) run() {
 	ticker := time.NewTicker(keepaliveInterval)
 	defer ticker.Stop()
 
+	var statsTicker <-chan time.Time
+	if m.admin != nil && m.statsInterval > 0 {
+		t := time.NewTicker(m.statsInterval)
+		defer t.Stop()
+		statsTicker = t.C
+		// Statistics of a previous connection are no longer valid.
+		defer m.setStatsTotals(nil)
+	}
+
 loop:
 	for {
 		select {
 		case <-ticker.C:
 			m.sendKeepalive()
+		case <-statsTicker:
+			go m.collectStats()
 		case <-m.closeChan:
 			break loop
 		}
@@ -363,6 +516,43 @@ func (m *mcuJanus) Stop() {
 }
 
 func (m *mcuJanus) Reload(config *goconf.ConfigFile) {
+	m.reloadBitrates(config)
+
+	url, _ := config.GetString("mcu", "url")
+	if urls := strings.Fields(url); len(urls) != 1 {
+		if len(urls) > 1 {
+			log.Printf("Switching from a single Janus gateway to multiple gateways requires a restart")
+		}
+		return
+	}
+
+	m.mu.Lock()
+	if url == m.url {
+		m.mu.Unlock()
+		return
+	}
+
+	log.Printf("Janus gateway changed from %s to %s, reconnecting", m.url, url)
+	m.url = url
+	m.reconnectInterval = initialReconnectInterval
+	m.reconnectTimer.Reset(0)
+	m.mu.Unlock()
+	m.notifyOnDisconnected()
+}
+
+func (m *mcuJanus) reloadBitrates(config *goconf.ConfigFile) {
+	maxStreamBitrate, maxScreenBitrate := getJanusMaxBitrates(config)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if maxStreamBitrate != m.maxStreamBitrate {
+		log.Printf("Maximum bandwidth per publishing stream changed from %d to %d bits/sec", m.maxStreamBitrate, maxStreamBitrate)
+		m.maxStreamBitrate = maxStreamBitrate
+	}
+	if maxScreenBitrate != m.maxScreenBitrate {
+		log.Printf("Maximum bandwidth per screensharing stream changed from %d to %d bits/sec", m.maxScreenBitrate, maxScreenBitrate)
+		m.maxScreenBitrate = maxScreenBitrate
+	}
 }
 
 func (m *mcuJanus) SetOnConnected(f func()) {
@@ -401,7 +591,7 @@ type mcuJanusConnectionStats struct {
 
 func (m *mcuJanus) GetStats() interface{} {
 	result := mcuJanusConnectionStats{
-		Url: m.url,
+		Url: m.getUrl(),
 	}
 	if m.session != nil {
 		result.Connected = true
@@ -416,6 +606,35 @@ func (m *mcuJanus) GetStats() interface{} {
 	return result
 }
 
+// checkHealth performs a request against the Janus gateway to make sure it
+// is still responding.
+func (m *mcuJanus) checkHealth(ctx context.Context) error {
+	gw := m.gw
+	if gw == nil || m.session == nil {
+		return ErrNotConnected
+	}
+
+	_, err := gw.Info(ctx)
+	return err
+}
+
+func (m *mcuJanus) getClients() []clientInterface {
+	m.muClients.Lock()
+	defer m.muClients.Unlock()
+	result := make([]clientInterface, 0, len(m.clients))
+	for client := range m.clients {
+		result = append(result, client)
+	}
+	return result
+}
+
+func (m *mcuJanus) hasPublisher(publisher string, streamType string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.publishers[publisher+"|"+streamType]
+	return found
+}
+
 func (m *mcuJanus) sendKeepalive() {
 	ctx := context.TODO()
 	if _, err := m.session.KeepAlive(ctx); err != nil {
@@ -486,6 +705,18 @@ func (c *mcuJanusClient) closeClient(ctx context.Context) bool {
 	return false
 }
 
+// replaceHandleLocked switches the client to a new handle, e.g. after the
+// connection to Janus was re-established. The lock must be held.
+func (c *mcuJanusClient) replaceHandleLocked(handle *JanusHandle) {
+	if c.handle != nil {
+		c.closeChan <- true
+	}
+	c.handle = handle
+	c.handleId = handle.Id
+	c.closeChan = make(chan bool, 1)
+	go c.run(handle, c.closeChan)
+}
+
 func (c *mcuJanusClient) run(handle *JanusHandle, closeChan chan bool) {
 loop:
 	for {
@@ -688,6 +919,8 @@ type mcuJanusPublisher struct {
 	bitrate    int
 	mediaTypes MediaType
 	stats      publisherStatsCounter
+	layers     atomic.Value
+	streams    atomic.Value
 }
 
 func (m *mcuJanus) SubscriberConnected(id string, publisher string, streamType string) {
@@ -716,17 +949,27 @@ func min(a, b int) int {
 	return b
 }
 
-func (m *mcuJanus) getOrCreatePublisherHandle(ctx context.Context, id string, streamType string, bitrate int) (*JanusHandle, uint64, uint64, error) {
-	session := m.session
-	if session == nil {
-		return nil, 0, 0, ErrNotConnected
+// getPublisherBitrate returns the bitrate to use for a publisher, capped to
+// the maximum bitrate configured for the stream type.
+func (m *mcuJanus) getPublisherBitrate(streamType string, bitrate int) int {
+	var maxBitrate int
+	m.mu.Lock()
+	if streamType == streamTypeScreen {
+		maxBitrate = m.maxScreenBitrate
+	} else {
+		maxBitrate = m.maxStreamBitrate
 	}
-	handle, err := session.Attach(ctx, pluginVideoRoom)
-	if err != nil {
-		return nil, 0, 0, err
+	m.mu.Unlock()
+	if bitrate <= 0 {
+		return maxBitrate
 	}
 
-	log.Printf("Attached %s as publisher %d to plugin %s in session %d", streamType, handle.Id, pluginVideoRoom, session.Id)
+	return min(bitrate, maxBitrate)
+}
+
+// createPublisherRoom creates the room a publisher will join, every publisher
+// uses its own room.
+func (m *mcuJanus) createPublisherRoom(ctx context.Context, handle *JanusHandle, id string, streamType string, bitrate int) (uint64, error) {
 	create_msg := map[string]interface{}{
 		"request":     "create",
 		"description": id + "|" + streamType,
@@ -736,35 +979,42 @@ func (m *mcuJanus) getOrCreatePublisherHandle(ctx context.Context, id string, st
 		// orientation changes in Firefox.
 		"videoorient_ext": false,
 	}
-	var maxBitrate int
-	if streamType == streamTypeScreen {
-		maxBitrate = m.maxScreenBitrate
-	} else {
-		maxBitrate = m.maxStreamBitrate
-	}
-	if bitrate <= 0 {
-		bitrate = maxBitrate
-	} else {
-		bitrate = min(bitrate, maxBitrate)
+	create_msg["bitrate"] = m.getPublisherBitrate(streamType, bitrate)
+	if m.audioLevelEvents && streamType == streamTypeVideo {
+		create_msg["audiolevel_event"] = true
 	}
-	create_msg["bitrate"] = bitrate
 	create_response, err := handle.Request(ctx, create_msg)
 	if err != nil {
-		if _, err2 := handle.Detach(ctx); err2 != nil {
-			log.Printf("Error detaching handle %d: %s", handle.Id, err2)
-		}
-		return nil, 0, 0, err
+		return 0, err
 	}
 
 	roomId := getPluginIntValue(create_response.PluginData, pluginVideoRoom, "room")
 	if roomId == 0 {
-		if _, err := handle.Detach(ctx); err != nil {
-			log.Printf("Error detaching handle %d: %s", handle.Id, err)
-		}
-		return nil, 0, 0, fmt.Errorf("No room id received: %+v", create_response)
+		return 0, fmt.Errorf("No room id received: %+v", create_response)
 	}
 
 	log.Println("Created room", roomId, create_response.PluginData)
+	return roomId, nil
+}
+
+func (m *mcuJanus) getOrCreatePublisherHandle(ctx context.Context, id string, streamType string, bitrate int) (*JanusHandle, uint64, uint64, error) {
+	session := m.session
+	if session == nil {
+		return nil, 0, 0, ErrNotConnected
+	}
+	handle, err := session.Attach(ctx, pluginVideoRoom)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	log.Printf("Attached %s as publisher %d to plugin %s in session %d", streamType, handle.Id, pluginVideoRoom, session.Id)
+	roomId, err := m.createPublisherRoom(ctx, handle, id, streamType, bitrate)
+	if err != nil {
+		if _, err2 := handle.Detach(ctx); err2 != nil {
+			log.Printf("Error detaching handle %d: %s", handle.Id, err2)
+		}
+		return nil, 0, 0, err
+	}
 
 	msg := map[string]interface{}{
 		"request": "join",
@@ -842,6 +1092,13 @@ func (p *mcuJanusPublisher) handleEvent(event *janus.EventMsg) {
 			go p.Close(ctx)
 		case "slow_link":
 			// Ignore, processed through "handleSlowLink" in the general events.
+		case "talking":
+			fallthrough
+		case "stopped-talking":
+			if listener, ok := p.listener.(McuPublisherTalkingListener); ok {
+				level := getPluginFloatValue(event.Plugindata, pluginVideoRoom, "audio-level-dBov-avg")
+				listener.PublisherTalking(p, videoroom == "talking", level)
+			}
 		default:
 			log.Printf("Unsupported videoroom publisher event in %d: %+v", p.handleId, event)
 		}
@@ -881,6 +1138,15 @@ func (p *mcuJanusPublisher) handleMedia(event *janus.MediaMsg) {
 	}
 
 	p.stats.EnableStream(mediaType, event.Receiving)
+
+	if listener, ok := p.listener.(McuPublisherMediaListener); ok {
+		switch event.Type {
+		case "audio":
+			listener.PublisherMediaChanged(p, MediaTypeAudio, event.Receiving)
+		case "video":
+			listener.PublisherMediaChanged(p, MediaTypeVideo, event.Receiving)
+		}
+	}
 }
 
 func (p *mcuJanusPublisher) HasMedia(mt MediaType) bool {
@@ -892,20 +1158,65 @@ func (p *mcuJanusPublisher) SetMedia(mt MediaType) {
 }
 
 func (p *mcuJanusPublisher) NotifyReconnected() {
-	ctx := context.TODO()
+	ctx, cancel := context.WithTimeout(context.Background(), p.mcu.mcuTimeout)
+	defer cancel()
 	handle, session, roomId, err := p.mcu.getOrCreatePublisherHandle(ctx, p.id, p.streamType, p.bitrate)
 	if err != nil {
 		log.Printf("Could not reconnect publisher %s: %s", p.id, err)
-		// TODO(jojo): Retry
+		p.Close(context.Background())
 		return
 	}
 
-	p.handle = handle
-	p.handleId = handle.Id
+	key := p.id + "|" + p.streamType
+	p.mu.Lock()
+	p.replaceHandleLocked(handle)
 	p.session = session
 	p.roomId = roomId
+	p.mu.Unlock()
+
+	p.mcu.mu.Lock()
+	p.mcu.publishers[key] = p
+	p.mcu.publisherCreated.Notify(key)
+	p.mcu.mu.Unlock()
 
 	log.Printf("Publisher %s reconnected on handle %d", p.id, p.handleId)
+	p.listener.PublisherReconnected(p)
+}
+
+// migrate re-creates the room of the publisher on another Janus instance. The
+// listener is notified that the WebRTC connection of the publisher has to be
+// re-established.
+func (p *mcuJanusPublisher) migrate(ctx context.Context, target *mcuJanus) error {
+	handle, session, roomId, err := target.getOrCreatePublisherHandle(ctx, p.id, p.streamType, p.bitrate)
+	if err != nil {
+		return err
+	}
+
+	key := p.id + "|" + p.streamType
+	p.mu.Lock()
+	previous := p.mcu
+	p.mcu = target
+	p.replaceHandleLocked(handle)
+	p.session = session
+	p.roomId = roomId
+	p.mu.Unlock()
+
+	previous.unregisterClient(p)
+	previous.mu.Lock()
+	if previous.publishers[key] == p {
+		delete(previous.publishers, key)
+	}
+	previous.mu.Unlock()
+
+	target.registerClient(p)
+	target.mu.Lock()
+	target.publishers[key] = p
+	target.publisherCreated.Notify(key)
+	target.mu.Unlock()
+
+	log.Printf("Publisher %s migrated to %s on handle %d", p.id, target.url, p.handleId)
+	p.listener.PublisherReconnected(p)
+	return nil
 }
 
 func (p *mcuJanusPublisher) Close(ctx context.Context) {
@@ -940,6 +1251,52 @@ func (p *mcuJanusPublisher) Close(ctx context.Context) {
 	p.mcuJanusClient.Close(ctx)
 }
 
+func (p *mcuJanusPublisher) SetMaxBitrate(ctx context.Context, bitrate int) error {
+	handle := p.handle
+	if handle == nil {
+		return ErrNotConnected
+	}
+
+	defaultBitrate := p.mcu.getPublisherBitrate(p.streamType, p.bitrate)
+	if bitrate <= 0 || bitrate > defaultBitrate {
+		bitrate = defaultBitrate
+	}
+
+	configure_msg := map[string]interface{}{
+		"request": "configure",
+		"bitrate": bitrate,
+	}
+	response, err := handle.Message(ctx, configure_msg, nil)
+	if err != nil {
+		return err
+	}
+
+	return getPluginError(response.Plugindata, pluginVideoRoom)
+}
+
+func (p *mcuJanusPublisher) Mute(ctx context.Context, mediaTypes MediaType) error {
+	handle := p.handle
+	if handle == nil {
+		return ErrNotConnected
+	}
+
+	configure_msg := map[string]interface{}{
+		"request": "configure",
+	}
+	if mediaTypes&MediaTypeAudio != 0 {
+		configure_msg["audio"] = false
+	}
+	if mediaTypes&MediaTypeVideo != 0 {
+		configure_msg["video"] = false
+	}
+	response, err := handle.Message(ctx, configure_msg, nil)
+	if err != nil {
+		return err
+	}
+
+	return getPluginError(response.Plugindata, pluginVideoRoom)
+}
+
 func (p *mcuJanusPublisher) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
 	statsMcuMessagesTotal.WithLabelValues(data.Type).Inc()
 	jsep_msg := data.Payload
@@ -951,7 +1308,13 @@ func (p *mcuJanusPublisher) SendMessage(ctx context.Context, message *MessageCli
 
 			// TODO Tear down previous publisher and get a new one if sid does
 			// not match?
-			p.sendOffer(msgctx, jsep_msg, callback)
+			p.setSimulcastLayers(parseSimulcastLayers(jsep_msg))
+			p.sendOffer(msgctx, jsep_msg, func(err error, answer map[string]interface{}) {
+				if err == nil {
+					p.setStreams(getPublisherStreams(answer))
+				}
+				callback(err, answer)
+			})
 		}
 	case "candidate":
 		p.deferred <- func() {
@@ -1131,10 +1494,12 @@ func (p *mcuJanusSubscriber) NotifyReconnected() {
 		return
 	}
 
-	p.handle = handle
-	p.handleId = handle.Id
+	p.mu.Lock()
+	p.replaceHandleLocked(handle)
 	p.roomId = pub.roomId
 	p.sid = strconv.FormatUint(handle.Id, 10)
+	p.mu.Unlock()
+
 	p.listener.SubscriberSidUpdated(p)
 	log.Printf("Subscriber %d for publisher %s reconnected on handle %d", p.id, p.publisher, p.handleId)
 }
@@ -1153,6 +1518,26 @@ func (p *mcuJanusSubscriber) Close(ctx context.Context) {
 	p.mcuJanusClient.Close(ctx)
 }
 
+func (p *mcuJanusSubscriber) SetPaused(ctx context.Context, paused bool) error {
+	handle := p.handle
+	if handle == nil {
+		return ErrNotConnected
+	}
+
+	request := "start"
+	if paused {
+		request = "pause"
+	}
+	response, err := handle.Message(ctx, map[string]interface{}{
+		"request": request,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return getPluginError(response.Plugindata, pluginVideoRoom)
+}
+
 func (p *mcuJanusSubscriber) joinRoom(ctx context.Context, stream *streamSelection, callback func(error, map[string]interface{})) {
 	handle := p.handle
 	if handle == nil {
@@ -1399,8 +1784,13 @@ func (p *mcuJanusSubscriber) SendMessage(ctx context.Context, message *MessageCl
 		}
 	case "endOfCandidates":
 		// Ignore
+	case "configure":
+		fallthrough
 	case "selectStream":
 		stream, err := parseStreamSelection(jsep_msg)
+		if err == nil && data.Type == "configure" {
+			err = stream.checkLayers(p.SimulcastLayers())
+		}
 		if err != nil {
 			go callback(err, nil)
 			return
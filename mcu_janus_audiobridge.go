@@ -0,0 +1,330 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/notedit/janus-go"
+)
+
+type mcuJanusAudioBridgeRoom struct {
+	roomId       uint64
+	participants int
+}
+
+type mcuJanusAudioBridgeParticipant struct {
+	mcuJanusClient
+
+	id         string
+	room       string
+	mediaTypes MediaType
+}
+
+func (m *mcuJanus) getOrCreateAudioBridgeRoom(ctx context.Context, handle *JanusHandle, room string) (uint64, error) {
+	m.muAudioBridge.Lock()
+	defer m.muAudioBridge.Unlock()
+
+	if r, found := m.audioBridgeRooms[room]; found {
+		r.participants++
+		return r.roomId, nil
+	}
+
+	create_msg := map[string]interface{}{
+		"request":       "create",
+		"description":   room,
+		"sampling_rate": 48000,
+	}
+	create_response, err := handle.Request(ctx, create_msg)
+	if err != nil {
+		return 0, err
+	}
+
+	roomId := getPluginIntValue(create_response.PluginData, pluginAudioBridge, "room")
+	if roomId == 0 {
+		return 0, fmt.Errorf("No room id received: %+v", create_response)
+	}
+
+	log.Printf("Created audio bridge room %d for %s", roomId, room)
+	m.audioBridgeRooms[room] = &mcuJanusAudioBridgeRoom{
+		roomId:       roomId,
+		participants: 1,
+	}
+	return roomId, nil
+}
+
+// releaseAudioBridgeRoom removes a participant from the audio bridge room and
+// destroys it if it was the last one.
+func (m *mcuJanus) releaseAudioBridgeRoom(ctx context.Context, handle *JanusHandle, room string, roomId uint64) {
+	m.muAudioBridge.Lock()
+	defer m.muAudioBridge.Unlock()
+
+	r, found := m.audioBridgeRooms[room]
+	if !found || r.roomId != roomId {
+		return
+	}
+
+	r.participants--
+	if r.participants > 0 {
+		return
+	}
+
+	delete(m.audioBridgeRooms, room)
+	destroy_msg := map[string]interface{}{
+		"request": "destroy",
+		"room":    roomId,
+	}
+	if _, err := handle.Request(ctx, destroy_msg); err != nil {
+		log.Printf("Error destroying audio bridge room %d: %s", roomId, err)
+	} else {
+		log.Printf("Audio bridge room %d destroyed", roomId)
+	}
+}
+
+func (m *mcuJanus) joinAudioBridge(ctx context.Context, id string, room string) (*JanusHandle, uint64, error) {
+	m.mu.Lock()
+	supported := m.audioBridgeSupported
+	m.mu.Unlock()
+	if !supported {
+		return nil, 0, ErrAudioBridgeNotSupported
+	}
+
+	session := m.session
+	if session == nil {
+		return nil, 0, ErrNotConnected
+	}
+	handle, err := session.Attach(ctx, pluginAudioBridge)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.Printf("Attached %s as audio bridge participant %d to plugin %s in session %d", id, handle.Id, pluginAudioBridge, session.Id)
+	roomId, err := m.getOrCreateAudioBridgeRoom(ctx, handle, room)
+	if err != nil {
+		if _, err2 := handle.Detach(ctx); err2 != nil {
+			log.Printf("Error detaching handle %d: %s", handle.Id, err2)
+		}
+		return nil, 0, err
+	}
+
+	join_msg := map[string]interface{}{
+		"request": "join",
+		"room":    roomId,
+		"display": id,
+	}
+	response, err := handle.Message(ctx, join_msg, nil)
+	if err == nil {
+		err = getPluginError(response.Plugindata, pluginAudioBridge)
+	}
+	if err != nil {
+		m.releaseAudioBridgeRoom(ctx, handle, room, roomId)
+		if _, err2 := handle.Detach(ctx); err2 != nil {
+			log.Printf("Error detaching handle %d: %s", handle.Id, err2)
+		}
+		return nil, 0, err
+	}
+
+	return handle, roomId, nil
+}
+
+func (m *mcuJanus) NewAudioBridgeParticipant(ctx context.Context, listener McuListener, roomId string, id string, sid string, mediaTypes MediaType) (McuPublisher, error) {
+	handle, janusRoomId, err := m.joinAudioBridge(ctx, id, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &mcuJanusAudioBridgeParticipant{
+		mcuJanusClient: mcuJanusClient{
+			mcu:      m,
+			listener: listener,
+
+			id:         atomic.AddUint64(&m.clientId, 1),
+			roomId:     janusRoomId,
+			sid:        sid,
+			streamType: streamTypeAudioBridge,
+
+			handle:    handle,
+			handleId:  handle.Id,
+			closeChan: make(chan bool, 1),
+			deferred:  make(chan func(), 64),
+		},
+		id:         id,
+		room:       roomId,
+		mediaTypes: mediaTypes,
+	}
+	client.mcuJanusClient.handleEvent = client.handleEvent
+	client.mcuJanusClient.handleHangup = client.handleHangup
+	client.mcuJanusClient.handleDetached = client.handleDetached
+	client.mcuJanusClient.handleConnected = client.handleConnected
+	client.mcuJanusClient.handleSlowLink = client.handleSlowLink
+	client.mcuJanusClient.handleMedia = client.handleMedia
+
+	m.registerClient(client)
+	log.Printf("Audio bridge participant %s is using handle %d", client.id, client.handleId)
+	go client.run(handle, client.closeChan)
+	statsPublishersCurrent.WithLabelValues(streamTypeAudioBridge).Inc()
+	statsPublishersTotal.WithLabelValues(streamTypeAudioBridge).Inc()
+	return client, nil
+}
+
+func (p *mcuJanusAudioBridgeParticipant) handleEvent(event *janus.EventMsg) {
+	if audiobridge := getPluginStringValue(event.Plugindata, pluginAudioBridge, "audiobridge"); audiobridge != "" {
+		switch audiobridge {
+		case "destroyed":
+			log.Printf("Audio bridge participant %d: associated room has been destroyed, closing", p.handleId)
+			go p.Close(context.Background())
+		case "event":
+			// Ignore, notifications about other participants are sent through
+			// the signaling server.
+		default:
+			log.Printf("Unsupported audio bridge event in %d: %+v", p.handleId, event)
+		}
+	} else {
+		log.Printf("Unsupported audio bridge participant event in %d: %+v", p.handleId, event)
+	}
+}
+
+func (p *mcuJanusAudioBridgeParticipant) handleHangup(event *janus.HangupMsg) {
+	log.Printf("Audio bridge participant %d received hangup (%s), closing", p.handleId, event.Reason)
+	go p.Close(context.Background())
+}
+
+func (p *mcuJanusAudioBridgeParticipant) handleDetached(event *janus.DetachedMsg) {
+	log.Printf("Audio bridge participant %d received detached, closing", p.handleId)
+	go p.Close(context.Background())
+}
+
+func (p *mcuJanusAudioBridgeParticipant) handleConnected(event *janus.WebRTCUpMsg) {
+	log.Printf("Audio bridge participant %d received connected", p.handleId)
+}
+
+func (p *mcuJanusAudioBridgeParticipant) handleSlowLink(event *janus.SlowLinkMsg) {
+	if event.Uplink {
+		log.Printf("Audio bridge participant %s (%d) is reporting %d lost packets on the uplink (Janus -> client)", p.listener.PublicId(), p.handleId, event.Lost)
+	} else {
+		log.Printf("Audio bridge participant %s (%d) is reporting %d lost packets on the downlink (client -> Janus)", p.listener.PublicId(), p.handleId, event.Lost)
+	}
+}
+
+func (p *mcuJanusAudioBridgeParticipant) handleMedia(event *janus.MediaMsg) {
+}
+
+func (p *mcuJanusAudioBridgeParticipant) HasMedia(mt MediaType) bool {
+	return (p.mediaTypes & mt) == mt
+}
+
+func (p *mcuJanusAudioBridgeParticipant) SetMedia(mt MediaType) {
+	p.mediaTypes = mt
+}
+
+func (p *mcuJanusAudioBridgeParticipant) NotifyReconnected() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.mcu.mcuTimeout)
+	defer cancel()
+	handle, roomId, err := p.mcu.joinAudioBridge(ctx, p.id, p.room)
+	if err != nil {
+		log.Printf("Could not reconnect audio bridge participant %s: %s", p.id, err)
+		p.Close(context.Background())
+		return
+	}
+
+	p.mu.Lock()
+	p.replaceHandleLocked(handle)
+	p.roomId = roomId
+	p.mu.Unlock()
+
+	log.Printf("Audio bridge participant %s reconnected on handle %d", p.id, p.handleId)
+	p.listener.PublisherReconnected(p)
+}
+
+func (p *mcuJanusAudioBridgeParticipant) Close(ctx context.Context) {
+	notify := false
+	p.mu.Lock()
+	if handle := p.handle; handle != nil && p.roomId != 0 {
+		p.mcu.releaseAudioBridgeRoom(ctx, handle, p.room, p.roomId)
+		p.roomId = 0
+		notify = true
+	}
+	p.closeClient(ctx)
+	p.mu.Unlock()
+
+	if notify {
+		statsPublishersCurrent.WithLabelValues(streamTypeAudioBridge).Dec()
+		p.mcu.unregisterClient(p)
+		p.listener.PublisherClosed(p)
+	}
+	p.mcuJanusClient.Close(ctx)
+}
+
+func (p *mcuJanusAudioBridgeParticipant) sendOffer(ctx context.Context, offer map[string]interface{}, callback func(error, map[string]interface{})) {
+	handle := p.handle
+	if handle == nil {
+		callback(ErrNotConnected, nil)
+		return
+	}
+
+	configure_msg := map[string]interface{}{
+		"request": "configure",
+		"muted":   false,
+	}
+	answer_msg, err := handle.Message(ctx, configure_msg, offer)
+	if err == nil {
+		err = getPluginError(answer_msg.Plugindata, pluginAudioBridge)
+	}
+	if err != nil {
+		callback(err, nil)
+		return
+	}
+
+	callback(nil, answer_msg.Jsep)
+}
+
+func (p *mcuJanusAudioBridgeParticipant) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
+	statsMcuMessagesTotal.WithLabelValues(data.Type).Inc()
+	jsep_msg := data.Payload
+	switch data.Type {
+	case "offer":
+		p.deferred <- func() {
+			msgctx, cancel := context.WithTimeout(context.Background(), p.mcu.mcuTimeout)
+			defer cancel()
+
+			p.sendOffer(msgctx, jsep_msg, callback)
+		}
+	case "candidate":
+		p.deferred <- func() {
+			msgctx, cancel := context.WithTimeout(context.Background(), p.mcu.mcuTimeout)
+			defer cancel()
+
+			if data.Sid == "" || data.Sid == p.Sid() {
+				p.sendCandidate(msgctx, jsep_msg["candidate"], callback)
+			} else {
+				go callback(fmt.Errorf("Candidate message sid (%s) does not match audio bridge participant sid (%s)", data.Sid, p.Sid()), nil)
+			}
+		}
+	case "endOfCandidates":
+		// Ignore
+	default:
+		go callback(fmt.Errorf("Unsupported message type: %s", data.Type), nil)
+	}
+}
@@ -0,0 +1,162 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	janusAdminTransactionLength = 16
+)
+
+// janusAdminClient performs requests against the HTTP Admin API of Janus.
+type janusAdminClient struct {
+	url    string
+	secret string
+	client http.Client
+}
+
+func newJanusAdminClient(url string, secret string) *janusAdminClient {
+	if url == "" {
+		return nil
+	}
+
+	return &janusAdminClient{
+		url:    strings.TrimSuffix(url, "/"),
+		secret: secret,
+	}
+}
+
+type janusAdminResponse struct {
+	Janus string                 `json:"janus"`
+	Info  map[string]interface{} `json:"info,omitempty"`
+	Error *struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+func (c *janusAdminClient) HandleInfo(ctx context.Context, session uint64, handle uint64) (map[string]interface{}, error) {
+	request := map[string]interface{}{
+		"janus":       "handle_info",
+		"transaction": newRandomString(janusAdminTransactionLength),
+	}
+	if c.secret != "" {
+		request["admin_secret"] = c.secret
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%s/%d/%d", c.url, session, handle)
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var response janusAdminResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("could not decode admin response %s from %s: %w", string(body), u, err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("admin request to %s failed: %s (%d)", u, response.Error.Reason, response.Error.Code)
+	} else if response.Janus != "success" {
+		return nil, fmt.Errorf("unexpected admin response %s from %s", string(body), u)
+	}
+
+	return response.Info, nil
+}
+
+// getJanusHandleBandwidth returns the bandwidth in bits per second that was
+// received and sent by a handle during the last second. The byte counters
+// are collected from all "in_stats" / "out_stats" entries of the handle
+// info, which covers both the single-stream layout of Janus 0.x and the
+// multistream layout of Janus 1.x. Counters of simulcast substreams have a
+// suffix (e.g. "video_bytes_lastsec-1") and are included as well.
+func getJanusHandleBandwidth(info map[string]interface{}) *McuClientBandwidth {
+	var received uint64
+	var sent uint64
+	var walk func(value interface{}, counter *uint64)
+	walk = func(value interface{}, counter *uint64) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, entry := range v {
+				switch {
+				case key == "in_stats":
+					walk(entry, &received)
+				case key == "out_stats":
+					walk(entry, &sent)
+				case counter != nil && strings.Contains(key, "bytes_lastsec"):
+					if value, err := convertIntValue(entry); err == nil {
+						*counter += value
+					}
+				default:
+					walk(entry, counter)
+				}
+			}
+		case []interface{}:
+			for _, entry := range v {
+				walk(entry, counter)
+			}
+		}
+	}
+	walk(info, nil)
+
+	return &McuClientBandwidth{
+		Received: received * 8,
+		Sent:     sent * 8,
+	}
+}
+
+func (c *mcuJanusClient) Bandwidth(ctx context.Context) (*McuClientBandwidth, error) {
+	admin := c.mcu.admin
+	if admin == nil {
+		return nil, nil
+	}
+
+	info, err := admin.HandleInfo(ctx, c.session, c.handleId)
+	if err != nil {
+		return nil, err
+	}
+
+	return getJanusHandleBandwidth(info), nil
+}
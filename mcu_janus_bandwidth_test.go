@@ -0,0 +1,105 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetJanusHandleBandwidth(t *testing.T) {
+	testcases := []struct {
+		info     string
+		expected McuClientBandwidth
+	}{
+		{
+			// Janus 0.x
+			`{"plugin":"janus.plugin.videoroom","streams":[{"id":1,"components":[{"id":1,"in_stats":{"audio_packets":100,"audio_bytes":10000,"audio_bytes_lastsec":1000,"video_packets":500,"video_bytes":100000,"video_bytes_lastsec":20000},"out_stats":{"audio_packets":0,"audio_bytes":0,"audio_bytes_lastsec":0,"video_bytes_lastsec":0}}]}]}`,
+			McuClientBandwidth{Received: 21000 * 8, Sent: 0},
+		},
+		{
+			// Janus 1.x
+			`{"plugin":"janus.plugin.videoroom","webrtc":{"media":[{"mindex":0,"type":"audio","in_stats":{"packets":100,"bytes":10000,"bytes_lastsec":0},"out_stats":{"packets":100,"bytes":10000,"bytes_lastsec":1500}},{"mindex":1,"type":"video","in_stats":{"video_bytes_lastsec":0},"out_stats":{"video_bytes_lastsec":25000,"video_bytes_lastsec-1":7000}}]}}`,
+			McuClientBandwidth{Received: 0, Sent: 33500 * 8},
+		},
+		{
+			// No WebRTC connection
+			`{"plugin":"janus.plugin.videoroom","handle_id":123}`,
+			McuClientBandwidth{},
+		},
+	}
+
+	for idx, tc := range testcases {
+		var info map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.info), &info); err != nil {
+			t.Fatal(err)
+		}
+
+		if bandwidth := getJanusHandleBandwidth(info); *bandwidth != tc.expected {
+			t.Errorf("Test %d: expected %+v, got %+v", idx, tc.expected, bandwidth)
+		}
+	}
+}
+
+func TestJanusAdminClientHandleInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if r.URL.Path != "/admin/123/456" {
+			w.Write([]byte(`{"janus":"error","error":{"code":458,"reason":"No such session"}}`)) // nolint
+			return
+		} else if request["janus"] != "handle_info" || request["admin_secret"] != "the-secret" {
+			t.Errorf("Unexpected request %+v", request)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"janus":"success","transaction":"` + request["transaction"].(string) + `","info":{"streams":[{"components":[{"in_stats":{"audio_bytes_lastsec":100}}]}]}}`)) // nolint
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	admin := newJanusAdminClient(server.URL+"/admin/", "the-secret")
+	info, err := admin.HandleInfo(ctx, 123, 456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bandwidth := getJanusHandleBandwidth(info); bandwidth.Received != 800 || bandwidth.Sent != 0 {
+		t.Errorf("Unexpected bandwidth %+v", bandwidth)
+	}
+
+	if _, err := admin.HandleInfo(ctx, 123, 789); err == nil {
+		t.Error("Expected error for unknown handle")
+	}
+
+	if admin := newJanusAdminClient("", ""); admin != nil {
+		t.Errorf("Expected no admin client without url, got %+v", admin)
+	}
+}
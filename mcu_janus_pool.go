@@ -0,0 +1,426 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Number of points per Janus instance on the consistent hash ring.
+	janusHashRingReplicas = 128
+
+	defaultJanusHealthCheckInterval = 10 * time.Second
+)
+
+type janusHashRingPoint struct {
+	hash  uint32
+	owner int
+}
+
+// janusHashRing distributes keys over a list of owners using consistent
+// hashing, so adding or removing an owner only moves the keys assigned to it.
+type janusHashRing struct {
+	points []janusHashRingPoint
+}
+
+func hashJanusRingKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key)) // nolint
+	return h.Sum32()
+}
+
+func newJanusHashRing(names []string, replicas int) *janusHashRing {
+	points := make([]janusHashRingPoint, 0, len(names)*replicas)
+	for owner, name := range names {
+		for i := 0; i < replicas; i++ {
+			points = append(points, janusHashRingPoint{
+				hash:  hashJanusRingKey(name + "#" + strconv.Itoa(i)),
+				owner: owner,
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].owner < points[j].owner
+		}
+		return points[i].hash < points[j].hash
+	})
+	return &janusHashRing{
+		points: points,
+	}
+}
+
+// Get returns the owner for the given key, skipping owners that are not
+// accepted by the (optional) filter function. Returns -1 if no owner could
+// be found.
+func (r *janusHashRing) Get(key string, accept func(owner int) bool) int {
+	if len(r.points) == 0 {
+		return -1
+	}
+
+	hash := hashJanusRingKey(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	for i := 0; i < len(r.points); i++ {
+		point := r.points[(start+i)%len(r.points)]
+		if accept == nil || accept(point.owner) {
+			return point.owner
+		}
+	}
+	return -1
+}
+
+type mcuJanusPoolInstance struct {
+	// 32-bit members that are accessed atomically must be 32-bit aligned.
+	healthy uint32
+
+	mcu *mcuJanus
+}
+
+func (i *mcuJanusPoolInstance) isHealthy() bool {
+	return atomic.LoadUint32(&i.healthy) != 0
+}
+
+// mcuJanusPool manages connections to multiple Janus instances. The rooms of
+// publishers are sharded across the instances, subscribers are created on
+// the instance that hosts the room of their publisher.
+type mcuJanusPool struct {
+	// 32-bit members that are accessed atomically must be 32-bit aligned.
+	healthyCount int32
+
+	instances []*mcuJanusPoolInstance
+	ring      *janusHashRing
+
+	mcuTimeout          time.Duration
+	healthCheckInterval time.Duration
+	closeChan           chan bool
+
+	onConnected    atomic.Value
+	onDisconnected atomic.Value
+}
+
+func newMcuJanusPool(urls []string, config *goconf.ConfigFile) (Mcu, error) {
+	healthCheckInterval := defaultJanusHealthCheckInterval
+	if seconds, _ := config.GetInt("mcu", "healthcheckinterval"); seconds > 0 {
+		healthCheckInterval = time.Duration(seconds) * time.Second
+	}
+
+	pool := &mcuJanusPool{
+		ring: newJanusHashRing(urls, janusHashRingReplicas),
+
+		healthCheckInterval: healthCheckInterval,
+		closeChan:           make(chan bool, 1),
+	}
+	pool.onConnected.Store(emptyOnConnected)
+	pool.onDisconnected.Store(emptyOnDisconnected)
+
+	adminUrl, _ := config.GetString("mcu", "adminurl")
+	adminUrls := strings.Fields(adminUrl)
+	if len(adminUrls) > 0 && len(adminUrls) != len(urls) {
+		log.Printf("Got %d admin urls for %d Janus gateways, bandwidth reporting will be disabled", len(adminUrls), len(urls))
+		adminUrls = nil
+	}
+
+	var lastErr error
+	connected := 0
+	for idx, url := range urls {
+		adminUrl := ""
+		if len(adminUrls) > 0 {
+			adminUrl = adminUrls[idx]
+		}
+		instance := &mcuJanusPoolInstance{
+			mcu: newMcuJanus(url, adminUrl, config),
+		}
+		pool.mcuTimeout = instance.mcu.mcuTimeout
+		if err := instance.mcu.reconnect(); err != nil {
+			log.Printf("Could not connect to Janus gateway at %s: %s", url, err)
+			lastErr = err
+		} else {
+			connected++
+		}
+		instance.mcu.SetOnConnected(func() {
+			pool.instanceConnected(instance)
+		})
+		instance.mcu.SetOnDisconnected(func() {
+			pool.instanceDisconnected(instance)
+		})
+		pool.instances = append(pool.instances, instance)
+	}
+
+	if connected == 0 {
+		pool.stopInstances()
+		return nil, lastErr
+	}
+
+	return pool, nil
+}
+
+func (p *mcuJanusPool) Start() error {
+	started := 0
+	for _, instance := range p.instances {
+		m := instance.mcu
+		if m.gw == nil {
+			m.scheduleReconnect(ErrNotConnected)
+			continue
+		}
+
+		if err := m.Start(); err != nil {
+			log.Printf("Could not start Janus gateway at %s: %s", m.url, err)
+			m.scheduleReconnect(err)
+			continue
+		}
+
+		started++
+	}
+
+	if started == 0 {
+		p.stopInstances()
+		return fmt.Errorf("Could not start any of the %d Janus gateways", len(p.instances))
+	}
+
+	go p.run()
+	return nil
+}
+
+func (p *mcuJanusPool) stopInstances() {
+	for _, instance := range p.instances {
+		instance.mcu.Stop()
+	}
+}
+
+func (p *mcuJanusPool) Stop() {
+	select {
+	case p.closeChan <- true:
+	default:
+	}
+	p.stopInstances()
+}
+
+func (p *mcuJanusPool) Reload(config *goconf.ConfigFile) {
+	for _, instance := range p.instances {
+		instance.mcu.reloadBitrates(config)
+	}
+
+	// The rooms are sharded based on the list of gateways, so changing it
+	// would move existing rooms to other instances.
+	url, _ := config.GetString("mcu", "url")
+	urls := strings.Fields(url)
+	changed := len(urls) != len(p.instances)
+	for idx := 0; !changed && idx < len(urls); idx++ {
+		changed = urls[idx] != p.instances[idx].mcu.url
+	}
+	if changed {
+		log.Printf("Changing the list of Janus gateways requires a restart")
+	}
+}
+
+func (p *mcuJanusPool) run() {
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+		case <-p.closeChan:
+			break loop
+		}
+	}
+}
+
+func (p *mcuJanusPool) checkHealth() {
+	for _, instance := range p.instances {
+		if !instance.isHealthy() {
+			// Unhealthy instances are reconnected automatically.
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.mcuTimeout)
+		err := instance.mcu.checkHealth(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Health check of Janus gateway at %s failed: %s", instance.mcu.url, err)
+			p.instanceDisconnected(instance)
+			instance.mcu.scheduleReconnect(err)
+		}
+	}
+}
+
+func (p *mcuJanusPool) instanceConnected(instance *mcuJanusPoolInstance) {
+	if !atomic.CompareAndSwapUint32(&instance.healthy, 0, 1) {
+		return
+	}
+
+	log.Printf("Janus gateway at %s is available", instance.mcu.url)
+	if atomic.AddInt32(&p.healthyCount, 1) == 1 {
+		p.notifyOnConnected()
+	}
+}
+
+func (p *mcuJanusPool) instanceDisconnected(instance *mcuJanusPoolInstance) {
+	if !atomic.CompareAndSwapUint32(&instance.healthy, 1, 0) {
+		return
+	}
+
+	log.Printf("Janus gateway at %s is no longer available", instance.mcu.url)
+	if atomic.AddInt32(&p.healthyCount, -1) == 0 {
+		p.notifyOnDisconnected()
+	}
+	go p.failover(instance)
+}
+
+// failover re-creates the rooms of publishers hosted on a failed instance on
+// healthy instances. Subscribers and audio bridge participants of the failed
+// instance are closed and need to be re-created by the clients.
+func (p *mcuJanusPool) failover(failed *mcuJanusPoolInstance) {
+	var closed []McuClient
+	for _, client := range failed.mcu.getClients() {
+		switch client := client.(type) {
+		case *mcuJanusPublisher:
+			target := p.getInstance(client.id, failed)
+			if target == nil {
+				log.Printf("No healthy Janus gateway available for publisher %s, waiting for %s to reconnect", client.id, failed.mcu.url)
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.mcuTimeout)
+			if err := client.migrate(ctx, target.mcu); err != nil {
+				log.Printf("Could not migrate publisher %s to %s: %s", client.id, target.mcu.url, err)
+			}
+			cancel()
+		case *mcuJanusSubscriber:
+			closed = append(closed, client)
+		case *mcuJanusAudioBridgeParticipant:
+			closed = append(closed, client)
+		}
+	}
+
+	for _, client := range closed {
+		ctx, cancel := context.WithTimeout(context.Background(), p.mcuTimeout)
+		client.Close(ctx)
+		cancel()
+	}
+}
+
+func (p *mcuJanusPool) getInstance(key string, exclude *mcuJanusPoolInstance) *mcuJanusPoolInstance {
+	idx := p.ring.Get(key, func(owner int) bool {
+		instance := p.instances[owner]
+		return instance != exclude && instance.isHealthy()
+	})
+	if idx < 0 {
+		return nil
+	}
+
+	return p.instances[idx]
+}
+
+func (p *mcuJanusPool) SetOnConnected(f func()) {
+	if f == nil {
+		f = emptyOnConnected
+	}
+
+	p.onConnected.Store(f)
+}
+
+func (p *mcuJanusPool) notifyOnConnected() {
+	f := p.onConnected.Load().(func())
+	f()
+}
+
+func (p *mcuJanusPool) SetOnDisconnected(f func()) {
+	if f == nil {
+		f = emptyOnDisconnected
+	}
+
+	p.onDisconnected.Store(f)
+}
+
+func (p *mcuJanusPool) notifyOnDisconnected() {
+	f := p.onDisconnected.Load().(func())
+	f()
+}
+
+type mcuJanusPoolStats struct {
+	Publishers int64                     `json:"publishers"`
+	Clients    int64                     `json:"clients"`
+	Details    []mcuJanusConnectionStats `json:"details"`
+}
+
+func (p *mcuJanusPool) GetStats() interface{} {
+	result := &mcuJanusPoolStats{}
+	for _, instance := range p.instances {
+		stats := instance.mcu.GetStats().(mcuJanusConnectionStats)
+		result.Publishers += stats.Publishers
+		result.Clients += stats.Clients
+		result.Details = append(result.Details, stats)
+	}
+	return result
+}
+
+func (p *mcuJanusPool) NewPublisher(ctx context.Context, listener McuListener, id string, sid string, streamType string, bitrate int, mediaTypes MediaType, initiator McuInitiator) (McuPublisher, error) {
+	instance := p.getInstance(id, nil)
+	if instance == nil {
+		return nil, ErrNotConnected
+	}
+
+	return instance.mcu.NewPublisher(ctx, listener, id, sid, streamType, bitrate, mediaTypes, initiator)
+}
+
+func (p *mcuJanusPool) NewSubscriber(ctx context.Context, listener McuListener, publisher string, streamType string) (McuSubscriber, error) {
+	for _, instance := range p.instances {
+		if instance.mcu.hasPublisher(publisher, streamType) {
+			return instance.mcu.NewSubscriber(ctx, listener, publisher, streamType)
+		}
+	}
+
+	// The publisher has not been created yet, wait for it on the instance it
+	// will most likely be created on.
+	instance := p.getInstance(publisher, nil)
+	if instance == nil {
+		return nil, ErrNotConnected
+	}
+
+	return instance.mcu.NewSubscriber(ctx, listener, publisher, streamType)
+}
+
+func (p *mcuJanusPool) NewAudioBridgeParticipant(ctx context.Context, listener McuListener, roomId string, id string, sid string, mediaTypes MediaType) (McuPublisher, error) {
+	// All participants of a room must be mixed on the same instance.
+	instance := p.getInstance(roomId, nil)
+	if instance == nil {
+		return nil, ErrNotConnected
+	}
+
+	return instance.mcu.NewAudioBridgeParticipant(ctx, listener, roomId, id, sid, mediaTypes)
+}
@@ -0,0 +1,85 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestJanusHashRing(t *testing.T) {
+	names := []string{
+		"ws://janus1",
+		"ws://janus2",
+		"ws://janus3",
+	}
+	ring := newJanusHashRing(names, janusHashRingReplicas)
+
+	const count = 3000
+	assigned := make(map[string]int)
+	counts := make(map[int]int)
+	for i := 0; i < count; i++ {
+		key := "publisher-" + strconv.Itoa(i)
+		owner := ring.Get(key, nil)
+		if owner < 0 || owner >= len(names) {
+			t.Fatalf("Got invalid owner %d for %s", owner, key)
+		}
+		if again := ring.Get(key, nil); again != owner {
+			t.Errorf("Expected stable owner %d for %s, got %d", owner, key, again)
+		}
+		assigned[key] = owner
+		counts[owner]++
+	}
+
+	for idx := range names {
+		// Each owner should get a reasonable share of the keys.
+		if counts[idx] < count/len(names)/2 {
+			t.Errorf("Owner %d only got %d of %d keys: %+v", idx, counts[idx], count, counts)
+		}
+	}
+
+	// Skipping an owner only moves the keys assigned to it.
+	skipped := 1
+	for key, owner := range assigned {
+		other := ring.Get(key, func(owner int) bool {
+			return owner != skipped
+		})
+		if owner == skipped {
+			if other == skipped || other < 0 {
+				t.Errorf("Expected different owner for %s, got %d", key, other)
+			}
+		} else if other != owner {
+			t.Errorf("Expected owner %d for %s, got %d", owner, key, other)
+		}
+	}
+
+	if owner := ring.Get("foo", func(owner int) bool {
+		return false
+	}); owner != -1 {
+		t.Errorf("Expected no owner, got %d", owner)
+	}
+
+	empty := newJanusHashRing(nil, janusHashRingReplicas)
+	if owner := empty.Get("foo", nil); owner != -1 {
+		t.Errorf("Expected no owner, got %d", owner)
+	}
+}
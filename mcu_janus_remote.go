@@ -0,0 +1,337 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/sdp"
+)
+
+// getPublisherStreams returns the streams that were negotiated in the answer
+// Janus sent to a publisher.
+func getPublisherStreams(answer map[string]interface{}) []PublisherStream {
+	sdpText, ok := answer["sdp"].(string)
+	if !ok {
+		return nil
+	}
+
+	var s sdp.SessionDescription
+	if err := s.Unmarshal(sdpText); err != nil {
+		return nil
+	}
+
+	var result []PublisherStream
+	for idx, m := range s.MediaDescriptions {
+		stream := PublisherStream{
+			Mindex:   idx,
+			Disabled: m.MediaName.Port.Value == 0,
+		}
+		switch m.MediaName.Media {
+		case "audio":
+			fallthrough
+		case "video":
+			stream.Type = m.MediaName.Media
+			if len(m.MediaName.Formats) > 0 {
+				// The answer only contains the codec that was negotiated.
+				stream.Codec = getSdpCodec(m, m.MediaName.Formats[0])
+			}
+		case "application":
+			stream.Type = "data"
+		default:
+			continue
+		}
+		stream.Mid, _ = m.Attribute("mid")
+		result = append(result, stream)
+	}
+	return result
+}
+
+func getSdpCodec(m *sdp.MediaDescription, format string) string {
+	for _, a := range m.Attributes {
+		if a.Key != "rtpmap" {
+			continue
+		}
+
+		fields := strings.Fields(a.Value)
+		if len(fields) < 2 || fields[0] != format {
+			continue
+		}
+
+		codec := strings.SplitN(fields[1], "/", 2)[0]
+		return strings.ToLower(codec)
+	}
+	return ""
+}
+
+func (p *mcuJanusPublisher) setStreams(streams []PublisherStream) {
+	p.streams.Store(streams)
+}
+
+func (p *mcuJanusPublisher) GetStreams(ctx context.Context) ([]PublisherStream, error) {
+	streams, _ := p.streams.Load().([]PublisherStream)
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("Publisher %s has not negotiated any streams", p.id)
+	}
+
+	result := make([]PublisherStream, len(streams))
+	copy(result, streams)
+	if layers := p.SimulcastLayers(); layers != nil && layers.Substreams > 0 {
+		for idx := range result {
+			if result[idx].Type == "video" {
+				result[idx].Simulcast = true
+			}
+		}
+	}
+	return result, nil
+}
+
+func (p *mcuJanusPublisher) PublishRemote(ctx context.Context, remoteId string, hostname string, port int, rtcpPort int) error {
+	p.mu.Lock()
+	handle := p.handle
+	roomId := p.roomId
+	p.mu.Unlock()
+	if handle == nil || roomId == 0 {
+		return ErrNotConnected
+	}
+
+	msg := map[string]interface{}{
+		"request":      "publish_remotely",
+		"room":         roomId,
+		"publisher_id": streamTypeUserIds[p.streamType],
+		"remote_id":    remoteId,
+		"host":         hostname,
+		"port":         port,
+	}
+	if rtcpPort > 0 {
+		msg["rtcp_port"] = rtcpPort
+	}
+	if layers := p.SimulcastLayers(); layers != nil && layers.Substreams > 0 {
+		msg["simulcast"] = true
+	}
+	response, err := handle.Request(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if err := getPluginError(response.PluginData, pluginVideoRoom); err != nil {
+		return err
+	}
+
+	log.Printf("Publisher %s is sending to remote %s at %s", p.id, remoteId, net.JoinHostPort(hostname, fmt.Sprintf("%d", port)))
+	return nil
+}
+
+func (p *mcuJanusPublisher) UnpublishRemote(ctx context.Context, remoteId string) error {
+	p.mu.Lock()
+	handle := p.handle
+	roomId := p.roomId
+	p.mu.Unlock()
+	if handle == nil || roomId == 0 {
+		return ErrNotConnected
+	}
+
+	msg := map[string]interface{}{
+		"request":      "unpublish_remotely",
+		"room":         roomId,
+		"publisher_id": streamTypeUserIds[p.streamType],
+		"remote_id":    remoteId,
+	}
+	response, err := handle.Request(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if err := getPluginError(response.PluginData, pluginVideoRoom); err != nil {
+		return err
+	}
+
+	log.Printf("Publisher %s stopped sending to remote %s", p.id, remoteId)
+	return nil
+}
+
+// mcuJanusRemotePublisher receives the media of a publisher on another Janus
+// server. It is registered like a regular publisher, so subscribers can be
+// created for it.
+type mcuJanusRemotePublisher struct {
+	mcuJanusPublisher
+
+	hostname string
+	port     int
+	rtcpPort int
+}
+
+// mcuJanusRemotePublisherListener passes the remote publisher instead of the
+// embedded publisher to the listener when it is closed.
+type mcuJanusRemotePublisherListener struct {
+	McuListener
+
+	publisher *mcuJanusRemotePublisher
+}
+
+func (l *mcuJanusRemotePublisherListener) PublisherClosed(publisher McuPublisher) {
+	l.McuListener.PublisherClosed(l.publisher)
+}
+
+func (p *mcuJanusRemotePublisher) Hostname() string {
+	return p.hostname
+}
+
+func (p *mcuJanusRemotePublisher) Port() int {
+	return p.port
+}
+
+func (p *mcuJanusRemotePublisher) RtcpPort() int {
+	return p.rtcpPort
+}
+
+func (p *mcuJanusRemotePublisher) NotifyReconnected() {
+	// The room and the remote publisher no longer exist on the new connection,
+	// the source has to be published again.
+	log.Printf("Remote publisher %s can't be reconnected, closing", p.id)
+	p.Close(context.Background())
+}
+
+func (m *mcuJanus) NewRemotePublisher(ctx context.Context, listener McuListener, id string, streamType string, streams []PublisherStream) (McuRemotePublisher, error) {
+	if _, found := streamTypeUserIds[streamType]; !found {
+		return nil, fmt.Errorf("Unsupported stream type %s", streamType)
+	}
+
+	session := m.session
+	if session == nil {
+		return nil, ErrNotConnected
+	}
+	handle, err := session.Attach(ctx, pluginVideoRoom)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Attached %s as remote publisher %d to plugin %s in session %d", streamType, handle.Id, pluginVideoRoom, session.Id)
+	roomId, err := m.createPublisherRoom(ctx, handle, id, streamType, 0)
+	if err != nil {
+		if _, err2 := handle.Detach(ctx); err2 != nil {
+			log.Printf("Error detaching handle %d: %s", handle.Id, err2)
+		}
+		return nil, err
+	}
+
+	add_msg := map[string]interface{}{
+		"request": "add_remote_publisher",
+		"room":    roomId,
+		"id":      streamTypeUserIds[streamType],
+		"display": id,
+		"streams": streams,
+	}
+	var hostname string
+	var port int
+	response, err := handle.Request(ctx, add_msg)
+	if err == nil {
+		err = getPluginError(response.PluginData, pluginVideoRoom)
+	}
+	if err == nil {
+		hostname = m.cascadeHost
+		if hostname == "" {
+			hostname = getPluginStringValue(response.PluginData, pluginVideoRoom, "ip")
+		}
+		port = int(getPluginIntValue(response.PluginData, pluginVideoRoom, "port"))
+		if hostname == "" || port == 0 {
+			err = fmt.Errorf("No address received for remote publisher: %+v", response)
+		}
+	}
+	if err != nil {
+		destroy_msg := map[string]interface{}{
+			"request": "destroy",
+			"room":    roomId,
+		}
+		if _, err2 := handle.Request(ctx, destroy_msg); err2 != nil {
+			log.Printf("Error destroying room %d: %s", roomId, err2)
+		}
+		if _, err2 := handle.Detach(ctx); err2 != nil {
+			log.Printf("Error detaching handle %d: %s", handle.Id, err2)
+		}
+		return nil, err
+	}
+
+	client := &mcuJanusRemotePublisher{
+		mcuJanusPublisher: mcuJanusPublisher{
+			mcuJanusClient: mcuJanusClient{
+				mcu: m,
+
+				id:         atomic.AddUint64(&m.clientId, 1),
+				roomId:     roomId,
+				sid:        id,
+				streamType: streamType,
+
+				handle:    handle,
+				handleId:  handle.Id,
+				closeChan: make(chan bool, 1),
+				deferred:  make(chan func(), 64),
+			},
+			id: id,
+		},
+		hostname: hostname,
+		port:     port,
+		rtcpPort: int(getPluginIntValue(response.PluginData, pluginVideoRoom, "rtcp_port")),
+	}
+	client.listener = &mcuJanusRemotePublisherListener{
+		McuListener: listener,
+		publisher:   client,
+	}
+	for _, stream := range streams {
+		switch stream.Type {
+		case "audio":
+			client.mediaTypes |= MediaTypeAudio
+		case "video":
+			client.mediaTypes |= MediaTypeVideo
+		}
+	}
+	client.setStreams(streams)
+	client.mcuJanusClient.handleEvent = client.handleEvent
+	client.mcuJanusClient.handleHangup = client.handleHangup
+	client.mcuJanusClient.handleDetached = client.handleDetached
+	client.mcuJanusClient.handleConnected = client.handleConnected
+	client.mcuJanusClient.handleSlowLink = client.handleSlowLink
+	client.mcuJanusClient.handleMedia = client.handleMedia
+
+	m.registerClient(client)
+	log.Printf("Remote publisher %s is using handle %d and receives on %s", client.id, client.handleId, net.JoinHostPort(client.hostname, fmt.Sprintf("%d", client.port)))
+	go client.run(handle, client.closeChan)
+	m.mu.Lock()
+	m.publishers[id+"|"+streamType] = &client.mcuJanusPublisher
+	m.publisherCreated.Notify(id + "|" + streamType)
+	m.mu.Unlock()
+	statsPublishersCurrent.WithLabelValues(streamType).Inc()
+	statsPublishersTotal.WithLabelValues(streamType).Inc()
+	return client, nil
+}
+
+func (p *mcuJanusPool) NewRemotePublisher(ctx context.Context, listener McuListener, id string, streamType string, streams []PublisherStream) (McuRemotePublisher, error) {
+	instance := p.getInstance(id, nil)
+	if instance == nil {
+		return nil, ErrNotConnected
+	}
+
+	return instance.mcu.NewRemotePublisher(ctx, listener, id, streamType, streams)
+}
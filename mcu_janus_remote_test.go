@@ -0,0 +1,63 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetPublisherStreams(t *testing.T) {
+	streams := getPublisherStreams(map[string]interface{}{
+		"type": "answer",
+		"sdp":  MockSdpAnswerAudioAndVideo,
+	})
+	expected := []PublisherStream{
+		{
+			Type:   "audio",
+			Mindex: 0,
+			Mid:    "audio",
+			Codec:  "opus",
+		},
+		{
+			Type:   "video",
+			Mindex: 1,
+			Mid:    "video",
+			Codec:  "h264",
+		},
+	}
+	if !reflect.DeepEqual(expected, streams) {
+		t.Errorf("Expected streams %+v, got %+v", expected, streams)
+	}
+
+	if streams := getPublisherStreams(map[string]interface{}{
+		"type": "answer",
+	}); streams != nil {
+		t.Errorf("Expected no streams without sdp, got %+v", streams)
+	}
+	if streams := getPublisherStreams(map[string]interface{}{
+		"type": "answer",
+		"sdp":  "invalid-sdp",
+	}); streams != nil {
+		t.Errorf("Expected no streams for invalid sdp, got %+v", streams)
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+func getRtpForwardStreams(data map[string]interface{}, host string) []*RtpForwardStream {
+	var result []*RtpForwardStream
+	if forwarders, ok := data["forwarders"].([]interface{}); ok {
+		// Format of the multistream videoroom plugin.
+		for _, f := range forwarders {
+			forwarder, ok := f.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			streamId, err := convertIntValue(forwarder["stream_id"])
+			if err != nil {
+				continue
+			}
+			port, _ := convertIntValue(forwarder["port"])
+			mediaType, _ := forwarder["type"].(string)
+			result = append(result, &RtpForwardStream{
+				StreamId: streamId,
+				Type:     mediaType,
+				Host:     host,
+				Port:     int(port),
+			})
+		}
+		return result
+	}
+
+	stream, ok := data["rtp_stream"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, mediaType := range []string{"audio", "video"} {
+		streamId, err := convertIntValue(stream[mediaType+"_stream_id"])
+		if err != nil {
+			continue
+		}
+
+		port, _ := convertIntValue(stream[mediaType])
+		result = append(result, &RtpForwardStream{
+			StreamId: streamId,
+			Type:     mediaType,
+			Host:     host,
+			Port:     int(port),
+		})
+	}
+	return result
+}
+
+func (p *mcuJanusPublisher) StartRtpForward(ctx context.Context, host string, audioPort int, videoPort int) ([]*RtpForwardStream, error) {
+	p.mu.Lock()
+	handle := p.handle
+	roomId := p.roomId
+	p.mu.Unlock()
+	if handle == nil || roomId == 0 {
+		return nil, ErrNotConnected
+	}
+
+	forward_msg := map[string]interface{}{
+		"request":      "rtp_forward",
+		"room":         roomId,
+		"publisher_id": streamTypeUserIds[p.streamType],
+		"host":         host,
+	}
+	if audioPort > 0 {
+		forward_msg["audio_port"] = audioPort
+	}
+	if videoPort > 0 {
+		forward_msg["video_port"] = videoPort
+	}
+	if p.mcu.adminKey != "" {
+		forward_msg["admin_key"] = p.mcu.adminKey
+	}
+	response, err := handle.Request(ctx, forward_msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := getPluginError(response.PluginData, pluginVideoRoom); err != nil {
+		return nil, err
+	}
+
+	streams := getRtpForwardStreams(response.PluginData.Data, host)
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("No forwarded streams received: %+v", response)
+	}
+
+	log.Printf("Publisher %s started %d RTP forwarders to %s", p.id, len(streams), host)
+	return streams, nil
+}
+
+func (p *mcuJanusPublisher) StopRtpForward(ctx context.Context, streamId uint64) error {
+	p.mu.Lock()
+	handle := p.handle
+	roomId := p.roomId
+	p.mu.Unlock()
+	if handle == nil || roomId == 0 {
+		return ErrNotConnected
+	}
+
+	stop_msg := map[string]interface{}{
+		"request":      "stop_rtp_forward",
+		"room":         roomId,
+		"publisher_id": streamTypeUserIds[p.streamType],
+		"stream_id":    streamId,
+	}
+	if p.mcu.adminKey != "" {
+		stop_msg["admin_key"] = p.mcu.adminKey
+	}
+	response, err := handle.Request(ctx, stop_msg)
+	if err != nil {
+		return err
+	}
+	if err := getPluginError(response.PluginData, pluginVideoRoom); err != nil {
+		return err
+	}
+
+	log.Printf("Publisher %s stopped RTP forwarder %d", p.id, streamId)
+	return nil
+}
@@ -0,0 +1,70 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGetRtpForwardStreams(t *testing.T) {
+	testcases := []struct {
+		data     string
+		expected []*RtpForwardStream
+	}{
+		{
+			`{"videoroom":"rtp_forward","rtp_stream":{"host":"127.0.0.1","audio":5002,"audio_stream_id":123,"video":5004,"video_stream_id":456}}`,
+			[]*RtpForwardStream{
+				{StreamId: 123, Type: "audio", Host: "127.0.0.1", Port: 5002},
+				{StreamId: 456, Type: "video", Host: "127.0.0.1", Port: 5004},
+			},
+		},
+		{
+			`{"videoroom":"rtp_forward","rtp_stream":{"host":"127.0.0.1","video":5004,"video_stream_id":456}}`,
+			[]*RtpForwardStream{
+				{StreamId: 456, Type: "video", Host: "127.0.0.1", Port: 5004},
+			},
+		},
+		{
+			`{"videoroom":"rtp_forward","forwarders":[{"stream_id":789,"type":"audio","host":"127.0.0.1","port":5006}]}`,
+			[]*RtpForwardStream{
+				{StreamId: 789, Type: "audio", Host: "127.0.0.1", Port: 5006},
+			},
+		},
+		{
+			`{"videoroom":"rtp_forward"}`,
+			nil,
+		},
+	}
+
+	for _, tc := range testcases {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.data), &data); err != nil {
+			t.Fatal(err)
+		}
+
+		if streams := getRtpForwardStreams(data, "127.0.0.1"); !reflect.DeepEqual(streams, tc.expected) {
+			t.Errorf("Expected %+v for %s, got %+v", tc.expected, tc.data, streams)
+		}
+	}
+}
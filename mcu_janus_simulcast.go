@@ -0,0 +1,141 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/sdp"
+)
+
+const (
+	// Janus supports up to three temporal layers for simulcast streams.
+	maxSimulcastTemporalLayers = 3
+)
+
+// parseSimulcastLayers returns the simulcast layers announced in the video
+// sections of an offer. Both RID based ("a=simulcast") and SSRC based
+// ("a=ssrc-group:SIM") simulcast is supported.
+func parseSimulcastLayers(payload map[string]interface{}) *SimulcastLayers {
+	sdpText, ok := payload["sdp"].(string)
+	if !ok {
+		return nil
+	}
+
+	var s sdp.SessionDescription
+	if err := s.Unmarshal(sdpText); err != nil {
+		return nil
+	}
+
+	layers := &SimulcastLayers{}
+	for _, m := range s.MediaDescriptions {
+		if m.MediaName.Media != "video" {
+			continue
+		}
+
+		if value, found := m.Attribute("simulcast"); found {
+			if rids := parseSimulcastSendRids(value); len(rids) > 0 {
+				layers.Substreams = len(rids)
+				layers.Rids = rids
+				break
+			}
+		}
+
+		for _, a := range m.Attributes {
+			if a.Key != "ssrc-group" {
+				continue
+			}
+
+			fields := strings.Fields(a.Value)
+			if len(fields) > 1 && fields[0] == "SIM" {
+				layers.Substreams = len(fields) - 1
+				break
+			}
+		}
+		if layers.Substreams > 0 {
+			break
+		}
+	}
+	return layers
+}
+
+// parseSimulcastSendRids returns the RIDs of the "send" direction of a
+// "simulcast" attribute value like "send h;m;l" or "send h,~m;l recv x".
+func parseSimulcastSendRids(value string) []string {
+	fields := strings.Fields(value)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] != "send" {
+			continue
+		}
+
+		var rids []string
+		for _, alternatives := range strings.Split(fields[i+1], ";") {
+			// Only the first alternative of each stream is used.
+			rid := strings.TrimPrefix(strings.Split(alternatives, ",")[0], "~")
+			if rid != "" {
+				rids = append(rids, rid)
+			}
+		}
+		return rids
+	}
+	return nil
+}
+
+func (s *streamSelection) checkLayers(layers *SimulcastLayers) error {
+	if s.temporal.Valid && (s.temporal.Int16 < 0 || s.temporal.Int16 >= maxSimulcastTemporalLayers) {
+		return fmt.Errorf("Unsupported temporal layer: %d", s.temporal.Int16)
+	}
+
+	if !s.substream.Valid || layers == nil {
+		// The layers of the publisher are not known yet, let Janus decide.
+		return nil
+	}
+
+	if layers.Substreams == 0 {
+		return fmt.Errorf("Publisher is not sending simulcast")
+	} else if s.substream.Int16 < 0 || int(s.substream.Int16) >= layers.Substreams {
+		return fmt.Errorf("Unsupported substream: %d", s.substream.Int16)
+	}
+
+	return nil
+}
+
+func (p *mcuJanusPublisher) setSimulcastLayers(layers *SimulcastLayers) {
+	p.layers.Store(layers)
+}
+
+func (p *mcuJanusPublisher) SimulcastLayers() *SimulcastLayers {
+	layers, _ := p.layers.Load().(*SimulcastLayers)
+	return layers
+}
+
+func (p *mcuJanusSubscriber) SimulcastLayers() *SimulcastLayers {
+	p.mcu.mu.Lock()
+	pub, found := p.mcu.publishers[p.publisher+"|"+p.streamType]
+	p.mcu.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	return pub.SimulcastLayers()
+}
@@ -0,0 +1,149 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testSdpSimulcastRid = `v=0
+o=- 20518 0 IN IP4 0.0.0.0
+s=-
+t=0 0
+m=audio 9 UDP/TLS/RTP/SAVPF 111
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:111 opus/48000/2
+m=video 9 UDP/TLS/RTP/SAVPF 96
+c=IN IP4 0.0.0.0
+a=mid:1
+a=rtpmap:96 VP8/90000
+a=rid:h send
+a=rid:m send
+a=rid:l send
+a=simulcast:send h;~m;l
+`
+	testSdpSimulcastSsrc = `v=0
+o=- 20518 0 IN IP4 0.0.0.0
+s=-
+t=0 0
+m=video 9 UDP/TLS/RTP/SAVPF 96
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:96 VP8/90000
+a=ssrc-group:FID 1 4
+a=ssrc-group:SIM 1 2 3
+a=ssrc:1 cname:test
+a=ssrc:2 cname:test
+a=ssrc:3 cname:test
+`
+	testSdpNoSimulcast = `v=0
+o=- 20518 0 IN IP4 0.0.0.0
+s=-
+t=0 0
+m=video 9 UDP/TLS/RTP/SAVPF 96
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:96 VP8/90000
+`
+)
+
+func TestParseSimulcastLayers(t *testing.T) {
+	testcases := []struct {
+		sdp      string
+		expected *SimulcastLayers
+	}{
+		{
+			testSdpSimulcastRid,
+			&SimulcastLayers{
+				Substreams: 3,
+				Rids:       []string{"h", "m", "l"},
+			},
+		},
+		{
+			testSdpSimulcastSsrc,
+			&SimulcastLayers{
+				Substreams: 3,
+			},
+		},
+		{
+			testSdpNoSimulcast,
+			&SimulcastLayers{},
+		},
+		{
+			"invalid sdp",
+			nil,
+		},
+	}
+
+	for idx, tc := range testcases {
+		payload := map[string]interface{}{
+			"type": "offer",
+			"sdp":  strings.ReplaceAll(tc.sdp, "\n", "\r\n"),
+		}
+		if layers := parseSimulcastLayers(payload); !reflect.DeepEqual(tc.expected, layers) {
+			t.Errorf("Expected %+v for %d, got %+v", tc.expected, idx, layers)
+		}
+	}
+
+	if layers := parseSimulcastLayers(map[string]interface{}{}); layers != nil {
+		t.Errorf("Expected no layers without sdp, got %+v", layers)
+	}
+}
+
+func TestStreamSelectionCheckLayers(t *testing.T) {
+	simulcast := &SimulcastLayers{
+		Substreams: 3,
+	}
+	noSimulcast := &SimulcastLayers{}
+
+	testcases := []struct {
+		payload map[string]interface{}
+		layers  *SimulcastLayers
+		valid   bool
+	}{
+		{map[string]interface{}{"substream": float64(0)}, simulcast, true},
+		{map[string]interface{}{"substream": float64(2), "temporal": float64(2)}, simulcast, true},
+		{map[string]interface{}{"substream": float64(3)}, simulcast, false},
+		{map[string]interface{}{"substream": float64(-1)}, simulcast, false},
+		{map[string]interface{}{"temporal": float64(3)}, simulcast, false},
+		{map[string]interface{}{"substream": float64(0)}, noSimulcast, false},
+		{map[string]interface{}{"temporal": float64(1)}, noSimulcast, true},
+		{map[string]interface{}{"substream": float64(5)}, nil, true},
+	}
+
+	for idx, tc := range testcases {
+		stream, err := parseStreamSelection(tc.payload)
+		if err != nil {
+			t.Fatalf("Could not parse stream selection %d: %s", idx, err)
+		}
+
+		if err := stream.checkLayers(tc.layers); tc.valid && err != nil {
+			t.Errorf("Expected %d to be valid, got %s", idx, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("Expected %d to be invalid", idx)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	janusStatsTypePublisher  = "publisher"
+	janusStatsTypeSubscriber = "subscriber"
+)
+
+// getJanusStatsInterval returns the interval in which statistics of the Janus
+// handles are collected, or 0 if they should not be collected.
+func getJanusStatsInterval(config *goconf.ConfigFile) time.Duration {
+	interval, _ := config.GetInt("mcu", "statsinterval")
+	if interval <= 0 {
+		return 0
+	}
+
+	return time.Duration(interval) * time.Second
+}
+
+// getJanusHandleStats returns the statistics of a handle from its handle info.
+// Like the bandwidth, the values are collected from all entries of the handle
+// info to support both the layout of Janus 0.x and the multistream layout of
+// Janus 1.x. PLI counters are only available if reported by Janus.
+func getJanusHandleStats(info map[string]interface{}) *McuClientStats {
+	result := &McuClientStats{}
+	var walk func(value interface{}, section string)
+	walk = func(value interface{}, section string) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, entry := range v {
+				switch {
+				case key == "in_stats" || key == "out_stats" || key == "rtcp_stats":
+					walk(entry, key)
+				case section == "in_stats" || section == "out_stats":
+					count, err := convertIntValue(entry)
+					if err != nil {
+						walk(entry, section)
+						continue
+					}
+
+					switch {
+					case strings.Contains(key, "bytes_lastsec"):
+						if section == "in_stats" {
+							result.BitrateReceived += count * 8
+						} else {
+							result.BitrateSent += count * 8
+						}
+					case key == "nacks" || strings.HasSuffix(key, "_nacks"):
+						result.Nacks += count
+					case key == "plis" || strings.HasSuffix(key, "_plis"):
+						result.Plis += count
+					}
+				case section == "rtcp_stats":
+					switch key {
+					case "lost", "lost-by-remote":
+						if count, err := convertIntValue(entry); err == nil {
+							result.Lost += count
+						}
+					case "jitter-local", "jitter-remote":
+						if jitter, ok := entry.(float64); ok && jitter > result.Jitter {
+							result.Jitter = jitter
+						}
+					default:
+						walk(entry, section)
+					}
+				default:
+					walk(entry, section)
+				}
+			}
+		case []interface{}:
+			for _, entry := range v {
+				walk(entry, section)
+			}
+		}
+	}
+	walk(info, "")
+	return result
+}
+
+func (c *mcuJanusClient) Stats(ctx context.Context) (*McuClientStats, error) {
+	admin := c.mcu.admin
+	if admin == nil {
+		return nil, nil
+	}
+
+	info, err := admin.HandleInfo(ctx, c.session, c.handleId)
+	if err != nil {
+		return nil, err
+	}
+
+	return getJanusHandleStats(info), nil
+}
+
+// janusStatsTotals are the summed up statistics of all handles of a type.
+type janusStatsTotals map[string]McuClientStats
+
+func (t janusStatsTotals) add(statsType string, stats *McuClientStats) {
+	total := t[statsType]
+	total.BitrateReceived += stats.BitrateReceived
+	total.BitrateSent += stats.BitrateSent
+	total.Lost += stats.Lost
+	total.Nacks += stats.Nacks
+	total.Plis += stats.Plis
+	t[statsType] = total
+}
+
+// updateJanusStatsMetrics applies the difference between the previous and the
+// current totals to the metrics, so multiple Janus gateways can update them.
+func updateJanusStatsMetrics(previous janusStatsTotals, current janusStatsTotals) {
+	for _, statsType := range []string{janusStatsTypePublisher, janusStatsTypeSubscriber} {
+		prev := previous[statsType]
+		cur := current[statsType]
+		statsJanusBitrateCurrent.WithLabelValues(statsType, "incoming").Add(float64(cur.BitrateReceived) - float64(prev.BitrateReceived))
+		statsJanusBitrateCurrent.WithLabelValues(statsType, "outgoing").Add(float64(cur.BitrateSent) - float64(prev.BitrateSent))
+		statsJanusLostPacketsCurrent.WithLabelValues(statsType).Add(float64(cur.Lost) - float64(prev.Lost))
+		statsJanusNacksCurrent.WithLabelValues(statsType).Add(float64(cur.Nacks) - float64(prev.Nacks))
+		statsJanusPlisCurrent.WithLabelValues(statsType).Add(float64(cur.Plis) - float64(prev.Plis))
+	}
+}
+
+func (m *mcuJanus) collectStats() {
+	if !atomic.CompareAndSwapUint32(&m.collectingStats, 0, 1) {
+		// Previous collection is still running.
+		return
+	}
+	defer atomic.StoreUint32(&m.collectingStats, 0)
+
+	m.muClients.Lock()
+	clients := make(map[McuClientWithStats]string, len(m.clients))
+	for client := range m.clients {
+		switch c := client.(type) {
+		case *mcuJanusPublisher:
+			clients[c] = janusStatsTypePublisher
+		case *mcuJanusSubscriber:
+			clients[c] = janusStatsTypeSubscriber
+		}
+	}
+	m.muClients.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.mcuTimeout)
+	defer cancel()
+
+	totals := make(janusStatsTotals)
+	for client, statsType := range clients {
+		stats, err := client.Stats(ctx)
+		if err != nil {
+			log.Printf("Could not get statistics of %s %+v: %s", statsType, client, err)
+			continue
+		} else if stats == nil {
+			continue
+		}
+
+		totals.add(statsType, stats)
+		statsJanusJitter.WithLabelValues(statsType).Observe(stats.Jitter)
+	}
+
+	m.setStatsTotals(totals)
+}
+
+func (m *mcuJanus) setStatsTotals(totals janusStatsTotals) {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+
+	updateJanusStatsMetrics(m.statsTotals, totals)
+	m.statsTotals = totals
+}
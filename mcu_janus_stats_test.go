@@ -0,0 +1,118 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestGetJanusHandleStats(t *testing.T) {
+	testcases := []struct {
+		info     string
+		expected McuClientStats
+	}{
+		{
+			// Janus 0.x
+			`{"plugin":"janus.plugin.videoroom","streams":[{"id":1,"rtcp_stats":{"audio":{"base":48000,"lost":3,"lost-by-remote":1,"jitter-local":4,"jitter-remote":2},"video":{"base":90000,"lost":10,"lost-by-remote":0,"jitter-local":12,"jitter-remote":8}},"components":[{"id":1,"in_stats":{"audio_packets":100,"audio_bytes":10000,"audio_bytes_lastsec":1000,"do_audio_nacks":true,"video_packets":500,"video_bytes":100000,"video_bytes_lastsec":20000,"video_nacks":7},"out_stats":{"audio_packets":0,"audio_bytes":0,"audio_bytes_lastsec":0,"video_bytes_lastsec":0,"video_nacks":2}}]}]}`,
+			McuClientStats{
+				BitrateReceived: 21000 * 8,
+				Lost:            14,
+				Nacks:           9,
+				Jitter:          12,
+			},
+		},
+		{
+			// Janus 1.x
+			`{"plugin":"janus.plugin.videoroom","webrtc":{"media":[{"mindex":0,"type":"audio","rtcp_stats":{"main":{"base":48000,"lost":1,"lost-by-remote":2,"jitter-local":3,"jitter-remote":5}},"in_stats":{"packets":100,"bytes":10000,"bytes_lastsec":0,"nacks":0},"out_stats":{"packets":100,"bytes":10000,"bytes_lastsec":1500,"nacks":1}},{"mindex":1,"type":"video","rtcp_stats":{"main":{"base":90000,"lost":4,"lost-by-remote":0,"jitter-local":7,"jitter-remote":1}},"in_stats":{"bytes_lastsec":0,"nacks":3,"plis":2},"out_stats":{"bytes_lastsec":25000,"nacks":0}}]}}`,
+			McuClientStats{
+				BitrateSent: 26500 * 8,
+				Lost:        7,
+				Nacks:       4,
+				Plis:        2,
+				Jitter:      7,
+			},
+		},
+		{
+			// No WebRTC connection
+			`{"plugin":"janus.plugin.videoroom","handle_id":123}`,
+			McuClientStats{},
+		},
+	}
+
+	for idx, tc := range testcases {
+		var info map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.info), &info); err != nil {
+			t.Fatal(err)
+		}
+
+		if stats := getJanusHandleStats(info); *stats != tc.expected {
+			t.Errorf("Test %d: expected %+v, got %+v", idx, tc.expected, stats)
+		}
+	}
+}
+
+func TestJanusStatsMetrics(t *testing.T) {
+	statsJanusBitrateCurrent.Reset()
+	statsJanusLostPacketsCurrent.Reset()
+	defer statsJanusBitrateCurrent.Reset()
+	defer statsJanusLostPacketsCurrent.Reset()
+
+	// Totals of multiple gateways are summed up.
+	totals1 := make(janusStatsTotals)
+	totals1.add(janusStatsTypePublisher, &McuClientStats{BitrateReceived: 1000, Lost: 2})
+	totals1.add(janusStatsTypePublisher, &McuClientStats{BitrateReceived: 500, Lost: 1})
+	updateJanusStatsMetrics(nil, totals1)
+	totals2 := make(janusStatsTotals)
+	totals2.add(janusStatsTypePublisher, &McuClientStats{BitrateReceived: 2000})
+	updateJanusStatsMetrics(nil, totals2)
+	checkStatsValue(t, statsJanusBitrateCurrent.WithLabelValues(janusStatsTypePublisher, "incoming"), 3500)
+	checkStatsValue(t, statsJanusLostPacketsCurrent.WithLabelValues(janusStatsTypePublisher), 3)
+
+	// Only the difference to the previous totals is applied.
+	updated := make(janusStatsTotals)
+	updated.add(janusStatsTypePublisher, &McuClientStats{BitrateReceived: 100})
+	updateJanusStatsMetrics(totals1, updated)
+	checkStatsValue(t, statsJanusBitrateCurrent.WithLabelValues(janusStatsTypePublisher, "incoming"), 2100)
+	checkStatsValue(t, statsJanusLostPacketsCurrent.WithLabelValues(janusStatsTypePublisher), 0)
+
+	updateJanusStatsMetrics(updated, nil)
+	updateJanusStatsMetrics(totals2, nil)
+	checkStatsValue(t, statsJanusBitrateCurrent.WithLabelValues(janusStatsTypePublisher, "incoming"), 0)
+
+	collectAndLint(t, janusMcuStats...)
+}
+
+func TestJanusStatsInterval(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if interval := getJanusStatsInterval(config); interval != 0 {
+		t.Errorf("Expected disabled statistics, got %s", interval)
+	}
+
+	config.AddOption("mcu", "statsinterval", "30")
+	if interval := getJanusStatsInterval(config); interval != 30*time.Second {
+		t.Errorf("Expected interval of 30s, got %s", interval)
+	}
+}
@@ -68,25 +68,39 @@ const (
 
 	defaultProxyTimeoutSeconds = 2
 
+	// Number of connections that are opened to each proxy by default.
+	defaultConnectionsPerProxy = 1
+
 	rttLogDuration = 500 * time.Millisecond
 
 	// Update service IP addresses every 10 seconds.
 	updateDnsInterval = 10 * time.Second
+
+	// Maximum time to wait for a client to renegotiate a publisher that was
+	// migrated to a different proxy before its subscribers are migrated.
+	publisherMigrationTimeout = 30 * time.Second
 )
 
 type mcuProxyPubSubCommon struct {
-	sid        string
 	streamType string
-	proxyId    string
-	conn       *mcuProxyConnection
 	listener   McuListener
+
+	// The following fields change when a client is migrated to another proxy.
+	mu      sync.Mutex
+	sid     string
+	proxyId string
+	conn    *mcuProxyConnection
 }
 
 func (c *mcuProxyPubSubCommon) Id() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.proxyId
 }
 
 func (c *mcuProxyPubSubCommon) Sid() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.sid
 }
 
@@ -94,15 +108,39 @@ func (c *mcuProxyPubSubCommon) StreamType() string {
 	return c.streamType
 }
 
+func (c *mcuProxyPubSubCommon) getConnection() (*mcuProxyConnection, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.proxyId
+}
+
+func (c *mcuProxyPubSubCommon) ProxyUrl() string {
+	conn, _ := c.getConnection()
+	if conn == nil {
+		return ""
+	}
+
+	return conn.rawUrl
+}
+
+func (c *mcuProxyPubSubCommon) setConnection(conn *mcuProxyConnection, proxyId string, sid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	c.proxyId = proxyId
+	c.sid = sid
+}
+
 func (c *mcuProxyPubSubCommon) doSendMessage(ctx context.Context, msg *ProxyClientMessage, callback func(error, map[string]interface{})) {
-	c.conn.performAsyncRequest(ctx, msg, func(err error, response *ProxyServerMessage) {
+	conn, _ := c.getConnection()
+	conn.performAsyncRequest(ctx, msg, func(err error, response *ProxyServerMessage) {
 		if err != nil {
 			callback(err, nil)
 			return
 		}
 
 		if proxyDebugMessages {
-			log.Printf("Response from %s: %+v", c.conn, response)
+			log.Printf("Response from %s: %+v", conn, response)
 		}
 		if response.Type == "error" {
 			callback(response.Error, nil)
@@ -121,7 +159,8 @@ func (c *mcuProxyPubSubCommon) doProcessPayload(client McuClient, msg *PayloadPr
 	case "candidate":
 		c.listener.OnIceCandidate(client, msg.Payload["candidate"])
 	default:
-		log.Printf("Unsupported payload from %s: %+v", c.conn, msg)
+		conn, _ := c.getConnection()
+		log.Printf("Unsupported payload from %s: %+v", conn, msg)
 	}
 }
 
@@ -129,10 +168,14 @@ type mcuProxyPublisher struct {
 	mcuProxyPubSubCommon
 
 	id         string
+	bitrate    int
 	mediaTypes MediaType
+
+	// Notified when ICE is completed after the publisher was migrated.
+	migrated chan bool
 }
 
-func newMcuProxyPublisher(id string, sid string, streamType string, mediaTypes MediaType, proxyId string, conn *mcuProxyConnection, listener McuListener) *mcuProxyPublisher {
+func newMcuProxyPublisher(id string, sid string, streamType string, bitrate int, mediaTypes MediaType, proxyId string, conn *mcuProxyConnection, listener McuListener) *mcuProxyPublisher {
 	return &mcuProxyPublisher{
 		mcuProxyPubSubCommon: mcuProxyPubSubCommon{
 			sid:        sid,
@@ -142,6 +185,7 @@ func newMcuProxyPublisher(id string, sid string, streamType string, mediaTypes M
 			listener:   listener,
 		},
 		id:         id,
+		bitrate:    bitrate,
 		mediaTypes: mediaTypes,
 	}
 }
@@ -157,26 +201,40 @@ func (p *mcuProxyPublisher) SetMedia(mt MediaType) {
 
 func (p *mcuProxyPublisher) NotifyClosed() {
 	p.listener.PublisherClosed(p)
-	p.conn.removePublisher(p)
+	conn, _ := p.getConnection()
+	conn.removePublisher(p)
 }
 
 func (p *mcuProxyPublisher) Close(ctx context.Context) {
 	p.NotifyClosed()
 
+	conn, proxyId := p.getConnection()
 	msg := &ProxyClientMessage{
 		Type: "command",
 		Command: &CommandProxyClientMessage{
 			Type:     "delete-publisher",
-			ClientId: p.proxyId,
+			ClientId: proxyId,
 		},
 	}
 
-	if _, err := p.conn.performSyncRequest(ctx, msg); err != nil {
-		log.Printf("Could not delete publisher %s at %s: %s", p.proxyId, p.conn, err)
+	if _, err := conn.performSyncRequest(ctx, msg); err != nil {
+		log.Printf("Could not delete publisher %s at %s: %s", proxyId, conn, err)
 		return
 	}
 
-	log.Printf("Delete publisher %s at %s", p.proxyId, p.conn)
+	log.Printf("Delete publisher %s at %s", proxyId, conn)
+}
+
+// migrate switches the publisher to a different proxy. The returned channel
+// is notified once ICE has been completed for the new publisher.
+func (p *mcuProxyPublisher) migrate(conn *mcuProxyConnection, proxyId string) <-chan bool {
+	ch := make(chan bool, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = conn
+	p.proxyId = proxyId
+	p.migrated = ch
+	return ch
 }
 
 func (p *mcuProxyPublisher) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
@@ -184,7 +242,7 @@ func (p *mcuProxyPublisher) SendMessage(ctx context.Context, message *MessageCli
 		Type: "payload",
 		Payload: &PayloadProxyClientMessage{
 			Type:     data.Type,
-			ClientId: p.proxyId,
+			ClientId: p.Id(),
 			Sid:      data.Sid,
 			Payload:  data.Payload,
 		},
@@ -200,11 +258,20 @@ func (p *mcuProxyPublisher) ProcessPayload(msg *PayloadProxyServerMessage) {
 func (p *mcuProxyPublisher) ProcessEvent(msg *EventProxyServerMessage) {
 	switch msg.Type {
 	case "ice-completed":
+		p.mu.Lock()
+		if p.migrated != nil {
+			p.migrated <- true
+			p.migrated = nil
+		}
+		p.mu.Unlock()
 		p.listener.OnIceCompleted(p)
+	case "publisher-reconnected":
+		p.listener.PublisherReconnected(p)
 	case "publisher-closed":
 		p.NotifyClosed()
 	default:
-		log.Printf("Unsupported event from %s: %+v", p.conn, msg)
+		conn, _ := p.getConnection()
+		log.Printf("Unsupported event from %s: %+v", conn, msg)
 	}
 }
 
@@ -212,6 +279,8 @@ type mcuProxySubscriber struct {
 	mcuProxyPubSubCommon
 
 	publisherId string
+	// Country of the client the subscriber belongs to, if known.
+	country string
 }
 
 func newMcuProxySubscriber(publisherId string, sid string, streamType string, proxyId string, conn *mcuProxyConnection, listener McuListener) *mcuProxySubscriber {
@@ -234,26 +303,28 @@ func (s *mcuProxySubscriber) Publisher() string {
 
 func (s *mcuProxySubscriber) NotifyClosed() {
 	s.listener.SubscriberClosed(s)
-	s.conn.removeSubscriber(s)
+	conn, _ := s.getConnection()
+	conn.removeSubscriber(s)
 }
 
 func (s *mcuProxySubscriber) Close(ctx context.Context) {
 	s.NotifyClosed()
 
+	conn, proxyId := s.getConnection()
 	msg := &ProxyClientMessage{
 		Type: "command",
 		Command: &CommandProxyClientMessage{
 			Type:     "delete-subscriber",
-			ClientId: s.proxyId,
+			ClientId: proxyId,
 		},
 	}
 
-	if _, err := s.conn.performSyncRequest(ctx, msg); err != nil {
-		log.Printf("Could not delete subscriber %s at %s: %s", s.proxyId, s.conn, err)
+	if _, err := conn.performSyncRequest(ctx, msg); err != nil {
+		log.Printf("Could not delete subscriber %s at %s: %s", proxyId, conn, err)
 		return
 	}
 
-	log.Printf("Delete subscriber %s at %s", s.proxyId, s.conn)
+	log.Printf("Delete subscriber %s at %s", proxyId, conn)
 }
 
 func (s *mcuProxySubscriber) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
@@ -261,7 +332,7 @@ func (s *mcuProxySubscriber) SendMessage(ctx context.Context, message *MessageCl
 		Type: "payload",
 		Payload: &PayloadProxyClientMessage{
 			Type:     data.Type,
-			ClientId: s.proxyId,
+			ClientId: s.Id(),
 			Sid:      data.Sid,
 			Payload:  data.Payload,
 		},
@@ -279,12 +350,15 @@ func (s *mcuProxySubscriber) ProcessEvent(msg *EventProxyServerMessage) {
 	case "ice-completed":
 		s.listener.OnIceCompleted(s)
 	case "subscriber-sid-updated":
+		s.mu.Lock()
 		s.sid = msg.Sid
+		s.mu.Unlock()
 		s.listener.SubscriberSidUpdated(s)
 	case "subscriber-closed":
 		s.NotifyClosed()
 	default:
-		log.Printf("Unsupported event from %s: %+v", s.conn, msg)
+		conn, _ := s.getConnection()
+		log.Printf("Unsupported event from %s: %+v", conn, msg)
 	}
 }
 
@@ -314,12 +388,15 @@ type mcuProxyConnection struct {
 	helloMsgId string
 	sessionId  string
 	country    atomic.Value
+	bandwidth  atomic.Value
 
 	callbacks map[string]func(*ProxyServerMessage)
 
 	publishersLock sync.RWMutex
 	publishers     map[string]*mcuProxyPublisher
 	publisherIds   map[string]string
+	// Maps ids of publishers cascaded from other proxies to the publisher key.
+	cascadedPublishers map[string]string
 
 	subscribersLock sync.RWMutex
 	subscribers     map[string]*mcuProxySubscriber
@@ -344,6 +421,8 @@ func newMcuProxyConnection(proxy *mcuProxy, baseUrl string, ip net.IP) (*mcuProx
 		publishers:        make(map[string]*mcuProxyPublisher),
 		publisherIds:      make(map[string]string),
 		subscribers:       make(map[string]*mcuProxySubscriber),
+
+		cascadedPublishers: make(map[string]string),
 	}
 	conn.country.Store("")
 	return conn, nil
@@ -358,14 +437,15 @@ func (c *mcuProxyConnection) String() string {
 }
 
 type mcuProxyConnectionStats struct {
-	Url        string     `json:"url"`
-	IP         net.IP     `json:"ip,omitempty"`
-	Connected  bool       `json:"connected"`
-	Publishers int64      `json:"publishers"`
-	Clients    int64      `json:"clients"`
-	Load       *int64     `json:"load,omitempty"`
-	Shutdown   *bool      `json:"shutdown,omitempty"`
-	Uptime     *time.Time `json:"uptime,omitempty"`
+	Url        string                     `json:"url"`
+	IP         net.IP                     `json:"ip,omitempty"`
+	Connected  bool                       `json:"connected"`
+	Publishers int64                      `json:"publishers"`
+	Clients    int64                      `json:"clients"`
+	Load       *int64                     `json:"load,omitempty"`
+	Bandwidth  *EventProxyServerBandwidth `json:"bandwidth,omitempty"`
+	Shutdown   *bool                      `json:"shutdown,omitempty"`
+	Uptime     *time.Time                 `json:"uptime,omitempty"`
 }
 
 func (c *mcuProxyConnection) GetStats() *mcuProxyConnectionStats {
@@ -379,6 +459,7 @@ func (c *mcuProxyConnection) GetStats() *mcuProxyConnectionStats {
 		result.Uptime = &c.connectedSince
 		load := c.Load()
 		result.Load = &load
+		result.Bandwidth = c.Bandwidth()
 		shutdown := c.IsShutdownScheduled()
 		result.Shutdown = &shutdown
 	}
@@ -393,10 +474,34 @@ func (c *mcuProxyConnection) GetStats() *mcuProxyConnectionStats {
 	return result
 }
 
+// countClients returns the number of publishers and subscribers on the
+// connection.
+func (c *mcuProxyConnection) countClients() int {
+	c.publishersLock.RLock()
+	count := len(c.publishers)
+	c.publishersLock.RUnlock()
+	c.subscribersLock.RLock()
+	count += len(c.subscribers)
+	c.subscribersLock.RUnlock()
+	return count
+}
+
+// isConnected returns true if the connection has a session on the proxy.
+func (c *mcuProxyConnection) isConnected() bool {
+	return atomic.LoadUint32(&c.trackClose) != 0
+}
+
 func (c *mcuProxyConnection) Load() int64 {
 	return atomic.LoadInt64(&c.load)
 }
 
+// Bandwidth returns the bandwidth reported by the proxy, or nil if the proxy
+// doesn't support measuring its bandwidth.
+func (c *mcuProxyConnection) Bandwidth() *EventProxyServerBandwidth {
+	bandwidth, _ := c.bandwidth.Load().(*EventProxyServerBandwidth)
+	return bandwidth
+}
+
 func (c *mcuProxyConnection) Country() string {
 	return c.country.Load().(string)
 }
@@ -415,6 +520,7 @@ func (c *mcuProxyConnection) readPump() {
 	}()
 	defer c.close()
 	defer atomic.StoreInt64(&c.load, loadNotConnected)
+	defer c.bandwidth.Store((*EventProxyServerBandwidth)(nil))
 
 	c.mu.Lock()
 	conn := c.conn
@@ -659,23 +765,71 @@ func (c *mcuProxyConnection) reconnect() {
 	go c.readPump()
 }
 
+func (c *mcuProxyConnection) addPublisher(publisher *mcuProxyPublisher, proxyId string) {
+	c.publishersLock.Lock()
+	defer c.publishersLock.Unlock()
+
+	c.publishers[proxyId] = publisher
+	c.publisherIds[publisher.id+"|"+publisher.StreamType()] = proxyId
+	statsPublishersCurrent.WithLabelValues(publisher.StreamType()).Inc()
+}
+
 func (c *mcuProxyConnection) removePublisher(publisher *mcuProxyPublisher) {
 	c.proxy.removePublisher(publisher)
+	c.detachPublisher(publisher, publisher.Id())
+}
 
+// detachPublisher removes the publisher with the given id on the proxy from
+// the connection without notifying anybody.
+func (c *mcuProxyConnection) detachPublisher(publisher *mcuProxyPublisher, proxyId string) {
 	c.publishersLock.Lock()
 	defer c.publishersLock.Unlock()
 
-	if _, found := c.publishers[publisher.proxyId]; found {
-		delete(c.publishers, publisher.proxyId)
+	if p, found := c.publishers[proxyId]; found && p == publisher {
+		delete(c.publishers, proxyId)
 		statsPublishersCurrent.WithLabelValues(publisher.StreamType()).Dec()
 	}
-	delete(c.publisherIds, publisher.id+"|"+publisher.StreamType())
+	key := publisher.id + "|" + publisher.StreamType()
+	if c.publisherIds[key] == proxyId {
+		delete(c.publisherIds, key)
+	}
 
 	if len(c.publishers) == 0 && atomic.LoadUint32(&c.closeScheduled) != 0 {
 		go c.closeIfEmpty()
 	}
 }
 
+// addRemotePublisher registers a publisher that was not created through this
+// connection (e.g. through WHIP), so subscribers can be created for it.
+func (c *mcuProxyConnection) addRemotePublisher(publisherId string, streamType string, proxyId string) {
+	key := publisherId + "|" + streamType
+	c.publishersLock.Lock()
+	c.publisherIds[key] = proxyId
+	c.publishersLock.Unlock()
+
+	c.proxy.mu.Lock()
+	c.proxy.publishers[key] = c
+	c.proxy.mu.Unlock()
+	c.proxy.wakeupWaiters()
+}
+
+func (c *mcuProxyConnection) removeRemotePublisher(publisherId string, streamType string, proxyId string) {
+	key := publisherId + "|" + streamType
+	c.publishersLock.Lock()
+	if c.publisherIds[key] != proxyId {
+		c.publishersLock.Unlock()
+		return
+	}
+	delete(c.publisherIds, key)
+	c.publishersLock.Unlock()
+
+	c.proxy.mu.Lock()
+	if c.proxy.publishers[key] == c {
+		delete(c.proxy.publishers, key)
+	}
+	c.proxy.mu.Unlock()
+}
+
 func (c *mcuProxyConnection) clearPublishers() {
 	c.publishersLock.Lock()
 	defer c.publishersLock.Unlock()
@@ -687,18 +841,33 @@ func (c *mcuProxyConnection) clearPublishers() {
 	}(c.publishers)
 	c.publishers = make(map[string]*mcuProxyPublisher)
 	c.publisherIds = make(map[string]string)
+	c.cascadedPublishers = make(map[string]string)
 
 	if atomic.LoadUint32(&c.closeScheduled) != 0 {
 		go c.closeIfEmpty()
 	}
 }
 
+func (c *mcuProxyConnection) addSubscriber(subscriber *mcuProxySubscriber, proxyId string) {
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+
+	c.subscribers[proxyId] = subscriber
+	statsSubscribersCurrent.WithLabelValues(subscriber.StreamType()).Inc()
+}
+
 func (c *mcuProxyConnection) removeSubscriber(subscriber *mcuProxySubscriber) {
+	c.detachSubscriber(subscriber, subscriber.Id())
+}
+
+// detachSubscriber removes the subscriber with the given id on the proxy from
+// the connection without notifying anybody.
+func (c *mcuProxyConnection) detachSubscriber(subscriber *mcuProxySubscriber, proxyId string) {
 	c.subscribersLock.Lock()
 	defer c.subscribersLock.Unlock()
 
-	if _, found := c.subscribers[subscriber.proxyId]; found {
-		delete(c.subscribers, subscriber.proxyId)
+	if s, found := c.subscribers[proxyId]; found && s == subscriber {
+		delete(c.subscribers, proxyId)
 		statsSubscribersCurrent.WithLabelValues(subscriber.StreamType()).Dec()
 	}
 
@@ -707,6 +876,19 @@ func (c *mcuProxyConnection) removeSubscriber(subscriber *mcuProxySubscriber) {
 	}
 }
 
+func (c *mcuProxyConnection) getSubscribersOf(publisher string, streamType string) []*mcuProxySubscriber {
+	c.subscribersLock.RLock()
+	defer c.subscribersLock.RUnlock()
+
+	var result []*mcuProxySubscriber
+	for _, subscriber := range c.subscribers {
+		if subscriber.publisherId == publisher && subscriber.StreamType() == streamType {
+			result = append(result, subscriber)
+		}
+	}
+	return result
+}
+
 func (c *mcuProxyConnection) clearSubscribers() {
 	c.subscribersLock.Lock()
 	defer c.subscribersLock.Unlock()
@@ -723,6 +905,144 @@ func (c *mcuProxyConnection) clearSubscribers() {
 	}
 }
 
+// syncClients requests the clients that still exist on the proxy after a
+// session was resumed and reconciles them with the local state.
+func (c *mcuProxyConnection) syncClients() {
+	c.publishersLock.RLock()
+	publishers := make(map[string]*mcuProxyPublisher, len(c.publishers))
+	for id, publisher := range c.publishers {
+		publishers[id] = publisher
+	}
+	c.publishersLock.RUnlock()
+
+	c.subscribersLock.RLock()
+	subscribers := make(map[string]*mcuProxySubscriber, len(c.subscribers))
+	for id, subscriber := range c.subscribers {
+		subscribers[id] = subscriber
+	}
+	c.subscribersLock.RUnlock()
+
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type: "list-clients",
+		},
+	}
+	c.performAsyncRequest(context.Background(), msg, func(err error, response *ProxyServerMessage) {
+		if err != nil {
+			log.Printf("Could not list clients on %s: %s", c, err)
+			return
+		} else if response.Type == "error" {
+			// Older proxies don't support listing clients, keep current state.
+			log.Printf("Could not list clients on %s: %+v", c, response.Error)
+			return
+		} else if response.Command == nil {
+			log.Printf("Received unsupported list clients response %+v from %s", response, c)
+			return
+		}
+
+		go c.reconcileClients(publishers, subscribers, response.Command.Publishers, response.Command.Subscribers)
+	})
+}
+
+// reconcileClients notifies about known clients that no longer exist on the
+// proxy and closes clients on the proxy that are no longer known locally.
+func (c *mcuProxyConnection) reconcileClients(publishers map[string]*mcuProxyPublisher, subscribers map[string]*mcuProxySubscriber, remotePublishers []string, remoteSubscribers []string) {
+	var lostPublishers []*mcuProxyPublisher
+	remote := make(map[string]bool, len(remotePublishers))
+	for _, id := range remotePublishers {
+		remote[id] = true
+	}
+	for id, publisher := range publishers {
+		if !remote[id] {
+			lostPublishers = append(lostPublishers, publisher)
+		}
+	}
+
+	var lostSubscribers []*mcuProxySubscriber
+	remote = make(map[string]bool, len(remoteSubscribers))
+	for _, id := range remoteSubscribers {
+		remote[id] = true
+	}
+	for id, subscriber := range subscribers {
+		if !remote[id] {
+			lostSubscribers = append(lostSubscribers, subscriber)
+		}
+	}
+
+	var orphanPublishers []string
+	c.publishersLock.RLock()
+	for _, id := range remotePublishers {
+		if _, found := c.publishers[id]; !found && c.cascadedPublishers[id] == "" {
+			orphanPublishers = append(orphanPublishers, id)
+		}
+	}
+	c.publishersLock.RUnlock()
+
+	var orphanSubscribers []string
+	c.subscribersLock.RLock()
+	for _, id := range remoteSubscribers {
+		if _, found := c.subscribers[id]; !found {
+			orphanSubscribers = append(orphanSubscribers, id)
+		}
+	}
+	c.subscribersLock.RUnlock()
+
+	if len(lostPublishers) == 0 && len(lostSubscribers) == 0 && len(orphanPublishers) == 0 && len(orphanSubscribers) == 0 {
+		log.Printf("Clients on %s are in sync", c)
+		return
+	}
+
+	log.Printf("Reconciling clients on %s: %d publishers and %d subscribers lost, %d publishers and %d subscribers orphaned",
+		c, len(lostPublishers), len(lostSubscribers), len(orphanPublishers), len(orphanSubscribers))
+	for _, publisher := range lostPublishers {
+		publisher.NotifyClosed()
+	}
+	for _, subscriber := range lostSubscribers {
+		subscriber.NotifyClosed()
+	}
+
+	c.mu.Lock()
+	pending := len(c.callbacks)
+	c.mu.Unlock()
+	if pending > 0 && (len(orphanPublishers) > 0 || len(orphanSubscribers) > 0) {
+		// Clients might have been created by requests that are still pending.
+		log.Printf("Not closing orphaned clients on %s while %d requests are pending", c, pending)
+		return
+	}
+
+	for _, id := range orphanPublishers {
+		if c.deleteClient("delete-publisher", id) {
+			log.Printf("Closed orphaned publisher %s at %s", id, c)
+		}
+	}
+	for _, id := range orphanSubscribers {
+		if c.deleteClient("delete-subscriber", id) {
+			log.Printf("Closed orphaned subscriber %s at %s", id, c)
+		}
+	}
+}
+
+func (c *mcuProxyConnection) deleteClient(command string, id string) bool {
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type:     command,
+			ClientId: id,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.proxy.proxyTimeout)
+	defer cancel()
+
+	if _, err := c.performSyncRequest(ctx, msg); err != nil {
+		log.Printf("Could not %s %s at %s: %s", command, id, c, err)
+		return false
+	}
+
+	return true
+}
+
 func (c *mcuProxyConnection) clearCallbacks() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -774,6 +1094,7 @@ func (c *mcuProxyConnection) processMessage(msg *ProxyServerMessage) {
 			c.country.Store(country)
 			if resumed {
 				log.Printf("Resumed session %s on %s", c.sessionId, c)
+				c.syncClients()
 			} else if country != "" {
 				log.Printf("Received session %s from %s (in %s)", c.sessionId, c, country)
 			} else {
@@ -841,6 +1162,9 @@ func (c *mcuProxyConnection) processEvent(msg *ProxyServerMessage) {
 		c.clearCallbacks()
 		// TODO: Should we also reconnect?
 		return
+	case "backend-interrupted":
+		log.Printf("Upstream backend at %s got interrupted, waiting for reconnect", c)
+		return
 	case "backend-connected":
 		log.Printf("Upstream backend at %s is connected", c)
 		return
@@ -849,11 +1173,30 @@ func (c *mcuProxyConnection) processEvent(msg *ProxyServerMessage) {
 			log.Printf("Load of %s now at %d", c, event.Load)
 		}
 		atomic.StoreInt64(&c.load, event.Load)
+		c.bandwidth.Store(event.Bandwidth)
 		statsProxyBackendLoadCurrent.WithLabelValues(c.url.String()).Set(float64(event.Load))
+		if bandwidth := event.Bandwidth; bandwidth != nil {
+			statsProxyBackendBandwidthCurrent.WithLabelValues(c.url.String(), "incoming").Set(float64(bandwidth.Incoming))
+			statsProxyBackendBandwidthCurrent.WithLabelValues(c.url.String(), "outgoing").Set(float64(bandwidth.Outgoing))
+		}
+		return
+	case "remote-publisher-added":
+		log.Printf("Remote %s publisher %s was created as %s on %s", event.StreamType, event.PublisherId, event.ClientId, c)
+		c.addRemotePublisher(event.PublisherId, event.StreamType, event.ClientId)
+		return
+	case "remote-publisher-removed":
+		log.Printf("Remote %s publisher %s (%s) was removed from %s", event.StreamType, event.PublisherId, event.ClientId, c)
+		c.removeRemotePublisher(event.PublisherId, event.StreamType, event.ClientId)
 		return
 	case "shutdown-scheduled":
-		log.Printf("Proxy %s is scheduled to shutdown", c)
-		atomic.StoreUint32(&c.shutdownScheduled, 1)
+		if event.DrainTimeout > 0 {
+			log.Printf("Proxy %s is scheduled to shutdown in %s", c, time.Duration(event.DrainTimeout)*time.Second)
+		} else {
+			log.Printf("Proxy %s is scheduled to shutdown", c)
+		}
+		if atomic.CompareAndSwapUint32(&c.shutdownScheduled, 0, 1) {
+			go c.migratePublishers()
+		}
 		return
 	}
 
@@ -897,6 +1240,10 @@ func (c *mcuProxyConnection) sendHello() error {
 		Type: "hello",
 		Hello: &HelloProxyClientMessage{
 			Version: "1.0",
+			Features: []string{
+				ProxyFeatureRenegotiate,
+				ProxyFeatureRemotePublishers,
+			},
 		},
 	}
 	if c.sessionId != "" {
@@ -978,70 +1325,105 @@ func (c *mcuProxyConnection) performSyncRequest(ctx context.Context, msg *ProxyC
 	}
 }
 
-func (c *mcuProxyConnection) newPublisher(ctx context.Context, listener McuListener, id string, sid string, streamType string, bitrate int, mediaTypes MediaType) (McuPublisher, error) {
+func (c *mcuProxyConnection) createPublisher(ctx context.Context, id string, sid string, streamType string, bitrate int, mediaTypes MediaType) (string, error) {
 	msg := &ProxyClientMessage{
 		Type: "command",
 		Command: &CommandProxyClientMessage{
-			Type:       "create-publisher",
-			Sid:        sid,
-			StreamType: streamType,
-			Bitrate:    bitrate,
-			MediaTypes: mediaTypes,
+			Type:        "create-publisher",
+			PublisherId: id,
+			Sid:         sid,
+			StreamType:  streamType,
+			Bitrate:     bitrate,
+			MediaTypes:  mediaTypes,
 		},
 	}
 
 	response, err := c.performSyncRequest(ctx, msg)
 	if err != nil {
 		// TODO: Cancel request
+		return "", err
+	} else if response.Type == "error" {
+		return "", response.Error
+	}
+
+	return response.Command.Id, nil
+}
+
+func (c *mcuProxyConnection) newPublisher(ctx context.Context, listener McuListener, id string, sid string, streamType string, bitrate int, mediaTypes MediaType) (McuPublisher, error) {
+	proxyId, err := c.createPublisher(ctx, id, sid, streamType, bitrate, mediaTypes)
+	if err != nil {
 		return nil, err
 	}
 
-	proxyId := response.Command.Id
 	log.Printf("Created %s publisher %s on %s for %s", streamType, proxyId, c, id)
-	publisher := newMcuProxyPublisher(id, sid, streamType, mediaTypes, proxyId, c, listener)
-	c.publishersLock.Lock()
-	c.publishers[proxyId] = publisher
-	c.publisherIds[id+"|"+streamType] = proxyId
-	c.publishersLock.Unlock()
-	statsPublishersCurrent.WithLabelValues(streamType).Inc()
+	publisher := newMcuProxyPublisher(id, sid, streamType, bitrate, mediaTypes, proxyId, c, listener)
+	c.addPublisher(publisher, proxyId)
 	statsPublishersTotal.WithLabelValues(streamType).Inc()
 	return publisher, nil
 }
 
-func (c *mcuProxyConnection) newSubscriber(ctx context.Context, listener McuListener, publisher string, streamType string) (McuSubscriber, error) {
-	c.publishersLock.Lock()
-	id, found := c.publisherIds[publisher+"|"+streamType]
-	c.publishersLock.Unlock()
-	if !found {
-		return nil, fmt.Errorf("Unknown publisher %s", publisher)
-	}
-
+func (c *mcuProxyConnection) createSubscriber(ctx context.Context, publisherId string, streamType string) (string, string, error) {
 	msg := &ProxyClientMessage{
 		Type: "command",
 		Command: &CommandProxyClientMessage{
 			Type:        "create-subscriber",
 			StreamType:  streamType,
-			PublisherId: id,
+			PublisherId: publisherId,
 		},
 	}
 
 	response, err := c.performSyncRequest(ctx, msg)
 	if err != nil {
 		// TODO: Cancel request
+		return "", "", err
+	} else if response.Type == "error" {
+		return "", "", response.Error
+	}
+
+	return response.Command.Id, response.Command.Sid, nil
+}
+
+func (c *mcuProxyConnection) newSubscriber(ctx context.Context, listener McuListener, publisher string, streamType string) (McuSubscriber, error) {
+	c.publishersLock.Lock()
+	id, found := c.publisherIds[publisher+"|"+streamType]
+	c.publishersLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("Unknown publisher %s", publisher)
+	}
+
+	proxyId, sid, err := c.createSubscriber(ctx, id, streamType)
+	if err != nil {
 		return nil, err
 	}
 
-	proxyId := response.Command.Id
 	log.Printf("Created %s subscriber %s on %s for %s", streamType, proxyId, c, publisher)
-	subscriber := newMcuProxySubscriber(publisher, response.Command.Sid, streamType, proxyId, c, listener)
-	c.subscribersLock.Lock()
-	c.subscribers[proxyId] = subscriber
-	c.subscribersLock.Unlock()
-	statsSubscribersCurrent.WithLabelValues(streamType).Inc()
+	subscriber := newMcuProxySubscriber(publisher, sid, streamType, proxyId, c, listener)
+	subscriber.country = getMcuListenerCountry(listener)
+	c.addSubscriber(subscriber, proxyId)
 	statsSubscribersTotal.WithLabelValues(streamType).Inc()
 	return subscriber, nil
 }
 
+// migratePublishers moves all publishers to other proxies so the proxy of
+// this connection can shutdown without interrupting the streams.
+func (c *mcuProxyConnection) migratePublishers() {
+	c.publishersLock.RLock()
+	publishers := make([]*mcuProxyPublisher, 0, len(c.publishers))
+	for _, publisher := range c.publishers {
+		publishers = append(publishers, publisher)
+	}
+	c.publishersLock.RUnlock()
+
+	if len(publishers) == 0 {
+		return
+	}
+
+	log.Printf("Migrating %d publishers from %s", len(publishers), c)
+	for _, publisher := range publishers {
+		go c.proxy.migratePublisher(c, publisher)
+	}
+}
+
 type mcuProxy struct {
 	// 64-bit members that are accessed atomically must be 64-bit aligned.
 	connRequests int64
@@ -1051,10 +1433,11 @@ type mcuProxy struct {
 	tokenId  string
 	tokenKey *rsa.PrivateKey
 
-	etcdMu   sync.Mutex
-	client   atomic.Value
-	keyInfos map[string]*ProxyInformationEtcd
-	urlToKey map[string]string
+	etcdMu     sync.Mutex
+	client     atomic.Value
+	keyInfos   map[string]*ProxyInformationEtcd
+	urlToKey   map[string]string
+	etcdFilter *proxyEtcdFilter
 
 	dialer         *websocket.Dialer
 	connections    []*mcuProxyConnection
@@ -1062,6 +1445,10 @@ type mcuProxy struct {
 	connectionsMu  sync.RWMutex
 	proxyTimeout   time.Duration
 
+	// Number of connections that are opened to each proxy (and IP), requests
+	// are distributed between them.
+	connectionsPerProxy int
+
 	dnsDiscovery bool
 	stopping     chan bool
 	stopped      chan bool
@@ -1069,6 +1456,13 @@ type mcuProxy struct {
 	maxStreamBitrate int
 	maxScreenBitrate int
 
+	// Minimum number of subscribers of a publisher on a different continent
+	// before its media is cascaded to a proxy there, 0 to disable.
+	cascadeSubscribers int32
+	cascadesMu         sync.Mutex
+	cascades           map[string][]*mcuProxyCascade
+	cascadesFailed     map[string]time.Time
+
 	mu         sync.RWMutex
 	publishers map[string]*mcuProxyConnection
 
@@ -1078,6 +1472,13 @@ type mcuProxy struct {
 	continentsMap atomic.Value
 }
 
+func init() {
+	RegisterMcuType(McuTypeProxy, func(url string, config *goconf.ConfigFile) (Mcu, error) {
+		// The urls of the proxies are configured separately.
+		return NewMcuProxy(config)
+	}, RegisterProxyMcuStats, UnregisterProxyMcuStats)
+}
+
 func NewMcuProxy(config *goconf.ConfigFile) (Mcu, error) {
 	urlType, _ := config.GetString("mcu", "urltype")
 	if urlType == "" {
@@ -1108,6 +1509,14 @@ func NewMcuProxy(config *goconf.ConfigFile) (Mcu, error) {
 	proxyTimeout := time.Duration(proxyTimeoutSeconds) * time.Second
 	log.Printf("Using a timeout of %s for proxy requests", proxyTimeout)
 
+	connectionsPerProxy, _ := config.GetInt("mcu", "connectionsperproxy")
+	if connectionsPerProxy <= 0 {
+		connectionsPerProxy = defaultConnectionsPerProxy
+	}
+	if connectionsPerProxy > 1 {
+		log.Printf("Using %d connections per proxy", connectionsPerProxy)
+	}
+
 	maxStreamBitrate, _ := config.GetInt("mcu", "maxstreambitrate")
 	if maxStreamBitrate <= 0 {
 		maxStreamBitrate = defaultMaxStreamBitrate
@@ -1129,12 +1538,18 @@ func NewMcuProxy(config *goconf.ConfigFile) (Mcu, error) {
 		connectionsMap: make(map[string][]*mcuProxyConnection),
 		proxyTimeout:   proxyTimeout,
 
+		connectionsPerProxy: connectionsPerProxy,
+
 		stopping: make(chan bool, 1),
 		stopped:  make(chan bool, 1),
 
 		maxStreamBitrate: maxStreamBitrate,
 		maxScreenBitrate: maxScreenBitrate,
 
+		cascadeSubscribers: getCascadeSubscribers(config),
+		cascades:           make(map[string][]*mcuProxyCascade),
+		cascadesFailed:     make(map[string]time.Time),
+
 		publishers: make(map[string]*mcuProxyConnection),
 
 		publisherWaiters: make(map[uint64]chan bool),
@@ -1291,20 +1706,23 @@ func (m *mcuProxy) updateProxyIPs() {
 		}
 
 		var newConns []*mcuProxyConnection
+		existing := make(map[string]bool)
 		changed := false
 		for _, conn := range conns {
 			found := false
-			for idx, ip := range ips {
+			for _, ip := range ips {
 				if ip.Equal(conn.ip) {
-					ips = append(ips[:idx], ips[idx+1:]...)
 					found = true
-					conn.stopCloseIfEmpty()
-					newConns = append(newConns, conn)
 					break
 				}
 			}
 
-			if !found {
+			if found {
+				// All connections of the pool to this IP are kept.
+				existing[conn.ip.String()] = true
+				conn.stopCloseIfEmpty()
+				newConns = append(newConns, conn)
+			} else {
 				changed = true
 				log.Printf("Removing connection to %s", conn)
 				conn.closeIfEmpty()
@@ -1312,21 +1730,27 @@ func (m *mcuProxy) updateProxyIPs() {
 		}
 
 		for _, ip := range ips {
-			conn, err := newMcuProxyConnection(m, u, ip)
-			if err != nil {
-				log.Printf("Could not create proxy connection to %s (%s): %s", u, ip, err)
+			if existing[ip.String()] {
 				continue
 			}
 
-			if err := conn.start(); err != nil {
-				log.Printf("Could not start new connection to %s: %s", conn, err)
+			created, err := m.newConnections(u, ip)
+			if err != nil {
+				log.Printf("Could not create proxy connection to %s (%s): %s", u, ip, err)
 				continue
 			}
 
-			log.Printf("Adding new connection to %s", conn)
-			m.connections = append(m.connections, conn)
-			newConns = append(newConns, conn)
-			changed = true
+			for _, conn := range created {
+				if err := conn.start(); err != nil {
+					log.Printf("Could not start new connection to %s: %s", conn, err)
+					continue
+				}
+
+				log.Printf("Adding new connection to %s", conn)
+				m.connections = append(m.connections, conn)
+				newConns = append(newConns, conn)
+				changed = true
+			}
 		}
 
 		if changed {
@@ -1395,7 +1819,7 @@ func (m *mcuProxy) configureStatic(config *goconf.ConfigFile, fromReload bool) e
 
 		var conns []*mcuProxyConnection
 		if ips == nil {
-			conn, err := newMcuProxyConnection(m, u, nil)
+			created, err := m.newConnections(u, nil)
 			if err != nil {
 				if !fromReload {
 					return err
@@ -1405,10 +1829,10 @@ func (m *mcuProxy) configureStatic(config *goconf.ConfigFile, fromReload bool) e
 				continue
 			}
 
-			conns = append(conns, conn)
+			conns = append(conns, created...)
 		} else {
 			for _, ip := range ips {
-				conn, err := newMcuProxyConnection(m, u, ip)
+				created, err := m.newConnections(u, ip)
 				if err != nil {
 					if !fromReload {
 						return err
@@ -1418,7 +1842,7 @@ func (m *mcuProxy) configureStatic(config *goconf.ConfigFile, fromReload bool) e
 					continue
 				}
 
-				conns = append(conns, conn)
+				conns = append(conns, created...)
 			}
 		}
 		created[u] = conns
@@ -1469,6 +1893,11 @@ func (m *mcuProxy) configureEtcd(config *goconf.ConfigFile, ignoreErrors bool) e
 		keyPrefix = "/%s"
 	}
 
+	filter := newProxyEtcdFilter(config)
+	m.etcdMu.Lock()
+	m.etcdFilter = filter
+	m.etcdMu.Unlock()
+
 	var endpoints []string
 	if endpointsString, _ := config.GetString("mcu", "endpoints"); endpointsString != "" {
 		for _, ep := range strings.Split(endpointsString, ",") {
@@ -1621,6 +2050,8 @@ func (m *mcuProxy) Reload(config *goconf.ConfigFile) {
 		log.Printf("Error loading continents map: %s", err)
 	}
 
+	atomic.StoreInt32(&m.cascadeSubscribers, getCascadeSubscribers(config))
+
 	switch m.urlType {
 	case proxyUrlTypeStatic:
 		if err := m.configureStatic(config, true); err != nil {
@@ -1646,6 +2077,77 @@ func (m *mcuProxy) processWatches(ch clientv3.WatchChan) {
 	}
 }
 
+// proxyEtcdFilter restricts the proxies received from etcd based on their
+// deployment metadata. Filters that are not configured accept all values.
+type proxyEtcdFilter struct {
+	regions         map[string]bool
+	versions        []string
+	capacityClasses map[string]bool
+}
+
+func getConfigList(config *goconf.ConfigFile, section string, option string) []string {
+	var result []string
+	value, _ := config.GetString(section, option)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func newProxyEtcdFilter(config *goconf.ConfigFile) *proxyEtcdFilter {
+	filter := &proxyEtcdFilter{
+		versions: getConfigList(config, "mcu", "versions"),
+	}
+	if regions := getConfigList(config, "mcu", "regions"); len(regions) > 0 {
+		filter.regions = make(map[string]bool)
+		for _, region := range regions {
+			filter.regions[region] = true
+		}
+		log.Printf("Only using proxies in regions %+v", regions)
+	}
+	if len(filter.versions) > 0 {
+		log.Printf("Only using proxies with versions %+v", filter.versions)
+	}
+	if classes := getConfigList(config, "mcu", "capacityclasses"); len(classes) > 0 {
+		filter.capacityClasses = make(map[string]bool)
+		for _, class := range classes {
+			filter.capacityClasses[class] = true
+		}
+		log.Printf("Only using proxies with capacity classes %+v", classes)
+	}
+	return filter
+}
+
+func (f *proxyEtcdFilter) acceptsVersion(version string) bool {
+	if len(f.versions) == 0 {
+		return true
+	}
+
+	for _, v := range f.versions {
+		// Allow filtering for "1.2" to match "1.2.3", but not "1.20".
+		if version == v || strings.HasPrefix(version, v+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *proxyEtcdFilter) Accepts(info *ProxyInformationEtcd) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.regions != nil && !f.regions[info.Region] {
+		return false
+	}
+	if f.capacityClasses != nil && !f.capacityClasses[info.CapacityClass] {
+		return false
+	}
+	return f.acceptsVersion(info.Version)
+}
+
 func (m *mcuProxy) addEtcdProxy(key string, data []byte) {
 	var info ProxyInformationEtcd
 	if err := json.Unmarshal(data, &info); err != nil {
@@ -1660,6 +2162,13 @@ func (m *mcuProxy) addEtcdProxy(key string, data []byte) {
 	m.etcdMu.Lock()
 	defer m.etcdMu.Unlock()
 
+	if !m.etcdFilter.Accepts(&info) {
+		log.Printf("Ignoring proxy %s (from %s) with region %q, version %q and capacity class %q", info.Address, key, info.Region, info.Version, info.CapacityClass)
+		// The metadata of a previously accepted proxy might have changed.
+		m.removeEtcdProxyLocked(key)
+		return
+	}
+
 	prev, found := m.keyInfos[key]
 	if found && info.Address != prev.Address {
 		// Address of a proxy has changed.
@@ -1680,22 +2189,30 @@ func (m *mcuProxy) addEtcdProxy(key string, data []byte) {
 			conn.stopCloseIfEmpty()
 		}
 	} else {
-		conn, err := newMcuProxyConnection(m, info.Address, nil)
+		created, err := m.newConnections(info.Address, nil)
 		if err != nil {
 			log.Printf("Could not create proxy connection to %s: %s", info.Address, err)
 			return
 		}
 
-		if err := conn.start(); err != nil {
-			log.Printf("Could not start new connection to %s: %s", info.Address, err)
+		var started []*mcuProxyConnection
+		for _, conn := range created {
+			if err := conn.start(); err != nil {
+				log.Printf("Could not start new connection to %s: %s", info.Address, err)
+				continue
+			}
+
+			started = append(started, conn)
+		}
+		if len(started) == 0 {
 			return
 		}
 
-		log.Printf("Adding new connection to %s (from %s)", info.Address, key)
+		log.Printf("Adding %d new connection(s) to %s (from %s)", len(started), info.Address, key)
 		m.keyInfos[key] = &info
 		m.urlToKey[info.Address] = key
-		m.connections = append(m.connections, conn)
-		m.connectionsMap[info.Address] = []*mcuProxyConnection{conn}
+		m.connections = append(m.connections, started...)
+		m.connectionsMap[info.Address] = started
 		atomic.StoreInt64(&m.nextSort, 0)
 	}
 }
@@ -1727,6 +2244,52 @@ func (m *mcuProxy) removeEtcdProxyLocked(key string) {
 	}
 }
 
+// newConnections creates the configured number of connections to the proxy at
+// the given url (and IP).
+func (m *mcuProxy) newConnections(baseUrl string, ip net.IP) ([]*mcuProxyConnection, error) {
+	count := m.connectionsPerProxy
+	if count <= 0 {
+		count = defaultConnectionsPerProxy
+	}
+
+	conns := make([]*mcuProxyConnection, 0, count)
+	for i := 0; i < count; i++ {
+		conn, err := newMcuProxyConnection(m, baseUrl, ip)
+		if err != nil {
+			return nil, err
+		}
+
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// getPoolConnection returns the connection with the fewest clients of all
+// connections to the same proxy as the given connection.
+func (m *mcuProxy) getPoolConnection(conn *mcuProxyConnection) *mcuProxyConnection {
+	if m.connectionsPerProxy <= 1 {
+		return conn
+	}
+
+	m.connectionsMu.RLock()
+	conns := m.connectionsMap[conn.rawUrl]
+	m.connectionsMu.RUnlock()
+
+	result := conn
+	clients := conn.countClients()
+	for _, c := range conns {
+		if c == conn || !c.ip.Equal(conn.ip) || c.IsShutdownScheduled() || !c.isConnected() {
+			continue
+		}
+
+		if count := c.countClients(); count < clients {
+			result = c
+			clients = count
+		}
+	}
+	return result
+}
+
 func (m *mcuProxy) removeConnection(c *mcuProxyConnection) {
 	m.connectionsMu.Lock()
 	defer m.connectionsMu.Unlock()
@@ -1810,8 +2373,40 @@ func (l mcuProxyConnectionsList) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
+// mcuProxyConnectionsByBandwidth sorts connections by the bandwidth reported
+// by the proxies, connections without bandwidth information are sorted last.
+type mcuProxyConnectionsByBandwidth []*mcuProxyConnection
+
+func (l mcuProxyConnectionsByBandwidth) Len() int {
+	return len(l)
+}
+
+func (l mcuProxyConnectionsByBandwidth) Less(i, j int) bool {
+	a := l[i].Bandwidth()
+	b := l[j].Bandwidth()
+	if a == nil {
+		return false
+	} else if b == nil {
+		return true
+	}
+	return a.Total() < b.Total()
+}
+
+func (l mcuProxyConnectionsByBandwidth) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Sort sorts the connections by their bandwidth if all connected proxies
+// report it, otherwise by the number of streams they are handling.
 func (l mcuProxyConnectionsList) Sort() {
-	sort.Sort(l)
+	for _, conn := range l {
+		if conn.Load() != loadNotConnected && conn.Bandwidth() == nil {
+			sort.Sort(l)
+			return
+		}
+	}
+
+	sort.Sort(mcuProxyConnectionsByBandwidth(l))
 }
 
 func ContinentsOverlap(a, b []string) bool {
@@ -1905,9 +2500,101 @@ func (m *mcuProxy) getSortedConnections(initiator McuInitiator) []*mcuProxyConne
 
 func (m *mcuProxy) removePublisher(publisher *mcuProxyPublisher) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	delete(m.publishers, publisher.id+"|"+publisher.StreamType())
+	m.mu.Unlock()
+
+	m.removeCascades(publisher.id, publisher.StreamType())
+}
+
+// migratePublisher creates a new publisher on a different proxy and asks the
+// client to renegotiate. Once ICE has completed (or a timeout occurred), the
+// subscribers are also migrated and the old publisher is removed.
+func (m *mcuProxy) migratePublisher(from *mcuProxyConnection, publisher *mcuProxyPublisher) {
+	streamType := publisher.StreamType()
+	oldConn, oldId := publisher.getConnection()
+	if oldConn != from {
+		// Publisher has already been moved.
+		return
+	}
+
+	var conn *mcuProxyConnection
+	var proxyId string
+	for _, c := range m.getSortedConnections(nil) {
+		if c == from || c.IsShutdownScheduled() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.proxyTimeout)
+		id, err := c.createPublisher(ctx, publisher.id, publisher.Sid(), streamType, publisher.bitrate, publisher.mediaTypes)
+		cancel()
+		if err != nil {
+			log.Printf("Could not create %s publisher for %s on %s: %s", streamType, publisher.id, c, err)
+			continue
+		}
+
+		conn = c
+		proxyId = id
+		break
+	}
+	if conn == nil {
+		log.Printf("No proxy available to migrate %s publisher %s from %s", streamType, publisher.id, from)
+		statsProxyMigratedPublishersTotal.WithLabelValues(streamType, "failed").Inc()
+		return
+	}
+
+	log.Printf("Migrating %s publisher %s for %s from %s to %s", streamType, oldId, publisher.id, from, conn)
+	m.removeCascades(publisher.id, streamType)
+	migrated := publisher.migrate(conn, proxyId)
+	conn.addPublisher(publisher, proxyId)
+	from.detachPublisher(publisher, oldId)
+	m.mu.Lock()
+	m.publishers[publisher.id+"|"+streamType] = conn
+	m.mu.Unlock()
+
+	publisher.listener.PublisherReconnected(publisher)
+
+	timer := time.NewTimer(publisherMigrationTimeout)
+	defer timer.Stop()
+	select {
+	case <-migrated:
+	case <-timer.C:
+		log.Printf("Publisher %s for %s was not renegotiated on %s in time", proxyId, publisher.id, conn)
+	}
+
+	for _, subscriber := range from.getSubscribersOf(publisher.id, streamType) {
+		m.migrateSubscriber(from, conn, proxyId, subscriber)
+	}
+
+	if from.deleteClient("delete-publisher", oldId) {
+		log.Printf("Deleted migrated publisher %s at %s", oldId, from)
+	}
+	statsProxyMigratedPublishersTotal.WithLabelValues(streamType, "success").Inc()
+}
+
+func (m *mcuProxy) migrateSubscriber(from *mcuProxyConnection, to *mcuProxyConnection, publisherId string, subscriber *mcuProxySubscriber) {
+	streamType := subscriber.StreamType()
+	_, oldId := subscriber.getConnection()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.proxyTimeout)
+	defer cancel()
+
+	proxyId, sid, err := to.createSubscriber(ctx, publisherId, streamType)
+	if err != nil {
+		log.Printf("Could not migrate %s subscriber %s for %s to %s: %s", streamType, oldId, subscriber.publisherId, to, err)
+		subscriber.Close(ctx)
+		return
+	}
+
+	log.Printf("Migrated %s subscriber %s for %s from %s to %s", streamType, oldId, subscriber.publisherId, from, to)
+	subscriber.setConnection(to, proxyId, sid)
+	to.addSubscriber(subscriber, proxyId)
+	from.detachSubscriber(subscriber, oldId)
+
+	subscriber.listener.SubscriberSidUpdated(subscriber)
+
+	if from.deleteClient("delete-subscriber", oldId) {
+		log.Printf("Deleted migrated subscriber %s at %s", oldId, from)
+	}
 }
 
 func (m *mcuProxy) wakeupWaiters() {
@@ -1936,6 +2623,7 @@ func (m *mcuProxy) NewPublisher(ctx context.Context, listener McuListener, id st
 			continue
 		}
 
+		conn = m.getPoolConnection(conn)
 		subctx, cancel := context.WithTimeout(ctx, m.proxyTimeout)
 		defer cancel()
 
@@ -2012,5 +2700,9 @@ func (m *mcuProxy) NewSubscriber(ctx context.Context, listener McuListener, publ
 		return nil, fmt.Errorf("No %s publisher %s found", streamType, publisher)
 	}
 
+	if subscriber := m.newCascadedSubscriber(ctx, conn, listener, publisher, streamType); subscriber != nil {
+		return subscriber, nil
+	}
+
 	return conn.newSubscriber(ctx, listener, publisher, streamType)
 }
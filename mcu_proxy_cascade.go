@@ -0,0 +1,370 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Don't try to create a cascade for a publisher again if the previous
+	// attempt failed within this interval.
+	cascadeRetryInterval = time.Minute
+)
+
+// mcuProxyCascade sends the media of a publisher from the proxy it was created
+// on (origin) to a proxy on the continent of some of its subscribers (edge),
+// which then serves the subscribers of this continent.
+type mcuProxyCascade struct {
+	publisherId string
+	streamType  string
+	continents  []string
+
+	origin   *mcuProxyConnection
+	originId string
+	edge     *mcuProxyConnection
+	edgeId   string
+}
+
+func (c *mcuProxyCascade) String() string {
+	return fmt.Sprintf("%s publisher %s from %s to %s", c.streamType, c.publisherId, c.origin, c.edge)
+}
+
+func (c *mcuProxyCascade) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.origin.proxy.proxyTimeout)
+	defer cancel()
+
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type:     "unpublish-remote",
+			ClientId: c.originId,
+			RemoteId: c.edgeId,
+		},
+	}
+	if response, err := c.origin.performSyncRequest(ctx, msg); err != nil {
+		log.Printf("Could not stop cascading %s: %s", c, err)
+	} else if response.Type == "error" {
+		// The publisher on the origin has most probably been closed already.
+		log.Printf("Could not stop cascading %s: %s", c, response.Error)
+	}
+
+	c.edge.removeCascadedPublisher(c.publisherId, c.streamType, c.edgeId)
+	if c.edge.deleteClient("delete-publisher", c.edgeId) {
+		log.Printf("Stopped cascading %s", c)
+	}
+}
+
+// getMcuListenerCountry returns the country of the client a MCU listener
+// (i.e. the session) belongs to, if known.
+func getMcuListenerCountry(listener McuListener) string {
+	if initiator, ok := listener.(McuInitiator); ok {
+		if country := initiator.Country(); IsValidCountry(country) {
+			return country
+		}
+	}
+	return ""
+}
+
+func getCascadeSubscribers(config *goconf.ConfigFile) int32 {
+	subscribers, _ := config.GetInt("mcu", "cascadesubscribers")
+	if subscribers < 0 {
+		subscribers = 0
+	}
+	return int32(subscribers)
+}
+
+func (c *mcuProxyConnection) addCascadedPublisher(publisherId string, streamType string, proxyId string) {
+	c.publishersLock.Lock()
+	defer c.publishersLock.Unlock()
+
+	c.publisherIds[publisherId+"|"+streamType] = proxyId
+	c.cascadedPublishers[proxyId] = publisherId + "|" + streamType
+}
+
+func (c *mcuProxyConnection) removeCascadedPublisher(publisherId string, streamType string, proxyId string) {
+	c.publishersLock.Lock()
+	defer c.publishersLock.Unlock()
+
+	key := publisherId + "|" + streamType
+	if c.publisherIds[key] == proxyId {
+		delete(c.publisherIds, key)
+	}
+	delete(c.cascadedPublishers, proxyId)
+}
+
+func (c *mcuProxyConnection) getPublisherStreams(ctx context.Context, proxyId string) ([]PublisherStream, error) {
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type:     "get-publisher-streams",
+			ClientId: proxyId,
+		},
+	}
+
+	response, err := c.performSyncRequest(ctx, msg)
+	if err != nil {
+		return nil, err
+	} else if response.Type == "error" {
+		return nil, response.Error
+	}
+
+	return response.Command.Streams, nil
+}
+
+func (c *mcuProxyConnection) createRemotePublisher(ctx context.Context, publisherId string, streamType string, streams []PublisherStream) (*CommandProxyServerMessage, error) {
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type:        "create-remote-publisher",
+			PublisherId: publisherId,
+			StreamType:  streamType,
+			Streams:     streams,
+		},
+	}
+
+	response, err := c.performSyncRequest(ctx, msg)
+	if err != nil {
+		return nil, err
+	} else if response.Type == "error" {
+		return nil, response.Error
+	}
+
+	return response.Command, nil
+}
+
+func (c *mcuProxyConnection) publishRemote(ctx context.Context, proxyId string, remoteId string, hostname string, port int, rtcpPort int) error {
+	msg := &ProxyClientMessage{
+		Type: "command",
+		Command: &CommandProxyClientMessage{
+			Type:     "publish-remote",
+			ClientId: proxyId,
+			RemoteId: remoteId,
+			Hostname: hostname,
+			Port:     port,
+			RtcpPort: rtcpPort,
+		},
+	}
+
+	response, err := c.performSyncRequest(ctx, msg)
+	if err != nil {
+		return err
+	} else if response.Type == "error" {
+		return response.Error
+	}
+
+	return nil
+}
+
+// getCascadeEdge returns the connection to a proxy on one of the given
+// continents that is not the origin.
+func (m *mcuProxy) getCascadeEdge(origin *mcuProxyConnection, initiator McuInitiator, continents []string) *mcuProxyConnection {
+	for _, conn := range m.getSortedConnections(initiator) {
+		if conn == origin || conn.IsShutdownScheduled() {
+			continue
+		}
+
+		if country := conn.Country(); IsValidCountry(country) && ContinentsOverlap(continents, ContinentMap[country]) {
+			return conn
+		}
+	}
+	return nil
+}
+
+func (m *mcuProxy) countSubscribersOnContinents(conn *mcuProxyConnection, publisherId string, streamType string, continents []string) int {
+	count := 0
+	for _, subscriber := range conn.getSubscribersOf(publisherId, streamType) {
+		if ContinentsOverlap(continents, ContinentMap[subscriber.country]) {
+			count++
+		}
+	}
+	return count
+}
+
+// createCascade sends the publisher to a proxy on the given continents. The
+// cascade lock must be held.
+func (m *mcuProxy) createCascadeLocked(ctx context.Context, origin *mcuProxyConnection, initiator McuInitiator, publisherId string, streamType string, continents []string) (*mcuProxyCascade, error) {
+	edge := m.getCascadeEdge(origin, initiator, continents)
+	if edge == nil {
+		return nil, fmt.Errorf("no proxy available on %+v", continents)
+	}
+
+	origin.publishersLock.RLock()
+	originId, found := origin.publisherIds[publisherId+"|"+streamType]
+	origin.publishersLock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown publisher on %s", origin)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.proxyTimeout)
+	defer cancel()
+
+	streams, err := origin.getPublisherStreams(ctx, originId)
+	if err != nil {
+		return nil, fmt.Errorf("could not get streams from %s: %w", origin, err)
+	}
+
+	remote, err := edge.createRemotePublisher(ctx, publisherId, streamType, streams)
+	if err != nil {
+		return nil, fmt.Errorf("could not create remote publisher on %s: %w", edge, err)
+	}
+
+	if err := origin.publishRemote(ctx, originId, remote.Id, remote.Hostname, remote.Port, remote.RtcpPort); err != nil {
+		if edge.deleteClient("delete-publisher", remote.Id) {
+			log.Printf("Deleted remote publisher %s at %s", remote.Id, edge)
+		}
+		return nil, fmt.Errorf("could not publish to %s: %w", edge, err)
+	}
+
+	edge.addCascadedPublisher(publisherId, streamType, remote.Id)
+	return &mcuProxyCascade{
+		publisherId: publisherId,
+		streamType:  streamType,
+		continents:  continents,
+
+		origin:   origin,
+		originId: originId,
+		edge:     edge,
+		edgeId:   remote.Id,
+	}, nil
+}
+
+// getOrCreateCascade returns the cascade of a publisher to the given
+// continents. A new cascade is only created if enough subscribers of the
+// publisher are located on these continents.
+func (m *mcuProxy) getOrCreateCascade(ctx context.Context, origin *mcuProxyConnection, initiator McuInitiator, publisherId string, streamType string, continents []string, minSubscribers int) *mcuProxyCascade {
+	key := publisherId + "|" + streamType
+
+	m.cascadesMu.Lock()
+	defer m.cascadesMu.Unlock()
+
+	for _, cascade := range m.cascades[key] {
+		if cascade.origin == origin && ContinentsOverlap(continents, cascade.continents) {
+			return cascade
+		}
+	}
+
+	if failed, found := m.cascadesFailed[key]; found && time.Since(failed) < cascadeRetryInterval {
+		return nil
+	}
+
+	// The new subscriber also counts.
+	if m.countSubscribersOnContinents(origin, publisherId, streamType, continents)+1 < minSubscribers {
+		return nil
+	}
+
+	cascade, err := m.createCascadeLocked(ctx, origin, initiator, publisherId, streamType, continents)
+	if err != nil {
+		log.Printf("Could not cascade %s publisher %s from %s: %s", streamType, publisherId, origin, err)
+		m.cascadesFailed[key] = time.Now()
+		statsProxyCascadesTotal.WithLabelValues(streamType, "failed").Inc()
+		return nil
+	}
+
+	log.Printf("Cascading %s", cascade)
+	delete(m.cascadesFailed, key)
+	m.cascades[key] = append(m.cascades[key], cascade)
+	statsProxyCascadesTotal.WithLabelValues(streamType, "success").Inc()
+	return cascade
+}
+
+func (m *mcuProxy) removeCascade(cascade *mcuProxyCascade) {
+	key := cascade.publisherId + "|" + cascade.streamType
+
+	m.cascadesMu.Lock()
+	cascades := m.cascades[key]
+	for idx, c := range cascades {
+		if c == cascade {
+			cascades = append(cascades[:idx], cascades[idx+1:]...)
+			break
+		}
+	}
+	if len(cascades) > 0 {
+		m.cascades[key] = cascades
+	} else {
+		delete(m.cascades, key)
+	}
+	m.cascadesMu.Unlock()
+
+	go cascade.close()
+}
+
+// removeCascades stops sending the publisher to other proxies, e.g. because
+// it was closed or migrated.
+func (m *mcuProxy) removeCascades(publisherId string, streamType string) {
+	key := publisherId + "|" + streamType
+
+	m.cascadesMu.Lock()
+	cascades := m.cascades[key]
+	delete(m.cascades, key)
+	delete(m.cascadesFailed, key)
+	m.cascadesMu.Unlock()
+
+	for _, cascade := range cascades {
+		go cascade.close()
+	}
+}
+
+// newCascadedSubscriber creates the subscriber on a proxy close to it if
+// enough subscribers of the publisher are located on a different continent
+// than the proxy of the publisher. Returns nil if the subscriber should be
+// created on the proxy of the publisher.
+func (m *mcuProxy) newCascadedSubscriber(ctx context.Context, origin *mcuProxyConnection, listener McuListener, publisherId string, streamType string) McuSubscriber {
+	minSubscribers := int(atomic.LoadInt32(&m.cascadeSubscribers))
+	if minSubscribers <= 0 {
+		return nil
+	}
+
+	country := getMcuListenerCountry(listener)
+	if country == "" {
+		return nil
+	}
+
+	continents := ContinentMap[country]
+	if originCountry := origin.Country(); len(continents) == 0 || (IsValidCountry(originCountry) && ContinentsOverlap(continents, ContinentMap[originCountry])) {
+		// The publisher is already close to the subscriber.
+		return nil
+	}
+
+	initiator := listener.(McuInitiator)
+	cascade := m.getOrCreateCascade(ctx, origin, initiator, publisherId, streamType, continents, minSubscribers)
+	if cascade == nil {
+		return nil
+	}
+
+	subscriber, err := cascade.edge.newSubscriber(ctx, listener, publisherId, streamType)
+	if err != nil {
+		log.Printf("Could not create subscriber for cascaded %s: %s", cascade, err)
+		// Subscribers will be created on the origin until the cascade could be
+		// created again.
+		m.removeCascade(cascade)
+		return nil
+	}
+
+	return subscriber
+}
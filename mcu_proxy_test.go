@@ -22,7 +22,20 @@
 package signaling
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/gorilla/websocket"
 )
 
 func TestMcuProxyStats(t *testing.T) {
@@ -35,6 +48,36 @@ func newProxyConnectionWithCountry(country string) *mcuProxyConnection {
 	return conn
 }
 
+func Test_ProxyEtcdFilter(t *testing.T) {
+	config := goconf.NewConfigFile()
+	filter := newProxyEtcdFilter(config)
+	if !filter.Accepts(&ProxyInformationEtcd{Address: "https://proxy1/"}) {
+		t.Error("should accept all proxies without filters")
+	}
+
+	config.AddOption("mcu", "regions", "eu-central, eu-west")
+	config.AddOption("mcu", "versions", "1.1")
+	config.AddOption("mcu", "capacityclasses", "large")
+	filter = newProxyEtcdFilter(config)
+	testcases := []struct {
+		info     ProxyInformationEtcd
+		expected bool
+	}{
+		{ProxyInformationEtcd{Region: "eu-central", Version: "1.1", CapacityClass: "large"}, true},
+		{ProxyInformationEtcd{Region: "eu-west", Version: "1.1.3", CapacityClass: "large"}, true},
+		{ProxyInformationEtcd{Region: "us-east", Version: "1.1", CapacityClass: "large"}, false},
+		{ProxyInformationEtcd{Region: "eu-central", Version: "1.10", CapacityClass: "large"}, false},
+		{ProxyInformationEtcd{Region: "eu-central", Version: "1.0", CapacityClass: "large"}, false},
+		{ProxyInformationEtcd{Region: "eu-central", Version: "1.1", CapacityClass: "small"}, false},
+		{ProxyInformationEtcd{Version: "1.1", CapacityClass: "large"}, false},
+	}
+	for _, tc := range testcases {
+		if accepted := filter.Accepts(&tc.info); accepted != tc.expected {
+			t.Errorf("Expected %v for %+v, got %v", tc.expected, tc.info, accepted)
+		}
+	}
+}
+
 func Test_sortConnectionsForCountry(t *testing.T) {
 	conn_de := newProxyConnectionWithCountry("DE")
 	conn_at := newProxyConnectionWithCountry("AT")
@@ -166,3 +209,604 @@ func Test_sortConnectionsForCountryWithOverride(t *testing.T) {
 		})
 	}
 }
+
+type testProxyListener struct {
+	mu                    sync.Mutex
+	closedPublishers      []McuPublisher
+	closedSubscribers     []McuSubscriber
+	reconnectedPublishers []McuPublisher
+	updatedSubscribers    []McuSubscriber
+}
+
+func (l *testProxyListener) PublicId() string {
+	return "test-listener"
+}
+
+func (l *testProxyListener) OnUpdateOffer(client McuClient, offer map[string]interface{}) {
+}
+
+func (l *testProxyListener) OnIceCandidate(client McuClient, candidate interface{}) {
+}
+
+func (l *testProxyListener) OnIceCompleted(client McuClient) {
+}
+
+func (l *testProxyListener) SubscriberSidUpdated(subscriber McuSubscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.updatedSubscribers = append(l.updatedSubscribers, subscriber)
+}
+
+func (l *testProxyListener) PublisherReconnected(publisher McuPublisher) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reconnectedPublishers = append(l.reconnectedPublishers, publisher)
+}
+
+func (l *testProxyListener) PublisherClosed(publisher McuPublisher) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closedPublishers = append(l.closedPublishers, publisher)
+}
+
+func (l *testProxyListener) SubscriberClosed(subscriber McuSubscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closedSubscribers = append(l.closedSubscribers, subscriber)
+}
+
+func Test_ProxyConnectionReconcileClients(t *testing.T) {
+	proxy := &mcuProxy{
+		proxyTimeout: time.Second,
+		publishers:   make(map[string]*mcuProxyConnection),
+	}
+	conn := &mcuProxyConnection{
+		proxy:        proxy,
+		rawUrl:       "https://proxy.domain.invalid",
+		callbacks:    make(map[string]func(*ProxyServerMessage)),
+		publishers:   make(map[string]*mcuProxyPublisher),
+		publisherIds: make(map[string]string),
+		subscribers:  make(map[string]*mcuProxySubscriber),
+	}
+
+	listener := &testProxyListener{}
+	pub1 := newMcuProxyPublisher("session1", "sid1", streamTypeVideo, 0, MediaTypeAudio, "pub1", conn, listener)
+	pub2 := newMcuProxyPublisher("session2", "sid2", streamTypeVideo, 0, MediaTypeAudio, "pub2", conn, listener)
+	sub1 := newMcuProxySubscriber("session1", "sid3", streamTypeVideo, "sub1", conn, listener)
+	sub2 := newMcuProxySubscriber("session2", "sid4", streamTypeVideo, "sub2", conn, listener)
+	conn.publishers[pub1.proxyId] = pub1
+	conn.publishers[pub2.proxyId] = pub2
+	conn.subscribers[sub1.proxyId] = sub1
+	conn.subscribers[sub2.proxyId] = sub2
+
+	publishers := map[string]*mcuProxyPublisher{
+		pub1.proxyId: pub1,
+		pub2.proxyId: pub2,
+	}
+	subscribers := map[string]*mcuProxySubscriber{
+		sub1.proxyId: sub1,
+		sub2.proxyId: sub2,
+	}
+	conn.reconcileClients(publishers, subscribers, []string{"pub1", "pub3"}, []string{"sub2"})
+
+	if len(listener.closedPublishers) != 1 || listener.closedPublishers[0] != pub2 {
+		t.Errorf("Expected publisher %s to be closed, got %+v", pub2.proxyId, listener.closedPublishers)
+	}
+	if len(listener.closedSubscribers) != 1 || listener.closedSubscribers[0] != sub1 {
+		t.Errorf("Expected subscriber %s to be closed, got %+v", sub1.proxyId, listener.closedSubscribers)
+	}
+
+	if _, found := conn.publishers[pub1.proxyId]; !found {
+		t.Errorf("Publisher %s should still exist", pub1.proxyId)
+	}
+	if _, found := conn.publishers[pub2.proxyId]; found {
+		t.Errorf("Publisher %s should have been removed", pub2.proxyId)
+	}
+	if _, found := conn.subscribers[sub1.proxyId]; found {
+		t.Errorf("Subscriber %s should have been removed", sub1.proxyId)
+	}
+	if _, found := conn.subscribers[sub2.proxyId]; !found {
+		t.Errorf("Subscriber %s should still exist", sub2.proxyId)
+	}
+}
+
+type testProxyServer struct {
+	t    *testing.T
+	name string
+
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	nextId   int
+	commands []string
+}
+
+func (s *testProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	for {
+		var msg ProxyClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		response := &ProxyServerMessage{
+			Id:   msg.Id,
+			Type: msg.Type,
+		}
+		s.mu.Lock()
+		switch msg.Type {
+		case "hello":
+			response.Hello = &HelloProxyServerMessage{
+				Version:   "1.0",
+				SessionId: s.name + "-session",
+			}
+		case "command":
+			s.commands = append(s.commands, msg.Command.Type+":"+msg.Command.ClientId)
+			response.Command = &CommandProxyServerMessage{}
+			switch msg.Command.Type {
+			case "create-publisher":
+				s.nextId++
+				response.Command.Id = fmt.Sprintf("%s-pub-%d", s.name, s.nextId)
+			case "create-subscriber":
+				s.nextId++
+				response.Command.Id = fmt.Sprintf("%s-sub-%d", s.name, s.nextId)
+				response.Command.Sid = fmt.Sprintf("%s-sid-%d", s.name, s.nextId)
+			case "get-publisher-streams":
+				response.Command.Streams = []PublisherStream{
+					{
+						Type:   "video",
+						Mid:    "0",
+						Codec:  "vp8",
+						Mindex: 0,
+					},
+				}
+			case "create-remote-publisher":
+				s.nextId++
+				response.Command.Id = fmt.Sprintf("%s-remote-%d", s.name, s.nextId)
+				response.Command.Hostname = s.name + ".local"
+				response.Command.Port = 10000 + s.nextId
+			}
+		}
+		err := conn.WriteJSON(response)
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *testProxyServer) sendEvent(event *EventProxyServerMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.WriteJSON(&ProxyServerMessage{
+		Type:  "event",
+		Event: event,
+	})
+}
+
+func (s *testProxyServer) hasCommand(command string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestProxyConnection(ctx context.Context, t *testing.T, proxy *mcuProxy, name string) (*mcuProxyConnection, *testProxyServer) {
+	server := &testProxyServer{
+		t:    t,
+		name: name,
+	}
+	s := httptest.NewServer(server)
+	t.Cleanup(s.Close)
+
+	conn, err := newMcuProxyConnection(proxy, s.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		conn.stop(ctx)
+	})
+
+	waitForCondition(ctx, t, func() bool {
+		return atomic.LoadUint32(&conn.trackClose) == 1
+	})
+	return conn, server
+}
+
+func waitForCondition(ctx context.Context, t *testing.T, f func() bool) {
+	for !f() {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func Test_ProxyMigratePublishersOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &mcuProxy{
+		tokenId:          "test-token",
+		tokenKey:         key,
+		dialer:           &websocket.Dialer{},
+		proxyTimeout:     time.Second,
+		publishers:       make(map[string]*mcuProxyConnection),
+		publisherWaiters: make(map[uint64]chan bool),
+	}
+	conn1, server1 := newTestProxyConnection(ctx, t, proxy, "proxy1")
+	conn2, server2 := newTestProxyConnection(ctx, t, proxy, "proxy2")
+	proxy.connections = []*mcuProxyConnection{conn1, conn2}
+
+	listener := &testProxyListener{}
+	pub, err := conn1.newPublisher(ctx, listener, "session1", "sid1", streamTypeVideo, 1000, MediaTypeAudio|MediaTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.publishers["session1|"+streamTypeVideo] = conn1
+
+	sub, err := conn1.newSubscriber(ctx, listener, "session1", streamTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server1.sendEvent(&EventProxyServerMessage{
+		Type: "shutdown-scheduled",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The publisher is re-created on the other proxy and must renegotiate.
+	waitForCondition(ctx, t, func() bool {
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		return len(listener.reconnectedPublishers) == 1 && listener.reconnectedPublishers[0] == pub
+	})
+	if id := pub.Id(); id != "proxy2-pub-1" {
+		t.Errorf("Expected publisher on proxy2, got %s", id)
+	}
+	if conn := proxy.getPublisherConnection(ctx, "session1", streamTypeVideo); conn != conn2 {
+		t.Errorf("Expected publisher connection %s, got %s", conn2, conn)
+	}
+	if server1.hasCommand("delete-publisher:proxy1-pub-1") {
+		t.Error("Old publisher should not be deleted before the new one is connected")
+	}
+
+	if err := server2.sendEvent(&EventProxyServerMessage{
+		Type:     "ice-completed",
+		ClientId: pub.Id(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribers are moved once the new publisher is connected.
+	waitForCondition(ctx, t, func() bool {
+		listener.mu.Lock()
+		defer listener.mu.Unlock()
+		return len(listener.updatedSubscribers) == 1 && listener.updatedSubscribers[0] == sub
+	})
+	if id := sub.Id(); id != "proxy2-sub-2" {
+		t.Errorf("Expected subscriber on proxy2, got %s", id)
+	}
+	if sid := sub.Sid(); sid != "proxy2-sid-2" {
+		t.Errorf("Expected updated sid, got %s", sid)
+	}
+
+	waitForCondition(ctx, t, func() bool {
+		return server1.hasCommand("delete-subscriber:proxy1-sub-2") && server1.hasCommand("delete-publisher:proxy1-pub-1")
+	})
+
+	conn1.publishersLock.RLock()
+	if len(conn1.publishers) != 0 {
+		t.Errorf("Expected no publishers on %s, got %+v", conn1, conn1.publishers)
+	}
+	conn1.publishersLock.RUnlock()
+	conn1.subscribersLock.RLock()
+	if len(conn1.subscribers) != 0 {
+		t.Errorf("Expected no subscribers on %s, got %+v", conn1, conn1.subscribers)
+	}
+	conn1.subscribersLock.RUnlock()
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if len(listener.closedPublishers) != 0 || len(listener.closedSubscribers) != 0 {
+		t.Errorf("No clients should have been closed, got %+v / %+v", listener.closedPublishers, listener.closedSubscribers)
+	}
+}
+
+func Test_ProxyConnectionPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &mcuProxy{
+		tokenId:             "test-token",
+		tokenKey:            key,
+		dialer:              &websocket.Dialer{},
+		proxyTimeout:        time.Second,
+		connectionsMap:      make(map[string][]*mcuProxyConnection),
+		connectionsPerProxy: 2,
+		publishers:          make(map[string]*mcuProxyConnection),
+		publisherWaiters:    make(map[uint64]chan bool),
+	}
+
+	server := &testProxyServer{
+		t:    t,
+		name: "proxy1",
+	}
+	s := httptest.NewServer(server)
+	t.Cleanup(s.Close)
+
+	conns, err := proxy.newConnections(s.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(conns) != 2 {
+		t.Fatalf("Expected 2 connections, got %+v", conns)
+	}
+	for _, conn := range conns {
+		if err := conn.start(); err != nil {
+			t.Fatal(err)
+		}
+		conn := conn
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			conn.stop(ctx)
+		})
+
+		waitForCondition(ctx, t, conn.isConnected)
+	}
+	proxy.connections = conns
+	proxy.connectionsMap[s.URL+"/"] = conns
+
+	listener := &testProxyListener{}
+	for _, id := range []string{"session1", "session2"} {
+		if _, err := proxy.NewPublisher(ctx, listener, id, "sid-"+id, streamTypeVideo, 0, MediaTypeAudio|MediaTypeVideo, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Publishers are distributed between the connections of the pool.
+	conn1 := proxy.getPublisherConnection(ctx, "session1", streamTypeVideo)
+	conn2 := proxy.getPublisherConnection(ctx, "session2", streamTypeVideo)
+	if conn1 == nil || conn2 == nil || conn1 == conn2 {
+		t.Errorf("Expected publishers on different connections, got %s / %s", conn1, conn2)
+	}
+
+	// Subscribers are created on the connection of the publisher.
+	sub, err := proxy.NewSubscriber(ctx, listener, "session2", streamTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, _ := sub.(*mcuProxySubscriber).getConnection(); conn != conn2 {
+		t.Errorf("Expected subscriber on %s, got %s", conn2, conn)
+	}
+}
+
+type testProxyCountryListener struct {
+	testProxyListener
+
+	country string
+}
+
+func (l *testProxyCountryListener) Country() string {
+	return l.country
+}
+
+func Test_ProxyCascadePublisher(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &mcuProxy{
+		tokenId:            "test-token",
+		tokenKey:           key,
+		dialer:             &websocket.Dialer{},
+		proxyTimeout:       time.Second,
+		cascadeSubscribers: 2,
+		cascades:           make(map[string][]*mcuProxyCascade),
+		cascadesFailed:     make(map[string]time.Time),
+		publishers:         make(map[string]*mcuProxyConnection),
+		publisherWaiters:   make(map[uint64]chan bool),
+	}
+	conn1, server1 := newTestProxyConnection(ctx, t, proxy, "proxy1")
+	conn1.country.Store("DE")
+	conn2, server2 := newTestProxyConnection(ctx, t, proxy, "proxy2")
+	conn2.country.Store("US")
+	proxy.connections = []*mcuProxyConnection{conn1, conn2}
+
+	listener := &testProxyListener{}
+	pub, err := conn1.newPublisher(ctx, listener, "session1", "sid1", streamTypeVideo, 1000, MediaTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.publishers["session1|"+streamTypeVideo] = conn1
+
+	// Subscribers on the same continent as the publisher are never cascaded.
+	for i := 0; i < 3; i++ {
+		sub, err := proxy.NewSubscriber(ctx, &testProxyCountryListener{country: "FR"}, "session1", streamTypeVideo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := sub.Id(); !strings.HasPrefix(id, "proxy1-sub-") {
+			t.Errorf("Expected subscriber on proxy1, got %s", id)
+		}
+	}
+
+	sub1, err := proxy.NewSubscriber(ctx, &testProxyCountryListener{country: "US"}, "session1", streamTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := sub1.Id(); !strings.HasPrefix(id, "proxy1-sub-") {
+		t.Errorf("Expected first remote subscriber on proxy1, got %s", id)
+	}
+
+	// The second subscriber from the other continent reaches the threshold.
+	sub2, err := proxy.NewSubscriber(ctx, &testProxyCountryListener{country: "CA"}, "session1", streamTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := sub2.Id(); !strings.HasPrefix(id, "proxy2-sub-") {
+		t.Errorf("Expected cascaded subscriber on proxy2, got %s", id)
+	}
+	if !server1.hasCommand("get-publisher-streams:"+pub.Id()) || !server1.hasCommand("publish-remote:"+pub.Id()) {
+		t.Errorf("Expected publisher to be cascaded, got %+v", server1.commands)
+	}
+	if !server2.hasCommand("create-remote-publisher:") {
+		t.Errorf("Expected remote publisher to be created, got %+v", server2.commands)
+	}
+
+	// Further subscribers use the existing cascade.
+	sub3, err := proxy.NewSubscriber(ctx, &testProxyCountryListener{country: "US"}, "session1", streamTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := sub3.Id(); !strings.HasPrefix(id, "proxy2-sub-") {
+		t.Errorf("Expected cascaded subscriber on proxy2, got %s", id)
+	}
+
+	proxy.cascadesMu.Lock()
+	cascades := proxy.cascades["session1|"+streamTypeVideo]
+	proxy.cascadesMu.Unlock()
+	if len(cascades) != 1 {
+		t.Fatalf("Expected one cascade, got %+v", cascades)
+	}
+	remoteId := cascades[0].edgeId
+
+	proxy.removePublisher(pub.(*mcuProxyPublisher))
+	waitForCondition(ctx, t, func() bool {
+		return server1.hasCommand("unpublish-remote:"+pub.Id()) && server2.hasCommand("delete-publisher:"+remoteId)
+	})
+}
+
+func newProxyConnectionWithLoad(load int64, bandwidth *EventProxyServerBandwidth) *mcuProxyConnection {
+	conn := &mcuProxyConnection{
+		load: load,
+	}
+	conn.bandwidth.Store(bandwidth)
+	return conn
+}
+
+func checkProxyConnectionsOrder(t *testing.T, expected mcuProxyConnectionsList, connections mcuProxyConnectionsList) {
+	t.Helper()
+	for idx, conn := range connections {
+		if expected[idx] != conn {
+			t.Errorf("Index %d: expected load %d, got %d", idx, expected[idx].Load(), conn.Load())
+		}
+	}
+}
+
+func Test_ProxyConnectionsSortByBandwidth(t *testing.T) {
+	conn1 := newProxyConnectionWithLoad(1, &EventProxyServerBandwidth{Incoming: 3000, Outgoing: 1000})
+	conn2 := newProxyConnectionWithLoad(5, &EventProxyServerBandwidth{Incoming: 1000, Outgoing: 1000})
+	conn3 := newProxyConnectionWithLoad(3, &EventProxyServerBandwidth{Incoming: 500, Outgoing: 2000})
+	disconnected := newProxyConnectionWithLoad(loadNotConnected, nil)
+
+	connections := mcuProxyConnectionsList{disconnected, conn1, conn2, conn3}
+	connections.Sort()
+	checkProxyConnectionsOrder(t, mcuProxyConnectionsList{conn2, conn3, conn1, disconnected}, connections)
+
+	// Fall back to sorting by load if a connected proxy doesn't report its bandwidth.
+	conn4 := newProxyConnectionWithLoad(2, nil)
+	connections = mcuProxyConnectionsList{disconnected, conn1, conn2, conn3, conn4}
+	connections.Sort()
+	checkProxyConnectionsOrder(t, mcuProxyConnectionsList{conn1, conn4, conn3, conn2, disconnected}, connections)
+}
+
+func Test_ProxyRemotePublishers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := &mcuProxy{
+		tokenId:          "test-token",
+		tokenKey:         key,
+		dialer:           &websocket.Dialer{},
+		proxyTimeout:     time.Second,
+		publishers:       make(map[string]*mcuProxyConnection),
+		publisherWaiters: make(map[uint64]chan bool),
+	}
+	conn, server := newTestProxyConnection(ctx, t, proxy, "proxy1")
+	proxy.connections = []*mcuProxyConnection{conn}
+
+	// Subscribers wait until the remote publisher is announced by the proxy.
+	subscribed := make(chan McuSubscriber, 1)
+	go func() {
+		sub, err := proxy.NewSubscriber(ctx, &testProxyListener{}, "whip-session", streamTypeVideo)
+		if err != nil {
+			t.Error(err)
+		}
+		subscribed <- sub
+	}()
+
+	if err := server.sendEvent(&EventProxyServerMessage{
+		Type:        "remote-publisher-added",
+		ClientId:    "whip-client",
+		PublisherId: "whip-session",
+		StreamType:  streamTypeVideo,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case sub := <-subscribed:
+		if sub == nil {
+			t.Fatal("Subscriber should have been created")
+		} else if sub.Publisher() != "whip-session" {
+			t.Errorf("Expected subscriber for whip-session, got %s", sub.Publisher())
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	if err := server.sendEvent(&EventProxyServerMessage{
+		Type:        "remote-publisher-removed",
+		ClientId:    "whip-client",
+		PublisherId: "whip-session",
+		StreamType:  streamTypeVideo,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForCondition(ctx, t, func() bool {
+		proxy.mu.RLock()
+		defer proxy.mu.RUnlock()
+		return proxy.publishers["whip-session|"+streamTypeVideo] == nil
+	})
+}
@@ -98,26 +98,89 @@ var (
 		Name:      "backend_load",
 		Help:      "Current load of signaling proxy backends",
 	}, []string{"url"})
+	statsProxyBackendBandwidthCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "backend_bandwidth",
+		Help:      "Current bandwidth of signaling proxy backends in bits per second",
+	}, []string{"url", "direction"})
 	statsProxyNobackendAvailableTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "signaling",
 		Subsystem: "mcu",
 		Name:      "no_backend_available_total",
 		Help:      "Total number of publishing requests where no backend was available",
 	}, []string{"type"})
+	statsProxyMigratedPublishersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "migrated_publishers_total",
+		Help:      "Total number of publishers migrated from proxies that are shutting down",
+	}, []string{"type", "result"})
+	statsProxyCascadesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "cascades_total",
+		Help:      "Total number of publishers cascaded to proxies close to their subscribers",
+	}, []string{"type", "result"})
+
+	statsJanusBitrateCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "janus_bitrate",
+		Help:      "The current bitrate of all Janus handles in bits per second",
+	}, []string{"type", "direction"})
+	statsJanusLostPacketsCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "janus_lost_packets",
+		Help:      "The number of lost packets of all current Janus handles",
+	}, []string{"type"})
+	statsJanusNacksCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "janus_nacks",
+		Help:      "The number of NACKs of all current Janus handles",
+	}, []string{"type"})
+	statsJanusPlisCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "janus_plis",
+		Help:      "The number of PLIs of all current Janus handles",
+	}, []string{"type"})
+	statsJanusJitter = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "signaling",
+		Subsystem: "mcu",
+		Name:      "janus_jitter",
+		Help:      "The jitter of Janus handles in milliseconds",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"type"})
+
+	janusMcuStats = []prometheus.Collector{
+		statsJanusBitrateCurrent,
+		statsJanusLostPacketsCurrent,
+		statsJanusNacksCurrent,
+		statsJanusPlisCurrent,
+		statsJanusJitter,
+	}
 
 	proxyMcuStats = []prometheus.Collector{
 		statsConnectedProxyBackendsCurrent,
 		statsProxyBackendLoadCurrent,
+		statsProxyBackendBandwidthCurrent,
 		statsProxyNobackendAvailableTotal,
+		statsProxyMigratedPublishersTotal,
+		statsProxyCascadesTotal,
 	}
 )
 
 func RegisterJanusMcuStats() {
 	registerAll(commonMcuStats...)
+	registerAll(janusMcuStats...)
 }
 
 func UnregisterJanusMcuStats() {
 	unregisterAll(commonMcuStats...)
+	unregisterAll(janusMcuStats...)
 }
 
 func RegisterProxyMcuStats() {
@@ -25,6 +25,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -116,7 +117,24 @@ func (m *TestMCU) GetPublisher(id string) *TestMCUPublisher {
 }
 
 func (m *TestMCU) NewSubscriber(ctx context.Context, listener McuListener, publisher string, streamType string) (McuSubscriber, error) {
-	return nil, fmt.Errorf("Not implemented")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pub := m.publishers[publisher]
+	if pub == nil {
+		return nil, fmt.Errorf("Waiting for publisher not implemented yet")
+	}
+
+	sub := &TestMCUSubscriber{
+		TestMCUClient: TestMCUClient{
+			id:         pub.id,
+			sid:        pub.sid,
+			streamType: pub.streamType,
+		},
+
+		publisher: pub,
+	}
+	return sub, nil
 }
 
 type TestMCUClient struct {
@@ -153,6 +171,78 @@ type TestMCUPublisher struct {
 
 	mediaTypes MediaType
 	bitrate    int
+	maxBitrate int32
+	muted      int32
+
+	forwardMu     sync.Mutex
+	forwards      map[uint64]*RtpForwardStream
+	nextForwardId uint64
+}
+
+func (p *TestMCUPublisher) StartRtpForward(ctx context.Context, host string, audioPort int, videoPort int) ([]*RtpForwardStream, error) {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+
+	if p.forwards == nil {
+		p.forwards = make(map[uint64]*RtpForwardStream)
+	}
+	var result []*RtpForwardStream
+	for mediaType, port := range map[string]int{"audio": audioPort, "video": videoPort} {
+		if port == 0 {
+			continue
+		}
+
+		p.nextForwardId++
+		stream := &RtpForwardStream{
+			StreamId: p.nextForwardId,
+			Type:     mediaType,
+			Host:     host,
+			Port:     port,
+		}
+		p.forwards[stream.StreamId] = stream
+		result = append(result, stream)
+	}
+	return result, nil
+}
+
+func (p *TestMCUPublisher) StopRtpForward(ctx context.Context, streamId uint64) error {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+
+	if _, found := p.forwards[streamId]; !found {
+		return fmt.Errorf("Unknown stream %d", streamId)
+	}
+
+	delete(p.forwards, streamId)
+	return nil
+}
+
+func (p *TestMCUPublisher) getRtpForwards() int {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+	return len(p.forwards)
+}
+
+func (p *TestMCUPublisher) SetMaxBitrate(ctx context.Context, bitrate int) error {
+	atomic.StoreInt32(&p.maxBitrate, int32(bitrate))
+	return nil
+}
+
+func (p *TestMCUPublisher) getMaxBitrate() int {
+	return int(atomic.LoadInt32(&p.maxBitrate))
+}
+
+func (p *TestMCUPublisher) Mute(ctx context.Context, mediaTypes MediaType) error {
+	for {
+		muted := atomic.LoadInt32(&p.muted)
+		if atomic.CompareAndSwapInt32(&p.muted, muted, muted|int32(mediaTypes)) {
+			return nil
+		}
+	}
+}
+
+func (p *TestMCUPublisher) isMuted(mt MediaType) bool {
+	return MediaType(atomic.LoadInt32(&p.muted))&mt == mt
 }
 
 func (p *TestMCUPublisher) HasMedia(mt MediaType) bool {
@@ -186,6 +276,13 @@ func (p *TestMCUPublisher) SendMessage(ctx context.Context, message *MessageClie
 						"sdp":  MockSdpAnswerAudioAndVideo,
 					})
 					return
+				} else if strings.Contains(sdp, "\r\ns=selftest\r\n") {
+					// Offer sent by the self test.
+					callback(nil, map[string]interface{}{
+						"type": "answer",
+						"sdp":  MockSdpAnswerAudioAndVideo,
+					})
+					return
 				}
 			}
 			callback(fmt.Errorf("Offer payload %+v is not implemented", data.Payload), nil)
@@ -194,3 +291,54 @@ func (p *TestMCUPublisher) SendMessage(ctx context.Context, message *MessageClie
 		}
 	}()
 }
+
+type TestMCUSubscriber struct {
+	TestMCUClient
+
+	publisher *TestMCUPublisher
+	paused    int32
+}
+
+func (s *TestMCUSubscriber) SetPaused(ctx context.Context, paused bool) error {
+	if s.isClosed() {
+		return fmt.Errorf("Already closed")
+	}
+
+	if paused {
+		atomic.StoreInt32(&s.paused, 1)
+	} else {
+		atomic.StoreInt32(&s.paused, 0)
+	}
+	return nil
+}
+
+func (s *TestMCUSubscriber) isPaused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+func (s *TestMCUSubscriber) Publisher() string {
+	return s.publisher.id
+}
+
+func (s *TestMCUSubscriber) SendMessage(ctx context.Context, message *MessageClientMessage, data *MessageClientMessageData, callback func(error, map[string]interface{})) {
+	go func() {
+		if s.isClosed() {
+			callback(fmt.Errorf("Already closed"), nil)
+			return
+		}
+
+		switch data.Type {
+		case "requestoffer":
+			fallthrough
+		case "sendoffer":
+			callback(nil, map[string]interface{}{
+				"type": "offer",
+				"sdp":  MockSdpOfferAudioAndVideo,
+			})
+		case "answer":
+			callback(nil, nil)
+		default:
+			callback(fmt.Errorf("Message type %s is not implemented", data.Type), nil)
+		}
+	}()
+}
@@ -0,0 +1,178 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+)
+
+type additionalRoom struct {
+	room          *Room
+	roomSessionId string
+	subject       string
+	subscription  NatsSubscription
+}
+
+func (r *additionalRoom) unsubscribe(session *ClientSession) {
+	if err := r.subscription.Unsubscribe(); err != nil {
+		log.Printf("Error closing additional room %s subscription in session %s: %s", r.room.Id(), session.PublicId(), err)
+	}
+}
+
+func (h *Hub) processAdditionalRoom(ctx context.Context, client *Client, message *ClientMessage) {
+	session := client.GetSession()
+	if session == nil {
+		return
+	}
+
+	if !h.allowMultiRoom {
+		response := message.NewErrorServerMessage(NewError("not_supported", "Joining multiple rooms is not supported."))
+		session.SendMessage(response)
+		return
+	}
+
+	roomId := message.Room.RoomId
+	if message.Room.Leave {
+		if session.LeaveAdditionalRoom(roomId, true) != nil {
+			h.sendAdditionalRoom(session, message, roomId, nil)
+		}
+		return
+	}
+
+	if room := session.GetRoom(); room != nil && room.Id() == roomId {
+		response := message.NewErrorServerMessage(NewError("already_joined", "The room has already been joined."))
+		session.SendMessage(response)
+		return
+	} else if session.IsInAdditionalRoom(roomId) {
+		// Session already is in that room, no action needed.
+		return
+	}
+
+	var room BackendClientResponse
+	if session.ClientType() == HelloClientTypeInternal {
+		// Internal clients can join any room.
+		room = BackendClientResponse{
+			Type: "room",
+			Room: &BackendClientRoomResponse{
+				RoomId: roomId,
+			},
+		}
+	} else {
+		// Run in timeout context to prevent blocking too long.
+		ctx, cancel := context.WithTimeout(ctx, h.backendTimeout)
+		defer cancel()
+
+		sessionId := message.Room.SessionId
+		if sessionId == "" {
+			log.Printf("User did not send a room session id for additional room, assuming session %s", session.PublicId())
+			sessionId = session.PublicId()
+		}
+		request := NewBackendClientRoomRequest(roomId, session.UserId(), sessionId)
+		if err := h.backend.PerformJSONRequest(ctx, session.ParsedBackendUrl(), request, &room); err != nil {
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+	}
+
+	h.processJoinAdditionalRoom(session, message, &room)
+}
+
+func (h *Hub) processJoinAdditionalRoom(session *ClientSession, message *ClientMessage, room *BackendClientResponse) {
+	if room.Type == "error" {
+		session.SendMessage(message.NewErrorServerMessage(room.Error))
+		return
+	} else if room.Type != "room" {
+		session.SendMessage(message.NewErrorServerMessage(RoomJoinFailed))
+		return
+	}
+
+	roomId := room.Room.RoomId
+	internalRoomId := getRoomIdForBackend(roomId, session.Backend())
+
+	h.ru.Lock()
+	r, found := h.rooms[internalRoomId]
+	if !found {
+		var err error
+		if r, err = h.createRoom(roomId, room.Room.Properties, session.Backend()); err != nil {
+			h.ru.Unlock()
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+	}
+	h.ru.Unlock()
+
+	roomSessionId := message.Room.SessionId
+	if session.ClientType() != HelloClientTypeInternal && roomSessionId == "" {
+		roomSessionId = session.PublicId()
+	}
+	if err := session.JoinAdditionalRoom(h.nats, r, roomSessionId); err != nil {
+		session.SendMessage(message.NewWrappedErrorServerMessage(err))
+		if !found {
+			r.Close()
+		}
+		return
+	}
+
+	r.AddObserver(session, roomSessionId)
+	h.sendAdditionalRoom(session, message, roomId, r)
+
+	// Observers receive the current participants of the room, further
+	// changes are sent as regular events.
+	if sessions := r.GetSessions(); len(sessions) > 0 {
+		events := make([]*EventServerMessageSessionEntry, 0, len(sessions))
+		for _, s := range sessions {
+			events = append(events, newEventServerMessageSessionEntry(s))
+		}
+		session.SendMessage(&ServerMessage{
+			Type:   "event",
+			RoomId: roomId,
+			Event: &EventServerMessage{
+				Target: "room",
+				Type:   "join",
+				Join:   events,
+			},
+		})
+	}
+}
+
+func (h *Hub) sendAdditionalRoom(session *ClientSession, message *ClientMessage, roomId string, room *Room) bool {
+	response := &ServerMessage{
+		Type:   "room",
+		RoomId: roomId,
+	}
+	if message != nil {
+		response.Id = message.Id
+	}
+	if room == nil {
+		response.Room = &RoomServerMessage{
+			RoomId: "",
+		}
+	} else {
+		response.Room = &RoomServerMessage{
+			RoomId:      room.id,
+			Properties:  room.properties,
+			AudioBridge: room.UsesAudioBridge(),
+		}
+	}
+	return session.SendMessage(response)
+}
@@ -0,0 +1,217 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func getTestConfigWithMultiRoom(server *httptest.Server) (*goconf.ConfigFile, error) {
+	config, err := getTestConfig(server)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AddOption("app", "multiroom", "true")
+	return config, nil
+}
+
+func joinAdditionalRoom(client *TestClient, roomId string, leave bool) error {
+	return client.WriteJSON(&ClientMessage{
+		Id:   "EFGH",
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId:     roomId,
+			SessionId:  roomId + "-" + client.publicId,
+			Additional: true,
+			Leave:      leave,
+		},
+	})
+}
+
+func Test_MultiRoomDisabled(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := joinAdditionalRoom(client, "test-room", false); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_supported"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_MultiRoom(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, getTestConfigWithMultiRoom)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, f := range hello1.Hello.Server.Features {
+		if f == ServerFeatureMultiRoom {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureMultiRoom, hello1.Hello.Server.Features)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId1 := "test-room1"
+	if room, err := client1.JoinRoom(ctx, roomId1); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId1 {
+		t.Fatalf("Expected room %s, got %s", roomId1, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId2 := "test-room2"
+	if room, err := client2.JoinRoom(ctx, roomId2); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId2 {
+		t.Fatalf("Expected room %s, got %s", roomId2, room.Room.RoomId)
+	}
+	if err := client2.RunUntilJoined(ctx, hello2.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := joinAdditionalRoom(client1, roomId2, false); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, roomId2); err != nil {
+		t.Fatal(err)
+	} else if msg.RoomId != roomId2 {
+		t.Errorf("Expected message for room %s, got %+v", roomId2, msg)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if msg.RoomId != roomId2 {
+		t.Errorf("Expected message for room %s, got %+v", roomId2, msg)
+	} else if err := client1.checkMessageJoined(msg, hello2.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary room of the session is not changed.
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if room := session1.GetRoom(); room == nil || room.Id() != roomId1 {
+		t.Errorf("Expected session in room %s, got %+v", roomId1, room)
+	}
+
+	// Messages sent to the additional room are received with its id.
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+	data := "from-room2"
+	if err := client2.SendMessage(recipient, data); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "message"); err != nil {
+		t.Fatal(err)
+	} else if msg.RoomId != roomId2 {
+		t.Errorf("Expected message for room %s, got %+v", roomId2, msg)
+	}
+
+	// Messages of the primary room don't contain a room id.
+	if _, err := client2.JoinRoom(ctx, roomId1); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := client1.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Event != nil && msg.Event.Type == "leave" {
+			// The session left the additional room.
+			if msg.RoomId != roomId2 {
+				t.Errorf("Expected message for room %s, got %+v", roomId2, msg)
+			}
+			continue
+		}
+
+		if err := client1.checkMessageJoined(msg, hello2.Hello); err != nil {
+			t.Fatal(err)
+		} else if msg.RoomId != "" {
+			t.Errorf("Expected message without room id, got %+v", msg)
+		}
+		break
+	}
+
+	if err := joinAdditionalRoom(client1, roomId2, true); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, ""); err != nil {
+		t.Fatal(err)
+	} else if msg.RoomId != roomId2 {
+		t.Errorf("Expected message for room %s, got %+v", roomId2, msg)
+	}
+
+	if session1.IsInAdditionalRoom(roomId2) {
+		t.Errorf("Session should have left room %s", roomId2)
+	}
+}
@@ -27,8 +27,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
+	"github.com/mailru/easyjson/jlexer"
 	"github.com/nats-io/nats.go"
 )
 
@@ -47,10 +49,57 @@ type NatsMessage struct {
 	Room *BackendServerRoomRequest `json:"room,omitempty"`
 
 	Permissions []Permission `json:"permissions,omitempty"`
+	// Participant permissions bitmap, replaces only the permissions that are
+	// defined by the bitmap.
+	PermissionsBitmap *int `json:"permissionsbitmap,omitempty"`
+
+	// Id of the backend of the room for room keys, they are only delivered to
+	// sessions in a room of the same backend.
+	Backend string `json:"backend,omitempty"`
+
+	Reaction *NatsReactionMessage `json:"reaction,omitempty"`
 
 	Id string `json:"id"`
 }
 
+// NatsReactionMessage contains a change to the raised hands or an emoji
+// reaction in a room, so all servers with sessions in the room can notify
+// their local sessions.
+type NatsReactionMessage struct {
+	Type string `json:"type"`
+
+	SessionId string `json:"sessionid,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	Emoji string `json:"emoji,omitempty"`
+}
+
+// getRawNatsServerMessage returns the serialized "message" of an encoded
+// NatsMessage without copying it, so it can be sent to clients without
+// serializing it again. Returns nil if the data doesn't contain a message.
+func getRawNatsServerMessage(data []byte) []byte {
+	in := jlexer.Lexer{Data: data}
+	in.Delim('{')
+	for !in.IsDelim('}') && in.Ok() {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if key == "message" {
+			if in.IsNull() {
+				return nil
+			}
+
+			raw := in.Raw()
+			if !in.Ok() {
+				return nil
+			}
+			return raw
+		}
+		in.SkipRecursive()
+		in.WantComma()
+	}
+	return nil
+}
+
 type NatsSubscription interface {
 	Unsubscribe() error
 }
@@ -58,6 +107,10 @@ type NatsSubscription interface {
 type NatsClient interface {
 	Close()
 
+	// Reload connects to the given url if it differs from the current one.
+	// Existing subscriptions are moved to the new connection.
+	Reload(url string)
+
 	Subscribe(subject string, ch chan *nats.Msg) (NatsSubscription, error)
 
 	Publish(subject string, message interface{}) error
@@ -75,9 +128,27 @@ func GetEncodedSubject(prefix string, suffix string) string {
 	return prefix + "." + base64.StdEncoding.EncodeToString([]byte(suffix))
 }
 
+//easyjson:skip
 type natsClient struct {
+	mu   sync.RWMutex
+	url  string
 	nc   *nats.Conn
 	conn *nats.EncodedConn
+
+	subscriptions map[*natsSubscription]bool
+}
+
+//easyjson:skip
+type natsSubscription struct {
+	client  *natsClient
+	subject string
+	ch      chan *nats.Msg
+
+	sub *nats.Subscription
+}
+
+func (s *natsSubscription) Unsubscribe() error {
+	return s.client.unsubscribe(s)
 }
 
 func NewNatsClient(url string) (NatsClient, error) {
@@ -86,13 +157,13 @@ func NewNatsClient(url string) (NatsClient, error) {
 		return NewLoopbackNatsClient()
 	}
 
-	client := &natsClient{}
+	client := &natsClient{
+		url:           url,
+		subscriptions: make(map[*natsSubscription]bool),
+	}
 
 	var err error
-	client.nc, err = nats.Connect(url,
-		nats.ClosedHandler(client.onClosed),
-		nats.DisconnectHandler(client.onDisconnected),
-		nats.ReconnectHandler(client.onReconnected))
+	client.nc, err = client.connect(url)
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
@@ -115,7 +186,7 @@ func NewNatsClient(url string) (NatsClient, error) {
 			}
 		}
 
-		client.nc, err = nats.Connect(url)
+		client.nc, err = client.connect(url)
 	}
 	log.Printf("Connection established to %s (%s)", client.nc.ConnectedUrl(), client.nc.ConnectedServerId())
 
@@ -124,10 +195,62 @@ func NewNatsClient(url string) (NatsClient, error) {
 	return client, nil
 }
 
+func (c *natsClient) connect(url string) (*nats.Conn, error) {
+	return nats.Connect(url,
+		nats.ClosedHandler(c.onClosed),
+		nats.DisconnectHandler(c.onDisconnected),
+		nats.ReconnectHandler(c.onReconnected))
+}
+
 func (c *natsClient) Close() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	c.conn.Close()
 }
 
+func (c *natsClient) Reload(url string) {
+	if url == ":loopback:" {
+		log.Printf("Switching from NATS server to internal loopback client requires a restart")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if url == c.url {
+		return
+	}
+
+	nc, err := c.connect(url)
+	if err != nil {
+		log.Printf("Could not connect to NATS server at %s, keeping previous connection: %s", url, err)
+		return
+	}
+
+	// Subscribe on the new connection before closing the old one, so no
+	// messages are missed while switching.
+	subs := make(map[*natsSubscription]*nats.Subscription, len(c.subscriptions))
+	for s := range c.subscriptions {
+		sub, err := nc.ChanSubscribe(s.subject, s.ch)
+		if err != nil {
+			log.Printf("Could not subscribe to %s on NATS server at %s, keeping previous connection: %s", s.subject, url, err)
+			nc.Close()
+			return
+		}
+		subs[s] = sub
+	}
+
+	log.Printf("Connection established to %s (%s)", nc.ConnectedUrl(), nc.ConnectedServerId())
+	conn, _ := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
+	old := c.conn
+	c.url = url
+	c.nc = nc
+	c.conn = conn
+	for s, sub := range subs {
+		s.sub = sub
+	}
+	old.Close()
+}
+
 func (c *natsClient) onClosed(conn *nats.Conn) {
 	log.Println("NATS client closed", conn.LastError())
 }
@@ -141,10 +264,35 @@ func (c *natsClient) onReconnected(conn *nats.Conn) {
 }
 
 func (c *natsClient) Subscribe(subject string, ch chan *nats.Msg) (NatsSubscription, error) {
-	return c.nc.ChanSubscribe(subject, ch)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sub, err := c.nc.ChanSubscribe(subject, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &natsSubscription{
+		client:  c,
+		subject: subject,
+		ch:      ch,
+		sub:     sub,
+	}
+	c.subscriptions[s] = true
+	return s, nil
+}
+
+func (c *natsClient) unsubscribe(s *natsSubscription) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.subscriptions, s)
+	return s.sub.Unsubscribe()
 }
 
 func (c *natsClient) Publish(subject string, message interface{}) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.conn.Publish(subject, message)
 }
 
@@ -171,5 +319,7 @@ func (c *natsClient) PublishBackendServerRoomRequest(subject string, message *Ba
 }
 
 func (c *natsClient) Decode(msg *nats.Msg, v interface{}) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.conn.Enc.Decode(msg.Subject, msg.Data, v)
 }
@@ -97,6 +97,12 @@ func (c *LoopbackNatsClient) Close() {
 	c.wakeup.Signal()
 }
 
+func (c *LoopbackNatsClient) Reload(url string) {
+	if url != ":loopback:" {
+		log.Printf("Switching from internal loopback client to NATS server at %s requires a restart", url)
+	}
+}
+
 type loopbackNatsSubscription struct {
 	subject string
 	client  *LoopbackNatsClient
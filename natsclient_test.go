@@ -22,6 +22,7 @@
 package signaling
 
 import (
+	"encoding/json"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -166,3 +167,81 @@ func TestNatsClient_BadSubjects(t *testing.T) {
 		testNatsClient_BadSubjects(t, client)
 	})
 }
+
+func TestNatsClient_Reload(t *testing.T) {
+	url1 := startLocalNatsServer(t)
+	url2 := startLocalNatsServer(t)
+	client, err := NewNatsClient(url1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dest := make(chan *nats.Msg, 1)
+	sub, err := client.Subscribe("foo", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe() // nolint
+
+	client.Reload(url2)
+	if connected := client.(*natsClient).nc.ConnectedUrl(); connected != url2 {
+		t.Errorf("Expected connection to %s, got %s", url2, connected)
+	}
+
+	if err := client.Publish("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-dest:
+		var s string
+		if err := client.Decode(msg, &s); err != nil {
+			t.Fatal(err)
+		} else if s != "bar" {
+			t.Errorf("Expected bar, got %s", s)
+		}
+	case <-time.After(time.Second):
+		t.Error("Message was not received after reload")
+	}
+}
+
+func TestGetRawNatsServerMessage(t *testing.T) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "join",
+		},
+	}
+	expected, err := message.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(&NatsMessage{
+		SendTime: time.Now(),
+		Type:     "message",
+		Message:  message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw := getRawNatsServerMessage(data); string(raw) != string(expected) {
+		t.Errorf("Expected %s, got %s", string(expected), string(raw))
+	}
+
+	for _, data := range []string{
+		"",
+		"invalid",
+		"{}",
+		"{\"type\":\"room\"}",
+		"{\"type\":\"message\",\"message\":null}",
+		"{\"type\":\"message\",\"message\":{\"type\":",
+	} {
+		if raw := getRawNatsServerMessage([]byte(data)); raw != nil {
+			t.Errorf("Expected no message for %s, got %s", data, string(raw))
+		}
+	}
+}
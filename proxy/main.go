@@ -22,10 +22,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -36,6 +36,8 @@ import (
 
 	"github.com/dlintw/goconf"
 	"github.com/gorilla/mux"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
 )
 
 var (
@@ -44,6 +46,10 @@ var (
 	configFlag = flag.String("config", "proxy.conf", "config file to use")
 
 	showVersion = flag.Bool("version", false, "show version and quit")
+
+	checkConfig = flag.Bool("check-config", false, "validate the configuration and quit")
+
+	probe = flag.Bool("probe", false, "also check connectivity to etcd with -check-config")
 )
 
 const (
@@ -53,6 +59,60 @@ const (
 	proxyDebugMessages = false
 )
 
+func checkProxyConfig(ctx context.Context, config *goconf.ConfigFile, probe bool) *signaling.ConfigCheckReport {
+	report := &signaling.ConfigCheckReport{}
+	report.Check("tokens", func() error {
+		tokenType, _ := config.GetString("app", "tokentype")
+		if tokenType == "" {
+			tokenType = TokenTypeDefault
+		}
+
+		switch tokenType {
+		case TokenTypeStatic:
+			tokens, err := NewProxyTokensStatic(config)
+			if err != nil {
+				return err
+			}
+			tokens.Close()
+			return nil
+		case TokenTypeEtcd:
+			return signaling.CheckEtcdConfig(ctx, config, "tokens", probe)
+		default:
+			return fmt.Errorf("Unsupported token type configured: %s", tokenType)
+		}
+	})
+	report.Check("registration", func() error {
+		if key, _ := config.GetString("registration", "key"); key == "" {
+			return nil
+		}
+
+		if address, _ := config.GetString("registration", "address"); address == "" {
+			return fmt.Errorf("No address configured for the proxy registration")
+		}
+		return signaling.CheckEtcdConfig(ctx, config, "registration", probe)
+	})
+	report.Check("country", func() error {
+		country, _ := config.GetString("app", "country")
+		if country != "" && !signaling.IsValidCountry(strings.ToUpper(country)) {
+			return fmt.Errorf("Invalid country: %s", country)
+		}
+		return nil
+	})
+	report.Check("mcu", func() error {
+		if mcuUrl, _ := config.GetString("mcu", "url"); mcuUrl == "" {
+			return fmt.Errorf("No MCU server url configured")
+		}
+
+		switch mcuType, _ := config.GetString("mcu", "type"); mcuType {
+		case "", signaling.McuTypeJanus:
+			return nil
+		default:
+			return fmt.Errorf("Unsupported MCU type: %s", mcuType)
+		}
+	})
+	return report
+}
+
 func main() {
 	log.SetFlags(log.Lshortfile)
 	flag.Parse()
@@ -62,6 +122,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *checkConfig {
+		config, err := signaling.LoadConfig(*configFlag)
+		if err != nil {
+			log.Fatal("Could not read configuration: ", err)
+		}
+
+		report := checkProxyConfig(context.Background(), config, *probe)
+		report.Print(os.Stdout)
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	signal.Notify(sigChan, syscall.SIGHUP)
@@ -69,7 +143,7 @@ func main() {
 
 	log.Printf("Starting up version %s/%s as pid %d", version, runtime.Version(), os.Getpid())
 
-	config, err := goconf.ReadConfigFile(*configFlag)
+	config, err := signaling.LoadConfig(*configFlag)
 	if err != nil {
 		log.Fatal("Could not read configuration: ", err)
 	}
@@ -78,6 +152,13 @@ func main() {
 	runtime.GOMAXPROCS(cpus)
 	log.Printf("Using a maximum of %d CPUs", cpus)
 
+	tracing, err := signaling.NewTracing(config, "nextcloud-spreed-signaling-proxy", version)
+	if err != nil {
+		log.Fatal("Could not initialize tracing: ", err)
+	} else if tracing != nil {
+		defer tracing.Close()
+	}
+
 	r := mux.NewRouter()
 
 	proxy, err := NewProxyServer(r, version, config)
@@ -103,7 +184,7 @@ func main() {
 		for _, address := range strings.Split(addr, " ") {
 			go func(address string) {
 				log.Println("Listening on", address)
-				listener, err := net.Listen("tcp", address)
+				listener, err := signaling.Listen(address)
 				if err != nil {
 					log.Fatal("Could not start listening: ", err)
 				}
@@ -131,7 +212,7 @@ loop:
 				break loop
 			case syscall.SIGHUP:
 				log.Printf("Received SIGHUP, reloading %s", *configFlag)
-				if config, err := goconf.ReadConfigFile(*configFlag); err != nil {
+				if config, err := signaling.LoadConfig(*configFlag); err != nil {
 					log.Printf("Could not read configuration from %s: %s", *configFlag, err)
 				} else {
 					proxy.Reload(config)
@@ -141,7 +222,7 @@ loop:
 				proxy.ScheduleShutdown()
 			}
 		case <-proxy.ShutdownChannel():
-			log.Printf("All clients disconnected, shutting down")
+			log.Printf("Draining finished, shutting down")
 			break loop
 		}
 	}
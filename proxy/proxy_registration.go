@@ -0,0 +1,172 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dlintw/goconf"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
+)
+
+const (
+	defaultRegistrationTtl = 30
+
+	registrationRetryInterval = time.Second
+	registrationRemoveTimeout = time.Second
+)
+
+// ProxyRegistration publishes the address and deployment metadata of the
+// proxy in etcd, so signaling servers using the "etcd" url type can find it.
+// The entry is bound to a lease and removed when the proxy stops.
+type ProxyRegistration struct {
+	client *signaling.EtcdClient
+	key    string
+	value  string
+	ttl    int64
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewProxyRegistration creates the registration configured in the section
+// "registration" and returns nil if no key is configured.
+func NewProxyRegistration(config *goconf.ConfigFile, version string) (*ProxyRegistration, error) {
+	key, _ := config.GetString("registration", "key")
+	if key == "" {
+		return nil, nil
+	}
+
+	info := &signaling.ProxyInformationEtcd{
+		Version: version,
+	}
+	info.Address, _ = config.GetString("registration", "address")
+	info.Region, _ = config.GetString("registration", "region")
+	info.CapacityClass, _ = config.GetString("registration", "capacityclass")
+	if v, _ := config.GetString("registration", "version"); v != "" {
+		info.Version = v
+	}
+	if err := info.CheckValid(); err != nil {
+		return nil, fmt.Errorf("Invalid proxy registration: %w", err)
+	}
+
+	value, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, _ := config.GetInt("registration", "ttl")
+	if ttl <= 0 {
+		ttl = defaultRegistrationTtl
+	}
+
+	client, err := signaling.NewEtcdClient(config, "registration")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &ProxyRegistration{
+		client: client,
+		key:    key,
+		value:  string(value),
+		ttl:    int64(ttl),
+
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	go result.run()
+	return result, nil
+}
+
+func (r *ProxyRegistration) run() {
+	defer close(r.stopped)
+
+	for {
+		if err := r.register(); err != nil {
+			log.Printf("Could not register proxy in etcd key %s, retry in %s: %s", r.key, registrationRetryInterval, err)
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(registrationRetryInterval):
+		}
+	}
+}
+
+// register stores the proxy information with a new lease and keeps it alive
+// until the registration is closed or the lease could not be refreshed.
+func (r *ProxyRegistration) register() error {
+	if err := r.client.WaitForConnection(r.ctx); err != nil {
+		return err
+	}
+
+	lease, err := r.client.Grant(r.ctx, r.ttl)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.client.Put(r.ctx, r.key, r.value, clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+
+	ch, err := r.client.KeepAlive(r.ctx, lease.ID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Registered proxy in etcd key %s: %s", r.key, r.value)
+	for range ch { // nolint
+		// Drain responses until the lease expires or the context is cancelled.
+	}
+
+	if r.ctx.Err() != nil {
+		return nil
+	}
+
+	return fmt.Errorf("lease %x expired", lease.ID)
+}
+
+// Close removes the proxy from etcd, so no new clients are sent to it.
+func (r *ProxyRegistration) Close() {
+	r.cancel()
+	<-r.stopped
+
+	ctx, cancel := context.WithTimeout(context.Background(), registrationRemoveTimeout)
+	defer cancel()
+	if _, err := r.client.Delete(ctx, r.key); err != nil {
+		log.Printf("Could not remove proxy from etcd key %s: %s", r.key, err)
+	}
+	if err := r.client.Close(); err != nil {
+		log.Printf("Error closing etcd client for proxy registration: %s", err)
+	}
+}
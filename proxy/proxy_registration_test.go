@@ -0,0 +1,103 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"go.etcd.io/etcd/server/v3/mvcc"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
+)
+
+func getRegistrationForTest(t *testing.T, kv mvcc.KV, key string) *signaling.ProxyInformationEtcd {
+	result, err := kv.Range(context.Background(), []byte(key), nil, mvcc.RangeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(result.KVs) == 0 {
+		return nil
+	}
+
+	var info signaling.ProxyInformationEtcd
+	if err := json.Unmarshal(result.KVs[0].Value, &info); err != nil {
+		t.Fatal(err)
+	}
+	return &info
+}
+
+func TestProxyRegistration(t *testing.T) {
+	etcd := newEtcdForTesting(t)
+
+	config := goconf.NewConfigFile()
+	if registration, err := NewProxyRegistration(config, "1.2.3"); err != nil {
+		t.Error(err)
+	} else if registration != nil {
+		t.Errorf("expected no registration, got %+v", registration)
+	}
+
+	config.AddOption("registration", "key", "/proxies/proxy1")
+	config.AddOption("registration", "endpoints", etcd.Config().LCUrls[0].String())
+	if _, err := NewProxyRegistration(config, "1.2.3"); err == nil {
+		t.Error("should have failed without address")
+	}
+
+	config.AddOption("registration", "address", "https://proxy1.domain.invalid")
+	config.AddOption("registration", "region", "eu-central")
+	config.AddOption("registration", "capacityclass", "large")
+	registration, err := NewProxyRegistration(config, "1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kv := etcd.Server.KV()
+	var info *signaling.ProxyInformationEtcd
+	for info == nil {
+		select {
+		case <-ctx.Done():
+			t.Fatal("proxy was not registered")
+		case <-time.After(10 * time.Millisecond):
+		}
+		info = getRegistrationForTest(t, kv, "/proxies/proxy1")
+	}
+
+	expected := &signaling.ProxyInformationEtcd{
+		Address:       "https://proxy1.domain.invalid/",
+		Region:        "eu-central",
+		Version:       "1.2.3",
+		CapacityClass: "large",
+	}
+	if *info != *expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+
+	registration.Close()
+	if info := getRegistrationForTest(t, kv, "/proxies/proxy1"); info != nil {
+		t.Errorf("registration should have been removed, got %+v", info)
+	}
+}
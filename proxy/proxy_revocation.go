@@ -0,0 +1,329 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/dlintw/goconf"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	RevocationTypeEtcd = "etcd"
+	RevocationTypeHttp = "http"
+
+	defaultRevocationInterval = time.Minute
+
+	revocationRequestTimeout = 10 * time.Second
+	revocationRetryInterval  = time.Second
+)
+
+// TokenRevocationList is the JSON document containing the issuers (i.e. token
+// key ids) and token ids ("jti" claim) that may no longer be used.
+type TokenRevocationList struct {
+	Issuers []string `json:"issuers,omitempty"`
+	Tokens  []string `json:"tokens,omitempty"`
+}
+
+type ProxyTokenRevocations interface {
+	IsRevoked(issuer string, id string) bool
+
+	Close()
+}
+
+type revokedTokens struct {
+	issuers map[string]bool
+	tokens  map[string]bool
+}
+
+// revocationList stores the current list of revoked tokens and notifies
+// about changes.
+type revocationList struct {
+	revoked   atomic.Value
+	onChanged func()
+}
+
+func (l *revocationList) init(onChanged func()) {
+	l.revoked.Store(&revokedTokens{})
+	l.onChanged = onChanged
+}
+
+func (l *revocationList) IsRevoked(issuer string, id string) bool {
+	revoked := l.revoked.Load().(*revokedTokens)
+	if revoked.issuers[issuer] {
+		return true
+	}
+
+	return id != "" && revoked.tokens[id]
+}
+
+func (l *revocationList) update(data []byte) error {
+	var list TokenRevocationList
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+
+	revoked := &revokedTokens{
+		issuers: make(map[string]bool),
+		tokens:  make(map[string]bool),
+	}
+	for _, issuer := range list.Issuers {
+		revoked.issuers[issuer] = true
+	}
+	for _, id := range list.Tokens {
+		revoked.tokens[id] = true
+	}
+
+	l.revoked.Store(revoked)
+	log.Printf("Revoked %d issuers and %d tokens", len(revoked.issuers), len(revoked.tokens))
+	if l.onChanged != nil {
+		l.onChanged()
+	}
+	return nil
+}
+
+// NewProxyTokenRevocations creates the revocation list configured in the
+// section "revocation" and returns nil if no list is configured. The function
+// "onChanged" is called whenever the list was updated.
+func NewProxyTokenRevocations(config *goconf.ConfigFile, tokens ProxyTokens, onChanged func()) (ProxyTokenRevocations, error) {
+	revocationType, _ := config.GetString("revocation", "type")
+	switch revocationType {
+	case "":
+		return nil, nil
+	case RevocationTypeHttp:
+		return newRevocationsHttp(config, onChanged)
+	case RevocationTypeEtcd:
+		etcdTokens, ok := tokens.(*tokensEtcd)
+		if !ok {
+			return nil, fmt.Errorf("Revocation type %s requires token type %s", RevocationTypeEtcd, TokenTypeEtcd)
+		}
+
+		return newRevocationsEtcd(config, etcdTokens.getClient, onChanged)
+	default:
+		return nil, fmt.Errorf("Unsupported revocation type configured: %s", revocationType)
+	}
+}
+
+// revocationsHttp periodically polls the revocation list from a HTTP endpoint.
+// The ETag of the last response is used to avoid processing unchanged lists.
+type revocationsHttp struct {
+	revocationList
+
+	url      string
+	interval time.Duration
+	client   http.Client
+	etag     string
+
+	closeChan chan bool
+}
+
+func newRevocationsHttp(config *goconf.ConfigFile, onChanged func()) (*revocationsHttp, error) {
+	url, _ := config.GetString("revocation", "url")
+	if url == "" {
+		return nil, fmt.Errorf("No revocation url configured")
+	}
+
+	interval := defaultRevocationInterval
+	if seconds, _ := config.GetInt("revocation", "interval"); seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	result := &revocationsHttp{
+		url:      url,
+		interval: interval,
+		client: http.Client{
+			Timeout: revocationRequestTimeout,
+		},
+
+		closeChan: make(chan bool, 1),
+	}
+	result.init(onChanged)
+	if err := result.fetch(); err != nil {
+		// Don't fail startup if the endpoint is temporarily unavailable.
+		log.Printf("Could not get revocation list from %s: %s", url, err)
+	}
+	go result.run()
+	log.Printf("Polling revocation list from %s every %s", url, interval)
+	return result, nil
+}
+
+func (r *revocationsHttp) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.fetch(); err != nil {
+				log.Printf("Could not get revocation list from %s: %s", r.url, err)
+			}
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+func (r *revocationsHttp) fetch() error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+		// Process list below.
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := r.update(body); err != nil {
+		return err
+	}
+
+	r.etag = resp.Header.Get("ETag")
+	return nil
+}
+
+func (r *revocationsHttp) Close() {
+	select {
+	case r.closeChan <- true:
+	default:
+	}
+}
+
+// revocationsEtcd watches a key in the etcd cluster that is also used to
+// retrieve the token keys.
+type revocationsEtcd struct {
+	revocationList
+
+	key       string
+	getClient func() *clientv3.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newRevocationsEtcd(config *goconf.ConfigFile, getClient func() *clientv3.Client, onChanged func()) (*revocationsEtcd, error) {
+	key, _ := config.GetString("revocation", "key")
+	if key == "" {
+		return nil, fmt.Errorf("No revocation key configured")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &revocationsEtcd{
+		key:       key,
+		getClient: getClient,
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	result.init(onChanged)
+	go result.run()
+	log.Printf("Watching revocation list in etcd key %s", key)
+	return result, nil
+}
+
+func (r *revocationsEtcd) run() {
+	for {
+		if client := r.getClient(); client != nil {
+			if err := r.watch(client); err != nil {
+				log.Printf("Error watching revocation list in %s: %s", r.key, err)
+			}
+		}
+
+		// The client has been closed (e.g. after the configuration was
+		// reloaded) or an error occurred, retry with the current client.
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(revocationRetryInterval):
+		}
+	}
+}
+
+func (r *revocationsEtcd) watch(client *clientv3.Client) error {
+	ctx, cancel := context.WithTimeout(r.ctx, revocationRequestTimeout)
+	resp, err := client.Get(ctx, r.key)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	if len(resp.Kvs) > 0 {
+		value = resp.Kvs[len(resp.Kvs)-1].Value
+	}
+	if err := r.update(value); err != nil {
+		log.Printf("Could not parse revocation list in %s: %s", r.key, err)
+	}
+
+	ch := client.Watch(r.ctx, r.key, clientv3.WithRev(resp.Header.Revision+1))
+	for response := range ch {
+		if err := response.Err(); err != nil {
+			return err
+		}
+
+		for _, ev := range response.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				err = r.update(ev.Kv.Value)
+			case clientv3.EventTypeDelete:
+				err = r.update(nil)
+			}
+			if err != nil {
+				log.Printf("Could not parse revocation list in %s: %s", r.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *revocationsEtcd) Close() {
+	r.cancel()
+}
@@ -0,0 +1,236 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/golang-jwt/jwt"
+	"go.etcd.io/etcd/server/v3/lease"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
+)
+
+func waitForRevoked(t *testing.T, revocations ProxyTokenRevocations, issuer string, id string, expected bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for revocations.IsRevoked(issuer, id) != expected {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("token %s of %s should have revoked=%v", id, issuer, expected)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestProxyTokenRevocationsHttp(t *testing.T) {
+	var body atomic.Value
+	body.Store(`{"issuers":["server1"],"tokens":["token1"]}`)
+	var notModified uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := body.Load().(string)
+		etag := "\"" + data + "\""
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddUint32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(data)) // nolint
+	}))
+	defer server.Close()
+
+	config := goconf.NewConfigFile()
+	config.AddOption("revocation", "type", RevocationTypeHttp)
+	config.AddOption("revocation", "url", server.URL)
+	config.AddOption("revocation", "interval", "1")
+
+	var changed uint32
+	revocations, err := NewProxyTokenRevocations(config, nil, func() {
+		atomic.AddUint32(&changed, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer revocations.Close()
+
+	if !revocations.IsRevoked("server1", "") {
+		t.Error("issuer server1 should be revoked")
+	}
+	if !revocations.IsRevoked("server2", "token1") {
+		t.Error("token1 should be revoked")
+	}
+	if revocations.IsRevoked("server2", "token2") {
+		t.Error("token2 should not be revoked")
+	}
+	if revocations.IsRevoked("server2", "") {
+		t.Error("tokens without id should not be revoked")
+	}
+
+	// Wait for the unchanged list to be polled again.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for atomic.LoadUint32(&notModified) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("list was not polled with ETag")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if c := atomic.LoadUint32(&changed); c != 1 {
+		t.Errorf("expected one change notification, got %d", c)
+	}
+
+	body.Store(`{"tokens":["token2"]}`)
+	waitForRevoked(t, revocations, "server2", "token2", true)
+	if revocations.IsRevoked("server1", "token1") {
+		t.Error("server1 / token1 should no longer be revoked")
+	}
+}
+
+func TestProxyTokenRevocationsConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if revocations, err := NewProxyTokenRevocations(config, nil, nil); err != nil {
+		t.Error(err)
+	} else if revocations != nil {
+		t.Errorf("expected no revocations, got %+v", revocations)
+	}
+
+	config.AddOption("revocation", "type", RevocationTypeHttp)
+	if _, err := NewProxyTokenRevocations(config, nil, nil); err == nil {
+		t.Error("should have failed without url")
+	}
+
+	config.AddOption("revocation", "type", RevocationTypeEtcd)
+	config.AddOption("revocation", "key", "/revoked")
+	if _, err := NewProxyTokenRevocations(config, nil, nil); err == nil {
+		t.Error("should have failed without etcd tokens")
+	}
+
+	config.AddOption("revocation", "type", "unknown")
+	if _, err := NewProxyTokenRevocations(config, nil, nil); err == nil {
+		t.Error("should have failed for unknown type")
+	}
+}
+
+func TestProxyTokenRevocationsEtcd(t *testing.T) {
+	tokens, etcd := newTokensEtcdForTesting(t)
+
+	config := goconf.NewConfigFile()
+	config.AddOption("revocation", "type", RevocationTypeEtcd)
+	config.AddOption("revocation", "key", "/revoked")
+
+	revocations, err := NewProxyTokenRevocations(config, tokens, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer revocations.Close()
+
+	if revocations.IsRevoked("server1", "token1") {
+		t.Error("should not be revoked without list")
+	}
+
+	kv := etcd.Server.KV()
+	kv.Put([]byte("/revoked"), []byte(`{"issuers":["server1"]}`), lease.NoLease)
+	kv.Commit()
+	waitForRevoked(t, revocations, "server1", "", true)
+
+	kv.DeleteRange([]byte("/revoked"), nil)
+	kv.Commit()
+	waitForRevoked(t, revocations, "server1", "", false)
+}
+
+func TestProxyTokenRevokedSession(t *testing.T) {
+	server, key := newProxyServerForTest(t)
+
+	list := &revocationsStaticForTest{}
+	list.init(server.closeRevokedClients)
+	server.revocationsLock.Lock()
+	server.revocations = list
+	server.revocationsLock.Unlock()
+
+	newHello := func(id string) *signaling.HelloProxyClientMessage {
+		claims := &signaling.TokenClaims{
+			StandardClaims: jwt.StandardClaims{
+				Id:       id,
+				IssuedAt: time.Now().Unix(),
+				Issuer:   TokenIdForTest,
+			},
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("could not create token: %s", err)
+		}
+
+		return &signaling.HelloProxyClientMessage{
+			Version: "1.0",
+			Token:   tokenString,
+		}
+	}
+
+	session, err := server.NewSession(newHello("token1"), "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := list.update([]byte(`{"tokens":["token1"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if s := server.GetSession(session.Sid()); s != nil {
+		t.Errorf("session with revoked token should have been removed")
+	}
+
+	if session, err := server.NewSession(newHello("token1"), "127.0.0.1"); err != TokenRevoked {
+		if session != nil {
+			defer session.Close()
+		}
+		t.Errorf("expected TokenRevoked, got %v", err)
+	}
+
+	if err := list.update([]byte(`{"issuers":["` + TokenIdForTest + `"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if session, err := server.NewSession(newHello("token2"), "127.0.0.1"); err != TokenRevoked {
+		if session != nil {
+			defer session.Close()
+		}
+		t.Errorf("expected TokenRevoked, got %v", err)
+	}
+}
+
+type revocationsStaticForTest struct {
+	revocationList
+}
+
+func (r *revocationsStaticForTest) Close() {
+}
@@ -57,11 +57,15 @@ const (
 	initialMcuRetry = time.Second
 	maxMcuRetry     = time.Second * 16
 
-	updateLoadInterval     = time.Second
-	expireSessionsInterval = 10 * time.Second
+	updateLoadInterval      = time.Second
+	updateBandwidthInterval = 5 * time.Second
+	expireSessionsInterval  = 10 * time.Second
 
 	// Maximum age a token may have to prevent reuse of old tokens.
 	maxTokenAge = 5 * time.Minute
+
+	// Default number of commands per session that are processed concurrently.
+	defaultMaxConcurrentRequests = 16
 )
 
 type ContextKey string
@@ -72,12 +76,15 @@ var (
 	TimeoutCreatingPublisher  = signaling.NewError("timeout", "Timeout creating publisher.")
 	TimeoutCreatingSubscriber = signaling.NewError("timeout", "Timeout creating subscriber.")
 	TokenAuthFailed           = signaling.NewError("auth_failed", "The token could not be authenticated.")
+	TokenAddressNotAllowed    = signaling.NewError("address_not_allowed", "The token may not be used from this address.")
 	TokenExpired              = signaling.NewError("token_expired", "The token is expired.")
+	TokenRevoked              = signaling.NewError("token_revoked", "The token has been revoked.")
 	TokenNotValidYet          = signaling.NewError("token_not_valid_yet", "The token is not valid yet.")
 	UnknownClient             = signaling.NewError("unknown_client", "Unknown client id given.")
 	UnsupportedCommand        = signaling.NewError("bad_request", "Unsupported command received.")
 	UnsupportedMessage        = signaling.NewError("bad_request", "Unsupported message received.")
 	UnsupportedPayload        = signaling.NewError("unsupported_payload", "Unsupported payload type.")
+	CascadingNotSupported     = signaling.NewError("cascading_not_supported", "Cascading publishers is not supported.")
 	ShutdownScheduled         = signaling.NewError("shutdown_scheduled", "The server is scheduled to shutdown.")
 )
 
@@ -85,21 +92,34 @@ type ProxyServer struct {
 	// 64-bit members that are accessed atomically must be 64-bit aligned.
 	load int64
 
+	bandwidth         atomic.Value
+	updatingBandwidth uint32
+
 	version string
 	country string
 
+	maxConcurrentRequests int
+
 	url     string
 	mcu     signaling.Mcu
 	stopped uint32
 
 	shutdownChannel   chan bool
 	shutdownScheduled uint32
+	drainTimeout      time.Duration
+	drainDeadline     atomic.Value
 
 	upgrader websocket.Upgrader
 
 	tokens          ProxyTokens
 	statsAllowedIps map[string]bool
 
+	revocations     ProxyTokenRevocations
+	revocationsLock sync.RWMutex
+
+	registration     *ProxyRegistration
+	registrationLock sync.Mutex
+
 	sid          uint64
 	cookie       *securecookie.SecureCookie
 	sessions     map[uint64]*ProxySession
@@ -108,6 +128,14 @@ type ProxyServer struct {
 	clients     map[string]signaling.McuClient
 	clientIds   map[string]string
 	clientsLock sync.RWMutex
+
+	// Maps "publisherId|streamType" of the signaling server to the id of the
+	// publisher on the proxy (and vice versa).
+	publisherIds  map[string]string
+	publisherKeys map[string]string
+
+	remoteClients     map[string]*RemoteClient
+	remoteClientsLock sync.RWMutex
 }
 
 func NewProxyServer(r *mux.Router, version string, config *goconf.ConfigFile) (*ProxyServer, error) {
@@ -168,11 +196,26 @@ func NewProxyServer(r *mux.Router, version string, config *goconf.ConfigFile) (*
 		log.Printf("Not sending country information")
 	}
 
+	drainTimeoutSeconds, _ := config.GetInt("app", "draintimeout")
+	if drainTimeoutSeconds < 0 {
+		drainTimeoutSeconds = 0
+	}
+	drainTimeout := time.Duration(drainTimeoutSeconds) * time.Second
+
+	maxConcurrentRequests, _ := config.GetInt("app", "maxconcurrentrequests")
+	if maxConcurrentRequests <= 0 {
+		maxConcurrentRequests = defaultMaxConcurrentRequests
+	}
+	log.Printf("Processing up to %d concurrent requests per session", maxConcurrentRequests)
+
 	result := &ProxyServer{
 		version: version,
 		country: country,
 
+		maxConcurrentRequests: maxConcurrentRequests,
+
 		shutdownChannel: make(chan bool, 1),
+		drainTimeout:    drainTimeout,
 
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  websocketReadBufferSize,
@@ -187,8 +230,19 @@ func NewProxyServer(r *mux.Router, version string, config *goconf.ConfigFile) (*
 
 		clients:   make(map[string]signaling.McuClient),
 		clientIds: make(map[string]string),
+
+		publisherIds:  make(map[string]string),
+		publisherKeys: make(map[string]string),
+
+		remoteClients: make(map[string]*RemoteClient),
 	}
 
+	result.bandwidth.Store((*signaling.EventProxyServerBandwidth)(nil))
+	result.drainDeadline.Store(time.Time{})
+	if result.revocations, err = NewProxyTokenRevocations(config, tokens, result.closeRevokedClients); err != nil {
+		tokens.Close()
+		return nil, err
+	}
 	result.upgrader.CheckOrigin = result.checkOrigin
 
 	if debug, _ := config.GetBool("app", "debug"); debug {
@@ -205,6 +259,7 @@ func NewProxyServer(r *mux.Router, version string, config *goconf.ConfigFile) (*
 	}
 
 	r.HandleFunc("/proxy", result.setCommonHeaders(result.proxyHandler)).Methods("GET")
+	result.registerRemoteHandlers(r)
 	r.HandleFunc("/stats", result.setCommonHeaders(result.validateStatsRequest(result.statsHandler))).Methods("GET")
 	r.HandleFunc("/metrics", result.setCommonHeaders(result.validateStatsRequest(result.metricsHandler))).Methods("GET")
 	return result, nil
@@ -235,13 +290,12 @@ func (s *ProxyServer) Start(config *goconf.ConfigFile) error {
 	mcuRetry := initialMcuRetry
 	mcuRetryTimer := time.NewTimer(mcuRetry)
 	for {
-		switch mcuType {
-		case signaling.McuTypeJanus:
-			mcu, err = signaling.NewMcuJanus(s.url, config)
-			if err == nil {
-				signaling.RegisterJanusMcuStats()
-			}
-		default:
+		if mcuType == signaling.McuTypeProxy {
+			return fmt.Errorf("Unsupported MCU type: %s", mcuType)
+		}
+
+		mcu, err = signaling.NewMcu(mcuType, s.url, config)
+		if err == signaling.ErrUnsupportedMcuType {
 			return fmt.Errorf("Unsupported MCU type: %s", mcuType)
 		}
 		if err == nil {
@@ -272,13 +326,36 @@ func (s *ProxyServer) Start(config *goconf.ConfigFile) error {
 
 	s.mcu = mcu
 
+	// Only publish the proxy once the MCU is available.
+	registration, err := NewProxyRegistration(config, s.version)
+	if err != nil {
+		return err
+	}
+	s.registrationLock.Lock()
+	s.registration = registration
+	s.registrationLock.Unlock()
+
 	go s.run()
 
 	return nil
 }
 
+// closeRegistration removes the proxy from etcd, so signaling servers no
+// longer use it for new clients.
+func (s *ProxyServer) closeRegistration() {
+	s.registrationLock.Lock()
+	registration := s.registration
+	s.registration = nil
+	s.registrationLock.Unlock()
+
+	if registration != nil {
+		registration.Close()
+	}
+}
+
 func (s *ProxyServer) run() {
 	updateLoadTicker := time.NewTicker(updateLoadInterval)
+	updateBandwidthTicker := time.NewTicker(updateBandwidthInterval)
 	expireSessionsTicker := time.NewTicker(expireSessionsInterval)
 loop:
 	for {
@@ -288,6 +365,16 @@ loop:
 				break loop
 			}
 			s.updateLoad()
+		case <-updateBandwidthTicker.C:
+			if atomic.LoadUint32(&s.stopped) != 0 {
+				break loop
+			}
+			if atomic.CompareAndSwapUint32(&s.updatingBandwidth, 0, 1) {
+				go func() {
+					defer atomic.StoreUint32(&s.updatingBandwidth, 0)
+					s.updateBandwidth()
+				}()
+			}
 		case <-expireSessionsTicker.C:
 			if atomic.LoadUint32(&s.stopped) != 0 {
 				break loop
@@ -301,24 +388,93 @@ func (s *ProxyServer) updateLoad() {
 	// TODO: Take maximum bandwidth of clients into account when calculating
 	// load (screensharing requires more than regular audio/video).
 	load := s.GetClientCount()
+	if atomic.LoadUint32(&s.shutdownScheduled) != 0 {
+		s.updateDrainStats(load)
+	}
 	if load == atomic.LoadInt64(&s.load) {
 		return
 	}
 
 	atomic.StoreInt64(&s.load, load)
-	if atomic.LoadUint32(&s.shutdownScheduled) != 0 {
-		// Server is scheduled to shutdown, no need to update clients with current load.
+	s.sendLoadToSessions()
+}
+
+func (s *ProxyServer) getBandwidth() *signaling.EventProxyServerBandwidth {
+	return s.bandwidth.Load().(*signaling.EventProxyServerBandwidth)
+}
+
+// measureBandwidth returns the bandwidth of all clients that support reporting
+// it, or nil if the bandwidth of no client is known.
+func (s *ProxyServer) measureBandwidth(ctx context.Context) *signaling.EventProxyServerBandwidth {
+	s.clientsLock.RLock()
+	clients := make([]signaling.McuClientWithBandwidth, 0, len(s.clients))
+	for _, client := range s.clients {
+		if c, ok := client.(signaling.McuClientWithBandwidth); ok {
+			clients = append(clients, c)
+		}
+	}
+	s.clientsLock.RUnlock()
+
+	var result *signaling.EventProxyServerBandwidth
+	for _, client := range clients {
+		bandwidth, err := client.Bandwidth(ctx)
+		if err != nil {
+			log.Printf("Could not get bandwidth of %+v: %s", client, err)
+			continue
+		} else if bandwidth == nil {
+			continue
+		}
+
+		if result == nil {
+			result = &signaling.EventProxyServerBandwidth{}
+		}
+		result.Incoming += bandwidth.Received
+		result.Outgoing += bandwidth.Sent
+	}
+	return result
+}
+
+func (s *ProxyServer) updateBandwidth() {
+	ctx, cancel := context.WithTimeout(context.Background(), updateBandwidthInterval)
+	defer cancel()
+
+	bandwidth := s.measureBandwidth(ctx)
+	if bandwidth != nil {
+		statsBandwidthCurrent.WithLabelValues("incoming").Set(float64(bandwidth.Incoming))
+		statsBandwidthCurrent.WithLabelValues("outgoing").Set(float64(bandwidth.Outgoing))
+	} else {
+		statsBandwidthCurrent.Reset()
+	}
+
+	previous := s.getBandwidth()
+	s.bandwidth.Store(bandwidth)
+	if previous == nil && bandwidth == nil {
+		return
+	} else if previous != nil && bandwidth != nil && *previous == *bandwidth {
 		return
 	}
 
-	msg := &signaling.ProxyServerMessage{
+	s.sendLoadToSessions()
+}
+
+func (s *ProxyServer) newLoadMessage() *signaling.ProxyServerMessage {
+	return &signaling.ProxyServerMessage{
 		Type: "event",
 		Event: &signaling.EventProxyServerMessage{
-			Type: "update-load",
-			Load: load,
+			Type:      "update-load",
+			Load:      atomic.LoadInt64(&s.load),
+			Bandwidth: s.getBandwidth(),
 		},
 	}
+}
 
+func (s *ProxyServer) sendLoadToSessions() {
+	if atomic.LoadUint32(&s.shutdownScheduled) != 0 {
+		// Server is scheduled to shutdown, no need to update clients with current load.
+		return
+	}
+
+	msg := s.newLoadMessage()
 	s.IterateSessions(func(session *ProxySession) {
 		session.sendMessage(msg)
 	})
@@ -358,9 +514,16 @@ func (s *ProxyServer) Stop() {
 		return
 	}
 
+	s.closeRegistration()
 	if s.mcu != nil {
 		s.mcu.Stop()
 	}
+	s.revocationsLock.Lock()
+	if s.revocations != nil {
+		s.revocations.Close()
+		s.revocations = nil
+	}
+	s.revocationsLock.Unlock()
 	s.tokens.Close()
 }
 
@@ -368,30 +531,133 @@ func (s *ProxyServer) ShutdownChannel() chan bool {
 	return s.shutdownChannel
 }
 
+// notifyShutdown signals that the server can shutdown now.
+func (s *ProxyServer) notifyShutdown() {
+	select {
+	case s.shutdownChannel <- true:
+	default:
+		// Shutdown has already been signaled.
+	}
+}
+
+// ScheduleShutdown stops accepting new publishers and notifies the connected
+// signaling servers so they can move their clients to other proxies. The
+// server shuts down once all clients are gone or the drain timeout expired.
 func (s *ProxyServer) ScheduleShutdown() {
 	if !atomic.CompareAndSwapUint32(&s.shutdownScheduled, 0, 1) {
 		return
 	}
 
+	if s.drainTimeout > 0 {
+		s.drainDeadline.Store(time.Now().Add(s.drainTimeout))
+		log.Printf("Waiting up to %s for clients to disconnect", s.drainTimeout)
+	}
+
+	s.closeRegistration()
+
+	clients := s.GetClientCount()
+	statsDrainingCurrent.Set(1)
+	s.updateDrainStats(clients)
+
+	msg := s.newShutdownScheduledMessage()
+	s.IterateSessions(func(session *ProxySession) {
+		session.sendMessage(msg)
+	})
+
+	if clients == 0 {
+		s.notifyShutdown()
+	} else if s.drainTimeout > 0 {
+		time.AfterFunc(s.drainTimeout, func() {
+			log.Printf("Drain timeout of %s expired with %d clients remaining", s.drainTimeout, s.GetClientCount())
+			s.notifyShutdown()
+		})
+	}
+}
+
+// getDrainRemaining returns the time until the drain timeout expires or zero
+// if no timeout is configured.
+func (s *ProxyServer) getDrainRemaining() time.Duration {
+	deadline := s.drainDeadline.Load().(time.Time)
+	if deadline.IsZero() {
+		return 0
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+func (s *ProxyServer) updateDrainStats(clients int64) {
+	statsDrainClientsCurrent.Set(float64(clients))
+	statsDrainRemainingSeconds.Set(s.getDrainRemaining().Seconds())
+}
+
+func (s *ProxyServer) newShutdownScheduledMessage() *signaling.ProxyServerMessage {
 	msg := &signaling.ProxyServerMessage{
 		Type: "event",
 		Event: &signaling.EventProxyServerMessage{
 			Type: "shutdown-scheduled",
 		},
 	}
-	s.IterateSessions(func(session *ProxySession) {
-		session.sendMessage(msg)
-	})
-
-	if s.GetClientCount() == 0 {
-		go func() {
-			s.shutdownChannel <- true
-		}()
+	if remaining := s.getDrainRemaining(); remaining > 0 {
+		// Round up so clients don't expect the shutdown too early.
+		msg.Event.DrainTimeout = int64((remaining + time.Second - 1) / time.Second)
 	}
+	return msg
 }
 
 func (s *ProxyServer) Reload(config *goconf.ConfigFile) {
 	s.tokens.Reload(config)
+
+	revocations, err := NewProxyTokenRevocations(config, s.tokens, s.closeRevokedClients)
+	if err != nil {
+		log.Printf("Could not reload token revocations, keeping current: %s", err)
+		return
+	}
+
+	s.revocationsLock.Lock()
+	prev := s.revocations
+	s.revocations = revocations
+	s.revocationsLock.Unlock()
+	if prev != nil {
+		prev.Close()
+	}
+	s.closeRevokedClients()
+}
+
+func (s *ProxyServer) isTokenRevoked(issuer string, id string) bool {
+	s.revocationsLock.RLock()
+	defer s.revocationsLock.RUnlock()
+	return s.revocations != nil && s.revocations.IsRevoked(issuer, id)
+}
+
+// closeRevokedClients closes all sessions and remote clients that were created
+// with a token that has been revoked.
+func (s *ProxyServer) closeRevokedClients() {
+	var revoked []*ProxySession
+	s.IterateSessions(func(session *ProxySession) {
+		if issuer, id := session.Token(); s.isTokenRevoked(issuer, id) {
+			revoked = append(revoked, session)
+		}
+	})
+
+	for _, session := range revoked {
+		log.Printf("Closing session %s with revoked token", session.PublicId())
+		if client := session.SetClient(nil); client != nil {
+			client.SendMessage(&signaling.ProxyServerMessage{
+				Type: "bye",
+				Bye: &signaling.ByeProxyServerMessage{
+					Reason: "token_revoked",
+				},
+			})
+			client.Close()
+		}
+		s.DeleteSession(session.Sid())
+	}
+
+	s.closeRevokedRemoteClients()
 }
 
 func (s *ProxyServer) setCommonHeaders(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -483,32 +749,32 @@ func (s *ProxyServer) onMcuDisconnected() {
 			Type: "backend-disconnected",
 		},
 	}
+	// Clients that support renegotiation keep their publishers and
+	// subscribers, they will be re-created once the MCU is reconnected.
+	interruptedMsg := &signaling.ProxyServerMessage{
+		Type: "event",
+		Event: &signaling.EventProxyServerMessage{
+			Type: "backend-interrupted",
+		},
+	}
 
 	s.IterateSessions(func(session *ProxySession) {
+		if session.HasFeature(signaling.ProxyFeatureRenegotiate) {
+			session.sendMessage(interruptedMsg)
+			return
+		}
+
 		session.sendMessage(msg)
 		session.NotifyDisconnected()
 	})
 }
 
 func (s *ProxyServer) sendCurrentLoad(session *ProxySession) {
-	msg := &signaling.ProxyServerMessage{
-		Type: "event",
-		Event: &signaling.EventProxyServerMessage{
-			Type: "update-load",
-			Load: atomic.LoadInt64(&s.load),
-		},
-	}
-	session.sendMessage(msg)
+	session.sendMessage(s.newLoadMessage())
 }
 
 func (s *ProxyServer) sendShutdownScheduled(session *ProxySession) {
-	msg := &signaling.ProxyServerMessage{
-		Type: "event",
-		Event: &signaling.EventProxyServerMessage{
-			Type: "shutdown-scheduled",
-		},
-	}
-	session.sendMessage(msg)
+	session.sendMessage(s.newShutdownScheduledMessage())
 }
 
 func (s *ProxyServer) processMessage(client *ProxyClient, data []byte) {
@@ -555,8 +821,15 @@ func (s *ProxyServer) processMessage(client *ProxyClient, data []byte) {
 				return
 			}
 
+			if issuer, id := session.Token(); s.isTokenRevoked(issuer, id) {
+				statsTokenErrorsTotal.WithLabelValues("revoked").Inc()
+				client.SendMessage(message.NewErrorServerMessage(TokenRevoked))
+				return
+			}
+
 			log.Printf("Resumed session %s", session.PublicId())
 			session.MarkUsed()
+			session.SetFeatures(message.Hello.Features)
 			if atomic.LoadUint32(&s.shutdownScheduled) != 0 {
 				s.sendShutdownScheduled(session)
 			} else {
@@ -565,7 +838,7 @@ func (s *ProxyServer) processMessage(client *ProxyClient, data []byte) {
 			statsSessionsResumedTotal.Inc()
 		} else {
 			var err error
-			if session, err = s.NewSession(message.Hello); err != nil {
+			if session, err = s.NewSession(message.Hello, client.RemoteAddr()); err != nil {
 				if e, ok := err.(*signaling.Error); ok {
 					client.SendMessage(message.NewErrorServerMessage(e))
 				} else {
@@ -603,6 +876,9 @@ func (s *ProxyServer) processMessage(client *ProxyClient, data []byte) {
 		} else {
 			s.sendCurrentLoad(session)
 		}
+		if session.HasFeature(signaling.ProxyFeatureRemotePublishers) {
+			s.sendRemotePublishers(session)
+		}
 		return
 	}
 
@@ -611,9 +887,17 @@ func (s *ProxyServer) processMessage(client *ProxyClient, data []byte) {
 
 	switch message.Type {
 	case "command":
-		s.processCommand(ctx, client, session, &message)
+		// Commands may take a while (e.g. creating publishers in Janus), so they
+		// are processed concurrently to not block following requests. The
+		// signaling server matches out-of-order responses through the message id.
+		session.RunRequest(message.Command.ClientId, func() {
+			s.processCommand(ctx, client, session, &message)
+		})
 	case "payload":
-		s.processPayload(ctx, client, session, &message)
+		// Payloads must be processed in order with commands for the same client.
+		session.RunRequest(message.Payload.ClientId, func() {
+			s.processPayload(ctx, client, session, &message)
+		})
 	default:
 		session.sendMessage(message.NewErrorServerMessage(UnsupportedMessage))
 	}
@@ -638,7 +922,7 @@ func (s *ProxyServer) processCommand(ctx context.Context, client *ProxyClient, s
 		}
 
 		id := uuid.New().String()
-		publisher, err := s.mcu.NewPublisher(ctx, session, id, cmd.Sid, cmd.StreamType, cmd.Bitrate, cmd.MediaTypes, &emptyInitiator{})
+		publisher, err := s.mcu.NewPublisher(ctx, session, id, cmd.Sid, cmd.StreamType, session.LimitBitrate(cmd.Bitrate), cmd.MediaTypes, &emptyInitiator{})
 		if err == context.DeadlineExceeded {
 			log.Printf("Timeout while creating %s publisher %s for %s", cmd.StreamType, id, session.PublicId())
 			session.sendMessage(message.NewErrorServerMessage(TimeoutCreatingPublisher))
@@ -652,6 +936,9 @@ func (s *ProxyServer) processCommand(ctx context.Context, client *ProxyClient, s
 		log.Printf("Created %s publisher %s as %s for %s", cmd.StreamType, publisher.Id(), id, session.PublicId())
 		session.StorePublisher(ctx, id, publisher)
 		s.StoreClient(id, publisher)
+		if cmd.PublisherId != "" {
+			s.StorePublisherId(cmd.PublisherId, cmd.StreamType, id)
+		}
 
 		response := &signaling.ProxyServerMessage{
 			Id:   message.Id,
@@ -762,12 +1049,140 @@ func (s *ProxyServer) processCommand(ctx context.Context, client *ProxyClient, s
 			},
 		}
 		session.sendMessage(response)
+	case "get-publisher-streams":
+		source, e := s.getRemotePublisherSource(session, cmd.ClientId)
+		if e != nil {
+			session.sendMessage(message.NewErrorServerMessage(e))
+			return
+		}
+
+		streams, err := source.GetStreams(ctx)
+		if err != nil {
+			log.Printf("Error getting streams of publisher %s for %s: %s", cmd.ClientId, session.PublicId(), err)
+			session.sendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		response := &signaling.ProxyServerMessage{
+			Id:   message.Id,
+			Type: "command",
+			Command: &signaling.CommandProxyServerMessage{
+				Id:      cmd.ClientId,
+				Streams: streams,
+			},
+		}
+		session.sendMessage(response)
+	case "create-remote-publisher":
+		creator, ok := s.mcu.(signaling.McuRemotePublisherCreator)
+		if !ok {
+			session.sendMessage(message.NewErrorServerMessage(CascadingNotSupported))
+			return
+		}
+
+		id := uuid.New().String()
+		publisher, err := creator.NewRemotePublisher(ctx, session, id, cmd.StreamType, cmd.Streams)
+		if err == context.DeadlineExceeded {
+			log.Printf("Timeout while creating %s remote publisher %s for %s", cmd.StreamType, id, session.PublicId())
+			session.sendMessage(message.NewErrorServerMessage(TimeoutCreatingPublisher))
+			return
+		} else if err != nil {
+			log.Printf("Error while creating %s remote publisher %s for %s: %s", cmd.StreamType, id, session.PublicId(), err)
+			session.sendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		log.Printf("Created %s remote publisher %s as %s for %s (%s)", cmd.StreamType, publisher.Id(), id, session.PublicId(), cmd.PublisherId)
+		session.StorePublisher(ctx, id, publisher)
+		s.StoreClient(id, publisher)
+
+		response := &signaling.ProxyServerMessage{
+			Id:   message.Id,
+			Type: "command",
+			Command: &signaling.CommandProxyServerMessage{
+				Id:       id,
+				Hostname: publisher.Hostname(),
+				Port:     publisher.Port(),
+				RtcpPort: publisher.RtcpPort(),
+			},
+		}
+		session.sendMessage(response)
+		statsPublishersCurrent.WithLabelValues(cmd.StreamType).Inc()
+		statsPublishersTotal.WithLabelValues(cmd.StreamType).Inc()
+	case "publish-remote":
+		source, e := s.getRemotePublisherSource(session, cmd.ClientId)
+		if e != nil {
+			session.sendMessage(message.NewErrorServerMessage(e))
+			return
+		}
+
+		if err := source.PublishRemote(ctx, cmd.RemoteId, cmd.Hostname, cmd.Port, cmd.RtcpPort); err != nil {
+			log.Printf("Error publishing %s to remote %s for %s: %s", cmd.ClientId, cmd.RemoteId, session.PublicId(), err)
+			session.sendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		response := &signaling.ProxyServerMessage{
+			Id:   message.Id,
+			Type: "command",
+			Command: &signaling.CommandProxyServerMessage{
+				Id: cmd.ClientId,
+			},
+		}
+		session.sendMessage(response)
+	case "unpublish-remote":
+		source, e := s.getRemotePublisherSource(session, cmd.ClientId)
+		if e != nil {
+			session.sendMessage(message.NewErrorServerMessage(e))
+			return
+		}
+
+		if err := source.UnpublishRemote(ctx, cmd.RemoteId); err != nil {
+			log.Printf("Error unpublishing %s from remote %s for %s: %s", cmd.ClientId, cmd.RemoteId, session.PublicId(), err)
+			session.sendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		response := &signaling.ProxyServerMessage{
+			Id:   message.Id,
+			Type: "command",
+			Command: &signaling.CommandProxyServerMessage{
+				Id: cmd.ClientId,
+			},
+		}
+		session.sendMessage(response)
+	case "list-clients":
+		publishers, subscribers := session.ListClients()
+		response := &signaling.ProxyServerMessage{
+			Id:   message.Id,
+			Type: "command",
+			Command: &signaling.CommandProxyServerMessage{
+				Publishers:  publishers,
+				Subscribers: subscribers,
+			},
+		}
+		session.sendMessage(response)
 	default:
 		log.Printf("Unsupported command %+v", message.Command)
 		session.sendMessage(message.NewErrorServerMessage(UnsupportedCommand))
 	}
 }
 
+// getRemotePublisherSource returns the publisher of the session with the given
+// id if it can be sent to other proxies.
+func (s *ProxyServer) getRemotePublisherSource(session *ProxySession, id string) (signaling.McuRemotePublisherSource, *signaling.Error) {
+	publisher := session.GetPublisher(id)
+	if publisher == nil {
+		return nil, UnknownClient
+	}
+
+	source, ok := publisher.(signaling.McuRemotePublisherSource)
+	if !ok {
+		return nil, CascadingNotSupported
+	}
+
+	return source, nil
+}
+
 func (s *ProxyServer) processPayload(ctx context.Context, client *ProxyClient, session *ProxySession, message *signaling.ProxyClientMessage) {
 	payload := message.Payload
 	mcuClient := s.GetClient(payload.ClientId)
@@ -786,6 +1201,8 @@ func (s *ProxyServer) processPayload(ctx context.Context, client *ProxyClient, s
 		fallthrough
 	case "selectStream":
 		fallthrough
+	case "configure":
+		fallthrough
 	case "candidate":
 		mcuData = &signaling.MessageClientMessageData{
 			Type:    payload.Type,
@@ -836,13 +1253,14 @@ func (s *ProxyServer) processPayload(ctx context.Context, client *ProxyClient, s
 	})
 }
 
-func (s *ProxyServer) NewSession(hello *signaling.HelloProxyClientMessage) (*ProxySession, error) {
-	if proxyDebugMessages {
-		log.Printf("Hello: %+v", hello)
-	}
-
+// parseToken validates the signature of a token with the key of its issuer and
+// decodes it into "claims", "standard" must point to the standard claims
+// embedded in "claims". Returns the key the token was signed with and its
+// restrictions.
+func (s *ProxyServer) parseToken(tokenString string, claims jwt.Claims, standard *jwt.StandardClaims) (*ProxyToken, error) {
 	reason := "auth-failed"
-	token, err := jwt.ParseWithClaims(hello.Token, &signaling.TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+	var tokenKey *ProxyToken
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			log.Printf("Unexpected signing method: %v", token.Header["alg"])
@@ -850,27 +1268,28 @@ func (s *ProxyServer) NewSession(hello *signaling.HelloProxyClientMessage) (*Pro
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
 
-		claims, ok := token.Claims.(*signaling.TokenClaims)
-		if !ok {
-			log.Printf("Unsupported claims type: %+v", token.Claims)
-			reason = "unsupported-claims"
-			return nil, fmt.Errorf("Unsupported claims type")
-		}
-
-		tokenKey, err := s.tokens.Get(claims.Issuer)
+		issuer := standard.Issuer
+		key, err := s.tokens.Get(issuer)
 		if err != nil {
-			log.Printf("Could not get token for %s: %s", claims.Issuer, err)
+			log.Printf("Could not get token for %s: %s", issuer, err)
 			reason = "missing-issuer"
 			return nil, err
 		}
 
-		if tokenKey == nil || tokenKey.key == nil {
-			log.Printf("Issuer %s is not supported", claims.Issuer)
+		if key == nil || key.key == nil {
+			log.Printf("Issuer %s is not supported", issuer)
 			reason = "unsupported-issuer"
 			return nil, fmt.Errorf("No key found for issuer")
 		}
 
-		return tokenKey.key, nil
+		if key.IsExpired(time.Now()) {
+			log.Printf("Key of issuer %s has expired", issuer)
+			reason = "expired-key"
+			return nil, fmt.Errorf("Key of issuer has expired")
+		}
+
+		tokenKey = key
+		return key.key, nil
 	})
 	if err, ok := err.(*jwt.ValidationError); ok {
 		if err.Errors&jwt.ValidationErrorIssuedAt == jwt.ValidationErrorIssuedAt {
@@ -883,12 +1302,38 @@ func (s *ProxyServer) NewSession(hello *signaling.HelloProxyClientMessage) (*Pro
 		return nil, TokenAuthFailed
 	}
 
-	claims, ok := token.Claims.(*signaling.TokenClaims)
-	if !ok || !token.Valid {
+	if !token.Valid {
 		statsTokenErrorsTotal.WithLabelValues("auth-failed").Inc()
 		return nil, TokenAuthFailed
 	}
 
+	if s.isTokenRevoked(standard.Issuer, standard.Id) {
+		log.Printf("Token %s of issuer %s has been revoked", standard.Id, standard.Issuer)
+		statsTokenErrorsTotal.WithLabelValues("revoked").Inc()
+		return nil, TokenRevoked
+	}
+
+	return tokenKey, nil
+}
+
+// NewSession creates a session for a client connecting from the given address.
+func (s *ProxyServer) NewSession(hello *signaling.HelloProxyClientMessage, addr string) (*ProxySession, error) {
+	if proxyDebugMessages {
+		log.Printf("Hello: %+v", hello)
+	}
+
+	claims := &signaling.TokenClaims{}
+	tokenKey, err := s.parseToken(hello.Token, claims, &claims.StandardClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tokenKey.IsAllowedAddress(addr) {
+		log.Printf("Token of issuer %s may not be used from %s", claims.Issuer, addr)
+		statsTokenErrorsTotal.WithLabelValues("address-not-allowed").Inc()
+		return nil, TokenAddressNotAllowed
+	}
+
 	minIssuedAt := time.Now().Add(-maxTokenAge)
 	if issuedAt := time.Unix(claims.IssuedAt, 0); issuedAt.Before(minIssuedAt) {
 		statsTokenErrorsTotal.WithLabelValues("expired").Inc()
@@ -912,6 +1357,9 @@ func (s *ProxyServer) NewSession(hello *signaling.HelloProxyClientMessage) (*Pro
 
 	log.Printf("Created session %s for %+v", encoded, claims)
 	session := NewProxySession(s, sid, encoded)
+	session.SetToken(claims.Issuer, claims.Id)
+	session.SetMaxBitrate(tokenKey.maxBitrate)
+	session.SetFeatures(hello.Features)
 	s.StoreSession(sid, session)
 	statsSessionsCurrent.Inc()
 	statsSessionsTotal.Inc()
@@ -975,15 +1423,35 @@ func (s *ProxyServer) DeleteClient(id string, client signaling.McuClient) bool {
 
 	delete(s.clients, id)
 	delete(s.clientIds, client.Id())
+	if key, found := s.publisherKeys[id]; found {
+		delete(s.publisherKeys, id)
+		if s.publisherIds[key] == id {
+			delete(s.publisherIds, key)
+		}
+	}
 
 	if len(s.clients) == 0 && atomic.LoadUint32(&s.shutdownScheduled) != 0 {
-		go func() {
-			s.shutdownChannel <- true
-		}()
+		s.notifyShutdown()
 	}
 	return true
 }
 
+// StorePublisherId stores the id of the publisher on the signaling server, so
+// remote clients can subscribe to it.
+func (s *ProxyServer) StorePublisherId(publisherId string, streamType string, id string) {
+	key := publisherId + "|" + streamType
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+	s.publisherIds[key] = id
+	s.publisherKeys[id] = key
+}
+
+func (s *ProxyServer) GetPublisherClientId(publisherId string, streamType string) string {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	return s.publisherIds[publisherId+"|"+streamType]
+}
+
 func (s *ProxyServer) GetClientCount() int64 {
 	s.clientsLock.RLock()
 	defer s.clientsLock.RUnlock()
@@ -1008,6 +1476,9 @@ func (s *ProxyServer) getStats() map[string]interface{} {
 		"load":     atomic.LoadInt64(&s.load),
 		"mcu":      s.mcu.GetStats(),
 	}
+	if bandwidth := s.getBandwidth(); bandwidth != nil {
+		result["bandwidth"] = bandwidth
+	}
 	return result
 }
 
@@ -22,11 +22,14 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -111,7 +114,7 @@ func TestTokenInFuture(t *testing.T) {
 		Version: "1.0",
 		Token:   tokenString,
 	}
-	session, err := server.NewSession(hello)
+	session, err := server.NewSession(hello, "127.0.0.1")
 	if session != nil {
 		defer session.Close()
 		t.Errorf("should not have created session")
@@ -119,3 +122,172 @@ func TestTokenInFuture(t *testing.T) {
 		t.Errorf("could have failed with TokenNotValidYet, got %s", err)
 	}
 }
+
+func newSessionForTest(t *testing.T, server *ProxyServer, key *rsa.PrivateKey) *ProxySession {
+	claims := &signaling.TokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt: time.Now().Unix(),
+			Issuer:   TokenIdForTest,
+		},
+	}
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("could not create token: %s", err)
+	}
+
+	session, err := server.NewSession(&signaling.HelloProxyClientMessage{
+		Version: "1.0",
+		Token:   tokenString,
+	}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	return session
+}
+
+type testBlockingMcu struct {
+	*testRemoteMcu
+
+	started chan string
+	release chan struct{}
+}
+
+func (m *testBlockingMcu) NewPublisher(ctx context.Context, listener signaling.McuListener, id string, sid string, streamType string, bitrate int, mediaTypes signaling.MediaType, initiator signaling.McuInitiator) (signaling.McuPublisher, error) {
+	m.started <- sid
+	<-m.release
+	return m.testRemoteMcu.NewPublisher(ctx, listener, id, sid, streamType, bitrate, mediaTypes, initiator)
+}
+
+func TestProxyConcurrentCommands(t *testing.T) {
+	server, key := newProxyServerForTest(t)
+	mcu := &testBlockingMcu{
+		testRemoteMcu: &testRemoteMcu{
+			publishers: make(map[string]*testRemoteMcuClient),
+		},
+		started: make(chan string, 2),
+		release: make(chan struct{}),
+	}
+	server.mcu = mcu
+
+	session := newSessionForTest(t, server, key)
+	client := &ProxyClient{
+		proxy: server,
+	}
+	client.SetSession(session)
+
+	for i := 1; i <= 2; i++ {
+		data := fmt.Sprintf(`{"id":"%d","type":"command","command":{"type":"create-publisher","sid":"sid%d","streamType":"video"}}`, i, i)
+		server.processMessage(client, []byte(data))
+	}
+
+	// The second command must be processed while the first is still pending.
+	started := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case sid := <-mcu.started:
+			started[sid] = true
+		case <-time.After(time.Second):
+			t.Fatalf("commands were not processed concurrently, started %+v", started)
+		}
+	}
+	close(mcu.release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		session.clientLock.Lock()
+		count := len(session.pendingMessages)
+		session.clientLock.Unlock()
+		if count == 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected 2 responses, got %d", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProxyDrainTimeout(t *testing.T) {
+	server, key := newProxyServerForTest(t)
+	server.drainTimeout = 100 * time.Millisecond
+	session := newSessionForTest(t, server, key)
+
+	server.StoreClient("the-client", &testRemoteMcuClient{
+		id: "the-client",
+	})
+
+	server.ScheduleShutdown()
+
+	session.clientLock.Lock()
+	messages := session.pendingMessages
+	session.clientLock.Unlock()
+	if len(messages) != 1 {
+		t.Fatalf("expected one message, got %+v", messages)
+	} else if msg := messages[0]; msg.Type != "event" || msg.Event.Type != "shutdown-scheduled" {
+		t.Errorf("expected shutdown-scheduled event, got %+v", msg)
+	} else if msg.Event.DrainTimeout != 1 {
+		t.Errorf("expected drain timeout of 1 second, got %d", msg.Event.DrainTimeout)
+	}
+
+	select {
+	case <-server.ShutdownChannel():
+		t.Fatal("should wait for the drain timeout")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	select {
+	case <-server.ShutdownChannel():
+	case <-time.After(time.Second):
+		t.Fatal("should have shutdown after the drain timeout")
+	}
+}
+
+func TestProxySessionRequestOrder(t *testing.T) {
+	server, _ := newProxyServerForTest(t)
+	session := NewProxySession(server, 1, "session")
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var processed []string
+	done := make(chan string, 3)
+	run := func(name string, wait bool) func() {
+		return func() {
+			if wait {
+				<-release
+			}
+			mu.Lock()
+			processed = append(processed, name)
+			mu.Unlock()
+			done <- name
+		}
+	}
+
+	session.RunRequest("client1", run("delete", true))
+	session.RunRequest("client1", run("payload", false))
+	session.RunRequest("client2", run("other", false))
+
+	// Requests for other clients are not blocked.
+	select {
+	case name := <-done:
+		if name != "other" {
+			t.Errorf("Expected request of other client, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request of other client was blocked")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("requests were not processed")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(processed) != 3 || processed[1] != "delete" || processed[2] != "payload" {
+		t.Errorf("Requests of the same client were processed out of order: %+v", processed)
+	}
+}
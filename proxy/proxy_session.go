@@ -44,6 +44,14 @@ type ProxySession struct {
 	id    string
 	sid   uint64
 
+	// Limits the number of concurrently processed requests.
+	requests chan struct{}
+
+	// Pending requests by client id, requests for the same client are processed
+	// in the order they were received.
+	queuesLock sync.Mutex
+	queues     map[string][]func()
+
 	clientLock      sync.Mutex
 	client          *ProxyClient
 	pendingMessages []*signaling.ProxyServerMessage
@@ -55,6 +63,14 @@ type ProxySession struct {
 	subscribersLock sync.Mutex
 	subscribers     map[string]signaling.McuSubscriber
 	subscriberIds   map[signaling.McuSubscriber]string
+
+	features atomic.Value
+
+	// Issuer and id of the token used to create the session.
+	tokenIssuer string
+	tokenId     string
+	// Maximum bitrate of publishers as configured for the token key.
+	maxBitrate int
 }
 
 func NewProxySession(proxy *ProxyServer, sid uint64, id string) *ProxySession {
@@ -64,6 +80,9 @@ func NewProxySession(proxy *ProxyServer, sid uint64, id string) *ProxySession {
 		sid:      sid,
 		lastUsed: time.Now().UnixNano(),
 
+		requests: make(chan struct{}, proxy.maxConcurrentRequests),
+		queues:   make(map[string][]func()),
+
 		publishers:   make(map[string]signaling.McuPublisher),
 		publisherIds: make(map[signaling.McuPublisher]string),
 
@@ -72,6 +91,81 @@ func NewProxySession(proxy *ProxyServer, sid uint64, id string) *ProxySession {
 	}
 }
 
+// RunRequest processes the given function in the background without blocking
+// the caller. Functions for the same client id are run in the order they were
+// passed, functions without a client id (e.g. creating new clients) can run in
+// any order.
+func (s *ProxySession) RunRequest(clientId string, f func()) {
+	if clientId != "" {
+		s.queuesLock.Lock()
+		if queue, found := s.queues[clientId]; found {
+			// Will be processed once the pending requests have completed.
+			s.queues[clientId] = append(queue, f)
+			s.queuesLock.Unlock()
+			return
+		}
+		s.queues[clientId] = nil
+		s.queuesLock.Unlock()
+	}
+
+	go s.processRequests(clientId, f)
+}
+
+func (s *ProxySession) processRequests(clientId string, f func()) {
+	for f != nil {
+		s.requests <- struct{}{}
+		f()
+		<-s.requests
+
+		if clientId == "" {
+			return
+		}
+
+		s.queuesLock.Lock()
+		if queue := s.queues[clientId]; len(queue) == 0 {
+			delete(s.queues, clientId)
+			f = nil
+		} else {
+			f = queue[0]
+			queue[0] = nil
+			s.queues[clientId] = queue[1:]
+		}
+		s.queuesLock.Unlock()
+	}
+}
+
+func (s *ProxySession) SetFeatures(features []string) {
+	s.features.Store(features)
+}
+
+func (s *ProxySession) HasFeature(feature string) bool {
+	features, _ := s.features.Load().([]string)
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ProxySession) SetToken(issuer string, id string) {
+	s.tokenIssuer = issuer
+	s.tokenId = id
+}
+
+func (s *ProxySession) Token() (string, string) {
+	return s.tokenIssuer, s.tokenId
+}
+
+func (s *ProxySession) SetMaxBitrate(maxBitrate int) {
+	s.maxBitrate = maxBitrate
+}
+
+// LimitBitrate returns the bitrate to use for a publisher of the session.
+func (s *ProxySession) LimitBitrate(bitrate int) int {
+	return limitBitrate(bitrate, s.maxBitrate)
+}
+
 func (s *ProxySession) PublicId() string {
 	return s.id
 }
@@ -210,6 +304,23 @@ func (s *ProxySession) SubscriberSidUpdated(subscriber signaling.McuSubscriber)
 	s.sendMessage(msg)
 }
 
+func (s *ProxySession) PublisherReconnected(publisher signaling.McuPublisher) {
+	id := s.proxy.GetClientId(publisher)
+	if id == "" {
+		log.Printf("Received publisher reconnected event from unknown %s publisher %s (%+v)", publisher.StreamType(), publisher.Id(), publisher)
+		return
+	}
+
+	msg := &signaling.ProxyServerMessage{
+		Type: "event",
+		Event: &signaling.EventProxyServerMessage{
+			Type:     "publisher-reconnected",
+			ClientId: id,
+		},
+	}
+	s.sendMessage(msg)
+}
+
 func (s *ProxySession) PublisherClosed(publisher signaling.McuPublisher) {
 	if id := s.DeletePublisher(publisher); id != "" {
 		if s.proxy.DeleteClient(id, publisher) {
@@ -252,6 +363,13 @@ func (s *ProxySession) StorePublisher(ctx context.Context, id string, publisher
 	s.publisherIds[publisher] = id
 }
 
+func (s *ProxySession) GetPublisher(id string) signaling.McuPublisher {
+	s.publishersLock.Lock()
+	defer s.publishersLock.Unlock()
+
+	return s.publishers[id]
+}
+
 func (s *ProxySession) DeletePublisher(publisher signaling.McuPublisher) string {
 	s.publishersLock.Lock()
 	defer s.publishersLock.Unlock()
@@ -288,6 +406,24 @@ func (s *ProxySession) DeleteSubscriber(subscriber signaling.McuSubscriber) stri
 	return id
 }
 
+// ListClients returns the ids of the publishers and subscribers of the session.
+func (s *ProxySession) ListClients() ([]string, []string) {
+	s.publishersLock.Lock()
+	publishers := make([]string, 0, len(s.publishers))
+	for id := range s.publishers {
+		publishers = append(publishers, id)
+	}
+	s.publishersLock.Unlock()
+
+	s.subscribersLock.Lock()
+	subscribers := make([]string, 0, len(s.subscribers))
+	for id := range s.subscribers {
+		subscribers = append(subscribers, id)
+	}
+	s.subscribersLock.Unlock()
+	return publishers, subscribers
+}
+
 func (s *ProxySession) clearPublishers() {
 	s.publishersLock.Lock()
 	defer s.publishersLock.Unlock()
@@ -86,6 +86,30 @@ var (
 		Name:      "token_errors_total",
 		Help:      "The total number of token errors",
 	}, []string{"reason"})
+	statsBandwidthCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "proxy",
+		Name:      "bandwidth",
+		Help:      "The current bandwidth in bits per second",
+	}, []string{"direction"})
+	statsDrainingCurrent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "proxy",
+		Name:      "draining",
+		Help:      "Whether the proxy is scheduled to shutdown and waiting for clients to disconnect",
+	})
+	statsDrainClientsCurrent = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "proxy",
+		Name:      "drain_clients",
+		Help:      "The current number of clients the proxy is waiting for before shutting down",
+	})
+	statsDrainRemainingSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "proxy",
+		Name:      "drain_remaining_seconds",
+		Help:      "The remaining time in seconds until the proxy shuts down even if clients are still connected",
+	})
 )
 
 func init() {
@@ -99,4 +123,8 @@ func init() {
 	prometheus.MustRegister(statsCommandMessagesTotal)
 	prometheus.MustRegister(statsPayloadMessagesTotal)
 	prometheus.MustRegister(statsTokenErrorsTotal)
+	prometheus.MustRegister(statsBandwidthCurrent)
+	prometheus.MustRegister(statsDrainingCurrent)
+	prometheus.MustRegister(statsDrainClientsCurrent)
+	prometheus.MustRegister(statsDrainRemainingSeconds)
 }
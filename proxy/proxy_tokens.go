@@ -23,8 +23,11 @@ package main
 
 import (
 	"crypto/rsa"
+	"time"
 
 	"github.com/dlintw/goconf"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
 )
 
 const (
@@ -37,6 +40,31 @@ const (
 type ProxyToken struct {
 	id  string
 	key *rsa.PublicKey
+
+	// Optional restrictions for tokens signed with the key.
+	allowedIps *signaling.TrustedProxies
+	expires    time.Time
+	maxBitrate int
+}
+
+// IsExpired returns true if tokens signed with the key may no longer be used.
+func (t *ProxyToken) IsExpired(now time.Time) bool {
+	return !t.expires.IsZero() && now.After(t.expires)
+}
+
+// IsAllowedAddress returns true if the token may be used from the given
+// address. All addresses are allowed if no restriction is configured.
+func (t *ProxyToken) IsAllowedAddress(addr string) bool {
+	return t.allowedIps.Contains(addr)
+}
+
+// limitBitrate returns the bitrate to use for a publisher that requested the
+// given bitrate (0 for the default bitrate).
+func limitBitrate(bitrate int, maxBitrate int) int {
+	if maxBitrate > 0 && (bitrate <= 0 || bitrate > maxBitrate) {
+		return maxBitrate
+	}
+	return bitrate
 }
 
 type ProxyTokens interface {
@@ -24,6 +24,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
@@ -44,6 +45,52 @@ const (
 	tokenCacheSize = 4096
 )
 
+// tokenMetadata can be stored in etcd instead of only the public key to
+// restrict what tokens signed with the key may be used for.
+type tokenMetadata struct {
+	Key string `json:"key"`
+
+	// Comma- or space-separated list of IP addresses / networks from which
+	// tokens may be used.
+	AllowedIps string `json:"allowedips,omitempty"`
+	// Tokens may no longer be used after this time.
+	Expires time.Time `json:"expires,omitempty"`
+	// Maximum bitrate of publishers (in bits per second).
+	MaxBitrate int `json:"maxbitrate,omitempty"`
+}
+
+// parseEtcdToken parses a token from either a PEM encoded public key or a JSON
+// document with the key and its metadata.
+func parseEtcdToken(id string, value []byte) (*ProxyToken, error) {
+	var metadata tokenMetadata
+	if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &metadata); err != nil {
+			return nil, err
+		}
+	} else {
+		metadata.Key = string(value)
+	}
+
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM([]byte(metadata.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	allowedIps, err := signaling.ParseTrustedProxies(metadata.AllowedIps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed ips: %w", err)
+	}
+
+	return &ProxyToken{
+		id:  id,
+		key: publicKey,
+
+		allowedIps: allowedIps,
+		expires:    metadata.Expires,
+		maxBitrate: metadata.MaxBitrate,
+	}, nil
+}
+
 type tokenCacheEntry struct {
 	keyValue []byte
 	token    *ProxyToken
@@ -104,17 +151,14 @@ func (t *tokensEtcd) getByKey(id string, key string) (*ProxyToken, error) {
 	cached, _ := t.tokenCache.Get(key).(*tokenCacheEntry)
 	if cached == nil || !bytes.Equal(cached.keyValue, keyValue) {
 		// Parsed public keys are cached to avoid the parse overhead.
-		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(keyValue)
+		token, err := parseEtcdToken(id, keyValue)
 		if err != nil {
 			return nil, err
 		}
 
 		cached = &tokenCacheEntry{
 			keyValue: keyValue,
-			token: &ProxyToken{
-				id:  id,
-				key: publicKey,
-			},
+			token:    token,
 		}
 		t.tokenCache.Set(key, cached)
 	}
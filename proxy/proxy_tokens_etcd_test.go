@@ -26,6 +26,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"net"
@@ -35,6 +36,7 @@ import (
 	"strconv"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/dlintw/goconf"
 	"go.etcd.io/etcd/server/v3/embed"
@@ -80,6 +82,8 @@ func newEtcdForTesting(t *testing.T) *embed.Etcd {
 	for port := 50000; port < 50100; port++ {
 		u.Host = net.JoinHostPort("localhost", strconv.Itoa(port))
 		cfg.LCUrls = []url.URL{*u}
+		// Clients sync their endpoints with the advertised urls.
+		cfg.ACUrls = cfg.LCUrls
 		etcd, err = embed.StartEtcd(cfg)
 		if isErrorAddressAlreadyInUse(err) {
 			continue
@@ -119,7 +123,7 @@ func newTokensEtcdForTesting(t *testing.T) (*tokensEtcd, *embed.Etcd) {
 	return tokens.(*tokensEtcd), etcd
 }
 
-func storeKey(t *testing.T, etcd *embed.Etcd, key string, pubkey crypto.PublicKey) {
+func encodeKey(t *testing.T, pubkey crypto.PublicKey) []byte {
 	var data []byte
 	var err error
 	switch pubkey := pubkey.(type) {
@@ -132,17 +136,23 @@ func storeKey(t *testing.T, etcd *embed.Etcd, key string, pubkey crypto.PublicKe
 		t.Fatalf("unknown key type %T in %+v", pubkey, pubkey)
 	}
 
-	data = pem.EncodeToMemory(&pem.Block{
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA PUBLIC KEY",
 		Bytes: data,
 	})
+}
 
+func storeValue(etcd *embed.Etcd, key string, data []byte) {
 	if kv := etcd.Server.KV(); kv != nil {
 		kv.Put([]byte(key), data, lease.NoLease)
 		kv.Commit()
 	}
 }
 
+func storeKey(t *testing.T, etcd *embed.Etcd, key string, pubkey crypto.PublicKey) {
+	storeValue(etcd, key, encodeKey(t, pubkey))
+}
+
 func generateAndSaveKey(t *testing.T, etcd *embed.Etcd, name string) *rsa.PrivateKey {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
@@ -175,3 +185,74 @@ func TestProxyTokensEtcd(t *testing.T) {
 		t.Error("token keys mismatch")
 	}
 }
+
+func TestProxyTokensEtcdMetadata(t *testing.T) {
+	tokens, etcd := newTokensEtcdForTesting(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	data, err := json.Marshal(map[string]interface{}{
+		"key":        string(encodeKey(t, key.PublicKey)),
+		"allowedips": "192.168.0.0/24, 10.1.2.3",
+		"expires":    expires.Format(time.RFC3339),
+		"maxbitrate": 1000000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeValue(etcd, "/foo", data)
+
+	token, err := tokens.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	} else if token == nil {
+		t.Fatal("could not get token")
+	}
+
+	if !key.PublicKey.Equal(token.key) {
+		t.Error("token keys mismatch")
+	}
+	if !token.expires.Equal(expires) {
+		t.Errorf("expected expiration %s, got %s", expires, token.expires)
+	}
+	if token.IsExpired(time.Now()) {
+		t.Error("token should not be expired")
+	}
+	if !token.IsExpired(expires.Add(time.Second)) {
+		t.Error("token should be expired")
+	}
+	for addr, expected := range map[string]bool{
+		"192.168.0.1":       true,
+		"192.168.0.1:12345": true,
+		"10.1.2.3":          true,
+		"10.1.2.4":          false,
+		"127.0.0.1":         false,
+	} {
+		if allowed := token.IsAllowedAddress(addr); allowed != expected {
+			t.Errorf("expected %s allowed=%v, got %v", addr, expected, allowed)
+		}
+	}
+	if bitrate := limitBitrate(0, token.maxBitrate); bitrate != 1000000 {
+		t.Errorf("expected bitrate %d, got %d", 1000000, bitrate)
+	}
+	if bitrate := limitBitrate(2000000, token.maxBitrate); bitrate != 1000000 {
+		t.Errorf("expected bitrate %d, got %d", 1000000, bitrate)
+	}
+	if bitrate := limitBitrate(500000, token.maxBitrate); bitrate != 500000 {
+		t.Errorf("expected bitrate %d, got %d", 500000, bitrate)
+	}
+
+	// Keys without metadata don't have any restrictions.
+	storeKey(t, etcd, "/testing/bar/key", key.PublicKey)
+	if token, err := tokens.Get("bar"); err != nil {
+		t.Fatal(err)
+	} else if token == nil {
+		t.Fatal("could not get token")
+	} else if token.IsExpired(time.Now().Add(24*time.Hour)) || !token.IsAllowedAddress("127.0.0.1") || token.maxBitrate != 0 {
+		t.Errorf("token should not have restrictions: %+v", token)
+	}
+}
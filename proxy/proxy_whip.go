@@ -0,0 +1,600 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pion/sdp"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
+)
+
+const (
+	// Maximum size of SDP offers / answers and trickle ICE fragments.
+	maxRemoteRequestSize = 64 * 1024
+
+	remoteClientTimeout = 10 * time.Second
+
+	contentTypeSdp        = "application/sdp"
+	contentTypeTrickleIce = "application/trickle-ice-sdpfrag"
+
+	defaultRemoteStreamType = "video"
+)
+
+// StreamTokenClaims are the claims of tokens that authorize external clients
+// to publish (WHIP) or subscribe (WHEP) a stream.
+type StreamTokenClaims struct {
+	jwt.StandardClaims
+
+	// Type of the stream to publish or subscribe, defaults to "video".
+	StreamType string `json:"streamtype,omitempty"`
+	// Optional bitrate for published streams.
+	Bitrate int `json:"bitrate,omitempty"`
+}
+
+// RemoteClient is a publisher or subscriber that was created through WHIP or
+// WHEP instead of the proxy protocol.
+type RemoteClient struct {
+	proxy      *ProxyServer
+	id         string
+	publicId   string
+	streamType string
+	publisher  bool
+	client     signaling.McuClient
+	closed     uint32
+
+	// Issuer and id of the token used to create the client.
+	issuer  string
+	tokenId string
+}
+
+func (c *RemoteClient) String() string {
+	if c.publisher {
+		return fmt.Sprintf("WHIP %s publisher %s (%s)", c.streamType, c.id, c.publicId)
+	}
+
+	return fmt.Sprintf("WHEP %s subscriber %s (%s)", c.streamType, c.id, c.publicId)
+}
+
+func (c *RemoteClient) PublicId() string {
+	return c.publicId
+}
+
+func (c *RemoteClient) OnUpdateOffer(client signaling.McuClient, offer map[string]interface{}) {
+	log.Printf("Updating offers is not supported for %s", c)
+}
+
+func (c *RemoteClient) OnIceCandidate(client signaling.McuClient, candidate interface{}) {
+	// Remote clients don't support trickle ICE from the server, the MCU
+	// includes its candidates in the SDP.
+}
+
+func (c *RemoteClient) OnIceCompleted(client signaling.McuClient) {
+	log.Printf("ICE completed for %s", c)
+}
+
+func (c *RemoteClient) SubscriberSidUpdated(subscriber signaling.McuSubscriber) {
+	log.Printf("Renegotiation is not supported for %s, closing", c)
+	go c.Close(context.Background())
+}
+
+func (c *RemoteClient) PublisherReconnected(publisher signaling.McuPublisher) {
+	log.Printf("Renegotiation is not supported for %s, closing", c)
+	go c.Close(context.Background())
+}
+
+func (c *RemoteClient) PublisherClosed(publisher signaling.McuPublisher) {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		c.proxy.removeRemoteClient(c)
+	}
+}
+
+func (c *RemoteClient) SubscriberClosed(subscriber signaling.McuSubscriber) {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		c.proxy.removeRemoteClient(c)
+	}
+}
+
+func (c *RemoteClient) Close(ctx context.Context) {
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return
+	}
+
+	c.client.Close(ctx)
+	c.proxy.removeRemoteClient(c)
+}
+
+type remoteClientResult struct {
+	err      error
+	response map[string]interface{}
+}
+
+func (c *RemoteClient) sendMessage(ctx context.Context, data *signaling.MessageClientMessageData) (map[string]interface{}, error) {
+	ch := make(chan remoteClientResult, 1)
+	c.client.SendMessage(ctx, &signaling.MessageClientMessage{}, data, func(err error, response map[string]interface{}) {
+		ch <- remoteClientResult{
+			err:      err,
+			response: response,
+		}
+	})
+
+	select {
+	case result := <-ch:
+		return result.response, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RemoteClient) sendSdp(ctx context.Context, sdpType string, sdpText string) (string, error) {
+	response, err := c.sendMessage(ctx, &signaling.MessageClientMessageData{
+		Type:     sdpType,
+		RoomType: c.streamType,
+		Payload: map[string]interface{}{
+			"type": sdpType,
+			"sdp":  sdpText,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	result, _ := response["sdp"].(string)
+	return result, nil
+}
+
+func (c *RemoteClient) requestOffer(ctx context.Context) (string, error) {
+	response, err := c.sendMessage(ctx, &signaling.MessageClientMessageData{
+		Type:     "requestoffer",
+		RoomType: c.streamType,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	offer, _ := response["sdp"].(string)
+	if offer == "" {
+		return "", fmt.Errorf("no offer received")
+	}
+	return offer, nil
+}
+
+func (c *RemoteClient) sendCandidates(ctx context.Context, candidates []map[string]interface{}) error {
+	for _, candidate := range candidates {
+		if _, err := c.sendMessage(ctx, &signaling.MessageClientMessageData{
+			Type:     "candidate",
+			RoomType: c.streamType,
+			Payload: map[string]interface{}{
+				"candidate": candidate,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTrickleIceCandidates returns the candidates contained in a trickle ICE
+// SDP fragment (RFC 8840) in the format expected by the MCU.
+func parseTrickleIceCandidates(frag string) []map[string]interface{} {
+	var result []map[string]interface{}
+	mid := ""
+	mlineIndex := 0
+	mlines := 0
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mlineIndex = mlines
+			mlines++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = line[len("a=mid:"):]
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := map[string]interface{}{
+				"candidate":     line[len("a="):],
+				"sdpMLineIndex": mlineIndex,
+			}
+			if mid != "" {
+				candidate["sdpMid"] = mid
+			}
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+func getSdpMediaTypes(sdpText string) (signaling.MediaType, error) {
+	var s sdp.SessionDescription
+	if err := s.Unmarshal(sdpText); err != nil {
+		return 0, err
+	}
+
+	var mediaTypes signaling.MediaType
+	for _, md := range s.MediaDescriptions {
+		switch md.MediaName.Media {
+		case "audio":
+			mediaTypes |= signaling.MediaTypeAudio
+		case "video":
+			mediaTypes |= signaling.MediaTypeVideo
+		}
+	}
+	if mediaTypes == 0 {
+		return 0, fmt.Errorf("no audio or video found")
+	}
+	return mediaTypes, nil
+}
+
+func hasContentType(r *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentType
+}
+
+func readRemoteRequestBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteRequestSize))
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusRequestEntityTooLarge)
+		return "", false
+	}
+
+	return string(body), true
+}
+
+func (s *ProxyServer) registerRemoteHandlers(r *mux.Router) {
+	r.HandleFunc("/whip", s.setCommonHeaders(s.setRemoteHeaders(s.whipHandler))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/whip/{id}", s.setCommonHeaders(s.setRemoteHeaders(s.remoteResourceHandler(true)))).Methods("PATCH", "DELETE", "OPTIONS")
+	r.HandleFunc("/whep", s.setCommonHeaders(s.setRemoteHeaders(s.whepHandler))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/whep/{id}", s.setCommonHeaders(s.setRemoteHeaders(s.remoteResourceHandler(false)))).Methods("PATCH", "DELETE", "OPTIONS")
+}
+
+// setRemoteHeaders allows browser based players to access the WHIP / WHEP
+// endpoints from other origins.
+func (s *ProxyServer) setRemoteHeaders(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		h.Set("Access-Control-Expose-Headers", "Location")
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		f(w, r)
+	}
+}
+
+func (s *ProxyServer) getStreamClaims(w http.ResponseWriter, r *http.Request) *StreamTokenClaims {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil
+	}
+
+	claims := &StreamTokenClaims{}
+	tokenKey, err := s.parseToken(auth[len("Bearer "):], claims, &claims.StandardClaims)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	if addr := getRealUserIP(r); !tokenKey.IsAllowedAddress(addr) {
+		log.Printf("Token of issuer %s may not be used from %s", claims.Issuer, addr)
+		statsTokenErrorsTotal.WithLabelValues("address-not-allowed").Inc()
+		http.Error(w, TokenAddressNotAllowed.Error(), http.StatusForbidden)
+		return nil
+	}
+	claims.Bitrate = limitBitrate(claims.Bitrate, tokenKey.maxBitrate)
+
+	if claims.Subject == "" || claims.ExpiresAt == 0 {
+		// Tokens for remote clients are used for longer periods, so they must
+		// expire at some point.
+		statsTokenErrorsTotal.WithLabelValues("incomplete-claims").Inc()
+		w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		http.Error(w, "Token must contain a subject and an expiration", http.StatusUnauthorized)
+		return nil
+	}
+
+	if claims.StreamType == "" {
+		claims.StreamType = defaultRemoteStreamType
+	}
+	return claims
+}
+
+func (s *ProxyServer) whipHandler(w http.ResponseWriter, r *http.Request) {
+	claims := s.getStreamClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	if !hasContentType(r, contentTypeSdp) {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	} else if atomic.LoadUint32(&s.shutdownScheduled) != 0 {
+		http.Error(w, ShutdownScheduled.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	offer, ok := readRemoteRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	mediaTypes, err := getSdpMediaTypes(offer)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid offer: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), remoteClientTimeout)
+	defer cancel()
+
+	client := &RemoteClient{
+		proxy:      s,
+		id:         uuid.New().String(),
+		publicId:   claims.Subject,
+		streamType: claims.StreamType,
+		publisher:  true,
+		issuer:     claims.Issuer,
+		tokenId:    claims.Id,
+	}
+	publisher, err := s.mcu.NewPublisher(ctx, client, client.id, client.id, client.streamType, claims.Bitrate, mediaTypes, &emptyInitiator{})
+	if err != nil {
+		log.Printf("Error creating %s: %s", client, err)
+		http.Error(w, "Could not create publisher", http.StatusInternalServerError)
+		return
+	}
+	client.client = publisher
+
+	answer, err := client.sendSdp(ctx, "offer", offer)
+	if err != nil {
+		log.Printf("Error sending offer of %s: %s", client, err)
+		publisher.Close(context.Background())
+		http.Error(w, "Could not process offer", http.StatusInternalServerError)
+		return
+	}
+
+	s.addRemoteClient(client)
+	w.Header().Set("Content-Type", contentTypeSdp)
+	// Relative to the endpoint, so the proxy can be served from a sub-path.
+	w.Header().Set("Location", "whip/"+client.id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer)) // nolint
+}
+
+func (s *ProxyServer) whepHandler(w http.ResponseWriter, r *http.Request) {
+	claims := s.getStreamClaims(w, r)
+	if claims == nil {
+		return
+	}
+
+	body, ok := readRemoteRequestBody(w, r)
+	if !ok {
+		return
+	} else if strings.TrimSpace(body) != "" {
+		// The MCU always creates the offer for subscribers, the player must
+		// send the answer in a PATCH request to the resource.
+		http.Error(w, "Offers from players are not supported", http.StatusNotAcceptable)
+		return
+	}
+
+	publisherId := s.GetPublisherClientId(claims.Subject, claims.StreamType)
+	if publisherId == "" {
+		http.Error(w, "Publisher not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), remoteClientTimeout)
+	defer cancel()
+
+	client := &RemoteClient{
+		proxy:      s,
+		id:         uuid.New().String(),
+		publicId:   claims.Subject,
+		streamType: claims.StreamType,
+		issuer:     claims.Issuer,
+		tokenId:    claims.Id,
+	}
+	subscriber, err := s.mcu.NewSubscriber(ctx, client, publisherId, client.streamType)
+	if err != nil {
+		log.Printf("Error creating %s: %s", client, err)
+		http.Error(w, "Could not create subscriber", http.StatusInternalServerError)
+		return
+	}
+	client.client = subscriber
+
+	offer, err := client.requestOffer(ctx)
+	if err != nil {
+		log.Printf("Error requesting offer for %s: %s", client, err)
+		subscriber.Close(context.Background())
+		http.Error(w, "Could not create offer", http.StatusInternalServerError)
+		return
+	}
+
+	s.addRemoteClient(client)
+	w.Header().Set("Content-Type", contentTypeSdp)
+	w.Header().Set("Location", "whep/"+client.id)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(offer)) // nolint
+}
+
+func (s *ProxyServer) remoteResourceHandler(publisher bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := s.getStreamClaims(w, r)
+		if claims == nil {
+			return
+		}
+
+		client := s.GetRemoteClient(mux.Vars(r)["id"])
+		if client == nil || client.publisher != publisher || client.publicId != claims.Subject {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), remoteClientTimeout)
+		defer cancel()
+
+		if r.Method == "DELETE" {
+			log.Printf("Deleting %s", client)
+			client.Close(ctx)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		switch {
+		case hasContentType(r, contentTypeTrickleIce):
+			frag, ok := readRemoteRequestBody(w, r)
+			if !ok {
+				return
+			}
+
+			if err := client.sendCandidates(ctx, parseTrickleIceCandidates(frag)); err != nil {
+				log.Printf("Error sending candidates of %s: %s", client, err)
+				http.Error(w, "Could not process candidates", http.StatusBadRequest)
+				return
+			}
+		case hasContentType(r, contentTypeSdp) && !client.publisher:
+			answer, ok := readRemoteRequestBody(w, r)
+			if !ok {
+				return
+			}
+
+			if _, err := client.sendSdp(ctx, "answer", answer); err != nil {
+				log.Printf("Error sending answer of %s: %s", client, err)
+				http.Error(w, "Could not process answer", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *ProxyServer) addRemoteClient(client *RemoteClient) {
+	s.remoteClientsLock.Lock()
+	s.remoteClients[client.id] = client
+	s.remoteClientsLock.Unlock()
+
+	s.StoreClient(client.id, client.client)
+	log.Printf("Created %s", client)
+	if client.publisher {
+		s.StorePublisherId(client.publicId, client.streamType, client.id)
+		statsPublishersCurrent.WithLabelValues(client.streamType).Inc()
+		statsPublishersTotal.WithLabelValues(client.streamType).Inc()
+		s.notifyRemotePublisher("remote-publisher-added", client)
+	} else {
+		statsSubscribersCurrent.WithLabelValues(client.streamType).Inc()
+		statsSubscribersTotal.WithLabelValues(client.streamType).Inc()
+	}
+}
+
+func (s *ProxyServer) removeRemoteClient(client *RemoteClient) {
+	s.remoteClientsLock.Lock()
+	if s.remoteClients[client.id] != client {
+		s.remoteClientsLock.Unlock()
+		return
+	}
+	delete(s.remoteClients, client.id)
+	s.remoteClientsLock.Unlock()
+
+	s.DeleteClient(client.id, client.client)
+	log.Printf("Removed %s", client)
+	if client.publisher {
+		statsPublishersCurrent.WithLabelValues(client.streamType).Dec()
+		s.notifyRemotePublisher("remote-publisher-removed", client)
+	} else {
+		statsSubscribersCurrent.WithLabelValues(client.streamType).Dec()
+	}
+}
+
+func (s *ProxyServer) closeRevokedRemoteClients() {
+	var revoked []*RemoteClient
+	s.remoteClientsLock.RLock()
+	for _, client := range s.remoteClients {
+		if s.isTokenRevoked(client.issuer, client.tokenId) {
+			revoked = append(revoked, client)
+		}
+	}
+	s.remoteClientsLock.RUnlock()
+
+	for _, client := range revoked {
+		log.Printf("Closing %s with revoked token", client)
+		client.Close(context.Background())
+	}
+}
+
+func (s *ProxyServer) GetRemoteClient(id string) *RemoteClient {
+	s.remoteClientsLock.RLock()
+	defer s.remoteClientsLock.RUnlock()
+	return s.remoteClients[id]
+}
+
+func newRemotePublisherEvent(eventType string, client *RemoteClient) *signaling.ProxyServerMessage {
+	return &signaling.ProxyServerMessage{
+		Type: "event",
+		Event: &signaling.EventProxyServerMessage{
+			Type:        eventType,
+			ClientId:    client.id,
+			PublisherId: client.publicId,
+			StreamType:  client.streamType,
+		},
+	}
+}
+
+func (s *ProxyServer) notifyRemotePublisher(eventType string, client *RemoteClient) {
+	msg := newRemotePublisherEvent(eventType, client)
+	s.IterateSessions(func(session *ProxySession) {
+		if session.HasFeature(signaling.ProxyFeatureRemotePublishers) {
+			session.sendMessage(msg)
+		}
+	})
+}
+
+// sendRemotePublishers sends the currently active remote publishers to a
+// session that was just created or resumed.
+func (s *ProxyServer) sendRemotePublishers(session *ProxySession) {
+	s.remoteClientsLock.RLock()
+	defer s.remoteClientsLock.RUnlock()
+	for _, client := range s.remoteClients {
+		if client.publisher {
+			session.sendMessage(newRemotePublisherEvent("remote-publisher-added", client))
+		}
+	}
+}
@@ -0,0 +1,325 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
+)
+
+const (
+	testWhipOffer = "v=0\r\n" +
+		"o=- 1 1 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=mid:0\r\n" +
+		"a=sendonly\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n"
+)
+
+type testRemoteMcu struct {
+	mu          sync.Mutex
+	publishers  map[string]*testRemoteMcuClient
+	subscribers []*testRemoteMcuClient
+}
+
+func (m *testRemoteMcu) Start() error                     { return nil }
+func (m *testRemoteMcu) Stop()                            {}
+func (m *testRemoteMcu) Reload(config *goconf.ConfigFile) {}
+func (m *testRemoteMcu) SetOnConnected(f func())          {}
+func (m *testRemoteMcu) SetOnDisconnected(f func())       {}
+func (m *testRemoteMcu) GetStats() interface{}            { return nil }
+
+func (m *testRemoteMcu) NewPublisher(ctx context.Context, listener signaling.McuListener, id string, sid string, streamType string, bitrate int, mediaTypes signaling.MediaType, initiator signaling.McuInitiator) (signaling.McuPublisher, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	publisher := &testRemoteMcuClient{
+		id:         id,
+		streamType: streamType,
+		listener:   listener,
+		mediaTypes: mediaTypes,
+	}
+	m.publishers[id] = publisher
+	return publisher, nil
+}
+
+func (m *testRemoteMcu) NewSubscriber(ctx context.Context, listener signaling.McuListener, publisher string, streamType string) (signaling.McuSubscriber, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.publishers[publisher]; !found {
+		return nil, fmt.Errorf("publisher %s not found", publisher)
+	}
+
+	subscriber := &testRemoteMcuClient{
+		id:         "subscriber-" + publisher,
+		streamType: streamType,
+		listener:   listener,
+		publisher:  publisher,
+	}
+	m.subscribers = append(m.subscribers, subscriber)
+	return subscriber, nil
+}
+
+type testRemoteMcuClient struct {
+	id         string
+	streamType string
+	listener   signaling.McuListener
+	mediaTypes signaling.MediaType
+	publisher  string
+
+	mu       sync.Mutex
+	messages []*signaling.MessageClientMessageData
+	closed   bool
+}
+
+func (c *testRemoteMcuClient) Id() string                           { return c.id }
+func (c *testRemoteMcuClient) Sid() string                          { return c.id }
+func (c *testRemoteMcuClient) StreamType() string                   { return c.streamType }
+func (c *testRemoteMcuClient) HasMedia(mt signaling.MediaType) bool { return c.mediaTypes&mt == mt }
+func (c *testRemoteMcuClient) SetMedia(mt signaling.MediaType)      { c.mediaTypes = mt }
+func (c *testRemoteMcuClient) Publisher() string                    { return c.publisher }
+
+func (c *testRemoteMcuClient) Close(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+func (c *testRemoteMcuClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *testRemoteMcuClient) getMessages() []*signaling.MessageClientMessageData {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*signaling.MessageClientMessageData{}, c.messages...)
+}
+
+func (c *testRemoteMcuClient) SendMessage(ctx context.Context, message *signaling.MessageClientMessage, data *signaling.MessageClientMessageData, callback func(error, map[string]interface{})) {
+	c.mu.Lock()
+	c.messages = append(c.messages, data)
+	c.mu.Unlock()
+
+	switch data.Type {
+	case "offer":
+		go callback(nil, map[string]interface{}{
+			"type": "answer",
+			"sdp":  "answer-to-" + c.id,
+		})
+	case "requestoffer":
+		go callback(nil, map[string]interface{}{
+			"type": "offer",
+			"sdp":  "offer-from-" + c.id,
+		})
+	default:
+		go callback(nil, nil)
+	}
+}
+
+func newRemoteServerForTest(t *testing.T) (*ProxyServer, *rsa.PrivateKey, *testRemoteMcu, *httptest.Server) {
+	proxy, key := newProxyServerForTest(t)
+	mcu := &testRemoteMcu{
+		publishers: make(map[string]*testRemoteMcuClient),
+	}
+	proxy.mcu = mcu
+
+	r := mux.NewRouter()
+	proxy.registerRemoteHandlers(r)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return proxy, key, mcu, server
+}
+
+func newStreamTokenForTest(t *testing.T, key *rsa.PrivateKey, subject string) string {
+	claims := &StreamTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			Issuer:    TokenIdForTest,
+			Subject:   subject,
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func doRemoteRequest(t *testing.T, method string, url string, token string, contentType string, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestWhipWhep(t *testing.T) {
+	proxy, key, mcu, server := newRemoteServerForTest(t)
+	token := newStreamTokenForTest(t, key, "the-publisher")
+
+	if resp, _ := doRemoteRequest(t, "POST", server.URL+"/whip", "", contentTypeSdp, testWhipOffer); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized without token, got %s", resp.Status)
+	}
+	if resp, _ := doRemoteRequest(t, "POST", server.URL+"/whip", token, "text/plain", testWhipOffer); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected unsupported media type, got %s", resp.Status)
+	}
+	if resp, _ := doRemoteRequest(t, "POST", server.URL+"/whep", token, "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected not found for unknown publisher, got %s", resp.Status)
+	}
+
+	resp, answer := doRemoteRequest(t, "POST", server.URL+"/whip", token, contentTypeSdp, testWhipOffer)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected publisher to be created, got %s: %s", resp.Status, answer)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "whip/") {
+		t.Fatalf("Unexpected location %s", location)
+	}
+	publisherId := strings.TrimPrefix(location, "whip/")
+	if answer != "answer-to-"+publisherId {
+		t.Errorf("Unexpected answer %s", answer)
+	}
+	publisher := mcu.publishers[publisherId]
+	if publisher == nil {
+		t.Fatalf("Publisher %s not found", publisherId)
+	} else if !publisher.HasMedia(signaling.MediaTypeAudio) || publisher.HasMedia(signaling.MediaTypeVideo) {
+		t.Errorf("Expected audio publisher, got %+v", publisher)
+	}
+	if id := proxy.GetPublisherClientId("the-publisher", "video"); id != publisherId {
+		t.Errorf("Expected publisher id %s, got %s", publisherId, id)
+	}
+
+	// Resources can only be modified with a token for the same subject.
+	otherToken := newStreamTokenForTest(t, key, "other-publisher")
+	if resp, _ := doRemoteRequest(t, "DELETE", server.URL+"/"+location, otherToken, "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected not found for other subject, got %s", resp.Status)
+	}
+
+	resp, offer := doRemoteRequest(t, "POST", server.URL+"/whep", token, "", "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected subscriber to be created, got %s: %s", resp.Status, offer)
+	}
+	if offer != "offer-from-subscriber-"+publisherId {
+		t.Errorf("Unexpected offer %s", offer)
+	}
+	subscriberLocation := resp.Header.Get("Location")
+	if !strings.HasPrefix(subscriberLocation, "whep/") {
+		t.Fatalf("Unexpected location %s", subscriberLocation)
+	}
+
+	if resp, body := doRemoteRequest(t, "PATCH", server.URL+"/"+subscriberLocation, token, contentTypeSdp, "the-answer"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected answer to be accepted, got %s: %s", resp.Status, body)
+	}
+	frag := "a=ice-ufrag:abcd\r\n" +
+		"a=ice-pwd:efgh\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1 1 UDP 2130706431 192.0.2.1 10000 typ host\r\n"
+	if resp, body := doRemoteRequest(t, "PATCH", server.URL+"/"+subscriberLocation, token, contentTypeTrickleIce, frag); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected candidates to be accepted, got %s: %s", resp.Status, body)
+	}
+
+	subscriber := mcu.subscribers[0]
+	messages := subscriber.getMessages()
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %+v", messages)
+	}
+	if messages[1].Type != "answer" || messages[1].Payload["sdp"] != "the-answer" {
+		t.Errorf("Expected answer, got %+v", messages[1])
+	}
+	if candidate, ok := messages[2].Payload["candidate"].(map[string]interface{}); !ok || messages[2].Type != "candidate" ||
+		candidate["candidate"] != "candidate:1 1 UDP 2130706431 192.0.2.1 10000 typ host" || candidate["sdpMid"] != "0" || candidate["sdpMLineIndex"] != 0 {
+		t.Errorf("Expected candidate, got %+v", messages[2])
+	}
+
+	if resp, _ := doRemoteRequest(t, "DELETE", server.URL+"/"+subscriberLocation, token, "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected subscriber to be deleted, got %s", resp.Status)
+	}
+	if !subscriber.isClosed() {
+		t.Error("Subscriber should have been closed")
+	}
+
+	if resp, _ := doRemoteRequest(t, "DELETE", server.URL+"/"+location, token, "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected publisher to be deleted, got %s", resp.Status)
+	}
+	if !publisher.isClosed() {
+		t.Error("Publisher should have been closed")
+	}
+	if id := proxy.GetPublisherClientId("the-publisher", "video"); id != "" {
+		t.Errorf("Expected publisher id to be removed, got %s", id)
+	}
+	if count := proxy.GetClientCount(); count != 0 {
+		t.Errorf("Expected no clients, got %d", count)
+	}
+}
+
+func TestParseTrickleIceCandidates(t *testing.T) {
+	frag := "a=ice-ufrag:abcd\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1 1 UDP 1 192.0.2.1 10000 typ host\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+		"a=mid:1\r\n" +
+		"a=candidate:2 1 UDP 1 192.0.2.1 10002 typ host\r\n" +
+		"a=end-of-candidates\r\n"
+	candidates := parseTrickleIceCandidates(frag)
+	if len(candidates) != 2 {
+		t.Fatalf("Expected 2 candidates, got %+v", candidates)
+	}
+	if candidates[1]["sdpMid"] != "1" || candidates[1]["sdpMLineIndex"] != 1 || candidates[1]["candidate"] != "candidate:2 1 UDP 1 192.0.2.1 10002 typ host" {
+		t.Errorf("Unexpected candidate %+v", candidates[1])
+	}
+}
@@ -0,0 +1,357 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum time to wait for the PROXY protocol header after a connection
+	// has been accepted.
+	proxyProtocolHeaderTimeout = 5 * time.Second
+
+	// Maximum length of a version 1 header including the trailing CRLF.
+	proxyProtocolV1MaxLength = 107
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// parseIPNets parses a comma- or space-separated list of IP addresses and
+// CIDRs.
+func parseIPNets(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse CIDR %s: %s", entry, err)
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("could not parse IP %s", entry)
+		}
+
+		var mask net.IPMask
+		if ipv4 := ip.To4(); ipv4 != nil {
+			mask = net.CIDRMask(32, 32)
+		} else {
+			mask = net.CIDRMask(128, 128)
+		}
+		nets = append(nets, &net.IPNet{
+			IP:   ip,
+			Mask: mask,
+		})
+	}
+	return nets, nil
+}
+
+// containsIP returns true if the given address (with optional port) is
+// contained in one of the networks.
+func containsIP(nets []*net.IPNet, addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxies is a list of IP addresses / ranges of proxies that are
+// allowed to provide the address of clients.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// ParseTrustedProxies parses a comma- or space-separated list of IP addresses
+// and CIDRs. Returns nil if the list is empty.
+func ParseTrustedProxies(value string) (*TrustedProxies, error) {
+	nets, err := parseIPNets(value)
+	if err != nil {
+		return nil, err
+	} else if len(nets) == 0 {
+		return nil, nil
+	}
+
+	return &TrustedProxies{
+		nets: nets,
+	}, nil
+}
+
+// Contains returns true if the given address (with optional port) is trusted.
+// All addresses are trusted if no trusted proxies are configured.
+func (t *TrustedProxies) Contains(addr string) bool {
+	if t == nil {
+		return true
+	}
+
+	return containsIP(t.nets, addr)
+}
+
+// ProxyProtocolListener accepts connections with an optional header of the
+// PROXY protocol (version 1 or 2) as sent by HAProxy and other load balancers.
+// The remote address of connections is replaced by the client address from
+// the header. Headers are only evaluated if the connection originates from a
+// trusted proxy.
+type ProxyProtocolListener struct {
+	net.Listener
+
+	trusted *TrustedProxies
+}
+
+func NewProxyProtocolListener(listener net.Listener, trusted *TrustedProxies) *ProxyProtocolListener {
+	return &ProxyProtocolListener{
+		Listener: listener,
+		trusted:  trusted,
+	}
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); !ok && !l.trusted.Contains(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+
+	// The header is parsed lazily so a slow client doesn't block accepting
+	// further connections.
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout)); err != nil {
+			c.err = err
+			return
+		}
+
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.reader)
+		if c.err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+			return
+		}
+
+		c.err = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header. Returns a nil address
+// if no header was sent or the original address of the connection should be
+// used.
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	data, err := reader.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if bytes.Equal(data, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1Header(reader)
+	} else if !bytes.Equal(data, proxyProtocolV2Signature[:len(data)]) {
+		return nil, nil
+	}
+
+	data, err = reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	} else if !bytes.Equal(data, proxyProtocolV2Signature) {
+		return nil, nil
+	}
+
+	return readProxyProtocolV2Header(reader)
+}
+
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		} else if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("header too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("header not terminated by CRLF")
+	}
+
+	// PROXY <protocol> <source ip> <destination ip> <source port> <destination port>
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid header %q", line)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4":
+		fallthrough
+	case "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", fields[1])
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid source address %s", fields[2])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %s", fields[4])
+	}
+
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port),
+	}, nil
+}
+
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x00:
+		// LOCAL, e.g. health checks of the proxy.
+		return nil, nil
+	case 0x01:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("address data too short")
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(data[0:4]),
+			Port: int(binary.BigEndian.Uint16(data[8:10])),
+		}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("address data too short")
+		}
+
+		return &net.TCPAddr{
+			IP:   net.IP(data[0:16]),
+			Port: int(binary.BigEndian.Uint16(data[32:34])),
+		}, nil
+	default:
+		// Other families are not supported, use the original address.
+		return nil, nil
+	}
+}
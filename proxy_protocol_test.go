@@ -0,0 +1,187 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	if trusted, err := ParseTrustedProxies(" "); err != nil {
+		t.Fatal(err)
+	} else if trusted != nil {
+		t.Errorf("expected no trusted proxies, got %+v", trusted)
+	} else if !trusted.Contains("1.2.3.4") {
+		t.Error("all addresses should be trusted if no proxies are configured")
+	}
+
+	if _, err := ParseTrustedProxies("1.2.3.4, invalid"); err == nil {
+		t.Error("expected error for invalid address")
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+
+	trusted, err := ParseTrustedProxies("127.0.0.1, 10.0.0.0/8 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"127.0.0.1":          true,
+		"127.0.0.1:1234":     true,
+		"127.0.0.2":          false,
+		"10.1.2.3":           true,
+		"[2001:db8::1]:1234": true,
+		"2001:db9::1":        false,
+		"invalid":            false,
+	}
+	for addr, result := range expected {
+		if trusted.Contains(addr) != result {
+			t.Errorf("expected %v for %s", result, addr)
+		}
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v2Header := func(command byte, family byte, addr []byte) []byte {
+		var buf bytes.Buffer
+		buf.Write(proxyProtocolV2Signature)
+		buf.WriteByte(0x20 | command)
+		buf.WriteByte(family)
+		binary.Write(&buf, binary.BigEndian, uint16(len(addr))) // nolint
+		buf.Write(addr)
+		return buf.Bytes()
+	}
+
+	v4Addr := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6Addr := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	v6Addr = append(v6Addr, 0x30, 0x39, 0x01, 0xbb)
+
+	tests := []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"), "192.0.2.1:12345"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345"},
+		{[]byte("PROXY UNKNOWN\r\n"), ""},
+		{v2Header(0x01, 0x11, v4Addr), "192.0.2.1:12345"},
+		{v2Header(0x01, 0x21, v6Addr), "[2001:db8::1]:12345"},
+		// LOCAL connections use the original address.
+		{v2Header(0x00, 0x00, nil), ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		data := append(test.header, []byte("GET / HTTP/1.1\r\n")...)
+		reader := bufio.NewReader(bytes.NewReader(data))
+		addr, err := readProxyProtocolHeader(reader)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.header, err)
+			continue
+		}
+
+		if addr == nil {
+			if test.expected != "" {
+				t.Errorf("expected %s for %q, got no address", test.expected, test.header)
+			}
+		} else if addr.String() != test.expected {
+			t.Errorf("expected %s for %q, got %s", test.expected, test.header, addr)
+		}
+
+		// The remaining data must be unchanged.
+		if remaining, err := io.ReadAll(reader); err != nil {
+			t.Error(err)
+		} else if string(remaining) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("unexpected remaining data %q for %q", remaining, test.header)
+		}
+	}
+
+	invalid := [][]byte{
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 2001:db8::2 12345 443\r\n"),
+		[]byte("PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n"),
+		append([]byte("PROXY "), bytes.Repeat([]byte("x"), proxyProtocolV1MaxLength)...),
+		v2Header(0x02, 0x11, v4Addr),
+		v2Header(0x01, 0x11, v4Addr[:8]),
+	}
+	for _, header := range invalid {
+		if addr, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(header))); err == nil {
+			t.Errorf("expected error for %q, got %s", header, addr)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	for _, trustedValue := range []string{"", "127.0.0.1", "10.0.0.0/8"} {
+		trusted, err := ParseTrustedProxies(trustedValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxyListener := NewProxyProtocolListener(listener, trusted)
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nhello")); err != nil {
+			t.Fatal(err)
+		}
+
+		accepted, err := proxyListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if trusted.Contains("127.0.0.1") {
+			if addr := accepted.RemoteAddr().String(); addr != "192.0.2.1:12345" {
+				t.Errorf("expected address from header with trusted proxies %q, got %s", trustedValue, addr)
+			}
+
+			data := make([]byte, 5)
+			if _, err := io.ReadFull(accepted, data); err != nil {
+				t.Error(err)
+			} else if string(data) != "hello" {
+				t.Errorf("expected data after header, got %q", data)
+			}
+		} else if addr := accepted.RemoteAddr().String(); addr != conn.LocalAddr().String() {
+			// Headers from untrusted addresses are not evaluated.
+			t.Errorf("expected original address %s with trusted proxies %q, got %s", conn.LocalAddr(), trustedValue, addr)
+		}
+
+		conn.Close()
+		accepted.Close()
+		proxyListener.Close()
+	}
+}
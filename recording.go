@@ -0,0 +1,310 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// Number of concurrent recordings that are assumed for recording backends
+	// that didn't report their capacity.
+	defaultRecordingCapacity = 1
+
+	RecordingFailedNoBackend     = "no_recording_backend"
+	TranscriptionFailedNoBackend = "no_transcription_backend"
+)
+
+// RecordingBackendSession is an internal session that can record rooms.
+type RecordingBackendSession interface {
+	PublicId() string
+	Backend() *Backend
+	SendMessage(message *ServerMessage) bool
+}
+
+type recordingBackend struct {
+	session  RecordingBackendSession
+	capacity int
+	rooms    map[string]*recording
+}
+
+func (b *recordingBackend) available() int {
+	return b.capacity - len(b.rooms)
+}
+
+type recording struct {
+	key     string
+	roomId  string
+	backend *Backend
+
+	current *recordingBackend
+	// Recording backends that failed to record the room.
+	failed map[RecordingBackendSession]bool
+}
+
+// RecordingBackends keeps track of the internal sessions that can record
+// rooms and assigns recordings to them. If a recording backend fails or
+// disconnects, the recording is moved to another backend.
+//
+// The same logic is used to assign live transcriptions of rooms to internal
+// transcription services.
+type RecordingBackends struct {
+	// Type of the messages sent to the backends, "recording" or "transcription".
+	messageType     string
+	noBackendReason string
+
+	mu         sync.Mutex
+	backends   map[RecordingBackendSession]*recordingBackend
+	recordings map[string]*recording
+
+	// Called if a recording could not be started on any backend.
+	onFailed func(roomId string, backend *Backend, reason string)
+}
+
+func NewRecordingBackends(onFailed func(roomId string, backend *Backend, reason string)) *RecordingBackends {
+	return newRecordingBackends("recording", RecordingFailedNoBackend, onFailed)
+}
+
+func NewTranscriptionBackends(onFailed func(roomId string, backend *Backend, reason string)) *RecordingBackends {
+	return newRecordingBackends("transcription", TranscriptionFailedNoBackend, onFailed)
+}
+
+func newRecordingBackends(messageType string, noBackendReason string, onFailed func(roomId string, backend *Backend, reason string)) *RecordingBackends {
+	return &RecordingBackends{
+		messageType:     messageType,
+		noBackendReason: noBackendReason,
+
+		backends:   make(map[RecordingBackendSession]*recordingBackend),
+		recordings: make(map[string]*recording),
+		onFailed:   onFailed,
+	}
+}
+
+// AddBackend registers a new recording backend.
+func (r *RecordingBackends) AddBackend(session RecordingBackendSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.backends[session]; found {
+		return
+	}
+
+	log.Printf("Backend %s for %s connected for %s", session.PublicId(), session.Backend().Id(), r.messageType)
+	r.backends[session] = &recordingBackend{
+		session:  session,
+		capacity: defaultRecordingCapacity,
+		rooms:    make(map[string]*recording),
+	}
+}
+
+// RemoveBackend removes a recording backend. Its recordings are moved to
+// other backends.
+func (r *RecordingBackends) RemoveBackend(session RecordingBackendSession) {
+	var failed []*recording
+	r.mu.Lock()
+	defer func() {
+		r.mu.Unlock()
+		r.notifyFailed(failed)
+	}()
+
+	b, found := r.backends[session]
+	if !found {
+		return
+	}
+
+	delete(r.backends, session)
+	log.Printf("Backend %s for %s disconnected for %s", session.PublicId(), session.Backend().Id(), r.messageType)
+	for _, rec := range b.rooms {
+		rec.current = nil
+		rec.failed[session] = true
+		if !r.startLocked(rec) {
+			failed = append(failed, rec)
+		}
+	}
+}
+
+// SetCapacity updates the number of concurrent recordings a backend supports.
+func (r *RecordingBackends) SetCapacity(session RecordingBackendSession, capacity int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, found := r.backends[session]; found {
+		b.capacity = capacity
+	}
+}
+
+func (r *RecordingBackends) notifyFailed(failed []*recording) {
+	for _, rec := range failed {
+		log.Printf("No %s backend available for room %s of %s", r.messageType, rec.roomId, rec.backend.Id())
+		if r.onFailed != nil {
+			r.onFailed(rec.roomId, rec.backend, r.noBackendReason)
+		}
+	}
+}
+
+func (r *RecordingBackends) newMessage(messageType string, roomId string) *ServerMessage {
+	switch r.messageType {
+	case "transcription":
+		return &ServerMessage{
+			Type: "transcription",
+			Transcription: &TranscriptionServerMessage{
+				Type:   messageType,
+				RoomId: roomId,
+			},
+		}
+	default:
+		return &ServerMessage{
+			Type: "recording",
+			Recording: &RecordingServerMessage{
+				Type:   messageType,
+				RoomId: roomId,
+			},
+		}
+	}
+}
+
+// Start assigns the recording of a room to a backend. Returns false if no
+// backend is available.
+func (r *RecordingBackends) Start(roomId string, backend *Backend) bool {
+	key := getRoomIdForBackend(roomId, backend)
+	r.mu.Lock()
+	if _, found := r.recordings[key]; found {
+		r.mu.Unlock()
+		return true
+	}
+
+	rec := &recording{
+		key:     key,
+		roomId:  roomId,
+		backend: backend,
+		failed:  make(map[RecordingBackendSession]bool),
+	}
+	r.recordings[key] = rec
+	started := r.startLocked(rec)
+	r.mu.Unlock()
+	if !started {
+		r.notifyFailed([]*recording{rec})
+	}
+	return started
+}
+
+func (r *RecordingBackends) startLocked(rec *recording) bool {
+	for {
+		var best *recordingBackend
+		for session, b := range r.backends {
+			if rec.failed[session] || session.Backend().Id() != rec.backend.Id() || b.available() <= 0 {
+				continue
+			}
+
+			if best == nil || b.available() > best.available() {
+				best = b
+			}
+		}
+
+		if best == nil {
+			delete(r.recordings, rec.key)
+			return false
+		}
+
+		if best.session.SendMessage(r.newMessage("start", rec.roomId)) {
+			log.Printf("Started %s of room %s of %s on %s", r.messageType, rec.roomId, rec.backend.Id(), best.session.PublicId())
+			rec.current = best
+			best.rooms[rec.key] = rec
+			return true
+		}
+
+		rec.failed[best.session] = true
+	}
+}
+
+// Stop stops the recording of a room.
+func (r *RecordingBackends) Stop(roomId string, backend *Backend) {
+	key := getRoomIdForBackend(roomId, backend)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, found := r.recordings[key]
+	if !found {
+		return
+	}
+
+	delete(r.recordings, key)
+	if b := rec.current; b != nil {
+		delete(b.rooms, key)
+		b.session.SendMessage(r.newMessage("stop", roomId))
+	}
+}
+
+// Stopped is called if a recording backend stopped recording a room.
+func (r *RecordingBackends) Stopped(session RecordingBackendSession, roomId string) {
+	key := getRoomIdForBackend(roomId, session.Backend())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, found := r.recordings[key]
+	if !found || rec.current == nil || rec.current.session != session {
+		return
+	}
+
+	delete(r.recordings, key)
+	delete(rec.current.rooms, key)
+}
+
+// Failed is called if a recording backend could not record a room. The
+// recording is moved to another backend.
+func (r *RecordingBackends) Failed(session RecordingBackendSession, roomId string, reason string) {
+	key := getRoomIdForBackend(roomId, session.Backend())
+	var failed []*recording
+	r.mu.Lock()
+	defer func() {
+		r.mu.Unlock()
+		r.notifyFailed(failed)
+	}()
+
+	rec, found := r.recordings[key]
+	if !found || rec.current == nil || rec.current.session != session {
+		return
+	}
+
+	log.Printf("The %s of room %s of %s failed on %s: %s", r.messageType, roomId, rec.backend.Id(), session.PublicId(), reason)
+	delete(rec.current.rooms, key)
+	rec.current = nil
+	rec.failed[session] = true
+	if !r.startLocked(rec) {
+		failed = append(failed, rec)
+	}
+}
+
+// GetRecordingBackend returns the id of the session that is recording the
+// given room.
+func (r *RecordingBackends) GetRecordingBackend(roomId string, backend *Backend) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, found := r.recordings[getRoomIdForBackend(roomId, backend)]
+	if !found || rec.current == nil {
+		return ""
+	}
+
+	return rec.current.session.PublicId()
+}
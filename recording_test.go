@@ -0,0 +1,326 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type testRecordingSession struct {
+	mu       sync.Mutex
+	id       string
+	backend  *Backend
+	closed   bool
+	messages []*RecordingServerMessage
+}
+
+func (s *testRecordingSession) PublicId() string {
+	return s.id
+}
+
+func (s *testRecordingSession) Backend() *Backend {
+	return s.backend
+}
+
+func (s *testRecordingSession) SendMessage(message *ServerMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+
+	s.messages = append(s.messages, message.Recording)
+	return true
+}
+
+func (s *testRecordingSession) popMessage(t *testing.T, msgType string, roomId string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		t.Errorf("Expected %s message for %s on %s, got none", msgType, roomId, s.id)
+		return
+	}
+
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	if msg.Type != msgType || msg.RoomId != roomId {
+		t.Errorf("Expected %s message for %s on %s, got %+v", msgType, roomId, s.id, msg)
+	}
+}
+
+func (s *testRecordingSession) checkNoMessage(t *testing.T) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) > 0 {
+		t.Errorf("Expected no message on %s, got %+v", s.id, s.messages[0])
+	}
+}
+
+func TestRecordingBackends(t *testing.T) {
+	backend := &Backend{
+		id: "backend1",
+	}
+	other := &Backend{
+		id: "backend2",
+	}
+
+	var failed []string
+	recordings := NewRecordingBackends(func(roomId string, backend *Backend, reason string) {
+		failed = append(failed, roomId+"@"+backend.Id())
+	})
+
+	if recordings.Start("room1", backend) {
+		t.Error("Should not have started without recording backends")
+	}
+	if len(failed) != 1 || failed[0] != "room1@backend1" {
+		t.Errorf("Expected failed room1, got %+v", failed)
+	}
+	failed = nil
+
+	session1 := &testRecordingSession{
+		id:      "session1",
+		backend: backend,
+	}
+	session2 := &testRecordingSession{
+		id:      "session2",
+		backend: backend,
+	}
+	session3 := &testRecordingSession{
+		id:      "session3",
+		backend: other,
+	}
+	recordings.AddBackend(session1)
+	recordings.AddBackend(session2)
+	recordings.AddBackend(session3)
+	recordings.SetCapacity(session1, 2)
+
+	// The backend with the most free capacity is used.
+	if !recordings.Start("room1", backend) {
+		t.Fatal("Could not start recording")
+	}
+	session1.popMessage(t, "start", "room1")
+	if id := recordings.GetRecordingBackend("room1", backend); id != session1.id {
+		t.Errorf("Expected recording on %s, got %s", session1.id, id)
+	}
+
+	// Starting again doesn't change the backend.
+	if !recordings.Start("room1", backend) {
+		t.Fatal("Could not start recording")
+	}
+	session1.checkNoMessage(t)
+
+	recordings.SetCapacity(session2, 2)
+	if !recordings.Start("room2", backend) {
+		t.Fatal("Could not start recording")
+	}
+	session2.popMessage(t, "start", "room2")
+	if id := recordings.GetRecordingBackend("room2", backend); id != session2.id {
+		t.Errorf("Expected recording on %s, got %s", session2.id, id)
+	}
+
+	// Failover to the backend with free capacity.
+	recordings.Failed(session1, "room1", "out of disk space")
+	session2.popMessage(t, "start", "room1")
+	if id := recordings.GetRecordingBackend("room1", backend); id != session2.id {
+		t.Errorf("Expected recording on %s, got %s", session2.id, id)
+	}
+	if len(failed) != 0 {
+		t.Errorf("Expected no failed recordings, got %+v", failed)
+	}
+
+	recordings.Stop("room2", backend)
+	session2.popMessage(t, "stop", "room2")
+	if id := recordings.GetRecordingBackend("room2", backend); id != "" {
+		t.Errorf("Expected no recording, got %s", id)
+	}
+
+	// The remaining backend already failed and the backend of the other
+	// Nextcloud instance can't be used.
+	recordings.RemoveBackend(session2)
+	if id := recordings.GetRecordingBackend("room1", backend); id != "" {
+		t.Errorf("Expected no recording, got %s", id)
+	}
+	if len(failed) != 1 || failed[0] != "room1@backend1" {
+		t.Errorf("Expected failed room1, got %+v", failed)
+	}
+	session1.checkNoMessage(t)
+	session3.checkNoMessage(t)
+}
+
+func TestRecordingBackends_Stopped(t *testing.T) {
+	backend := &Backend{
+		id: "backend1",
+	}
+	recordings := NewRecordingBackends(nil)
+	session := &testRecordingSession{
+		id:      "session1",
+		backend: backend,
+	}
+	recordings.AddBackend(session)
+
+	if !recordings.Start("room1", backend) {
+		t.Fatal("Could not start recording")
+	}
+	session.popMessage(t, "start", "room1")
+
+	// The capacity is used by the recording.
+	if recordings.Start("room2", backend) {
+		t.Error("Should not have started recording without free capacity")
+	}
+
+	recordings.Stopped(session, "room1")
+	if id := recordings.GetRecordingBackend("room1", backend); id != "" {
+		t.Errorf("Expected no recording, got %s", id)
+	}
+
+	if !recordings.Start("room2", backend) {
+		t.Fatal("Could not start recording")
+	}
+	session.popMessage(t, "start", "room2")
+
+	session.mu.Lock()
+	session.closed = true
+	session.mu.Unlock()
+	if recordings.Start("room3", backend) {
+		t.Error("Should not have started recording on closed session")
+	}
+}
+
+func TestTranscription(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	transcriber := NewTestClient(t, server, hub)
+	defer transcriber.CloseWithBye()
+	if err := transcriber.SendHelloInternalWithFeatures([]string{ClientFeatureInternalTranscription}); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := transcriber.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	session := hub.GetSessionByPublicId(client.publicId).(*ClientSession)
+	start := &ClientMessage{
+		Id:   "abcd",
+		Type: "transcription",
+		Transcription: &TranscriptionClientMessage{
+			Type: "start",
+		},
+	}
+
+	// Only moderators may start transcriptions.
+	session.SetPermissions([]Permission{})
+	if err := client.WriteJSON(start); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(message, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	session.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	if err := client.WriteJSON(start); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := transcriber.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "transcription"); err != nil {
+		t.Fatal(err)
+	} else if message.Transcription.Type != "start" || message.Transcription.RoomId != roomId {
+		t.Errorf("Expected start of transcription in %s, got %+v", roomId, message.Transcription)
+	}
+
+	if backend := hub.transcriptions.GetRecordingBackend(roomId, session.Backend()); backend != hello.Hello.SessionId {
+		t.Errorf("Expected transcription by %s, got %s", hello.Hello.SessionId, backend)
+	}
+
+	if err := transcriber.WriteJSON(&ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "transcription",
+			Transcription: &TranscriptionInternalClientMessage{
+				Type:      "caption",
+				RoomId:    roomId,
+				SessionId: session.PublicId(),
+				Text:      "Hello world",
+				Final:     true,
+				Language:  "en",
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if message, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "caption"); err != nil {
+		t.Fatal(err)
+	} else if caption := message.Caption; caption.RoomId != roomId || caption.SessionId != session.PublicId() ||
+		caption.Text != "Hello world" || !caption.Final || caption.Language != "en" {
+		t.Errorf("Unexpected caption %+v", caption)
+	}
+
+	if err := client.WriteJSON(&ClientMessage{
+		Type: "transcription",
+		Transcription: &TranscriptionClientMessage{
+			Type: "stop",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := transcriber.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(message, "transcription"); err != nil {
+		t.Fatal(err)
+	} else if message.Transcription.Type != "stop" || message.Transcription.RoomId != roomId {
+		t.Errorf("Expected stop of transcription in %s, got %+v", roomId, message.Transcription)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -46,7 +47,7 @@ const (
 )
 
 var (
-	updateActiveSessionsInterval = 10 * time.Second
+	updateRoomStatsInterval = 10 * time.Second
 )
 
 func init() {
@@ -69,19 +70,53 @@ type Room struct {
 	virtualSessions  map[*VirtualSession]bool
 	inCallSessions   map[Session]bool
 	roomSessionData  map[string]*RoomSessionData
+	// Recording consent of sessions, mapped by their public session id.
+	recordingConsent map[string]bool
+	// Metadata of sessions, mapped by their public session id.
+	sessionMetadata map[string]map[string]interface{}
+	// Muted media of sessions, mapped by their public session id.
+	mutedMedia map[string]MediaType
+	// Public ids of sessions that placed their call on hold.
+	onHoldSessions map[string]bool
+
+	// Sessions that joined the room as additional room, mapped to their room
+	// session id.
+	observers map[*ClientSession]string
 
 	statsRoomSessionsCurrent *prometheus.GaugeVec
 
 	natsReceiver        chan *nats.Msg
 	backendSubscription NatsSubscription
 
-	// Users currently in the room
+	subject  string
+	messages *RoomMessages
+
+	// Only set if the room history is enabled.
+	history             *RoomHistory
+	historyReceiver     chan *nats.Msg
+	historySubscription NatsSubscription
+
+	// Users currently in the room. The list is shared with messages that are
+	// being sent and must not be modified, it is replaced on updates.
 	users []map[string]interface{}
+	// Strings of the current users, reused for the next list of users.
+	rosterStrings map[string]string
 
 	// Timestamps of last NATS backend requests for the different types.
 	lastNatsRoomRequests map[string]int64
 
 	transientData *TransientData
+	reactions     *RoomReactions
+	typing        *RoomTyping
+	// Only set if active speaker events are enabled.
+	speakers *RoomSpeakers
+
+	// Set for breakout rooms that are managed by the hub.
+	parent *Room
+
+	// Bitrate limits that have been applied to the publishers in the room.
+	bitrateMu     *sync.Mutex
+	bitrateLimits map[McuPublisher]int
 }
 
 func GetSubjectForRoomId(roomId string, backend *Backend) string {
@@ -92,6 +127,16 @@ func GetSubjectForRoomId(roomId string, backend *Backend) string {
 	return GetEncodedSubject("room", roomId+"|"+backend.Id())
 }
 
+// getBackendId returns the id of the backend, or an empty string if no backend
+// is given.
+func getBackendId(backend *Backend) string {
+	if backend == nil {
+		return ""
+	}
+
+	return backend.Id()
+}
+
 func GetSubjectForBackendRoomId(roomId string, backend *Backend) string {
 	if backend == nil || backend.IsCompat() {
 		return GetEncodedSubject("backend.room", roomId)
@@ -132,6 +177,12 @@ func NewRoom(roomId string, properties *json.RawMessage, hub *Hub, n NatsClient,
 		virtualSessions:  make(map[*VirtualSession]bool),
 		inCallSessions:   make(map[Session]bool),
 		roomSessionData:  make(map[string]*RoomSessionData),
+		recordingConsent: make(map[string]bool),
+		sessionMetadata:  make(map[string]map[string]interface{}),
+		mutedMedia:       make(map[string]MediaType),
+		onHoldSessions:   make(map[string]bool),
+
+		observers: make(map[*ClientSession]string),
 
 		statsRoomSessionsCurrent: statsRoomSessionsCurrent.MustCurryWith(prometheus.Labels{
 			"backend": backend.Id(),
@@ -141,9 +192,28 @@ func NewRoom(roomId string, properties *json.RawMessage, hub *Hub, n NatsClient,
 		natsReceiver:        natsReceiver,
 		backendSubscription: backendSubscription,
 
+		subject:  GetSubjectForRoomId(roomId, backend),
+		messages: NewRoomMessages(),
+
 		lastNatsRoomRequests: make(map[string]int64),
 
 		transientData: NewTransientData(),
+		reactions:     NewRoomReactions(),
+		typing:        NewRoomTyping(),
+
+		bitrateMu: &sync.Mutex{},
+	}
+	if hub.activeSpeakerInterval > 0 {
+		room.speakers = NewRoomSpeakers(hub.activeSpeakerInterval)
+	}
+	if hub.roomHistorySize > 0 {
+		room.history = NewRoomHistory(hub.roomHistorySize, hub.roomHistoryMaxAge)
+		room.historyReceiver = make(chan *nats.Msg, 64)
+		room.historySubscription, err = n.Subscribe(room.subject, room.historyReceiver)
+		if err != nil {
+			room.unsubscribeBackend()
+			return nil, err
+		}
 	}
 	go room.run()
 
@@ -154,6 +224,20 @@ func (r *Room) Id() string {
 	return r.id
 }
 
+// BackendRoomId returns the id of the room as known by the backend. Breakout
+// rooms only exist in the hub, so their parent room is used.
+func (r *Room) BackendRoomId() string {
+	if r.parent != nil {
+		return r.parent.Id()
+	}
+
+	return r.id
+}
+
+func (r *Room) Parent() *Room {
+	return r.parent
+}
+
 func (r *Room) Properties() *json.RawMessage {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -164,6 +248,32 @@ func (r *Room) Backend() *Backend {
 	return r.backend
 }
 
+type roomTypeProperties struct {
+	Type int `json:"type"`
+}
+
+// UsesAudioBridge returns true if the audio of the room should be mixed by
+// the MCU instead of sending individual streams to the participants.
+func (r *Room) UsesAudioBridge() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.usesAudioBridgeLocked()
+}
+
+func (r *Room) usesAudioBridgeLocked() bool {
+	if r.backend == nil {
+		return false
+	}
+
+	var properties roomTypeProperties
+	if r.properties != nil {
+		if err := json.Unmarshal(*r.properties, &properties); err != nil {
+			return false
+		}
+	}
+	return r.backend.UseAudioBridge(properties.Type)
+}
+
 func (r *Room) IsEqual(other *Room) bool {
 	if r == other {
 		return true
@@ -186,8 +296,20 @@ func (r *Room) IsEqual(other *Room) bool {
 	return b1.Id() == b2.Id()
 }
 
+// getPingInterval returns the time until the active sessions of the room
+// should be sent to the backend again.
+func (r *Room) getPingInterval() time.Duration {
+	r.mu.RLock()
+	busy := len(r.inCallSessions) > 0
+	r.mu.RUnlock()
+	return r.hub.roomPingIntervals.get(r.backend, busy)
+}
+
 func (r *Room) run() {
-	ticker := time.NewTicker(updateActiveSessionsInterval)
+	ticker := time.NewTicker(updateRoomStatsInterval)
+	defer ticker.Stop()
+	pingTimer := time.NewTimer(r.getPingInterval())
+	defer pingTimer.Stop()
 loop:
 	for {
 		select {
@@ -197,8 +319,15 @@ loop:
 			if msg != nil {
 				r.processNatsMessage(msg)
 			}
-		case <-ticker.C:
+		case msg := <-r.historyReceiver:
+			if msg != nil {
+				r.processHistoryMessage(msg)
+			}
+		case <-pingTimer.C:
 			r.publishActiveSessions()
+			pingTimer.Reset(r.getPingInterval())
+		case <-ticker.C:
+			r.updateQualityStats()
 		}
 	}
 }
@@ -223,11 +352,30 @@ func (r *Room) unsubscribeBackend() {
 	r.backendSubscription = nil
 }
 
+func (r *Room) unsubscribeHistory() {
+	if r.historySubscription == nil {
+		return
+	}
+
+	go func(subscription NatsSubscription) {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Error closing history subscription for room %s: %s", r.Id(), err)
+		}
+	}(r.historySubscription)
+	r.historySubscription = nil
+}
+
 func (r *Room) Close() []Session {
 	r.hub.removeRoom(r)
 	r.doClose()
+	r.reactions.Close()
+	r.typing.Close()
+	if r.speakers != nil {
+		r.speakers.Close()
+	}
 	r.mu.Lock()
 	r.unsubscribeBackend()
+	r.unsubscribeHistory()
 	result := make([]Session, 0, len(r.sessions))
 	for _, s := range r.sessions {
 		result = append(result, s)
@@ -236,6 +384,7 @@ func (r *Room) Close() []Session {
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeClient})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeInternal})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeVirtual})
+	r.deleteQualityStats()
 	r.mu.Unlock()
 	return result
 }
@@ -250,11 +399,37 @@ func (r *Room) processNatsMessage(message *nats.Msg) {
 	switch msg.Type {
 	case "room":
 		r.processBackendRoomRequest(msg.Room)
+	case "reaction":
+		if msg.Reaction != nil {
+			r.processReaction(msg.Reaction)
+		}
 	default:
 		log.Printf("Unsupported NATS room request with type %s: %+v", msg.Type, msg)
 	}
 }
 
+func (r *Room) processHistoryMessage(message *nats.Msg) {
+	msg, err := r.DecodeNatsMessage(message)
+	if err != nil {
+		log.Printf("Could not decode nats message %+v, %s", message, err)
+		return
+	}
+
+	if msg.Type == "message" {
+		r.history.Add(msg.Message, msg.SendTime)
+	}
+}
+
+// GetHistory returns the messages recently sent to the room that should be
+// replayed to the given session after joining.
+func (r *Room) GetHistory(sessionId string) []*ServerMessage {
+	if r.history == nil {
+		return nil
+	}
+
+	return r.history.Get(sessionId)
+}
+
 func (r *Room) processBackendRoomRequest(message *BackendServerRoomRequest) {
 	received := message.ReceivedTime
 	if last, found := r.lastNatsRoomRequests[message.Type]; found && last > received {
@@ -295,6 +470,13 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 		}
 	}
 
+	var metadata map[string]interface{}
+	var muted MediaType
+	if clientSession, ok := session.(*ClientSession); ok {
+		metadata = clientSession.GetMetadata()
+		muted = clientSession.GetMutedMedia()
+	}
+
 	sid := session.PublicId()
 	r.mu.Lock()
 	_, found := r.sessions[sid]
@@ -327,6 +509,12 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 		r.roomSessionData[sid] = roomSessionData
 		log.Printf("Session %s sent room session data %+v", session.PublicId(), roomSessionData)
 	}
+	if len(metadata) > 0 {
+		r.sessionMetadata[sid] = metadata
+	}
+	if muted != 0 {
+		r.mutedMedia[sid] = muted
+	}
 	r.mu.Unlock()
 	if !found {
 		r.PublishSessionJoined(session, roomSessionData)
@@ -338,6 +526,11 @@ func (r *Room) AddSession(session Session, sessionData *json.RawMessage) []Sessi
 		}
 		if clientSession, ok := session.(*ClientSession); ok {
 			r.transientData.AddListener(clientSession)
+			r.reactions.AddListener(clientSession)
+			r.typing.AddListener(clientSession)
+			if r.speakers != nil {
+				r.speakers.AddListener(clientSession)
+			}
 		}
 	}
 	return result
@@ -357,6 +550,198 @@ func (r *Room) IsSessionInCall(session Session) bool {
 	return result
 }
 
+// GetCallSize returns the number of participants in the call, as reported by
+// the backend or known to this server.
+func (r *Room) GetCallSize() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := 0
+	for _, user := range r.users {
+		if value, found := user["inCall"]; found {
+			if inCall, ok := IsInCall(value); ok && inCall {
+				count++
+			}
+		}
+	}
+	if len(r.inCallSessions) > count {
+		count = len(r.inCallSessions)
+	}
+	return count
+}
+
+func (r *Room) setSessionInCall(session Session, inCall bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if inCall {
+		r.inCallSessions[session] = true
+	} else {
+		delete(r.inCallSessions, session)
+	}
+}
+
+// prewarmSubscribers creates the subscribers for the video streams of the
+// sessions that spoke most recently, so the media is available faster once
+// the client requests them after joining the call.
+func (r *Room) prewarmSubscribers(session *ClientSession) {
+	count := r.hub.prewarmSubscribers
+	if count <= 0 || r.speakers == nil || r.hub.mcu == nil || session.ClientType() == HelloClientTypeInternal {
+		return
+	}
+
+	if policy := r.hub.getSubscriberPolicy(); policy != nil {
+		if maxSubscribers := policy.GetMaxVideoSubscribers(r.GetCallSize()); maxSubscribers > 0 && maxSubscribers < count {
+			count = maxSubscribers
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.hub.mcuTimeout)
+	defer cancel()
+
+	for _, sessionId := range r.speakers.GetRecentSpeakers(count) {
+		if sessionId == session.PublicId() {
+			continue
+		}
+
+		speaker, ok := r.hub.GetSessionByPublicId(sessionId).(*ClientSession)
+		if !ok || !r.IsSessionInCall(speaker) || speaker.GetPublisher(streamTypeVideo) == nil {
+			continue
+		}
+
+		if !r.IsSessionInCall(session) {
+			// The session left the call in the meantime.
+			return
+		}
+
+		if _, err := session.GetOrCreateSubscriber(ctx, r.hub.mcu, sessionId, streamTypeVideo); err != nil {
+			log.Printf("Could not prewarm subscriber for %s in session %s: %s", sessionId, session.PublicId(), err)
+		}
+	}
+}
+
+// RemoveSessionFromCall removes a session from the call and notifies the
+// participants. The backend is informed separately by the caller.
+func (r *Room) RemoveSessionFromCall(session Session) bool {
+	r.mu.Lock()
+	_, found := r.inCallSessions[session]
+	delete(r.inCallSessions, session)
+	r.mu.Unlock()
+	if !found {
+		return false
+	}
+
+	log.Printf("Session %s was removed from call %s", session.PublicId(), r.id)
+	if clientSession, ok := session.(*ClientSession); ok {
+		clientSession.LeaveCall()
+	}
+
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: r.id,
+				Changed: []map[string]interface{}{
+					{
+						"sessionId": session.PublicId(),
+						"inCall":    FlagDisconnected,
+					},
+				},
+				Users: r.addInternalSessions(r.getUsers()),
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish incall message in room %s: %s", r.Id(), err)
+	}
+	return true
+}
+
+// GetSessions returns the sessions that are currently in the room.
+func (r *Room) GetSessions() []Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		result = append(result, s)
+	}
+	return result
+}
+
+// GetStats returns the statistics of the sessions in the room that are
+// connected to this server.
+// GetParticipantCounts returns the number of sessions in the room and how many
+// of them are in the call.
+func (r *Room) GetParticipantCounts() (participants int, inCall int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions), len(r.inCallSessions)
+}
+
+func (r *Room) GetStats() *RoomStats {
+	r.mu.RLock()
+	sessions := make([]Session, 0, len(r.sessions))
+	inCall := make(map[Session]bool, len(r.inCallSessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session)
+		if r.inCallSessions[session] {
+			inCall[session] = true
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].PublicId() < sessions[j].PublicId()
+	})
+	stats := &RoomStats{
+		RoomId:       r.id,
+		Backend:      r.backend.Id(),
+		Participants: len(sessions),
+		InCall:       len(inCall),
+		Quality:      getRoomQualityStats(sessions),
+		Sessions:     make([]*RoomStatsSession, 0, len(sessions)),
+	}
+	if r.parent != nil {
+		stats.Parent = r.parent.Id()
+	}
+	for _, session := range sessions {
+		sessionStats := &RoomStatsSession{
+			SessionId:  session.PublicId(),
+			ClientType: session.ClientType(),
+			UserId:     session.UserId(),
+			InCall:     inCall[session],
+		}
+		if clientSession, ok := session.(*ClientSession); ok {
+			sessionStats.Quality = clientSession.GetQualityStats()
+			publishers := clientSession.GetPublishers()
+			streamTypes := make([]string, 0, len(publishers))
+			for streamType := range publishers {
+				streamTypes = append(streamTypes, streamType)
+			}
+			sort.Strings(streamTypes)
+			for _, streamType := range streamTypes {
+				publisher := &RoomStatsPublisher{
+					StreamType: streamType,
+				}
+				if p, ok := publishers[streamType].(McuClientWithProxy); ok {
+					publisher.Proxy = p.ProxyUrl()
+					if publisher.Proxy != "" {
+						if stats.Proxies == nil {
+							stats.Proxies = make(map[string]int)
+						}
+						stats.Proxies[publisher.Proxy]++
+					}
+				}
+				sessionStats.Publishers = append(sessionStats.Publishers, publisher)
+			}
+			stats.Publishers += len(publishers)
+		}
+		stats.Sessions = append(stats.Sessions, sessionStats)
+	}
+	return stats
+}
+
 // Returns "true" if there are still clients in the room.
 func (r *Room) RemoveSession(session Session) bool {
 	r.mu.Lock()
@@ -374,49 +759,213 @@ func (r *Room) RemoveSession(session Session) bool {
 	}
 	if clientSession, ok := session.(*ClientSession); ok {
 		r.transientData.RemoveListener(clientSession)
+		r.reactions.RemoveListener(clientSession)
+		r.typing.RemoveListener(clientSession)
+		if r.speakers != nil {
+			r.speakers.RemoveListener(clientSession)
+		}
 	}
+	if r.speakers != nil {
+		r.speakers.RemoveSession(sid)
+	}
+	r.lowerHandOfRemovedSession(sid)
+	// Notify asynchronously as the session lock might be held by the caller.
+	go r.typing.RemoveSession(sid)
 	delete(r.inCallSessions, session)
 	delete(r.roomSessionData, sid)
-	if len(r.sessions) > 0 {
+	delete(r.recordingConsent, sid)
+	delete(r.sessionMetadata, sid)
+	delete(r.mutedMedia, sid)
+	delete(r.onHoldSessions, sid)
+	if len(r.sessions) > 0 || len(r.observers) > 0 {
 		r.mu.Unlock()
+		if _, ok := session.(*ClientSession); ok {
+			r.PublishersChanged()
+		}
 		r.PublishSessionLeft(session)
 		return true
 	}
 
+	r.closeEmptyLocked()
+	r.mu.Unlock()
+	return false
+}
+
+// AddVirtualSessions adds multiple virtual sessions to the room. Other
+// sessions are notified with a single event instead of one per session.
+func (r *Room) AddVirtualSessions(sessions []*VirtualSession) {
+	r.mu.Lock()
+	added := make([]*VirtualSession, 0, len(sessions))
+	for _, session := range sessions {
+		sid := session.PublicId()
+		if _, found := r.sessions[sid]; found {
+			continue
+		}
+
+		r.sessions[sid] = session
+		r.virtualSessions[session] = true
+		r.statsRoomSessionsCurrent.With(prometheus.Labels{"clienttype": session.ClientType()}).Inc()
+		added = append(added, session)
+	}
+	r.mu.Unlock()
+	if len(added) == 0 {
+		return
+	}
+
+	entries := make([]*EventServerMessageSessionEntry, 0, len(added))
+	for _, session := range added {
+		entries = append(entries, newEventServerMessageSessionEntry(session))
+	}
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "join",
+			Join:   entries,
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish sessions joined message in room %s: %s", r.Id(), err)
+	}
+
+	r.publishUsersChangedWithInternal()
+	for _, session := range added {
+		if session.Flags() != 0 {
+			r.publishSessionFlagsChanged(session)
+		}
+	}
+}
+
+// RemoveVirtualSessions removes multiple virtual sessions from the room.
+// Other sessions are notified with a single event instead of one per session.
+// Returns "true" if there are still clients in the room.
+func (r *Room) RemoveVirtualSessions(sessions []*VirtualSession) bool {
+	r.mu.Lock()
+	removed := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		sid := session.PublicId()
+		if _, found := r.sessions[sid]; !found {
+			continue
+		}
+
+		r.statsRoomSessionsCurrent.With(prometheus.Labels{"clienttype": session.ClientType()}).Dec()
+		delete(r.sessions, sid)
+		delete(r.virtualSessions, session)
+		r.lowerHandOfRemovedSession(sid)
+		delete(r.inCallSessions, session)
+		delete(r.roomSessionData, sid)
+		removed = append(removed, sid)
+	}
+	if len(removed) == 0 {
+		r.mu.Unlock()
+		return true
+	}
+	if len(r.sessions) > 0 || len(r.observers) > 0 {
+		r.mu.Unlock()
+		message := &ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "room",
+				Type:   "leave",
+				Leave:  removed,
+			},
+		}
+		if err := r.publish(message); err != nil {
+			log.Printf("Could not publish sessions left message in room %s: %s", r.Id(), err)
+		}
+		return true
+	}
+
+	r.closeEmptyLocked()
+	r.mu.Unlock()
+	return false
+}
+
+// AddObserver registers a session that joined the room as additional room.
+// Observers receive the messages of the room but are not participants.
+func (r *Room) AddObserver(session *ClientSession, roomSessionId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.observers[session] = roomSessionId
+}
+
+// Returns "true" if there are still clients or observers in the room.
+func (r *Room) RemoveObserver(session *ClientSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.observers[session]; !found {
+		return true
+	}
+
+	delete(r.observers, session)
+	if len(r.sessions) > 0 || len(r.observers) > 0 {
+		return true
+	}
+
+	r.closeEmptyLocked()
+	return false
+}
+
+func (r *Room) GetObservers() []*ClientSession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]*ClientSession, 0, len(r.observers))
+	for s := range r.observers {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (r *Room) closeEmptyLocked() {
 	r.hub.removeRoom(r)
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeClient})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeInternal})
 	r.statsRoomSessionsCurrent.Delete(prometheus.Labels{"clienttype": HelloClientTypeVirtual})
+	r.deleteQualityStats()
 	r.unsubscribeBackend()
+	r.unsubscribeHistory()
 	r.doClose()
-	r.mu.Unlock()
-	return false
+	r.reactions.Close()
+	r.typing.Close()
+	if r.speakers != nil {
+		r.speakers.Close()
+	}
 }
 
 func (r *Room) publish(message *ServerMessage) error {
-	return r.nats.PublishMessage(GetSubjectForRoomId(r.id, r.backend), message)
+	return r.nats.PublishMessage(r.subject, message)
+}
+
+// DecodeNatsMessage decodes a message received on the subject of the room.
+// The result is shared by all local sessions and may not be modified.
+func (r *Room) DecodeNatsMessage(msg *nats.Msg) (*NatsMessage, error) {
+	return r.messages.Decode(r.nats, msg)
 }
 
-func (r *Room) UpdateProperties(properties *json.RawMessage) {
+// UpdateProperties stores the properties of the room and notifies the
+// participants, returns false if the properties didn't change.
+func (r *Room) UpdateProperties(properties *json.RawMessage) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if (r.properties == nil && properties == nil) ||
 		(r.properties != nil && properties != nil && bytes.Equal(*r.properties, *properties)) {
 		// Don't notify if properties didn't change.
-		return
+		return false
 	}
 
 	r.properties = properties
 	message := &ServerMessage{
 		Type: "room",
 		Room: &RoomServerMessage{
-			RoomId:     r.id,
-			Properties: r.properties,
+			RoomId:      r.id,
+			Properties:  r.properties,
+			AudioBridge: r.usesAudioBridgeLocked(),
 		},
 	}
 	if err := r.publish(message); err != nil {
 		log.Printf("Could not publish update properties message in room %s: %s", r.Id(), err)
 	}
+	return true
 }
 
 func (r *Room) GetRoomSessionData(session Session) *RoomSessionData {
@@ -490,7 +1039,11 @@ func (r *Room) PublishSessionLeft(session Session) {
 func (r *Room) addInternalSessions(users []map[string]interface{}) []map[string]interface{} {
 	now := time.Now().Unix()
 	r.mu.Lock()
-	for _, user := range users {
+	// Don't modify the passed list, it might be shared with other messages.
+	result := make([]map[string]interface{}, len(users), len(users)+len(r.internalSessions)+len(r.virtualSessions))
+	copy(result, users)
+	users = result
+	for idx, user := range users {
 		sessionid, found := user["sessionId"]
 		if !found || sessionid == "" {
 			continue
@@ -501,6 +1054,21 @@ func (r *Room) addInternalSessions(users []map[string]interface{}) []map[string]
 				user["userId"] = roomSessionData.UserId
 			}
 		}
+		if consent, found := r.recordingConsent[sessionid.(string)]; found {
+			user = withRecordingConsent(user, consent)
+			users[idx] = user
+		}
+		if metadata, found := r.sessionMetadata[sessionid.(string)]; found {
+			user = withSessionMetadata(user, metadata)
+			users[idx] = user
+		}
+		if muted, found := r.mutedMedia[sessionid.(string)]; found {
+			user = withMuteState(user, muted)
+			users[idx] = user
+		}
+		if r.onHoldSessions[sessionid.(string)] {
+			users[idx] = withCallState(user, CallStateOnHold)
+		}
 	}
 	for session := range r.internalSessions {
 		users = append(users, map[string]interface{}{
@@ -549,8 +1117,24 @@ func IsInCall(value interface{}) (bool, bool) {
 	}
 }
 
-func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users []map[string]interface{}) {
+func (r *Room) setUsers(users []map[string]interface{}) []map[string]interface{} {
+	users = r.filterPermissions(users)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	users, r.rosterStrings = internRosterStrings(users, r.rosterStrings)
 	r.users = users
+	return users
+}
+
+func (r *Room) getUsers() []map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.users
+}
+
+func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users []map[string]interface{}) {
+	users = r.setUsers(users)
 	for _, user := range changed {
 		inCallInterface, found := user["inCall"]
 		if !found {
@@ -581,11 +1165,15 @@ func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users
 
 		if inCall {
 			r.mu.Lock()
-			if !r.inCallSessions[session] {
+			joined := !r.inCallSessions[session]
+			if joined {
 				r.inCallSessions[session] = true
 				log.Printf("Session %s joined call %s", session.PublicId(), r.id)
 			}
 			r.mu.Unlock()
+			if clientSession, ok := session.(*ClientSession); ok && joined {
+				go r.prewarmSubscribers(clientSession)
+			}
 		} else {
 			r.mu.Lock()
 			delete(r.inCallSessions, session)
@@ -597,7 +1185,6 @@ func (r *Room) PublishUsersInCallChanged(changed []map[string]interface{}, users
 	}
 
 	changed = r.filterPermissions(changed)
-	users = r.filterPermissions(users)
 
 	message := &ServerMessage{
 		Type: "event",
@@ -710,8 +1297,6 @@ func (r *Room) PublishUsersChanged(changed []map[string]interface{}, users []map
 }
 
 func (r *Room) getParticipantsUpdateMessage(users []map[string]interface{}) *ServerMessage {
-	users = r.filterPermissions(users)
-
 	message := &ServerMessage{
 		Type: "event",
 		Event: &EventServerMessage{
@@ -727,7 +1312,7 @@ func (r *Room) getParticipantsUpdateMessage(users []map[string]interface{}) *Ser
 }
 
 func (r *Room) NotifySessionResumed(session *ClientSession) {
-	message := r.getParticipantsUpdateMessage(r.users)
+	message := r.getParticipantsUpdateMessage(r.getUsers())
 	if len(message.Event.Update.Users) == 0 {
 		return
 	}
@@ -750,7 +1335,7 @@ func (r *Room) NotifySessionChanged(session Session) {
 }
 
 func (r *Room) publishUsersChangedWithInternal() {
-	message := r.getParticipantsUpdateMessage(r.users)
+	message := r.getParticipantsUpdateMessage(r.getUsers())
 	if err := r.publish(message); err != nil {
 		log.Printf("Could not publish users changed message in room %s: %s", r.Id(), err)
 	}
@@ -775,6 +1360,12 @@ func (r *Room) publishSessionFlagsChanged(session *VirtualSession) {
 }
 
 func (r *Room) publishActiveSessions() (int, *sync.WaitGroup) {
+	if r.hub.backend.backends.IsInMaintenance(r.backend) {
+		// Will be resynchronized once the maintenance has ended.
+		var wg sync.WaitGroup
+		return 0, &wg
+	}
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -818,6 +1409,26 @@ func (r *Room) publishActiveSessions() (int, *sync.WaitGroup) {
 			UserId:    uid,
 		})
 	}
+	for session, sid := range r.observers {
+		u := session.BackendUrl()
+		if u == "" || sid == "" {
+			continue
+		}
+
+		e, found := entries[u]
+		if !found {
+			p := session.ParsedBackendUrl()
+			if p == nil {
+				continue
+			}
+			urls[u] = p
+		}
+
+		entries[u] = append(e, BackendPingEntry{
+			SessionId: sid,
+			UserId:    session.AuthUserId(),
+		})
+	}
 	var wg sync.WaitGroup
 	if len(urls) == 0 {
 		return 0, &wg
@@ -829,7 +1440,13 @@ func (r *Room) publishActiveSessions() (int, *sync.WaitGroup) {
 			ctx, cancel := context.WithTimeout(context.Background(), r.hub.backendTimeout)
 			defer cancel()
 
-			request := NewBackendClientPingRequest(r.id, entries)
+			if r.hub.backend.UseBatchPing(ctx, url) {
+				// Will be sent together with the sessions of other rooms.
+				r.hub.roomPing.Add(url, r.BackendRoomId(), entries)
+				return
+			}
+
+			request := NewBackendClientPingRequest(r.BackendRoomId(), entries)
 			var response BackendClientResponse
 			if err := r.hub.backend.PerformJSONRequest(ctx, url, request, &response); err != nil {
 				log.Printf("Error pinging room %s for active entries %+v: %s", r.id, entries, err)
@@ -883,3 +1500,80 @@ func (r *Room) SetTransientData(key string, value interface{}) {
 func (r *Room) RemoveTransientData(key string) {
 	r.transientData.Remove(key)
 }
+
+// publishReaction sends a change of the raised hands or an emoji reaction to
+// all servers with sessions in the room, including the local one.
+func (r *Room) publishReaction(reaction *NatsReactionMessage) {
+	msg := &NatsMessage{
+		SendTime: time.Now(),
+		Type:     "reaction",
+		Reaction: reaction,
+	}
+	if err := r.nats.PublishNats(GetSubjectForBackendRoomId(r.id, r.backend), msg); err != nil {
+		log.Printf("Could not publish %s reaction in room %s: %s", reaction.Type, r.Id(), err)
+	}
+}
+
+func (r *Room) processReaction(reaction *NatsReactionMessage) {
+	switch reaction.Type {
+	case "raisehand":
+		r.reactions.RaiseHandAt(reaction.SessionId, reaction.Timestamp)
+	case "lowerhand":
+		r.reactions.LowerHand(reaction.SessionId)
+	case "emoji":
+		r.reactions.AddEmoji(reaction.Emoji)
+	default:
+		log.Printf("Unsupported NATS reaction with type %s in room %s", reaction.Type, r.Id())
+	}
+}
+
+func (r *Room) RaiseHand(session Session) {
+	r.publishReaction(&NatsReactionMessage{
+		Type:      "raisehand",
+		SessionId: session.PublicId(),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// LowerHand lowers the hand of a session, which may be connected to a
+// different server.
+func (r *Room) LowerHand(sessionId string) {
+	r.publishReaction(&NatsReactionMessage{
+		Type:      "lowerhand",
+		SessionId: sessionId,
+	})
+}
+
+// lowerHandOfRemovedSession lowers the hand of a session that left the room.
+// The local state is updated directly as the room might be closed before the
+// published change is received.
+func (r *Room) lowerHandOfRemovedSession(sessionId string) {
+	if r.reactions.LowerHand(sessionId) {
+		r.LowerHand(sessionId)
+	}
+}
+
+func (r *Room) AddReaction(emoji string) {
+	r.publishReaction(&NatsReactionMessage{
+		Type:  "emoji",
+		Emoji: emoji,
+	})
+}
+
+func (r *Room) StartTyping(session Session) bool {
+	return r.typing.StartTyping(session.PublicId())
+}
+
+func (r *Room) StopTyping(session Session) bool {
+	return r.typing.StopTyping(session.PublicId())
+}
+
+// SetTalking updates the talking state of a session for active speaker
+// events. Does nothing if active speaker events are disabled.
+func (r *Room) SetTalking(session Session, talking bool, level float64) {
+	if r.speakers == nil {
+		return
+	}
+
+	r.speakers.SetTalking(session.PublicId(), talking, level)
+}
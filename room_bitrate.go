@@ -0,0 +1,112 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+)
+
+// PublishersChanged must be called if a session in the room started or
+// stopped publishing. The bitrate limits of the publishers in the room are
+// updated in the background.
+func (r *Room) PublishersChanged() {
+	if r.hub.getBitratePolicy() == nil {
+		// Limits that were applied before the policy was removed are reset
+		// when reloading the configuration.
+		return
+	}
+
+	go r.updatePublisherBitrates()
+}
+
+func (r *Room) updatePublisherBitrates() {
+	r.bitrateMu.Lock()
+	defer r.bitrateMu.Unlock()
+
+	policy := r.hub.getBitratePolicy()
+	if policy == nil && len(r.bitrateLimits) == 0 {
+		return
+	}
+
+	var publishers []McuPublisher
+	var screenPublishers []McuPublisher
+	for _, session := range r.GetSessions() {
+		clientSession, ok := session.(*ClientSession)
+		if !ok {
+			continue
+		}
+
+		if publisher := clientSession.GetPublisher(streamTypeVideo); publisher != nil && publisher.HasMedia(MediaTypeVideo) {
+			publishers = append(publishers, publisher)
+		}
+		if publisher := clientSession.GetPublisher(streamTypeScreen); publisher != nil {
+			screenPublishers = append(screenPublishers, publisher)
+		}
+	}
+
+	bitrate := 0
+	screenBitrate := 0
+	if policy != nil {
+		bitrate = policy.GetStreamBitrate(len(publishers), len(screenPublishers) > 0)
+		screenBitrate = policy.GetScreenBitrate(len(screenPublishers))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.hub.mcuTimeout)
+	defer cancel()
+
+	limits := make(map[McuPublisher]int)
+	for _, publisher := range publishers {
+		r.updatePublisherBitrate(ctx, publisher, bitrate, limits)
+	}
+	for _, publisher := range screenPublishers {
+		r.updatePublisherBitrate(ctx, publisher, screenBitrate, limits)
+	}
+	r.bitrateLimits = limits
+}
+
+func (r *Room) updatePublisherBitrate(ctx context.Context, publisher McuPublisher, bitrate int, limits map[McuPublisher]int) {
+	limiter, ok := publisher.(McuBitrateLimiter)
+	if !ok {
+		return
+	}
+
+	// Publishers without a limit are not stored, so "prev" is 0 for them.
+	if prev := r.bitrateLimits[publisher]; prev == bitrate {
+		if prev != 0 {
+			limits[publisher] = prev
+		}
+		return
+	}
+
+	if err := limiter.SetMaxBitrate(ctx, bitrate); err != nil {
+		log.Printf("Could not set maximum bitrate of %s publisher %s in room %s to %d: %s", publisher.StreamType(), publisher.Id(), r.Id(), bitrate, err)
+		return
+	}
+
+	if bitrate != 0 {
+		log.Printf("Limited bitrate of %s publisher %s in room %s to %d", publisher.StreamType(), publisher.Id(), r.Id(), bitrate)
+		limits[publisher] = bitrate
+	} else {
+		log.Printf("Removed bitrate limit of %s publisher %s in room %s", publisher.StreamType(), publisher.Id(), r.Id())
+	}
+}
@@ -0,0 +1,248 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// BreakoutRooms contains the state of breakout rooms that have been started
+// from a room by a moderator.
+type BreakoutRooms struct {
+	parent    *Room
+	moderator *ClientSession
+	rooms     map[string]*Room
+}
+
+func (h *Hub) processBreakoutMsg(client *Client, message *ClientMessage) {
+	msg := message.Breakout
+	session := client.GetSession()
+	if session == nil {
+		// Client is not connected yet.
+		return
+	}
+
+	room := session.GetRoom()
+	if room == nil {
+		response := message.NewErrorServerMessage(NewError("not_in_room", "No room joined yet."))
+		session.SendMessage(response)
+		return
+	}
+
+	if !isAllowedToControl(session) {
+		sendNotAllowed(session, message, "Not allowed to manage breakout rooms.")
+		return
+	}
+
+	if room.Parent() != nil {
+		response := message.NewErrorServerMessage(NewError("breakout_nested", "Breakout rooms can not be nested."))
+		session.SendMessage(response)
+		return
+	}
+
+	switch msg.Type {
+	case "start":
+		h.startBreakoutRooms(session, message, room)
+	case "end":
+		h.endBreakoutRooms(session, message, room)
+	}
+}
+
+func (h *Hub) startBreakoutRooms(session *ClientSession, message *ClientMessage, room *Room) {
+	internalRoomId := getRoomIdForBackend(room.Id(), room.Backend())
+
+	h.ru.Lock()
+	if _, found := h.breakoutRooms[internalRoomId]; found {
+		h.ru.Unlock()
+		response := message.NewErrorServerMessage(NewError("breakout_active", "Breakout rooms are already active."))
+		session.SendMessage(response)
+		return
+	}
+
+	for roomId := range message.Breakout.Rooms {
+		if _, found := h.rooms[getRoomIdForBackend(roomId, room.Backend())]; found {
+			h.ru.Unlock()
+			response := message.NewErrorServerMessage(NewError("room_exists", fmt.Sprintf("A room with id %s already exists.", roomId)))
+			session.SendMessage(response)
+			return
+		}
+	}
+
+	breakout := &BreakoutRooms{
+		parent:    room,
+		moderator: session,
+		rooms:     make(map[string]*Room),
+	}
+	for roomId := range message.Breakout.Rooms {
+		r, err := h.createRoom(roomId, room.Properties(), room.Backend())
+		if err != nil {
+			for _, created := range breakout.rooms {
+				created.Close()
+			}
+			h.ru.Unlock()
+			session.SendMessage(message.NewWrappedErrorServerMessage(err))
+			return
+		}
+
+		r.parent = room
+		breakout.rooms[roomId] = r
+	}
+	h.breakoutRooms[internalRoomId] = breakout
+	h.ru.Unlock()
+
+	moved := make(map[string][]string)
+	for roomId, sessionIds := range message.Breakout.Rooms {
+		target := breakout.rooms[roomId]
+		if err := session.SubscribeBreakoutRoomNats(h.nats, target); err != nil {
+			log.Printf("Could not subscribe session %s to breakout room %s: %s", session.PublicId(), roomId, err)
+		}
+
+		for _, sessionId := range sessionIds {
+			s, ok := h.GetSessionByPublicId(sessionId).(*ClientSession)
+			if !ok || s == session || s.GetRoom() != room {
+				// Only participants of the parent room can be moved.
+				continue
+			}
+
+			if err := h.moveSessionToRoom(s, room, target); err != nil {
+				log.Printf("Could not move session %s to breakout room %s: %s", sessionId, roomId, err)
+				continue
+			}
+
+			moved[roomId] = append(moved[roomId], sessionId)
+		}
+	}
+
+	log.Printf("Session %s started %d breakout rooms in room %s", session.PublicId(), len(breakout.rooms), room.Id())
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "breakout",
+		Breakout: &BreakoutServerMessage{
+			Type:   "started",
+			RoomId: room.Id(),
+			Rooms:  moved,
+		},
+	})
+}
+
+func (h *Hub) endBreakoutRooms(session *ClientSession, message *ClientMessage, room *Room) {
+	internalRoomId := getRoomIdForBackend(room.Id(), room.Backend())
+
+	h.ru.Lock()
+	breakout, found := h.breakoutRooms[internalRoomId]
+	if found {
+		delete(h.breakoutRooms, internalRoomId)
+	}
+	h.ru.Unlock()
+	if !found {
+		response := message.NewErrorServerMessage(NewError("breakout_not_active", "No breakout rooms are active."))
+		session.SendMessage(response)
+		return
+	}
+
+	breakout.moderator.UnsubscribeBreakoutRoomsNats()
+	for roomId, r := range breakout.rooms {
+		for _, s := range r.GetSessions() {
+			if s, ok := s.(*ClientSession); ok {
+				if err := h.moveSessionToRoom(s, r, room); err != nil {
+					log.Printf("Could not move session %s back from breakout room %s: %s", s.PublicId(), roomId, err)
+				}
+			}
+		}
+		h.closeRoomSessions(r)
+	}
+
+	log.Printf("Session %s ended breakout rooms in room %s", session.PublicId(), room.Id())
+	session.SendMessage(&ServerMessage{
+		Id:   message.Id,
+		Type: "breakout",
+		Breakout: &BreakoutServerMessage{
+			Type:   "ended",
+			RoomId: room.Id(),
+		},
+	})
+}
+
+// closeBreakoutRooms closes all breakout rooms of the given room, the sessions
+// in them will leave their room.
+func (h *Hub) closeBreakoutRooms(room *Room) {
+	internalRoomId := getRoomIdForBackend(room.Id(), room.Backend())
+
+	h.ru.Lock()
+	breakout, found := h.breakoutRooms[internalRoomId]
+	if found {
+		delete(h.breakoutRooms, internalRoomId)
+	}
+	h.ru.Unlock()
+	if !found {
+		return
+	}
+
+	breakout.moderator.UnsubscribeBreakoutRoomsNats()
+	for _, r := range breakout.rooms {
+		h.closeRoomSessions(r)
+	}
+}
+
+func (h *Hub) closeRoomSessions(room *Room) {
+	sessions := room.Close()
+	for _, session := range sessions {
+		session.LeaveRoom(true)
+		if sess, ok := session.(*ClientSession); ok {
+			h.sendRoom(sess, nil, nil)
+		}
+	}
+}
+
+// moveSessionToRoom moves a session between a room and its breakout room
+// without notifying the backend, the session stays in the backend room.
+func (h *Hub) moveSessionToRoom(session *ClientSession, from *Room, to *Room) error {
+	var sessionData *json.RawMessage
+	if data := from.GetRoomSessionData(session); data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		raw := json.RawMessage(encoded)
+		sessionData = &raw
+	}
+	inCall := from.IsSessionInCall(session)
+	roomSessionId := session.RoomSessionId()
+
+	session.LeaveRoom(false)
+	if err := session.SubscribeRoomNats(h.nats, to.Id(), roomSessionId); err != nil {
+		// The client (implicitly) left the room due to an error.
+		h.sendRoom(session, nil, nil)
+		return err
+	}
+
+	session.SetRoom(to)
+	h.sendRoom(session, nil, to)
+	h.notifyUserJoinedRoom(to, session, sessionData)
+	if inCall {
+		to.setSessionInCall(session, true)
+	}
+	return nil
+}
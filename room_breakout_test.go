@@ -0,0 +1,175 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func runUntilMessageOfType(ctx context.Context, client *TestClient, messageType string) (*ServerMessage, error) {
+	for {
+		msg, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Type == messageType {
+			return msg, nil
+		}
+	}
+}
+
+func Test_BreakoutRooms(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+
+	breakoutRoomId := "test-breakout"
+	rooms := map[string][]string{
+		breakoutRoomId: {hello2.Hello.SessionId},
+	}
+
+	// Only moderators may start breakout rooms.
+	if err := client2.SendBreakout("start", rooms); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client2, "error"); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.SendBreakout("start", rooms); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client1, "breakout"); err != nil {
+		t.Fatal(err)
+	} else if msg.Breakout.Type != "started" || msg.Breakout.RoomId != roomId {
+		t.Errorf("Expected started breakout rooms in %s, got %+v", roomId, msg.Breakout)
+	} else if !reflect.DeepEqual(msg.Breakout.Rooms, rooms) {
+		t.Errorf("Expected rooms %+v, got %+v", rooms, msg.Breakout.Rooms)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client2, "room"); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, breakoutRoomId); err != nil {
+		t.Fatal(err)
+	}
+
+	if room := session2.GetRoom(); room == nil || room.Id() != breakoutRoomId {
+		t.Fatalf("Expected session in room %s, got %+v", breakoutRoomId, room)
+	} else if room.BackendRoomId() != roomId {
+		t.Errorf("Expected backend room %s, got %s", roomId, room.BackendRoomId())
+	}
+
+	// Breakout rooms can not be started twice.
+	if err := client1.SendBreakout("start", map[string][]string{"other-breakout": {}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client1, "error"); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "breakout_active"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The moderator receives messages sent to the breakout room.
+	recipient := MessageClientMessageRecipient{
+		Type: "room",
+	}
+	data := "from-breakout"
+	if err := client2.SendMessage(recipient, data); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client1, "message"); err != nil {
+		t.Fatal(err)
+	} else if msg.Message.Sender.SessionId != hello2.Hello.SessionId {
+		t.Errorf("Expected message from %s, got %+v", hello2.Hello.SessionId, msg.Message.Sender)
+	}
+
+	if err := client1.SendBreakout("end", nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client1, "breakout"); err != nil {
+		t.Fatal(err)
+	} else if msg.Breakout.Type != "ended" || msg.Breakout.RoomId != roomId {
+		t.Errorf("Expected ended breakout rooms in %s, got %+v", roomId, msg.Breakout)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client2, "room"); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageRoomId(msg, roomId); err != nil {
+		t.Fatal(err)
+	}
+
+	if room := hub.getRoomForBackend(breakoutRoomId, session2.Backend()); room != nil {
+		t.Errorf("Breakout room %s should have been closed", breakoutRoomId)
+	}
+
+	if err := client1.SendBreakout("end", nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client1, "error"); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "breakout_not_active"); err != nil {
+		t.Fatal(err)
+	}
+}
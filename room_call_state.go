@@ -0,0 +1,123 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+)
+
+// withCallState returns a copy of the user entry with the call state of the
+// session set, the passed entry might be shared with other messages and must
+// not be modified.
+func withCallState(user map[string]interface{}, state string) map[string]interface{} {
+	result := make(map[string]interface{}, len(user)+1)
+	for k, v := range user {
+		result[k] = v
+	}
+	result["callState"] = state
+	return result
+}
+
+// GetSessionCallState returns the call state of a session in the room, or an
+// empty string if the session is not in the room.
+func (r *Room) GetSessionCallState(session Session) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.getSessionCallStateLocked(session)
+}
+
+func (r *Room) getSessionCallStateLocked(session Session) string {
+	sid := session.PublicId()
+	if _, found := r.sessions[sid]; !found {
+		return ""
+	} else if !r.inCallSessions[session] {
+		return CallStateJoined
+	} else if r.onHoldSessions[sid] {
+		return CallStateOnHold
+	}
+
+	return CallStateInCall
+}
+
+// SetSessionOnHold places the call of a session on hold or resumes it and
+// notifies the participants if the state changed. Only sessions in the call
+// can be placed on hold. Returns the new call state of the session.
+func (r *Room) SetSessionOnHold(session Session, onHold bool) (string, bool) {
+	sid := session.PublicId()
+	r.mu.Lock()
+	state := r.getSessionCallStateLocked(session)
+	switch state {
+	case CallStateInCall:
+		if !onHold {
+			r.mu.Unlock()
+			return state, false
+		}
+
+		r.onHoldSessions[sid] = true
+		state = CallStateOnHold
+	case CallStateOnHold:
+		if onHold {
+			r.mu.Unlock()
+			return state, false
+		}
+
+		delete(r.onHoldSessions, sid)
+		state = CallStateInCall
+	default:
+		r.mu.Unlock()
+		return state, false
+	}
+	r.mu.Unlock()
+	log.Printf("Session %s changed call state in room %s to %s", sid, r.Id(), state)
+	r.publishCallStateChanged(sid, state)
+	return state, true
+}
+
+// clearSessionOnHold resets the hold state of a session that left the call.
+func (r *Room) clearSessionOnHold(session Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.onHoldSessions, session.PublicId())
+}
+
+func (r *Room) publishCallStateChanged(sessionId string, state string) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: r.id,
+				Changed: []map[string]interface{}{
+					{
+						"sessionId": sessionId,
+						"callState": state,
+					},
+				},
+				Users: r.addInternalSessions(r.getUsers()),
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish call state message in room %s: %s", r.Id(), err)
+	}
+}
@@ -0,0 +1,219 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// runUntilNonEvent skips "event" messages that are sent to all participants
+// of the room, e.g. when the call state of a session changes.
+func runUntilNonEvent(ctx context.Context, t *testing.T, client *TestClient) *ServerMessage {
+	for {
+		message, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type != "event" {
+			return message
+		}
+	}
+}
+
+func checkCallState(message *ServerMessage, roomId string, state string) error {
+	if err := checkMessageType(message, "call"); err != nil {
+		return err
+	} else if message.Call.RoomId != roomId || message.Call.State != state {
+		return fmt.Errorf("Expected call state %s in room %s, got %+v", state, roomId, message.Call)
+	}
+	return nil
+}
+
+func TestClientCallHold(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasFeature(hello2.Hello.Server, ServerFeatureCallHold) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureCallHold, hello2.Hello.Server.Features)
+	}
+
+	roomId := "test-room"
+	for _, client := range []*TestClient{client1, client2} {
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+	}
+
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Could not find room %s", roomId)
+	}
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	if state := room.GetSessionCallState(session2); state != CallStateJoined {
+		t.Errorf("Expected call state %s, got %s", CallStateJoined, state)
+	}
+
+	// Only sessions in the call can be placed on hold.
+	if err := client2.SendCall("hold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageError(runUntilNonEvent(ctx, t, client2), "not_in_call"); err != nil {
+		t.Error(err)
+	}
+
+	users := []map[string]interface{}{
+		{
+			"sessionId": hello1.Hello.SessionId,
+			"inCall":    FlagInCall | FlagWithVideo,
+		},
+		{
+			"sessionId": hello2.Hello.SessionId,
+			"inCall":    FlagInCall | FlagWithVideo,
+		},
+	}
+	room.PublishUsersInCallChanged(users, users)
+	for _, client := range []*TestClient{client1, client2} {
+		if err := checkReceiveClientEvent(ctx, client, "update", nil); err != nil {
+			t.Error(err)
+		}
+	}
+	if state := room.GetSessionCallState(session2); state != CallStateInCall {
+		t.Errorf("Expected call state %s, got %s", CallStateInCall, state)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_MEDIA})
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := session2.GetOrCreateSubscriber(ctx, mcu, hello1.Hello.SessionId, streamTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscriber := sub.(*TestMCUSubscriber)
+
+	if err := client2.SendCall("hold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCallState(runUntilNonEvent(ctx, t, client2), roomId, CallStateOnHold); err != nil {
+		t.Error(err)
+	}
+	if state := room.GetSessionCallState(session2); state != CallStateOnHold {
+		t.Errorf("Expected call state %s, got %s", CallStateOnHold, state)
+	}
+	if !subscriber.isPaused() {
+		t.Error("Subscriber should be paused")
+	}
+
+	// No new streams can be subscribed while the call is on hold.
+	if err := client2.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "requestoffer",
+		Sid:      "12345",
+		RoomType: "screen",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageError(runUntilNonEvent(ctx, t, client2), "not_allowed"); err != nil {
+		t.Error(err)
+	}
+
+	if err := client2.SendCall("resume"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCallState(runUntilNonEvent(ctx, t, client2), roomId, CallStateInCall); err != nil {
+		t.Error(err)
+	}
+	if subscriber.isPaused() {
+		t.Error("Subscriber should no longer be paused")
+	}
+
+	// Leaving the call also resets the hold state.
+	if err := client2.SendCall("hold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCallState(runUntilNonEvent(ctx, t, client2), roomId, CallStateOnHold); err != nil {
+		t.Error(err)
+	}
+
+	room.RemoveSessionFromCall(session2)
+	if state := room.GetSessionCallState(session2); state != CallStateJoined {
+		t.Errorf("Expected call state %s, got %s", CallStateJoined, state)
+	}
+	room.setSessionInCall(session2, true)
+	if state := room.GetSessionCallState(session2); state != CallStateInCall {
+		t.Errorf("Expected call state %s, got %s", CallStateInCall, state)
+	}
+}
@@ -0,0 +1,123 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Default maximum age of messages in the room history.
+	defaultRoomHistoryMaxAge = time.Minute
+)
+
+type roomHistoryEntry struct {
+	sent    time.Time
+	message *ServerMessage
+}
+
+// RoomHistory keeps a bounded list of the last "message" and "control"
+// messages that were sent to a room, so they can be replayed to sessions
+// joining the room later.
+type RoomHistory struct {
+	mu          sync.Mutex
+	maxMessages int
+	maxAge      time.Duration
+	entries     []roomHistoryEntry
+
+	// Can be overwritten in tests.
+	getNow func() time.Time
+}
+
+// NewRoomHistory creates a new history that keeps at most "maxMessages"
+// messages which are not older than "maxAge".
+func NewRoomHistory(maxMessages int, maxAge time.Duration) *RoomHistory {
+	return &RoomHistory{
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		getNow:      time.Now,
+	}
+}
+
+// expireLocked removes messages that are too old.
+// Note: the mutex must be held.
+func (h *RoomHistory) expireLocked(now time.Time) {
+	expired := now.Add(-h.maxAge)
+	idx := 0
+	for idx < len(h.entries) && h.entries[idx].sent.Before(expired) {
+		idx++
+	}
+	if idx > 0 {
+		h.entries = append(h.entries[:0], h.entries[idx:]...)
+	}
+}
+
+// Add stores a message that was sent at the given time.
+func (h *RoomHistory) Add(message *ServerMessage, sent time.Time) {
+	if message == nil || (message.Type != "message" && message.Type != "control") {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.expireLocked(h.getNow())
+	if len(h.entries) >= h.maxMessages {
+		h.entries = append(h.entries[:0], h.entries[len(h.entries)-h.maxMessages+1:]...)
+	}
+	h.entries = append(h.entries, roomHistoryEntry{
+		sent:    sent,
+		message: message,
+	})
+}
+
+// Get returns copies of the stored messages that were not sent by the given
+// session, marked as history.
+func (h *RoomHistory) Get(sessionId string) []*ServerMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.expireLocked(h.getNow())
+	result := make([]*ServerMessage, 0, len(h.entries))
+	for _, entry := range h.entries {
+		msg := entry.message.Copy()
+		switch msg.Type {
+		case "message":
+			message := *msg.Message
+			if message.Sender != nil && message.Sender.SessionId == sessionId {
+				continue
+			}
+			message.History = true
+			msg.Message = &message
+		case "control":
+			control := *msg.Control
+			if control.Sender != nil && control.Sender.SessionId == sessionId {
+				continue
+			}
+			control.History = true
+			msg.Control = &control
+		}
+		result = append(result, msg)
+	}
+	return result
+}
@@ -0,0 +1,119 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newRoomHistoryMessage(messageType string, sender string, data string) *ServerMessage {
+	raw := json.RawMessage(`"` + data + `"`)
+	senderInfo := &MessageServerMessageSender{
+		Type:      "room",
+		SessionId: sender,
+	}
+	switch messageType {
+	case "control":
+		return &ServerMessage{
+			Type: "control",
+			Control: &ControlServerMessage{
+				Sender: senderInfo,
+				Data:   &raw,
+			},
+		}
+	case "message":
+		return &ServerMessage{
+			Type: "message",
+			Message: &MessageServerMessage{
+				Sender: senderInfo,
+				Data:   &raw,
+			},
+		}
+	default:
+		return &ServerMessage{
+			Type: messageType,
+		}
+	}
+}
+
+func TestRoomHistory(t *testing.T) {
+	now := time.Now()
+	history := NewRoomHistory(3, time.Minute)
+	history.getNow = func() time.Time {
+		return now
+	}
+
+	history.Add(newRoomHistoryMessage("event", "session1", "ignored"), now)
+	for i, data := range []string{"1", "2", "3", "4"} {
+		messageType := "message"
+		if i%2 == 1 {
+			messageType = "control"
+		}
+		history.Add(newRoomHistoryMessage(messageType, "session1", data), now.Add(time.Duration(i)*time.Second))
+	}
+
+	getData := func(messages []*ServerMessage) []string {
+		var result []string
+		for _, msg := range messages {
+			var data *json.RawMessage
+			var replayed bool
+			switch msg.Type {
+			case "message":
+				data, replayed = msg.Message.Data, msg.Message.History
+			case "control":
+				data, replayed = msg.Control.Data, msg.Control.History
+			}
+			if !replayed {
+				t.Errorf("Expected message to be marked as history: %+v", msg)
+			}
+			result = append(result, string(*data))
+		}
+		return result
+	}
+
+	// Only the last messages are kept.
+	if data := getData(history.Get("session2")); len(data) != 3 || data[0] != `"2"` || data[2] != `"4"` {
+		t.Errorf("Unexpected history %+v", data)
+	}
+	// Messages of the session itself are not returned.
+	if messages := history.Get("session1"); len(messages) != 0 {
+		t.Errorf("Expected no messages for sender, got %+v", messages)
+	}
+	// Stored messages are not modified.
+	history.mu.Lock()
+	if history.entries[0].message.Control.History {
+		t.Error("Stored message should not be modified")
+	}
+	history.mu.Unlock()
+
+	// Old messages expire.
+	now = now.Add(time.Minute + 2500*time.Millisecond)
+	if data := getData(history.Get("session2")); len(data) != 1 || data[0] != `"4"` {
+		t.Errorf("Expected only the last message, got %+v", data)
+	}
+	now = now.Add(time.Minute)
+	if messages := history.Get("session2"); len(messages) != 0 {
+		t.Errorf("Expected all messages to expire, got %+v", messages)
+	}
+}
@@ -0,0 +1,88 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Number of recently received messages of a room subject that are kept
+	// decoded for the other local sessions in the room.
+	maxRoomMessages = 8
+)
+
+// RoomMessages decodes messages received on the subject of a room only once,
+// all local sessions in the room share the decoded (and prepared) message.
+type RoomMessages struct {
+	mu       sync.Mutex
+	messages map[string]*NatsMessage
+	keys     []string
+}
+
+// NewRoomMessages creates a new cache for messages of a room.
+func NewRoomMessages() *RoomMessages {
+	return &RoomMessages{
+		messages: make(map[string]*NatsMessage),
+	}
+}
+
+// Decode returns the decoded NATS message. The result is shared with other
+// sessions and may not be modified.
+func (m *RoomMessages) Decode(n NatsClient, msg *nats.Msg) (*NatsMessage, error) {
+	m.mu.Lock()
+	message, found := m.messages[string(msg.Data)]
+	m.mu.Unlock()
+	if found {
+		return message, nil
+	}
+
+	message = &NatsMessage{}
+	if err := n.Decode(msg, message); err != nil {
+		return nil, err
+	}
+	if message.Type == "message" && message.Message != nil {
+		// Messages that are sent unmodified to the clients don't need to be
+		// serialized again.
+		if data := getRawNatsServerMessage(msg.Data); data != nil {
+			message.Message.setPrepared(data)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, found := m.messages[string(msg.Data)]; found {
+		// Decoded concurrently by another session.
+		return existing, nil
+	}
+
+	if len(m.keys) >= maxRoomMessages {
+		delete(m.messages, m.keys[0])
+		m.keys = append(m.keys[:0], m.keys[1:]...)
+	}
+	key := string(msg.Data)
+	m.messages[key] = message
+	m.keys = append(m.keys, key)
+	return message, nil
+}
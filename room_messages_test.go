@@ -0,0 +1,134 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func newRoomNatsMessageForTest(t *testing.T, subject string, message *ServerMessage) *nats.Msg {
+	data, err := json.Marshal(&NatsMessage{
+		SendTime: time.Now(),
+		Type:     "message",
+		Message:  message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &nats.Msg{
+		Subject: subject,
+		Data:    data,
+	}
+}
+
+func TestRoomMessages(t *testing.T) {
+	n, err := NewLoopbackNatsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	messages := NewRoomMessages()
+	update := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: "the-room",
+				Changed: []map[string]interface{}{
+					{"sessionId": "session1", "inCall": 1},
+				},
+				Users: []map[string]interface{}{
+					{"sessionId": "session2", "inCall": 0},
+				},
+			},
+		},
+	}
+	msg := newRoomNatsMessageForTest(t, "room.the-room", update)
+	decoded1, err := messages.Decode(n, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each session receives its own copy of the data.
+	msg2 := &nats.Msg{
+		Subject: msg.Subject,
+		Data:    append([]byte{}, msg.Data...),
+	}
+	decoded2, err := messages.Decode(n, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded1 != decoded2 {
+		t.Errorf("Expected shared message, got %+v and %+v", decoded1, decoded2)
+	}
+	if data := decoded1.Message.getPrepared(); len(data) == 0 {
+		t.Error("Message should have been prepared")
+	}
+
+	// Filtered participants updates are only created once.
+	for _, pages := range []bool{false, true} {
+		filtered := decoded1.Message.getParticipantsUpdate(pages)
+		if filtered == nil || filtered == decoded1.Message {
+			t.Fatalf("Expected filtered update, got %+v", filtered)
+		}
+		if filtered2 := decoded2.Message.getParticipantsUpdate(pages); filtered2 != filtered {
+			t.Errorf("Expected shared filtered update, got %+v and %+v", filtered, filtered2)
+		}
+		if len(filtered.Event.Update.Changed) != 0 {
+			t.Errorf("Changed participants should have been merged, got %+v", filtered.Event.Update)
+		}
+		if pages && len(filtered.Event.Update.Users) != 1 {
+			t.Errorf("Expected only changed participants, got %+v", filtered.Event.Update.Users)
+		} else if !pages && len(filtered.Event.Update.Users) != 2 {
+			t.Errorf("Expected all participants, got %+v", filtered.Event.Update.Users)
+		}
+	}
+
+	// Only the recent messages are kept.
+	for i := 0; i < maxRoomMessages; i++ {
+		other := &ServerMessage{
+			Type: "event",
+			Event: &EventServerMessage{
+				Target: "room",
+				Type:   "message",
+				Message: &RoomEventMessage{
+					RoomId: "the-room-" + strconv.Itoa(i),
+				},
+			},
+		}
+		if _, err := messages.Decode(n, newRoomNatsMessageForTest(t, msg.Subject, other)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if decoded3, err := messages.Decode(n, msg); err != nil {
+		t.Fatal(err)
+	} else if decoded3 == decoded1 {
+		t.Error("Message should have been expired")
+	}
+}
@@ -0,0 +1,100 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+)
+
+// withMuteState returns a copy of the user entry with the mute state of the
+// session set, the passed entry might be shared with other messages and must
+// not be modified.
+func withMuteState(user map[string]interface{}, muted MediaType) map[string]interface{} {
+	result := make(map[string]interface{}, len(user)+1)
+	for k, v := range user {
+		result[k] = v
+	}
+	result["muted"] = NewSessionMuteState(muted)
+	return result
+}
+
+// getMuteMediaType returns the media type of a "mute" / "unmute" message
+// sent by clients, or 0 if it is not supported.
+func getMuteMediaType(payload map[string]interface{}) MediaType {
+	name, _ := payload["name"].(string)
+	switch name {
+	case "audio":
+		return MediaTypeAudio
+	case "video":
+		return MediaTypeVideo
+	default:
+		return 0
+	}
+}
+
+// SetSessionMuted stores the muted media of a session in the room and
+// notifies the participants if it changed.
+func (r *Room) SetSessionMuted(session Session, muted MediaType) bool {
+	sid := session.PublicId()
+	r.mu.Lock()
+	if _, found := r.sessions[sid]; !found {
+		r.mu.Unlock()
+		return false
+	}
+
+	if r.mutedMedia[sid] == muted {
+		r.mu.Unlock()
+		return false
+	}
+
+	if muted == 0 {
+		delete(r.mutedMedia, sid)
+	} else {
+		r.mutedMedia[sid] = muted
+	}
+	r.mu.Unlock()
+	r.publishMuteStateChanged(sid, muted)
+	return true
+}
+
+func (r *Room) publishMuteStateChanged(sessionId string, muted MediaType) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: r.id,
+				Changed: []map[string]interface{}{
+					{
+						"sessionId": sessionId,
+						"muted":     NewSessionMuteState(muted),
+					},
+				},
+				Users: r.addInternalSessions(r.getUsers()),
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish mute state message in room %s: %s", r.Id(), err)
+	}
+}
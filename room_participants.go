@@ -0,0 +1,89 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sort"
+)
+
+func newEventServerMessageSessionEntry(session Session) *EventServerMessageSessionEntry {
+	entry := &EventServerMessageSessionEntry{
+		SessionId: session.PublicId(),
+		UserId:    session.UserId(),
+		User:      session.UserData(),
+	}
+	if s, ok := session.(*ClientSession); ok {
+		entry.RoomSessionId = s.RoomSessionId()
+	}
+	return entry
+}
+
+// newParticipantsSummary returns the number of sessions and the moderators
+// of a room. It is sent to clients that support fetching the participants in
+// pages instead of the full list of sessions when joining.
+func newParticipantsSummary(room *Room) *ParticipantsServerMessage {
+	sessions := room.GetSessions()
+	summary := &ParticipantsServerMessage{
+		Type:   "summary",
+		RoomId: room.Id(),
+		Count:  len(sessions),
+	}
+	for _, s := range sessions {
+		if room.IsSessionInCall(s) {
+			summary.InCall++
+		}
+		if s.ClientType() == HelloClientTypeInternal || s.HasPermission(PERMISSION_MAY_CONTROL) {
+			summary.Moderators = append(summary.Moderators, newEventServerMessageSessionEntry(s))
+		}
+	}
+	return summary
+}
+
+// newParticipantsPage returns up to "limit" sessions of a room, starting at
+// "offset". The sessions are sorted by their public id so pages are stable
+// while the sessions in the room don't change.
+func newParticipantsPage(room *Room, offset int, limit int) *ParticipantsServerMessage {
+	sessions := room.GetSessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].PublicId() < sessions[j].PublicId()
+	})
+
+	page := &ParticipantsServerMessage{
+		Type:   "page",
+		RoomId: room.Id(),
+		Count:  len(sessions),
+		Offset: offset,
+	}
+	if offset >= len(sessions) {
+		return page
+	}
+
+	sessions = sessions[offset:]
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	page.Sessions = make([]*EventServerMessageSessionEntry, 0, len(sessions))
+	for _, s := range sessions {
+		page.Sessions = append(page.Sessions, newEventServerMessageSessionEntry(s))
+	}
+	return page
+}
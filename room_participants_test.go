@@ -0,0 +1,142 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func Test_RoomParticipantsPages(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("app", "participantspagesize", "2")
+		return config, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	roomId := "test-room"
+	var sessionIds []string
+	for i := 1; i <= 2; i++ {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+		if err := client.SendHello(fmt.Sprintf("%s%d", testDefaultUserId, i)); err != nil {
+			t.Fatal(err)
+		}
+		hello, err := client.RunUntilHello(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+		sessionIds = append(sessionIds, hello.Hello.SessionId)
+	}
+
+	session1 := hub.GetSessionByPublicId(sessionIds[0]).(*ClientSession)
+	session1.SetPermissions([]Permission{PERMISSION_MAY_CONTROL})
+	session2 := hub.GetSessionByPublicId(sessionIds[1]).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHelloWithFeatures(testDefaultUserId+"3", []string{ClientFeatureParticipantsPages}); err != nil {
+		t.Fatal(err)
+	}
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session3 := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	session3.SetPermissions([]Permission{})
+	sessionIds = append(sessionIds, hello.Hello.SessionId)
+
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Instead of the list of sessions, a summary is sent.
+	if msg, err := runUntilMessageOfType(ctx, client, "participants"); err != nil {
+		t.Fatal(err)
+	} else if summary := msg.Participants; summary.Type != "summary" {
+		t.Errorf("Expected summary, got %+v", summary)
+	} else if summary.RoomId != roomId || summary.Count != 3 {
+		t.Errorf("Expected 3 sessions in room %s, got %+v", roomId, summary)
+	} else if len(summary.Moderators) != 1 || summary.Moderators[0].SessionId != sessionIds[0] {
+		t.Errorf("Expected moderator %s, got %+v", sessionIds[0], summary.Moderators)
+	}
+
+	// Pages are limited to the configured size.
+	found := make(map[string]bool)
+	for offset := 0; offset < 4; offset += 2 {
+		if err := client.SendParticipantsGet(offset, 10); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := runUntilMessageOfType(ctx, client, "participants")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		page := msg.Participants
+		if page.Type != "page" || page.Count != 3 || page.Offset != offset {
+			t.Errorf("Expected page at offset %d of 3 sessions, got %+v", offset, page)
+		}
+		expected := 2
+		if offset > 0 {
+			expected = 1
+		}
+		if len(page.Sessions) != expected {
+			t.Errorf("Expected %d sessions, got %+v", expected, page.Sessions)
+		}
+		for _, entry := range page.Sessions {
+			found[entry.SessionId] = true
+		}
+	}
+	for _, sid := range sessionIds {
+		if !found[sid] {
+			t.Errorf("Session %s was not returned in pages", sid)
+		}
+	}
+
+	if err := client.SendParticipantsGet(10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := runUntilMessageOfType(ctx, client, "participants"); err != nil {
+		t.Fatal(err)
+	} else if page := msg.Participants; page.Count != 3 || len(page.Sessions) != 0 {
+		t.Errorf("Expected empty page, got %+v", page)
+	}
+}
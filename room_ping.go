@@ -0,0 +1,204 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Maximum number of sessions that are sent in one batched ping request.
+	maxPingEntriesPerRequest = 1000
+
+	defaultRoomPingInterval     = 10 * time.Second
+	defaultIdleRoomPingInterval = 25 * time.Second
+	// Maximum percentage by which the ping interval of a room is shortened.
+	defaultRoomPingJitter = 10
+)
+
+// roomPingIntervals defines how often the active sessions of a room are sent
+// to the backend. Rooms with sessions in a call are "busy" and pinged more
+// often than "idle" rooms.
+type roomPingIntervals struct {
+	busy   time.Duration
+	idle   time.Duration
+	jitter int
+}
+
+func newRoomPingIntervals(config *goconf.ConfigFile) *roomPingIntervals {
+	result := &roomPingIntervals{
+		busy:   defaultRoomPingInterval,
+		idle:   defaultIdleRoomPingInterval,
+		jitter: defaultRoomPingJitter,
+	}
+	if seconds, _ := config.GetInt("backend", "pinginterval"); seconds > 0 {
+		result.busy = time.Duration(seconds) * time.Second
+	}
+	if seconds, _ := config.GetInt("backend", "idlepinginterval"); seconds > 0 {
+		result.idle = time.Duration(seconds) * time.Second
+	}
+	if result.idle < result.busy {
+		result.idle = result.busy
+	}
+	if jitter, err := config.GetInt("backend", "pingjitter"); err == nil && jitter >= 0 && jitter < 100 {
+		result.jitter = jitter
+	}
+	return result
+}
+
+// get returns the time until the next ping of a room on the given backend.
+// The interval is shortened by a random jitter, so rooms that were created at
+// the same time don't ping the backend at the same time.
+func (i *roomPingIntervals) get(backend *Backend, busy bool) time.Duration {
+	interval := i.idle
+	if busy {
+		interval = i.busy
+	}
+	if backend != nil {
+		if busy && backend.pingInterval > 0 {
+			interval = time.Duration(backend.pingInterval) * time.Second
+		} else if !busy && backend.idlePingInterval > 0 {
+			interval = time.Duration(backend.idlePingInterval) * time.Second
+		}
+	}
+
+	if maxJitter := int64(interval) * int64(i.jitter) / 100; maxJitter > 0 {
+		interval -= time.Duration(rand.Int63n(maxJitter + 1))
+	}
+	return interval
+}
+
+type roomPingEntries struct {
+	url     *url.URL
+	entries []BackendPingEntry
+}
+
+// RoomPing collects the active sessions of rooms on backends that support
+// pinging sessions of multiple rooms and sends them in one request per backend
+// instead of one request per room.
+type RoomPing struct {
+	mu       sync.Mutex
+	perform  backendQueuePerformer
+	timeout  time.Duration
+	interval time.Duration
+	entries  map[string]*roomPingEntries
+
+	stopChan chan bool
+}
+
+func NewRoomPing(perform backendQueuePerformer, timeout time.Duration, interval time.Duration) *RoomPing {
+	return &RoomPing{
+		perform:  perform,
+		timeout:  timeout,
+		interval: interval,
+		entries:  make(map[string]*roomPingEntries),
+
+		stopChan: make(chan bool, 1),
+	}
+}
+
+// Add queues the entries of a room to be sent with the next batched request
+// to the backend at the given url.
+func (p *RoomPing) Add(u *url.URL, roomId string, entries []BackendPingEntry) {
+	key := u.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, found := p.entries[key]
+	if !found {
+		e = &roomPingEntries{
+			url: u,
+		}
+		p.entries[key] = e
+	}
+	for _, entry := range entries {
+		entry.RoomId = roomId
+		e.entries = append(e.entries, entry)
+	}
+}
+
+func (p *RoomPing) publishEntries(u *url.URL, entries []BackendPingEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	request := NewBackendClientBatchPingRequest(entries)
+	var response BackendClientResponse
+	if err := p.perform(ctx, u, request, &response); err != nil {
+		log.Printf("Error pinging %d active entries on %s: %s", len(entries), u, err)
+	}
+}
+
+// publishActiveSessions sends the queued entries to the backends. Returns the
+// number of requests that are sent.
+func (p *RoomPing) publishActiveSessions() (int, *sync.WaitGroup) {
+	p.mu.Lock()
+	entries := p.entries
+	p.entries = make(map[string]*roomPingEntries)
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	count := 0
+	for _, e := range entries {
+		remaining := e.entries
+		for len(remaining) > 0 {
+			batch := remaining
+			if len(batch) > maxPingEntriesPerRequest {
+				batch = batch[:maxPingEntriesPerRequest]
+			}
+			remaining = remaining[len(batch):]
+
+			count++
+			wg.Add(1)
+			go func(u *url.URL, entries []BackendPingEntry) {
+				defer wg.Done()
+				p.publishEntries(u, entries)
+			}(e.url, batch)
+		}
+	}
+	return count, &wg
+}
+
+func (p *RoomPing) Run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.publishActiveSessions()
+		}
+	}
+}
+
+func (p *RoomPing) Stop() {
+	select {
+	case p.stopChan <- true:
+	default:
+	}
+}
@@ -0,0 +1,177 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+type testRoomPingRequests struct {
+	mu       sync.Mutex
+	requests map[string][]*BackendClientPingRequest
+}
+
+func (r *testRoomPingRequests) perform(ctx context.Context, u *url.URL, request interface{}, response interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.requests == nil {
+		r.requests = make(map[string][]*BackendClientPingRequest)
+	}
+	r.requests[u.String()] = append(r.requests[u.String()], request.(*BackendClientRequest).Ping)
+	return nil
+}
+
+func TestRoomPing(t *testing.T) {
+	var requests testRoomPingRequests
+	ping := NewRoomPing(requests.perform, time.Second, time.Second)
+
+	u1, _ := url.Parse("https://server1.domain.invalid")
+	u2, _ := url.Parse("https://server2.domain.invalid")
+	ping.Add(u1, "room1", []BackendPingEntry{
+		{
+			SessionId: "session1",
+			UserId:    "user1",
+		},
+	})
+	ping.Add(u1, "room2", []BackendPingEntry{
+		{
+			SessionId: "session2",
+		},
+	})
+	ping.Add(u2, "room3", []BackendPingEntry{
+		{
+			SessionId: "session3",
+		},
+	})
+
+	count, wg := ping.publishActiveSessions()
+	if count != 2 {
+		t.Errorf("Expected 2 requests, got %d", count)
+	}
+	wg.Wait()
+
+	if r := requests.requests[u1.String()]; len(r) != 1 {
+		t.Errorf("Expected one request to %s, got %+v", u1, r)
+	} else if r[0].RoomId != "" || len(r[0].Entries) != 2 {
+		t.Errorf("Unexpected request %+v", r[0])
+	} else if e := r[0].Entries[0]; e.RoomId != "room1" || e.SessionId != "session1" || e.UserId != "user1" {
+		t.Errorf("Unexpected entry %+v", e)
+	} else if e := r[0].Entries[1]; e.RoomId != "room2" || e.SessionId != "session2" || e.UserId != "" {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	if r := requests.requests[u2.String()]; len(r) != 1 {
+		t.Errorf("Expected one request to %s, got %+v", u2, r)
+	} else if len(r[0].Entries) != 1 || r[0].Entries[0].RoomId != "room3" {
+		t.Errorf("Unexpected request %+v", r[0])
+	}
+
+	// Entries are only sent once.
+	if count, _ := ping.publishActiveSessions(); count != 0 {
+		t.Errorf("Expected no requests, got %d", count)
+	}
+}
+
+func TestRoomPingMaxEntries(t *testing.T) {
+	var requests testRoomPingRequests
+	ping := NewRoomPing(requests.perform, time.Second, time.Second)
+
+	u, _ := url.Parse("https://server.domain.invalid")
+	entries := make([]BackendPingEntry, maxPingEntriesPerRequest+1)
+	for idx := range entries {
+		entries[idx].SessionId = "session"
+	}
+	ping.Add(u, "room", entries)
+
+	count, wg := ping.publishActiveSessions()
+	if count != 2 {
+		t.Errorf("Expected 2 requests, got %d", count)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, r := range requests.requests[u.String()] {
+		if len(r.Entries) > maxPingEntriesPerRequest {
+			t.Errorf("Expected at most %d entries, got %d", maxPingEntriesPerRequest, len(r.Entries))
+		}
+		total += len(r.Entries)
+	}
+	if total != len(entries) {
+		t.Errorf("Expected %d entries, got %d", len(entries), total)
+	}
+}
+
+func TestRoomPingIntervals(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("backend", "pinginterval", "5")
+	config.AddOption("backend", "idlepinginterval", "20")
+	config.AddOption("backend", "pingjitter", "0")
+	intervals := newRoomPingIntervals(config)
+
+	if interval := intervals.get(nil, true); interval != 5*time.Second {
+		t.Errorf("Expected busy interval of 5s, got %s", interval)
+	}
+	if interval := intervals.get(nil, false); interval != 20*time.Second {
+		t.Errorf("Expected idle interval of 20s, got %s", interval)
+	}
+
+	backend := &Backend{
+		idlePingInterval: 15,
+	}
+	if interval := intervals.get(backend, true); interval != 5*time.Second {
+		t.Errorf("Expected busy interval of 5s, got %s", interval)
+	}
+	if interval := intervals.get(backend, false); interval != 15*time.Second {
+		t.Errorf("Expected idle interval of 15s, got %s", interval)
+	}
+	backend.pingInterval = 2
+	if interval := intervals.get(backend, true); interval != 2*time.Second {
+		t.Errorf("Expected busy interval of 2s, got %s", interval)
+	}
+
+	intervals.jitter = 20
+	for i := 0; i < 100; i++ {
+		if interval := intervals.get(nil, false); interval < 16*time.Second || interval > 20*time.Second {
+			t.Fatalf("Expected idle interval between 16s and 20s, got %s", interval)
+		}
+	}
+}
+
+func TestRoomPingIntervalsDefaults(t *testing.T) {
+	config := goconf.NewConfigFile()
+	// The idle interval may not be shorter than the busy interval.
+	config.AddOption("backend", "pinginterval", "30")
+	config.AddOption("backend", "pingjitter", "100")
+	intervals := newRoomPingIntervals(config)
+
+	if intervals.busy != 30*time.Second || intervals.idle != 30*time.Second {
+		t.Errorf("Unexpected intervals %+v", intervals)
+	}
+	if intervals.jitter != defaultRoomPingJitter {
+		t.Errorf("Expected jitter %d, got %d", defaultRoomPingJitter, intervals.jitter)
+	}
+}
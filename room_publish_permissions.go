@@ -0,0 +1,106 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+)
+
+const (
+	// Must match values in "Webinary.php" from Nextcloud Talk.
+	RoomLobbyStateAllParticipants = 0
+	RoomLobbyStateModeratorsOnly  = 1
+
+	// Permission bit of participants, must match value in "Attendee.php"
+	// from Nextcloud Talk. Only if set, the other bits of the call
+	// permissions of a room are used.
+	ParticipantPermissionCustom = 1
+
+	// Reasons why a publisher was closed by the server.
+	PublisherClosedReasonPermissions     = "permissions"
+	PublisherClosedReasonLobby           = "lobby"
+	PublisherClosedReasonCallPermissions = "call-permissions"
+)
+
+type roomPublishProperties struct {
+	LobbyState      int `json:"lobbyState"`
+	CallPermissions int `json:"callPermissions"`
+}
+
+// getRevokedPublishPermissions returns the publish permissions that are
+// revoked for non-moderators by the properties of the room together with
+// the reason, or nil if no permissions are revoked.
+func (r *Room) getRevokedPublishPermissions() (map[Permission]bool, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.properties == nil {
+		return nil, ""
+	}
+
+	var properties roomPublishProperties
+	if err := json.Unmarshal(*r.properties, &properties); err != nil {
+		return nil, ""
+	}
+
+	if properties.LobbyState == RoomLobbyStateModeratorsOnly {
+		return map[Permission]bool{
+			PERMISSION_MAY_PUBLISH_MEDIA:  true,
+			PERMISSION_MAY_PUBLISH_AUDIO:  true,
+			PERMISSION_MAY_PUBLISH_VIDEO:  true,
+			PERMISSION_MAY_PUBLISH_SCREEN: true,
+		}, PublisherClosedReasonLobby
+	}
+
+	if properties.CallPermissions&ParticipantPermissionCustom == 0 {
+		return nil, ""
+	}
+
+	var revoked map[Permission]bool
+	for bit, permission := range participantPermissionBits {
+		if permission == PERMISSION_MAY_CHAT || properties.CallPermissions&bit == bit {
+			continue
+		}
+
+		if revoked == nil {
+			revoked = make(map[Permission]bool)
+		}
+		revoked[permission] = true
+		if permission == PERMISSION_MAY_PUBLISH_AUDIO || permission == PERMISSION_MAY_PUBLISH_VIDEO {
+			// Replaced by the separate audio / video permissions.
+			revoked[PERMISSION_MAY_PUBLISH_MEDIA] = true
+		}
+	}
+	if revoked == nil {
+		return nil, ""
+	}
+	return revoked, PublisherClosedReasonCallPermissions
+}
+
+// closeUnallowedPublishers closes the publishers of all sessions in the room
+// that are no longer allowed to publish.
+func (r *Room) closeUnallowedPublishers() {
+	for _, session := range r.GetSessions() {
+		if s, ok := session.(*ClientSession); ok {
+			s.closeUnallowedPublishers()
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+)
+
+func Test_RoomRevokedPublishPermissions(t *testing.T) {
+	testcases := []struct {
+		properties string
+		revoked    []Permission
+		reason     string
+	}{
+		{
+			"{}",
+			nil,
+			"",
+		},
+		{
+			"{\"lobbyState\":0,\"callPermissions\":0}",
+			nil,
+			"",
+		},
+		{
+			"{\"lobbyState\":1}",
+			[]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO, PERMISSION_MAY_PUBLISH_SCREEN},
+			PublisherClosedReasonLobby,
+		},
+		{
+			// Call permissions without the "custom" bit are ignored.
+			"{\"callPermissions\":128}",
+			nil,
+			"",
+		},
+		{
+			"{\"callPermissions\":129}",
+			[]Permission{PERMISSION_MAY_PUBLISH_MEDIA, PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO, PERMISSION_MAY_PUBLISH_SCREEN},
+			PublisherClosedReasonCallPermissions,
+		},
+		{
+			"{\"callPermissions\":49}",
+			[]Permission{PERMISSION_MAY_PUBLISH_SCREEN},
+			PublisherClosedReasonCallPermissions,
+		},
+		{
+			"{\"callPermissions\":113}",
+			nil,
+			"",
+		},
+	}
+
+	for _, tc := range testcases {
+		properties := json.RawMessage(tc.properties)
+		room := &Room{
+			mu:         &sync.RWMutex{},
+			properties: &properties,
+		}
+		revoked, reason := room.getRevokedPublishPermissions()
+		if reason != tc.reason {
+			t.Errorf("Expected reason %s for %s, got %s", tc.reason, tc.properties, reason)
+		}
+		if len(revoked) != len(tc.revoked) {
+			t.Errorf("Expected revoked permissions %+v for %s, got %+v", tc.revoked, tc.properties, revoked)
+			continue
+		}
+		for _, p := range tc.revoked {
+			if !revoked[p] {
+				t.Errorf("Expected permission %s to be revoked for %s, got %+v", p, tc.properties, revoked)
+			}
+		}
+	}
+}
+
+func TestClientPublisherClosedByLobby(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Join room by id.
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Error(err)
+	}
+
+	session1 := hub.GetSessionByPublicId(hello1.Hello.SessionId).(*ClientSession)
+	if session1 == nil {
+		t.Fatalf("Session %s does not exist", hello1.Hello.SessionId)
+	}
+
+	// Client is allowed to send audio and video but is no moderator.
+	session1.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO, PERMISSION_MAY_PUBLISH_VIDEO})
+
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54321",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.RunUntilAnswer(ctx, MockSdpAnswerAudioAndVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enabling the lobby will stop the publisher.
+	properties := json.RawMessage("{\"lobbyState\":1}")
+	msg := &BackendServerRoomRequest{
+		Type: "update",
+		Update: &BackendRoomUpdateRequest{
+			Properties: &properties,
+		},
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := performBackendRequest(server.URL+"/api/v1/room/"+roomId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Expected successful request, got %s: %s", res.Status, string(body))
+	}
+
+	for {
+		message, err := client1.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type != "event" || message.Event.Type != "publisher-closed" {
+			continue
+		}
+
+		if message.Event.Target != "room" {
+			t.Errorf("Expected target room, got %+v", message.Event)
+		} else if publisher := message.Event.Publisher; publisher == nil {
+			t.Errorf("Expected publisher details, got %+v", message.Event)
+		} else if publisher.RoomId != roomId || publisher.StreamType != "video" || publisher.Reason != PublisherClosedReasonLobby {
+			t.Errorf("Unexpected publisher details %+v", publisher)
+		}
+		break
+	}
+
+	pubs := mcu.GetPublishers()
+	if len(pubs) != 1 {
+		t.Fatalf("expected one publisher, got %+v", pubs)
+	}
+	for _, pub := range pubs {
+		if !pub.isClosed() {
+			t.Errorf("publisher %+v was not closed", pub)
+		}
+	}
+
+	// New offers are rejected while the lobby is enabled.
+	if err := client1.SendMessage(MessageClientMessageRecipient{
+		Type:      "session",
+		SessionId: hello1.Hello.SessionId,
+	}, MessageClientMessageData{
+		Type:     "offer",
+		Sid:      "54322",
+		RoomType: "video",
+		Payload: map[string]interface{}{
+			"sdp": MockSdpOfferAudioAndVideo,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		message, err := client1.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Type == "room" {
+			// The room update may be received after the publisher was closed.
+			continue
+		}
+
+		if err := checkMessageType(message, "error"); err != nil {
+			t.Error(err)
+		} else if message.Error.Code != "not_allowed" {
+			t.Errorf("Expected error not_allowed, got %+v", message.Error)
+		}
+		break
+	}
+}
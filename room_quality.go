@@ -0,0 +1,98 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"time"
+)
+
+var (
+	// Reports of clients that are older are no longer used for the
+	// statistics of a room.
+	clientQualityStatsMaxAge = time.Minute
+)
+
+// getRoomQualityStats aggregates the recent connection quality reports of the
+// given sessions. Returns nil if none of them reported recently.
+func getRoomQualityStats(sessions []Session) *RoomQualityStats {
+	var stats *RoomQualityStats
+	for _, session := range sessions {
+		clientSession, ok := session.(*ClientSession)
+		if !ok {
+			continue
+		}
+
+		report := clientSession.GetQualityStats()
+		if report == nil {
+			continue
+		}
+
+		if stats == nil {
+			stats = &RoomQualityStats{}
+		}
+		stats.Reports++
+		stats.Rtt += report.Rtt
+		stats.PacketLoss += report.PacketLoss
+		if report.Rtt > stats.MaxRtt {
+			stats.MaxRtt = report.Rtt
+		}
+		if report.PacketLoss > stats.MaxPacketLoss {
+			stats.MaxPacketLoss = report.PacketLoss
+		}
+	}
+	if stats != nil {
+		stats.Rtt /= float64(stats.Reports)
+		stats.PacketLoss /= float64(stats.Reports)
+	}
+	return stats
+}
+
+// GetQualityStats returns the aggregated connection quality of the sessions
+// in the room that are connected to this server.
+func (r *Room) GetQualityStats() *RoomQualityStats {
+	r.mu.RLock()
+	sessions := make([]Session, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session)
+	}
+	r.mu.RUnlock()
+
+	return getRoomQualityStats(sessions)
+}
+
+func (r *Room) updateQualityStats() {
+	stats := r.GetQualityStats()
+	if stats == nil {
+		r.deleteQualityStats()
+		return
+	}
+
+	statsRoomClientReportsCurrent.WithLabelValues(r.backend.Id(), r.id).Set(float64(stats.Reports))
+	statsRoomClientRttCurrent.WithLabelValues(r.backend.Id(), r.id).Set(stats.Rtt)
+	statsRoomClientPacketLossCurrent.WithLabelValues(r.backend.Id(), r.id).Set(stats.PacketLoss)
+}
+
+func (r *Room) deleteQualityStats() {
+	statsRoomClientReportsCurrent.DeleteLabelValues(r.backend.Id(), r.id)
+	statsRoomClientRttCurrent.DeleteLabelValues(r.backend.Id(), r.id)
+	statsRoomClientPacketLossCurrent.DeleteLabelValues(r.backend.Id(), r.id)
+}
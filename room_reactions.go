@@ -0,0 +1,224 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// Changes to raised hands and emoji reactions are collected and sent
+	// to the sessions in the room in this interval.
+	reactionsFlushInterval = 200 * time.Millisecond
+)
+
+type ReactionsListener interface {
+	SendMessage(message *ServerMessage) bool
+}
+
+// RoomReactions keeps track of raised hands and aggregates emoji reactions
+// of the sessions in a room.
+type RoomReactions struct {
+	mu        sync.Mutex
+	hands     map[string]int64
+	listeners map[ReactionsListener]bool
+
+	changedHands  map[string]bool
+	pendingEmojis map[string]int
+	flushTimer    *time.Timer
+	closed        bool
+}
+
+// NewRoomReactions creates a new container for reactions in a room.
+func NewRoomReactions() *RoomReactions {
+	return &RoomReactions{}
+}
+
+// AddListener adds a new listener to be notified about changes. The listener
+// will receive the list of currently raised hands.
+func (r *RoomReactions) AddListener(listener ReactionsListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listeners == nil {
+		r.listeners = make(map[ReactionsListener]bool)
+	}
+	r.listeners[listener] = true
+	if len(r.hands) > 0 {
+		raised := make(map[string]int64, len(r.hands))
+		for sessionId, ts := range r.hands {
+			raised[sessionId] = ts
+		}
+		msg := &ServerMessage{
+			Type: "reaction",
+			Reaction: &ReactionServerMessage{
+				Type:   "initial",
+				Raised: raised,
+			},
+		}
+		listener.SendMessage(msg)
+	}
+}
+
+// RemoveListener removes a previously registered listener.
+func (r *RoomReactions) RemoveListener(listener ReactionsListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.listeners, listener)
+}
+
+func (r *RoomReactions) scheduleFlushLocked() {
+	if r.flushTimer != nil || r.closed {
+		return
+	}
+
+	r.flushTimer = time.AfterFunc(reactionsFlushInterval, r.flush)
+}
+
+func (r *RoomReactions) flush() {
+	r.mu.Lock()
+	r.flushTimer = nil
+	if r.closed || (len(r.changedHands) == 0 && len(r.pendingEmojis) == 0) {
+		r.mu.Unlock()
+		return
+	}
+
+	update := &ReactionServerMessage{
+		Type:   "update",
+		Emojis: r.pendingEmojis,
+	}
+	for sessionId := range r.changedHands {
+		if ts, found := r.hands[sessionId]; found {
+			if update.Raised == nil {
+				update.Raised = make(map[string]int64)
+			}
+			update.Raised[sessionId] = ts
+		} else {
+			update.Lowered = append(update.Lowered, sessionId)
+		}
+	}
+	r.changedHands = nil
+	r.pendingEmojis = nil
+
+	listeners := make([]ReactionsListener, 0, len(r.listeners))
+	for listener := range r.listeners {
+		listeners = append(listeners, listener)
+	}
+	r.mu.Unlock()
+
+	// Send outside of the lock as listeners might be removed concurrently
+	// while holding their own locks.
+	msg := &ServerMessage{
+		Type:     "reaction",
+		Reaction: update,
+	}
+	msg.Prepare()
+	for _, listener := range listeners {
+		listener.SendMessage(msg)
+	}
+}
+
+// RaiseHand marks the hand of the given session as raised. Returns false if
+// the hand was already raised.
+func (r *RoomReactions) RaiseHand(sessionId string) bool {
+	return r.RaiseHandAt(sessionId, time.Now().UnixNano()/int64(time.Millisecond))
+}
+
+// RaiseHandAt marks the hand of the given session as raised at the given
+// timestamp (in milliseconds). Returns false if the hand was already raised.
+func (r *RoomReactions) RaiseHandAt(sessionId string, timestamp int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.hands[sessionId]; found {
+		return false
+	}
+
+	if r.hands == nil {
+		r.hands = make(map[string]int64)
+	}
+	r.hands[sessionId] = timestamp
+	r.markChangedLocked(sessionId)
+	return true
+}
+
+// LowerHand marks the hand of the given session as lowered. Returns false if
+// the hand was not raised.
+func (r *RoomReactions) LowerHand(sessionId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.hands[sessionId]; !found {
+		return false
+	}
+
+	delete(r.hands, sessionId)
+	r.markChangedLocked(sessionId)
+	return true
+}
+
+func (r *RoomReactions) markChangedLocked(sessionId string) {
+	if r.changedHands == nil {
+		r.changedHands = make(map[string]bool)
+	}
+	r.changedHands[sessionId] = true
+	r.scheduleFlushLocked()
+}
+
+// AddEmoji records an emoji reaction that will be sent to all listeners with
+// the next update.
+func (r *RoomReactions) AddEmoji(emoji string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pendingEmojis == nil {
+		r.pendingEmojis = make(map[string]int)
+	}
+	r.pendingEmojis[emoji]++
+	r.scheduleFlushLocked()
+}
+
+// GetRaisedHands returns a copy of the currently raised hands.
+func (r *RoomReactions) GetRaisedHands() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make(map[string]int64, len(r.hands))
+	for sessionId, ts := range r.hands {
+		result[sessionId] = ts
+	}
+	return result
+}
+
+// Close stops sending any pending updates.
+func (r *RoomReactions) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
+		r.flushTimer = nil
+	}
+}
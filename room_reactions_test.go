@@ -0,0 +1,326 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testReactionsListener struct {
+	mu       sync.Mutex
+	messages []*ServerMessage
+}
+
+func (l *testReactionsListener) SendMessage(message *ServerMessage) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, message)
+	return true
+}
+
+func (l *testReactionsListener) getMessages() []*ServerMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := l.messages
+	l.messages = nil
+	return result
+}
+
+func Test_RoomReactions(t *testing.T) {
+	reactionsFlushInterval = time.Millisecond
+	defer func() {
+		reactionsFlushInterval = 200 * time.Millisecond
+	}()
+
+	reactions := NewRoomReactions()
+	defer reactions.Close()
+
+	listener1 := &testReactionsListener{}
+	reactions.AddListener(listener1)
+	if messages := listener1.getMessages(); len(messages) != 0 {
+		t.Errorf("Expected no initial messages, got %+v", messages)
+	}
+
+	if !reactions.RaiseHand("session1") {
+		t.Error("should have raised hand")
+	}
+	if reactions.RaiseHand("session1") {
+		t.Error("should not have raised hand")
+	}
+	if reactions.LowerHand("session2") {
+		t.Error("should not have lowered hand")
+	}
+	reactions.AddEmoji("+1")
+	reactions.AddEmoji("+1")
+	reactions.AddEmoji("heart")
+
+	time.Sleep(50 * time.Millisecond)
+	if messages := listener1.getMessages(); len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	} else if update := messages[0].Reaction; update.Type != "update" {
+		t.Errorf("Expected update, got %+v", update)
+	} else if _, found := update.Raised["session1"]; !found || len(update.Raised) != 1 {
+		t.Errorf("Expected raised hand of session1, got %+v", update.Raised)
+	} else if len(update.Lowered) != 0 {
+		t.Errorf("Expected no lowered hands, got %+v", update.Lowered)
+	} else if update.Emojis["+1"] != 2 || update.Emojis["heart"] != 1 {
+		t.Errorf("Expected aggregated emojis, got %+v", update.Emojis)
+	}
+
+	listener2 := &testReactionsListener{}
+	reactions.AddListener(listener2)
+	if messages := listener2.getMessages(); len(messages) != 1 {
+		t.Errorf("Expected initial message, got %+v", messages)
+	} else if initial := messages[0].Reaction; initial.Type != "initial" {
+		t.Errorf("Expected initial, got %+v", initial)
+	} else if _, found := initial.Raised["session1"]; !found || len(initial.Raised) != 1 {
+		t.Errorf("Expected raised hand of session1, got %+v", initial.Raised)
+	}
+
+	if !reactions.LowerHand("session1") {
+		t.Error("should have lowered hand")
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, listener := range []*testReactionsListener{listener1, listener2} {
+		if messages := listener.getMessages(); len(messages) != 1 {
+			t.Errorf("Expected one update, got %+v", messages)
+		} else if update := messages[0].Reaction; len(update.Raised) != 0 || len(update.Emojis) != 0 {
+			t.Errorf("Expected only lowered hands, got %+v", update)
+		} else if len(update.Lowered) != 1 || update.Lowered[0] != "session1" {
+			t.Errorf("Expected lowered hand of session1, got %+v", update.Lowered)
+		}
+	}
+
+	if hands := reactions.GetRaisedHands(); len(hands) != 0 {
+		t.Errorf("Expected no raised hands, got %+v", hands)
+	}
+}
+
+func Test_RoomReactionsMessages(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.SendReaction("raisehand", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_in_room"); err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if err := client1.RunUntilJoined(ctx, hello1.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.SendReaction("raisehand", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "reaction"); err != nil {
+		t.Fatal(err)
+	} else if _, found := msg.Reaction.Raised[hello1.Hello.SessionId]; !found {
+		t.Errorf("Expected raised hand of %s, got %+v", hello1.Hello.SessionId, msg.Reaction)
+	}
+
+	// Sessions joining later receive the current list of raised hands.
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	gotInitial := false
+	for !gotInitial {
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "reaction" {
+			continue
+		}
+
+		if msg.Reaction.Type != "initial" {
+			t.Errorf("Expected initial reactions, got %+v", msg.Reaction)
+		} else if _, found := msg.Reaction.Raised[hello1.Hello.SessionId]; !found {
+			t.Errorf("Expected raised hand of %s, got %+v", hello1.Hello.SessionId, msg.Reaction)
+		}
+		gotInitial = true
+	}
+
+	// Only moderators may lower the hands of other sessions.
+	session2 := hub.GetSessionByPublicId(hello2.Hello.SessionId).(*ClientSession)
+	session2.SetPermissions([]Permission{})
+	if err := client2.SendReaction("lowerhand", "", hello1.Hello.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "event" {
+			// Ignore "join" events.
+			continue
+		}
+
+		if err := checkMessageError(msg, "not_allowed"); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	// The hand is lowered automatically when the session leaves.
+	client1.CloseWithBye()
+	if err := client1.WaitForClientRemoved(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "reaction" {
+			continue
+		}
+
+		if len(msg.Reaction.Lowered) != 1 || msg.Reaction.Lowered[0] != hello1.Hello.SessionId {
+			t.Errorf("Expected lowered hand of %s, got %+v", hello1.Hello.SessionId, msg.Reaction)
+		}
+		break
+	}
+}
+
+func Test_RoomReactionsClustered(t *testing.T) {
+	hub1, hub2, server1, server2 := CreateClusteredHubsForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server1, hub1)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client1.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server2, hub2)
+	defer client2.CloseWithBye()
+	params2 := TestBackendClientAuthParams{
+		UserId: testDefaultUserId + "2",
+	}
+	if err := client2.SendHelloParams(server1.URL, "", params2); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if room, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+	if room, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	runUntilReaction := func(client *TestClient) *ReactionServerMessage {
+		for {
+			msg, err := client.RunUntilMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == "reaction" {
+				return msg.Reaction
+			}
+		}
+	}
+
+	// Raised hands are sent to the sessions on all servers.
+	if err := client2.SendReaction("raisehand", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if reaction := runUntilReaction(client1); reaction.Raised[hello2.Hello.SessionId] == 0 {
+		t.Errorf("Expected raised hand of %s, got %+v", hello2.Hello.SessionId, reaction)
+	}
+	if reaction := runUntilReaction(client2); reaction.Raised[hello2.Hello.SessionId] == 0 {
+		t.Errorf("Expected raised hand of %s, got %+v", hello2.Hello.SessionId, reaction)
+	}
+
+	// Hands of sessions on other servers can be lowered.
+	if err := client1.SendReaction("lowerhand", "", hello2.Hello.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if reaction := runUntilReaction(client2); len(reaction.Lowered) != 1 || reaction.Lowered[0] != hello2.Hello.SessionId {
+		t.Errorf("Expected lowered hand of %s, got %+v", hello2.Hello.SessionId, reaction)
+	}
+	if reaction := runUntilReaction(client1); len(reaction.Lowered) != 1 || reaction.Lowered[0] != hello2.Hello.SessionId {
+		t.Errorf("Expected lowered hand of %s, got %+v", hello2.Hello.SessionId, reaction)
+	}
+
+	// Emoji reactions are aggregated on all servers.
+	if err := client1.SendReaction("emoji", "+1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if reaction := runUntilReaction(client2); reaction.Emojis["+1"] != 1 {
+		t.Errorf("Expected emoji reaction, got %+v", reaction)
+	}
+}
@@ -0,0 +1,137 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"log"
+)
+
+const (
+	// Must match values in "RecordingService.php" from Nextcloud Talk.
+	RecordingConsentNotRequired = 0
+	RecordingConsentRequired    = 1
+)
+
+type roomRecordingConsentProperties struct {
+	RecordingConsent int `json:"recordingConsent"`
+}
+
+// withRecordingConsent returns a copy of the user entry with the recording
+// consent of the session set, the passed entry might be shared with other
+// messages and must not be modified.
+func withRecordingConsent(user map[string]interface{}, consent bool) map[string]interface{} {
+	result := make(map[string]interface{}, len(user)+1)
+	for k, v := range user {
+		result[k] = v
+	}
+	result["recordingConsent"] = consent
+	return result
+}
+
+// IsRecordingConsentRequired returns true if the backend requires sessions
+// to consent to being recorded before they may publish streams.
+func (r *Room) IsRecordingConsentRequired() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.isRecordingConsentRequiredLocked()
+}
+
+func (r *Room) isRecordingConsentRequiredLocked() bool {
+	if r.properties == nil {
+		return false
+	}
+
+	var properties roomRecordingConsentProperties
+	if err := json.Unmarshal(*r.properties, &properties); err != nil {
+		return false
+	}
+	return properties.RecordingConsent == RecordingConsentRequired
+}
+
+func (r *Room) HasRecordingConsent(session Session) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.recordingConsent[session.PublicId()]
+}
+
+// SetRecordingConsent stores the recording consent of a session in the room
+// and notifies the participants if it changed.
+func (r *Room) SetRecordingConsent(session Session, consent bool) bool {
+	sid := session.PublicId()
+	r.mu.Lock()
+	if _, found := r.sessions[sid]; !found {
+		r.mu.Unlock()
+		return false
+	}
+
+	if prev, found := r.recordingConsent[sid]; found && prev == consent {
+		r.mu.Unlock()
+		return false
+	}
+
+	r.recordingConsent[sid] = consent
+	r.mu.Unlock()
+	log.Printf("Session %s changed recording consent in room %s to %v", sid, r.Id(), consent)
+	r.publishRecordingConsentChanged(sid, consent)
+	return true
+}
+
+func (r *Room) publishRecordingConsentChanged(sessionId string, consent bool) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: r.id,
+				Changed: []map[string]interface{}{
+					{
+						"sessionId":        sessionId,
+						"recordingConsent": consent,
+					},
+				},
+				Users: r.addInternalSessions(r.getUsers()),
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish recording consent message in room %s: %s", r.Id(), err)
+	}
+}
+
+// IsAllowedToPublish returns false if the room requires consent to being
+// recorded and the session didn't consent yet.
+func (r *Room) IsAllowedToPublish(session Session) bool {
+	if session.ClientType() != HelloClientTypeClient {
+		// Only regular clients need to consent.
+		return true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.isRecordingConsentRequiredLocked() {
+		return true
+	}
+
+	return r.recordingConsent[session.PublicId()]
+}
@@ -0,0 +1,257 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	// Audio levels are reported by Janus in -dBov, 127 is silence.
+	speakerLevelSilence = 127
+
+	// Maximum number of recent dominant speakers to remember per room.
+	maxRecentSpeakers = 16
+)
+
+// getActiveSpeakerInterval returns the interval in which active speaker events
+// are sent to rooms, or 0 if they are disabled.
+func getActiveSpeakerInterval(config *goconf.ConfigFile) time.Duration {
+	interval, _ := config.GetInt("mcu", "activespeakerinterval")
+	if interval <= 0 {
+		return 0
+	}
+
+	return time.Duration(interval) * time.Millisecond
+}
+
+// getPrewarmSubscribers returns the number of recent speakers whose video
+// streams are subscribed as soon as a session joins a call.
+func getPrewarmSubscribers(config *goconf.ConfigFile) int {
+	count, _ := config.GetInt("mcu", "prewarmsubscribers")
+	if count <= 0 {
+		return 0
+	} else if count > maxRecentSpeakers {
+		count = maxRecentSpeakers
+	}
+
+	return count
+}
+
+type SpeakerListener interface {
+	PublicId() string
+	SendMessage(message *ServerMessage) bool
+}
+
+// RoomSpeakers keeps track of the sessions that are currently talking in a
+// room and notifies the listeners about the dominant speaker in regular
+// intervals.
+type RoomSpeakers struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// Audio levels of the talking sessions, lower levels are louder.
+	talking  map[string]float64
+	dominant string
+	// Sessions that recently were the dominant speaker, most recent first.
+	recent    []string
+	timer     *time.Timer
+	listeners map[SpeakerListener]bool
+	closed    bool
+}
+
+// NewRoomSpeakers creates a new container for talking sessions in a room that
+// checks for changes of the dominant speaker in the given interval.
+func NewRoomSpeakers(interval time.Duration) *RoomSpeakers {
+	return &RoomSpeakers{
+		interval: interval,
+		talking:  make(map[string]float64),
+	}
+}
+
+// AddListener adds a new listener to be notified about the dominant speaker.
+func (r *RoomSpeakers) AddListener(listener SpeakerListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listeners == nil {
+		r.listeners = make(map[SpeakerListener]bool)
+	}
+	r.listeners[listener] = true
+}
+
+// RemoveListener removes a previously registered listener.
+func (r *RoomSpeakers) RemoveListener(listener SpeakerListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.listeners, listener)
+}
+
+// SetTalking updates the talking state and audio level of a session.
+func (r *RoomSpeakers) SetTalking(sessionId string, talking bool, level float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	if !talking {
+		delete(r.talking, sessionId)
+		return
+	}
+
+	r.talking[sessionId] = level
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.interval, r.update)
+	}
+}
+
+// RemoveSession removes a session that left the room.
+func (r *RoomSpeakers) RemoveSession(sessionId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.talking, sessionId)
+	if r.dominant == sessionId {
+		r.dominant = ""
+	}
+	r.removeRecentLocked(sessionId)
+}
+
+func (r *RoomSpeakers) removeRecentLocked(sessionId string) {
+	for idx, id := range r.recent {
+		if id == sessionId {
+			r.recent = append(r.recent[:idx], r.recent[idx+1:]...)
+			return
+		}
+	}
+}
+
+// GetRecentSpeakers returns up to "count" sessions that were the dominant
+// speaker most recently, most recent first.
+func (r *RoomSpeakers) GetRecentSpeakers(count int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if count > len(r.recent) {
+		count = len(r.recent)
+	}
+	result := make([]string, count)
+	copy(result, r.recent)
+	return result
+}
+
+// GetDominantSpeaker returns the id of the session that was the dominant
+// speaker in the last interval.
+func (r *RoomSpeakers) GetDominantSpeaker() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.dominant
+}
+
+func (r *RoomSpeakers) getDominantLocked() string {
+	dominant := ""
+	level := float64(speakerLevelSilence + 1)
+	for sessionId, l := range r.talking {
+		// Keep the current speaker if others are talking as loud.
+		if l < level || (l == level && sessionId == r.dominant) {
+			dominant = sessionId
+			level = l
+		}
+	}
+	return dominant
+}
+
+func (r *RoomSpeakers) update() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+
+	if len(r.talking) > 0 {
+		r.timer.Reset(r.interval)
+	} else {
+		r.timer = nil
+	}
+
+	dominant := r.getDominantLocked()
+	if dominant == "" || dominant == r.dominant {
+		r.mu.Unlock()
+		return
+	}
+
+	r.dominant = dominant
+	r.removeRecentLocked(dominant)
+	r.recent = append([]string{dominant}, r.recent...)
+	if len(r.recent) > maxRecentSpeakers {
+		r.recent = r.recent[:maxRecentSpeakers]
+	}
+	talking := make([]string, 0, len(r.talking))
+	for sessionId := range r.talking {
+		talking = append(talking, sessionId)
+	}
+	sort.Strings(talking)
+	listeners := make([]SpeakerListener, 0, len(r.listeners))
+	for listener := range r.listeners {
+		listeners = append(listeners, listener)
+	}
+	r.mu.Unlock()
+
+	// Send outside of the lock as listeners might be removed concurrently
+	// while holding their own locks.
+	msg := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "room",
+			Type:   "speaker",
+			Speaker: &RoomEventSpeakerMessage{
+				SessionId: dominant,
+				Talking:   talking,
+			},
+		},
+	}
+	msg.Prepare()
+	for _, listener := range listeners {
+		listener.SendMessage(msg)
+	}
+}
+
+// Close stops sending updates.
+func (r *RoomSpeakers) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.talking = nil
+	r.recent = nil
+}
@@ -0,0 +1,144 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func waitForSpeakerMessages(ctx context.Context, t *testing.T, listener *testTypingListener) []*ServerMessage {
+	for {
+		if messages := listener.getMessages(); len(messages) > 0 {
+			return messages
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("No speaker update received for %s", listener.PublicId())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func Test_RoomSpeakers(t *testing.T) {
+	interval := 20 * time.Millisecond
+	speakers := NewRoomSpeakers(interval)
+	defer speakers.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	listener1 := &testTypingListener{publicId: "session1"}
+	speakers.AddListener(listener1)
+	listener2 := &testTypingListener{publicId: "session2"}
+	speakers.AddListener(listener2)
+
+	speakers.SetTalking("session1", true, 40)
+	speakers.SetTalking("session2", true, 30)
+	messages := waitForSpeakerMessages(ctx, t, listener1)
+	if len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	} else if msg := messages[0].Event; msg.Target != "room" || msg.Type != "speaker" {
+		t.Errorf("Expected speaker event, got %+v", msg)
+	} else if msg.Speaker.SessionId != "session2" || !reflect.DeepEqual(msg.Speaker.Talking, []string{"session1", "session2"}) {
+		t.Errorf("Expected session2 as dominant speaker, got %+v", msg.Speaker)
+	}
+	if messages := waitForSpeakerMessages(ctx, t, listener2); len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	}
+	if dominant := speakers.GetDominantSpeaker(); dominant != "session2" {
+		t.Errorf("Expected session2 as dominant speaker, got %s", dominant)
+	}
+
+	// No updates are sent while the dominant speaker doesn't change.
+	speakers.SetTalking("session1", true, 35)
+	time.Sleep(3 * interval)
+	if messages := listener1.getMessages(); len(messages) != 0 {
+		t.Errorf("Expected no updates, got %+v", messages)
+	}
+
+	speakers.SetTalking("session2", false, 60)
+	messages = waitForSpeakerMessages(ctx, t, listener1)
+	if len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	} else if msg := messages[0].Event.Speaker; msg.SessionId != "session1" || !reflect.DeepEqual(msg.Talking, []string{"session1"}) {
+		t.Errorf("Expected session1 as dominant speaker, got %+v", msg)
+	}
+
+	// The last dominant speaker is kept if nobody is talking.
+	speakers.SetTalking("session1", false, 60)
+	time.Sleep(3 * interval)
+	if messages := listener1.getMessages(); len(messages) != 0 {
+		t.Errorf("Expected no updates, got %+v", messages)
+	}
+	if dominant := speakers.GetDominantSpeaker(); dominant != "session1" {
+		t.Errorf("Expected session1 as dominant speaker, got %s", dominant)
+	}
+	if recent := speakers.GetRecentSpeakers(5); !reflect.DeepEqual(recent, []string{"session1", "session2"}) {
+		t.Errorf("Expected recent speakers session1 and session2, got %+v", recent)
+	}
+	if recent := speakers.GetRecentSpeakers(1); !reflect.DeepEqual(recent, []string{"session1"}) {
+		t.Errorf("Expected recent speaker session1, got %+v", recent)
+	}
+
+	speakers.RemoveSession("session1")
+	if dominant := speakers.GetDominantSpeaker(); dominant != "" {
+		t.Errorf("Expected no dominant speaker, got %s", dominant)
+	}
+	if recent := speakers.GetRecentSpeakers(5); !reflect.DeepEqual(recent, []string{"session2"}) {
+		t.Errorf("Expected recent speaker session2, got %+v", recent)
+	}
+}
+
+func Test_RoomSpeakersInterval(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if interval := getActiveSpeakerInterval(config); interval != 0 {
+		t.Errorf("Expected disabled active speaker events, got %s", interval)
+	}
+
+	config.AddOption("mcu", "activespeakerinterval", "500")
+	if interval := getActiveSpeakerInterval(config); interval != 500*time.Millisecond {
+		t.Errorf("Expected interval of 500ms, got %s", interval)
+	}
+}
+
+func Test_RoomSpeakersPrewarmSubscribers(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if count := getPrewarmSubscribers(config); count != 0 {
+		t.Errorf("Expected disabled prewarming, got %d", count)
+	}
+
+	config.AddOption("mcu", "prewarmsubscribers", "4")
+	if count := getPrewarmSubscribers(config); count != 4 {
+		t.Errorf("Expected 4 subscribers, got %d", count)
+	}
+
+	config.AddOption("mcu", "prewarmsubscribers", "100")
+	if count := getPrewarmSubscribers(config); count != maxRecentSpeakers {
+		t.Errorf("Expected %d subscribers, got %d", maxRecentSpeakers, count)
+	}
+}
@@ -32,9 +32,30 @@ var (
 		Name:      "sessions",
 		Help:      "The current number of sessions in a room",
 	}, []string{"backend", "room", "clienttype"})
+	statsRoomClientReportsCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "room",
+		Name:      "client_reports",
+		Help:      "The current number of sessions in a room that reported their connection quality",
+	}, []string{"backend", "room"})
+	statsRoomClientRttCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "room",
+		Name:      "client_rtt",
+		Help:      "The average round trip time in milliseconds reported by sessions in a room",
+	}, []string{"backend", "room"})
+	statsRoomClientPacketLossCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "signaling",
+		Subsystem: "room",
+		Name:      "client_packet_loss",
+		Help:      "The average packet loss in percent reported by sessions in a room",
+	}, []string{"backend", "room"})
 
 	roomStats = []prometheus.Collector{
 		statsRoomSessionsCurrent,
+		statsRoomClientReportsCurrent,
+		statsRoomClientRttCurrent,
+		statsRoomClientPacketLossCurrent,
 	}
 )
 
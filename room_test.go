@@ -27,10 +27,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http/httptest"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/dlintw/goconf"
 	"github.com/gorilla/websocket"
 )
 
@@ -420,6 +422,60 @@ func TestRoom_RoomSessionData(t *testing.T) {
 	wg.Wait()
 }
 
+func TestRoom_BatchPing(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	var rooms []*Room
+	for idx, roomId := range []string{"test-room1", "test-room2"} {
+		client := NewTestClient(t, server, hub)
+		defer client.CloseWithBye()
+
+		if err := client.SendHello(testDefaultUserId + strconv.Itoa(idx+1)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.RunUntilHello(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		}
+
+		room := hub.getRoom(roomId)
+		if room == nil {
+			t.Fatalf("Room %s not found", roomId)
+		}
+		rooms = append(rooms, room)
+	}
+
+	for _, room := range rooms {
+		entries, wg := room.publishActiveSessions()
+		if entries != 1 {
+			t.Errorf("expected 1 entries, got %d", entries)
+		}
+		wg.Wait()
+	}
+
+	// The sessions of both rooms are sent in one request.
+	hub.roomPing.mu.Lock()
+	for _, e := range hub.roomPing.entries {
+		if len(e.entries) != 2 {
+			t.Errorf("expected 2 entries, got %+v", e.entries)
+		}
+	}
+	hub.roomPing.mu.Unlock()
+
+	requests, wg := hub.roomPing.publishActiveSessions()
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+	wg.Wait()
+}
+
 func TestRoom_InCallAll(t *testing.T) {
 	hub, _, router, server := CreateHubForTest(t)
 
@@ -564,3 +620,158 @@ func TestRoom_InCallAll(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRoom_AudioBridge(t *testing.T) {
+	hub, _, _, server := CreateHubForTestWithConfig(t, func(server *httptest.Server) (*goconf.ConfigFile, error) {
+		config, err := getTestConfig(server)
+		if err != nil {
+			return nil, err
+		}
+
+		config.AddOption("backend", "audiobridge", "3")
+		return config, nil
+	})
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only rooms with the configured type are using the audio bridge.
+	for _, roomId := range []string{"test-room", "test-room-audiobridge"} {
+		expected := roomId == "test-room-audiobridge"
+		if room, err := client.JoinRoom(ctx, roomId); err != nil {
+			t.Fatal(err)
+		} else if room.Room.RoomId != roomId {
+			t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+		} else if room.Room.AudioBridge != expected {
+			t.Errorf("Expected audio bridge %v for room %s, got %+v", expected, roomId, room.Room)
+		}
+		if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+			t.Fatal(err)
+		}
+
+		if room := hub.getRoom(roomId); room == nil {
+			t.Errorf("Room %s not found", roomId)
+		} else if room.UsesAudioBridge() != expected {
+			t.Errorf("Expected room %s to use audio bridge %v", roomId, expected)
+		}
+	}
+}
+
+func TestRoom_RecordingConsent(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	hello, err := client.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !hasFeature(hello.Hello.Server, ServerFeatureRecordingConsent) {
+		t.Errorf("Expected feature %s, got %+v", ServerFeatureRecordingConsent, hello.Hello.Server.Features)
+	}
+
+	roomId := "test-room-recording-consent"
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	if err := client.RunUntilJoined(ctx, hello.Hello); err != nil {
+		t.Fatal(err)
+	}
+
+	room := hub.getRoom(roomId)
+	if room == nil {
+		t.Fatalf("Room %s not found", roomId)
+	} else if !room.IsRecordingConsentRequired() {
+		t.Errorf("Expected room %s to require recording consent", roomId)
+	}
+
+	session := hub.GetSessionByPublicId(hello.Hello.SessionId).(*ClientSession)
+	session.SetPermissions([]Permission{PERMISSION_MAY_PUBLISH_AUDIO})
+
+	sendOffer := func() {
+		if err := client.SendMessage(MessageClientMessageRecipient{
+			Type:      "session",
+			SessionId: hello.Hello.SessionId,
+		}, MessageClientMessageData{
+			Type:     "offer",
+			Sid:      "54321",
+			RoomType: "video",
+			Payload: map[string]interface{}{
+				"sdp": MockSdpOfferAudioOnly,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Publishing is not allowed without consent.
+	sendOffer()
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.WriteJSON(&ClientMessage{
+		Type: "recording",
+		Recording: &RecordingClientMessage{
+			Type:    "consent",
+			Consent: true,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := client.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "event"); err != nil {
+		t.Fatal(err)
+	} else if msg.Event.Target != "participants" || msg.Event.Type != "update" {
+		t.Errorf("Expected participants update, got %+v", msg.Event)
+	} else if users := msg.Event.Update.Users; len(users) != 1 {
+		t.Errorf("Expected one participant, got %+v", msg.Event.Update)
+	} else if users[0]["sessionId"] != hello.Hello.SessionId || users[0]["recordingConsent"] != true {
+		t.Errorf("Expected recording consent of %s, got %+v", hello.Hello.SessionId, users[0])
+	}
+
+	if !room.HasRecordingConsent(session) {
+		t.Errorf("Expected session %s to have consented", session.PublicId())
+	}
+
+	sendOffer()
+	if err := client.RunUntilAnswer(ctx, MockSdpAnswerAudioOnly); err != nil {
+		t.Fatal(err)
+	}
+}
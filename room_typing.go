@@ -0,0 +1,202 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// Sessions are no longer typing if they didn't send an update in this
+	// interval.
+	typingTimeout = 5 * time.Second
+
+	// Minimum interval between changes of the typing state of a session that
+	// will be sent to the other sessions in the room.
+	typingMinInterval = time.Second
+)
+
+type TypingListener interface {
+	PublicId() string
+	SendMessage(message *ServerMessage) bool
+}
+
+type typingSession struct {
+	timer *time.Timer
+}
+
+// RoomTyping keeps track of the sessions that are currently typing in a room
+// and expires them automatically.
+type RoomTyping struct {
+	mu        sync.Mutex
+	typing    map[string]*typingSession
+	changed   map[string]time.Time
+	listeners map[TypingListener]bool
+	closed    bool
+}
+
+// NewRoomTyping creates a new container for typing sessions in a room.
+func NewRoomTyping() *RoomTyping {
+	return &RoomTyping{}
+}
+
+// AddListener adds a new listener to be notified about typing sessions.
+func (r *RoomTyping) AddListener(listener TypingListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.listeners == nil {
+		r.listeners = make(map[TypingListener]bool)
+	}
+	r.listeners[listener] = true
+}
+
+// RemoveListener removes a previously registered listener.
+func (r *RoomTyping) RemoveListener(listener TypingListener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.listeners, listener)
+}
+
+// StartTyping marks the given session as typing. Returns false if no update
+// was sent to the listeners, i.e. because the session was already typing or
+// changed its state too often.
+func (r *RoomTyping) StartTyping(sessionId string) bool {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return false
+	}
+
+	if s, found := r.typing[sessionId]; found {
+		// Still typing, only refresh the expiration.
+		s.timer.Reset(typingTimeout)
+		r.mu.Unlock()
+		return false
+	}
+
+	now := time.Now()
+	if last, found := r.changed[sessionId]; found && now.Sub(last) < typingMinInterval {
+		r.mu.Unlock()
+		return false
+	}
+
+	if r.typing == nil {
+		r.typing = make(map[string]*typingSession)
+	}
+	if r.changed == nil {
+		r.changed = make(map[string]time.Time)
+	}
+	ts := &typingSession{}
+	ts.timer = time.AfterFunc(typingTimeout, func() {
+		r.stopTyping(sessionId, ts)
+	})
+	r.typing[sessionId] = ts
+	r.changed[sessionId] = now
+	listeners := r.getListenersLocked(sessionId)
+	r.mu.Unlock()
+
+	r.notify(listeners, sessionId, "start")
+	return true
+}
+
+// StopTyping marks the given session as no longer typing. Returns false if
+// the session was not typing.
+func (r *RoomTyping) StopTyping(sessionId string) bool {
+	return r.stopTyping(sessionId, nil)
+}
+
+func (r *RoomTyping) stopTyping(sessionId string, expected *typingSession) bool {
+	r.mu.Lock()
+	s, found := r.typing[sessionId]
+	if !found || r.closed || (expected != nil && s != expected) {
+		r.mu.Unlock()
+		return false
+	}
+
+	s.timer.Stop()
+	delete(r.typing, sessionId)
+	listeners := r.getListenersLocked(sessionId)
+	r.mu.Unlock()
+
+	r.notify(listeners, sessionId, "stop")
+	return true
+}
+
+// RemoveSession stops typing of a session that left the room.
+func (r *RoomTyping) RemoveSession(sessionId string) {
+	r.StopTyping(sessionId)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.changed, sessionId)
+}
+
+// IsTyping returns true if the given session is currently typing.
+func (r *RoomTyping) IsTyping(sessionId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, found := r.typing[sessionId]
+	return found
+}
+
+func (r *RoomTyping) getListenersLocked(sessionId string) []TypingListener {
+	listeners := make([]TypingListener, 0, len(r.listeners))
+	for listener := range r.listeners {
+		if listener.PublicId() != sessionId {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners
+}
+
+func (r *RoomTyping) notify(listeners []TypingListener, sessionId string, typingType string) {
+	// Send outside of the lock as listeners might be removed concurrently
+	// while holding their own locks.
+	msg := &ServerMessage{
+		Type: "typing",
+		Typing: &TypingServerMessage{
+			Type:      typingType,
+			SessionId: sessionId,
+		},
+	}
+	msg.Prepare()
+	for _, listener := range listeners {
+		listener.SendMessage(msg)
+	}
+}
+
+// Close stops all pending expirations.
+func (r *RoomTyping) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, s := range r.typing {
+		s.timer.Stop()
+	}
+	r.typing = nil
+	r.changed = nil
+}
@@ -0,0 +1,182 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testTypingListener struct {
+	testReactionsListener
+
+	publicId string
+}
+
+func (l *testTypingListener) PublicId() string {
+	return l.publicId
+}
+
+func Test_RoomTyping(t *testing.T) {
+	typingTimeout = 50 * time.Millisecond
+	typingMinInterval = 20 * time.Millisecond
+	defer func() {
+		typingTimeout = 5 * time.Second
+		typingMinInterval = time.Second
+	}()
+
+	typing := NewRoomTyping()
+	defer typing.Close()
+
+	listener1 := &testTypingListener{publicId: "session1"}
+	typing.AddListener(listener1)
+	listener2 := &testTypingListener{publicId: "session2"}
+	typing.AddListener(listener2)
+
+	if !typing.StartTyping("session1") {
+		t.Error("should have started typing")
+	}
+	if typing.StartTyping("session1") {
+		t.Error("should not have started typing again")
+	}
+	if messages := listener1.getMessages(); len(messages) != 0 {
+		t.Errorf("Typing session should not receive own updates, got %+v", messages)
+	}
+	if messages := listener2.getMessages(); len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	} else if msg := messages[0].Typing; msg.Type != "start" || msg.SessionId != "session1" {
+		t.Errorf("Expected start of session1, got %+v", msg)
+	}
+
+	if !typing.StopTyping("session1") {
+		t.Error("should have stopped typing")
+	}
+	if typing.StopTyping("session1") {
+		t.Error("should not have stopped typing again")
+	}
+	if messages := listener2.getMessages(); len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	} else if msg := messages[0].Typing; msg.Type != "stop" || msg.SessionId != "session1" {
+		t.Errorf("Expected stop of session1, got %+v", msg)
+	}
+
+	// Changes are rate limited.
+	if typing.StartTyping("session1") {
+		t.Error("should not have started typing while rate limited")
+	}
+
+	time.Sleep(typingMinInterval)
+	if !typing.StartTyping("session1") {
+		t.Error("should have started typing")
+	}
+	listener2.getMessages()
+
+	// Typing expires automatically.
+	time.Sleep(2 * typingTimeout)
+	if typing.IsTyping("session1") {
+		t.Error("typing should have expired")
+	}
+	if messages := listener2.getMessages(); len(messages) != 1 {
+		t.Errorf("Expected one update, got %+v", messages)
+	} else if msg := messages[0].Typing; msg.Type != "stop" || msg.SessionId != "session1" {
+		t.Errorf("Expected stop of session1, got %+v", msg)
+	}
+}
+
+func Test_RoomTypingMessages(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	client1 := NewTestClient(t, server, hub)
+	defer client1.CloseWithBye()
+	if err := client1.SendHello(testDefaultUserId + "1"); err != nil {
+		t.Fatal(err)
+	}
+	hello1, err := client1.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client1.SendTyping("start"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client1.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageError(msg, "not_in_room"); err != nil {
+		t.Fatal(err)
+	}
+
+	client2 := NewTestClient(t, server, hub)
+	defer client2.CloseWithBye()
+	if err := client2.SendHello(testDefaultUserId + "2"); err != nil {
+		t.Fatal(err)
+	}
+	hello2, err := client2.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roomId := "test-room"
+	if _, err := client1.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client2.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	}
+	WaitForUsersJoined(ctx, t, client1, hello1, client2, hello2)
+
+	if err := client1.SendTyping("start"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := client2.RunUntilMessage(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg, "typing"); err != nil {
+		t.Fatal(err)
+	} else if msg.Typing.Type != "start" || msg.Typing.SessionId != hello1.Hello.SessionId {
+		t.Errorf("Expected start of %s, got %+v", hello1.Hello.SessionId, msg.Typing)
+	}
+
+	// Leaving the room stops typing.
+	if _, err := client1.JoinRoom(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := client2.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "event" {
+			// Ignore "leave" events.
+			continue
+		}
+
+		if err := checkMessageType(msg, "typing"); err != nil {
+			t.Fatal(err)
+		} else if msg.Typing.Type != "stop" || msg.Typing.SessionId != hello1.Hello.SessionId {
+			t.Errorf("Expected stop of %s, got %+v", hello1.Hello.SessionId, msg.Typing)
+		}
+		break
+	}
+}
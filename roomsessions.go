@@ -23,6 +23,13 @@ package signaling
 
 import (
 	"fmt"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	RoomSessionsTypeBuiltin = "builtin"
+	RoomSessionsTypeRedis   = "redis"
 )
 
 var (
@@ -34,4 +41,22 @@ type RoomSessions interface {
 	DeleteRoomSession(session Session)
 
 	GetSessionId(roomSessionId string) (string, error)
+
+	Close()
+}
+
+// NewRoomSessions creates the storage for room sessions configured in the
+// section "roomsessions".
+func NewRoomSessions(config *goconf.ConfigFile) (RoomSessions, error) {
+	roomSessionsType, _ := config.GetString("roomsessions", "type")
+	switch roomSessionsType {
+	case "":
+		fallthrough
+	case RoomSessionsTypeBuiltin:
+		return NewBuiltinRoomSessions()
+	case RoomSessionsTypeRedis:
+		return NewRedisRoomSessions(config)
+	default:
+		return nil, fmt.Errorf("unsupported room sessions type: %s", roomSessionsType)
+	}
 }
@@ -68,6 +68,9 @@ func (r *BuiltinRoomSessions) DeleteRoomSession(session Session) {
 	}
 }
 
+func (r *BuiltinRoomSessions) Close() {
+}
+
 func (r *BuiltinRoomSessions) GetSessionId(roomSessionId string) (string, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -0,0 +1,335 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultRedisPrefix = "signaling:"
+
+	// Mappings expire if they are not refreshed by the signaling server that
+	// owns the session, e.g. because it crashed.
+	defaultRedisRoomSessionsTtl = 60 * time.Second
+
+	redisRequestTimeout = 5 * time.Second
+)
+
+var (
+	// Only delete the mapping of the room session if it still belongs to the
+	// session, it might have been taken over by a different session.
+	redisDeleteRoomSession = redis.NewScript(`
+redis.call("DEL", KEYS[1], KEYS[3])
+redis.call("SREM", KEYS[4], ARGV[1])
+if redis.call("GET", KEYS[2]) == ARGV[1] then
+	redis.call("DEL", KEYS[2])
+end
+return 1
+`)
+)
+
+// RedisRoomSessions stores the room sessions in Redis, so they are available
+// to all signaling servers of a cluster. The mappings of sessions are owned
+// by the signaling server ("hub") they are connected to and expire if they
+// are not refreshed by it.
+type RedisRoomSessions struct {
+	client *redis.Client
+	prefix string
+	hubId  string
+	ttl    time.Duration
+
+	mu sync.Mutex
+	// Room session ids of the local sessions, indexed by session id.
+	sessions map[string]string
+
+	closeChan chan struct{}
+	closed    sync.WaitGroup
+}
+
+// NewRedisClient creates a client for the server configured in the "redis"
+// section and returns the prefix to use for keys.
+func NewRedisClient(config *goconf.ConfigFile) (*redis.Client, string, error) {
+	redisUrl, _ := config.GetString("redis", "url")
+	if redisUrl == "" {
+		return nil, "", fmt.Errorf("no redis url configured")
+	}
+
+	options, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid redis url: %w", err)
+	}
+
+	prefix, _ := config.GetString("redis", "prefix")
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+
+	return redis.NewClient(options), prefix, nil
+}
+
+func NewRedisRoomSessions(config *goconf.ConfigFile) (RoomSessions, error) {
+	client, prefix, err := NewRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hubId, _ := config.GetString("redis", "hubid")
+	if hubId == "" {
+		hubId = newRandomString(16)
+	}
+	ttl := defaultRedisRoomSessionsTtl
+	if seconds, _ := config.GetInt("redis", "ttl"); seconds > 0 {
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	result := &RedisRoomSessions{
+		client: client,
+		prefix: prefix,
+		hubId:  hubId,
+		ttl:    ttl,
+
+		sessions: make(map[string]string),
+
+		closeChan: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		// Don't fail startup, the server might become available later.
+		log.Printf("Could not connect to redis server %s: %s", client.Options().Addr, err)
+	} else {
+		log.Printf("Storing room sessions of hub %s in redis server %s", hubId, client.Options().Addr)
+		// Sessions of a previous run with the same hub id no longer exist.
+		result.cleanup(ctx)
+	}
+
+	result.closed.Add(1)
+	go result.run()
+	return result, nil
+}
+
+func (r *RedisRoomSessions) run() {
+	defer r.closed.Done()
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh()
+		case <-r.closeChan:
+			return
+		}
+	}
+}
+
+// HubId returns the id of the signaling server that is stored as owner of
+// the local sessions.
+func (r *RedisRoomSessions) HubId() string {
+	return r.hubId
+}
+
+func (r *RedisRoomSessions) sessionKey(sessionId string) string {
+	return r.prefix + "session:" + sessionId
+}
+
+func (r *RedisRoomSessions) roomSessionKey(roomSessionId string) string {
+	return r.prefix + "roomsession:" + roomSessionId
+}
+
+func (r *RedisRoomSessions) sessionHubKey(sessionId string) string {
+	return r.prefix + "sessionhub:" + sessionId
+}
+
+func (r *RedisRoomSessions) hubKey(hubId string) string {
+	return r.prefix + "hub:" + hubId
+}
+
+func (r *RedisRoomSessions) SetRoomSession(session Session, roomSessionId string) error {
+	if roomSessionId == "" {
+		r.DeleteRoomSession(session)
+		return nil
+	}
+
+	sid := session.PublicId()
+	if sid == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.sessionKey(sid), roomSessionId, r.ttl)
+		pipe.Set(ctx, r.roomSessionKey(roomSessionId), sid, r.ttl)
+		pipe.Set(ctx, r.sessionHubKey(sid), r.hubId, r.ttl)
+		pipe.SAdd(ctx, r.hubKey(r.hubId), sid)
+		pipe.Expire(ctx, r.hubKey(r.hubId), r.ttl)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.sessions[sid] = roomSessionId
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *RedisRoomSessions) DeleteRoomSession(session Session) {
+	sid := session.PublicId()
+	if sid == "" {
+		return
+	}
+
+	r.mu.Lock()
+	delete(r.sessions, sid)
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	r.deleteRoomSession(ctx, sid)
+}
+
+func (r *RedisRoomSessions) deleteRoomSession(ctx context.Context, sid string) {
+	roomSessionId, err := r.client.Get(ctx, r.sessionKey(sid)).Result()
+	if errors.Is(err, redis.Nil) {
+		// The room session might have expired, the owner must still be removed.
+		roomSessionId = ""
+	} else if err != nil {
+		log.Printf("Could not get room session of %s: %s", sid, err)
+		return
+	}
+
+	hubId, err := r.client.Get(ctx, r.sessionHubKey(sid)).Result()
+	if errors.Is(err, redis.Nil) {
+		hubId = r.hubId
+	} else if err != nil {
+		log.Printf("Could not get hub of %s: %s", sid, err)
+		return
+	}
+
+	keys := []string{
+		r.sessionKey(sid),
+		r.roomSessionKey(roomSessionId),
+		r.sessionHubKey(sid),
+		r.hubKey(hubId),
+	}
+	if err := redisDeleteRoomSession.Run(ctx, r.client, keys, sid).Err(); err != nil {
+		log.Printf("Could not delete room session %s of %s: %s", roomSessionId, sid, err)
+	}
+}
+
+// refresh extends the expiration of the mappings of all local sessions.
+func (r *RedisRoomSessions) refresh() {
+	r.mu.Lock()
+	sessions := make(map[string]string, len(r.sessions))
+	for sid, roomSessionId := range r.sessions {
+		sessions[sid] = roomSessionId
+	}
+	r.mu.Unlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for sid, roomSessionId := range sessions {
+			pipe.Expire(ctx, r.sessionKey(sid), r.ttl)
+			pipe.Expire(ctx, r.roomSessionKey(roomSessionId), r.ttl)
+			pipe.Expire(ctx, r.sessionHubKey(sid), r.ttl)
+		}
+		pipe.Expire(ctx, r.hubKey(r.hubId), r.ttl)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not refresh %d room sessions: %s", len(sessions), err)
+	}
+}
+
+// cleanup removes the mappings of all sessions that are owned by this hub.
+func (r *RedisRoomSessions) cleanup(ctx context.Context) {
+	sids, err := r.client.SMembers(ctx, r.hubKey(r.hubId)).Result()
+	if err != nil {
+		log.Printf("Could not get room sessions of hub %s: %s", r.hubId, err)
+		return
+	}
+
+	for _, sid := range sids {
+		r.deleteRoomSession(ctx, sid)
+	}
+	if len(sids) > 0 {
+		log.Printf("Removed %d room sessions of hub %s", len(sids), r.hubId)
+	}
+}
+
+// GetHubId returns the id of the signaling server the session with the given
+// id is connected to.
+func (r *RedisRoomSessions) GetHubId(sessionId string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	hubId, err := r.client.Get(ctx, r.sessionHubKey(sessionId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNoSuchRoomSession
+	} else if err != nil {
+		return "", err
+	}
+
+	return hubId, nil
+}
+
+func (r *RedisRoomSessions) GetSessionId(roomSessionId string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	sid, err := r.client.Get(ctx, r.roomSessionKey(roomSessionId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNoSuchRoomSession
+	} else if err != nil {
+		return "", err
+	}
+
+	return sid, nil
+}
+
+func (r *RedisRoomSessions) Close() {
+	close(r.closeChan)
+	r.closed.Wait()
+
+	// The local sessions are gone, so their mappings must no longer be used.
+	ctx, cancel := context.WithTimeout(context.Background(), redisRequestTimeout)
+	defer cancel()
+	r.cleanup(ctx)
+	if err := r.client.Close(); err != nil {
+		log.Printf("Error closing redis client: %s", err)
+	}
+}
@@ -0,0 +1,191 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dlintw/goconf"
+)
+
+func newRedisRoomSessionsForTest(t *testing.T) (*miniredis.Miniredis, RoomSessions) {
+	server := miniredis.RunT(t)
+
+	config := goconf.NewConfigFile()
+	config.AddOption("roomsessions", "type", RoomSessionsTypeRedis)
+	config.AddOption("redis", "url", "redis://"+server.Addr())
+	config.AddOption("redis", "prefix", "test:")
+	sessions, err := NewRoomSessions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sessions.Close()
+	})
+	return server, sessions
+}
+
+func TestRedisRoomSessions(t *testing.T) {
+	server, sessions := newRedisRoomSessionsForTest(t)
+
+	testRoomSessions(t, sessions)
+
+	if value, err := server.Get("test:roomsession:room-session"); err != nil {
+		t.Error(err)
+	} else if value != "session2" {
+		t.Errorf("Expected session2, got %s", value)
+	}
+}
+
+func TestRedisRoomSessionsShared(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	config := goconf.NewConfigFile()
+	config.AddOption("roomsessions", "type", RoomSessionsTypeRedis)
+	config.AddOption("redis", "url", "redis://"+server.Addr())
+	sessions1, err := NewRoomSessions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions1.Close()
+	sessions2, err := NewRoomSessions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions2.Close()
+
+	// Room sessions stored by one server can be retrieved from others.
+	session := checkSession(t, sessions1, "session1", "room1")
+	if sid, err := sessions2.GetSessionId("room1"); err != nil {
+		t.Error(err)
+	} else if sid != session.PublicId() {
+		t.Errorf("Expected session id %s, got %s", session.PublicId(), sid)
+	}
+
+	sessions2.DeleteRoomSession(session)
+	if sid, err := sessions1.GetSessionId("room1"); err != ErrNoSuchRoomSession {
+		t.Errorf("Expected error about invalid room session, got %s (%s)", sid, err)
+	}
+}
+
+func TestRoomSessionsInvalid(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("roomsessions", "type", "unknown")
+	if _, err := NewRoomSessions(config); err == nil {
+		t.Error("should have failed for unknown type")
+	}
+
+	config.AddOption("roomsessions", "type", RoomSessionsTypeRedis)
+	if _, err := NewRoomSessions(config); err == nil {
+		t.Error("should have failed without redis url")
+	}
+
+	config.AddOption("redis", "url", "invalid://foo")
+	if _, err := NewRoomSessions(config); err == nil {
+		t.Error("should have failed with invalid redis url")
+	}
+}
+
+func TestRedisRoomSessionsExpire(t *testing.T) {
+	server, sessions := newRedisRoomSessionsForTest(t)
+	redisSessions := sessions.(*RedisRoomSessions)
+
+	session := checkSession(t, sessions, "session1", "room1")
+	if hubId, err := redisSessions.GetHubId(session.PublicId()); err != nil {
+		t.Error(err)
+	} else if hubId != redisSessions.HubId() {
+		t.Errorf("Expected hub %s, got %s", redisSessions.HubId(), hubId)
+	}
+
+	// Mappings are kept while they are refreshed by the hub.
+	for i := 0; i < 3; i++ {
+		server.FastForward(defaultRedisRoomSessionsTtl / 2)
+		redisSessions.refresh()
+	}
+	if sid, err := sessions.GetSessionId("room1"); err != nil {
+		t.Error(err)
+	} else if sid != session.PublicId() {
+		t.Errorf("Expected session id %s, got %s", session.PublicId(), sid)
+	}
+
+	// Mappings of a crashed hub expire.
+	server.FastForward(defaultRedisRoomSessionsTtl + time.Second)
+	if sid, err := sessions.GetSessionId("room1"); err != ErrNoSuchRoomSession {
+		t.Errorf("Expected error about invalid room session, got %s (%s)", sid, err)
+	}
+	if hubId, err := redisSessions.GetHubId(session.PublicId()); err != ErrNoSuchRoomSession {
+		t.Errorf("Expected error about invalid session, got %s (%s)", hubId, err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("Expected all keys to expire, got %+v", keys)
+	}
+}
+
+func TestRedisRoomSessionsCleanup(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	config := goconf.NewConfigFile()
+	config.AddOption("roomsessions", "type", RoomSessionsTypeRedis)
+	config.AddOption("redis", "url", "redis://"+server.Addr())
+	config.AddOption("redis", "hubid", "hub1")
+	sessions1, err := NewRoomSessions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSession(t, sessions1, "session1", "room1")
+	checkSession(t, sessions1, "session2", "room2")
+	if owned, err := server.SMembers("signaling:hub:hub1"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(owned, []string{"session1", "session2"}) {
+		t.Errorf("Expected sessions of hub1, got %+v", owned)
+	}
+
+	// Simulate a crash, the hub is restarted without removing its sessions.
+	crashed := sessions1.(*RedisRoomSessions)
+	close(crashed.closeChan)
+	crashed.closed.Wait()
+	crashed.client.Close() // nolint
+
+	sessions2, err := NewRoomSessions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, roomSessionId := range []string{"room1", "room2"} {
+		if sid, err := sessions2.GetSessionId(roomSessionId); err != ErrNoSuchRoomSession {
+			t.Errorf("Expected error about invalid room session %s, got %s (%s)", roomSessionId, sid, err)
+		}
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("Expected all keys to be removed, got %+v", keys)
+	}
+
+	// Mappings of the hub are removed when it is closed.
+	checkSession(t, sessions2, "session3", "room3")
+	sessions2.Close()
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("Expected all keys to be removed, got %+v", keys)
+	}
+}
@@ -0,0 +1,56 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+// internRosterStrings returns a copy of the participants list where keys and
+// string values that were also contained in the previous list share their
+// memory with it. In large rooms this avoids keeping duplicate copies of the
+// same ids for every participant after each update.
+//
+// The returned map contains the strings of the new list and must be passed
+// as "previous" when the next list is received.
+func internRosterStrings(users []map[string]interface{}, previous map[string]string) ([]map[string]interface{}, map[string]string) {
+	strings := make(map[string]string, len(previous))
+	intern := func(s string) string {
+		if result, found := strings[s]; found {
+			return result
+		}
+		if result, found := previous[s]; found {
+			s = result
+		}
+		strings[s] = s
+		return s
+	}
+
+	result := make([]map[string]interface{}, 0, len(users))
+	for _, user := range users {
+		entry := make(map[string]interface{}, len(user))
+		for key, value := range user {
+			if s, ok := value.(string); ok {
+				value = intern(s)
+			}
+			entry[intern(key)] = value
+		}
+		result = append(result, entry)
+	}
+	return result, strings
+}
@@ -0,0 +1,135 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func stringDataPointer(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data // nolint
+}
+
+func decodeTestUsers(t testing.TB, data []byte) []map[string]interface{} {
+	var users []map[string]interface{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func generateTestUsers(count int) []byte {
+	users := make([]map[string]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		users = append(users, map[string]interface{}{
+			"sessionId":          fmt.Sprintf("session-%d", i),
+			"nextcloudSessionId": fmt.Sprintf("nextcloud-session-%d", i),
+			"userId":             fmt.Sprintf("user-%d", i),
+			"inCall":             FlagInCall | FlagWithAudio,
+			"lastPing":           1234567890,
+			"participantType":    3,
+		})
+	}
+	data, err := json.Marshal(users)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestInternRosterStrings(t *testing.T) {
+	data1 := []byte(`[{"sessionId":"session-1","userId":"user-1","inCall":1},{"sessionId":"session-2","userId":"user-1","inCall":0}]`)
+	data2 := []byte(`[{"sessionId":"session-1","userId":"user-1","inCall":0},{"sessionId":"session-3","userId":"user-3","inCall":1}]`)
+
+	users1 := decodeTestUsers(t, data1)
+	interned1, strings1 := internRosterStrings(users1, nil)
+	if !reflect.DeepEqual(users1, interned1) {
+		t.Errorf("Expected %+v, got %+v", users1, interned1)
+	}
+	if a, b := interned1[0]["userId"].(string), interned1[1]["userId"].(string); stringDataPointer(a) != stringDataPointer(b) {
+		t.Errorf("Expected shared user id in same list")
+	}
+
+	users2 := decodeTestUsers(t, data2)
+	interned2, strings2 := internRosterStrings(users2, strings1)
+	if !reflect.DeepEqual(users2, interned2) {
+		t.Errorf("Expected %+v, got %+v", users2, interned2)
+	}
+	if a, b := interned1[0]["sessionId"].(string), interned2[0]["sessionId"].(string); stringDataPointer(a) != stringDataPointer(b) {
+		t.Errorf("Expected shared session id between lists")
+	}
+
+	// Strings that are no longer used are not kept.
+	if _, found := strings2["session-2"]; found {
+		t.Errorf("Expected session-2 to be removed, got %+v", strings2)
+	}
+	if _, found := strings2["session-3"]; !found {
+		t.Errorf("Expected session-3 to be added, got %+v", strings2)
+	}
+}
+
+// measureRetained returns the number of bytes on the heap that are still
+// referenced by the result of the passed function.
+func measureRetained(f func() interface{}) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	result := f()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(result)
+	return float64(after.HeapAlloc) - float64(before.HeapAlloc)
+}
+
+func BenchmarkRoster_Decode10k(b *testing.B) {
+	data := generateTestUsers(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeTestUsers(b, data)
+	}
+	b.StopTimer()
+	b.ReportMetric(measureRetained(func() interface{} {
+		return decodeTestUsers(b, data)
+	}), "retained-B")
+}
+
+func BenchmarkRoster_DecodeIntern10k(b *testing.B) {
+	data := generateTestUsers(10000)
+	_, previous := internRosterStrings(decodeTestUsers(b, data), nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, previous = internRosterStrings(decodeTestUsers(b, data), previous)
+	}
+	b.StopTimer()
+	b.ReportMetric(measureRetained(func() interface{} {
+		users, _ := internRosterStrings(decodeTestUsers(b, data), previous)
+		return users
+	}), "retained-B")
+	runtime.KeepAlive(previous)
+}
@@ -0,0 +1,430 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	signaling "github.com/strukturag/nextcloud-spreed-signaling"
+)
+
+var (
+	version = "unreleased"
+
+	formatFlag = flag.String("format", "jsonschema", "output format, either \"jsonschema\" or \"typescript\"")
+
+	outputFlag = flag.String("output", "", "file to write to, defaults to stdout")
+
+	showVersion = flag.Bool("version", false, "show version and quit")
+)
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	timeType       = reflect.TypeOf(time.Time{})
+	signalingPkg   = reflect.TypeOf(signaling.ClientMessage{}).PkgPath()
+)
+
+// The messages that are exchanged between clients and the signaling server.
+// All other types are collected from their fields.
+var rootTypes = []reflect.Type{
+	reflect.TypeOf(signaling.ClientMessage{}),
+	reflect.TypeOf(signaling.ServerMessage{}),
+}
+
+type field struct {
+	Name     string
+	Type     reflect.Type
+	Optional bool
+}
+
+// collector walks the protocol types and records all named types in the
+// order they are first referenced.
+type collector struct {
+	names []string
+	types map[string]reflect.Type
+}
+
+func newCollector() *collector {
+	return &collector{
+		types: make(map[string]reflect.Type),
+	}
+}
+
+// isDefinition returns true if the type should be emitted as separate
+// definition instead of being inlined.
+func isDefinition(t reflect.Type) bool {
+	if t.Name() == "" || t == rawMessageType || t == timeType {
+		return false
+	}
+
+	return t.Kind() == reflect.Struct || t.PkgPath() == signalingPkg
+}
+
+func (c *collector) add(t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if isDefinition(t) {
+		if prev, found := c.types[t.Name()]; found {
+			if prev != t {
+				log.Fatalf("Type %s is defined in %s and %s", t.Name(), prev.PkgPath(), t.PkgPath())
+			}
+			return
+		}
+
+		c.names = append(c.names, t.Name())
+		c.types[t.Name()] = t
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for _, f := range getFields(t) {
+			c.add(f.Type)
+		}
+	case reflect.Slice:
+		fallthrough
+	case reflect.Array:
+		fallthrough
+	case reflect.Map:
+		if t != rawMessageType {
+			c.add(t.Elem())
+		}
+	}
+}
+
+// getFields returns the fields of a struct like they are serialized by
+// "encoding/json", including the fields of embedded structs.
+func getFields(t reflect.Type) []field {
+	var result []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		parts := strings.SplitN(tag, ",", 2)
+		name, options := parts[0], ""
+		if len(parts) > 1 {
+			options = parts[1]
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				result = append(result, getFields(ft)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		result = append(result, field{
+			Name:     name,
+			Type:     f.Type,
+			Optional: strings.Contains(","+options+",", ",omitempty,"),
+		})
+	}
+	return result
+}
+
+// elemType returns the element type of a slice, array or map. Elements are
+// never serialized as "null" by the server, so pointers are removed.
+func elemType(t reflect.Type) reflect.Type {
+	t = t.Elem()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+func isInteger(kind reflect.Kind) bool {
+	return isNumber(kind) && kind != reflect.Float32 && kind != reflect.Float64
+}
+
+func jsonSchemaType(t reflect.Type, root bool) interface{} {
+	if t.Kind() == reflect.Ptr {
+		return map[string]interface{}{
+			"anyOf": []interface{}{
+				jsonSchemaType(t.Elem(), false),
+				map[string]interface{}{"type": "null"},
+			},
+		}
+	}
+
+	if !root && isDefinition(t) {
+		return map[string]interface{}{
+			"$ref": "#/$defs/" + t.Name(),
+		}
+	}
+
+	switch {
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == timeType:
+		return map[string]interface{}{
+			"type":   "string",
+			"format": "date-time",
+		}
+	case isInteger(t.Kind()):
+		return map[string]interface{}{"type": "integer"}
+	case isNumber(t.Kind()):
+		return map[string]interface{}{"type": "number"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{
+				"type":            "string",
+				"contentEncoding": "base64",
+			}
+		}
+		fallthrough
+	case reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchemaType(elemType(t), false),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": jsonSchemaType(elemType(t), false),
+		}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for _, f := range getFields(t) {
+			properties[f.Name] = jsonSchemaType(f.Type, false)
+			if !f.Optional {
+				required = append(required, f.Name)
+			}
+		}
+		result := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(required) > 0 {
+			result["required"] = required
+		}
+		return result
+	default:
+		log.Fatalf("Unsupported type %s", t)
+		return nil
+	}
+}
+
+func writeJsonSchema(w io.Writer, c *collector) error {
+	defs := make(map[string]interface{})
+	for _, name := range c.names {
+		defs[name] = jsonSchemaType(c.types[name], true)
+	}
+
+	var roots []interface{}
+	for _, t := range rootTypes {
+		roots = append(roots, jsonSchemaType(t, false))
+	}
+
+	schema := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "Nextcloud Spreed standalone signaling API",
+		"description": fmt.Sprintf("Generated from nextcloud-spreed-signaling version %s", version),
+		"anyOf":       roots,
+		"$defs":       defs,
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+func typeScriptType(t reflect.Type, root bool, indent string) string {
+	if t.Kind() == reflect.Ptr {
+		elem := typeScriptType(t.Elem(), false, indent)
+		if elem == "any" {
+			return elem
+		}
+		return elem + " | null"
+	}
+
+	if !root && isDefinition(t) {
+		return t.Name()
+	}
+
+	switch {
+	case t == rawMessageType:
+		return "any"
+	case t == timeType:
+		return "string"
+	case isNumber(t.Kind()):
+		return "number"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Interface:
+		return "any"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		fallthrough
+	case reflect.Array:
+		elem := typeScriptType(elemType(t), false, indent)
+		if strings.Contains(elem, " ") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[]"
+	case reflect.Map:
+		return "{ [key: string]: " + typeScriptType(elemType(t), false, indent) + " }"
+	case reflect.Struct:
+		var b strings.Builder
+		b.WriteString("{\n")
+		for _, f := range getFields(t) {
+			ft := f.Type
+			optional := ""
+			if f.Optional {
+				optional = "?"
+				// Optional pointers are omitted instead of being "null".
+				for ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+			}
+			fmt.Fprintf(&b, "%s\t%s%s: %s;\n", indent, typeScriptName(f.Name), optional, typeScriptType(ft, false, indent+"\t"))
+		}
+		b.WriteString(indent + "}")
+		return b.String()
+	default:
+		log.Fatalf("Unsupported type %s", t)
+		return ""
+	}
+}
+
+func typeScriptName(name string) string {
+	for _, r := range name {
+		if !(r == '_' || r == '$' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return fmt.Sprintf("%q", name)
+		}
+	}
+	return name
+}
+
+func writeTypeScript(w io.Writer, c *collector) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by nextcloud-spreed-signaling schema version %s. DO NOT EDIT.\n", version)
+	for _, name := range c.names {
+		t := c.types[name]
+		b.WriteString("\n")
+		if t.Kind() == reflect.Struct {
+			fmt.Fprintf(&b, "export interface %s %s\n", name, typeScriptType(t, true, ""))
+		} else {
+			fmt.Fprintf(&b, "export type %s = %s;\n", name, typeScriptType(t, true, ""))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// generate writes the definitions of the protocol types in the given format.
+func generate(w io.Writer, format string) error {
+	c := newCollector()
+	for _, t := range rootTypes {
+		c.add(t)
+	}
+
+	switch format {
+	case "jsonschema":
+		return writeJsonSchema(w, c)
+	case "typescript":
+		return writeTypeScript(w, c)
+	default:
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nextcloud-spreed-signaling-schema version %s/%s\n", version, runtime.Version())
+		os.Exit(0)
+	}
+
+	switch *formatFlag {
+	case "jsonschema":
+	case "typescript":
+	default:
+		log.Fatalf("Unsupported format: %s", *formatFlag)
+	}
+
+	var w io.Writer = os.Stdout
+	if *outputFlag != "" {
+		f, err := os.Create(*outputFlag)
+		if err != nil {
+			log.Fatalf("Could not create %s: %s", *outputFlag, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := generate(w, *formatFlag); err != nil {
+		log.Fatalf("Could not write %s: %s", *formatFlag, err)
+	}
+}
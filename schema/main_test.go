@@ -0,0 +1,92 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateFlag = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestGenerateGolden(t *testing.T) {
+	for format, filename := range map[string]string{
+		"jsonschema": "signaling.schema.json",
+		"typescript": "signaling.d.ts",
+	} {
+		format, filename := format, filename
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := generate(&b, format); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", filename)
+			if *updateFlag {
+				if err := os.WriteFile(golden, b.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b.Bytes(), expected) {
+				t.Errorf("Output for %s differs from %s, run \"go test ./schema -update\" if the protocol was changed", format, golden)
+			}
+		})
+	}
+}
+
+func TestGenerateJsonSchemaValid(t *testing.T) {
+	var b bytes.Buffer
+	if err := generate(&b, "jsonschema"); err != nil {
+		t.Fatal(err)
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	defs, ok := schema["$defs"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected definitions, got %+v", schema["$defs"])
+	}
+	for _, name := range []string{"ClientMessage", "ServerMessage", "HelloClientMessage"} {
+		if _, found := defs[name]; !found {
+			t.Errorf("Expected definition of %s", name)
+		}
+	}
+}
+
+func TestGenerateUnsupportedFormat(t *testing.T) {
+	var b bytes.Buffer
+	if err := generate(&b, "invalid"); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+}
@@ -0,0 +1,477 @@
+// Code generated by nextcloud-spreed-signaling schema version unreleased. DO NOT EDIT.
+
+export interface ClientMessage {
+	id?: string;
+	type: string;
+	hello?: HelloClientMessage;
+	bye?: ByeClientMessage;
+	room?: RoomClientMessage;
+	message?: MessageClientMessage;
+	control?: ControlClientMessage;
+	internal?: InternalClientMessage;
+	transient?: TransientDataClientMessage;
+	reaction?: ReactionClientMessage;
+	breakout?: BreakoutClientMessage;
+	typing?: TypingClientMessage;
+	participants?: ParticipantsClientMessage;
+	rtpforward?: RtpForwardClientMessage;
+	recording?: RecordingClientMessage;
+	transcription?: TranscriptionClientMessage;
+	"room-key"?: RoomKeyClientMessage;
+	moderation?: ModerationClientMessage;
+	session?: SessionClientMessage;
+	report?: ReportClientMessage;
+	call?: CallClientMessage;
+}
+
+export interface HelloClientMessage {
+	version: string;
+	resumeid: string;
+	features?: string[];
+	versions?: { [key: string]: number };
+	auth: HelloClientMessageAuth;
+}
+
+export interface HelloClientMessageAuth {
+	type?: string;
+	params: any;
+	url: string;
+}
+
+export interface ByeClientMessage {
+}
+
+export interface RoomClientMessage {
+	roomid: string;
+	sessionid?: string;
+	additional?: boolean;
+	leave?: boolean;
+}
+
+export interface MessageClientMessage {
+	recipient: MessageClientMessageRecipient;
+	data: any;
+}
+
+export interface MessageClientMessageRecipient {
+	type: string;
+	sessionid?: string;
+	userid?: string;
+}
+
+export interface ControlClientMessage {
+	recipient: MessageClientMessageRecipient;
+	data: any;
+}
+
+export interface InternalClientMessage {
+	type: string;
+	addsession?: AddSessionInternalClientMessage;
+	updatesession?: UpdateSessionInternalClientMessage;
+	removesession?: RemoveSessionInternalClientMessage;
+	addsessions?: AddSessionsInternalClientMessage;
+	removesessions?: RemoveSessionsInternalClientMessage;
+	eventfilter?: EventFilterInternalClientMessage;
+	recording?: RecordingInternalClientMessage;
+	transcription?: TranscriptionInternalClientMessage;
+}
+
+export interface AddSessionInternalClientMessage {
+	sessionid: string;
+	roomid: string;
+	userid?: string;
+	user?: any;
+	flags?: number;
+	options?: AddSessionOptions;
+}
+
+export interface AddSessionOptions {
+	actorId?: string;
+	actorType?: string;
+}
+
+export interface UpdateSessionInternalClientMessage {
+	sessionid: string;
+	roomid: string;
+	flags?: number;
+}
+
+export interface RemoveSessionInternalClientMessage {
+	sessionid: string;
+	roomid: string;
+	userid?: string;
+}
+
+export interface AddSessionsInternalClientMessage {
+	roomid: string;
+	sessions: AddSessionInternalClientMessage[];
+}
+
+export interface RemoveSessionsInternalClientMessage {
+	roomid: string;
+	sessions: RemoveSessionInternalClientMessage[];
+}
+
+export interface EventFilterInternalClientMessage {
+	rooms?: string[];
+	targets?: string[];
+	types?: string[];
+}
+
+export interface RecordingInternalClientMessage {
+	type: string;
+	roomid?: string;
+	capacity?: number;
+	error?: string;
+}
+
+export interface TranscriptionInternalClientMessage {
+	type: string;
+	roomid?: string;
+	capacity?: number;
+	error?: string;
+	sessionid?: string;
+	text?: string;
+	final?: boolean;
+	language?: string;
+}
+
+export interface TransientDataClientMessage {
+	type: string;
+	key?: string;
+	value?: any;
+}
+
+export interface ReactionClientMessage {
+	type: string;
+	emoji?: string;
+	sessionid?: string;
+}
+
+export interface BreakoutClientMessage {
+	type: string;
+	rooms?: { [key: string]: string[] };
+}
+
+export interface TypingClientMessage {
+	type: string;
+}
+
+export interface ParticipantsClientMessage {
+	type: string;
+	offset?: number;
+	limit?: number;
+}
+
+export interface RtpForwardClientMessage {
+	type: string;
+	sessionid: string;
+	streamtype: string;
+	host?: string;
+	audioport?: number;
+	videoport?: number;
+	streamids?: number[];
+}
+
+export interface RecordingClientMessage {
+	type: string;
+	consent?: boolean;
+}
+
+export interface TranscriptionClientMessage {
+	type: string;
+}
+
+export interface RoomKeyClientMessage {
+	recipient: MessageClientMessageRecipient;
+	data: any;
+}
+
+export interface ModerationClientMessage {
+	type: string;
+	sessionid: string;
+	media?: string;
+}
+
+export interface SessionClientMessage {
+	type: string;
+	metadata?: { [key: string]: any };
+	sessionid?: string;
+}
+
+export interface ReportClientMessage {
+	type: string;
+	stats?: ClientQualityStats;
+}
+
+export interface ClientQualityStats {
+	rtt: number;
+	packetloss: number;
+	width?: number;
+	height?: number;
+}
+
+export interface CallClientMessage {
+	type: string;
+}
+
+export interface ServerMessage {
+	id?: string;
+	type: string;
+	roomid?: string;
+	error?: Error;
+	hello?: HelloServerMessage;
+	bye?: ByeServerMessage;
+	room?: RoomServerMessage;
+	message?: MessageServerMessage;
+	control?: ControlServerMessage;
+	event?: EventServerMessage;
+	transient?: TransientDataServerMessage;
+	reaction?: ReactionServerMessage;
+	breakout?: BreakoutServerMessage;
+	typing?: TypingServerMessage;
+	participants?: ParticipantsServerMessage;
+	rtpforward?: RtpForwardServerMessage;
+	recording?: RecordingServerMessage;
+	transcription?: TranscriptionServerMessage;
+	caption?: CaptionServerMessage;
+	"room-key"?: RoomKeyServerMessage;
+	moderation?: ModerationServerMessage;
+	session?: SessionServerMessage;
+	call?: CallServerMessage;
+}
+
+export interface Error {
+	code: string;
+	message: string;
+	details?: any;
+}
+
+export interface HelloServerMessage {
+	version: string;
+	sessionid: string;
+	resumeid: string;
+	userid: string;
+	server?: HelloServerMessageServer;
+	iceservers?: TurnCredentials;
+	internal?: HelloServerMessageInternal;
+}
+
+export interface HelloServerMessageServer {
+	version: string;
+	features?: string[];
+	country?: string;
+}
+
+export interface TurnCredentials {
+	username: string;
+	password: string;
+	ttl: number;
+	uris: string[];
+	servers?: TurnCredentials[];
+}
+
+export interface HelloServerMessageInternal {
+	versions?: { [key: string]: number };
+	unsupported?: InternalFeatureError[];
+}
+
+export interface InternalFeatureError {
+	feature: string;
+	version: number;
+	minversion: number;
+	maxversion: number;
+}
+
+export interface ByeServerMessage {
+	reason: string;
+}
+
+export interface RoomServerMessage {
+	roomid: string;
+	properties?: any;
+	audiobridge?: boolean;
+}
+
+export interface MessageServerMessage {
+	sender: MessageServerMessageSender | null;
+	recipient?: MessageClientMessageRecipient;
+	data: any;
+	history?: boolean;
+}
+
+export interface MessageServerMessageSender {
+	type: string;
+	sessionid?: string;
+	userid?: string;
+}
+
+export interface ControlServerMessage {
+	sender: MessageServerMessageSender | null;
+	recipient?: MessageClientMessageRecipient;
+	data: any;
+	history?: boolean;
+}
+
+export interface EventServerMessage {
+	target: string;
+	type: string;
+	join?: EventServerMessageSessionEntry[];
+	leave?: string[];
+	change?: EventServerMessageSessionEntry[];
+	invite?: RoomEventServerMessage;
+	disinvite?: RoomDisinviteEventServerMessage;
+	update?: RoomEventServerMessage;
+	flags?: RoomFlagsServerMessage;
+	message?: RoomEventMessage;
+	iceservers?: TurnCredentials;
+	recording?: RoomEventRecordingMessage;
+	transcription?: RoomEventRecordingMessage;
+	speaker?: RoomEventSpeakerMessage;
+	publisher?: RoomEventPublisherMessage;
+}
+
+export interface EventServerMessageSessionEntry {
+	sessionid: string;
+	userid: string;
+	user?: any;
+	roomsessionid?: string;
+}
+
+export interface RoomEventServerMessage {
+	roomid: string;
+	properties?: any;
+	incall?: any;
+	changed?: ({ [key: string]: any })[];
+	users?: ({ [key: string]: any })[];
+	all?: boolean;
+}
+
+export interface RoomDisinviteEventServerMessage {
+	roomid: string;
+	properties?: any;
+	incall?: any;
+	changed?: ({ [key: string]: any })[];
+	users?: ({ [key: string]: any })[];
+	all?: boolean;
+	reason: string;
+}
+
+export interface RoomFlagsServerMessage {
+	roomid: string;
+	sessionid: string;
+	flags: number;
+}
+
+export interface RoomEventMessage {
+	roomid: string;
+	data?: any;
+}
+
+export interface RoomEventRecordingMessage {
+	roomid: string;
+	error?: string;
+}
+
+export interface RoomEventSpeakerMessage {
+	sessionid: string;
+	talking: string[];
+}
+
+export interface RoomEventPublisherMessage {
+	roomid: string;
+	streamtype: string;
+	reason: string;
+}
+
+export interface TransientDataServerMessage {
+	type: string;
+	key?: string;
+	oldvalue?: any;
+	value?: any;
+	data?: { [key: string]: any };
+}
+
+export interface ReactionServerMessage {
+	type: string;
+	raised?: { [key: string]: number };
+	lowered?: string[];
+	emojis?: { [key: string]: number };
+}
+
+export interface BreakoutServerMessage {
+	type: string;
+	roomid: string;
+	rooms?: { [key: string]: string[] };
+}
+
+export interface TypingServerMessage {
+	type: string;
+	sessionid: string;
+}
+
+export interface ParticipantsServerMessage {
+	type: string;
+	roomid: string;
+	count: number;
+	incall?: number;
+	moderators?: EventServerMessageSessionEntry[];
+	offset?: number;
+	sessions?: EventServerMessageSessionEntry[];
+}
+
+export interface RtpForwardServerMessage {
+	type: string;
+	sessionid: string;
+	streamtype: string;
+	streams?: RtpForwardStream[];
+	streamids?: number[];
+}
+
+export interface RtpForwardStream {
+	streamid: number;
+	type: string;
+	host: string;
+	port: number;
+}
+
+export interface RecordingServerMessage {
+	type: string;
+	roomid: string;
+}
+
+export interface TranscriptionServerMessage {
+	type: string;
+	roomid: string;
+}
+
+export interface CaptionServerMessage {
+	roomid: string;
+	sessionid?: string;
+	text: string;
+	final?: boolean;
+	language?: string;
+}
+
+export interface RoomKeyServerMessage {
+	roomid: string;
+	sender: MessageServerMessageSender | null;
+	data: any;
+}
+
+export interface ModerationServerMessage {
+	type: string;
+	actor: string;
+	media?: string;
+}
+
+export interface SessionServerMessage {
+	type: string;
+	sessionid: string;
+	metadata: { [key: string]: any };
+}
+
+export interface CallServerMessage {
+	roomid: string;
+	state: string;
+}
@@ -0,0 +1,564 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/sdp"
+)
+
+const (
+	// Time to wait for errors after the subscriber sent its answer.
+	selfTestSettleTime = time.Second
+)
+
+var (
+	ErrSelfTestSkipped = errors.New("skipped after previous failure")
+)
+
+type SelfTestResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+type SelfTestReport struct {
+	Results []*SelfTestResult
+}
+
+func (r *SelfTestReport) Passed() bool {
+	for _, result := range r.Results {
+		if result.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *SelfTestReport) Print(w io.Writer) {
+	for _, result := range r.Results {
+		switch result.Err {
+		case nil:
+			fmt.Fprintf(w, "PASS  %s (%s)\n", result.Name, result.Duration) // nolint
+		case ErrSelfTestSkipped:
+			fmt.Fprintf(w, "SKIP  %s\n", result.Name) // nolint
+		default:
+			fmt.Fprintf(w, "FAIL  %s (%s): %s\n", result.Name, result.Duration, result.Err) // nolint
+		}
+	}
+	if r.Passed() {
+		fmt.Fprintln(w, "Self test passed") // nolint
+	} else {
+		fmt.Fprintln(w, "Self test failed") // nolint
+	}
+}
+
+type selfTestClient struct {
+	conn      *websocket.Conn
+	publicId  string
+	nextMsgId int
+
+	// Reading is no longer possible after an error (e.g. a timeout).
+	readErr error
+}
+
+func newSelfTestClient(ctx context.Context, url string) (*selfTestClient, error) {
+	dialer := websocket.Dialer{}
+	conn, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &selfTestClient{
+		conn: conn,
+	}, nil
+}
+
+func (c *selfTestClient) Close(ctx context.Context) {
+	if c.publicId != "" {
+		// Make sure the session is removed immediately and not kept for resuming.
+		if err := c.send(&ClientMessage{
+			Type: "bye",
+			Bye:  &ByeClientMessage{},
+		}); err != nil {
+			log.Printf("Could not send bye message: %s", err)
+		} else if c.readErr != nil {
+			// Can't wait for the response.
+		} else if _, err := c.receive(ctx, "bye"); err != nil {
+			log.Printf("Error waiting for bye response: %s", err)
+		}
+	}
+
+	if err := c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+		log.Printf("Could not send close message: %s", err)
+	}
+	c.conn.Close()
+}
+
+func (c *selfTestClient) send(msg *ClientMessage) error {
+	c.nextMsgId++
+	msg.Id = fmt.Sprintf("selftest-%d", c.nextMsgId)
+	return c.conn.WriteJSON(msg)
+}
+
+// receive returns the next message of the given type. Other messages are
+// skipped and errors sent by the server are returned as error.
+func (c *selfTestClient) receive(ctx context.Context, messageType string) (*ServerMessage, error) {
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		var msg ServerMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.readErr = err
+			return nil, err
+		}
+
+		switch msg.Type {
+		case messageType:
+			return &msg, nil
+		case "error":
+			return nil, msg.Error
+		case "bye":
+			return nil, fmt.Errorf("connection closed by server: %+v", msg.Bye)
+		}
+	}
+}
+
+// receiveSignaling returns the payload of the next signaling message of the
+// given type, ignoring other signaling messages like candidates.
+func (c *selfTestClient) receiveSignaling(ctx context.Context, signalingType string) (*AnswerOfferMessage, error) {
+	for {
+		msg, err := c.receive(ctx, "message")
+		if err != nil {
+			return nil, err
+		}
+
+		var data AnswerOfferMessage
+		if err := json.Unmarshal(*msg.Message.Data, &data); err != nil {
+			return nil, err
+		}
+
+		if data.Type == signalingType {
+			return &data, nil
+		}
+	}
+}
+
+func (c *selfTestClient) hello(ctx context.Context, secret []byte, backendUrl string) (*HelloServerMessage, error) {
+	random := newRandomString(48)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(random)) // nolint
+	params, err := json.Marshal(&ClientTypeInternalAuthParams{
+		Random:  random,
+		Token:   hex.EncodeToString(mac.Sum(nil)),
+		Backend: backendUrl,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.send(&ClientMessage{
+		Type: "hello",
+		Hello: &HelloClientMessage{
+			Version: HelloVersion,
+			Auth: HelloClientMessageAuth{
+				Type:   HelloClientTypeInternal,
+				Params: (*json.RawMessage)(&params),
+			},
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.receive(ctx, "hello")
+	if err != nil {
+		return nil, err
+	}
+
+	c.publicId = msg.Hello.SessionId
+	return msg.Hello, nil
+}
+
+func (c *selfTestClient) joinRoom(ctx context.Context, roomId string) error {
+	if err := c.send(&ClientMessage{
+		Type: "room",
+		Room: &RoomClientMessage{
+			RoomId: roomId,
+		},
+	}); err != nil {
+		return err
+	}
+
+	msg, err := c.receive(ctx, "room")
+	if err != nil {
+		return err
+	} else if msg.Room.RoomId != roomId {
+		return fmt.Errorf("joined room %s instead of %s", msg.Room.RoomId, roomId)
+	}
+	return nil
+}
+
+func (c *selfTestClient) sendSignaling(recipient string, data *MessageClientMessageData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return c.send(&ClientMessage{
+		Type: "message",
+		Message: &MessageClientMessage{
+			Recipient: MessageClientMessageRecipient{
+				Type:      RecipientTypeSession,
+				SessionId: recipient,
+			},
+			Data: (*json.RawMessage)(&encoded),
+		},
+	})
+}
+
+func parseSelfTestSdp(msg *AnswerOfferMessage) (*sdp.SessionDescription, error) {
+	sdpText, ok := msg.Payload["sdp"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a sdp: %+v", msg.Type, msg.Payload)
+	}
+
+	var s sdp.SessionDescription
+	if err := s.Unmarshal(sdpText); err != nil {
+		return nil, fmt.Errorf("could not parse sdp of %s: %w", msg.Type, err)
+	}
+	if len(s.MediaDescriptions) == 0 {
+		return nil, fmt.Errorf("%s does not contain any media", msg.Type)
+	}
+	return &s, nil
+}
+
+func newSelfTestFingerprint() (string, error) {
+	var fingerprint [sha256.Size]byte
+	if _, err := rand.Read(fingerprint[:]); err != nil {
+		return "", err
+	}
+
+	parts := make([]string, len(fingerprint))
+	for idx, b := range fingerprint {
+		parts[idx] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// newSelfTestSession creates a session description without any candidates
+// that is just good enough to be negotiated by the MCU.
+func newSelfTestSession() (*sdp.SessionDescription, string, error) {
+	fingerprint, err := newSelfTestFingerprint()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := sdp.NewJSEPSessionDescription(false).
+		WithFingerprint("sha-256", fingerprint)
+	s.SessionName = "selftest"
+	return s, newRandomString(16), nil
+}
+
+func newSelfTestOffer() (string, error) {
+	s, ufrag, err := newSelfTestSession()
+	if err != nil {
+		return "", err
+	}
+
+	pwd := newRandomString(32)
+	s.WithValueAttribute(sdp.AttrKeyGroup, "BUNDLE 0 1").
+		WithMedia(sdp.NewJSEPMediaDescription("audio", nil).
+			WithCodec(111, "opus", 48000, 2, "minptime=10;useinbandfec=1").
+			WithValueAttribute(sdp.AttrKeyMID, "0").
+			WithValueAttribute(sdp.AttrKeyConnectionSetup, "actpass").
+			WithICECredentials(ufrag, pwd).
+			WithPropertyAttribute(sdp.AttrKeyRtcpMux).
+			WithPropertyAttribute("sendonly").
+			WithMediaSource(1001, "selftest", "selftest", "audio")).
+		WithMedia(sdp.NewJSEPMediaDescription("video", nil).
+			WithCodec(96, "VP8", 90000, 0, "").
+			WithValueAttribute(sdp.AttrKeyMID, "1").
+			WithValueAttribute(sdp.AttrKeyConnectionSetup, "actpass").
+			WithICECredentials(ufrag, pwd).
+			WithPropertyAttribute(sdp.AttrKeyRtcpMux).
+			WithPropertyAttribute("sendonly").
+			WithMediaSource(1002, "selftest", "selftest", "video"))
+
+	return s.Marshal(), nil
+}
+
+// newSelfTestAnswer accepts the first format of every media in the given
+// offer for receiving.
+func newSelfTestAnswer(offer *sdp.SessionDescription) (string, error) {
+	s, ufrag, err := newSelfTestSession()
+	if err != nil {
+		return "", err
+	}
+
+	pwd := newRandomString(32)
+	var mids []string
+	for _, md := range offer.MediaDescriptions {
+		answer := sdp.NewJSEPMediaDescription(md.MediaName.Media, nil)
+		answer.MediaName.Protos = md.MediaName.Protos
+		if len(md.MediaName.Formats) == 0 {
+			// Rejected or unsupported media.
+			answer.MediaName.Port = sdp.RangedPort{Value: 0}
+			s.WithMedia(answer)
+			continue
+		}
+
+		format := md.MediaName.Formats[0]
+		answer.MediaName.Formats = []string{format}
+		for _, attr := range md.Attributes {
+			switch attr.Key {
+			case "rtpmap":
+				fallthrough
+			case "fmtp":
+				if strings.HasPrefix(attr.Value, format+" ") {
+					answer.WithValueAttribute(attr.Key, attr.Value)
+				}
+			}
+		}
+		if mid, found := md.Attribute(sdp.AttrKeyMID); found {
+			answer.WithValueAttribute(sdp.AttrKeyMID, mid)
+			mids = append(mids, mid)
+		}
+		answer.WithValueAttribute(sdp.AttrKeyConnectionSetup, "active").
+			WithICECredentials(ufrag, pwd).
+			WithPropertyAttribute(sdp.AttrKeyRtcpMux).
+			WithPropertyAttribute("recvonly")
+		s.WithMedia(answer)
+	}
+	if _, found := offer.Attribute(sdp.AttrKeyGroup); found && len(mids) > 0 {
+		s.WithValueAttribute(sdp.AttrKeyGroup, "BUNDLE "+strings.Join(mids, " "))
+	}
+
+	return s.Marshal(), nil
+}
+
+func (h *Hub) getSelfTestBackendUrl() (string, error) {
+	backends := h.backend.backends
+	hosts := make([]string, 0, len(backends.backends))
+	for host := range backends.backends {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		for _, backend := range backends.backends[host] {
+			if backend.url != "" {
+				return backend.url, nil
+			}
+
+			// Old-style configuration, only hosts are configured.
+			if backend.allowHttp {
+				return "http://" + host + "/", nil
+			}
+			return "https://" + host + "/", nil
+		}
+	}
+
+	if backends.allowAll {
+		return "https://localhost/", nil
+	}
+
+	return "", fmt.Errorf("no backends configured")
+}
+
+// RunSelfTest connects two internal clients to the signaling server running
+// at the given url, publishes synthetic media from one of them through the
+// MCU and subscribes it from the other one.
+func (h *Hub) RunSelfTest(ctx context.Context, url string) *SelfTestReport {
+	report := &SelfTestReport{}
+
+	var publisher *selfTestClient
+	var subscriber *selfTestClient
+	var backendUrl string
+	var offer *sdp.SessionDescription
+	roomId := "selftest-" + newRandomString(16)
+
+	steps := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{"Check configuration", func(ctx context.Context) (err error) {
+			if len(h.internalClientsSecret) == 0 {
+				return fmt.Errorf("no internal secret configured")
+			} else if h.mcu == nil {
+				return fmt.Errorf("no MCU configured")
+			}
+
+			backendUrl, err = h.getSelfTestBackendUrl()
+			return err
+		}},
+		{"Connect clients", func(ctx context.Context) (err error) {
+			if publisher, err = newSelfTestClient(ctx, url); err != nil {
+				return err
+			}
+			subscriber, err = newSelfTestClient(ctx, url)
+			return err
+		}},
+		{"Perform hello", func(ctx context.Context) error {
+			for _, client := range []*selfTestClient{publisher, subscriber} {
+				hello, err := client.hello(ctx, h.internalClientsSecret, backendUrl)
+				if err != nil {
+					return err
+				}
+
+				if hello.Server == nil || !hasFeature(hello.Server, ServerFeatureMcu) {
+					return fmt.Errorf("server does not support feature %s", ServerFeatureMcu)
+				}
+			}
+			return nil
+		}},
+		{"Join room", func(ctx context.Context) error {
+			for _, client := range []*selfTestClient{publisher, subscriber} {
+				if err := client.joinRoom(ctx, roomId); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"Negotiate publisher", func(ctx context.Context) error {
+			sdpOffer, err := newSelfTestOffer()
+			if err != nil {
+				return err
+			}
+
+			if err := publisher.sendSignaling(publisher.publicId, &MessageClientMessageData{
+				Type:     "offer",
+				RoomType: streamTypeVideo,
+				Payload: map[string]interface{}{
+					"type": "offer",
+					"sdp":  sdpOffer,
+				},
+			}); err != nil {
+				return err
+			}
+
+			answer, err := publisher.receiveSignaling(ctx, "answer")
+			if err != nil {
+				return err
+			}
+
+			_, err = parseSelfTestSdp(answer)
+			return err
+		}},
+		{"Request offer for subscriber", func(ctx context.Context) error {
+			if err := subscriber.sendSignaling(publisher.publicId, &MessageClientMessageData{
+				Type:     "requestoffer",
+				RoomType: streamTypeVideo,
+			}); err != nil {
+				return err
+			}
+
+			msg, err := subscriber.receiveSignaling(ctx, "offer")
+			if err != nil {
+				return err
+			} else if msg.From != publisher.publicId {
+				return fmt.Errorf("received offer from %s instead of %s", msg.From, publisher.publicId)
+			}
+
+			offer, err = parseSelfTestSdp(msg)
+			return err
+		}},
+		{"Negotiate subscriber", func(ctx context.Context) error {
+			sdpAnswer, err := newSelfTestAnswer(offer)
+			if err != nil {
+				return err
+			}
+
+			if err := subscriber.sendSignaling(publisher.publicId, &MessageClientMessageData{
+				Type:     "answer",
+				RoomType: streamTypeVideo,
+				Payload: map[string]interface{}{
+					"type": "answer",
+					"sdp":  sdpAnswer,
+				},
+			}); err != nil {
+				return err
+			}
+
+			// The answer is not acknowledged, only errors would be sent.
+			settleCtx, cancel := context.WithTimeout(ctx, selfTestSettleTime)
+			defer cancel()
+			if msg, err := subscriber.receive(settleCtx, "error"); err == nil {
+				return msg.Error
+			} else if e, ok := err.(interface{ Timeout() bool }); !ok || !e.Timeout() {
+				return err
+			}
+			return nil
+		}},
+	}
+
+	var failed bool
+	for _, step := range steps {
+		result := &SelfTestResult{
+			Name: step.name,
+		}
+		report.Results = append(report.Results, result)
+		if failed {
+			result.Err = ErrSelfTestSkipped
+			continue
+		}
+
+		stepCtx, cancel := context.WithTimeout(ctx, h.mcuTimeout)
+		start := time.Now()
+		result.Err = step.run(stepCtx)
+		result.Duration = time.Since(start)
+		cancel()
+		if result.Err != nil {
+			failed = true
+		}
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, h.mcuTimeout)
+	defer cancel()
+	for _, client := range []*selfTestClient{publisher, subscriber} {
+		if client != nil {
+			client.Close(closeCtx)
+		}
+	}
+	return report
+}
@@ -0,0 +1,84 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	mcu, err := NewTestMCU()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mcu.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mcu.Stop()
+
+	hub.SetMcu(mcu)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	report := hub.RunSelfTest(ctx, getWebsocketUrl(server.URL))
+	var output bytes.Buffer
+	report.Print(&output)
+	if !report.Passed() {
+		t.Fatalf("Expected self test to pass, got\n%s", output.String())
+	}
+
+	if publishers := mcu.GetPublishers(); len(publishers) != 1 {
+		t.Errorf("Expected one publisher, got %+v", publishers)
+	}
+	if !strings.HasSuffix(output.String(), "Self test passed\n") {
+		t.Errorf("Unexpected report\n%s", output.String())
+	}
+}
+
+func TestSelfTestNoMcu(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	report := hub.RunSelfTest(ctx, getWebsocketUrl(server.URL))
+	if report.Passed() {
+		t.Fatal("Expected self test to fail")
+	}
+
+	if len(report.Results) < 2 {
+		t.Fatalf("Expected multiple results, got %+v", report.Results)
+	}
+	if err := report.Results[0].Err; err == nil || err == ErrSelfTestSkipped {
+		t.Errorf("Expected first step to fail, got %s", err)
+	}
+	for _, result := range report.Results[1:] {
+		if result.Err != ErrSelfTestSkipped {
+			t.Errorf("Expected step %s to be skipped, got %s", result.Name, result.Err)
+		}
+	}
+}
@@ -22,6 +22,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -54,6 +55,12 @@ var (
 	memprofile = flag.String("memprofile", "", "write memory profile to file")
 
 	showVersion = flag.Bool("version", false, "show version and quit")
+
+	selfTest = flag.Bool("selftest", false, "validate the media path through the configured MCU and quit")
+
+	checkConfig = flag.Bool("check-config", false, "validate the configuration and quit")
+
+	probe = flag.Bool("probe", false, "also check connectivity to backends, etcd and NATS with -check-config")
 )
 
 const (
@@ -64,29 +71,65 @@ const (
 	maxMcuRetry     = time.Second * 16
 )
 
-func createListener(addr string) (net.Listener, error) {
-	if addr[0] == '/' {
-		os.Remove(addr)
-		return net.Listen("unix", addr)
+// createListener creates a listener for the given address. If "proxyProtocol"
+// is true, the addresses of clients are taken from PROXY protocol headers sent
+// by the trusted proxies.
+// getProxyProtocol returns true if PROXY protocol headers should be accepted
+// on the listeners of the given section. Any client could send a header if no
+// trusted proxies are configured, so these are required in that case.
+func getProxyProtocol(config *goconf.ConfigFile, section string, trusted *signaling.TrustedProxies) bool {
+	proxyProtocol, _ := config.GetBool(section, "proxyprotocol")
+	if proxyProtocol && trusted == nil {
+		log.Fatalf("The PROXY protocol is enabled in section \"%s\", need a list of \"trustedproxies\" in section \"app\"", section)
 	}
-
-	return net.Listen("tcp", addr)
+	return proxyProtocol
 }
 
-func createTLSListener(addr string, certFile, keyFile string) (net.Listener, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+func createListener(addr string, proxyProtocol bool, trusted *signaling.TrustedProxies) (net.Listener, error) {
+	listener, err := signaling.Listen(addr)
 	if err != nil {
 		return nil, err
 	}
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
+
+	if proxyProtocol {
+		listener = signaling.NewProxyProtocolListener(listener, trusted)
 	}
-	if addr[0] == '/' {
-		os.Remove(addr)
-		return tls.Listen("unix", addr, &config)
+	return listener, nil
+}
+
+func createTLSListener(addr string, config *tls.Config, proxyProtocol bool, trusted *signaling.TrustedProxies) (net.Listener, error) {
+	// The PROXY protocol header is sent before the TLS handshake.
+	listener, err := createListener(addr, proxyProtocol, trusted)
+	if err != nil {
+		return nil, err
 	}
 
-	return tls.Listen("tcp", addr, &config)
+	return tls.NewListener(listener, config), nil
+}
+
+func runSelfTest(hub *signaling.Hub, r *mux.Router) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal("Could not start listening: ", err)
+	}
+
+	srv := &http.Server{
+		Handler: r,
+
+		ReadTimeout:  defaultReadTimeout * time.Second,
+		WriteTimeout: defaultWriteTimeout * time.Second,
+	}
+	go srv.Serve(listener) // nolint
+	defer srv.Close()
+
+	url := fmt.Sprintf("ws://%s/spreed", listener.Addr())
+	log.Printf("Running self test against %s", url)
+	report := hub.RunSelfTest(context.Background(), url)
+	report.Print(os.Stdout)
+	if !report.Passed() {
+		return 1
+	}
+	return 0
 }
 
 func main() {
@@ -98,6 +141,28 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *checkConfig {
+		config, err := signaling.LoadConfig(*configFlag)
+		if err != nil {
+			log.Fatal("Could not read configuration: ", err)
+		}
+
+		report := signaling.CheckServerConfig(context.Background(), config, *probe)
+		report.Print(os.Stdout)
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	exitCode := 0
+	defer func() {
+		// Registered first so it runs after all other deferred cleanups.
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	signal.Notify(sigChan, syscall.SIGHUP)
@@ -132,7 +197,7 @@ func main() {
 
 	log.Printf("Starting up version %s/%s as pid %d", version, runtime.Version(), os.Getpid())
 
-	config, err := goconf.ReadConfigFile(*configFlag)
+	config, err := signaling.LoadConfig(*configFlag)
 	if err != nil {
 		log.Fatal("Could not read configuration: ", err)
 	}
@@ -143,6 +208,13 @@ func main() {
 
 	signaling.RegisterStats()
 
+	tracing, err := signaling.NewTracing(config, "nextcloud-spreed-signaling", version)
+	if err != nil {
+		log.Fatal("Could not initialize tracing: ", err)
+	} else if tracing != nil {
+		defer tracing.Close()
+	}
+
 	natsUrl, _ := config.GetString("nats", "url")
 	if natsUrl == "" {
 		natsUrl = nats.DefaultURL
@@ -175,16 +247,8 @@ func main() {
 		mcuRetryTimer := time.NewTimer(mcuRetry)
 	mcuTypeLoop:
 		for {
-			switch mcuType {
-			case signaling.McuTypeJanus:
-				mcu, err = signaling.NewMcuJanus(mcuUrl, config)
-				signaling.UnregisterProxyMcuStats()
-				signaling.RegisterJanusMcuStats()
-			case signaling.McuTypeProxy:
-				mcu, err = signaling.NewMcuProxy(config)
-				signaling.UnregisterJanusMcuStats()
-				signaling.RegisterProxyMcuStats()
-			default:
+			mcu, err = signaling.NewMcu(mcuType, mcuUrl, config)
+			if err == signaling.ErrUnsupportedMcuType {
 				log.Fatal("Unsupported MCU type: ", mcuType)
 			}
 			if err == nil {
@@ -195,6 +259,8 @@ func main() {
 			}
 			if err == nil {
 				break
+			} else if *selfTest {
+				log.Fatalf("Could not initialize %s MCU: %s", mcuType, err)
 			}
 
 			log.Printf("Could not initialize %s MCU (%s) will retry in %s", mcuType, err, mcuRetry)
@@ -206,7 +272,7 @@ func main() {
 					log.Fatalf("Cancelled")
 				case syscall.SIGHUP:
 					log.Printf("Received SIGHUP, reloading %s", *configFlag)
-					if config, err = goconf.ReadConfigFile(*configFlag); err != nil {
+					if config, err = signaling.LoadConfig(*configFlag); err != nil {
 						log.Printf("Could not read configuration from %s: %s", *configFlag, err)
 					} else {
 						mcuUrl, _ = config.GetString("mcu", "url")
@@ -248,6 +314,23 @@ func main() {
 		log.Fatal("Could not start backend server: ", err)
 	}
 
+	grpcServer, err := signaling.NewGrpcBackendServer(config, hub)
+	if err != nil {
+		log.Fatal("Could not create GRPC server: ", err)
+	} else if grpcServer != nil {
+		defer grpcServer.Close()
+		go func() {
+			if err := grpcServer.Run(); err != nil {
+				log.Fatal("Could not start GRPC server: ", err)
+			}
+		}()
+	}
+
+	if *selfTest {
+		exitCode = runSelfTest(hub, r)
+		return
+	}
+
 	if debug, _ := config.GetBool("app", "debug"); debug {
 		log.Println("Installing debug handlers in \"/debug/pprof\"")
 		r.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
@@ -261,11 +344,35 @@ func main() {
 		}
 	}
 
+	trustedProxiesValue, _ := config.GetString("app", "trustedproxies")
+	trustedProxies, err := signaling.ParseTrustedProxies(trustedProxiesValue)
+	if err != nil {
+		log.Fatal("Invalid trusted proxies: ", err)
+	}
+
+	acmeManager, err := signaling.NewAcmeManager(config, hub.EtcdClient())
+	if err != nil {
+		log.Fatal("Could not create ACME certificate manager: ", err)
+	}
+
 	if saddr, _ := config.GetString("https", "listen"); saddr != "" {
-		cert, _ := config.GetString("https", "certificate")
-		key, _ := config.GetString("https", "key")
-		if cert == "" || key == "" {
-			log.Fatal("Need a certificate and key for the HTTPS listener")
+		var tlsConfig *tls.Config
+		if acmeManager != nil {
+			tlsConfig = acmeManager.TLSConfig()
+		} else {
+			certFile, _ := config.GetString("https", "certificate")
+			keyFile, _ := config.GetString("https", "key")
+			if certFile == "" || keyFile == "" {
+				log.Fatal("Need a certificate and key for the HTTPS listener")
+			}
+
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				log.Fatal("Could not load certificate: ", err)
+			}
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			}
 		}
 
 		readTimeout, _ := config.GetInt("https", "readtimeout")
@@ -276,10 +383,11 @@ func main() {
 		if writeTimeout <= 0 {
 			writeTimeout = defaultWriteTimeout
 		}
+		proxyProtocol := getProxyProtocol(config, "https", trustedProxies)
 		for _, address := range strings.Split(saddr, " ") {
 			go func(address string) {
 				log.Println("Listening on", address)
-				listener, err := createTLSListener(address, cert, key)
+				listener, err := createTLSListener(address, tlsConfig, proxyProtocol, trustedProxies)
 				if err != nil {
 					log.Fatal("Could not start listening: ", err)
 				}
@@ -296,6 +404,33 @@ func main() {
 		}
 	}
 
+	if maddr, _ := config.GetString("mtls", "listen"); maddr != "" {
+		tlsConfig, err := signaling.NewInternalClientsTLSConfig(config)
+		if err != nil {
+			log.Fatal("Could not create mTLS listener: ", err)
+		}
+
+		proxyProtocol := getProxyProtocol(config, "mtls", trustedProxies)
+		for _, address := range strings.Split(maddr, " ") {
+			go func(address string) {
+				log.Println("Listening for internal clients with certificates on", address)
+				listener, err := createTLSListener(address, tlsConfig, proxyProtocol, trustedProxies)
+				if err != nil {
+					log.Fatal("Could not start listening: ", err)
+				}
+				srv := &http.Server{
+					Handler: r,
+
+					ReadTimeout:  time.Duration(defaultReadTimeout) * time.Second,
+					WriteTimeout: time.Duration(defaultWriteTimeout) * time.Second,
+				}
+				if err := srv.Serve(listener); err != nil {
+					log.Fatal("Could not start server: ", err)
+				}
+			}(address)
+		}
+	}
+
 	if addr, _ := config.GetString("http", "listen"); addr != "" {
 		readTimeout, _ := config.GetInt("http", "readtimeout")
 		if readTimeout <= 0 {
@@ -306,15 +441,22 @@ func main() {
 			writeTimeout = defaultWriteTimeout
 		}
 
+		var handler http.Handler = r
+		if acmeManager != nil {
+			// Answer HTTP-01 challenges of the ACME server.
+			handler = acmeManager.HTTPHandler(r)
+		}
+
+		proxyProtocol := getProxyProtocol(config, "http", trustedProxies)
 		for _, address := range strings.Split(addr, " ") {
 			go func(address string) {
 				log.Println("Listening on", address)
-				listener, err := createListener(address)
+				listener, err := createListener(address, proxyProtocol, trustedProxies)
 				if err != nil {
 					log.Fatal("Could not start listening: ", err)
 				}
 				srv := &http.Server{
-					Handler: r,
+					Handler: handler,
 					Addr:    addr,
 
 					ReadTimeout:  time.Duration(readTimeout) * time.Second,
@@ -335,7 +477,7 @@ loop:
 			break loop
 		case syscall.SIGHUP:
 			log.Printf("Received SIGHUP, reloading %s", *configFlag)
-			if config, err := goconf.ReadConfigFile(*configFlag); err != nil {
+			if config, err := signaling.LoadConfig(*configFlag); err != nil {
 				log.Printf("Could not read configuration from %s: %s", *configFlag, err)
 			} else {
 				hub.Reload(config)
@@ -37,6 +37,7 @@ var (
 	PERMISSION_MAY_CONTROL        Permission = "control"
 	PERMISSION_TRANSIENT_DATA     Permission = "transient-data"
 	PERMISSION_HIDE_DISPLAYNAMES  Permission = "hide-displaynames"
+	PERMISSION_MAY_CHAT           Permission = "chat"
 
 	// DefaultPermissionOverrides contains permission overrides for users where
 	// no permissions have been set by the server. If a permission is not set in
@@ -46,6 +47,52 @@ var (
 	}
 )
 
+const (
+	// Permission bits of participants, must match values in "Attendee.php"
+	// from Nextcloud Talk.
+	ParticipantPermissionPublishAudio  = 16
+	ParticipantPermissionPublishVideo  = 32
+	ParticipantPermissionPublishScreen = 64
+	ParticipantPermissionChat          = 128
+)
+
+var (
+	participantPermissionBits = map[int]Permission{
+		ParticipantPermissionPublishAudio:  PERMISSION_MAY_PUBLISH_AUDIO,
+		ParticipantPermissionPublishVideo:  PERMISSION_MAY_PUBLISH_VIDEO,
+		ParticipantPermissionPublishScreen: PERMISSION_MAY_PUBLISH_SCREEN,
+		ParticipantPermissionChat:          PERMISSION_MAY_CHAT,
+	}
+)
+
+// PermissionsFromBitmap returns the permissions of a Nextcloud Talk
+// participant permissions bitmap.
+func PermissionsFromBitmap(bitmap int) []Permission {
+	var result []Permission
+	for bit, permission := range participantPermissionBits {
+		if bitmap&bit == bit {
+			result = append(result, permission)
+		}
+	}
+	return result
+}
+
+// isBitmapPermission returns true if the permission is defined by the
+// participant permissions bitmap.
+func isBitmapPermission(permission Permission) bool {
+	if permission == PERMISSION_MAY_PUBLISH_MEDIA {
+		// Replaced by the separate audio / video permissions.
+		return true
+	}
+
+	for _, p := range participantPermissionBits {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 type SessionIdData struct {
 	Sid       uint64
 	Created   time.Time
@@ -0,0 +1,111 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	SessionEventHello  = "hello"
+	SessionEventResume = "resume"
+	SessionEventJoin   = "join"
+	SessionEventLeave  = "leave"
+	SessionEventMcu    = "mcu"
+	SessionEventError  = "error"
+	SessionEventKicked = "kicked"
+	SessionEventClosed = "closed"
+
+	// Number of events to keep per session by default.
+	defaultSessionEventsSize = 100
+
+	// Number of closed sessions to keep the events for.
+	closedSessionEventsSize = 1000
+)
+
+type SessionEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+// SessionEvents keeps the last events of a session in a ring buffer. All
+// methods can be called on a nil instance, in which case nothing is stored.
+type SessionEvents struct {
+	mu     sync.Mutex
+	events []SessionEvent
+	next   int
+	full   bool
+}
+
+func NewSessionEvents(size int) *SessionEvents {
+	if size <= 0 {
+		return nil
+	}
+
+	return &SessionEvents{
+		events: make([]SessionEvent, size),
+	}
+}
+
+func (e *SessionEvents) Add(eventType string, format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+
+	event := SessionEvent{
+		Time:    time.Now(),
+		Type:    eventType,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events[e.next] = event
+	e.next++
+	if e.next == len(e.events) {
+		e.next = 0
+		e.full = true
+	}
+}
+
+// Events returns a copy of the stored events, oldest first.
+func (e *SessionEvents) Events() []SessionEvent {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.full {
+		result := make([]SessionEvent, e.next)
+		copy(result, e.events[:e.next])
+		return result
+	}
+
+	result := make([]SessionEvent, 0, len(e.events))
+	result = append(result, e.events[e.next:]...)
+	result = append(result, e.events[:e.next]...)
+	return result
+}
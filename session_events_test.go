@@ -0,0 +1,68 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSessionEvents(t *testing.T) {
+	var nilEvents *SessionEvents
+	nilEvents.Add(SessionEventHello, "ignored")
+	if events := nilEvents.Events(); len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+
+	if events := NewSessionEvents(0); events != nil {
+		t.Errorf("expected no event log for size 0, got %+v", events)
+	}
+
+	events := NewSessionEvents(3)
+	if e := events.Events(); len(e) != 0 {
+		t.Errorf("expected no events, got %+v", e)
+	}
+
+	events.Add(SessionEventHello, "event %d", 1)
+	events.Add(SessionEventJoin, "event %d", 2)
+	if e := events.Events(); len(e) != 2 {
+		t.Errorf("expected 2 events, got %+v", e)
+	} else if e[0].Type != SessionEventHello || e[0].Message != "event 1" || e[1].Type != SessionEventJoin || e[1].Message != "event 2" {
+		t.Errorf("unexpected events %+v", e)
+	}
+
+	for i := 3; i <= 7; i++ {
+		events.Add(SessionEventMcu, "event %d", i)
+	}
+	e := events.Events()
+	if len(e) != 3 {
+		t.Fatalf("expected 3 events, got %+v", e)
+	}
+	for i, event := range e {
+		if expected := fmt.Sprintf("event %d", i+5); event.Message != expected {
+			t.Errorf("expected %s at %d, got %+v", expected, i, event)
+		}
+		if i > 0 && event.Time.Before(e[i-1].Time) {
+			t.Errorf("events are not ordered: %+v", e)
+		}
+	}
+}
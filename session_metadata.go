@@ -0,0 +1,93 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"log"
+)
+
+var (
+	ErrTooManySessionMetadataKeys = NewError("too_many_metadata_keys", "Too many metadata keys.")
+)
+
+func copySessionMetadata(metadata map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+// withSessionMetadata returns a copy of the user entry with the metadata of
+// the session set, the passed entry might be shared with other messages and
+// must not be modified.
+func withSessionMetadata(user map[string]interface{}, metadata map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(user)+1)
+	for k, v := range user {
+		result[k] = v
+	}
+	result["metadata"] = metadata
+	return result
+}
+
+// SetSessionMetadata stores the metadata of a session in the room and
+// notifies the participants.
+func (r *Room) SetSessionMetadata(session Session, metadata map[string]interface{}) bool {
+	sid := session.PublicId()
+	r.mu.Lock()
+	if _, found := r.sessions[sid]; !found {
+		r.mu.Unlock()
+		return false
+	}
+
+	if len(metadata) == 0 {
+		delete(r.sessionMetadata, sid)
+	} else {
+		r.sessionMetadata[sid] = metadata
+	}
+	r.mu.Unlock()
+	r.publishSessionMetadataChanged(sid, metadata)
+	return true
+}
+
+func (r *Room) publishSessionMetadataChanged(sessionId string, metadata map[string]interface{}) {
+	message := &ServerMessage{
+		Type: "event",
+		Event: &EventServerMessage{
+			Target: "participants",
+			Type:   "update",
+			Update: &RoomEventServerMessage{
+				RoomId: r.id,
+				Changed: []map[string]interface{}{
+					{
+						"sessionId": sessionId,
+						"metadata":  metadata,
+					},
+				},
+				Users: r.addInternalSessions(r.getUsers()),
+			},
+		},
+	}
+	if err := r.publish(message); err != nil {
+		log.Printf("Could not publish session metadata message in room %s: %s", r.Id(), err)
+	}
+}
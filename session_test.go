@@ -36,3 +36,36 @@ func assertSessionHasNotPermission(t *testing.T, session Session, permission Per
 		t.Errorf("Session %s has permission %s but shouldn't", session.PublicId(), permission)
 	}
 }
+
+func TestPermissionsFromBitmap(t *testing.T) {
+	testcases := []struct {
+		bitmap   int
+		expected []Permission
+	}{
+		{0, nil},
+		{ParticipantPermissionPublishAudio, []Permission{PERMISSION_MAY_PUBLISH_AUDIO}},
+		{ParticipantPermissionPublishVideo | 1, []Permission{PERMISSION_MAY_PUBLISH_VIDEO}},
+		{ParticipantPermissionPublishScreen | ParticipantPermissionChat, []Permission{PERMISSION_MAY_PUBLISH_SCREEN, PERMISSION_MAY_CHAT}},
+	}
+
+	for _, tc := range testcases {
+		permissions := PermissionsFromBitmap(tc.bitmap)
+		if len(permissions) != len(tc.expected) {
+			t.Errorf("Expected %+v for %d, got %+v", tc.expected, tc.bitmap, permissions)
+			continue
+		}
+
+		for _, p := range tc.expected {
+			found := false
+			for _, permission := range permissions {
+				if permission == p {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("Expected %+v for %d, got %+v", tc.expected, tc.bitmap, permissions)
+			}
+		}
+	}
+}
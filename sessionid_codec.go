@@ -0,0 +1,320 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	SessionIdCipherSecureCookie     = "securecookie"
+	SessionIdCipherAesGcm           = "aes-gcm"
+	SessionIdCipherChaCha20Poly1305 = "chacha20-poly1305"
+
+	// Version of session ids that are encrypted with an AEAD cipher.
+	sessionIdVersion1 = 1
+
+	sessionIdKeyPrefix = "key"
+	maxSessionIdKeyId  = 255
+)
+
+var (
+	ErrInvalidSessionId    = errors.New("invalid session id")
+	ErrUnknownSessionIdKey = errors.New("unknown session id key")
+
+	// Supported AEAD ciphers, indexed by their name.
+	sessionIdCiphers = map[string]func(key []byte) (cipher.AEAD, error){
+		SessionIdCipherAesGcm: func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+
+			return cipher.NewGCM(block)
+		},
+		SessionIdCipherChaCha20Poly1305: chacha20poly1305.New,
+	}
+)
+
+type sessionIdCipher interface {
+	Encode(name string, data *SessionIdData) (string, error)
+	Decode(name string, encoded string) (*SessionIdData, error)
+}
+
+// SessionIdCodec encodes the data of session ids with the configured cipher.
+// Session ids that were encoded with previous keys or the legacy hash / block
+// keys can still be decoded as long as they are configured.
+type SessionIdCodec struct {
+	encoder  sessionIdCipher
+	decoders []sessionIdCipher
+}
+
+type secureCookieSessionIdCipher struct {
+	cookie *securecookie.SecureCookie
+}
+
+func newSecureCookieSessionIdCipher(hashKey string, blockKey string) (*secureCookieSessionIdCipher, error) {
+	switch len(hashKey) {
+	case 32:
+	case 64:
+	default:
+		log.Printf("WARNING: The sessions hash key should be 32 or 64 bytes but is %d bytes", len(hashKey))
+	}
+
+	blockBytes := []byte(blockKey)
+	switch len(blockKey) {
+	case 0:
+		blockBytes = nil
+	case 16:
+	case 24:
+	case 32:
+	default:
+		return nil, fmt.Errorf("the sessions block key must be 16, 24 or 32 bytes but is %d bytes", len(blockKey))
+	}
+
+	return &secureCookieSessionIdCipher{
+		cookie: securecookie.New([]byte(hashKey), blockBytes).MaxAge(0),
+	}, nil
+}
+
+func (c *secureCookieSessionIdCipher) Encode(name string, data *SessionIdData) (string, error) {
+	return c.cookie.Encode(name, data)
+}
+
+func (c *secureCookieSessionIdCipher) Decode(name string, encoded string) (*SessionIdData, error) {
+	var data SessionIdData
+	if err := c.cookie.Decode(name, encoded, &data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// aeadSessionIdCipher encodes session ids as
+// "<version><key id><nonce><encrypted data>" using the key with the highest id
+// for new session ids.
+type aeadSessionIdCipher struct {
+	keyId byte
+	aeads map[byte]cipher.AEAD
+}
+
+func parseSessionIdKeyId(option string) (byte, bool) {
+	if !strings.HasPrefix(option, sessionIdKeyPrefix) {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(option[len(sessionIdKeyPrefix):])
+	if err != nil || id <= 0 || id > maxSessionIdKeyId {
+		return 0, false
+	}
+
+	return byte(id), true
+}
+
+func newAeadSessionIdCipher(config *goconf.ConfigFile, cipherName string) (*aeadSessionIdCipher, error) {
+	newAead, found := sessionIdCiphers[cipherName]
+	if !found {
+		return nil, fmt.Errorf("unsupported session id cipher %s", cipherName)
+	}
+
+	result := &aeadSessionIdCipher{
+		aeads: make(map[byte]cipher.AEAD),
+	}
+	options, _ := config.GetOptions("sessions")
+	for _, option := range options {
+		keyId, ok := parseSessionIdKeyId(option)
+		if !ok {
+			continue
+		}
+
+		key, _ := config.GetString("sessions", option)
+		aead, err := newAead([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid session id key %s: %w", option, err)
+		}
+
+		result.aeads[keyId] = aead
+		if keyId > result.keyId {
+			result.keyId = keyId
+		}
+	}
+
+	if len(result.aeads) == 0 {
+		return nil, fmt.Errorf("no keys configured for session id cipher %s", cipherName)
+	}
+
+	log.Printf("Using session id cipher %s with key %s%d (%d keys configured)", cipherName, sessionIdKeyPrefix, result.keyId, len(result.aeads))
+	return result, nil
+}
+
+func getSessionIdAdditionalData(name string, header []byte) []byte {
+	result := make([]byte, 0, len(header)+len(name))
+	result = append(result, header...)
+	return append(result, name...)
+}
+
+func marshalSessionIdData(data *SessionIdData) []byte {
+	result := make([]byte, 2*binary.MaxVarintLen64+len(data.BackendId))
+	pos := binary.PutUvarint(result, data.Sid)
+	pos += binary.PutVarint(result[pos:], data.Created.UnixNano())
+	pos += copy(result[pos:], data.BackendId)
+	return result[:pos]
+}
+
+func unmarshalSessionIdData(data []byte) (*SessionIdData, error) {
+	sid, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrInvalidSessionId
+	}
+	data = data[n:]
+
+	created, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, ErrInvalidSessionId
+	}
+	data = data[n:]
+
+	return &SessionIdData{
+		Sid:       sid,
+		Created:   time.Unix(0, created),
+		BackendId: string(data),
+	}, nil
+}
+
+func (c *aeadSessionIdCipher) Encode(name string, data *SessionIdData) (string, error) {
+	aead := c.aeads[c.keyId]
+	payload := marshalSessionIdData(data)
+	header := []byte{sessionIdVersion1, c.keyId}
+	nonceSize := aead.NonceSize()
+
+	result := make([]byte, len(header)+nonceSize, len(header)+nonceSize+len(payload)+aead.Overhead())
+	copy(result, header)
+	nonce := result[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	result = aead.Seal(result, nonce, payload, getSessionIdAdditionalData(name, header))
+	return base64.URLEncoding.EncodeToString(result), nil
+}
+
+func (c *aeadSessionIdCipher) Decode(name string, encoded string) (*SessionIdData, error) {
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	} else if len(decoded) < 2 || decoded[0] != sessionIdVersion1 {
+		return nil, ErrInvalidSessionId
+	}
+
+	header := decoded[:2]
+	aead, found := c.aeads[header[1]]
+	if !found {
+		return nil, ErrUnknownSessionIdKey
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(decoded) < len(header)+nonceSize+aead.Overhead() {
+		return nil, ErrInvalidSessionId
+	}
+
+	nonce := decoded[len(header) : len(header)+nonceSize]
+	payload, err := aead.Open(nil, nonce, decoded[len(header)+nonceSize:], getSessionIdAdditionalData(name, header))
+	if err != nil {
+		return nil, ErrInvalidSessionId
+	}
+
+	return unmarshalSessionIdData(payload)
+}
+
+// NewSessionIdCodec creates a codec for session ids from the settings in
+// section "sessions".
+func NewSessionIdCodec(config *goconf.ConfigFile) (*SessionIdCodec, error) {
+	hashKey, _ := config.GetString("sessions", "hashkey")
+	blockKey, _ := config.GetString("sessions", "blockkey")
+	cipherName, _ := config.GetString("sessions", "cipher")
+	if cipherName == "" || cipherName == SessionIdCipherSecureCookie {
+		legacy, err := newSecureCookieSessionIdCipher(hashKey, blockKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SessionIdCodec{
+			encoder:  legacy,
+			decoders: []sessionIdCipher{legacy},
+		}, nil
+	}
+
+	encoder, err := newAeadSessionIdCipher(config, cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SessionIdCodec{
+		encoder:  encoder,
+		decoders: []sessionIdCipher{encoder},
+	}
+	if hashKey != "" {
+		// Session ids created with the hash / block keys can still be used.
+		legacy, err := newSecureCookieSessionIdCipher(hashKey, blockKey)
+		if err != nil {
+			return nil, err
+		}
+
+		result.decoders = append(result.decoders, legacy)
+	}
+	return result, nil
+}
+
+// Encode returns the session id of the given type for the passed data.
+func (c *SessionIdCodec) Encode(name string, data *SessionIdData) (string, error) {
+	return c.encoder.Encode(name, data)
+}
+
+// Decode returns the data of a session id of the given type.
+func (c *SessionIdCodec) Decode(name string, encoded string) (*SessionIdData, error) {
+	var result error
+	for _, decoder := range c.decoders {
+		data, err := decoder.Decode(name, encoded)
+		if err == nil {
+			return data, nil
+		} else if result == nil {
+			// Return the error of the current cipher.
+			result = err
+		}
+	}
+
+	return nil, result
+}
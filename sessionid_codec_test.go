@@ -0,0 +1,190 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func newSessionIdCodecForTest(t *testing.T, options map[string]string) *SessionIdCodec {
+	config := goconf.NewConfigFile()
+	for option, value := range options {
+		config.AddOption("sessions", option, value)
+	}
+	codec, err := NewSessionIdCodec(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+func checkSessionIdData(t *testing.T, expected *SessionIdData, data *SessionIdData) {
+	if data.Sid != expected.Sid {
+		t.Errorf("Expected sid %d, got %d", expected.Sid, data.Sid)
+	}
+	if !data.Created.Equal(expected.Created) {
+		t.Errorf("Expected created %s, got %s", expected.Created, data.Created)
+	}
+	if data.BackendId != expected.BackendId {
+		t.Errorf("Expected backend id %s, got %s", expected.BackendId, data.BackendId)
+	}
+}
+
+func TestSessionIdCodec(t *testing.T) {
+	data := &SessionIdData{
+		Sid:       12345,
+		Created:   time.Now(),
+		BackendId: "the-backend",
+	}
+
+	for _, cipherName := range []string{SessionIdCipherSecureCookie, SessionIdCipherAesGcm, SessionIdCipherChaCha20Poly1305} {
+		t.Run(cipherName, func(t *testing.T) {
+			codec := newSessionIdCodecForTest(t, map[string]string{
+				"hashkey":  "12345678901234567890123456789012",
+				"blockkey": "09876543210987654321098765432109",
+				"cipher":   cipherName,
+				"key1":     "abcdefghijklmnopqrstuvwxyz123456",
+			})
+
+			encoded, err := codec.Encode(privateSessionName, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := codec.Decode(privateSessionName, encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSessionIdData(t, data, decoded)
+
+			if _, err := codec.Decode(publicSessionName, encoded); err == nil {
+				t.Error("Should not be able to decode with a different name")
+			}
+			if _, err := codec.Decode(privateSessionName, encoded[:len(encoded)-8]+"AAAAAAA="); err == nil {
+				t.Error("Should not be able to decode modified session id")
+			}
+		})
+	}
+}
+
+func TestSessionIdCodecRotation(t *testing.T) {
+	data := &SessionIdData{
+		Sid:       12345,
+		Created:   time.Now(),
+		BackendId: "the-backend",
+	}
+
+	legacy := newSessionIdCodecForTest(t, map[string]string{
+		"hashkey":  "12345678901234567890123456789012",
+		"blockkey": "09876543210987654321098765432109",
+	})
+	legacyId, err := legacy.Encode(privateSessionName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codec1 := newSessionIdCodecForTest(t, map[string]string{
+		"hashkey":  "12345678901234567890123456789012",
+		"blockkey": "09876543210987654321098765432109",
+		"cipher":   SessionIdCipherAesGcm,
+		"key1":     "abcdefghijklmnopqrstuvwxyz123456",
+	})
+	if decoded, err := codec1.Decode(privateSessionName, legacyId); err != nil {
+		t.Error(err)
+	} else {
+		checkSessionIdData(t, data, decoded)
+	}
+	id1, err := codec1.Encode(privateSessionName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codec2 := newSessionIdCodecForTest(t, map[string]string{
+		"cipher": SessionIdCipherAesGcm,
+		"key1":   "abcdefghijklmnopqrstuvwxyz123456",
+		"key2":   "654321zyxwvutsrqponmlkjihgfedcba",
+	})
+	if decoded, err := codec2.Decode(privateSessionName, id1); err != nil {
+		t.Error(err)
+	} else {
+		checkSessionIdData(t, data, decoded)
+	}
+	if _, err := codec2.Decode(privateSessionName, legacyId); err == nil {
+		t.Error("Should not be able to decode legacy session id without hash key")
+	}
+	id2, err := codec2.Encode(privateSessionName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := codec1.Decode(privateSessionName, id2); err != ErrUnknownSessionIdKey {
+		t.Errorf("Expected error %s, got %s", ErrUnknownSessionIdKey, err)
+	}
+
+	codec3 := newSessionIdCodecForTest(t, map[string]string{
+		"cipher": SessionIdCipherAesGcm,
+		"key2":   "654321zyxwvutsrqponmlkjihgfedcba",
+	})
+	if decoded, err := codec3.Decode(privateSessionName, id2); err != nil {
+		t.Error(err)
+	} else {
+		checkSessionIdData(t, data, decoded)
+	}
+	if _, err := codec3.Decode(privateSessionName, id1); err != ErrUnknownSessionIdKey {
+		t.Errorf("Expected error %s, got %s", ErrUnknownSessionIdKey, err)
+	}
+}
+
+func TestSessionIdCodecInvalidConfig(t *testing.T) {
+	testcases := []map[string]string{
+		{
+			"blockkey": "invalid",
+		},
+		{
+			"cipher": "unknown",
+			"key1":   "abcdefghijklmnopqrstuvwxyz123456",
+		},
+		{
+			"cipher": SessionIdCipherAesGcm,
+		},
+		{
+			"cipher": SessionIdCipherAesGcm,
+			"key1":   "too-short",
+		},
+		{
+			"cipher": SessionIdCipherChaCha20Poly1305,
+			"key1":   "abcdefghijklmnop",
+		},
+	}
+
+	for idx, options := range testcases {
+		config := goconf.NewConfigFile()
+		for option, value := range options {
+			config.AddOption("sessions", option, value)
+		}
+		if _, err := NewSessionIdCodec(config); err == nil {
+			t.Errorf("Should have failed for #%d: %+v", idx, options)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func checkStatsValue(t *testing.T, collector prometheus.Collector, value float64) {
@@ -74,3 +75,28 @@ func collectAndLint(t *testing.T, collectors ...prometheus.Collector) {
 		}
 	}
 }
+
+// hasStatsSeries returns true if the collector has a series with the given
+// value of a label.
+func hasStatsSeries(t *testing.T, collector prometheus.Collector, label string, value string) bool {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	found := false
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, pair := range m.GetLabel() {
+			if pair.GetName() == label && pair.GetValue() == value {
+				found = true
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,101 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dlintw/goconf"
+)
+
+type subscriberTier struct {
+	participants int
+	subscribers  int
+}
+
+// SubscriberPolicy calculates the maximum number of video streams a session
+// may subscribe depending on the number of participants in the call.
+type SubscriberPolicy struct {
+	// Sorted by number of participants in descending order.
+	tiers []subscriberTier
+}
+
+func parseSubscriberTiers(value string) ([]subscriberTier, error) {
+	var tiers []subscriberTier
+	for _, entry := range strings.Fields(value) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid subscriber tier %s, expected \"participants:subscribers\"", entry)
+		}
+
+		participants, err := strconv.Atoi(parts[0])
+		if err != nil || participants <= 0 {
+			return nil, fmt.Errorf("invalid number of participants in subscriber tier %s", entry)
+		}
+
+		subscribers, err := strconv.Atoi(parts[1])
+		if err != nil || subscribers <= 0 {
+			return nil, fmt.Errorf("invalid number of subscribers in subscriber tier %s", entry)
+		}
+
+		tiers = append(tiers, subscriberTier{
+			participants: participants,
+			subscribers:  subscribers,
+		})
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].participants > tiers[j].participants
+	})
+	return tiers, nil
+}
+
+// NewSubscriberPolicy creates a subscriber policy from the settings in section
+// "mcu". Returns nil if no limits are configured.
+func NewSubscriberPolicy(config *goconf.ConfigFile) (*SubscriberPolicy, error) {
+	value, _ := config.GetString("mcu", "videosubscribertiers")
+	tiers, err := parseSubscriberTiers(value)
+	if err != nil {
+		return nil, err
+	} else if len(tiers) == 0 {
+		return nil, nil
+	}
+
+	return &SubscriberPolicy{
+		tiers: tiers,
+	}, nil
+}
+
+// GetMaxVideoSubscribers returns the maximum number of video streams a session
+// may subscribe in a call with the given number of participants. Returns 0 if
+// the number should not be limited.
+func (p *SubscriberPolicy) GetMaxVideoSubscribers(participants int) int {
+	for _, tier := range p.tiers {
+		if participants >= tier.participants {
+			return tier.subscribers
+		}
+	}
+	return 0
+}
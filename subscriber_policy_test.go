@@ -0,0 +1,79 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestSubscriberPolicy(t *testing.T) {
+	config := goconf.NewConfigFile()
+	if policy, err := NewSubscriberPolicy(config); err != nil {
+		t.Fatal(err)
+	} else if policy != nil {
+		t.Errorf("Expected no policy, got %+v", policy)
+	}
+
+	config.AddOption("mcu", "videosubscribertiers", "50:9 20:16")
+	policy, err := NewSubscriberPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	} else if policy == nil {
+		t.Fatal("Expected a policy")
+	}
+
+	testcases := []struct {
+		participants int
+		expected     int
+	}{
+		{1, 0},
+		{19, 0},
+		{20, 16},
+		{49, 16},
+		{50, 9},
+		{100, 9},
+	}
+	for _, tc := range testcases {
+		if subscribers := policy.GetMaxVideoSubscribers(tc.participants); subscribers != tc.expected {
+			t.Errorf("Expected %d subscribers for %d participants, got %d", tc.expected, tc.participants, subscribers)
+		}
+	}
+}
+
+func TestSubscriberPolicyInvalid(t *testing.T) {
+	for _, tiers := range []string{
+		"10",
+		"10:",
+		"abc:5",
+		"0:5",
+		"10:0",
+		"10:5 20",
+	} {
+		config := goconf.NewConfigFile()
+		config.AddOption("mcu", "videosubscribertiers", tiers)
+		if _, err := NewSubscriberPolicy(config); err == nil {
+			t.Errorf("Expected error for tiers %s", tiers)
+		}
+	}
+}
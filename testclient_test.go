@@ -30,6 +30,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strconv"
@@ -119,6 +120,30 @@ func checkMessageType(message *ServerMessage, expectedType string) error {
 		if message.TransientData == nil {
 			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
 		}
+	case "rtpforward":
+		if message.RtpForward == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "recording":
+		if message.Recording == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "transcription":
+		if message.Transcription == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "caption":
+		if message.Caption == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "room-key":
+		if message.RoomKey == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
+	case "moderation":
+		if message.Moderation == nil {
+			return fmt.Errorf("Expected \"%s\" message, got %+v (%s)", expectedType, message, toJsonString(message))
+		}
 	}
 
 	return nil
@@ -183,6 +208,7 @@ type TestClient struct {
 
 	conn      *websocket.Conn
 	localAddr net.Addr
+	response  *http.Response
 
 	messageChan   chan []byte
 	readErrorChan chan error
@@ -191,8 +217,12 @@ type TestClient struct {
 }
 
 func NewTestClient(t *testing.T, server *httptest.Server, hub *Hub) *TestClient {
+	return NewTestClientWithDialer(t, server, hub, websocket.DefaultDialer)
+}
+
+func NewTestClientWithDialer(t *testing.T, server *httptest.Server, hub *Hub, dialer *websocket.Dialer) *TestClient {
 	// Reference "hub" to prevent compiler error.
-	conn, _, err := websocket.DefaultDialer.Dial(getWebsocketUrl(server.URL), nil)
+	conn, response, err := dialer.Dial(getWebsocketUrl(server.URL), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -222,6 +252,7 @@ func NewTestClient(t *testing.T, server *httptest.Server, hub *Hub) *TestClient
 
 		conn:      conn,
 		localAddr: conn.LocalAddr(),
+		response:  response,
 
 		messageChan:   messageChan,
 		readErrorChan: readErrorChan,
@@ -353,6 +384,10 @@ func (c *TestClient) SendHelloClient(userid string) error {
 }
 
 func (c *TestClient) SendHelloInternal() error {
+	return c.SendHelloInternalWithFeatures(nil)
+}
+
+func (c *TestClient) SendHelloInternalWithFeatures(features []string) error {
 	random := newRandomString(48)
 	mac := hmac.New(sha256.New, testInternalSecret)
 	mac.Write([]byte(random)) // nolint
@@ -364,10 +399,21 @@ func (c *TestClient) SendHelloInternal() error {
 		Token:   token,
 		Backend: backend,
 	}
-	return c.SendHelloParams("", "internal", params)
+	return c.SendHelloParamsWithFeatures("", "internal", params, features)
+}
+
+func (c *TestClient) SendHelloWithFeatures(userid string, features []string) error {
+	params := TestBackendClientAuthParams{
+		UserId: userid,
+	}
+	return c.SendHelloParamsWithFeatures(c.server.URL, "", params, features)
 }
 
 func (c *TestClient) SendHelloParams(url string, clientType string, params interface{}) error {
+	return c.SendHelloParamsWithFeatures(url, clientType, params, nil)
+}
+
+func (c *TestClient) SendHelloParamsWithFeatures(url string, clientType string, params interface{}, features []string) error {
 	data, err := json.Marshal(params)
 	if err != nil {
 		c.t.Fatal(err)
@@ -377,7 +423,8 @@ func (c *TestClient) SendHelloParams(url string, clientType string, params inter
 		Id:   "1234",
 		Type: "hello",
 		Hello: &HelloClientMessage{
-			Version: HelloVersion,
+			Version:  HelloVersion,
+			Features: features,
 			Auth: HelloClientMessageAuth{
 				Type:   clientType,
 				Url:    url,
@@ -444,6 +491,117 @@ func (c *TestClient) RemoveTransientData(key string) error {
 	return c.WriteJSON(message)
 }
 
+func (c *TestClient) SendReaction(reactionType string, emoji string, sessionId string) error {
+	message := &ClientMessage{
+		Id:   "mnop",
+		Type: "reaction",
+		Reaction: &ReactionClientMessage{
+			Type:      reactionType,
+			Emoji:     emoji,
+			SessionId: sessionId,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendTyping(typingType string) error {
+	message := &ClientMessage{
+		Id:   "uvwx",
+		Type: "typing",
+		Typing: &TypingClientMessage{
+			Type: typingType,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendReport(stats *ClientQualityStats) error {
+	message := &ClientMessage{
+		Id:   "report",
+		Type: "report",
+		Report: &ReportClientMessage{
+			Type:  "stats",
+			Stats: stats,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendCall(callType string) error {
+	message := &ClientMessage{
+		Id:   "call",
+		Type: "call",
+		Call: &CallClientMessage{
+			Type: callType,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendRoomKey(recipient MessageClientMessageRecipient, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	message := &ClientMessage{
+		Id:   "efgh",
+		Type: "room-key",
+		RoomKey: &RoomKeyClientMessage{
+			Recipient: recipient,
+			Data:      (*json.RawMessage)(&payload),
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendModeration(moderationType string, sessionId string, media string) error {
+	message := &ClientMessage{
+		Id:   "ijkl",
+		Type: "moderation",
+		Moderation: &ModerationClientMessage{
+			Type:      moderationType,
+			SessionId: sessionId,
+			Media:     media,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendParticipantsGet(offset int, limit int) error {
+	message := &ClientMessage{
+		Id:   "mnop",
+		Type: "participants",
+		Participants: &ParticipantsClientMessage{
+			Type:   "get",
+			Offset: offset,
+			Limit:  limit,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendRtpForward(msg *RtpForwardClientMessage) error {
+	message := &ClientMessage{
+		Id:         "uvwx",
+		Type:       "rtpforward",
+		RtpForward: msg,
+	}
+	return c.WriteJSON(message)
+}
+
+func (c *TestClient) SendBreakout(breakoutType string, rooms map[string][]string) error {
+	message := &ClientMessage{
+		Id:   "qrst",
+		Type: "breakout",
+		Breakout: &BreakoutClientMessage{
+			Type:  breakoutType,
+			Rooms: rooms,
+		},
+	}
+	return c.WriteJSON(message)
+}
+
 func (c *TestClient) DrainMessages(ctx context.Context) error {
 	select {
 	case err := <-c.readErrorChan:
@@ -0,0 +1,543 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Number of failed attempts after which further attempts are rejected.
+	defaultThrottleMaxAttempts = 10
+
+	// Failed attempts older than this are ignored.
+	defaultThrottleWindow = 30 * time.Minute
+
+	// Delay after the first failed attempt, doubles with every attempt.
+	defaultThrottleDelay = 100 * time.Millisecond
+
+	// Maximum delay after a failed attempt.
+	defaultThrottleMaxDelay = 25 * time.Second
+
+	// Interval to remove expired attempts.
+	throttleCleanupInterval = time.Minute
+
+	// NATS subject to share failed attempts between hubs.
+	throttleNatsSubject = "signaling.throttle"
+
+	// Failed authentication with the backend or internal secret.
+	ThrottleActionHello = "hello"
+	// Resume of a session that doesn't exist.
+	ThrottleActionResume = "resume"
+	// Room join that was rejected by the backend.
+	ThrottleActionJoin = "join"
+	// Messages that could not be parsed.
+	ThrottleActionMessage = "message"
+)
+
+var (
+	ErrBruteforceDetected = errors.New("bruteforce detected")
+
+	throttleActions = []string{
+		ThrottleActionHello,
+		ThrottleActionResume,
+		ThrottleActionJoin,
+		ThrottleActionMessage,
+	}
+)
+
+func init() {
+	RegisterThrottleStats()
+}
+
+// ThrottleFunc must be called if an attempt failed. It records the failure
+// and delays the caller depending on the number of previous failures.
+type ThrottleFunc func(ctx context.Context)
+
+type Throttler interface {
+	Close()
+
+	// Reload updates the policies and exemptions from the configuration.
+	Reload(config *goconf.ConfigFile)
+
+	// CheckBruteforce checks if the client performed too many failed attempts
+	// of the given action. Returns ErrBruteforceDetected in this case.
+	CheckBruteforce(ctx context.Context, client string, action string) (ThrottleFunc, error)
+
+	// GetState returns the policies and the clients with failed attempts.
+	GetState() *ThrottleAdminResponse
+}
+
+// ThrottlePolicy controls how failed attempts of an action are throttled.
+type ThrottlePolicy struct {
+	MaxAttempts int
+	Window      time.Duration
+	Delay       time.Duration
+	MaxDelay    time.Duration
+}
+
+func (p *ThrottlePolicy) getDelay(attempts int) time.Duration {
+	if attempts <= 0 {
+		return 0
+	}
+
+	delay := p.Delay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func (p *ThrottlePolicy) filterAttempts(attempts []time.Time, now time.Time) []time.Time {
+	expired := now.Add(-p.Window)
+	idx := 0
+	for idx < len(attempts) && !attempts[idx].After(expired) {
+		idx++
+	}
+	return attempts[idx:]
+}
+
+func newDefaultThrottlePolicy() *ThrottlePolicy {
+	return &ThrottlePolicy{
+		MaxAttempts: defaultThrottleMaxAttempts,
+		Window:      defaultThrottleWindow,
+		Delay:       defaultThrottleDelay,
+		MaxDelay:    defaultThrottleMaxDelay,
+	}
+}
+
+// loadThrottleConfig loads the policies per action and the exempted
+// addresses from the "throttle" section.
+func loadThrottleConfig(config *goconf.ConfigFile) (map[string]*ThrottlePolicy, []*net.IPNet, error) {
+	policies := make(map[string]*ThrottlePolicy)
+	for _, action := range throttleActions {
+		policy := newDefaultThrottlePolicy()
+		if value, err := config.GetInt("throttle", action+"_maxattempts"); err == nil && value > 0 {
+			policy.MaxAttempts = value
+		}
+		if value, err := config.GetInt("throttle", action+"_window"); err == nil && value > 0 {
+			policy.Window = time.Duration(value) * time.Second
+		}
+		if value, err := config.GetInt("throttle", action+"_delay"); err == nil && value >= 0 {
+			policy.Delay = time.Duration(value) * time.Millisecond
+		}
+		if value, err := config.GetInt("throttle", action+"_maxdelay"); err == nil && value >= 0 {
+			policy.MaxDelay = time.Duration(value) * time.Millisecond
+		}
+		if policy.Delay > policy.MaxDelay {
+			return nil, nil, fmt.Errorf("delay %s of action %s is larger than the maximum delay %s", policy.Delay, action, policy.MaxDelay)
+		}
+		policies[action] = policy
+	}
+
+	exemptValue, _ := config.GetString("throttle", "exempt")
+	exempt, err := parseIPNets(exemptValue)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid exempt addresses: %s", err)
+	}
+	return policies, exempt, nil
+}
+
+func NewThrottler(config *goconf.ConfigFile, n NatsClient) (Throttler, error) {
+	throttlerType, _ := config.GetString("throttle", "type")
+	switch throttlerType {
+	case "":
+		fallthrough
+	case "memory":
+		return newMemoryThrottler(config)
+	case "nats":
+		return newNatsThrottler(config, n)
+	case "none":
+		log.Printf("Brute-force protection is disabled")
+		return noopThrottler{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported throttler type %s", throttlerType)
+	}
+}
+
+type noopThrottler struct{}
+
+func (t noopThrottler) Close() {
+}
+
+func (t noopThrottler) Reload(config *goconf.ConfigFile) {
+}
+
+func (t noopThrottler) CheckBruteforce(ctx context.Context, client string, action string) (ThrottleFunc, error) {
+	return func(ctx context.Context) {}, nil
+}
+
+func (t noopThrottler) GetState() *ThrottleAdminResponse {
+	return &ThrottleAdminResponse{
+		Type: "none",
+	}
+}
+
+type throttleKey struct {
+	client string
+	action string
+}
+
+// memoryThrottler keeps track of failed attempts in this process.
+type memoryThrottler struct {
+	throttlerType string
+
+	mu       sync.Mutex
+	policies map[string]*ThrottlePolicy
+	exempt   []*net.IPNet
+	attempts map[throttleKey][]time.Time
+
+	// Can be overwritten in tests.
+	getNow func() time.Time
+	doWait func(ctx context.Context, delay time.Duration)
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemoryThrottler(config *goconf.ConfigFile) (*memoryThrottler, error) {
+	policies, exempt, err := loadThrottleConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &memoryThrottler{
+		throttlerType: "memory",
+
+		policies: policies,
+		exempt:   exempt,
+		attempts: make(map[throttleKey][]time.Time),
+
+		getNow: time.Now,
+		doWait: waitThrottleDelay,
+
+		closeChan: make(chan struct{}),
+	}
+	go t.runCleanup()
+	return t, nil
+}
+
+func waitThrottleDelay(ctx context.Context, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+func (t *memoryThrottler) Close() {
+	t.closeOnce.Do(func() {
+		close(t.closeChan)
+	})
+}
+
+func (t *memoryThrottler) Reload(config *goconf.ConfigFile) {
+	policies, exempt, err := loadThrottleConfig(config)
+	if err != nil {
+		log.Printf("Could not reload throttle configuration, keeping previous: %s", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.policies = policies
+	t.exempt = exempt
+}
+
+func (t *memoryThrottler) runCleanup() {
+	ticker := time.NewTicker(throttleCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closeChan:
+			return
+		case <-ticker.C:
+			t.cleanup(t.getNow())
+		}
+	}
+}
+
+// getPolicy returns the policy of the given action.
+// Note: the mutex must be held.
+func (t *memoryThrottler) getPolicy(action string) *ThrottlePolicy {
+	if policy, found := t.policies[action]; found {
+		return policy
+	}
+
+	return newDefaultThrottlePolicy()
+}
+
+func (t *memoryThrottler) cleanup(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, attempts := range t.attempts {
+		if attempts = t.getPolicy(key.action).filterAttempts(attempts, now); len(attempts) == 0 {
+			delete(t.attempts, key)
+		} else {
+			t.attempts[key] = attempts
+		}
+	}
+}
+
+// getAttempts returns the policy of the action and the number of recent
+// failed attempts.
+func (t *memoryThrottler) getAttempts(key throttleKey, now time.Time) (*ThrottlePolicy, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	policy := t.getPolicy(key.action)
+	attempts := policy.filterAttempts(t.attempts[key], now)
+	if len(attempts) == 0 {
+		delete(t.attempts, key)
+	} else {
+		t.attempts[key] = attempts
+	}
+	return policy, len(attempts)
+}
+
+// addAttempt records a failed attempt and returns the policy of the action
+// and the number of recent failed attempts.
+func (t *memoryThrottler) addAttempt(key throttleKey, when time.Time) (*ThrottlePolicy, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempts := t.attempts[key]
+	// Attempts from other hubs might be received out of order.
+	idx := len(attempts)
+	for idx > 0 && attempts[idx-1].After(when) {
+		idx--
+	}
+	attempts = append(attempts, time.Time{})
+	copy(attempts[idx+1:], attempts[idx:])
+	attempts[idx] = when
+	t.attempts[key] = attempts
+
+	policy := t.getPolicy(key.action)
+	return policy, len(policy.filterAttempts(attempts, t.getNow()))
+}
+
+func (t *memoryThrottler) isExempt(client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return containsIP(t.exempt, client)
+}
+
+func (t *memoryThrottler) newThrottleFunc(key throttleKey, onFailed func(key throttleKey, when time.Time)) ThrottleFunc {
+	return func(ctx context.Context) {
+		now := t.getNow()
+		policy, attempts := t.addAttempt(key, now)
+		if onFailed != nil {
+			onFailed(key, now)
+		}
+
+		delay := policy.getDelay(attempts)
+		log.Printf("Failed attempt %d of %s from %s, delaying by %s", attempts, key.action, key.client, delay)
+		t.doWait(ctx, delay)
+	}
+}
+
+// getThrottleClient returns the host of a client address. Attempts are counted
+// per address and not per connection, so the port must not be part of it.
+func getThrottleClient(client string) string {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
+
+func (t *memoryThrottler) checkBruteforce(ctx context.Context, client string, action string, onFailed func(key throttleKey, when time.Time)) (ThrottleFunc, error) {
+	client = getThrottleClient(client)
+	if t.isExempt(client) {
+		return func(ctx context.Context) {}, nil
+	}
+
+	key := throttleKey{
+		client: client,
+		action: action,
+	}
+	if policy, attempts := t.getAttempts(key, t.getNow()); attempts >= policy.MaxAttempts {
+		log.Printf("Detected brute-force attempt of %s from %s (%d failed attempts)", action, client, attempts)
+		statsThrottleBruteforceTotal.WithLabelValues(action).Inc()
+		t.doWait(ctx, policy.MaxDelay)
+		return nil, ErrBruteforceDetected
+	}
+
+	return t.newThrottleFunc(key, onFailed), nil
+}
+
+func (t *memoryThrottler) CheckBruteforce(ctx context.Context, client string, action string) (ThrottleFunc, error) {
+	return t.checkBruteforce(ctx, client, action, nil)
+}
+
+func (t *memoryThrottler) GetState() *ThrottleAdminResponse {
+	now := t.getNow()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := &ThrottleAdminResponse{
+		Type:     t.throttlerType,
+		Exempt:   make([]string, 0, len(t.exempt)),
+		Policies: make(map[string]*ThrottleAdminPolicy, len(t.policies)),
+		Clients:  make([]*ThrottleAdminClient, 0, len(t.attempts)),
+	}
+	for _, n := range t.exempt {
+		result.Exempt = append(result.Exempt, n.String())
+	}
+	for action, policy := range t.policies {
+		result.Policies[action] = &ThrottleAdminPolicy{
+			MaxAttempts: policy.MaxAttempts,
+			Window:      int(policy.Window / time.Second),
+			Delay:       int(policy.Delay / time.Millisecond),
+			MaxDelay:    int(policy.MaxDelay / time.Millisecond),
+		}
+	}
+	for key, attempts := range t.attempts {
+		policy := t.getPolicy(key.action)
+		if attempts = policy.filterAttempts(attempts, now); len(attempts) == 0 {
+			continue
+		}
+
+		result.Clients = append(result.Clients, &ThrottleAdminClient{
+			Client:      key.client,
+			Action:      key.action,
+			Attempts:    len(attempts),
+			LastAttempt: attempts[len(attempts)-1],
+			Blocked:     len(attempts) >= policy.MaxAttempts,
+		})
+	}
+	sort.Slice(result.Clients, func(i, j int) bool {
+		a := result.Clients[i]
+		b := result.Clients[j]
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Action < b.Action
+	})
+	return result
+}
+
+type ThrottleNatsEvent struct {
+	Sender string    `json:"sender"`
+	Client string    `json:"client"`
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// natsThrottler shares failed attempts with other hubs connected to the same
+// NATS cluster, so clients are throttled on all of them.
+type natsThrottler struct {
+	*memoryThrottler
+
+	id           string
+	nats         NatsClient
+	receiver     chan *nats.Msg
+	subscription NatsSubscription
+}
+
+func newNatsThrottler(config *goconf.ConfigFile, n NatsClient) (*natsThrottler, error) {
+	memory, err := newMemoryThrottler(config)
+	if err != nil {
+		return nil, err
+	}
+	memory.throttlerType = "nats"
+
+	receiver := make(chan *nats.Msg, 64)
+	subscription, err := n.Subscribe(throttleNatsSubject, receiver)
+	if err != nil {
+		memory.Close()
+		return nil, err
+	}
+
+	t := &natsThrottler{
+		memoryThrottler: memory,
+
+		id:           newRandomString(32),
+		nats:         n,
+		receiver:     receiver,
+		subscription: subscription,
+	}
+	go t.run()
+	log.Printf("Sharing failed attempts with other hubs using NATS")
+	return t, nil
+}
+
+func (t *natsThrottler) Close() {
+	if err := t.subscription.Unsubscribe(); err != nil {
+		log.Printf("Error unsubscribing throttle events: %s", err)
+	}
+	t.memoryThrottler.Close()
+}
+
+func (t *natsThrottler) run() {
+	for {
+		select {
+		case <-t.closeChan:
+			return
+		case msg := <-t.receiver:
+			var event ThrottleNatsEvent
+			if err := t.nats.Decode(msg, &event); err != nil {
+				log.Printf("Could not decode throttle event %+v: %s", msg, err)
+				continue
+			} else if event.Sender == t.id {
+				// Already recorded locally.
+				continue
+			}
+
+			t.addAttempt(throttleKey{
+				client: event.Client,
+				action: event.Action,
+			}, event.Time)
+		}
+	}
+}
+
+func (t *natsThrottler) publishFailed(key throttleKey, when time.Time) {
+	event := &ThrottleNatsEvent{
+		Sender: t.id,
+		Client: key.client,
+		Action: key.action,
+		Time:   when,
+	}
+	if err := t.nats.Publish(throttleNatsSubject, event); err != nil {
+		log.Printf("Could not publish failed attempt of %s from %s: %s", key.action, key.client, err)
+	}
+}
+
+func (t *natsThrottler) CheckBruteforce(ctx context.Context, client string, action string) (ThrottleFunc, error) {
+	return t.checkBruteforce(ctx, client, action, t.publishFailed)
+}
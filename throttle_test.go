@@ -0,0 +1,343 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func newMemoryThrottlerForTest(t *testing.T) (*memoryThrottler, *[]time.Duration) {
+	th, err := newMemoryThrottler(goconf.NewConfigFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(th.Close)
+
+	var delays []time.Duration
+	th.doWait = func(ctx context.Context, delay time.Duration) {
+		delays = append(delays, delay)
+	}
+	return th, &delays
+}
+
+func TestThrottleDelay(t *testing.T) {
+	policy := newDefaultThrottlePolicy()
+	expected := map[int]time.Duration{
+		0:   0,
+		1:   100 * time.Millisecond,
+		2:   200 * time.Millisecond,
+		5:   1600 * time.Millisecond,
+		9:   25600 * time.Millisecond,
+		100: defaultThrottleMaxDelay,
+	}
+	for attempts, delay := range expected {
+		if delay > defaultThrottleMaxDelay {
+			delay = defaultThrottleMaxDelay
+		}
+		if d := policy.getDelay(attempts); d != delay {
+			t.Errorf("expected delay %s for %d attempts, got %s", delay, attempts, d)
+		}
+	}
+}
+
+func TestThrottleBruteforce(t *testing.T) {
+	th, delays := newMemoryThrottlerForTest(t)
+	now := time.Now()
+	th.getNow = func() time.Time {
+		return now
+	}
+
+	ctx := context.Background()
+	for i := 0; i < defaultThrottleMaxAttempts; i++ {
+		throttle, err := th.CheckBruteforce(ctx, "192.0.2.1", "action1")
+		if err != nil {
+			t.Fatalf("attempt %d: %s", i+1, err)
+		}
+		throttle(ctx)
+		now = now.Add(time.Second)
+	}
+
+	if len(*delays) != defaultThrottleMaxAttempts {
+		t.Fatalf("expected %d delays, got %+v", defaultThrottleMaxAttempts, *delays)
+	}
+	for i, delay := range *delays {
+		if expected := newDefaultThrottlePolicy().getDelay(i + 1); delay != expected {
+			t.Errorf("expected delay %s for attempt %d, got %s", expected, i+1, delay)
+		}
+	}
+
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", "action1"); err != ErrBruteforceDetected {
+		t.Errorf("expected bruteforce to be detected, got %v", err)
+	}
+
+	// Other clients and actions are not affected.
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.2", "action1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", "action2"); err != nil {
+		t.Error(err)
+	}
+
+	// Old attempts expire.
+	now = now.Add(defaultThrottleWindow - defaultThrottleMaxAttempts*time.Second + 2*time.Second)
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", "action1"); err != nil {
+		t.Errorf("expected expired attempts to be ignored, got %s", err)
+	}
+
+	now = now.Add(defaultThrottleWindow)
+	th.cleanup(now)
+	th.mu.Lock()
+	count := len(th.attempts)
+	th.mu.Unlock()
+	if count != 0 {
+		t.Errorf("expected all attempts to be removed, got %d", count)
+	}
+}
+
+func TestThrottleBruteforceIgnoresPort(t *testing.T) {
+	th, _ := newMemoryThrottlerForTest(t)
+
+	// Each connection uses a different source port.
+	ctx := context.Background()
+	for i := 0; i < defaultThrottleMaxAttempts; i++ {
+		throttle, err := th.CheckBruteforce(ctx, fmt.Sprintf("192.0.2.1:%d", 40000+i), "action1")
+		if err != nil {
+			t.Fatalf("attempt %d: %s", i+1, err)
+		}
+		throttle(ctx)
+	}
+
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1:50000", "action1"); err != ErrBruteforceDetected {
+		t.Errorf("expected bruteforce to be detected, got %v", err)
+	}
+	if _, err := th.CheckBruteforce(ctx, "[2001:db8::1]:50000", "action1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThrottleNats(t *testing.T) {
+	n, err := NewLoopbackNatsClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	config := goconf.NewConfigFile()
+	config.AddOption("throttle", "type", "nats")
+	throttler1, err := NewThrottler(config, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer throttler1.Close()
+	throttler2, err := NewThrottler(config, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer throttler2.Close()
+
+	th1 := throttler1.(*natsThrottler)
+	th1.doWait = func(ctx context.Context, delay time.Duration) {}
+	th2 := throttler2.(*natsThrottler)
+	th2.doWait = func(ctx context.Context, delay time.Duration) {}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// Failed attempts on one hub are counted on all hubs.
+	for i := 0; i < defaultThrottleMaxAttempts; i++ {
+		throttle, err := th1.CheckBruteforce(ctx, "192.0.2.1", "action")
+		if err != nil {
+			t.Fatalf("attempt %d: %s", i+1, err)
+		}
+		throttle(ctx)
+	}
+
+	key := throttleKey{
+		client: "192.0.2.1",
+		action: "action",
+	}
+	getAttempts := func(th *natsThrottler) int {
+		_, attempts := th.getAttempts(key, time.Now())
+		return attempts
+	}
+	for getAttempts(th2) < defaultThrottleMaxAttempts {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("failed attempts were not shared, got %d", getAttempts(th2))
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if _, err := th2.CheckBruteforce(ctx, "192.0.2.1", "action"); err != ErrBruteforceDetected {
+		t.Errorf("expected bruteforce to be detected on other hub, got %v", err)
+	}
+	// Events from the own hub are not counted twice.
+	if attempts := getAttempts(th1); attempts != defaultThrottleMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", defaultThrottleMaxAttempts, attempts)
+	}
+}
+
+func TestThrottlerConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("throttle", "type", "invalid")
+	if _, err := NewThrottler(config, nil); err == nil {
+		t.Error("expected error for invalid throttler type")
+	}
+
+	config.AddOption("throttle", "type", "none")
+	throttler, err := NewThrottler(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer throttler.Close()
+
+	ctx := context.Background()
+	for i := 0; i < defaultThrottleMaxAttempts*2; i++ {
+		throttle, err := throttler.CheckBruteforce(ctx, "192.0.2.1", "action")
+		if err != nil {
+			t.Fatal(err)
+		}
+		throttle(ctx)
+	}
+}
+
+func TestThrottlePolicyConfig(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("throttle", "join_maxattempts", "3")
+	config.AddOption("throttle", "join_window", "60")
+	config.AddOption("throttle", "join_delay", "500")
+	config.AddOption("throttle", "join_maxdelay", "1000")
+	th, err := newMemoryThrottler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer th.Close()
+
+	var delays []time.Duration
+	th.doWait = func(ctx context.Context, delay time.Duration) {
+		delays = append(delays, delay)
+	}
+	now := time.Now()
+	th.getNow = func() time.Time {
+		return now
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		throttle, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionJoin)
+		if err != nil {
+			t.Fatalf("attempt %d: %s", i+1, err)
+		}
+		throttle(ctx)
+	}
+	expected := []time.Duration{500 * time.Millisecond, time.Second, time.Second}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("expected delays %+v, got %+v", expected, delays)
+	}
+
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionJoin); err != ErrBruteforceDetected {
+		t.Errorf("expected bruteforce to be detected, got %v", err)
+	}
+	if delay := delays[len(delays)-1]; delay != time.Second {
+		t.Errorf("expected blocked client to be delayed by the maximum delay, got %s", delay)
+	}
+	// Other actions use the default policy.
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionHello); err != nil {
+		t.Error(err)
+	}
+
+	now = now.Add(time.Minute + time.Second)
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionJoin); err != nil {
+		t.Errorf("expected attempts to expire after the window, got %s", err)
+	}
+
+	config.AddOption("throttle", "hello_delay", "2000")
+	config.AddOption("throttle", "hello_maxdelay", "1000")
+	if _, err := newMemoryThrottler(config); err == nil {
+		t.Error("expected error if the delay is larger than the maximum delay")
+	}
+}
+
+func TestThrottleExempt(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("throttle", "exempt", "127.0.0.1, 192.168.0.0/24")
+	th, err := newMemoryThrottler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer th.Close()
+	th.doWait = func(ctx context.Context, delay time.Duration) {}
+
+	ctx := context.Background()
+	for _, client := range []string{"127.0.0.1", "192.168.0.10", "192.0.2.1"} {
+		for i := 0; i < defaultThrottleMaxAttempts; i++ {
+			throttle, err := th.CheckBruteforce(ctx, client, ThrottleActionHello)
+			if err != nil {
+				t.Fatalf("attempt %d from %s: %s", i+1, client, err)
+			}
+			throttle(ctx)
+		}
+	}
+
+	for _, client := range []string{"127.0.0.1", "192.168.0.10"} {
+		if _, err := th.CheckBruteforce(ctx, client, ThrottleActionHello); err != nil {
+			t.Errorf("expected %s to be exempted, got %s", client, err)
+		}
+	}
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionHello); err != ErrBruteforceDetected {
+		t.Errorf("expected bruteforce to be detected, got %v", err)
+	}
+
+	state := th.GetState()
+	if expected := []string{"127.0.0.1/32", "192.168.0.0/24"}; !reflect.DeepEqual(state.Exempt, expected) {
+		t.Errorf("expected exempt %+v, got %+v", expected, state.Exempt)
+	}
+	if len(state.Clients) != 1 {
+		t.Fatalf("expected one throttled client, got %+v", state.Clients)
+	} else if client := state.Clients[0]; client.Client != "192.0.2.1" || client.Action != ThrottleActionHello || client.Attempts != defaultThrottleMaxAttempts || !client.Blocked {
+		t.Errorf("unexpected client state %+v", client)
+	}
+
+	// Exemptions can be changed when reloading.
+	config.RemoveOption("throttle", "exempt")
+	config.AddOption("throttle", "exempt", "192.0.2.0/24")
+	config.AddOption("throttle", "hello_maxattempts", "20")
+	th.Reload(config)
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionHello); err != nil {
+		t.Errorf("expected client to be exempted after reload, got %s", err)
+	}
+	if policy := th.GetState().Policies[ThrottleActionHello]; policy == nil || policy.MaxAttempts != 20 {
+		t.Errorf("expected policy to be reloaded, got %+v", policy)
+	}
+
+	config.AddOption("throttle", "exempt", "invalid")
+	th.Reload(config)
+	if _, err := th.CheckBruteforce(ctx, "192.0.2.1", ThrottleActionHello); err != nil {
+		t.Errorf("expected previous exemptions to be kept for invalid configuration, got %s", err)
+	}
+}
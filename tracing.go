@@ -0,0 +1,155 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TracingProtocolGrpc = "grpc"
+	TracingProtocolHttp = "http"
+
+	tracerName = "github.com/strukturag/nextcloud-spreed-signaling"
+
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+var (
+	// The global tracer forwards to the provider configured in NewTracing,
+	// spans are not recorded if tracing is disabled.
+	tracer = otel.Tracer(tracerName)
+)
+
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+}
+
+// NewTracing configures the OpenTelemetry exporter from the "[tracing]"
+// section. Returns nil if no endpoint is configured.
+func NewTracing(config *goconf.ConfigFile, serviceName string, version string) (*Tracing, error) {
+	endpoint, _ := config.GetString("tracing", "endpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	insecure, _ := config.GetBool("tracing", "insecure")
+	protocol, _ := config.GetString("tracing", "protocol")
+	protocol = strings.ToLower(protocol)
+	if protocol == "" {
+		protocol = TracingProtocolGrpc
+	}
+
+	var driver otlp.ProtocolDriver
+	switch protocol {
+	case TracingProtocolGrpc:
+		options := []otlpgrpc.Option{
+			otlpgrpc.WithEndpoint(endpoint),
+		}
+		if insecure {
+			options = append(options, otlpgrpc.WithInsecure())
+		}
+		driver = otlpgrpc.NewDriver(options...)
+	case TracingProtocolHttp:
+		options := []otlphttp.Option{
+			otlphttp.WithEndpoint(endpoint),
+		}
+		if insecure {
+			options = append(options, otlphttp.WithInsecure())
+		}
+		driver = otlphttp.NewDriver(options...)
+	default:
+		return nil, fmt.Errorf("unsupported tracing protocol %s", protocol)
+	}
+
+	samplerate := 1.0
+	if value, _ := config.GetString("tracing", "samplerate"); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid tracing sample rate %s", value)
+		}
+		samplerate = rate
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+
+	exporter, err := otlp.NewExporter(ctx, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplerate))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	log.Printf("Exporting traces to %s using %s (sample rate %.2f)", endpoint, protocol, samplerate)
+	return &Tracing{
+		provider: provider,
+	}, nil
+}
+
+// Close flushes pending spans and stops the exporter.
+func (t *Tracing) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down tracing: %s", err)
+	}
+}
+
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,68 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestTracing_Disabled(t *testing.T) {
+	config := goconf.NewConfigFile()
+	tracing, err := NewTracing(config, "test", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	} else if tracing != nil {
+		t.Errorf("tracing should be disabled without endpoint, got %+v", tracing)
+	}
+}
+
+func TestTracing_InvalidConfig(t *testing.T) {
+	testcases := []map[string]string{
+		{
+			"protocol": "invalid",
+		},
+		{
+			"samplerate": "abc",
+		},
+		{
+			"samplerate": "-0.5",
+		},
+		{
+			"samplerate": "1.5",
+		},
+	}
+
+	for _, tc := range testcases {
+		config := goconf.NewConfigFile()
+		config.AddOption("tracing", "endpoint", "127.0.0.1:4317")
+		for k, v := range tc {
+			config.AddOption("tracing", k, v)
+		}
+
+		if tracing, err := NewTracing(config, "test", "1.0"); err == nil {
+			tracing.Close()
+			t.Errorf("expected error for %+v", tc)
+		}
+	}
+}
@@ -51,6 +51,7 @@ func (t *TransientData) notifySet(key string, prev, value interface{}) {
 			Value:    value,
 		},
 	}
+	msg.Prepare()
 	for listener := range t.listeners {
 		listener.SendMessage(msg)
 	}
@@ -65,6 +66,7 @@ func (t *TransientData) notifyDeleted(key string, prev interface{}) {
 			OldValue: prev,
 		},
 	}
+	msg.Prepare()
 	for listener := range t.listeners {
 		listener.SendMessage(msg)
 	}
@@ -0,0 +1,331 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	defaultTurnTTL = 24 * time.Hour
+)
+
+var (
+	ErrNoTurnServers = errors.New("no TURN servers configured")
+)
+
+// turnServerGroup is a list of TURN / STUN servers that share a secret.
+type turnServerGroup struct {
+	name    string
+	secret  []byte
+	ttl     time.Duration
+	servers []string
+	// Country and continent codes the group should be used for. The group is
+	// used for all clients if this is empty.
+	regions map[string]bool
+}
+
+func splitTurnList(value string) []string {
+	var result []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func getTurnTTL(config *goconf.ConfigFile, section string, defaultTTL time.Duration) time.Duration {
+	if seconds, _ := config.GetInt(section, "ttl"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultTTL
+}
+
+func loadTurnServerGroup(config *goconf.ConfigFile, section string, defaultTTL time.Duration) (*turnServerGroup, error) {
+	serversValue, _ := config.GetString(section, "servers")
+	servers := splitTurnList(serversValue)
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	secret, _ := config.GetString(section, "secret")
+	if secret == "" {
+		return nil, fmt.Errorf("need a shared TURN secret for the servers in section %s", section)
+	}
+
+	var regions map[string]bool
+	regionsValue, _ := config.GetString(section, "regions")
+	for _, region := range splitTurnList(regionsValue) {
+		region = strings.ToUpper(region)
+		if _, found := ContinentMap[region]; !found && !IsValidContinent(region) {
+			log.Printf("Ignore unknown region %s for TURN servers in section %s", region, section)
+			continue
+		}
+
+		if regions == nil {
+			regions = make(map[string]bool)
+		}
+		regions[region] = true
+	}
+
+	return &turnServerGroup{
+		name:    section,
+		secret:  []byte(secret),
+		ttl:     getTurnTTL(config, section, defaultTTL),
+		servers: servers,
+		regions: regions,
+	}, nil
+}
+
+// loadTurnServerGroups returns the TURN servers configured in the "turn"
+// section and the sections listed in its "groups" option.
+func loadTurnServerGroups(config *goconf.ConfigFile) ([]*turnServerGroup, error) {
+	defaultTTL := getTurnTTL(config, "turn", defaultTurnTTL)
+
+	var groups []*turnServerGroup
+	group, err := loadTurnServerGroup(config, "turn", defaultTTL)
+	if err != nil {
+		return nil, err
+	} else if group != nil {
+		groups = append(groups, group)
+	}
+
+	groupIds, _ := config.GetString("turn", "groups")
+	for _, id := range splitTurnList(groupIds) {
+		if !config.HasSection(id) {
+			return nil, fmt.Errorf("section %s for TURN servers is missing", id)
+		}
+
+		group, err := loadTurnServerGroup(config, id, defaultTTL)
+		if err != nil {
+			return nil, err
+		} else if group == nil {
+			log.Printf("No TURN servers configured in section %s, skipping", id)
+			continue
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func (g *turnServerGroup) matchesRegion(country string) bool {
+	if g.regions[country] {
+		return true
+	}
+
+	for _, continent := range LookupContinents(country) {
+		if g.regions[continent] {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTurnServerGroups returns the groups to use for a client in the given
+// country. These are the groups without regions and the groups of the region
+// of the client. All groups are returned if none of them match.
+func selectTurnServerGroups(groups []*turnServerGroup, country string) []*turnServerGroup {
+	var result []*turnServerGroup
+	for _, group := range groups {
+		if len(group.regions) == 0 || group.matchesRegion(country) {
+			result = append(result, group)
+		}
+	}
+	if len(result) == 0 {
+		return groups
+	}
+
+	return result
+}
+
+func calculateTurnSecret(username string, secret []byte, valid time.Duration) (string, string) {
+	expires := time.Now().Add(valid)
+	username = fmt.Sprintf("%d:%s", expires.Unix(), username)
+	m := hmac.New(sha1.New, secret)
+	m.Write([]byte(username)) // nolint
+	password := base64.StdEncoding.EncodeToString(m.Sum(nil))
+	return username, password
+}
+
+func (g *turnServerGroup) getCredentials(username string) TurnCredentials {
+	username, password := calculateTurnSecret(username, g.secret, g.ttl)
+	return TurnCredentials{
+		Username: username,
+		Password: password,
+		TTL:      int64(g.ttl.Seconds()),
+		URIs:     g.servers,
+	}
+}
+
+// TurnServers contains the TURN servers that are returned through the TURN
+// REST API and to clients that support receiving ICE servers.
+type TurnServers struct {
+	mu      sync.RWMutex
+	groups  []*turnServerGroup
+	webhook *turnCredentialsWebhook
+
+	onChanged atomic.Value
+}
+
+func emptyOnTurnServersChanged() {}
+
+func NewTurnServers(config *goconf.ConfigFile) (*TurnServers, error) {
+	t := &TurnServers{}
+	t.onChanged.Store(emptyOnTurnServersChanged)
+	if _, err := t.load(config); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *TurnServers) load(config *goconf.ConfigFile) (bool, error) {
+	groups, err := loadTurnServerGroups(config)
+	if err != nil {
+		return false, err
+	}
+
+	webhook, err := newTurnCredentialsWebhook(config)
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := !reflect.DeepEqual(groups, t.groups)
+	if changed {
+		for _, group := range groups {
+			for _, s := range group.servers {
+				log.Printf("Adding \"%s\" as TURN server from %s (valid for %s)", s, group.name, group.ttl)
+			}
+		}
+		t.groups = groups
+	}
+
+	if webhook != nil && t.webhook != nil && webhook.equal(t.webhook) {
+		// Keep the existing webhook to preserve cached credentials.
+		return changed, nil
+	}
+
+	if webhook != nil {
+		log.Printf("Requesting TURN credentials from %s", webhook.url)
+		webhook.onRotated = t.notifyChanged
+	}
+	changed = changed || webhook != nil || t.webhook != nil
+	t.webhook = webhook
+	return changed, nil
+}
+
+// Reload updates the TURN servers from the given configuration. Returns true
+// if the servers have changed.
+func (t *TurnServers) Reload(config *goconf.ConfigFile) bool {
+	changed, err := t.load(config)
+	if err != nil {
+		log.Printf("Could not reload TURN servers, keeping previous: %s", err)
+		return false
+	}
+
+	return changed
+}
+
+// SetOnChanged sets a function that is called if the credentials of the TURN
+// servers were rotated by the webhook.
+func (t *TurnServers) SetOnChanged(f func()) {
+	if f == nil {
+		f = emptyOnTurnServersChanged
+	}
+
+	t.onChanged.Store(f)
+}
+
+func (t *TurnServers) notifyChanged() {
+	f := t.onChanged.Load().(func())
+	f()
+}
+
+// IsEnabled returns true if TURN servers or a webhook are configured.
+func (t *TurnServers) IsEnabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.groups) > 0 || t.webhook != nil
+}
+
+// GetCredentials returns TURN credentials for a client from the given
+// country. Credentials from the webhook are preferred, the configured
+// servers are used as fallback if the webhook fails.
+func (t *TurnServers) GetCredentials(ctx context.Context, username string, country string) (*TurnCredentials, error) {
+	t.mu.RLock()
+	groups := t.groups
+	webhook := t.webhook
+	t.mu.RUnlock()
+
+	if webhook != nil {
+		credentials, err := webhook.GetCredentials(ctx)
+		if err == nil {
+			return credentials, nil
+		} else if len(groups) == 0 {
+			return nil, err
+		}
+
+		log.Printf("Could not request TURN credentials from webhook, using configured servers: %s", err)
+	}
+
+	if len(groups) == 0 {
+		return nil, ErrNoTurnServers
+	}
+
+	if username == "" {
+		// Make sure to include an actual username in the credentials.
+		username = newRandomString(randomUsernameLength)
+	}
+
+	if len(groups) > 1 {
+		groups = selectTurnServerGroups(groups, country)
+	}
+
+	// The first group is returned in the format of the draft for clients
+	// that only support a single list of servers.
+	credentials := groups[0].getCredentials(username)
+	if len(groups) > 1 {
+		for _, group := range groups {
+			credentials.Servers = append(credentials.Servers, group.getCredentials(username))
+		}
+	}
+	return &credentials, nil
+}
@@ -0,0 +1,124 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func TestLoadTurnServerGroups(t *testing.T) {
+	config := goconf.NewConfigFile()
+	config.AddOption("turn", "secret", "the-secret")
+	config.AddOption("turn", "servers", "turn:1.2.3.4:9991?transport=udp, stun:1.2.3.4:9991")
+	config.AddOption("turn", "ttl", "3600")
+	config.AddOption("turn", "groups", "turn-eu, turn-us, turn-empty")
+	config.AddOption("turn-eu", "secret", "eu-secret")
+	config.AddOption("turn-eu", "servers", "turn:eu.domain.invalid:3478")
+	config.AddOption("turn-eu", "regions", "eu, us, XX")
+	config.AddOption("turn-eu", "ttl", "60")
+	config.AddOption("turn-us", "secret", "us-secret")
+	config.AddOption("turn-us", "servers", "turn:us.domain.invalid:3478")
+	config.AddOption("turn-us", "regions", "NA")
+	config.AddOption("turn-empty", "secret", "empty-secret")
+
+	groups, err := loadTurnServerGroups(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, got %+v", groups)
+	}
+
+	if groups[0].name != "turn" || len(groups[0].servers) != 2 || groups[0].ttl != time.Hour || len(groups[0].regions) != 0 {
+		t.Errorf("Unexpected default group %+v", groups[0])
+	}
+	if groups[1].name != "turn-eu" || string(groups[1].secret) != "eu-secret" || groups[1].ttl != time.Minute {
+		t.Errorf("Unexpected group %+v", groups[1])
+	} else if len(groups[1].regions) != 2 || !groups[1].regions["EU"] || !groups[1].regions["US"] {
+		t.Errorf("Unexpected regions %+v", groups[1].regions)
+	}
+	if groups[2].name != "turn-us" || groups[2].ttl != time.Hour {
+		t.Errorf("Unexpected group %+v", groups[2])
+	}
+
+	config.AddOption("turn-us", "secret", "")
+	if _, err := loadTurnServerGroups(config); err == nil {
+		t.Error("Should have failed for missing secret")
+	}
+
+	config.AddOption("turn", "groups", "turn-unknown")
+	if _, err := loadTurnServerGroups(config); err == nil {
+		t.Error("Should have failed for unknown section")
+	}
+}
+
+func TestSelectTurnServerGroups(t *testing.T) {
+	global := &turnServerGroup{
+		name: "global",
+	}
+	eu := &turnServerGroup{
+		name: "eu",
+		regions: map[string]bool{
+			"EU": true,
+		},
+	}
+	us := &turnServerGroup{
+		name: "us",
+		regions: map[string]bool{
+			"US": true,
+			"CA": true,
+		},
+	}
+
+	getNames := func(groups []*turnServerGroup) string {
+		var result string
+		for _, g := range groups {
+			if result != "" {
+				result += ","
+			}
+			result += g.name
+		}
+		return result
+	}
+
+	testcases := []struct {
+		groups   []*turnServerGroup
+		country  string
+		expected string
+	}{
+		{[]*turnServerGroup{global, eu, us}, "DE", "global,eu"},
+		{[]*turnServerGroup{global, eu, us}, "US", "global,us"},
+		{[]*turnServerGroup{global, eu, us}, "JP", "global"},
+		{[]*turnServerGroup{global, eu, us}, loopback, "global"},
+		{[]*turnServerGroup{eu, us}, "CA", "us"},
+		{[]*turnServerGroup{eu, us}, "JP", "eu,us"},
+		{[]*turnServerGroup{eu, us}, unknownCountry, "eu,us"},
+	}
+	for _, tc := range testcases {
+		if names := getNames(selectTurnServerGroups(tc.groups, tc.country)); names != tc.expected {
+			t.Errorf("Expected %s for %s, got %s", tc.expected, tc.country, names)
+		}
+	}
+}
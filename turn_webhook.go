@@ -0,0 +1,167 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+const (
+	defaultTurnWebhookTimeout = 5 * time.Second
+
+	// Maximum size of responses from the TURN credentials webhook.
+	maxTurnWebhookResponseSize = 64 * 1024
+)
+
+// turnCredentialsWebhook requests TURN credentials from an external service
+// that implements the TURN REST API (e.g. a cloud TURN provider). Responses
+// are cached for half of their TTL.
+type turnCredentialsWebhook struct {
+	url    string
+	token  string
+	client *http.Client
+
+	// Called if the webhook returned different credentials than before.
+	onRotated func()
+
+	mu      sync.Mutex
+	cached  *TurnCredentials
+	refresh time.Time
+	expires time.Time
+}
+
+func newTurnCredentialsWebhook(config *goconf.ConfigFile) (*turnCredentialsWebhook, error) {
+	webhookUrl, _ := config.GetString("turn", "webhookurl")
+	if webhookUrl == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(webhookUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TURN webhook url %s: %w", webhookUrl, err)
+	} else if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported scheme %s for TURN webhook url %s", u.Scheme, webhookUrl)
+	} else if u.Scheme == "http" {
+		log.Printf("WARNING: TURN credentials are requested from %s without encryption", u.Host)
+	}
+
+	timeout := defaultTurnWebhookTimeout
+	if seconds, _ := config.GetInt("turn", "webhooktimeout"); seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	token, _ := config.GetString("turn", "webhooktoken")
+
+	return &turnCredentialsWebhook{
+		url:   webhookUrl,
+		token: token,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+func isSameTurnCredentials(a *TurnCredentials, b *TurnCredentials) bool {
+	return a.Username == b.Username && a.Password == b.Password && reflect.DeepEqual(a.URIs, b.URIs)
+}
+
+func (w *turnCredentialsWebhook) equal(other *turnCredentialsWebhook) bool {
+	return w.url == other.url && w.token == other.token && w.client.Timeout == other.client.Timeout
+}
+
+// GetCredentials returns the cached credentials or requests new ones if they
+// are about to expire. The TTL is adjusted to the remaining validity.
+func (w *turnCredentialsWebhook) GetCredentials(ctx context.Context) (*TurnCredentials, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if w.cached == nil || !now.Before(w.refresh) {
+		credentials, err := w.requestCredentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if w.cached != nil && w.onRotated != nil && !isSameTurnCredentials(credentials, w.cached) {
+			go w.onRotated()
+		}
+
+		ttl := time.Duration(credentials.TTL) * time.Second
+		w.cached = credentials
+		w.refresh = now.Add(ttl / 2)
+		w.expires = now.Add(ttl)
+	}
+
+	result := *w.cached
+	result.TTL = int64(w.expires.Sub(now).Seconds())
+	return &result, nil
+}
+
+func (w *turnCredentialsWebhook) requestCredentials(ctx context.Context) (*TurnCredentials, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", w.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Accept", "application/json")
+	if w.token != "" {
+		request.Header.Set("Authorization", "Bearer "+w.token)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from TURN webhook", response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxTurnWebhookResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials TurnCredentials
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		return nil, fmt.Errorf("could not decode response from TURN webhook: %w", err)
+	}
+
+	if credentials.Username == "" || credentials.Password == "" || len(credentials.URIs) == 0 {
+		return nil, fmt.Errorf("incomplete credentials received from TURN webhook")
+	} else if credentials.TTL <= 0 {
+		return nil, fmt.Errorf("invalid TTL %d received from TURN webhook", credentials.TTL)
+	}
+
+	return &credentials, nil
+}
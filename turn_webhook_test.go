@@ -0,0 +1,125 @@
+/**
+ * Standalone signaling server for the Nextcloud Spreed app.
+ * Copyright (C) 2022 struktur AG
+ *
+ * @author Joachim Bauch <bauch@struktur.de>
+ *
+ * @license GNU AGPL version 3 or any later version
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dlintw/goconf"
+)
+
+func newTurnWebhookServerForTest(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTurnCredentialsWebhook(t *testing.T) {
+	var requests int32
+	server := newTurnWebhookServerForTest(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if auth := r.Header.Get("Authorization"); auth != "Bearer the-token" {
+			t.Errorf("Expected bearer token, got %s", auth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&TurnCredentials{ // nolint
+			Username: "the-username",
+			Password: "the-password",
+			TTL:      3600,
+			URIs:     []string{"turn:provider.domain.invalid:3478"},
+		})
+	})
+
+	config := goconf.NewConfigFile()
+	config.AddOption("turn", "webhookurl", server.URL)
+	config.AddOption("turn", "webhooktoken", "the-token")
+	webhook, err := newTurnCredentialsWebhook(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		credentials, err := webhook.GetCredentials(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if credentials.Username != "the-username" || credentials.Password != "the-password" {
+			t.Errorf("Unexpected credentials %+v", credentials)
+		}
+		if credentials.TTL <= 3590 || credentials.TTL > 3600 {
+			t.Errorf("Unexpected TTL %d", credentials.TTL)
+		}
+		if !reflect.DeepEqual(credentials.URIs, []string{"turn:provider.domain.invalid:3478"}) {
+			t.Errorf("Unexpected servers %+v", credentials.URIs)
+		}
+	}
+
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Errorf("Expected one request, got %d", count)
+	}
+}
+
+func TestTurnCredentialsWebhook_Errors(t *testing.T) {
+	responses := []string{
+		"",
+		"invalid-json",
+		`{"username":"the-username","password":"the-password","ttl":3600}`,
+		`{"username":"the-username","password":"the-password","uris":["turn:1.2.3.4:3478"]}`,
+	}
+	for _, response := range responses {
+		server := newTurnWebhookServerForTest(t, func(w http.ResponseWriter, r *http.Request) {
+			if response == "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(response)) // nolint
+		})
+
+		config := goconf.NewConfigFile()
+		config.AddOption("turn", "webhookurl", server.URL)
+		webhook, err := newTurnCredentialsWebhook(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if credentials, err := webhook.GetCredentials(context.Background()); err == nil {
+			t.Errorf("Expected error for response %s, got %+v", response, credentials)
+		}
+	}
+
+	config := goconf.NewConfigFile()
+	config.AddOption("turn", "webhookurl", "ftp://provider.domain.invalid")
+	if _, err := newTurnCredentialsWebhook(config); err == nil {
+		t.Error("Should have failed for unsupported scheme")
+	}
+}
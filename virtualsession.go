@@ -148,6 +148,12 @@ func (s *VirtualSession) notifyBackendRemoved(room *Room, session *ClientSession
 	ctx, cancel := context.WithTimeout(context.Background(), s.hub.backendTimeout)
 	defer cancel()
 
+	performJSONRequest := s.hub.backend.PerformJSONRequest
+	if message == nil {
+		// Nobody is waiting for the result, retry later if the request failed.
+		performJSONRequest = s.hub.backendQueue.PerformJSONRequest
+	}
+
 	if options := s.Options(); options != nil {
 		request := NewBackendClientRoomRequest(room.Id(), s.UserId(), s.PublicId())
 		request.Room.Action = "leave"
@@ -157,7 +163,7 @@ func (s *VirtualSession) notifyBackendRemoved(room *Room, session *ClientSession
 		}
 
 		var response BackendClientResponse
-		if err := s.hub.backend.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
+		if err := performJSONRequest(ctx, s.ParsedBackendUrl(), request, &response); err != nil {
 			virtualSessionId := GetVirtualSessionId(s.session, s.PublicId())
 			log.Printf("Could not leave virtual session %s at backend %s: %s", virtualSessionId, s.BackendUrl(), err)
 			if session != nil && message != nil {
@@ -179,7 +185,7 @@ func (s *VirtualSession) notifyBackendRemoved(room *Room, session *ClientSession
 	} else {
 		request := NewBackendClientSessionRequest(room.Id(), "remove", s.PublicId(), nil)
 		var response BackendClientSessionResponse
-		err := s.hub.backend.PerformJSONRequest(ctx, s.ParsedBackendUrl(), request, &response)
+		err := performJSONRequest(ctx, s.ParsedBackendUrl(), request, &response)
 		if err != nil {
 			log.Printf("Could not remove virtual session %s from backend %s: %s", s.PublicId(), s.BackendUrl(), err)
 			if session != nil && message != nil {
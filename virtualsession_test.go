@@ -25,6 +25,7 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 )
 
 func TestVirtualSession(t *testing.T) {
@@ -453,6 +454,256 @@ func TestVirtualSessionCleanup(t *testing.T) {
 	}
 }
 
+func TestVirtualSessionDeadPeer(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+	hub.internalPingPeriod = 50 * time.Millisecond
+	hub.internalPongWait = 200 * time.Millisecond
+
+	roomId := "the-room-id"
+	emptyProperties := json.RawMessage("{}")
+	backend := &Backend{
+		id:     "compat",
+		compat: true,
+	}
+	room, err := hub.createRoom(roomId, &emptyProperties, backend)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	defer room.Close()
+
+	clientInternal := NewTestClient(t, server, hub)
+	defer clientInternal.CloseWithBye()
+	// Simulate a crashed internal client that no longer responds to pings.
+	clientInternal.conn.SetPingHandler(func(string) error {
+		return nil
+	})
+	if err := clientInternal.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	helloInternal, err := clientInternal.RunUntilHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	msgAdd := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "addsession",
+			AddSession: &AddSessionInternalClientMessage{
+				CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+					SessionId: "session1",
+					RoomId:    roomId,
+				},
+				UserId: "user1",
+			},
+		},
+	}
+	if err := clientInternal.WriteJSON(msgAdd); err != nil {
+		t.Fatal(err)
+	}
+
+	msg1, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.checkMessageJoinedSession(msg1, "", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	sessionId := msg1.Event.Join[0].SessionId
+
+	// The virtual session is removed once the internal client is detected as
+	// dead, without waiting for the session to expire.
+	for {
+		msg, err := client.RunUntilMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type == "event" && msg.Event.Target == "room" && msg.Event.Type == "leave" {
+			if err := client.checkMessageRoomLeaveSession(msg, sessionId); err != nil {
+				t.Error(err)
+			}
+			break
+		}
+	}
+
+	if err := clientInternal.WaitForSessionRemoved(ctx, helloInternal.Hello.SessionId); err != nil {
+		t.Error(err)
+	}
+
+	hub.mu.Lock()
+	virtualSessions := len(hub.virtualSessions)
+	hub.mu.Unlock()
+	if virtualSessions != 0 {
+		t.Errorf("Expected no virtual sessions, got %d", virtualSessions)
+	}
+}
+
+func TestVirtualSessionBulk(t *testing.T) {
+	hub, _, _, server := CreateHubForTest(t)
+
+	roomId := "the-room-id"
+	emptyProperties := json.RawMessage("{}")
+	backend := &Backend{
+		id:     "compat",
+		compat: true,
+	}
+	room, err := hub.createRoom(roomId, &emptyProperties, backend)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	defer room.Close()
+
+	clientInternal := NewTestClient(t, server, hub)
+	defer clientInternal.CloseWithBye()
+	if err := clientInternal.SendHelloInternal(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(t, server, hub)
+	defer client.CloseWithBye()
+	if err := client.SendHello(testDefaultUserId); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := clientInternal.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.RunUntilHello(ctx); err != nil {
+		t.Error(err)
+	}
+
+	if room, err := client.JoinRoom(ctx, roomId); err != nil {
+		t.Fatal(err)
+	} else if room.Room.RoomId != roomId {
+		t.Fatalf("Expected room %s, got %s", roomId, room.Room.RoomId)
+	}
+
+	// Ignore "join" events.
+	if err := client.DrainMessages(ctx); err != nil {
+		t.Error(err)
+	}
+
+	internalSessionIds := []string{"session1", "session2", "session3"}
+	msgAdd := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "addsessions",
+			AddSessions: &AddSessionsInternalClientMessage{
+				RoomId: roomId,
+			},
+		},
+	}
+	for _, sid := range internalSessionIds {
+		msgAdd.Internal.AddSessions.Sessions = append(msgAdd.Internal.AddSessions.Sessions, &AddSessionInternalClientMessage{
+			CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+				SessionId: sid,
+			},
+			UserId: "user-" + sid,
+		})
+	}
+	if err := clientInternal.WriteJSON(msgAdd); err != nil {
+		t.Fatal(err)
+	}
+
+	// All sessions are notified in one event.
+	msg1, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg1, "event"); err != nil {
+		t.Fatal(err)
+	} else if msg1.Event.Target != "room" || msg1.Event.Type != "join" {
+		t.Fatalf("Expected join event, got %+v", msg1.Event)
+	} else if len(msg1.Event.Join) != len(internalSessionIds) {
+		t.Fatalf("Expected %d joined sessions, got %+v", len(internalSessionIds), msg1.Event.Join)
+	}
+
+	var sessionIds []string
+	for _, entry := range msg1.Event.Join {
+		session := hub.GetSessionByPublicId(entry.SessionId)
+		if session == nil {
+			t.Fatalf("Could not get virtual session %s", entry.SessionId)
+		} else if session.ClientType() != HelloClientTypeVirtual {
+			t.Errorf("Expected client type %s, got %s", HelloClientTypeVirtual, session.ClientType())
+		}
+		sessionIds = append(sessionIds, entry.SessionId)
+	}
+
+	msg2, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updateMsg, err := checkMessageParticipantsInCall(msg2); err != nil {
+		t.Error(err)
+	} else if len(updateMsg.Users) != len(internalSessionIds) {
+		t.Errorf("Expected %d users, got %+v", len(internalSessionIds), updateMsg.Users)
+	}
+
+	msgRemove := &ClientMessage{
+		Type: "internal",
+		Internal: &InternalClientMessage{
+			Type: "removesessions",
+			RemoveSessions: &RemoveSessionsInternalClientMessage{
+				RoomId: roomId,
+			},
+		},
+	}
+	for _, sid := range internalSessionIds {
+		msgRemove.Internal.RemoveSessions.Sessions = append(msgRemove.Internal.RemoveSessions.Sessions, &RemoveSessionInternalClientMessage{
+			CommonSessionInternalClientMessage: CommonSessionInternalClientMessage{
+				SessionId: sid,
+			},
+		})
+	}
+	if err := clientInternal.WriteJSON(msgRemove); err != nil {
+		t.Fatal(err)
+	}
+
+	msg3, err := client.RunUntilMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := checkMessageType(msg3, "event"); err != nil {
+		t.Fatal(err)
+	} else if msg3.Event.Target != "room" || msg3.Event.Type != "leave" {
+		t.Fatalf("Expected leave event, got %+v", msg3.Event)
+	} else if len(msg3.Event.Leave) != len(sessionIds) {
+		t.Fatalf("Expected %d left sessions, got %+v", len(sessionIds), msg3.Event.Leave)
+	}
+
+	for _, sid := range sessionIds {
+		if session := hub.GetSessionByPublicId(sid); session != nil {
+			t.Errorf("Virtual session %s should have been removed", sid)
+		}
+	}
+}
+
 func TestVirtualSessionFlags(t *testing.T) {
 	s := &VirtualSession{
 		publicId: "dummy-for-testing",